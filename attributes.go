@@ -1,10 +1,16 @@
 package irma
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -34,9 +40,10 @@ type metadataField struct {
 
 // metadataAttribute represents a metadata attribute. Contains the credential type, signing date, validity, and the public key counter.
 type MetadataAttribute struct {
-	Int  *big.Int
-	pk   *gabi.PublicKey
-	Conf *Configuration
+	Int    *big.Int
+	pk     *gabi.PublicKey
+	Conf   *Configuration
+	cached *metadataCacheEntry
 }
 
 // AttributeList contains attributes, excluding the secret key,
@@ -175,7 +182,7 @@ func MetadataFromInt(i *big.Int, conf *Configuration) *MetadataAttribute {
 // 0 as keycounter
 // ValidityDefault (half a year) as default validity.
 func NewMetadataAttribute(version byte) *MetadataAttribute {
-	val := MetadataAttribute{new(big.Int), nil, nil}
+	val := MetadataAttribute{Int: new(big.Int)}
 	val.setField(versionField, []byte{version})
 	val.setSigningDate()
 	val.setKeyCounter(0)
@@ -195,13 +202,28 @@ func (attr *MetadataAttribute) Bytes() []byte {
 // PublicKey extracts identifier of the Idemix public key with which this instance was signed,
 // and returns this public key.
 func (attr *MetadataAttribute) PublicKey() (*gabi.PublicKey, error) {
-	if attr.pk == nil {
-		var err error
-		attr.pk, err = attr.Conf.PublicKey(attr.CredentialType().IssuerIdentifier(), attr.KeyCounter())
-		if err != nil {
-			return nil, err
+	return attr.publicKey(context.Background())
+}
+
+// publicKey is like PublicKey, but aborts fetching the public key when the context is done.
+func (attr *MetadataAttribute) publicKey(ctx context.Context) (*gabi.PublicKey, error) {
+	if attr.pk != nil {
+		return attr.pk, nil
+	}
+	entry := attr.cacheEntry()
+	if entry != nil {
+		if attr.pk = entry.publicKey(); attr.pk != nil {
+			return attr.pk, nil
 		}
 	}
+	var err error
+	attr.pk, err = attr.Conf.PublicKeyContext(ctx, attr.CredentialType().IssuerIdentifier(), attr.KeyCounter())
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && attr.pk != nil {
+		entry.setPublicKey(attr.pk)
+	}
 	return attr.pk, nil
 }
 
@@ -259,6 +281,9 @@ func (attr *MetadataAttribute) setExpiryDate(timestamp *Timestamp) error {
 // CredentialType returns the credential type of the current instance
 // using the Configuration.
 func (attr *MetadataAttribute) CredentialType() *CredentialType {
+	if entry := attr.cacheEntry(); entry != nil {
+		return entry.credtype
+	}
 	return attr.Conf.hashToCredentialType(attr.field(credentialID))
 }
 
@@ -268,7 +293,7 @@ func (attr *MetadataAttribute) setCredentialTypeIdentifier(id string) {
 }
 
 func (attr *MetadataAttribute) CredentialTypeHash() []byte {
-	return attr.field(credentialID)
+	return append([]byte(nil), attr.field(credentialID)...)
 }
 
 // Expiry returns the expiry date of this instance
@@ -287,6 +312,132 @@ func (attr *MetadataAttribute) IsValid() bool {
 	return attr.IsValidOn(time.Now())
 }
 
+// MetadataFields contains the decoded fields of a metadata attribute, for inspecting metadata attributes
+// (e.g. when debugging verification failures) and for constructing them with arbitrary values.
+type MetadataFields struct {
+	Version            byte                      `json:"version"`
+	SigningDate        Timestamp                 `json:"signingDate"`
+	ValidityDuration   int                       `json:"validityDuration"` // in epochs of ExpiryFactor seconds
+	Expiry             Timestamp                 `json:"expiry"`
+	KeyCounter         int                       `json:"keyCounter"`
+	CredentialTypeHash []byte                    `json:"credentialTypeHash"`
+	CredentialTypeID   *CredentialTypeIdentifier `json:"credentialType,omitempty"` // nil if not known to the Configuration
+}
+
+// Supported metadata versions; see also GetMetadataVersion().
+const (
+	MetadataVersion2 byte = 0x02
+	MetadataVersion3 byte = 0x03 // supports absent optional attributes
+)
+
+var (
+	ErrorMalformedMetadata             = errors.New("Malformed metadata attribute")
+	ErrorUnsupportedMetadataVersion    = errors.New("Unsupported metadata version")
+	ErrorUnknownMetadataCredentialType = errors.New("Unknown credential type")
+)
+
+// MetadataError is returned when a metadata attribute cannot be decoded, or refers to a credential
+// type or public key that is unknown. Its message describes the fields of the metadata attribute.
+type MetadataError struct {
+	Err      error           // e.g. ErrorUnknownMetadataCredentialType or ErrorMissingPublicKey
+	Metadata *MetadataFields // nil if the metadata attribute is malformed
+}
+
+func (e *MetadataError) Error() string {
+	if e.Metadata == nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s (metadata attribute: %s)", e.Err.Error(), e.Metadata.String())
+}
+
+// String returns a human-readable description of the metadata fields, e.g.
+// "credential type irma-demo.RU.studentCard, signed 2016-02-01, expires 2017-02-01, key counter 2, version 3".
+func (f *MetadataFields) String() string {
+	credtype := "unknown credential type " + base64.StdEncoding.EncodeToString(f.CredentialTypeHash)
+	if f.CredentialTypeID != nil {
+		credtype = "credential type " + f.CredentialTypeID.String()
+	}
+	return fmt.Sprintf("%s, signed %s, expires %s, key counter %d, version %d",
+		credtype,
+		time.Time(f.SigningDate).UTC().Format(AttributeDateFormat),
+		time.Time(f.Expiry).UTC().Format(AttributeDateFormat),
+		f.KeyCounter,
+		f.Version,
+	)
+}
+
+// Fields returns the decoded fields of this metadata attribute. The credential type identifier
+// is only included if the metadata attribute has a Configuration that knows the credential type.
+func (attr *MetadataAttribute) Fields() *MetadataFields {
+	fields := &MetadataFields{
+		Version:            attr.Version(),
+		SigningDate:        Timestamp(attr.SigningDate()),
+		ValidityDuration:   attr.ValidityDuration(),
+		Expiry:             Timestamp(attr.Expiry()),
+		KeyCounter:         attr.KeyCounter(),
+		CredentialTypeHash: attr.CredentialTypeHash(),
+	}
+	if attr.Conf != nil {
+		if credtype := attr.CredentialType(); credtype != nil {
+			id := credtype.Identifier()
+			fields.CredentialTypeID = &id
+		}
+	}
+	return fields
+}
+
+// NewMetadataAttributeFromFields constructs a metadata attribute containing the specified fields,
+// e.g. for tests. The credential type is set from CredentialTypeID if present and from
+// CredentialTypeHash otherwise, and Expiry is ignored in favour of ValidityDuration.
+// The signing date is floored to an epoch boundary.
+func NewMetadataAttributeFromFields(fields *MetadataFields, conf *Configuration) (*MetadataAttribute, error) {
+	if fields.Version == 0 {
+		return nil, errors.New("Metadata version cannot be 0")
+	}
+	signing := time.Time(fields.SigningDate).Unix() / ExpiryFactor
+	if signing < 0 || signing > math.MaxUint16 {
+		return nil, errors.Errorf("Signing date %s cannot be encoded in a metadata attribute", time.Time(fields.SigningDate))
+	}
+	if fields.ValidityDuration < 0 || fields.ValidityDuration > math.MaxUint16 {
+		return nil, errors.Errorf("Validity duration %d cannot be encoded in a metadata attribute", fields.ValidityDuration)
+	}
+	if fields.KeyCounter < 0 || fields.KeyCounter > math.MaxUint16 {
+		return nil, errors.Errorf("Key counter %d cannot be encoded in a metadata attribute", fields.KeyCounter)
+	}
+	if fields.CredentialTypeID == nil && len(fields.CredentialTypeHash) != credentialID.length {
+		return nil, errors.Errorf("Credential type hash must have length %d", credentialID.length)
+	}
+
+	attr := &MetadataAttribute{Int: new(big.Int), Conf: conf}
+	attr.setField(versionField, []byte{fields.Version})
+	attr.setField(signingDateField, shortToByte(int(signing)))
+	attr.setValidityDuration(fields.ValidityDuration)
+	attr.setKeyCounter(fields.KeyCounter)
+	if fields.CredentialTypeID != nil {
+		attr.setCredentialTypeIdentifier(fields.CredentialTypeID.String())
+	} else {
+		attr.setField(credentialID, fields.CredentialTypeHash)
+	}
+	return attr, nil
+}
+
+// DecodeMetadata decodes the specified metadata attribute, e.g. as disclosed in a proof. A *MetadataError
+// is returned if it is malformed, has an unsupported version, or (if conf is not nil) if its
+// credential type is unknown.
+func DecodeMetadata(i *big.Int, conf *Configuration) (*MetadataAttribute, error) {
+	if i == nil || i.Sign() <= 0 || len(i.Bytes()) > metadataLength {
+		return nil, &MetadataError{Err: ErrorMalformedMetadata}
+	}
+	attr := MetadataFromInt(i, conf)
+	if v := attr.Version(); v != MetadataVersion2 && v != MetadataVersion3 {
+		return nil, &MetadataError{Err: ErrorUnsupportedMetadataVersion, Metadata: attr.Fields()}
+	}
+	if conf != nil && attr.CredentialType() == nil {
+		return nil, &MetadataError{Err: ErrorUnknownMetadataCredentialType, Metadata: attr.Fields()}
+	}
+	return attr, nil
+}
+
 // FloorToEpochBoundary returns the greatest time not greater than the argument
 // that falls on the boundary of an epoch for attribute validity or expiry,
 // of which the value is defined by ExpiryFactor (one week).
@@ -294,8 +445,15 @@ func FloorToEpochBoundary(t time.Time) time.Time {
 	return time.Unix((t.Unix()/ExpiryFactor)*ExpiryFactor, 0)
 }
 
+// field returns the bytes of the specified field, which must not be modified.
 func (attr *MetadataAttribute) field(field metadataField) []byte {
-	return attr.Bytes()[field.offset : field.offset+field.length]
+	var bytes []byte
+	if entry := attr.cacheEntry(); entry != nil {
+		bytes = entry.bytes
+	} else {
+		bytes = attr.Bytes()
+	}
+	return bytes[field.offset : field.offset+field.length]
 }
 
 func (attr *MetadataAttribute) setField(field metadataField, value []byte) {
@@ -329,17 +487,41 @@ func shortToByte(x int) []byte {
 	return bytes
 }
 
-// A DisclosureChoice contains the attributes chosen to be disclosed.
+// A DisclosureChoice contains the attributes chosen to be disclosed, one for each disjunction
+// of the request. A nil attribute skips the corresponding disjunction, if it is optional.
 type DisclosureChoice struct {
 	Attributes []*AttributeIdentifier
+
+	// Reissue specifies, in issuance sessions, what to do with existing instances of the
+	// credential types being issued. Instances of credential types not present are removed if
+	// the credential type is a singleton, and kept otherwise.
+	Reissue map[CredentialTypeIdentifier]*ReissueChoice `json:",omitempty"`
+}
+
+// A ReissueChoice specifies what to do with the existing instances of a credential type
+// when a new instance of it is issued.
+type ReissueChoice struct {
+	// KeepAll keeps all existing instances, even if the credential type is a singleton.
+	KeepAll bool `json:",omitempty"`
+	// Replace contains the hashes of the existing instances to be replaced by the new one.
+	Replace []string `json:",omitempty"`
 }
 
 // An AttributeDisjunction encapsulates a list of possible attributes, one
-// of which should be disclosed.
+// of which should be disclosed. Optionally the disjunction is only satisfied by attributes having
+// a particular value (Values), or one of several values (AllowedValues), which the verifier checks
+// after verifying the disclosure proofs. Optional disjunctions may be skipped by the user.
+//
+// The Label of a disjunction is shown to the user. It may be translated in Labels, in which case
+// Label is its translation in the fallback language (see TranslatedString.Translation()); in JSON the
+// label is then marshaled as an object mapping languages to translations, instead of a string.
 type AttributeDisjunction struct {
-	Label      string
-	Attributes []AttributeTypeIdentifier
-	Values     map[AttributeTypeIdentifier]*string
+	Label         string
+	Labels        TranslatedString
+	Attributes    []AttributeTypeIdentifier
+	Values        map[AttributeTypeIdentifier]*string
+	AllowedValues map[AttributeTypeIdentifier][]string
+	Optional      bool
 
 	selected *AttributeTypeIdentifier
 	value    *string
@@ -352,13 +534,14 @@ type AttributeDisjunctionList []*AttributeDisjunction
 // HasValues indicates if the attributes of this disjunction have values
 // that should be satisfied.
 func (disjunction *AttributeDisjunction) HasValues() bool {
-	return disjunction.Values != nil && len(disjunction.Values) != 0
+	return len(disjunction.Values) != 0 || len(disjunction.AllowedValues) != 0
 }
 
 // attemptSatisfy tries to match the specified attribute type and value against the current disjunction,
 // returning true if the disjunction contains the specified attribute type. Note that if the disjunction
 // has required values, then it is only considered satisfied by the specified attribute type and value
-// if the required value matches the specified value.
+// if the required value matches the specified value. An absent attribute (nil value) never satisfies
+// the disjunction.
 func (disjunction *AttributeDisjunction) attemptSatisfy(id AttributeTypeIdentifier, value *string) bool {
 	var found bool
 	for index, attr := range disjunction.Attributes {
@@ -367,7 +550,7 @@ func (disjunction *AttributeDisjunction) attemptSatisfy(id AttributeTypeIdentifi
 			disjunction.selected = &id
 			disjunction.index = &index
 			disjunction.value = value
-			if !disjunction.HasValues() || disjunction.Values[id] == value {
+			if disjunction.satisfiedBy(id, value) {
 				return true
 			}
 		}
@@ -383,7 +566,102 @@ func (disjunction *AttributeDisjunction) satisfied() bool {
 	}
 
 	attr := disjunction.Attributes[*disjunction.index]
-	return !disjunction.HasValues() || disjunction.value == disjunction.Values[attr]
+	return disjunction.satisfiedBy(attr, disjunction.value)
+}
+
+// satisfiedBy indicates if the specified attribute value satisfies the required value of the
+// specified attribute type in this disjunction, if any. Absent attributes satisfy nothing.
+func (disjunction *AttributeDisjunction) satisfiedBy(id AttributeTypeIdentifier, value *string) bool {
+	if value == nil {
+		return false
+	}
+	return disjunction.ValueAllowed(id, *value)
+}
+
+// ValueAllowed indicates if the specified value of the specified attribute type meets the
+// condition of this disjunction on the values of that attribute type, if any.
+func (disjunction *AttributeDisjunction) ValueAllowed(id AttributeTypeIdentifier, value string) bool {
+	if allowed, ok := disjunction.AllowedValues[id]; ok {
+		for _, v := range allowed {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+	required := disjunction.Values[id]
+	return required == nil || *required == value
+}
+
+// contains indicates if the specified attribute type is one of the attributes of this disjunction.
+func (disjunction *AttributeDisjunction) contains(id AttributeTypeIdentifier) bool {
+	for _, attr := range disjunction.Attributes {
+		if attr == id {
+			return true
+		}
+	}
+	return false
+}
+
+// requests returns whether the disjunction contains the specified attribute, either by itself or
+// by a wildcard for its credential type.
+func (disjunction *AttributeDisjunction) requests(id AttributeTypeIdentifier) bool {
+	return disjunction.contains(id) || disjunction.contains(id.CredentialTypeIdentifier().Wildcard())
+}
+
+// validate checks that the disjunction is not empty, that its attributes and wildcards are well-formed, and
+// that its conditions on attribute values concern non-wildcard attributes of the disjunction and can be met.
+// Problems are recorded in verr; the disjunction is at the specified JSON path.
+func (disjunction *AttributeDisjunction) validate(verr *ValidationError, path string) {
+	if len(disjunction.Attributes) == 0 {
+		verr.add(jsonPath(path, "attributes"), nil, ValidationErrorMissingField, "Disclosure request had an empty disjunction")
+	}
+	for i, id := range disjunction.Attributes {
+		attrpath := jsonPath(path, fmt.Sprintf("attributes[%d]", i))
+		if !id.IsWildcard() && strings.Contains(id.String(), "*") {
+			verr.add(attrpath, id.String(), ValidationErrorInvalidValue, "Disclosure request had malformed wildcard %s", id)
+		}
+		if strings.Count(id.String(), ".") < 2 {
+			verr.add(attrpath, id.String(), ValidationErrorInvalidValue, "Disclosure request had malformed attribute %s", id)
+		}
+		_, hasValue := disjunction.Values[id]
+		_, hasValues := disjunction.AllowedValues[id]
+		if id.IsWildcard() && (hasValue || hasValues) {
+			verr.add(attrpath, id.String(), ValidationErrorConflictingFields, "Disclosure request had values for wildcard %s", id)
+		}
+		if values, ok := disjunction.AllowedValues[id]; ok && len(values) == 0 {
+			verr.add(attrpath, id.String(), ValidationErrorInvalidValue,
+				"Disclosure request had an empty list of values for attribute %s", id)
+		}
+		if hasValues && disjunction.Values[id] != nil {
+			verr.add(attrpath, id.String(), ValidationErrorConflictingFields,
+				"Disclosure request had both a value and a list of values for attribute %s", id)
+		}
+	}
+	for _, id := range disjunction.conditionIdentifiers() {
+		if !disjunction.contains(id) {
+			verr.add(jsonPath(path, "attributes"), id.String(), ValidationErrorInvalidValue,
+				"Disclosure request had a value for attribute %s outside its disjunction", id)
+		}
+	}
+}
+
+// conditionIdentifiers returns the attributes for which the disjunction contains a condition on
+// their values, sorted.
+func (disjunction *AttributeDisjunction) conditionIdentifiers() []AttributeTypeIdentifier {
+	ids := make([]AttributeTypeIdentifier, 0, len(disjunction.Values)+len(disjunction.AllowedValues))
+	for id := range disjunction.Values {
+		ids = append(ids, id)
+	}
+	for id := range disjunction.AllowedValues {
+		if _, ok := disjunction.Values[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+	return ids
 }
 
 // MatchesConfig returns true if all attributes contained in the disjunction are
@@ -401,10 +679,35 @@ func (disjunction *AttributeDisjunction) MatchesConfig(conf *Configuration) bool
 	return true
 }
 
-// satisfied indicates whether each contained attribute disjunction has a chosen attribute.
+// requests returns whether any of the contained disjunctions contains the specified attribute,
+// see AttributeDisjunction.requests().
+func (dl AttributeDisjunctionList) requests(id AttributeTypeIdentifier) bool {
+	for _, disjunction := range dl {
+		if disjunction.requests(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate validates each of the contained disjunctions, see AttributeDisjunction.validate(),
+// recording their problems in verr. The list is at the specified JSON path.
+func (dl AttributeDisjunctionList) validate(verr *ValidationError, path string) {
+	for i, disjunction := range dl {
+		disjunction.validate(verr, fmt.Sprintf("%s[%d]", path, i))
+	}
+}
+
+// skipped indicates if this disjunction is optional and no attribute was selected for it.
+func (disjunction *AttributeDisjunction) skipped() bool {
+	return disjunction.Optional && disjunction.index == nil
+}
+
+// satisfied indicates whether each contained attribute disjunction has a chosen attribute,
+// except for skipped optional disjunctions.
 func (dl AttributeDisjunctionList) satisfied() bool {
 	for _, disjunction := range dl {
-		if !disjunction.satisfied() {
+		if !disjunction.satisfied() && !disjunction.skipped() {
 			return false
 		}
 	}
@@ -423,29 +726,217 @@ func (dl AttributeDisjunctionList) Find(ai AttributeTypeIdentifier) *AttributeDi
 	return nil
 }
 
+// allowedValues returns the values of the specified attribute type allowed by the condition of this
+// disjunction, or nil if it has no condition on it.
+func (disjunction *AttributeDisjunction) allowedValues(id AttributeTypeIdentifier) []string {
+	if allowed, ok := disjunction.AllowedValues[id]; ok {
+		return allowed
+	}
+	if required := disjunction.Values[id]; required != nil {
+		return []string{*required}
+	}
+	return nil
+}
+
+// implies indicates whether every attribute satisfying this disjunction also satisfies the specified
+// disjunction: whether each attribute of this disjunction is contained in the other one, and the
+// values allowed by this disjunction for that attribute are allowed by the other one as well.
+// Attribute identifiers, including wildcards, are compared literally.
+func (disjunction *AttributeDisjunction) implies(other *AttributeDisjunction) bool {
+	for _, attr := range disjunction.Attributes {
+		if !other.contains(attr) {
+			return false
+		}
+		required := other.allowedValues(attr)
+		if required == nil {
+			continue
+		}
+		allowed := disjunction.allowedValues(attr)
+		if allowed == nil {
+			return false
+		}
+		for _, value := range allowed {
+			if !other.ValueAllowed(attr, value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// TranslatedLabel returns the label of the disjunction in the first of the specified languages in
+// which it is translated, falling back as described at TranslatedString.Translation(), or Label if
+// the label is not translated.
+func (disjunction *AttributeDisjunction) TranslatedLabel(langs ...string) string {
+	if len(disjunction.Labels) == 0 {
+		return disjunction.Label
+	}
+	return disjunction.Labels.Translation(langs...)
+}
+
+// sameLabel indicates whether the specified disjunction has the same label, including its
+// translations, as this disjunction.
+func (disjunction *AttributeDisjunction) sameLabel(other *AttributeDisjunction) bool {
+	if disjunction.Label != other.Label || len(disjunction.Labels) != len(other.Labels) {
+		return false
+	}
+	for lang, label := range disjunction.Labels {
+		if l, ok := other.Labels[lang]; !ok || l != label {
+			return false
+		}
+	}
+	return true
+}
+
+// equivalent indicates whether the specified disjunction has the same label, optionality, attributes
+// (regardless of their order) and conditions on attribute values as this disjunction.
+func (disjunction *AttributeDisjunction) equivalent(other *AttributeDisjunction) bool {
+	return disjunction.sameLabel(other) && disjunction.Optional == other.Optional &&
+		disjunction.implies(other) && other.implies(disjunction)
+}
+
+// Normalize returns a list of disjunctions that asks the same of the user as this list, without
+// redundant disjunctions. It contains the disjunctions of this list in the same order, except the
+// following. Of a number of equivalent disjunctions, i.e. having the same label, optionality, attributes
+// (in any order) and conditions on attribute values, only the first is kept. A disjunction is dropped
+// if the list contains a non-optional disjunction with the same label that implies it: of which all
+// attributes are contained in the former disjunction, with conditions on their values that are at least
+// as strict. As the user must disclose an attribute for the latter, which then also satisfies the
+// former, the former asks nothing extra of the user. A disjunction is not dropped in favour of an optional
+// one, as the user could skip that while still disclosing an attribute for the former.
+// Attribute identifiers, including wildcards, are compared literally. As the disclosed attributes in
+// the session result of a request correspond to its disjunctions, normalizing a request changes the
+// layout of its session result. The receiver is not modified; the returned list contains the same
+// disjunction instances.
+func (dl AttributeDisjunctionList) Normalize() AttributeDisjunctionList {
+	normalized := make(AttributeDisjunctionList, 0, len(dl))
+	for i, disjunction := range dl {
+		redundant := false
+		for j, other := range dl {
+			if i == j || !other.sameLabel(disjunction) {
+				continue
+			}
+			if other.equivalent(disjunction) {
+				redundant = j < i // keep the first of equivalent disjunctions
+			} else {
+				redundant = !other.Optional && other.implies(disjunction)
+			}
+			if redundant {
+				break
+			}
+		}
+		if !redundant {
+			normalized = append(normalized, disjunction)
+		}
+	}
+	return normalized
+}
+
+// Merge returns the normalized (see Normalize()) concatenation of this list and the specified list.
+// If a disjunction of the other list has the same label as a disjunction of this list but neither of
+// them implies the other, so that the user would be asked two different things under the same label,
+// then it is relabeled in the merged list by appending " (2)", " (3)", etc. to its label and each of
+// its translations, whichever is not yet in use. Such disjunctions are copied; the receiver and the other list are not modified.
+func (dl AttributeDisjunctionList) Merge(other AttributeDisjunctionList) AttributeDisjunctionList {
+	labels := map[string]struct{}{}
+	for _, disjunction := range dl {
+		labels[disjunction.Label] = struct{}{}
+	}
+	merged := append(AttributeDisjunctionList{}, dl...)
+	for _, disjunction := range other {
+		conflict := false
+		for _, d := range dl {
+			if d.sameLabel(disjunction) && !d.implies(disjunction) && !disjunction.implies(d) {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			relabeled := *disjunction
+			for i := 2; ; i++ {
+				relabeled.Label = fmt.Sprintf("%s (%d)", disjunction.Label, i)
+				if _, used := labels[relabeled.Label]; !used {
+					break
+				}
+			}
+			if len(disjunction.Labels) > 0 {
+				relabeled.Labels = make(TranslatedString, len(disjunction.Labels))
+				suffix := strings.TrimPrefix(relabeled.Label, disjunction.Label)
+				for lang, label := range disjunction.Labels {
+					relabeled.Labels[lang] = label + suffix
+				}
+			}
+			disjunction = &relabeled
+		}
+		labels[disjunction.Label] = struct{}{}
+		merged = append(merged, disjunction)
+	}
+	return merged.Normalize()
+}
+
 // MarshalJSON marshals the disjunction to JSON.
 func (disjunction *AttributeDisjunction) MarshalJSON() ([]byte, error) {
 	if !disjunction.HasValues() {
 		temp := struct {
-			Label      string                    `json:"label"`
+			Label      interface{}               `json:"label"`
 			Attributes []AttributeTypeIdentifier `json:"attributes"`
+			Optional   bool                      `json:"optional,omitempty"`
 		}{
-			Label:      disjunction.Label,
+			Label:      disjunction.jsonLabel(),
 			Attributes: disjunction.Attributes,
+			Optional:   disjunction.Optional,
 		}
 		return json.Marshal(temp)
 	}
 
+	// Attributes without condition are marshaled as null, attributes with multiple allowed
+	// values as a list of those
+	attrs := make(map[AttributeTypeIdentifier]interface{}, len(disjunction.Attributes))
+	for _, id := range disjunction.Attributes {
+		if allowed, ok := disjunction.AllowedValues[id]; ok {
+			attrs[id] = allowed
+		} else {
+			attrs[id] = disjunction.Values[id]
+		}
+	}
 	temp := struct {
-		Label      string                              `json:"label"`
-		Attributes map[AttributeTypeIdentifier]*string `json:"attributes"`
+		Label      interface{}                             `json:"label"`
+		Attributes map[AttributeTypeIdentifier]interface{} `json:"attributes"`
+		Optional   bool                                    `json:"optional,omitempty"`
 	}{
-		Label:      disjunction.Label,
-		Attributes: disjunction.Values,
+		Label:      disjunction.jsonLabel(),
+		Attributes: attrs,
+		Optional:   disjunction.Optional,
 	}
 	return json.Marshal(temp)
 }
 
+// jsonLabel returns the label of the disjunction as it is marshaled to JSON: a plain string
+// if it is not translated, for compatibility with parties not supporting translated labels.
+func (disjunction *AttributeDisjunction) jsonLabel() interface{} {
+	if len(disjunction.Labels) == 0 {
+		return disjunction.Label
+	}
+	return disjunction.Labels
+}
+
+// unmarshalLabel sets the label of the disjunction from its JSON representation, which is either
+// a string or an object mapping languages to translations.
+func (disjunction *AttributeDisjunction) unmarshalLabel(raw json.RawMessage) error {
+	disjunction.Label, disjunction.Labels = "", nil
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(raw, &disjunction.Label); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw, &disjunction.Labels); err != nil {
+		return errors.New("could not parse attribute disjunction: element 'label' was incorrect")
+	}
+	disjunction.Label = disjunction.Labels.Translation()
+	return nil
+}
+
 // UnmarshalJSON unmarshals an attribute disjunction from JSON.
 func (disjunction *AttributeDisjunction) UnmarshalJSON(bytes []byte) error {
 	if disjunction.Values == nil {
@@ -459,31 +950,46 @@ func (disjunction *AttributeDisjunction) UnmarshalJSON(bytes []byte) error {
 	// So we unmarshal it into a temporary struct that has interface{} as the
 	// type of "attributes", so that we can check which of the two it is.
 	temp := struct {
-		Label      string      `json:"label"`
-		Attributes interface{} `json:"attributes"`
+		Label      json.RawMessage `json:"label"`
+		Attributes interface{}     `json:"attributes"`
+		Optional   bool            `json:"optional"`
 	}{}
 	if err := json.Unmarshal(bytes, &temp); err != nil {
 		return err
 	}
-	disjunction.Label = temp.Label
+	if err := disjunction.unmarshalLabel(temp.Label); err != nil {
+		return err
+	}
+	disjunction.Optional = temp.Optional
 
 	switch temp.Attributes.(type) {
 	case map[string]interface{}:
+		// The value of each attribute is null, a required value, or a list of allowed values
 		temp := struct {
-			Label      string             `json:"label"`
-			Attributes map[string]*string `json:"attributes"`
+			Attributes map[string]json.RawMessage `json:"attributes"`
 		}{}
 		if err := json.Unmarshal(bytes, &temp); err != nil {
 			return err
 		}
-		for str, value := range temp.Attributes {
+		for str, raw := range temp.Attributes {
 			id := NewAttributeTypeIdentifier(str)
 			disjunction.Attributes = append(disjunction.Attributes, id)
-			disjunction.Values[id] = value
+			var value *string
+			if err := json.Unmarshal(raw, &value); err == nil {
+				disjunction.Values[id] = value
+				continue
+			}
+			var allowed []string
+			if err := json.Unmarshal(raw, &allowed); err != nil {
+				return errors.Errorf("could not parse attribute disjunction: value of %s was incorrect", str)
+			}
+			if disjunction.AllowedValues == nil {
+				disjunction.AllowedValues = make(map[AttributeTypeIdentifier][]string)
+			}
+			disjunction.AllowedValues[id] = allowed
 		}
 	case []interface{}:
 		temp := struct {
-			Label      string   `json:"label"`
 			Attributes []string `json:"attributes"`
 		}{}
 		if err := json.Unmarshal(bytes, &temp); err != nil {
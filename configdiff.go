@@ -0,0 +1,177 @@
+package irma
+
+import (
+	"reflect"
+	"sort"
+)
+
+// ConfigurationDiff describes how the parsed contents of a Configuration changed, e.g. by a scheme
+// update: the scheme managers, issuers and credential types that were added, removed or changed,
+// the attribute changes of each changed credential type, and the public keys that were added.
+// All lists are sorted by identifier.
+type ConfigurationDiff struct {
+	AddedSchemeManagers   []SchemeManagerIdentifier `json:"addedSchemeManagers,omitempty"`
+	RemovedSchemeManagers []SchemeManagerIdentifier `json:"removedSchemeManagers,omitempty"`
+	ChangedSchemeManagers []SchemeManagerIdentifier `json:"changedSchemeManagers,omitempty"`
+
+	AddedIssuers   []IssuerIdentifier `json:"addedIssuers,omitempty"`
+	RemovedIssuers []IssuerIdentifier `json:"removedIssuers,omitempty"`
+	ChangedIssuers []IssuerIdentifier `json:"changedIssuers,omitempty"`
+
+	AddedCredentialTypes   []CredentialTypeIdentifier `json:"addedCredentialTypes,omitempty"`
+	RemovedCredentialTypes []CredentialTypeIdentifier `json:"removedCredentialTypes,omitempty"`
+	ChangedCredentialTypes []*CredentialTypeDiff      `json:"changedCredentialTypes,omitempty"`
+
+	// Counters of the public keys added per issuer
+	AddedPublicKeys map[IssuerIdentifier][]int `json:"addedPublicKeys,omitempty"`
+}
+
+// CredentialTypeDiff describes how a credential type present before and after a change differs.
+// If only properties of the credential type itself changed, such as its name, the attribute lists
+// are empty.
+type CredentialTypeDiff struct {
+	ID                CredentialTypeIdentifier  `json:"id"`
+	AddedAttributes   []AttributeTypeIdentifier `json:"addedAttributes,omitempty"`
+	RemovedAttributes []AttributeTypeIdentifier `json:"removedAttributes,omitempty"`
+	ChangedAttributes []AttributeTypeIdentifier `json:"changedAttributes,omitempty"`
+}
+
+// Empty returns true if nothing changed.
+func (diff *ConfigurationDiff) Empty() bool {
+	return diff == nil || reflect.DeepEqual(*diff, ConfigurationDiff{})
+}
+
+// Diff compares the parsed scheme managers, issuers and credential types of conf with those of
+// other, returning how other differs from conf. As public keys are parsed lazily, they are not
+// compared; UpdateSchemes() fills in AddedPublicKeys from the files it downloaded instead.
+func (conf *Configuration) Diff(other *Configuration) *ConfigurationDiff {
+	diff := &ConfigurationDiff{}
+
+	for id, manager := range other.SchemeManagers {
+		old, ok := conf.SchemeManagers[id]
+		if !ok {
+			diff.AddedSchemeManagers = append(diff.AddedSchemeManagers, id)
+		} else if !equalSchemeManagers(old, manager) {
+			diff.ChangedSchemeManagers = append(diff.ChangedSchemeManagers, id)
+		}
+	}
+	for id := range conf.SchemeManagers {
+		if _, ok := other.SchemeManagers[id]; !ok {
+			diff.RemovedSchemeManagers = append(diff.RemovedSchemeManagers, id)
+		}
+	}
+
+	for id, issuer := range other.Issuers {
+		old, ok := conf.Issuers[id]
+		if !ok {
+			diff.AddedIssuers = append(diff.AddedIssuers, id)
+		} else if !reflect.DeepEqual(old, issuer) {
+			diff.ChangedIssuers = append(diff.ChangedIssuers, id)
+		}
+	}
+	for id := range conf.Issuers {
+		if _, ok := other.Issuers[id]; !ok {
+			diff.RemovedIssuers = append(diff.RemovedIssuers, id)
+		}
+	}
+
+	for id, credtype := range other.CredentialTypes {
+		old, ok := conf.CredentialTypes[id]
+		if !ok {
+			diff.AddedCredentialTypes = append(diff.AddedCredentialTypes, id)
+		} else if creddiff := diffCredentialTypes(old, credtype); creddiff != nil {
+			diff.ChangedCredentialTypes = append(diff.ChangedCredentialTypes, creddiff)
+		}
+	}
+	for id := range conf.CredentialTypes {
+		if _, ok := other.CredentialTypes[id]; !ok {
+			diff.RemovedCredentialTypes = append(diff.RemovedCredentialTypes, id)
+		}
+	}
+
+	diff.sort()
+	return diff
+}
+
+// equalSchemeManagers compares two parsed versions of a scheme manager, including their timestamp.
+func equalSchemeManagers(a, b *SchemeManager) bool {
+	x, y := *a, *b
+	x.index, y.index = nil, nil
+	return reflect.DeepEqual(x, y)
+}
+
+// diffCredentialTypes compares two parsed versions of a credential type, returning nil if they are equal.
+func diffCredentialTypes(old, credtype *CredentialType) *CredentialTypeDiff {
+	diff := &CredentialTypeDiff{ID: credtype.Identifier()}
+	oldattrs := map[AttributeTypeIdentifier]*AttributeType{}
+	for _, attr := range old.AttributeTypes {
+		oldattrs[attr.GetAttributeTypeIdentifier()] = attr
+	}
+	for _, attr := range credtype.AttributeTypes {
+		id := attr.GetAttributeTypeIdentifier()
+		oldattr, ok := oldattrs[id]
+		if !ok {
+			diff.AddedAttributes = append(diff.AddedAttributes, id)
+		} else if !reflect.DeepEqual(oldattr, attr) {
+			diff.ChangedAttributes = append(diff.ChangedAttributes, id)
+		}
+		delete(oldattrs, id)
+	}
+	for id := range oldattrs {
+		diff.RemovedAttributes = append(diff.RemovedAttributes, id)
+	}
+	sortAttributeTypeIdentifiers(diff.AddedAttributes)
+	sortAttributeTypeIdentifiers(diff.RemovedAttributes)
+	sortAttributeTypeIdentifiers(diff.ChangedAttributes)
+
+	x, y := *old, *credtype
+	x.AttributeTypes, y.AttributeTypes = nil, nil
+	if reflect.DeepEqual(x, y) && len(diff.AddedAttributes)+len(diff.RemovedAttributes)+len(diff.ChangedAttributes) == 0 {
+		return nil
+	}
+	return diff
+}
+
+// addPublicKeys adds the public keys that the specified files (relative to the irma_configuration
+// folder) contain to AddedPublicKeys.
+func (diff *ConfigurationDiff) addPublicKeys(files []string) {
+	set := &IrmaIdentifierSet{}
+	for _, file := range files {
+		addSchemeFile(set, file)
+	}
+	for id, counters := range set.PublicKeys {
+		if diff.AddedPublicKeys == nil {
+			diff.AddedPublicKeys = map[IssuerIdentifier][]int{}
+		}
+		diff.AddedPublicKeys[id] = append(diff.AddedPublicKeys[id], counters...)
+		sort.Ints(diff.AddedPublicKeys[id])
+	}
+}
+
+func (diff *ConfigurationDiff) sort() {
+	sort.Slice(diff.AddedSchemeManagers, func(i, j int) bool {
+		return diff.AddedSchemeManagers[i].String() < diff.AddedSchemeManagers[j].String()
+	})
+	sort.Slice(diff.RemovedSchemeManagers, func(i, j int) bool {
+		return diff.RemovedSchemeManagers[i].String() < diff.RemovedSchemeManagers[j].String()
+	})
+	sort.Slice(diff.ChangedSchemeManagers, func(i, j int) bool {
+		return diff.ChangedSchemeManagers[i].String() < diff.ChangedSchemeManagers[j].String()
+	})
+	sort.Slice(diff.AddedIssuers, func(i, j int) bool { return diff.AddedIssuers[i].String() < diff.AddedIssuers[j].String() })
+	sort.Slice(diff.RemovedIssuers, func(i, j int) bool { return diff.RemovedIssuers[i].String() < diff.RemovedIssuers[j].String() })
+	sort.Slice(diff.ChangedIssuers, func(i, j int) bool { return diff.ChangedIssuers[i].String() < diff.ChangedIssuers[j].String() })
+	sort.Slice(diff.AddedCredentialTypes, func(i, j int) bool {
+		return diff.AddedCredentialTypes[i].String() < diff.AddedCredentialTypes[j].String()
+	})
+	sort.Slice(diff.RemovedCredentialTypes, func(i, j int) bool {
+		return diff.RemovedCredentialTypes[i].String() < diff.RemovedCredentialTypes[j].String()
+	})
+	sort.Slice(diff.ChangedCredentialTypes, func(i, j int) bool {
+		return diff.ChangedCredentialTypes[i].ID.String() < diff.ChangedCredentialTypes[j].ID.String()
+	})
+}
+
+func sortAttributeTypeIdentifiers(ids []AttributeTypeIdentifier) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+}
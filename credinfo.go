@@ -9,14 +9,22 @@ import (
 )
 
 // CredentialInfo contains all information of an IRMA credential.
+// Its JSON serialization is passed to apps, so fields should only ever be added to it.
 type CredentialInfo struct {
-	ID              string                                       // e.g., "studentCard"
-	IssuerID        string                                       // e.g., "RU"
-	SchemeManagerID string                                       // e.g., "irma-demo"
-	SignedOn        Timestamp                                    // Unix timestamp
-	Expires         Timestamp                                    // Unix timestamp
-	Attributes      map[AttributeTypeIdentifier]TranslatedString // Human-readable rendered attributes
-	Hash            string                                       // SHA256 hash over the attributes
+	ID               string                                       // e.g., "studentCard"
+	IssuerID         string                                       // e.g., "RU"
+	SchemeManagerID  string                                       // e.g., "irma-demo"
+	SignedOn         Timestamp                                    // Unix timestamp
+	Expires          Timestamp                                    // Unix timestamp
+	Attributes       map[AttributeTypeIdentifier]TranslatedString // Human-readable rendered attributes; nil (null) if absent
+	Hash             string                                       // SHA256 hash over the attributes
+	IssuerKeyCounter int                                          // Counter of the issuer public key that signed the credential
+	Name             TranslatedString                             // Name of the credential type
+	IssuerName       TranslatedString                             // Name of the issuer
+	Expired          bool                                         // Whether the credential was expired when this was computed
+	Revoked          bool                                         // Always false, as revocation is not (yet) supported
+	NonProduction    bool                                         // Whether the credential is of a development scheme
+	DeprecatedSince  *Timestamp                                   // Unix timestamp from which on the credential type can no longer be issued, if any
 }
 
 // A CredentialInfoList is a list of credentials (implements sort.Interface).
@@ -32,14 +40,28 @@ func NewCredentialInfo(ints []*big.Int, conf *Configuration) *CredentialInfo {
 	attrs := NewAttributeListFromInts(ints, conf)
 	id := credtype.Identifier()
 	issid := id.IssuerIdentifier()
+	var issuerName TranslatedString
+	if issuer := conf.Issuers[issid]; issuer != nil {
+		issuerName = issuer.Name
+	}
+	var development bool
+	if manager := conf.SchemeManagers[issid.SchemeManagerIdentifier()]; manager != nil {
+		development = manager.Development
+	}
 	return &CredentialInfo{
-		ID:              id.Name(),
-		IssuerID:        issid.Name(),
-		SchemeManagerID: issid.SchemeManagerIdentifier().Name(),
-		SignedOn:        Timestamp(meta.SigningDate()),
-		Expires:         Timestamp(meta.Expiry()),
-		Attributes:      attrs.Map(conf),
-		Hash:            attrs.Hash(),
+		ID:               id.Name(),
+		IssuerID:         issid.Name(),
+		SchemeManagerID:  issid.SchemeManagerIdentifier().Name(),
+		SignedOn:         Timestamp(meta.SigningDate()),
+		Expires:          Timestamp(meta.Expiry()),
+		Attributes:       attrs.Map(conf),
+		Hash:             attrs.Hash(),
+		IssuerKeyCounter: meta.KeyCounter(),
+		Name:             credtype.Name,
+		IssuerName:       issuerName,
+		Expired:          !meta.IsValid(),
+		NonProduction:    development,
+		DeprecatedSince:  credtype.DeprecatedSince,
 	}
 }
 
@@ -62,8 +84,21 @@ func (cl CredentialInfoList) Swap(i, j int) {
 	cl[i], cl[j] = cl[j], cl[i]
 }
 
-// Less implements sort.Interface.
+// Less implements sort.Interface, sorting by credential type, and then by signing date and hash
+// so that the order of instances of the same credential type is deterministic.
 func (cl CredentialInfoList) Less(i, j int) bool {
-	// TODO Decide on sorting, and if it depends on a irmago.TranslatedString, allow language choosing
-	return strings.Compare(cl[i].ID, cl[j].ID) > 0
+	a, b := cl[i], cl[j]
+	if c := strings.Compare(a.SchemeManagerID, b.SchemeManagerID); c != 0 {
+		return c < 0
+	}
+	if c := strings.Compare(a.IssuerID, b.IssuerID); c != 0 {
+		return c < 0
+	}
+	if c := strings.Compare(a.ID, b.ID); c != 0 {
+		return c < 0
+	}
+	if !time.Time(a.SignedOn).Equal(time.Time(b.SignedOn)) {
+		return a.SignedOn.Before(b.SignedOn)
+	}
+	return a.Hash < b.Hash
 }
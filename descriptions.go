@@ -1,8 +1,13 @@
 package irma
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago/internal/fs"
@@ -21,12 +26,16 @@ type SchemeManager struct {
 	KeyshareServer    string
 	KeyshareWebsite   string
 	KeyshareAttribute string
+	TLSPins           []string `xml:"TLSPins>Pin"` // Pins of the scheme and keyshare server TLS keys, see HTTPTransport.SetTLSPins()
 	XMLVersion        int      `xml:"version,attr"`
 	XMLName           xml.Name `xml:"SchemeManager"`
 
 	Status SchemeManagerStatus `xml:"-"`
 	Valid  bool                `xml:"-"` // true iff Status == SchemeManagerStatusValid
 
+	// Development is true for unverified local development schemes, see Configuration.SetUnsignedSchemes()
+	Development bool `xml:"-"`
+
 	Timestamp Timestamp
 
 	index SchemeManagerIndex
@@ -42,6 +51,9 @@ type Issuer struct {
 	ContactEMail    string
 	XMLVersion      int `xml:"version,attr"`
 
+	// LogoPath is the absolute path to the logo of the issuer, or empty if the scheme contains none
+	LogoPath string `xml:"-" json:",omitempty"`
+
 	Valid bool `xml:"-"`
 }
 
@@ -58,6 +70,14 @@ type CredentialType struct {
 	XMLVersion      int              `xml:"version,attr"`
 	XMLName         xml.Name         `xml:"IssueSpecification"`
 	IssueURL        TranslatedString `xml:"IssueURL"`
+	// Category in which apps may group this credential type with related ones, if any
+	Category TranslatedString `xml:"Category" json:",omitempty"`
+	// DeprecatedSince, if present, is the Unix timestamp from which on no new instances of this
+	// credential type may be issued. Existing instances remain valid until they expire.
+	DeprecatedSince *Timestamp `xml:"DeprecatedSince"`
+
+	// LogoPath is the absolute path to the logo of the credential type, or empty if the scheme contains none
+	LogoPath string `xml:"-" json:",omitempty"`
 
 	Valid bool `xml:"-"`
 }
@@ -68,10 +88,15 @@ type AttributeType struct {
 	Optional    string `xml:"optional,attr"  json:",omitempty"`
 	Name        TranslatedString
 	Description TranslatedString
+	// Type of the values of this attribute; values of attributes without (known) type are strings
+	Type AttributeValueType `xml:"type,attr" json:",omitempty"`
 
 	Index        int  `xml:"-"`
 	DisplayIndex *int `xml:"displayIndex,attr" json:",omitempty"`
 
+	// If present, the value of this attribute is computed from another attribute at issuance
+	Derivation *AttributeDerivation `xml:"Derivation" json:",omitempty"`
+
 	// Taken from containing CredentialType
 	CredentialTypeID string `xml:"-"`
 	IssuerID         string `xml:"-"`
@@ -86,6 +111,151 @@ func (ad AttributeType) IsOptional() bool {
 	return ad.Optional == "true"
 }
 
+// AttributeValueType is the type of the values of an attribute type, as declared in its credential type.
+type AttributeValueType string
+
+const (
+	AttributeValueTypeString  = AttributeValueType("string")
+	AttributeValueTypeInteger = AttributeValueType("integer") // Decimal integer, e.g. 42
+	AttributeValueTypeDate    = AttributeValueType("date")    // Date in the format of AttributeDateFormat
+	AttributeValueTypeBoolean = AttributeValueType("boolean") // Either "true" or "false"
+)
+
+// AttributeDateFormat is the format of the values of attributes of type AttributeValueTypeDate.
+const AttributeDateFormat = "2006-01-02"
+
+// Parse parses the specified attribute value of this type, into an int64, time.Time or bool
+// for integer, date and boolean values respectively, and into a string otherwise.
+func (t AttributeValueType) Parse(value string) (interface{}, error) {
+	switch t {
+	case AttributeValueTypeInteger:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("Value %s is not an integer", value)
+		}
+		return i, nil
+	case AttributeValueTypeDate:
+		d, err := time.Parse(AttributeDateFormat, value)
+		if err != nil {
+			return nil, errors.Errorf("Value %s is not a date of the form %s", value, AttributeDateFormat)
+		}
+		return d, nil
+	case AttributeValueTypeBoolean:
+		switch value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		default:
+			return nil, errors.Errorf("Value %s is not a boolean (true or false)", value)
+		}
+	default:
+		return value, nil
+	}
+}
+
+// ValueType returns the type of the values of this attribute type, which is AttributeValueTypeString
+// unless one of the other types is declared.
+func (ad AttributeType) ValueType() AttributeValueType {
+	switch ad.Type {
+	case AttributeValueTypeInteger, AttributeValueTypeDate, AttributeValueTypeBoolean:
+		return ad.Type
+	default:
+		return AttributeValueTypeString
+	}
+}
+
+// AttributeDerivationOperation is an operation with which the value of an attribute is computed
+// from the value of another attribute of the same credential type.
+type AttributeDerivationOperation string
+
+// AttributeDerivationAgeThreshold derives whether the age at issuance, computed from the date of
+// birth in the source attribute, is at least the threshold of the derivation.
+const AttributeDerivationAgeThreshold = AttributeDerivationOperation("age-threshold")
+
+// AttributeDerivation describes how the value of a derived attribute is computed at issuance
+// from the value of its source attribute.
+type AttributeDerivation struct {
+	Source    string                       `xml:"source,attr"`
+	Operation AttributeDerivationOperation `xml:"operation,attr"`
+	Threshold int                          `xml:"threshold,attr"`
+	True      string                       `xml:"true,attr" json:",omitempty"`
+	False     string                       `xml:"false,attr" json:",omitempty"`
+}
+
+// TrueValue returns the value of the derived attribute if the derivation holds, "true" by default.
+func (d *AttributeDerivation) TrueValue() string {
+	if d.True == "" {
+		return "true"
+	}
+	return d.True
+}
+
+// FalseValue returns the value of the derived attribute if the derivation does not hold, "false" by default.
+func (d *AttributeDerivation) FalseValue() string {
+	if d.False == "" {
+		return "false"
+	}
+	return d.False
+}
+
+// Derive computes the value of the derived attribute from the specified value of its source attribute
+// at time t. For AttributeDerivationAgeThreshold, someone born on February 29 reaches an age
+// on March 1 in years that are not leap years.
+func (d *AttributeDerivation) Derive(source string, t time.Time) (string, error) {
+	switch d.Operation {
+	case AttributeDerivationAgeThreshold:
+		parsed, err := AttributeValueTypeDate.Parse(source)
+		if err != nil {
+			return "", err
+		}
+		dob := parsed.(time.Time)
+		y, m, day := t.UTC().Date()
+		today := time.Date(y, m, day, 0, 0, 0, 0, time.UTC)
+		if today.Before(dob.AddDate(d.Threshold, 0, 0)) {
+			return d.FalseValue(), nil
+		}
+		return d.TrueValue(), nil
+	default:
+		return "", errors.Errorf("Unknown attribute derivation operation %s", d.Operation)
+	}
+}
+
+// IsDerived returns whether the value of this attribute is computed from another attribute at issuance.
+func (ad AttributeType) IsDerived() bool {
+	return ad.Derivation != nil
+}
+
+// DisplayPosition returns the position of the attribute when displaying its credential type:
+// its displayIndex if specified, and its index in the credential type otherwise.
+func (ad AttributeType) DisplayPosition() int {
+	if ad.DisplayIndex != nil {
+		return *ad.DisplayIndex
+	}
+	return ad.Index
+}
+
+// AttributesInDisplayOrder returns the attribute types of this credential type in the order in
+// which they should be displayed, as specified by their displayIndex.
+func (ct *CredentialType) AttributesInDisplayOrder() []*AttributeType {
+	attrs := make([]*AttributeType, len(ct.AttributeTypes))
+	copy(attrs, ct.AttributeTypes)
+	sort.SliceStable(attrs, func(i, j int) bool {
+		return attrs[i].DisplayPosition() < attrs[j].DisplayPosition()
+	})
+	return attrs
+}
+
+// MarshalJSON marshals the credential type to JSON, including its attribute types in display order
+// under the Attributes key.
+func (ct CredentialType) MarshalJSON() ([]byte, error) {
+	type credentialType CredentialType // does not have this MarshalJSON method, preventing recursion
+	return json.Marshal(struct {
+		credentialType
+		Attributes []*AttributeType
+	}{credentialType(ct), ct.AttributesInDisplayOrder()})
+}
+
 // ContainsAttribute tests whether the specified attribute is contained in this
 // credentialtype.
 func (ct *CredentialType) ContainsAttribute(ai AttributeTypeIdentifier) bool {
@@ -125,6 +295,38 @@ func (ct CredentialType) AttributeType(ai AttributeTypeIdentifier) *AttributeTyp
 // TranslatedString is a map of translated strings.
 type TranslatedString map[string]string
 
+// TranslationFallbackLanguage is the language in which TranslatedString.Translation() returns
+// the string if it is not translated in any of the requested languages.
+const TranslationFallbackLanguage = "en"
+
+// Translation returns the translation in the first of the specified languages in which the string
+// is translated. A language that includes a region, such as "nl-BE" or "nl_BE", falls back to the
+// language itself ("nl") before the next language is tried. If none of the languages is present,
+// the translation in TranslationFallbackLanguage is returned, then the untranslated value (with
+// language ""), and otherwise the translation in the first language in alphabetical order.
+func (ts TranslatedString) Translation(langs ...string) string {
+	langs = append(append(make([]string, 0, len(langs)+2), langs...), TranslationFallbackLanguage, "")
+	for _, lang := range langs {
+		if translation, ok := ts[lang]; ok {
+			return translation
+		}
+		if i := strings.IndexAny(lang, "-_"); i > 0 {
+			if translation, ok := ts[lang[:i]]; ok {
+				return translation
+			}
+		}
+	}
+	available := make([]string, 0, len(ts))
+	for lang := range ts {
+		available = append(available, lang)
+	}
+	if len(available) == 0 {
+		return ""
+	}
+	sort.Strings(available)
+	return ts[available[0]]
+}
+
 type xmlTranslation struct {
 	XMLName xml.Name
 	Text    string `xml:",chardata"`
@@ -163,6 +365,12 @@ func (ts *TranslatedString) UnmarshalXML(d *xml.Decoder, start xml.StartElement)
 }
 
 // Identifier returns the identifier of the specified credential type.
+// IsDeprecatedAt returns whether the credential type is deprecated at the specified time,
+// i.e. whether new instances of it can no longer be issued (see DeprecatedSince).
+func (ct *CredentialType) IsDeprecatedAt(t Timestamp) bool {
+	return ct.DeprecatedSince != nil && !t.Before(*ct.DeprecatedSince)
+}
+
 func (ct *CredentialType) Identifier() CredentialTypeIdentifier {
 	return NewCredentialTypeIdentifier(ct.SchemeManagerID + "." + ct.IssuerID + "." + ct.ID)
 }
@@ -177,7 +385,7 @@ func (ct *CredentialType) SchemeManagerIdentifier() SchemeManagerIdentifier {
 }
 
 func (ct *CredentialType) Logo(conf *Configuration) string {
-	path := fmt.Sprintf("%s/%s/%s/Issues/%s/logo.png", conf.Path, ct.SchemeManagerID, ct.IssuerID, ct.ID)
+	path := conf.resolve(fmt.Sprintf("%s/%s/%s/Issues/%s/logo.png", conf.Path, ct.SchemeManagerID, ct.IssuerID, ct.ID))
 	exists, err := fs.PathExists(path)
 	if err != nil || !exists {
 		return ""
@@ -0,0 +1,149 @@
+package irma
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/go-errors/errors"
+)
+
+// This file makes the errors of this package inspectable using errors.Is() and errors.As() from
+// the standard library, so that callers can distinguish the causes of failures without matching
+// error messages, which are left unchanged. In particular:
+//  - An ErrorType matches the *SessionErrors of that type, e.g. errors.Is(err, ErrorTimeout).
+//    A *SessionError unwraps to its cause, or if it has none, to its *RemoteError.
+//  - A *RemoteError matches errors having the same error name, such as the errors of the
+//    server package: errors.Is(err, server.ErrorSessionUnknown).
+//  - A SchemeManagerStatus matches the *SchemeManagerErrors having that status, and
+//    a ValidationErrorCode the *ValidationErrors having a problem with that code.
+//  - A *SchemeManagerError and a *MetadataError unwrap to their cause.
+// Errors created by github.com/go-errors/errors, which do not implement Unwrap(), are unwrapped
+// to the error they wrap; the wrapping errors still match themselves, e.g. ErrorMissingPublicKey.
+
+// ErrorStage is the stage of an IRMA session during which a *SessionError occurred.
+type ErrorStage string
+
+const (
+	// Retrieving and parsing the session request
+	ErrorStageStart = ErrorStage("start")
+	// Updating and installing schemes, and downloading public keys
+	ErrorStageConfiguration = ErrorStage("configuration")
+	// Running the keyshare protocol with the keyshare server(s)
+	ErrorStageKeyshare = ErrorStage("keyshare")
+	// Computing the response, sending it to the server, and processing the server's reply
+	ErrorStageResponse = ErrorStage("response")
+)
+
+// Error returns the error type, so that error types can be used as sentinel errors
+// matching the *SessionErrors of that type.
+func (t ErrorType) Error() string {
+	return string(t)
+}
+
+func (e *SessionError) Is(target error) bool {
+	if t, ok := target.(ErrorType); ok {
+		return t == e.ErrorType
+	}
+	return sameError(e.Err, target)
+}
+
+func (e *SessionError) Unwrap() error {
+	if e.Err != nil {
+		return unwrapStack(e.Err)
+	}
+	if e.RemoteError != nil {
+		return e.RemoteError
+	}
+	return nil
+}
+
+// MarshalJSON serializes the session error, including its error type, stage and remote error,
+// e.g. for passing it to the app.
+func (e *SessionError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ErrorType    ErrorType    `json:"type"`
+		Stage        ErrorStage   `json:"stage,omitempty"`
+		Info         string       `json:"info,omitempty"`
+		WrappedError string       `json:"wrappedError,omitempty"`
+		RemoteStatus int          `json:"remoteStatus,omitempty"`
+		RemoteError  *RemoteError `json:"remoteError,omitempty"`
+	}{
+		ErrorType:    e.ErrorType,
+		Stage:        e.Stage,
+		Info:         e.Info,
+		WrappedError: e.WrappedError(),
+		RemoteStatus: e.RemoteStatus,
+		RemoteError:  e.RemoteError,
+	})
+}
+
+// Is returns whether the target is a *RemoteError, or an error having an ErrorName() method
+// such as the errors of the server package, with the same error name.
+func (err *RemoteError) Is(target error) bool {
+	switch t := target.(type) {
+	case *RemoteError:
+		return t.ErrorName == err.ErrorName
+	case interface{ ErrorName() string }:
+		return t.ErrorName() == err.ErrorName
+	default:
+		return false
+	}
+}
+
+// Error returns the status, so that statuses can be used as sentinel errors
+// matching the *SchemeManagerErrors having that status.
+func (s SchemeManagerStatus) Error() string {
+	return string(s)
+}
+
+func (sme SchemeManagerError) Is(target error) bool {
+	if s, ok := target.(SchemeManagerStatus); ok {
+		return s == sme.Status
+	}
+	return sameError(sme.Err, target)
+}
+
+func (sme SchemeManagerError) Unwrap() error {
+	return unwrapStack(sme.Err)
+}
+
+func (e *MetadataError) Is(target error) bool {
+	return sameError(e.Err, target)
+}
+
+func (e *MetadataError) Unwrap() error {
+	return unwrapStack(e.Err)
+}
+
+// Error returns the code, so that codes can be used as sentinel errors
+// matching the *ValidationErrors having a problem with that code.
+func (code ValidationErrorCode) Error() string {
+	return string(code)
+}
+
+func (verr *ValidationError) Is(target error) bool {
+	code, ok := target.(ValidationErrorCode)
+	if !ok {
+		return false
+	}
+	for _, problem := range verr.Problems {
+		if problem.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// unwrapStack returns the error wrapped by err if it was created by github.com/go-errors/errors
+// to add a stacktrace, and err itself otherwise.
+func unwrapStack(err error) error {
+	if e, ok := err.(*errors.Error); ok {
+		return e.Err
+	}
+	return err
+}
+
+// sameError returns whether err equals target, as errors.Is() would (without unwrapping).
+func sameError(err, target error) bool {
+	return err != nil && reflect.TypeOf(target).Comparable() && err == target
+}
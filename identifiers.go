@@ -34,6 +34,7 @@ type CredentialIdentifier struct {
 type AttributeIdentifier struct {
 	Type           AttributeTypeIdentifier
 	CredentialHash string
+	Expired        bool `json:",omitempty"` // Set on disclosure candidates from expired credentials
 }
 
 // IrmaIdentifierSet contains a set (ensured by using map[...]struct{}) of all scheme managers,
@@ -123,6 +124,18 @@ func (id AttributeTypeIdentifier) IsCredential() bool {
 	return strings.Count(id.String(), ".") == 2
 }
 
+// IsWildcard returns true if this attribute refers to all attributes of its containing credential
+// (i.e., it consists of 4 parts of which the last is "*").
+func (id AttributeTypeIdentifier) IsWildcard() bool {
+	return strings.Count(id.String(), ".") == 3 && id.Name() == "*"
+}
+
+// Wildcard returns the attribute identifier referring to all attributes of this credential type,
+// with which a disclosure request can ask for the entire credential.
+func (id CredentialTypeIdentifier) Wildcard() AttributeTypeIdentifier {
+	return NewAttributeTypeIdentifier(id.String() + ".*")
+}
+
 // CredentialIdentifier returns the credential identifier of this attribute.
 func (ai *AttributeIdentifier) CredentialIdentifier() CredentialIdentifier {
 	return CredentialIdentifier{Type: ai.Type.CredentialTypeIdentifier(), Hash: ai.CredentialHash}
@@ -181,6 +194,17 @@ func (set *IrmaIdentifierSet) Distributed(conf *Configuration) bool {
 	return false
 }
 
+// Development returns true if any of the scheme managers in the set is a development scheme
+// (see Configuration.SetUnsignedSchemes()).
+func (set *IrmaIdentifierSet) Development(conf *Configuration) bool {
+	for id := range set.SchemeManagers {
+		if manager := conf.SchemeManagers[id]; manager != nil && manager.Development {
+			return true
+		}
+	}
+	return false
+}
+
 func (set *IrmaIdentifierSet) Empty() bool {
 	return len(set.SchemeManagers) == 0 && len(set.Issuers) == 0 && len(set.CredentialTypes) == 0 && len(set.PublicKeys) == 0
 }
@@ -1,13 +1,20 @@
 package fs
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
 
 	"github.com/pkg/errors"
 )
@@ -80,28 +87,91 @@ func Copy(src, dest string) error {
 	return SaveFile(dest, bts)
 }
 
-// Save the filecontents at the specified path atomically:
-// - first save the content in a temp file with a random filename in the same dir
+// TempFilePrefix is the prefix of the names of the temp files written by SaveFile(),
+// which RemoveTempFiles() removes.
+const TempFilePrefix = ".irmatmp-"
+
+// Save the filecontents at the specified path atomically and durably:
+// - first save the content in a temp file with a random filename in the same dir, and fsync it
 // - then rename the temp file to the specified filepath, overwriting the old file
-func SaveFile(filepath string, content []byte) (err error) {
-	dir := path.Dir(filepath)
+// - then fsync the dir, so that the rename itself survives a crash
+// If the process is killed before the rename, the old file is left intact along with the
+// temp file, which RemoveTempFiles() cleans up.
+func SaveFile(filepath string, content []byte) error {
+	tempfile, err := WriteTempFile(filepath, content)
+	if err != nil {
+		return err
+	}
+	return CommitTempFile(tempfile, filepath)
+}
 
+// WriteTempFile writes the content to a new temp file in the directory of filepath and fsyncs it,
+// returning the path to the temp file. CommitTempFile() moves it to filepath.
+func WriteTempFile(filepath string, content []byte) (string, error) {
 	// Read random data for filename and convert to hex
 	randBytes := make([]byte, 16)
-	_, err = rand.Read(randBytes)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", err
+	}
+	tempfile := path.Join(path.Dir(filepath), TempFilePrefix+hex.EncodeToString(randBytes))
+
+	f, err := os.OpenFile(tempfile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
-		return
+		return "", err
+	}
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-	tempfilename := hex.EncodeToString(randBytes)
+	if err != nil {
+		_ = os.Remove(tempfile)
+		return "", err
+	}
+	return tempfile, nil
+}
+
+// CommitTempFile renames the temp file written by WriteTempFile() to filepath, overwriting the
+// old file, and fsyncs the directory containing it.
+func CommitTempFile(tempfile, filepath string) error {
+	if err := os.Rename(tempfile, filepath); err != nil {
+		_ = os.Remove(tempfile)
+		return err
+	}
+	return SyncDirectory(path.Dir(filepath))
+}
 
-	// Create temp file
-	err = ioutil.WriteFile(dir+"/"+tempfilename, content, 0600)
+// SyncDirectory fsyncs the specified directory, persisting the creation, renaming and removal
+// of the files in it. Platforms and filesystems not supporting this are ignored.
+func SyncDirectory(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
 	if err != nil {
-		return
+		return err
 	}
+	defer d.Close()
+	err = d.Sync()
+	if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.EINVAL {
+		return nil
+	}
+	return err
+}
 
-	// Rename, overwriting old file
-	return os.Rename(dir+"/"+tempfilename, filepath)
+// RemoveTempFiles removes the temp files of SaveFile() from the specified directory and its
+// subdirectories, which remain if the process was killed during SaveFile().
+func RemoveTempFiles(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasPrefix(info.Name(), TempFilePrefix) {
+			return nil
+		}
+		return os.Remove(path)
+	})
 }
 
 func CopyDirectory(src, dest string) error {
@@ -138,6 +208,97 @@ func CopyDirectory(src, dest string) error {
 	)
 }
 
+// ArchiveDirectory returns the files in the specified directory and its subdirectories as a
+// gzipped tar archive, which ExtractArchive() restores.
+func ArchiveDirectory(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		if header.Name, err = filepath.Rel(dir, path); err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(header.Name)
+		if err = tw.WriteHeader(header); err != nil || info.IsDir() {
+			return err
+		}
+		bts, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(bts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ExtractArchive extracts a gzipped tar archive created by ArchiveDirectory() into the specified
+// directory, creating it if necessary. Entries that would end up outside of dir are refused.
+func ExtractArchive(archive []byte, dir string) error {
+	if err := EnsureDirectoryExists(dir); err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(header.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) ||
+			filepath.Clean(name) != name {
+			return errors.Errorf("invalid path in archive: %s", header.Name)
+		}
+		path := filepath.Join(dir, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = EnsureDirectoryExists(path); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err = EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+				return err
+			}
+			bts, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if err = SaveFile(path, bts); err != nil {
+				return err
+			}
+		default:
+			return errors.Errorf("unsupported file type in archive: %s", header.Name)
+		}
+	}
+}
+
 // ReadKey returns either the content of the file specified at path, if it exists,
 // or []byte(key) otherwise. It is an error to specify both or none arguments, or
 // specify an empty or unreadable file. If there is no error then the return []byte is non-empty.
@@ -5,18 +5,18 @@
 package servercore
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
-	"io/ioutil"
 	"net/http"
-	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/jasonlvhit/gocron"
-	"github.com/privacybydesign/gabi"
-	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/server"
@@ -28,6 +28,20 @@ type Server struct {
 	sessions      sessionStore
 	scheduler     *gocron.Scheduler
 	stopScheduler chan bool
+	schemesLock   sync.Mutex // serializes scheme updates and installations
+
+	// Timestamps of the last accepted scheme update announcement of each scheme, guarded by schemesLock
+	announcements map[irma.SchemeManagerIdentifier]time.Time
+
+	reloadStatus     server.SchemesReloadStatus
+	reloadStatusLock sync.Mutex
+
+	// Publishes session results if the configuration has a ResultPublisher
+	publisher *resultPublisher
+
+	// Parent of the contexts of the sessions, cancelled when the server stops
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func New(conf *server.Configuration) (*Server, error) {
@@ -40,17 +54,31 @@ func New(conf *server.Configuration) (*Server, error) {
 			conf:      conf,
 		},
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	s.scheduler.Every(10).Seconds().Do(func() {
 		s.sessions.deleteExpired()
 	})
+	if conf.SchemesReloadInterval > 0 {
+		s.scheduler.Every(uint64(conf.SchemesReloadInterval)).Seconds().Do(func() {
+			_, _ = s.ReloadSchemes()
+		})
+	}
 	s.stopScheduler = s.scheduler.Start()
 
-	return s, s.verifyConfiguration(s.conf)
+	err := s.verifyConfiguration(s.conf)
+	if err == nil && conf.ResultPublisher != nil {
+		s.publisher = newResultPublisher(conf)
+	}
+	return s, err
 }
 
 func (s *Server) Stop() {
+	s.cancel()
 	s.stopScheduler <- true
 	s.sessions.stop()
+	if s.publisher != nil {
+		s.publisher.stop()
+	}
 }
 
 func (s *Server) verifyConfiguration(configuration *server.Configuration) error {
@@ -75,18 +103,36 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 			return server.LogError(errors.Errorf("Nonexisting schemes_path provided: %s", s.conf.SchemesPath))
 		}
 		s.conf.Logger.WithField("schemes_path", s.conf.SchemesPath).Info("Determined schemes path")
-		if s.conf.SchemesAssetsPath == "" {
+		if s.conf.SchemesAssetsPath == "" && len(s.conf.SchemesAssetsPaths) == 0 {
 			s.conf.IrmaConfiguration, err = irma.NewConfiguration(s.conf.SchemesPath)
 		} else {
-			s.conf.IrmaConfiguration, err = irma.NewConfigurationFromAssets(s.conf.SchemesPath, s.conf.SchemesAssetsPath)
+			assets := append([]string{s.conf.SchemesAssetsPath}, s.conf.SchemesAssetsPaths...)
+			s.conf.IrmaConfiguration, err = irma.NewConfigurationFromAssets(s.conf.SchemesPath, assets...)
 		}
 		if err != nil {
 			return server.LogError(err)
 		}
+		if len(s.conf.DevelopmentSchemes) > 0 {
+			ids := make([]irma.SchemeManagerIdentifier, 0, len(s.conf.DevelopmentSchemes))
+			for _, id := range s.conf.DevelopmentSchemes {
+				ids = append(ids, irma.NewSchemeManagerIdentifier(id))
+			}
+			s.conf.IrmaConfiguration.SetUnsignedSchemes(ids)
+		}
+		s.conf.IrmaConfiguration.SetStrict(s.conf.StrictSchemes)
 		if err = s.conf.IrmaConfiguration.ParseFolder(); err != nil {
 			return server.LogError(err)
 		}
 	}
+	for id, manager := range s.conf.IrmaConfiguration.SchemeManagers {
+		if !manager.Development {
+			continue
+		}
+		if s.conf.Production {
+			return server.LogError(errors.Errorf("Development scheme %s cannot be used in production mode", id))
+		}
+		s.conf.Logger.WithField("scheme", id).Warn("Using unverified development scheme")
+	}
 
 	if len(s.conf.IrmaConfiguration.SchemeManagers) == 0 {
 		s.conf.Logger.Infof("No schemes found in %s, downloading default (irma-demo and pbdf)", s.conf.SchemesPath)
@@ -97,42 +143,26 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 	if s.conf.SchemesUpdateInterval == 0 {
 		s.conf.SchemesUpdateInterval = 60
 	}
+	// Also applies to updates triggered by scheme update announcements
+	s.conf.IrmaConfiguration.SetAllowRollback(s.conf.AllowSchemesRollback)
 	if !s.conf.DisableSchemesUpdate {
-		s.conf.IrmaConfiguration.AutoUpdateSchemes(uint(s.conf.SchemesUpdateInterval))
+		// Fetch public keys that issuers started using since the last scheme update when verifying
+		s.conf.IrmaConfiguration.SetDownloadMissingPublicKeys(true)
+		s.conf.IrmaConfiguration.ScheduleSchemeUpdates(uint(s.conf.SchemesUpdateInterval), s.updateSchemes)
 	}
 
-	if s.conf.IssuerPrivateKeys == nil {
-		s.conf.IssuerPrivateKeys = make(map[irma.IssuerIdentifier]*gabi.PrivateKey)
+	if err := s.conf.LoadPrivateKeys(); err != nil {
+		return server.LogError(err)
 	}
-	if s.conf.IssuerPrivateKeysPath != "" {
-		files, err := ioutil.ReadDir(s.conf.IssuerPrivateKeysPath)
-		if err != nil {
-			return server.LogError(err)
-		}
-		for _, file := range files {
-			filename := file.Name()
-			issid := irma.NewIssuerIdentifier(strings.TrimSuffix(filename, filepath.Ext(filename))) // strip .xml
-			if _, ok := s.conf.IrmaConfiguration.Issuers[issid]; !ok {
-				return server.LogError(errors.Errorf("Private key %s belongs to an unknown issuer", filename))
-			}
-			sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(s.conf.IssuerPrivateKeysPath, filename))
-			if err != nil {
-				return server.LogError(err)
-			}
-			s.conf.IssuerPrivateKeys[issid] = sk
-		}
+
+	if s.conf.MaxExpiredAge < 0 {
+		return server.LogError(errors.New("max_expired_age must not be negative"))
 	}
-	for issid, sk := range s.conf.IssuerPrivateKeys {
-		pk, err := s.conf.IrmaConfiguration.PublicKey(issid, int(sk.Counter))
-		if err != nil {
-			return server.LogError(err)
-		}
-		if pk == nil {
-			return server.LogError(errors.Errorf("Missing public key belonging to private key %s-%d", issid.String(), sk.Counter))
-		}
-		if new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
-			return server.LogError(errors.Errorf("Private key %s-%d does not belong to corresponding public key", issid.String(), sk.Counter))
-		}
+	if s.conf.ResultPublishAttempts < 0 {
+		return server.LogError(errors.New("result_publish_attempts must not be negative"))
+	}
+	if s.conf.ResultPublishAttempts == 0 {
+		s.conf.ResultPublishAttempts = 10
 	}
 
 	if s.conf.URL != "" {
@@ -167,35 +197,76 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 	return nil
 }
 
-func (s *Server) StartSession(req interface{}) (*irma.Qr, string, error) {
-	rrequest, err := server.ParseSessionRequest(req)
+// StartSession starts a session of the specified session request, returning the session pointer
+// for the client and the token of the session. If the context is done before the session is
+// started, its error is returned.
+func (s *Server) StartSession(ctx context.Context, req interface{}) (*irma.Qr, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	parse := server.ParseSessionRequest
+	if s.conf.StrictRequests {
+		parse = server.ParseSessionRequestStrict
+	}
+	rrequest, err := parse(req)
 	if err != nil {
 		return nil, "", err
 	}
 
 	request := rrequest.SessionRequest()
 	action := request.Action()
+	if action != irma.ActionIssuing && s.conf.InstallUnknownSchemes {
+		if err := s.installUnknownSchemeManagers(ctx, request); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := irma.ValidateAgainstConfiguration(request, s.conf.CurrentIrmaConfiguration()); err != nil {
+		return nil, "", err
+	}
 	if action == irma.ActionIssuing {
 		if err := s.validateIssuanceRequest(request.(*irma.IssuanceRequest)); err != nil {
 			return nil, "", err
 		}
 	}
+	if err := s.validateWildcards(request); err != nil {
+		return nil, "", err
+	}
+	if request.RequiresRevocationCheck() && s.conf.RevocationChecker == nil {
+		return nil, "", server.ErrorUnsupported.Wrap(errors.New("Revocation check requested but no revocation checker configured"))
+	}
+	if s.conf.NormalizeRequests {
+		normalizeDisjunctions(request)
+	}
+	request.SetDefaultExpiryPolicy(irma.ExpiryPolicy{
+		AcceptExpired: s.conf.AcceptExpired,
+		MaxExpiredAge: time.Duration(s.conf.MaxExpiredAge) * time.Second,
+	})
+	multiSigned, err := s.multiSignedMessage(ctx, rrequest)
+	if err != nil {
+		return nil, "", err
+	}
 
-	session := s.newSession(action, rrequest)
+	session, err := s.newSession(ctx, action, rrequest)
+	if err != nil {
+		return nil, "", err
+	}
+	if multiSigned != nil {
+		session.multiSigned = multiSigned
+		session.request.SetContext(multiSigned.Context)
+	}
 	s.conf.Logger.WithFields(logrus.Fields{"action": action, "session": session.token}).Infof("Session started")
 	if s.conf.Logger.IsLevelEnabled(logrus.DebugLevel) {
 		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request: ", server.ToJson(rrequest))
 	} else {
 		s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session request (purged of attribute values): ", server.ToJson(purgeRequest(rrequest)))
 	}
-	return &irma.Qr{
-		Type: action,
-		URL:  s.conf.URL + session.clientToken,
-	}, session.token, nil
+	session.Lock()
+	defer session.Unlock()
+	return session.sessionPtr(), session.token, nil
 }
 
 func (s *Server) GetSessionResult(token string) *server.SessionResult {
-	session := s.sessions.get(token)
+	session, _ := s.sessions.get(context.Background(), token)
 	if session == nil {
 		s.conf.Logger.Warn("Session result requested of unknown session ", token)
 		return nil
@@ -204,7 +275,7 @@ func (s *Server) GetSessionResult(token string) *server.SessionResult {
 }
 
 func (s *Server) GetRequest(token string) irma.RequestorRequest {
-	session := s.sessions.get(token)
+	session, _ := s.sessions.get(context.Background(), token)
 	if session == nil {
 		s.conf.Logger.Warn("Session request requested of unknown session ", token)
 		return nil
@@ -212,15 +283,99 @@ func (s *Server) GetRequest(token string) irma.RequestorRequest {
 	return session.rrequest
 }
 
+// GetSessionPtr returns the current session pointer of the specified session, as returned by
+// StartSession() or RefreshSession().
+func (s *Server) GetSessionPtr(token string) *irma.Qr {
+	session, _ := s.sessions.get(context.Background(), token)
+	if session == nil {
+		s.conf.Logger.Warn("Session pointer requested of unknown session ", token)
+		return nil
+	}
+	session.Lock()
+	defer session.Unlock()
+	return session.sessionPtr()
+}
+
+// ClientSessionPtrExpiry returns when the session pointer of the session with the specified
+// client token expires, or nil if there is no such session or the client already connected to it.
+func (s *Server) ClientSessionPtrExpiry(clientToken string) *irma.Timestamp {
+	session, _ := s.sessions.clientGet(context.Background(), clientToken)
+	if session == nil {
+		return nil
+	}
+	session.Lock()
+	defer session.Unlock()
+	return session.expiry()
+}
+
+// RefreshSession issues a new session pointer for the specified session, provided that the
+// client has not yet connected to it, restarting its expiry. The previous session pointer of the
+// session can no longer be used.
+func (s *Server) RefreshSession(token string) (*irma.Qr, error) {
+	session, _ := s.sessions.get(context.Background(), token)
+	if session == nil {
+		return nil, server.LogError(server.ErrorSessionUnknown.Wrap(errors.Errorf("can't refresh unknown session %s", token)))
+	}
+	if !s.sessions.renewClientToken(session, newSessionToken()) {
+		return nil, server.LogError(server.ErrorUnexpectedRequest.Wrap(errors.Errorf("can't refresh session %s, which already started", token)))
+	}
+	session.Lock()
+	defer session.Unlock()
+	session.ptrIssued = time.Now()
+	session.markAlive()
+	s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Session pointer refreshed")
+	return session.sessionPtr(), nil
+}
+
+// CancelSession cancels the specified session, aborting the handling of any request of its
+// client that is in progress.
 func (s *Server) CancelSession(token string) error {
-	session := s.sessions.get(token)
+	session, _ := s.sessions.get(context.Background(), token)
 	if session == nil {
-		return server.LogError(errors.Errorf("can't cancel unknown session %s", token))
+		return server.LogError(server.ErrorSessionUnknown.Wrap(errors.Errorf("can't cancel unknown session %s", token)))
 	}
+	session.cancel()
+	session.Lock()
+	defer session.Unlock()
 	session.handleDelete()
 	return nil
 }
 
+// RemoveScheme removes the specified scheme, which is refused while sessions in progress refer to it.
+func (s *Server) RemoveScheme(id irma.SchemeManagerIdentifier) error {
+	if err := s.removeScheme(id); err != nil {
+		return server.LogError(err)
+	}
+	return nil
+}
+
+// ReloadSchemes reloads the schemes if they were changed on disk, returning how they changed.
+// Sessions that were started before keep using the previous schemes.
+func (s *Server) ReloadSchemes() (*irma.ConfigurationDiff, error) {
+	diff, err := s.reloadSchemes()
+	if err != nil {
+		return nil, server.LogError(err)
+	}
+	return diff, nil
+}
+
+// UpdateAnnouncedScheme immediately updates the scheme announced by the signed scheme update
+// announcement, returning how the schemes changed, if enabled by SchemeUpdateAnnouncements.
+// Announcements that are malformed, not validly signed by the announced scheme, or not newer than
+// the last accepted one of the scheme are logged and dropped without side effects, returning
+// server.ErrorInvalidRequest. Sessions that were started before keep using the previous schemes.
+func (s *Server) UpdateAnnouncedScheme(announcement *irma.SignedSchemeUpdateAnnouncement) (*irma.ConfigurationDiff, error) {
+	return s.updateAnnouncedScheme(announcement)
+}
+
+// SchemesReloadStatus returns the time of the last successful reload of the schemes,
+// and the error of the last attempt if it failed.
+func (s *Server) SchemesReloadStatus() server.SchemesReloadStatus {
+	s.reloadStatusLock.Lock()
+	defer s.reloadStatusLock.Unlock()
+	return s.reloadStatus
+}
+
 func ParsePath(path string) (string, string, error) {
 	pattern := regexp.MustCompile("(\\w+)/?(|commitments|proofs|status|statusevents)$")
 	matches := pattern.FindStringSubmatch(path)
@@ -232,20 +387,22 @@ func ParsePath(path string) (string, string, error) {
 
 func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
 	if !s.conf.EnableSSE {
-		return errors.New("Server sent events disabled")
+		return server.ErrorUnsupported.Wrap(errors.New("Server sent events disabled"))
 	}
 
 	var session *session
 	if requestor {
-		session = s.sessions.get(token)
+		session, _ = s.sessions.get(r.Context(), token)
 	} else {
-		session = s.sessions.clientGet(token)
+		session, _ = s.sessions.clientGet(r.Context(), token)
 	}
 	if session == nil {
-		return server.LogError(errors.Errorf("can't subscribe to server sent events of unknown session %s", token))
+		return server.LogError(server.ErrorSessionUnknown.Wrap(
+			errors.Errorf("can't subscribe to server sent events of unknown session %s", token)))
 	}
 	if session.status.Finished() {
-		return server.LogError(errors.Errorf("can't subscribe to server sent events of finished session %s", token))
+		return server.LogError(server.ErrorUnexpectedRequest.Wrap(
+			errors.Errorf("can't subscribe to server sent events of finished session %s", token)))
 	}
 
 	session.Lock()
@@ -266,7 +423,11 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 	return nil
 }
 
+// HandleProtocolMessage handles the specified message of the IRMA protocol from the client.
+// The handling of proofs and commitments is aborted when the context, or that of the session,
+// is done, in which case the session is left as it was and ErrorRequestCancelled is returned.
 func (s *Server) HandleProtocolMessage(
+	ctx context.Context,
 	path string,
 	method string,
 	headers map[string][]string,
@@ -283,9 +444,6 @@ func (s *Server) HandleProtocolMessage(
 	}
 
 	s.conf.Logger.WithFields(logrus.Fields{"method": method, "path": path}).Debugf("Routing protocol message")
-	if len(message) > 0 {
-		s.conf.Logger.Trace("POST body: ", string(message))
-	}
 	s.conf.Logger.Trace("HTTP headers: ", server.ToJson(headers))
 	token, noun, err := ParsePath(path)
 	if err != nil {
@@ -294,7 +452,11 @@ func (s *Server) HandleProtocolMessage(
 	}
 
 	// Fetch the session
-	session := s.sessions.clientGet(token)
+	session, err := s.sessions.clientGet(ctx, token)
+	if err != nil {
+		status, output = server.JsonResponse(nil, server.RemoteError(server.ErrorRequestCancelled, err.Error()))
+		return
+	}
 	if session == nil {
 		s.conf.Logger.WithField("clientToken", token).Warn("Session not found")
 		status, output = server.JsonResponse(nil, server.RemoteError(server.ErrorSessionUnknown, ""))
@@ -302,6 +464,13 @@ func (s *Server) HandleProtocolMessage(
 	}
 	session.Lock()
 	defer session.Unlock()
+	// The proofs of the client contain the disclosed attribute values, so don't log them if the
+	// requestor wants only their hashes
+	if len(message) > 0 && !session.rrequest.Base().HashAttributeValues {
+		s.conf.Logger.Trace("POST body: ", string(message))
+	}
+	ctx, cancel := session.requestContext(ctx)
+	defer cancel()
 
 	// However we return, if the session status has been updated
 	// then we should inform the user by returning a SessionResult
@@ -332,7 +501,7 @@ func (s *Server) HandleProtocolMessage(
 				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, err.Error()))
 				return
 			}
-			status, output = server.JsonResponse(session.handleGetRequest(min, max))
+			status, output = session.jsonResponse(session.handleGetRequest(min, max))
 			return
 		}
 		status, output = server.JsonResponse(nil, session.fail(server.ErrorInvalidRequest, ""))
@@ -355,31 +524,54 @@ func (s *Server) HandleProtocolMessage(
 			return
 		}
 
+		// Proofs or commitments can be posted only once. Clients may retry posting them however,
+		// so we respond to an identical resubmission as we did to the original submission.
+		if noun == "proofs" || noun == "commitments" {
+			hash := sha256.Sum256(message)
+			if session.postedHash != nil {
+				if bytes.Equal(session.postedHash, hash[:]) {
+					status, output = session.postedStatus, session.postedOutput
+					return
+				}
+				status, output = server.JsonResponse(nil,
+					server.RemoteError(server.ErrorUnexpectedRequest, "Session already received other proofs"))
+				return
+			}
+			if session.status == server.StatusConnected {
+				defer func() {
+					// Cancelled requests leave the session connected, so that the client may retry them
+					if session.status != server.StatusConnected {
+						session.postedHash, session.postedStatus, session.postedOutput = hash[:], status, output
+					}
+				}()
+			}
+		}
+
 		if noun == "commitments" && session.action == irma.ActionIssuing {
 			commitments := &irma.IssueCommitmentMessage{}
-			if err := irma.UnmarshalValidate(message, commitments); err != nil {
+			if err := irma.UnmarshalMessage(session.version, message, commitments); err != nil {
 				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, ""))
 				return
 			}
-			status, output = server.JsonResponse(session.handlePostCommitments(commitments))
+			status, output = session.jsonResponse(session.handlePostCommitments(ctx, commitments))
 			return
 		}
 		if noun == "proofs" && session.action == irma.ActionDisclosing {
 			disclosure := irma.Disclosure{}
-			if err := irma.UnmarshalValidate(message, &disclosure); err != nil {
+			if err := irma.UnmarshalMessage(session.version, message, &disclosure); err != nil {
 				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, ""))
 				return
 			}
-			status, output = server.JsonResponse(session.handlePostDisclosure(disclosure))
+			status, output = session.jsonResponse(session.handlePostDisclosure(ctx, disclosure))
 			return
 		}
 		if noun == "proofs" && session.action == irma.ActionSigning {
 			signature := &irma.SignedMessage{}
-			if err := irma.UnmarshalValidate(message, signature); err != nil {
+			if err := irma.UnmarshalMessage(session.version, message, signature); err != nil {
 				status, output = server.JsonResponse(nil, session.fail(server.ErrorMalformedInput, ""))
 				return
 			}
-			status, output = server.JsonResponse(session.handlePostSignature(signature))
+			status, output = session.jsonResponse(session.handlePostSignature(ctx, signature))
 			return
 		}
 
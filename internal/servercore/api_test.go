@@ -0,0 +1,168 @@
+package servercore
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// slowSessionStore is a sessionStore that takes its time to retrieve sessions, unless the
+// context of the caller is done first.
+type slowSessionStore struct {
+	*memorySessionStore
+	delay time.Duration
+}
+
+func (s *slowSessionStore) wait(ctx context.Context) error {
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *slowSessionStore) get(ctx context.Context, token string) (*session, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.memorySessionStore.get(ctx, token)
+}
+
+func (s *slowSessionStore) clientGet(ctx context.Context, token string) (*session, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.memorySessionStore.clientGet(ctx, token)
+}
+
+func newTestServer(t *testing.T) (*Server, *slowSessionStore) {
+	logger := logrus.New()
+	logger.Level = logrus.ErrorLevel
+	s, err := New(&server.Configuration{
+		SchemesPath:          filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		Logger:               logger,
+		DisableSchemesUpdate: true,
+	})
+	require.NoError(t, err)
+	store := &slowSessionStore{memorySessionStore: s.sessions.(*memorySessionStore)}
+	s.sessions = store
+	return s, store
+}
+
+func disclosureRequest() *irma.DisclosureRequest {
+	return &irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
+		Content: irma.AttributeDisjunctionList{{
+			Label:      "foo",
+			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		}},
+	}
+}
+
+func TestCancelledProtocolMessage(t *testing.T) {
+	s, store := newTestServer(t)
+	defer s.Stop()
+
+	request := disclosureRequest()
+	qr, token, err := s.StartSession(context.Background(), request)
+	require.NoError(t, err)
+	clientToken := qr.URL[strings.LastIndex(qr.URL, "/")+1:]
+
+	headers := http.Header{}
+	headers.Set(irma.MinVersionHeader, "2.4")
+	headers.Set(irma.MaxVersionHeader, "2.4")
+	status, _, _ := s.HandleProtocolMessage(context.Background(), clientToken, http.MethodGet, headers, nil)
+	require.Equal(t, http.StatusOK, status)
+
+	// A request whose context is cancelled while the store is slow returns promptly
+	store.delay = 10 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	status, _, result := s.HandleProtocolMessage(ctx, clientToken+"/proofs", http.MethodPost, nil, []byte("{}"))
+	require.True(t, time.Since(start) < time.Second)
+	require.Equal(t, server.ErrorRequestCancelled.Status, status)
+	require.Nil(t, result)
+
+	// The session is left as it was, so that the client may post its proofs again
+	store.delay = 0
+	session, err := s.sessions.get(context.Background(), token)
+	require.NoError(t, err)
+	require.Equal(t, server.StatusConnected, session.status)
+	require.Nil(t, session.postedHash)
+	require.NoError(t, session.ctx.Err())
+
+	// Sessions are not started with a context that is done
+	_, _, err = s.StartSession(ctx, request)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestSessionContextDone(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer s.Stop()
+
+	request := disclosureRequest()
+	_, token, err := s.StartSession(context.Background(), request)
+	require.NoError(t, err)
+	session, err := s.sessions.get(context.Background(), token)
+	require.NoError(t, err)
+	require.NoError(t, session.ctx.Err())
+
+	// Reaching a terminal status cancels the context of the session
+	require.NoError(t, s.CancelSession(token))
+	require.Equal(t, context.Canceled, session.ctx.Err())
+	require.Equal(t, server.StatusCancelled, session.status)
+}
+
+func TestSessionPtrExpiry(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer s.Stop()
+
+	qr, token, err := s.StartSession(context.Background(), disclosureRequest())
+	require.NoError(t, err)
+	require.NotNil(t, qr.Expiry)
+	clientToken := qr.URL[strings.LastIndex(qr.URL, "/")+1:]
+	session, err := s.sessions.get(context.Background(), token)
+	require.NoError(t, err)
+
+	// Without a maximum session pointer lifetime, polling the status does not postpone the expiry
+	past := time.Now().Add(-time.Minute)
+	session.lastActive = past
+	status, _, _ := s.HandleProtocolMessage(context.Background(), clientToken+"/status", http.MethodGet, nil, nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, past, session.lastActive)
+
+	// With it, the expiry slides along with the polls
+	s.conf.MaxSessionPtrLifetime = 3 * int(maxSessionLifetime/time.Second)
+	session.ptrIssued = time.Now().Add(-maxSessionLifetime)
+	s.HandleProtocolMessage(context.Background(), clientToken+"/status", http.MethodGet, nil, nil)
+	require.True(t, session.lastActive.After(past))
+	require.True(t, time.Time(*s.ClientSessionPtrExpiry(clientToken)).After(time.Now().Add(maxSessionLifetime-time.Minute)))
+
+	// up to the maximum lifetime after the session pointer was issued
+	session.ptrIssued = time.Now().Add(-5 * maxSessionLifetime / 2)
+	session.lastActive = session.ptrIssued
+	s.HandleProtocolMessage(context.Background(), clientToken+"/status", http.MethodGet, nil, nil)
+	max := session.ptrIssued.Add(time.Duration(s.conf.MaxSessionPtrLifetime) * time.Second)
+	require.True(t, max.Equal(time.Time(*session.expiry())))
+	require.Equal(t, irma.Timestamp(max).String(), s.GetSessionPtr(token).Expiry.String())
+
+	// Once the client connected, the session pointer no longer expires
+	headers := http.Header{}
+	headers.Set(irma.MinVersionHeader, "2.4")
+	headers.Set(irma.MaxVersionHeader, "2.4")
+	status, _, _ = s.HandleProtocolMessage(context.Background(), clientToken, http.MethodGet, headers, nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Nil(t, s.ClientSessionPtrExpiry(clientToken))
+	require.Nil(t, s.GetSessionPtr(token).Expiry)
+}
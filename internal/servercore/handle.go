@@ -1,6 +1,9 @@
 package servercore
 
 import (
+	"context"
+	"time"
+
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
@@ -10,7 +13,8 @@ import (
 // This file contains the handler functions for the protocol messages, receiving and returning normally
 // Go-typed messages here (JSON (un)marshalling is handled by the router).
 // Maintaining the session state is done here, as well as checking whether the session is in the
-// appropriate status before handling the request.
+// appropriate status before handling the request. Handlers taking a context leave the session
+// untouched if the context is done before they finish verifying what the client sent.
 
 func (session *session) handleDelete() {
 	if session.status.Finished() {
@@ -18,7 +22,8 @@ func (session *session) handleDelete() {
 	}
 	session.markAlive()
 
-	session.result = &server.SessionResult{Token: session.token, Status: server.StatusCancelled, Type: session.action}
+	session.result = &server.SessionResult{Token: session.token, Status: server.StatusCancelled, Type: session.action,
+		NonProduction: session.result.NonProduction}
 	session.setStatus(server.StatusCancelled)
 }
 
@@ -40,25 +45,44 @@ func (session *session) handleGetRequest(min, max *irma.ProtocolVersion) (irma.S
 }
 
 func (session *session) handleGetStatus() (server.Status, *irma.RemoteError) {
+	session.postponeExpiry()
 	return session.status, nil
 }
 
-func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irma.ProofStatus, *irma.RemoteError) {
+func (session *session) handlePostSignature(ctx context.Context, signature *irma.SignedMessage) (*irma.ProofStatus, *irma.RemoteError) {
 	if session.status != server.StatusConnected {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 	}
 	session.markAlive()
 
-	var err error
+	disclosed, proofStatus, reason, err := signature.VerifyWithReasonContext(
+		ctx, session.irmaConfiguration, session.request.(*irma.SignatureRequest))
+	if err != nil && ctx.Err() != nil {
+		return nil, session.cancelled(err)
+	}
+
 	var rerr *irma.RemoteError
 	session.result.Signature = signature
-	session.result.Disclosed, session.result.ProofStatus, err = signature.Verify(
-		session.conf.IrmaConfiguration, session.request.(*irma.SignatureRequest))
+	session.result.Disclosed, session.result.ProofStatus, session.result.ProofStatusReason = disclosed, proofStatus, reason
+	// Hash the values before anything else, so that the values can't end up in the result on any path
+	session.hashAttributeValues()
+	if err == nil {
+		if err = session.checkRevocation(); err != nil {
+			return nil, session.fail(server.ErrorRevocationCheck, err.Error())
+		}
+	}
+	session.logProofStatus()
 	if err == nil {
+		session.setOptionalDisjunctions()
+		session.setTypedValues()
+		session.removeCredentialHashes()
+		session.collectSignature()
 		session.setStatus(server.StatusDone)
 	} else {
-		if err == irma.ErrorMissingPublicKey {
+		if irma.IsMissingPublicKey(err) {
 			rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
+		} else if irma.IsExpiredPublicKey(err) {
+			rerr = session.fail(server.ErrorExpiredPublicKey, err.Error())
 		} else {
 			rerr = session.fail(server.ErrorUnknown, err.Error())
 		}
@@ -66,21 +90,36 @@ func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irm
 	return &session.result.ProofStatus, rerr
 }
 
-func (session *session) handlePostDisclosure(disclosure irma.Disclosure) (*irma.ProofStatus, *irma.RemoteError) {
+func (session *session) handlePostDisclosure(ctx context.Context, disclosure irma.Disclosure) (*irma.ProofStatus, *irma.RemoteError) {
 	if session.status != server.StatusConnected {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 	}
 	session.markAlive()
 
-	var err error
+	disclosed, proofStatus, reason, err := disclosure.VerifyWithReasonContext(
+		ctx, session.irmaConfiguration, session.request.(*irma.DisclosureRequest))
+	if err != nil && ctx.Err() != nil {
+		return nil, session.cancelled(err)
+	}
+
 	var rerr *irma.RemoteError
-	session.result.Disclosed, session.result.ProofStatus, err = disclosure.Verify(
-		session.conf.IrmaConfiguration, session.request.(*irma.DisclosureRequest))
+	session.result.Disclosed, session.result.ProofStatus, session.result.ProofStatusReason = disclosed, proofStatus, reason
+	if err == nil {
+		if err = session.checkRevocation(); err != nil {
+			return nil, session.fail(server.ErrorRevocationCheck, err.Error())
+		}
+	}
+	session.logProofStatus()
 	if err == nil {
+		session.setOptionalDisjunctions()
+		session.setTypedValues()
+		session.removeCredentialHashes()
 		session.setStatus(server.StatusDone)
 	} else {
-		if err == irma.ErrorMissingPublicKey {
+		if irma.IsMissingPublicKey(err) {
 			rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
+		} else if irma.IsExpiredPublicKey(err) {
+			rerr = session.fail(server.ErrorExpiredPublicKey, err.Error())
 		} else {
 			rerr = session.fail(server.ErrorUnknown, err.Error())
 		}
@@ -88,7 +127,7 @@ func (session *session) handlePostDisclosure(disclosure irma.Disclosure) (*irma.
 	return &session.result.ProofStatus, rerr
 }
 
-func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentMessage) ([]*gabi.IssueSignatureMessage, *irma.RemoteError) {
+func (session *session) handlePostCommitments(ctx context.Context, commitments *irma.IssueCommitmentMessage) ([]*gabi.IssueSignatureMessage, *irma.RemoteError) {
 	if session.status != server.StatusConnected {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 	}
@@ -103,13 +142,23 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 
 	// Compute list of public keys against which to verify the received proofs
 	disclosureproofs := irma.ProofList(commitments.Proofs[:discloseCount])
-	pubkeys, err := disclosureproofs.ExtractPublicKeys(session.conf.IrmaConfiguration)
+	pubkeys, err := disclosureproofs.ExtractPublicKeysContext(ctx, session.irmaConfiguration)
+	if err != nil && ctx.Err() != nil {
+		return nil, session.cancelled(err)
+	}
 	if err != nil {
+		session.result.ProofStatus, session.result.ProofStatusReason = irma.ProofStatusInvalid, irma.ProofErrorReason(err)
+		session.logProofStatus()
+		if irma.IsMissingPublicKey(err) {
+			return nil, session.fail(server.ErrorUnknownPublicKey, err.Error())
+		} else if irma.IsExpiredPublicKey(err) {
+			return nil, session.fail(server.ErrorExpiredPublicKey, err.Error())
+		}
 		return nil, session.fail(server.ErrorInvalidProofs, err.Error())
 	}
 	for _, cred := range request.Credentials {
 		iss := cred.CredentialTypeID.IssuerIdentifier()
-		pubkey, _ := session.conf.IrmaConfiguration.PublicKey(iss, cred.KeyCounter) // No error, already checked earlier
+		pubkey, _ := session.irmaConfiguration.PublicKey(iss, cred.KeyCounter) // No error, already checked earlier
 		pubkeys = append(pubkeys, pubkey)
 	}
 
@@ -117,7 +166,7 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	for i, proof := range commitments.Proofs {
 		pubkey := pubkeys[i]
 		schemeid := irma.NewIssuerIdentifier(pubkey.Issuer).SchemeManagerIdentifier()
-		if session.conf.IrmaConfiguration.SchemeManagers[schemeid].Distributed() {
+		if session.irmaConfiguration.SchemeManagers[schemeid].Distributed() {
 			proofP, err := session.getProofP(commitments, schemeid)
 			if err != nil {
 				return nil, session.fail(server.ErrorKeyshareProofMissing, err.Error())
@@ -127,11 +176,26 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	}
 
 	// Verify all proofs and check disclosed attributes, if any, against request
-	session.result.Disclosed, session.result.ProofStatus, err = commitments.Disclosure().VerifyAgainstDisjunctions(
-		session.conf.IrmaConfiguration, request.Disclose, request.Context, request.Nonce, pubkeys, false)
+	disclosed, proofStatus, reason, err := commitments.Disclosure().VerifyAgainstDisjunctionsWithReasonContext(
+		ctx, session.irmaConfiguration, request.Disclose, request.Context, request.Nonce, pubkeys, false)
+	if err != nil && ctx.Err() != nil {
+		return nil, session.cancelled(err)
+	}
+	session.result.Disclosed, session.result.ProofStatus, session.result.ProofStatusReason = disclosed, proofStatus, reason
+	if err == nil && session.result.ProofStatus == irma.ProofStatusValid &&
+		!disclosureproofs.CheckExpiry(session.irmaConfiguration, session.result.Disclosed, time.Now(), request.ExpiryPolicy()) {
+		session.result.ProofStatus = irma.ProofStatusExpired
+		session.result.ProofStatusReason = irma.ProofStatusReasonExpired
+	}
+	if err == nil {
+		if err = session.checkRevocation(); err != nil {
+			return nil, session.fail(server.ErrorRevocationCheck, err.Error())
+		}
+	}
+	session.logProofStatus()
 	if err != nil {
-		if err == irma.ErrorMissingPublicKey {
-			return nil, session.fail(server.ErrorUnknownPublicKey, "")
+		if irma.IsMissingPublicKey(err) {
+			return nil, session.fail(server.ErrorUnknownPublicKey, err.Error())
 		} else {
 			return nil, session.fail(server.ErrorUnknown, "")
 		}
@@ -139,19 +203,36 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	if session.result.ProofStatus == irma.ProofStatusExpired {
 		return nil, session.fail(server.ErrorAttributesExpired, "")
 	}
+	if session.result.ProofStatus == irma.ProofStatusRevoked {
+		return nil, session.fail(server.ErrorAttributesRevoked, "")
+	}
 	if session.result.ProofStatus != irma.ProofStatusValid {
-		return nil, session.fail(server.ErrorInvalidProofs, "")
+		return nil, session.fail(server.ErrorInvalidProofs, string(session.result.ProofStatusReason))
+	}
+	session.setOptionalDisjunctions()
+	session.setTypedValues()
+	session.removeCredentialHashes()
+
+	// Substitute the disclosed attributes to which the credentials to be issued refer
+	disclosed := map[irma.AttributeTypeIdentifier]*string{}
+	for _, attr := range session.result.Disclosed {
+		if _, ok := disclosed[attr.Identifier]; !ok {
+			disclosed[attr.Identifier] = attr.RawValue
+		}
+	}
+	if err = request.ResolveReferences(disclosed); err != nil {
+		return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
 	}
 
 	// Compute CL signatures
 	var sigs []*gabi.IssueSignatureMessage
 	for i, cred := range request.Credentials {
 		id := cred.CredentialTypeID.IssuerIdentifier()
-		pk, _ := session.conf.IrmaConfiguration.PublicKey(id, cred.KeyCounter)
-		sk, _ := session.conf.PrivateKey(id)
+		pk, _ := session.irmaConfiguration.PublicKey(id, cred.KeyCounter)
+		sk, _ := session.conf.PrivateKeyByCounter(id, uint(cred.KeyCounter))
 		issuer := gabi.NewIssuer(sk, pk, one)
 		proof := commitments.Proofs[i+discloseCount].(*gabi.ProofU)
-		attributes, err := cred.AttributeList(session.conf.IrmaConfiguration, 0x03)
+		attributes, err := cred.AttributeList(session.irmaConfiguration, 0x03)
 		if err != nil {
 			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
 		}
@@ -160,6 +241,8 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
 		}
 		sigs = append(sigs, sig)
+		session.result.CredentialValidity = append(session.result.CredentialValidity, *cred.Validity)
+		session.result.Issued = append(session.result.Issued, cred)
 	}
 
 	session.setStatus(server.StatusDone)
@@ -1,6 +1,7 @@
 package servercore
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -23,12 +24,84 @@ func (session *session) markAlive() {
 	session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Debugf("Session marked active, expiry delayed")
 }
 
+// timeout returns how long the session may be inactive before it expires.
+func (session *session) timeout() time.Duration {
+	if session.status == server.StatusInitialized && session.rrequest.Base().ClientTimeout != 0 {
+		return time.Duration(session.rrequest.Base().ClientTimeout) * time.Second
+	}
+	return maxSessionLifetime
+}
+
+// expiry returns when the session pointer of the session expires, or nil if the client
+// already connected to the session.
+func (session *session) expiry() *irma.Timestamp {
+	if session.status != server.StatusInitialized {
+		return nil
+	}
+	expiry := irma.Timestamp(session.lastActive.Add(session.timeout()))
+	return &expiry
+}
+
+// sessionPtr returns the current session pointer of the session.
+func (session *session) sessionPtr() *irma.Qr {
+	return &irma.Qr{
+		Type:   session.action,
+		URL:    session.conf.URL + session.clientToken,
+		Expiry: session.expiry(),
+	}
+}
+
+// postponeExpiry postpones the expiry of the session pointer of the session as if the session
+// were active, but not beyond MaxSessionPtrLifetime after the session pointer was issued.
+func (session *session) postponeExpiry() {
+	if session.status != server.StatusInitialized || session.conf.MaxSessionPtrLifetime <= 0 {
+		return
+	}
+	max := session.ptrIssued.Add(time.Duration(session.conf.MaxSessionPtrLifetime)*time.Second - session.timeout())
+	lastActive := time.Now()
+	if lastActive.After(max) {
+		lastActive = max
+	}
+	if lastActive.After(session.lastActive) {
+		session.lastActive = lastActive
+	}
+}
+
 func (session *session) setStatus(status server.Status) {
 	session.conf.Logger.WithFields(logrus.Fields{"session": session.token, "prevStatus": session.prevStatus, "status": status}).
 		Info("Session status updated")
+	finished := status.Finished() && !session.status.Finished()
 	session.status = status
 	session.result.Status = status
 	session.sessions.update(session)
+	if finished {
+		session.cancel()
+	}
+	if finished && session.publisher != nil {
+		result := *session.result
+		session.publisher.enqueue(&result)
+	}
+}
+
+// requestContext returns a context for handling a request of the session, which is done when
+// either the context of the request or that of the session is done.
+func (session *session) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-session.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// cancelled returns the error with which a request is refused whose context was done before
+// it was handled, leaving the session as it was so that the request may be retried.
+func (session *session) cancelled(err error) *irma.RemoteError {
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Info("Request cancelled: ", err)
+	return server.RemoteError(server.ErrorRequestCancelled, err.Error())
 }
 
 func (session *session) onUpdate() {
@@ -40,53 +113,430 @@ func (session *session) onUpdate() {
 	}
 }
 
+// setOptionalDisjunctions records in the session result how each disjunction of the request was
+// satisfied by the disclosed attributes, and which optional disjunctions were skipped by the user.
+func (session *session) setOptionalDisjunctions() {
+	disjunctions := session.request.ToDisclose()
+	session.result.Disjunctions = irma.DisjunctionResults(disjunctions, session.result.Disclosed)
+	session.result.SatisfiedOptional, session.result.SkippedOptional = irma.OptionalDisjunctions(
+		disjunctions, session.result.Disclosed)
+}
+
+// removeCredentialHashes removes the credential hashes of the disclosed attributes from the session
+// result, unless the requestor asked for them.
+func (session *session) removeCredentialHashes() {
+	if session.rrequest.Base().CredentialHashes {
+		return
+	}
+	for _, attr := range session.result.Disclosed {
+		attr.CredentialHash = ""
+	}
+}
+
+// hashAttributeValues replaces the values of the disclosed attributes in the session result by their
+// hashes, if the requestor asked for this (see irma.RequestorBaseRequest.HashAttributeValues).
+// This must be done directly after verifying the disclosure, so that the disjunction results
+// derived from the disclosed attributes contain the hashes as well.
+func (session *session) hashAttributeValues() {
+	base := session.rrequest.Base()
+	if !base.HashAttributeValues {
+		return
+	}
+	hash := func(value *string) *string {
+		if value == nil {
+			return nil
+		}
+		h := irma.HashAttributeValue(base.HashSalt, *value)
+		return &h
+	}
+	for _, attr := range session.result.Disclosed {
+		attr.RawValue = hash(attr.RawValue)
+		attr.Value = irma.NewTranslatedString(attr.RawValue)
+		attr.TypedValue = nil
+	}
+}
+
+// checkRevocation checks, if the request asks for it, whether the credentials of the disclosed
+// attributes in the session result were revoked, marking the attributes of revoked credentials
+// as such. If the proofs were valid otherwise, the proof status becomes irma.ProofStatusRevoked.
+// This must be done before removeCredentialHashes(), as the checker receives the credential hashes.
+func (session *session) checkRevocation() error {
+	if !session.request.RequiresRevocationCheck() {
+		return nil
+	}
+	checked := map[string]bool{}
+	anyRevoked := false
+	for _, attr := range session.result.Disclosed {
+		if attr.CredentialHash == "" { // not disclosed
+			continue
+		}
+		revoked, ok := checked[attr.CredentialHash]
+		if !ok {
+			var err error
+			if revoked, err = session.conf.RevocationChecker.Revoked(attr); err != nil {
+				return err
+			}
+			checked[attr.CredentialHash] = revoked
+		}
+		if revoked {
+			attr.RevocationStatus = irma.RevocationStatusRevoked
+			attr.Status = irma.AttributeProofStatusRevoked
+			anyRevoked = true
+		} else {
+			attr.RevocationStatus = irma.RevocationStatusNotRevoked
+		}
+	}
+	if anyRevoked && session.result.ProofStatus == irma.ProofStatusValid {
+		session.result.ProofStatus, session.result.ProofStatusReason = irma.ProofStatusRevoked, irma.ProofStatusReasonRevoked
+	}
+	return nil
+}
+
+// setTypedValues sets the typed values of the disclosed attributes in the session result,
+// if enabled by the configuration and the values were not replaced by their hashes.
+func (session *session) setTypedValues() {
+	if session.conf.TypedAttributeValues && !session.rrequest.Base().HashAttributeValues {
+		irma.SetTypedValues(session.irmaConfiguration, session.result.Disclosed)
+	}
+}
+
 func (session *session) fail(err server.Error, message string) *irma.RemoteError {
 	rerr := server.RemoteError(err, message)
+	session.result = &server.SessionResult{Err: rerr, Token: session.token, Status: server.StatusCancelled, Type: session.action,
+		NonProduction: session.result.NonProduction, ProofStatus: session.result.ProofStatus,
+		ProofStatusReason: session.result.ProofStatusReason}
 	session.setStatus(server.StatusCancelled)
-	session.result = &server.SessionResult{Err: rerr, Token: session.token, Status: server.StatusCancelled, Type: session.action}
 	return rerr
 }
 
+// logProofStatus logs the outcome of the verification of the proofs received from the client,
+// including why they were not valid, if they were not.
+func (session *session) logProofStatus() {
+	fields := logrus.Fields{"session": session.token, "proofStatus": session.result.ProofStatus}
+	if session.result.ProofStatusReason != irma.ProofStatusReasonNone {
+		fields["reason"] = session.result.ProofStatusReason
+	}
+	session.conf.Logger.WithFields(fields).Info("Proofs verified")
+}
+
+// validateWildcards checks that the wildcards in the disjunctions of the request, referring to all
+// attributes of a credential type, can be expanded into the attributes of known credential types.
+func (s *Server) validateWildcards(request irma.SessionRequest) error {
+	irmaconf := s.conf.CurrentIrmaConfiguration()
+	for _, disjunction := range request.ToDisclose() {
+		for _, attr := range disjunction.Attributes {
+			if !attr.IsWildcard() {
+				continue
+			}
+			if _, err := irmaconf.WildcardAttributes(attr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeDisjunctions removes redundant disjunctions from the request, see
+// irma.AttributeDisjunctionList.Normalize(). Issuance requests containing references to disclosed
+// attributes are left alone, as their references might concern attributes of removed disjunctions.
+func normalizeDisjunctions(request irma.SessionRequest) {
+	switch r := request.(type) {
+	case *irma.DisclosureRequest:
+		r.Content = r.Content.Normalize()
+	case *irma.SignatureRequest:
+		r.Content = r.Content.Normalize()
+	case *irma.IssuanceRequest:
+		for _, cred := range r.Credentials {
+			if len(cred.References()) > 0 {
+				return
+			}
+		}
+		r.Disclose = r.Disclose.Normalize()
+	}
+}
+
+// multiSignedMessage returns the signatures of the previous sessions of the multi-party signature
+// that the signature session of the request is part of, if any (see irma.SignatureRequestorRequest).
+func (s *Server) multiSignedMessage(ctx context.Context, rrequest irma.RequestorRequest) (*irma.MultiSignedMessage, error) {
+	sigrequest, ok := rrequest.(*irma.SignatureRequestorRequest)
+	if !ok || (!sigrequest.MultiParty && sigrequest.Previous == "") {
+		return nil, nil
+	}
+	request := sigrequest.Request
+	if sigrequest.Previous == "" {
+		return irma.NewMultiSignedMessage(request.Message, request.MessageType)
+	}
+
+	previous, err := s.sessions.get(ctx, sigrequest.Previous)
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil {
+		return nil, server.ErrorSessionUnknown.Wrap(errors.New("previous session of multi-party signature not found"))
+	}
+	previous.Lock()
+	defer previous.Unlock()
+	signatures := previous.result.Signatures
+	if previous.multiSigned == nil || previous.status != server.StatusDone || signatures == nil {
+		return nil, errors.New("previous session is not a finished session of a multi-party signature")
+	}
+	if previous.result.ProofStatus != irma.ProofStatusValid {
+		return nil, errors.New("previous session of multi-party signature did not have a valid signature")
+	}
+	if signatures.Message != request.Message || signatures.MessageType != request.MessageType {
+		return nil, errors.New("message differs from that of the previous session of multi-party signature")
+	}
+	return &irma.MultiSignedMessage{
+		Message:     signatures.Message,
+		MessageType: signatures.MessageType,
+		Context:     signatures.Context,
+		Signatures:  append([]*irma.SignedMessage{}, signatures.Signatures...),
+	}, nil
+}
+
+// collectSignature includes in the session result the signatures of the multi-party signature that
+// the session is part of, if any, along with the signature of this session if it is valid.
+func (session *session) collectSignature() {
+	if session.multiSigned == nil {
+		return
+	}
+	if session.result.ProofStatus == irma.ProofStatusValid {
+		if err := session.multiSigned.Add(session.result.Signature); err != nil {
+			session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Warn(
+				"Signature not added to multi-party signature: ", err)
+		}
+	}
+	session.result.Signatures = session.multiSigned
+}
+
 // Issuance helpers
 
 func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
+	if id := s.conf.DeprecatedCredentialType(request.Credentials); id != nil {
+		return server.ErrorCredentialTypeDeprecated.Wrap(
+			errors.Errorf("credential type %s is deprecated and can no longer be issued", id.String()))
+	}
+	irmaconf := s.conf.CurrentIrmaConfiguration()
 	for _, cred := range request.Credentials {
-		// Check that we have the appropriate private key
+		// Check that we have the appropriate private key: the one requested, or otherwise the latest one
 		iss := cred.CredentialTypeID.IssuerIdentifier()
-		privatekey, err := s.conf.PrivateKey(iss)
+		var privatekey *gabi.PrivateKey
+		var err error
+		if cred.KeyCounterSpecified() {
+			privatekey, err = s.conf.PrivateKeyByCounter(iss, uint(cred.KeyCounter))
+		} else {
+			privatekey, err = s.conf.PrivateKey(iss)
+		}
 		if err != nil {
 			return err
 		}
 		if privatekey == nil {
-			return errors.Errorf("missing private key of issuer %s", iss.String())
+			if cred.KeyCounterSpecified() {
+				return server.ErrorCannotIssue.Wrap(
+					errors.Errorf("missing private key %d of issuer %s", cred.KeyCounter, iss.String()))
+			}
+			return server.ErrorCannotIssue.Wrap(errors.Errorf("missing private key of issuer %s", iss.String()))
 		}
-		pubkey, err := s.conf.IrmaConfiguration.PublicKey(iss, int(privatekey.Counter))
+		pubkey, err := irmaconf.PublicKey(iss, int(privatekey.Counter))
 		if err != nil {
 			return err
 		}
 		if pubkey == nil {
-			return errors.Errorf("missing public key of issuer %s", iss.String())
+			return server.ErrorCannotIssue.Wrap(errors.Errorf("missing public key of issuer %s", iss.String()))
 		}
 		cred.KeyCounter = int(privatekey.Counter)
 
 		// Check that the credential is consistent with irma_configuration
-		if err := cred.Validate(s.conf.IrmaConfiguration); err != nil {
+		if err := cred.Validate(irmaconf); err != nil {
+			return err
+		}
+		// Compute derived attributes now, so that the client receives and signs the same values as we do
+		if err := cred.DeriveAttributes(irmaconf); err != nil {
 			return err
 		}
 
-		// Ensure the credential has an expiry date
-		defaultValidity := irma.Timestamp(time.Now().AddDate(0, 6, 0))
-		if cred.Validity == nil {
-			cred.Validity = &defaultValidity
+		// Ensure the credential has an expiry date, rounded down to the epoch boundary as it will be
+		// in the metadata attribute, and that our key does not expire before the credential
+		validity := time.Now().AddDate(0, 6, 0)
+		if cred.Validity != nil {
+			validity = time.Time(*cred.Validity)
 		}
-		if cred.Validity.Before(irma.Timestamp(time.Now())) {
+		floored := irma.Timestamp(irma.FloorToEpochBoundary(validity))
+		cred.Validity = &floored
+		if !cred.Validity.After(irma.Timestamp(time.Now())) {
 			return errors.New("cannot issue expired credentials")
 		}
+		if err := cred.ValidateKey(irmaconf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// installUnknownSchemeManagers installs the scheme managers that the disclosure or signature
+// request refers to but that are not in our configuration, if the request says where to find them.
+// They are installed into a new snapshot of the schemes, which then becomes the current one.
+// The context is checked before each scheme manager is downloaded, so that a download in progress
+// is finished but no further ones are started once it is done.
+func (s *Server) installUnknownSchemeManagers(ctx context.Context, request irma.SessionRequest) error {
+	s.schemesLock.Lock()
+	defer s.schemesLock.Unlock()
+
+	current := s.conf.CurrentIrmaConfiguration()
+	unknown := current.UnknownSchemeManagers(request)
+	if len(unknown) == 0 {
+		return nil
+	}
+	conf, err := current.Reparse()
+	if err != nil {
+		return err
+	}
+	for _, id := range unknown {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		pointer := request.SchemeManagerPointer(id)
+		if pointer == nil {
+			return errors.Errorf("unknown scheme manager %s", id)
+		}
+		s.conf.Logger.WithField("scheme", id).Info("Installing scheme manager referred to by session request")
+		manager, err := conf.DownloadPointedSchemeManager(id, pointer)
+		if err != nil {
+			return err
+		}
+		if err = conf.InstallPointedSchemeManager(manager, pointer); err != nil {
+			return err
+		}
+	}
+	s.conf.SetCurrentIrmaConfiguration(conf)
+	return nil
+}
+
+// updateSchemes updates the schemes into a new snapshot, which then becomes the current one,
+// so that sessions using the previous snapshot are unaffected.
+func (s *Server) updateSchemes() error {
+	s.schemesLock.Lock()
+	defer s.schemesLock.Unlock()
+
+	s.conf.Logger.Info("Auto-updating schemes")
+	conf, diff, err := s.conf.CurrentIrmaConfiguration().UpdateSchemesSnapshot()
+	if diff != nil {
+		for id := range diff.Schemes {
+			s.conf.Logger.WithField("scheme", id).Info("Updated scheme")
+		}
+	}
+	if conf != nil {
+		s.conf.SetCurrentIrmaConfiguration(conf)
+	}
+	return err
+}
+
+// updateAnnouncedScheme verifies the scheme update announcement, and if valid and newer than the
+// last accepted one of the scheme, updates the announced scheme into a new snapshot, which then
+// becomes the current one. Other announcements are dropped, so that replaying an announcement
+// does not make us fetch the scheme again.
+func (s *Server) updateAnnouncedScheme(signed *irma.SignedSchemeUpdateAnnouncement) (*irma.ConfigurationDiff, error) {
+	if !s.conf.SchemeUpdateAnnouncements {
+		return nil, server.ErrorUnsupported
+	}
+
+	s.schemesLock.Lock()
+	defer s.schemesLock.Unlock()
+
+	current := s.conf.CurrentIrmaConfiguration()
+	announcement, err := current.VerifySchemeUpdateAnnouncement(signed)
+	if err == nil {
+		if last, ok := s.announcements[announcement.Scheme]; ok && !time.Time(announcement.Timestamp).After(last) {
+			err = errors.Errorf("not newer than the last accepted announcement of %s", announcement.Scheme)
+		}
 	}
+	if err != nil {
+		return nil, server.LogWarning(server.ErrorInvalidRequest.Wrap(
+			errors.WrapPrefix(err, "Dropping scheme update announcement", 0)))
+	}
+	id := announcement.Scheme
+	if s.announcements == nil {
+		s.announcements = map[irma.SchemeManagerIdentifier]time.Time{}
+	}
+	s.announcements[id] = time.Time(announcement.Timestamp)
+
+	s.conf.Logger.WithField("scheme", id).Info("Updating scheme after update announcement")
+	conf, diff, err := current.UpdateSchemeSnapshot(id)
+	if conf != nil {
+		s.conf.Logger.WithField("scheme", id).Info("Updated scheme")
+		s.conf.SetCurrentIrmaConfiguration(conf)
+	}
+	if err != nil {
+		return nil, server.LogError(server.ErrorUnknown.Wrap(err))
+	}
+	if diff.Configuration == nil {
+		return &irma.ConfigurationDiff{}, nil
+	}
+	return diff.Configuration, nil
+}
+
+// removeScheme removes the specified scheme from storage and from a new snapshot of the schemes,
+// which then becomes the current one. This is refused while unfinished sessions refer to the scheme.
+func (s *Server) removeScheme(id irma.SchemeManagerIdentifier) error {
+	s.schemesLock.Lock()
+	defer s.schemesLock.Unlock()
 
+	current := s.conf.CurrentIrmaConfiguration()
+	if _, ok := current.SchemeManagers[id]; !ok {
+		return errors.Errorf("unknown scheme manager %s", id)
+	}
+	if s.sessions.active(id) {
+		return errors.Errorf("cannot remove scheme manager %s: it is used by sessions in progress", id)
+	}
+	conf, err := current.Reparse()
+	if err != nil {
+		return err
+	}
+	s.conf.Logger.WithField("scheme", id).Info("Removing scheme")
+	if err = conf.RemoveScheme(id); err != nil {
+		return err
+	}
+	s.conf.SetCurrentIrmaConfiguration(conf)
 	return nil
 }
 
+// reloadSchemes re-parses the schemes into a new snapshot if they were changed on disk, which then
+// becomes the current one, so that sessions using the previous snapshot are unaffected.
+func (s *Server) reloadSchemes() (*irma.ConfigurationDiff, error) {
+	s.schemesLock.Lock()
+	defer s.schemesLock.Unlock()
+
+	current := s.conf.CurrentIrmaConfiguration()
+	conf, err := current.ReloadSnapshot()
+	if err != nil {
+		s.setReloadStatus(err)
+		return nil, err
+	}
+	if conf == nil {
+		return &irma.ConfigurationDiff{}, nil
+	}
+	diff := current.Diff(conf)
+	for _, id := range append(append(diff.AddedSchemeManagers, diff.ChangedSchemeManagers...), diff.RemovedSchemeManagers...) {
+		s.conf.Logger.WithField("scheme", id).Info("Reloaded scheme")
+	}
+	s.conf.SetCurrentIrmaConfiguration(conf)
+	s.setReloadStatus(nil)
+	return diff, nil
+}
+
+// setReloadStatus records the outcome of an attempt to reload the schemes.
+func (s *Server) setReloadStatus(err error) {
+	s.reloadStatusLock.Lock()
+	defer s.reloadStatusLock.Unlock()
+	if err != nil {
+		s.reloadStatus.ReloadError = err.Error()
+		return
+	}
+	now := irma.Timestamp(time.Now())
+	s.reloadStatus = server.SchemesReloadStatus{LastReload: &now}
+}
+
 func (session *session) getProofP(commitments *irma.IssueCommitmentMessage, scheme irma.SchemeManagerIdentifier) (*gabi.ProofP, error) {
 	if session.kssProofs == nil {
 		session.kssProofs = make(map[irma.SchemeManagerIdentifier]*gabi.ProofP)
@@ -102,7 +552,7 @@ func (session *session) getProofP(commitments *irma.IssueCommitmentMessage, sche
 			jwt.StandardClaims
 			ProofP *gabi.ProofP
 		}{}
-		token, err := jwt.ParseWithClaims(str, claims, session.conf.IrmaConfiguration.KeyshareServerKeyFunc(scheme))
+		token, err := jwt.ParseWithClaims(str, claims, session.irmaConfiguration.KeyshareServerKeyFunc(scheme))
 		if err != nil {
 			return nil, err
 		}
@@ -130,14 +580,25 @@ func (session *session) eventSource() eventsource.EventSource {
 // Other
 
 func chooseProtocolVersion(min, max *irma.ProtocolVersion) (*irma.ProtocolVersion, error) {
-	if min.AboveVersion(maxProtocolVersion) || max.BelowVersion(minProtocolVersion) || max.BelowVersion(min) {
-		return nil, server.LogWarning(errors.Errorf("Protocol version negotiation failed, min=%s max=%s", min.String(), max.String()))
+	version, err := irma.NegotiateProtocolVersion(min, max)
+	if err != nil {
+		return nil, server.LogWarning(err)
+	}
+	return version, nil
+}
+
+// jsonResponse JSON-marshals the specified message or error like server.JsonResponse(), but in
+// the wire format of the protocol version of the session (see irma.MarshalMessage()).
+func (session *session) jsonResponse(v interface{}, rerr *irma.RemoteError) (int, []byte) {
+	if rerr != nil {
+		return server.JsonResponse(nil, rerr)
 	}
-	if max.AboveVersion(maxProtocolVersion) {
-		return maxProtocolVersion, nil
-	} else {
-		return max, nil
+	bts, err := irma.MarshalMessage(session.version, v)
+	if err != nil {
+		session.conf.Logger.Error("Failed to serialize response: ", err.Error())
+		return http.StatusInternalServerError, nil
 	}
+	return http.StatusOK, bts
 }
 
 // purgeRequest logs the request excluding any attribute values.
@@ -156,6 +617,7 @@ func purgeRequest(request irma.RequestorRequest) irma.RequestorRequest {
 	attrs := cpy.(irma.RequestorRequest).SessionRequest().ToDisclose()
 	for _, disjunction := range attrs {
 		disjunction.Values = nil
+		disjunction.AllowedValues = nil
 	}
 	// Remove attribute values from attributes to be issued
 	if isreq, ok := cpy.(*irma.IdentityProviderRequest); ok {
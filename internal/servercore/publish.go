@@ -0,0 +1,129 @@
+package servercore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// Delays between the attempts to publish a session result, doubling after each failed attempt.
+var (
+	publishRetryDelay    = 100 * time.Millisecond
+	publishMaxRetryDelay = 30 * time.Second
+)
+
+// resultPublisher delivers the results of finished sessions to the server.ResultPublisher of the
+// configuration, one at a time in the order in which the sessions finished, retrying each result
+// until it is published (see server.Configuration.ResultPublisher).
+type resultPublisher struct {
+	publisher server.ResultPublisher
+	attempts  int
+	logger    *logrus.Logger
+
+	mutex sync.Mutex
+	queue []*server.SessionResult
+	wake  chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newResultPublisher(conf *server.Configuration) *resultPublisher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &resultPublisher{
+		publisher: conf.ResultPublisher,
+		attempts:  conf.ResultPublishAttempts,
+		logger:    conf.Logger,
+		wake:      make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// enqueue schedules the specified result for publishing. It does not block.
+func (p *resultPublisher) enqueue(result *server.SessionResult) {
+	p.mutex.Lock()
+	p.queue = append(p.queue, result)
+	p.mutex.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop stops publishing, aborting the current attempt. Results not yet published are lost.
+func (p *resultPublisher) stop() {
+	p.cancel()
+	<-p.done
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, result := range p.queue {
+		p.logger.WithFields(logrus.Fields{"session": result.Token}).Warn("Session result not published before stopping")
+	}
+	p.queue = nil
+}
+
+func (p *resultPublisher) run() {
+	defer close(p.done)
+	for {
+		p.mutex.Lock()
+		var result *server.SessionResult
+		if len(p.queue) > 0 {
+			result = p.queue[0]
+		}
+		p.mutex.Unlock()
+
+		if result == nil {
+			select {
+			case <-p.wake:
+				continue
+			case <-p.ctx.Done():
+				return
+			}
+		}
+		if !p.publish(result) {
+			return
+		}
+		p.mutex.Lock()
+		p.queue = p.queue[1:]
+		p.mutex.Unlock()
+	}
+}
+
+// publish attempts to publish the result until it succeeds or the attempts run out,
+// returning false if the publisher was stopped in the meantime.
+func (p *resultPublisher) publish(result *server.SessionResult) bool {
+	delay := publishRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := p.publisher.Publish(p.ctx, result)
+		if err == nil {
+			p.logger.WithFields(logrus.Fields{"session": result.Token}).Debug("Session result published")
+			return true
+		}
+		if p.ctx.Err() != nil {
+			return false
+		}
+		fields := logrus.Fields{"session": result.Token, "attempt": attempt}
+		if attempt >= p.attempts {
+			p.logger.WithFields(fields).Error("Failed to publish session result, giving up: ", err.Error())
+			return true
+		}
+		p.logger.WithFields(fields).Warn("Failed to publish session result, retrying: ", err.Error())
+
+		select {
+		case <-time.After(delay):
+		case <-p.ctx.Done():
+			return false
+		}
+		if delay *= 2; delay > publishMaxRetryDelay {
+			delay = publishMaxRetryDelay
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package servercore
 
 import (
+	"context"
 	"crypto/rand"
 	"sync"
 	"time"
@@ -16,6 +17,11 @@ import (
 type session struct {
 	sync.Mutex
 
+	// Done when the session reaches a terminal status or the server stops, aborting the
+	// handling of requests of the session that are still in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	action      irma.Action
 	token       string
 	clientToken string
@@ -29,18 +35,37 @@ type session struct {
 
 	lastActive time.Time
 	result     *server.SessionResult
+	// When the current session pointer of the session was issued
+	ptrIssued time.Time
 
 	kssProofs map[irma.SchemeManagerIdentifier]*gabi.ProofP
 
-	conf     *server.Configuration
-	sessions sessionStore
+	// Signatures of the previous sessions of the multi-party signature the session is part of, if any
+	multiSigned *irma.MultiSignedMessage
+
+	// Hash of the proofs or commitments posted by the client and our response to them
+	postedHash   []byte
+	postedStatus int
+	postedOutput []byte
+
+	conf      *server.Configuration
+	sessions  sessionStore
+	publisher *resultPublisher // nil if session results are not published
+	// Snapshot of the schemes that was current when the session started, used throughout the
+	// session also if the schemes are updated in the meantime
+	irmaConfiguration *irma.Configuration
 }
 
+// sessionStore stores the sessions of the server. Its methods taking a context return the error
+// of the context if it is done before they finish. Updates are never abandoned halfway, so that
+// the stored session does not end up in an inconsistent state.
 type sessionStore interface {
-	get(token string) *session
-	clientGet(token string) *session
-	add(session *session)
+	get(ctx context.Context, token string) (*session, error)
+	clientGet(ctx context.Context, token string) (*session, error)
+	add(ctx context.Context, session *session) error
 	update(session *session)
+	renewClientToken(session *session, clientToken string) bool
+	active(scheme irma.SchemeManagerIdentifier) bool
 	deleteExpired()
 	stop()
 }
@@ -58,34 +83,72 @@ const (
 	sessionChars       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 )
 
-var (
-	minProtocolVersion = irma.NewVersion(2, 4)
-	maxProtocolVersion = irma.NewVersion(2, 4)
-)
-
-func (s *memorySessionStore) get(t string) *session {
+func (s *memorySessionStore) get(ctx context.Context, t string) (*session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	s.RLock()
 	defer s.RUnlock()
-	return s.requestor[t]
+	return s.requestor[t], nil
 }
 
-func (s *memorySessionStore) clientGet(t string) *session {
+func (s *memorySessionStore) clientGet(ctx context.Context, t string) (*session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	s.RLock()
 	defer s.RUnlock()
-	return s.client[t]
+	return s.client[t], nil
 }
 
-func (s *memorySessionStore) add(session *session) {
+func (s *memorySessionStore) add(ctx context.Context, session *session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	s.Lock()
 	defer s.Unlock()
 	s.requestor[session.token] = session
 	s.client[session.clientToken] = session
+	return nil
 }
 
 func (s *memorySessionStore) update(session *session) {
 	session.onUpdate()
 }
 
+// renewClientToken replaces the client token of the session, invalidating the previous one,
+// unless the client already connected to the session. It returns whether it did.
+func (s *memorySessionStore) renewClientToken(session *session, clientToken string) bool {
+	s.Lock()
+	defer s.Unlock()
+	session.Lock()
+	defer session.Unlock()
+
+	if session.status != server.StatusInitialized {
+		return false
+	}
+	delete(s.client, session.clientToken)
+	session.clientToken = clientToken
+	s.client[clientToken] = session
+	return true
+}
+
+// active returns whether any unfinished session refers to the specified scheme.
+func (s *memorySessionStore) active(scheme irma.SchemeManagerIdentifier) bool {
+	s.RLock()
+	defer s.RUnlock()
+	for _, session := range s.requestor {
+		session.Lock()
+		_, uses := session.request.Identifiers().SchemeManagers[scheme]
+		active := uses && !session.status.Finished()
+		session.Unlock()
+		if active {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *memorySessionStore) stop() {
 	s.Lock()
 	defer s.Unlock()
@@ -103,13 +166,7 @@ func (s *memorySessionStore) deleteExpired() {
 	expired := make([]string, 0, len(s.requestor))
 	for token, session := range s.requestor {
 		session.Lock()
-
-		timeout := maxSessionLifetime
-		if session.status == server.StatusInitialized && session.rrequest.Base().ClientTimeout != 0 {
-			timeout = time.Duration(session.rrequest.Base().ClientTimeout) * time.Second
-		}
-
-		if session.lastActive.Add(timeout).Before(time.Now()) {
+		if session.lastActive.Add(session.timeout()).Before(time.Now()) {
 			if !session.status.Finished() {
 				s.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Infof("Session expired")
 				session.markAlive()
@@ -138,35 +195,45 @@ func (s *memorySessionStore) deleteExpired() {
 
 var one *big.Int = big.NewInt(1)
 
-func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *session {
+func (s *Server) newSession(ctx context.Context, action irma.Action, request irma.RequestorRequest) (*session, error) {
 	token := newSessionToken()
 	clientToken := newSessionToken()
+	irmaconf := s.conf.CurrentIrmaConfiguration()
 
 	ses := &session{
 		action:      action,
 		rrequest:    request,
 		request:     request.SessionRequest(),
 		lastActive:  time.Now(),
+		ptrIssued:   time.Now(),
 		token:       token,
 		clientToken: clientToken,
 		status:      server.StatusInitialized,
 		prevStatus:  server.StatusInitialized,
 		conf:        s.conf,
 		sessions:    s.sessions,
+		publisher:   s.publisher,
 		result: &server.SessionResult{
-			Token:  token,
-			Type:   action,
-			Status: server.StatusInitialized,
+			Token:         token,
+			Type:          action,
+			Status:        server.StatusInitialized,
+			NonProduction: request.SessionRequest().Identifiers().Development(irmaconf),
+			Legacy:        request.Base().Legacy,
 		},
+		irmaConfiguration: irmaconf,
 	}
+	ses.ctx, ses.cancel = context.WithCancel(s.ctx)
 
 	s.conf.Logger.WithFields(logrus.Fields{"session": ses.token}).Debug("New session started")
 	nonce, _ := gabi.RandomBigInt(gabi.DefaultSystemParameters[2048].Lstatzk)
 	ses.request.SetNonce(nonce)
 	ses.request.SetContext(one)
-	s.sessions.add(ses)
+	if err := s.sessions.add(ctx, ses); err != nil {
+		ses.cancel()
+		return nil, err
+	}
 
-	return ses
+	return ses, nil
 }
 
 func newSessionToken() string {
@@ -13,10 +13,15 @@ import (
 type TestClientHandler struct {
 	t *testing.T
 	c chan error
+
+	resumable []*irmaclient.ResumableSession
 }
 
 func (i *TestClientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {}
 func (i *TestClientHandler) UpdateAttributes()                               {}
+func (i *TestClientHandler) ResumableSessions(sessions []*irmaclient.ResumableSession) {
+	i.resumable = sessions
+}
 func (i *TestClientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
 	select {
 	case i.c <- nil: // nop
@@ -30,6 +35,13 @@ func (i *TestClientHandler) EnrollmentFailure(manager irma.SchemeManagerIdentifi
 		i.t.Fatal(err)
 	}
 }
+func (i *TestClientHandler) KeyshareEnrollmentInvalid(manager irma.SchemeManagerIdentifier, err error) {
+	select {
+	case i.c <- err: // nop
+	default:
+		i.t.Fatal(err)
+	}
+}
 func (i *TestClientHandler) ChangePinSuccess(manager irma.SchemeManagerIdentifier) {
 	select {
 	case i.c <- nil: // nop
@@ -87,14 +99,14 @@ func (th TestHandler) Cancelled() {
 	th.Failure(&irma.SessionError{Err: errors.New("Cancelled")})
 }
 func (th TestHandler) Failure(err *irma.SessionError) {
-	th.t.Logf("Session failed: %+v\n", *err)
+	th.t.Logf("Session failed: %s\n", err.Error())
 	select {
 	case th.c <- &SessionResult{Err: err}:
 	default:
 		th.t.Fatal(err)
 	}
 }
-func (th TestHandler) UnsatisfiableRequest(serverName irma.TranslatedString, missing irma.AttributeDisjunctionList) {
+func (th TestHandler) UnsatisfiableRequest(serverName irma.TranslatedString, missing []*irmaclient.MissingDisjunction) {
 	th.Failure(&irma.SessionError{
 		ErrorType: irma.ErrorType("UnsatisfiableRequest"),
 	})
@@ -106,6 +118,10 @@ func (th TestHandler) RequestVerificationPermission(request irma.DisclosureReque
 	var candidates []*irma.AttributeIdentifier
 	for _, disjunction := range request.Content {
 		candidates = th.client.Candidates(disjunction)
+		if len(candidates) == 0 && disjunction.Optional {
+			choice.Attributes = append(choice.Attributes, nil) // skip it
+			continue
+		}
 		if len(candidates) == 0 {
 			th.Failure(&irma.SessionError{Err: errors.New("No disclosure candidates found")})
 		}
@@ -129,10 +145,43 @@ func (th TestHandler) RequestSignaturePermission(request irma.SignatureRequest,
 func (th TestHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
 	callback(true)
 }
+func (th TestHandler) RequestSchemeManagerInstallPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	callback(true)
+}
+func (th TestHandler) RequestThrottledSessionConfirmation(origin string, sessions int, callback func(proceed bool)) {
+	callback(true)
+}
 func (th TestHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
 	callback(true, "12345")
 }
 
+// ReissueTestHandler embeds a TestHandler, specifying what to do with existing instances
+// of the credential types being issued.
+type ReissueTestHandler struct {
+	TestHandler
+	reissue map[irma.CredentialTypeIdentifier]*irma.ReissueChoice
+}
+
+func (th ReissueTestHandler) RequestIssuancePermission(request irma.IssuanceRequest, ServerName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	th.TestHandler.RequestIssuancePermission(request, ServerName, func(proceed bool, choice *irma.DisclosureChoice) {
+		choice.Reissue = th.reissue
+		callback(proceed, choice)
+	})
+}
+
+// ThrottleTestHandler embeds a TestHandler, confirming sessions of throttled requestors and
+// sending the number of sessions of the requestor on confirmations.
+type ThrottleTestHandler struct {
+	TestHandler
+	confirmations chan int
+}
+
+func (th ThrottleTestHandler) RequestThrottledSessionConfirmation(origin string, sessions int, callback func(proceed bool)) {
+	require.Equal(th.t, "localhost", origin)
+	th.confirmations <- sessions
+	callback(true)
+}
+
 type SessionResult struct {
 	Err              error
 	SignatureResult  *irma.SignedMessage
@@ -187,10 +236,44 @@ func (th *ManualTestHandler) RequestIssuancePermission(request irma.IssuanceRequ
 func (th *ManualTestHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
 	th.Failure(&irma.SessionError{Err: errors.New("Unexpected session type")})
 }
+func (th *ManualTestHandler) RequestSchemeManagerInstallPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	th.Failure(&irma.SessionError{Err: errors.New("Unexpected scheme manager installation")})
+}
 func (th *ManualTestHandler) RequestVerificationPermission(request irma.DisclosureRequest, verifierName irma.TranslatedString, ph irmaclient.PermissionHandler) {
 	var choice irma.DisclosureChoice
 	for _, cand := range request.Candidates {
+		if len(cand) == 0 {
+			choice.Attributes = append(choice.Attributes, nil) // skip optional disjunction
+			continue
+		}
 		choice.Attributes = append(choice.Attributes, cand[0])
 	}
 	ph(true, &choice)
 }
+
+// PausingTestHandler embeds a TestHandler, never answering requests for permission but
+// signaling on paused instead, simulating the app being stopped while the user decides.
+type PausingTestHandler struct {
+	TestHandler
+	paused chan struct{}
+}
+
+func (th PausingTestHandler) RequestVerificationPermission(request irma.DisclosureRequest, ServerName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	th.paused <- struct{}{}
+}
+
+// CancellingTestHandler embeds a TestHandler, refusing permission for disclosure sessions and
+// for installing scheme managers, and reporting the subsequent cancellation of the session as success.
+type CancellingTestHandler struct {
+	TestHandler
+}
+
+func (th CancellingTestHandler) RequestVerificationPermission(request irma.DisclosureRequest, ServerName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	callback(false, nil)
+}
+func (th CancellingTestHandler) RequestSchemeManagerInstallPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	callback(false)
+}
+func (th CancellingTestHandler) Cancelled() {
+	th.c <- nil
+}
@@ -1,8 +1,9 @@
-// +build !local_tests
-
 package sessiontest
 
 import (
+	"net/http"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/privacybydesign/irmago"
@@ -12,6 +13,8 @@ import (
 )
 
 func TestManualKeyshareSession(t *testing.T) {
+	StartKeyshareServer(t)
+	defer StopKeyshareServer()
 	request := "{\"nonce\": 0, \"context\": 0, \"type\": \"signing\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"test.test.mijnirma.email\"]}]}"
 	ms := createManualSessionHandler(t, nil)
 
@@ -26,6 +29,8 @@ func TestRequestorIssuanceKeyshareSession(t *testing.T) {
 }
 
 func TestKeyshareRegister(t *testing.T) {
+	StartKeyshareServer(t)
+	defer StopKeyshareServer()
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t)
 
@@ -41,10 +46,54 @@ func TestKeyshareRegister(t *testing.T) {
 	keyshareSessions(t, client)
 }
 
+// countingRoundTripper counts the requests sent through it per host.
+type countingRoundTripper struct {
+	sync.Mutex
+	hosts map[string]int
+}
+
+func (rt *countingRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt.Lock()
+	rt.hosts[r.URL.Host]++
+	rt.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestKeyshareIssuanceCustomTransport(t *testing.T) {
+	StartKeyshareServer(t)
+	defer StopKeyshareServer()
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	rt := &countingRoundTripper{hosts: map[string]int{}}
+	path := test.FindTestdataFolder(t)
+	client, err := irmaclient.NewWithOptions(
+		filepath.Join(path, "storage", "test"),
+		filepath.Join(path, "irma_configuration"),
+		"",
+		&TestClientHandler{t: t, c: make(chan error)},
+		irmaclient.Options{Transport: rt},
+	)
+	require.NoError(t, err)
+
+	expiry := irma.Timestamp(irma.NewMetadataAttribute(0).Expiry())
+	request := getIssuanceRequest(true)
+	request.Credentials = append(request.Credentials, &irma.CredentialRequest{
+		Validity:         &expiry,
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("test.test.mijnirma"),
+		Attributes:       map[string]string{"email": "testusername"},
+	})
+	sessionHelper(t, request, "issue", client)
+
+	require.NotZero(t, rt.hosts["localhost:48682"], "requests to IRMA server did not use custom transport")
+	require.NotZero(t, rt.hosts["localhost:8080"], "requests to keyshare server did not use custom transport")
+}
+
 // Use the existing keyshare enrollment and credentials
 // in a keyshare session of each session type.
-// Use keyshareuser.sql to enroll the user at the keyshare server.
 func TestKeyshareSessions(t *testing.T) {
+	StartKeyshareServer(t)
+	defer StopKeyshareServer()
 	client, _ := parseStorage(t)
 	defer test.ClearTestStorage(t)
 	keyshareSessions(t, client)
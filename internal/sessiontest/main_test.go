@@ -37,6 +37,11 @@ func TestMain(m *testing.M) {
 
 func parseStorage(t *testing.T) (*irmaclient.Client, *TestClientHandler) {
 	test.SetupTestStorage(t)
+	return parseExistingStorage(t)
+}
+
+// parseExistingStorage constructs a client over the test storage without resetting it first.
+func parseExistingStorage(t *testing.T) (*irmaclient.Client, *TestClientHandler) {
 	handler := &TestClientHandler{t: t, c: make(chan error)}
 	path := test.FindTestdataFolder(t)
 	client, err := irmaclient.New(
@@ -224,6 +229,18 @@ func getJwt(t *testing.T, request irma.SessionRequest, sessiontype string, alg j
 }
 
 func sessionHelper(t *testing.T, request irma.SessionRequest, sessiontype string, client *irmaclient.Client) {
+	sessionHelperWithHandler(t, request, sessiontype, client, nil)
+}
+
+// sessionHelperWithHandler is like sessionHelper, but if specified, uses wrap to construct
+// the handler used in the session out of the default TestHandler.
+func sessionHelperWithHandler(
+	t *testing.T,
+	request irma.SessionRequest,
+	sessiontype string,
+	client *irmaclient.Client,
+	wrap func(TestHandler) irmaclient.Handler,
+) {
 	if client == nil {
 		client, _ = parseStorage(t)
 		defer test.ClearTestStorage(t)
@@ -237,7 +254,10 @@ func sessionHelper(t *testing.T, request irma.SessionRequest, sessiontype string
 	qr := startSession(t, request, sessiontype)
 
 	c := make(chan *SessionResult)
-	h := TestHandler{t, c, client, expectedServerName(t, request, client.Configuration)}
+	var h irmaclient.Handler = TestHandler{t, c, client, expectedServerName(t, request, client.Configuration)}
+	if wrap != nil {
+		h = wrap(h.(TestHandler))
+	}
 	qrjson, err := json.Marshal(qr)
 	require.NoError(t, err)
 	client.NewSession(string(qrjson), h)
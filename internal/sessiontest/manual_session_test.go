@@ -101,15 +101,54 @@ func TestManualSessionInvalidRequest(t *testing.T) {
 	require.Equal(t, irma.AttributeProofStatusExtra, attrs[1].Status)
 }
 
-// Test if proof verification fails with status 'MISSING_ATTRIBUTES' if we provide it with invalid attribute values
+// Test if proof verification fails with status 'UNSATISFIED_CONDITION' if we provide it with invalid attribute values
 func TestManualSessionInvalidAttributeValue(t *testing.T) {
 	request := "{\"nonce\": 0, \"context\": 0, \"type\": \"signing\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":{\"irma-demo.RU.studentCard.studentID\": \"456\"}}]}"
 	invalidRequest := "{\"nonce\": 0, \"context\": 0, \"type\": \"signing\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":{\"irma-demo.RU.studentCard.studentID\": \"123\"}}]}"
 	ms := createManualSessionHandler(t, nil)
 	attrs, status := manualSessionHelper(t, nil, ms, request, invalidRequest, false)
 
-	require.Equal(t, irma.ProofStatusMissingAttributes, status)
+	require.Equal(t, irma.ProofStatusUnsatisfiedCondition, status)
+	require.Equal(t, irma.AttributeProofStatusInvalidValue, attrs[0].Status)
+	require.Equal(t, irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), attrs[0].Identifier)
+}
+
+// Test the verification of disclosed attributes against a list of allowed values. The client
+// discloses its attribute regardless of the values, as older clients unaware of them would.
+func TestManualDisclosureSessionAllowedAttributeValues(t *testing.T) {
+	request := "{\"nonce\": 0, \"context\": 0, \"type\": \"disclosing\", \"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]}]}"
+	allowed := "{\"nonce\": 0, \"context\": 0, \"type\": \"disclosing\", \"content\":[{\"label\":\"Student number (RU)\",\"attributes\":{\"irma-demo.RU.studentCard.studentID\": [\"123\", \"456\"]}}]}"
+	notAllowed := "{\"nonce\": 0, \"context\": 0, \"type\": \"disclosing\", \"content\":[{\"label\":\"Student number (RU)\",\"attributes\":{\"irma-demo.RU.studentCard.studentID\": [\"123\", \"789\"]}}]}"
+
+	ms := createManualSessionHandler(t, nil)
+	attrs, status := manualSessionHelper(t, nil, ms, request, allowed, false)
+	require.Equal(t, irma.ProofStatusValid, status)
+	require.Equal(t, irma.AttributeProofStatusPresent, attrs[0].Status)
+
+	ms = createManualSessionHandler(t, nil)
+	attrs, status = manualSessionHelper(t, nil, ms, request, notAllowed, false)
+	require.Equal(t, irma.ProofStatusUnsatisfiedCondition, status)
 	require.Equal(t, irma.AttributeProofStatusInvalidValue, attrs[0].Status)
+	require.Equal(t, irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), attrs[0].Identifier)
+	require.Equal(t, "456", attrs[0].Value["en"])
+}
+
+// Test that a signature skipping an optional disjunction is valid against its request,
+// but not against a request in which that disjunction is mandatory
+func TestManualSigningSessionSkippedOptional(t *testing.T) {
+	request := "{\"nonce\": 0, \"context\": 0, \"type\": \"signing\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]},{\"label\":\"Name\",\"attributes\":[\"irma-demo.MijnOverheid.fullName.firstname\"],\"optional\":true}]}"
+	mandatory := "{\"nonce\": 0, \"context\": 0, \"type\": \"signing\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]},{\"label\":\"Name\",\"attributes\":[\"irma-demo.MijnOverheid.fullName.firstname\"]}]}"
+
+	ms := createManualSessionHandler(t, nil)
+	attrs, status := manualSessionHelper(t, nil, ms, request, request, false)
+	require.Equal(t, irma.ProofStatusValid, status)
+	require.Equal(t, irma.AttributeProofStatusPresent, attrs[0].Status)
+	require.Equal(t, irma.AttributeProofStatusSkipped, attrs[1].Status)
+
+	ms = createManualSessionHandler(t, nil)
+	attrs, status = manualSessionHelper(t, nil, ms, request, mandatory, false)
+	require.Equal(t, irma.ProofStatusMissingAttributes, status)
+	require.Equal(t, irma.AttributeProofStatusMissing, attrs[1].Status)
 }
 
 func TestManualSessionMultiProof(t *testing.T) {
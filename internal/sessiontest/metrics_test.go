@@ -0,0 +1,115 @@
+package sessiontest
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMetricsCollector is an irmaclient.MetricsCollector recording everything it is notified of.
+type TestMetricsCollector struct {
+	sync.Mutex
+	started       []irma.Action
+	stages        map[irma.ErrorStage]int
+	finished      []finishedSession
+	credentials   []int
+	schemeUpdates []irmaclient.SchemeUpdateOutcome
+}
+
+type finishedSession struct {
+	action    irma.Action
+	outcome   irmaclient.SessionOutcome
+	errorType irma.ErrorType
+}
+
+func (m *TestMetricsCollector) SessionStarted(action irma.Action) {
+	m.Lock()
+	defer m.Unlock()
+	m.started = append(m.started, action)
+}
+
+func (m *TestMetricsCollector) SessionStage(action irma.Action, stage irma.ErrorStage) {
+	m.Lock()
+	defer m.Unlock()
+	m.stages[stage]++
+}
+
+func (m *TestMetricsCollector) SessionFinished(action irma.Action, outcome irmaclient.SessionOutcome, errorType irma.ErrorType, duration time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.finished = append(m.finished, finishedSession{action, outcome, errorType})
+}
+
+func (m *TestMetricsCollector) CredentialCount(count int) {
+	m.Lock()
+	defer m.Unlock()
+	m.credentials = append(m.credentials, count)
+}
+
+func (m *TestMetricsCollector) SchemeUpdate(outcome irmaclient.SchemeUpdateOutcome) {
+	m.Lock()
+	defer m.Unlock()
+	m.schemeUpdates = append(m.schemeUpdates, outcome)
+}
+
+func TestMetrics(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	metrics := &TestMetricsCollector{stages: map[irma.ErrorStage]int{}}
+	path := test.FindTestdataFolder(t)
+	client, err := irmaclient.NewWithOptions(
+		filepath.Join(path, "storage", "test"),
+		filepath.Join(path, "irma_configuration"),
+		"",
+		&TestClientHandler{t: t, c: make(chan error)},
+		irmaclient.Options{Metrics: metrics},
+	)
+	require.NoError(t, err)
+	require.Len(t, metrics.credentials, 1)
+	initial := metrics.credentials[0]
+
+	// A successful disclosure and issuance session
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	sessionHelper(t, getDisclosureRequest(id), "verification", client)
+	sessionHelper(t, getIssuanceRequest(true), "issue", client)
+
+	// A session refused by the user
+	StartRequestorServer(JwtServerConfiguration)
+	qrjson, err := json.Marshal(startSession(t, getDisclosureRequest(id), "verification"))
+	require.NoError(t, err)
+	c := make(chan *SessionResult)
+	client.NewSession(string(qrjson), CancellingTestHandler{TestHandler{t: t, c: c, client: client}})
+	require.Nil(t, <-c)
+	StopRequestorServer()
+
+	// A session at a server that cannot be reached
+	c = make(chan *SessionResult, 1)
+	client.NewSession(`{"u":"http://localhost:1/irma/session/foo","irmaqr":"disclosing"}`, TestHandler{t: t, c: c, client: client})
+	require.Error(t, (<-c).Err)
+
+	_, err = client.UpdateSchemes()
+	require.NoError(t, err)
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	require.Equal(t, []irma.Action{
+		irma.ActionDisclosing, irma.ActionIssuing, irma.ActionDisclosing, irma.ActionDisclosing,
+	}, metrics.started)
+	require.Equal(t, []finishedSession{
+		{irma.ActionDisclosing, irmaclient.SessionOutcomeSuccess, ""},
+		{irma.ActionIssuing, irmaclient.SessionOutcomeSuccess, ""},
+		{irma.ActionDisclosing, irmaclient.SessionOutcomeCancelled, ""},
+		{irma.ActionDisclosing, irmaclient.SessionOutcomeNetworkFailure, irma.ErrorTransport},
+	}, metrics.finished)
+	require.Equal(t, 3, metrics.stages[irma.ErrorStageConfiguration])
+	require.Equal(t, 2, metrics.stages[irma.ErrorStageResponse])
+	require.True(t, metrics.credentials[len(metrics.credentials)-1] > initial)
+	require.Equal(t, []irmaclient.SchemeUpdateOutcome{irmaclient.SchemeUpdateOutcomeUnchanged}, metrics.schemeUpdates)
+}
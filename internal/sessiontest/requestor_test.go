@@ -1,12 +1,34 @@
 package sessiontest
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	gobig "math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/requestorserver"
 	"github.com/stretchr/testify/require"
 )
 
@@ -40,6 +62,24 @@ func requestorSessionHelper(t *testing.T, request irma.SessionRequest) *server.S
 	return serverResult
 }
 
+// clientSessionHelper performs a session with the running IRMA server using the specified client,
+// returning the session result of the server.
+func clientSessionHelper(t *testing.T, client *irmaclient.Client, request irma.SessionRequest) *server.SessionResult {
+	serverChan := make(chan *server.SessionResult)
+	qr, _, err := irmaServer.StartSession(request, func(result *server.SessionResult) {
+		serverChan <- result
+	})
+	require.NoError(t, err)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+	return <-serverChan
+}
+
 func TestRequestorSignatureSession(t *testing.T) {
 	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
 	serverResult := requestorSessionHelper(t, &irma.SignatureRequest{
@@ -90,6 +130,73 @@ func TestRequestorDisclosureMultipleAttrs(t *testing.T) {
 	require.Len(t, serverResult.Disclosed, 2)
 }
 
+func TestRequestorDisclosureOptional(t *testing.T) {
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	level := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	firstname := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname") // absent in the client
+	request := &irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
+		Content: irma.AttributeDisjunctionList([]*irma.AttributeDisjunction{
+			{Label: "foo", Attributes: []irma.AttributeTypeIdentifier{studentID}},
+			{Label: "bar", Attributes: []irma.AttributeTypeIdentifier{firstname}, Optional: true},
+			{Label: "baz", Attributes: []irma.AttributeTypeIdentifier{level}, Optional: true},
+		}),
+	}
+
+	serverResult := testRequestorDisclosure(t, request)
+	require.Len(t, serverResult.Disclosed, 3)
+	require.Equal(t, irma.AttributeProofStatusPresent, serverResult.Disclosed[0].Status)
+	require.Equal(t, irma.AttributeProofStatusSkipped, serverResult.Disclosed[1].Status)
+	require.Equal(t, irma.AttributeProofStatusPresent, serverResult.Disclosed[2].Status)
+	require.Equal(t, []int{2}, serverResult.SatisfiedOptional)
+	require.Equal(t, []int{1}, serverResult.SkippedOptional)
+}
+
+func TestRequestorSignatureSessionOptional(t *testing.T) {
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	firstname := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname") // absent in the client
+	serverResult := requestorSessionHelper(t, &irma.SignatureRequest{
+		Message: "message",
+		DisclosureRequest: irma.DisclosureRequest{
+			BaseRequest: irma.BaseRequest{Type: irma.ActionSigning},
+			Content: irma.AttributeDisjunctionList([]*irma.AttributeDisjunction{
+				{Label: "foo", Attributes: []irma.AttributeTypeIdentifier{studentID}},
+				{Label: "bar", Attributes: []irma.AttributeTypeIdentifier{firstname}, Optional: true},
+			}),
+		},
+	})
+
+	require.Nil(t, serverResult.Err)
+	require.Equal(t, irma.ProofStatusValid, serverResult.ProofStatus)
+	require.Empty(t, serverResult.SatisfiedOptional)
+	require.Equal(t, []int{1}, serverResult.SkippedOptional)
+	require.Equal(t, []int{1}, serverResult.Signature.SkippedDisjunctions())
+}
+
+func TestRequestorDisclosureWildcard(t *testing.T) {
+	wildcard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard").Wildcard()
+	request := &irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
+		Content: irma.AttributeDisjunctionList([]*irma.AttributeDisjunction{{
+			Label:      "foo",
+			Attributes: []irma.AttributeTypeIdentifier{wildcard},
+		}}),
+	}
+	serverResult := testRequestorDisclosure(t, request)
+
+	// The wildcard is satisfied by the credential, followed by all of its attributes
+	require.Equal(t, wildcard, serverResult.Disclosed[0].Identifier)
+	require.Equal(t, irma.AttributeProofStatusPresent, serverResult.Disclosed[0].Status)
+	values := map[irma.AttributeTypeIdentifier]string{}
+	for _, attr := range serverResult.Disclosed[1:] {
+		require.Equal(t, irma.AttributeProofStatusPresent, attr.Status)
+		require.Equal(t, wildcard.CredentialTypeIdentifier(), attr.Identifier.CredentialTypeIdentifier())
+		values[attr.Identifier] = attr.Value["en"]
+	}
+	require.Len(t, values, 4)
+	require.Equal(t, "456", values[irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")])
+}
+
 func testRequestorDisclosure(t *testing.T, request *irma.DisclosureRequest) *server.SessionResult {
 	serverResult := requestorSessionHelper(t, request)
 	require.Nil(t, serverResult.Err)
@@ -152,6 +259,8 @@ func testRequestorIssuance(t *testing.T, keyshare bool) {
 		},
 	}}
 	if keyshare {
+		StartKeyshareServer(t)
+		defer StopKeyshareServer()
 		request.Credentials = append(request.Credentials, &irma.CredentialRequest{
 			CredentialTypeID: irma.NewCredentialTypeIdentifier("test.test.mijnirma"),
 			Attributes:       map[string]string{"email": "testusername"},
@@ -169,3 +278,1109 @@ func testRequestorIssuance(t *testing.T, keyshare bool) {
 	require.Equal(t, attrid, result.Disclosed[0].Identifier)
 	require.Equal(t, "456", result.Disclosed[0].Value["en"])
 }
+
+func TestRequestorInstallsUnknownScheme(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+	testdata := test.FindTestdataFolder(t)
+	schemesPath := filepath.Join(testdata, "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join(testdata, "irma_configuration"), schemesPath))
+
+	conf := &server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           schemesPath,
+		DisableSchemesUpdate:  true,
+		InstallUnknownSchemes: true,
+	}
+	s, err := irmaserver.New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	pk, err := ioutil.ReadFile(filepath.Join(testdata, "irma_configuration_install", "test2", "pk.pem"))
+	require.NoError(t, err)
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("test2.issuer.card.number"))
+	request.SchemeManagers = map[irma.SchemeManagerIdentifier]*irma.SchemeManagerPointer{
+		irma.NewSchemeManagerIdentifier("test2"): {
+			Url:       "http://localhost:48681/irma_configuration_install/test2",
+			Publickey: pk,
+		},
+	}
+	_, _, err = s.StartSession(request, nil)
+	require.NoError(t, err)
+	require.Contains(t, conf.CurrentIrmaConfiguration().SchemeManagers, irma.NewSchemeManagerIdentifier("test2"))
+	require.Contains(t, conf.CurrentIrmaConfiguration().CredentialTypes, irma.NewCredentialTypeIdentifier("test2.issuer.card"))
+	// The scheme was installed into a new snapshot, leaving the one in use by earlier sessions untouched
+	require.NotContains(t, conf.IrmaConfiguration.SchemeManagers, irma.NewSchemeManagerIdentifier("test2"))
+
+	// Without a pointer, an unknown scheme manager cannot be installed
+	_, _, err = s.StartSession(getDisclosureRequest(irma.NewAttributeTypeIdentifier("test3.issuer.card.number")), nil)
+	require.Error(t, err)
+}
+
+func TestRequestorDevelopmentScheme(t *testing.T) {
+	conf := func(production bool) *server.Configuration {
+		return &server.Configuration{
+			URL:                  "http://localhost:48680",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+			DevelopmentSchemes:   []string{"irma-demo"},
+			Production:           production,
+		}
+	}
+
+	// Refused in production mode
+	_, err := irmaserver.New(conf(true))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "irma-demo")
+
+	startIrmaServer(t, conf(false))
+	defer StopIrmaServer()
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	serverChan := make(chan *server.SessionResult)
+	qr, _, err := irmaServer.StartSession(
+		getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+		func(result *server.SessionResult) { serverChan <- result },
+	)
+	require.NoError(t, err)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+
+	serverResult := <-serverChan
+	require.Equal(t, irma.ProofStatusValid, serverResult.ProofStatus)
+	require.True(t, serverResult.NonProduction)
+	require.Len(t, serverResult.Disclosed, 1)
+	require.True(t, serverResult.Disclosed[0].NonProduction)
+}
+
+func TestIssuanceDeprecatedCredentialType(t *testing.T) {
+	conf := &server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		DisableSchemesUpdate:  true,
+	}
+	s, err := irmaserver.New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	credtype := conf.IrmaConfiguration.CredentialTypes[irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")]
+	deprecated := irma.Timestamp(time.Now().Add(time.Hour))
+	credtype.DeprecatedSince = &deprecated
+
+	// Before the deprecation date
+	_, _, err = s.StartSession(getIssuanceRequest(true), nil)
+	require.NoError(t, err)
+
+	// After the deprecation date, issuance is refused but disclosure is unaffected
+	deprecated = irma.Timestamp(time.Now().Add(-time.Hour))
+	_, _, err = s.StartSession(getIssuanceRequest(true), nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "deprecated")
+	_, _, err = s.StartSession(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")), nil)
+	require.NoError(t, err)
+}
+
+// publishSchemeFiles writes the specified files, relative to the scheme in dir, into the scheme
+// and its index, signing the new index with the private key of the scheme.
+func publishSchemeFiles(t *testing.T, dir string, files map[string][]byte) {
+	id := filepath.Base(dir)
+	indexbts, err := ioutil.ReadFile(filepath.Join(dir, "index"))
+	require.NoError(t, err)
+	index := irma.SchemeManagerIndex{}
+	require.NoError(t, index.FromString(string(indexbts)))
+	for file, bts := range files {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(file)), bts, 0644))
+		hash := sha256.Sum256(bts)
+		index[id+"/"+file] = hash[:]
+	}
+	indexbts = []byte(index.String())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index"), indexbts, 0644))
+
+	skbts, err := ioutil.ReadFile(filepath.Join(dir, "sk.pem"))
+	require.NoError(t, err)
+	block, _ := pem.Decode(skbts)
+	require.NotNil(t, block)
+	sk, err := x509.ParseECPrivateKey(block.Bytes)
+	require.NoError(t, err)
+	hash := sha256.Sum256(indexbts)
+	r, s, err := ecdsa.Sign(rand.Reader, sk, hash[:])
+	require.NoError(t, err)
+	sig, err := asn1.Marshal([]*gobig.Int{r, s})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.sig"), sig, 0644))
+}
+
+// TestTypedAttributeValues checks that attribute values are validated against the type of their
+// attribute type when issuing, and that their typed values are included in session results if enabled.
+func TestTypedAttributeValues(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	conf := &server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		TypedAttributeValues:  true,
+	}
+	startIrmaServer(t, conf)
+	defer StopIrmaServer()
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	conf.CurrentIrmaConfiguration().AttributeTypes[studentID].Type = irma.AttributeValueTypeInteger
+
+	// The studentID in the issuance request is not an integer
+	_, _, err := irmaServer.StartSession(getIssuanceRequest(true), nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), studentID.String())
+
+	result := clientSessionHelper(t, client, getDisclosureRequest(studentID))
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, int64(456), result.Disclosed[0].TypedValue)
+	i, err := result.Disclosed[0].IntValue()
+	require.NoError(t, err)
+	require.Equal(t, int64(456), i)
+	_, err = result.Disclosed[0].BoolValue()
+	require.Error(t, err)
+}
+
+// TestIssuanceAfterSchemesReload checks that a public key that is added to a scheme on disk while
+// the server runs is used for issuance once the server has reloaded the schemes, without restarting.
+func TestIssuanceAfterSchemesReload(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	storage := filepath.Join(testdata, "storage", "test")
+	schemesPath := filepath.Join(storage, "schemes")
+	require.NoError(t, fs.CopyDirectory(filepath.Join(testdata, "irma_configuration"), schemesPath))
+	// The private key inventory contains key 3 of irma-demo.RU, which is not yet in the scheme
+	privkeysPath := filepath.Join(storage, "privatekeys")
+	require.NoError(t, fs.CopyDirectory(filepath.Join(testdata, "privatekeys"), privkeysPath))
+	sk, err := ioutil.ReadFile(filepath.Join(privkeysPath, "irma-demo.RU.xml"))
+	require.NoError(t, err)
+	sk = []byte(strings.Replace(string(sk), "<Counter>2</Counter>", "<Counter>3</Counter>", 1))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(privkeysPath, "irma-demo.RU.3.xml"), sk, 0644))
+
+	conf := &server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           schemesPath,
+		IssuerPrivateKeysPath: privkeysPath,
+		DisableSchemesUpdate:  true,
+		SchemesReloadInterval: 1,
+	}
+	startIrmaServer(t, conf)
+	defer StopIrmaServer()
+
+	issuerid := irma.NewIssuerIdentifier("irma-demo.RU")
+	key, err := conf.PrivateKey(issuerid)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), key.Counter)
+	diff, err := irmaServer.ReloadSchemes()
+	require.NoError(t, err)
+	require.True(t, diff.Empty())
+	require.Nil(t, irmaServer.SchemesReloadStatus().LastReload)
+
+	// Install a new version of irma-demo containing public key 3
+	pk, err := ioutil.ReadFile(filepath.Join(schemesPath, "irma-demo", "RU", "PublicKeys", "2.xml"))
+	require.NoError(t, err)
+	publishSchemeFiles(t, filepath.Join(schemesPath, "irma-demo"), map[string][]byte{
+		"RU/PublicKeys/3.xml": []byte(strings.Replace(string(pk), "<Counter>2</Counter>", "<Counter>3</Counter>", 1)),
+		"timestamp":           []byte(fmt.Sprintf("%d\n", time.Now().Unix())),
+	})
+
+	// Wait for the server to notice the new version
+	for i := 0; i < 50 && irmaServer.SchemesReloadStatus().LastReload == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	status := irmaServer.SchemesReloadStatus()
+	require.NotNil(t, status.LastReload)
+	require.Empty(t, status.ReloadError)
+	key, err = conf.PrivateKey(issuerid)
+	require.NoError(t, err)
+	require.Equal(t, uint(3), key.Counter)
+
+	// Issue using the new key, which the client fetches from the new version of the scheme
+	schemeid := irma.NewSchemeManagerIdentifier("irma-demo")
+	client.Configuration.SchemeManagers[schemeid].URL = "http://localhost:48681/storage/test/schemes/irma-demo"
+	require.Equal(t, server.StatusDone, clientSessionHelper(t, client, getIssuanceRequest(true)).Status)
+
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	var counter int
+	for i := 0; client.Attributes(credid, i) != nil; i++ {
+		counter = client.Attributes(credid, i).KeyCounter()
+	}
+	require.Equal(t, 3, counter)
+}
+
+// TestSchemeUpdateAnnouncement checks that a scheme update announcement posted to the requestor
+// server makes it update the announced scheme immediately, but only if it is validly signed.
+func TestSchemeUpdateAnnouncement(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Install a copy of irma-demo that updates from a remote in the test storage,
+	// served by the local scheme server, to which we publish a new version containing public key 3
+	storage := filepath.Join(testdata, "storage", "test")
+	schemesPath := filepath.Join(storage, "schemes")
+	require.NoError(t, fs.CopyDirectory(filepath.Join(testdata, "irma_configuration"), schemesPath))
+	description, err := ioutil.ReadFile(filepath.Join(schemesPath, "irma-demo", "description.xml"))
+	require.NoError(t, err)
+	publishSchemeFiles(t, filepath.Join(schemesPath, "irma-demo"), map[string][]byte{
+		"description.xml": []byte(strings.Replace(string(description),
+			"http://localhost:48681/irma_configuration/irma-demo",
+			"http://localhost:48681/storage/test/remote/irma-demo", 1)),
+	})
+	remote := filepath.Join(storage, "remote", "irma-demo")
+	require.NoError(t, fs.CopyDirectory(filepath.Join(schemesPath, "irma-demo"), remote))
+	pk, err := ioutil.ReadFile(filepath.Join(remote, "RU", "PublicKeys", "2.xml"))
+	require.NoError(t, err)
+	publishSchemeFiles(t, remote, map[string][]byte{
+		"RU/PublicKeys/3.xml": []byte(strings.Replace(string(pk), "<Counter>2</Counter>", "<Counter>3</Counter>", 1)),
+		"timestamp":           []byte(fmt.Sprintf("%d\n", time.Now().Unix())),
+	})
+
+	conf := &requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                   "http://localhost:48682/irma",
+			Logger:                logger,
+			SchemesPath:           schemesPath,
+			IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+			DisableSchemesUpdate:  true,
+		},
+		DisableRequestorAuthentication: true,
+		Port:                           48682,
+	}
+	StartRequestorServer(conf)
+	defer StopRequestorServer()
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	requireRejected := func(announcement *irma.SignedSchemeUpdateAnnouncement, status int) {
+		err := transport.Post("scheme-update", nil, announcement)
+		require.Error(t, err)
+		serr, ok := err.(*irma.SessionError)
+		require.True(t, ok)
+		require.NotNil(t, serr.RemoteError)
+		require.Equal(t, status, serr.RemoteError.Status)
+	}
+
+	issuerid := irma.NewIssuerIdentifier("irma-demo.RU")
+	requireKeys := func(expected []int) {
+		indices, err := conf.CurrentIrmaConfiguration().PublicKeyIndices(issuerid)
+		require.NoError(t, err)
+		require.ElementsMatch(t, expected, indices)
+	}
+	requireKeys([]int{2})
+
+	skbts, err := ioutil.ReadFile(filepath.Join(schemesPath, "irma-demo", "sk.pem"))
+	require.NoError(t, err)
+	block, _ := pem.Decode(skbts)
+	require.NotNil(t, block)
+	sk, err := x509.ParseECPrivateKey(block.Bytes)
+	require.NoError(t, err)
+	signed, err := irma.SignSchemeUpdateAnnouncement(sk, &irma.SchemeUpdateAnnouncement{
+		Scheme:    irma.NewSchemeManagerIdentifier("irma-demo"),
+		Timestamp: irma.Timestamp(time.Now()),
+	})
+	require.NoError(t, err)
+
+	// Announcements are refused unless the server opted in to them
+	requireRejected(signed, server.ErrorUnsupported.Status)
+	requireKeys([]int{2})
+	StopRequestorServer()
+	conf.SchemeUpdateAnnouncements = true
+	StartRequestorServer(conf)
+
+	// A tampered announcement is refused and does not trigger an update
+	tampered := &irma.SignedSchemeUpdateAnnouncement{
+		Announcement: []byte(strings.Replace(string(signed.Announcement), "irma-demo", "test", 1)),
+		Signature:    signed.Signature,
+	}
+	requireRejected(tampered, server.ErrorInvalidRequest.Status)
+	requireKeys([]int{2})
+
+	// A correctly signed announcement triggers the update
+	var diff irma.ConfigurationDiff
+	require.NoError(t, transport.Post("scheme-update", &diff, signed))
+	require.Equal(t, []int{3}, diff.AddedPublicKeys[issuerid])
+	requireKeys([]int{2, 3})
+
+	// Replaying the same announcement is refused
+	requireRejected(signed, server.ErrorInvalidRequest.Status)
+}
+
+// TestIssuanceValidityAndKeyCounter checks that the validity and key counter of an issuance request
+// are respected, and that the expiry date reported in the session result is the one the client stores.
+func TestIssuanceValidityAndKeyCounter(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	var request irma.IssuanceRequest
+	require.NoError(t, irma.UnmarshalValidate([]byte(`{
+		"type":"issuing",
+		"credentials": [
+			{
+				"credential":"irma-demo.RU.studentCard",
+				"validity":"2029-01-01T12:00:00Z",
+				"keyCounter":2,
+				"attributes" : {
+					"university":"Radboud",
+					"studentCardNumber":"31415927",
+					"studentID":"s1234567",
+					"level":"42"
+				}
+			}
+		]
+	}`), &request))
+
+	result := clientSessionHelper(t, client, &request)
+	require.Equal(t, server.StatusDone, result.Status)
+	expiry := irma.Timestamp(irma.FloorToEpochBoundary(time.Date(2029, 1, 1, 12, 0, 0, 0, time.UTC)))
+	require.Len(t, result.CredentialValidity, 1)
+	require.True(t, time.Time(result.CredentialValidity[0]).Equal(time.Time(expiry)))
+
+	var found bool
+	for _, cred := range client.CredentialInfoList() {
+		if cred.ID == "studentCard" && time.Time(cred.Expires).Equal(time.Time(expiry)) {
+			require.Equal(t, 2, cred.IssuerKeyCounter)
+			found = true
+		}
+	}
+	require.True(t, found)
+}
+
+// TestExpiryPolicy checks the policy for attributes of expired credentials on both sides of the
+// expiry date of a credential issued with a short validity.
+func TestExpiryPolicy(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	value := "short"
+	validity := irma.Timestamp(time.Now().AddDate(0, 0, 7))
+	issuance := getIssuanceRequest(true)
+	issuance.Credentials[0].Validity = &validity
+	issuance.Credentials[0].Attributes["studentID"] = value
+	result := clientSessionHelper(t, client, issuance)
+	require.Equal(t, server.StatusDone, result.Status)
+	expiry := time.Time(result.CredentialValidity[0])
+
+	// The server applies its default policy to requests that don't specify one
+	request := getSigningRequest(studentID)
+	request.Content[0].Values = map[irma.AttributeTypeIdentifier]*string{studentID: &value}
+	result = clientSessionHelper(t, client, request)
+	require.NotNil(t, request.AcceptExpired)
+	require.False(t, *request.AcceptExpired)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.False(t, result.Disclosed[0].Expired)
+	require.True(t, time.Time(*result.Disclosed[0].Expires).Equal(expiry))
+
+	// Check the signature just before and after the expiry date of the credential
+	proofs, attrs := irma.ProofList(result.Signature.Signature), result.Disclosed
+	before, after := expiry.Add(-time.Hour), expiry.Add(time.Hour)
+	require.True(t, proofs.CheckExpiry(client.Configuration, attrs, before, irma.ExpiryPolicy{}))
+	require.False(t, attrs[0].Expired)
+	require.False(t, proofs.CheckExpiry(client.Configuration, attrs, after, irma.ExpiryPolicy{}))
+	require.True(t, attrs[0].Expired)
+	require.True(t, proofs.CheckExpiry(client.Configuration, attrs, after, irma.ExpiryPolicy{AcceptExpired: true}))
+	require.True(t, proofs.CheckExpiry(client.Configuration, attrs, after,
+		irma.ExpiryPolicy{AcceptExpired: true, MaxExpiredAge: 2 * time.Hour}))
+	require.False(t, proofs.CheckExpiry(client.Configuration, attrs, after,
+		irma.ExpiryPolicy{AcceptExpired: true, MaxExpiredAge: time.Minute}))
+}
+
+// TestProofReplay checks that proofs meant for one session are rejected by another, and that
+// proofs can be posted to a session only once, apart from identical resubmissions.
+func TestProofReplay(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	// startSession starts a disclosure session and fetches its request like a client does
+	startSession := func() (string, *irma.HTTPTransport, *irma.DisclosureRequest) {
+		qr, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+		require.NoError(t, err)
+		transport := irma.NewHTTPTransport(qr.URL)
+		transport.SetHeader(irma.MinVersionHeader, "2.4")
+		transport.SetHeader(irma.MaxVersionHeader, "2.4")
+		request := &irma.DisclosureRequest{}
+		require.NoError(t, transport.Get("", request))
+		return token, transport, request
+	}
+	prove := func(request *irma.DisclosureRequest) *irma.Disclosure {
+		candidates := client.Candidates(request.Content[0])
+		require.NotEmpty(t, candidates)
+		choice := &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{candidates[0]}}
+		disclosure, err := client.Proofs(choice, request, false)
+		require.NoError(t, err)
+		return disclosure
+	}
+
+	var status irma.ProofStatus
+	tokenA, transportA, requestA := startSession()
+	disclosure := prove(requestA)
+	require.NoError(t, transportA.Post("proofs", &status, disclosure))
+	require.Equal(t, irma.ProofStatusValid, status)
+
+	// Replaying the proofs against another session fails, also if they don't specify their nonce and context
+	tokenB, transportB, _ := startSession()
+	require.NoError(t, transportB.Post("proofs", &status, disclosure))
+	require.Equal(t, irma.ProofStatusUnmatchedRequest, status)
+	require.Equal(t, irma.ProofStatusUnmatchedRequest, irmaServer.GetSessionResult(tokenB).ProofStatus)
+	require.Equal(t, irma.ProofStatusReasonNonceMismatch, irmaServer.GetSessionResult(tokenB).ProofStatusReason)
+	tokenC, transportC, _ := startSession()
+	require.NoError(t, transportC.Post("proofs", &status, &irma.Disclosure{Proofs: disclosure.Proofs, Indices: disclosure.Indices}))
+	require.Equal(t, irma.ProofStatusInvalid, status)
+	require.Equal(t, irma.ProofStatusReasonInvalidProof, irmaServer.GetSessionResult(tokenC).ProofStatusReason)
+
+	// Posting the same proofs again to the first session is answered as before, posting others fails
+	require.NoError(t, transportA.Post("proofs", &status, disclosure))
+	require.Equal(t, irma.ProofStatusValid, status)
+	require.Error(t, transportA.Post("proofs", &status, prove(requestA)))
+	result := irmaServer.GetSessionResult(tokenA)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+}
+
+func TestStartSessionInferredType(t *testing.T) {
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	qr, _, err := irmaServer.StartSession(`{
+		"content": [{"label": "Student ID", "attributes": ["irma-demo.RU.studentCard.studentID"]}]
+	}`, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ActionDisclosing, qr.Type)
+	transport := irma.NewHTTPTransport(qr.URL)
+	transport.SetHeader(irma.MinVersionHeader, "2.4")
+	transport.SetHeader(irma.MaxVersionHeader, "2.4")
+	request := &irma.DisclosureRequest{}
+	require.NoError(t, transport.Get("", request))
+	require.Equal(t, irma.ActionDisclosing, request.Type)
+
+	qr, _, err = irmaServer.StartSession(`{"request": {
+		"message": "message",
+		"content": [{"label": "Student ID", "attributes": ["irma-demo.RU.studentCard.studentID"]}]
+	}}`, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ActionSigning, qr.Type)
+
+	_, _, err = irmaServer.StartSession(`{
+		"type": "disclosing",
+		"credentials": [{"credential": "irma-demo.RU.studentCard", "attributes": {"studentID": "456"}}],
+		"content": [{"label": "Student ID", "attributes": ["irma-demo.RU.studentCard.studentID"]}]
+	}`, nil)
+	require.IsType(t, &irma.ValidationError{}, err)
+	require.Equal(t, "credentials", err.(*irma.ValidationError).Problems[0].Path)
+}
+
+func TestIssuanceDisclosedAttributeReference(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	// Obtain the BSN to be copied
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	request := getMultipleIssuanceRequest()
+	request.Credentials = request.Credentials[1:]
+	clientSessionHelper(t, client, request)
+
+	// Issue a student card with the disclosed BSN as student ID
+	request = getCombinedIssuanceRequest(bsn)
+	request.Credentials[0].Attributes["studentID"] = irma.DisclosedAttributeReferencePrefix + bsn.String()
+	result := clientSessionHelper(t, client, request)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Len(t, result.Disclosed, 1)
+	require.Equal(t, bsn, result.Disclosed[0].Identifier)
+	require.Equal(t, "299792458", *result.Disclosed[0].RawValue)
+	require.Len(t, result.Issued, 1)
+	require.Equal(t, "299792458", result.Issued[0].Attributes["studentID"])
+	require.Empty(t, result.Issued[0].References())
+
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	var found bool
+	for i := 0; client.Attributes(credid, i) != nil; i++ {
+		value := client.Attributes(credid, i).UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+		if value != nil && *value == "299792458" {
+			found = true
+		}
+	}
+	require.True(t, found, "issued credential does not contain the disclosed BSN")
+
+	// References to attributes that are not disclosed are rejected
+	request = getIssuanceRequest(true)
+	request.Credentials[0].Attributes["studentID"] = irma.DisclosedAttributeReferencePrefix + bsn.String()
+	_, _, err := irmaServer.StartSession(request, nil)
+	require.IsType(t, &irma.ValidationError{}, err)
+}
+
+func TestIssuanceDerivedAttributes(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.ageLimits")
+	dob := time.Now().AddDate(-20, 0, 0).Format(irma.AttributeDateFormat)
+	request := &irma.IssuanceRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing},
+		Credentials: []*irma.CredentialRequest{{
+			CredentialTypeID: credid,
+			Attributes:       map[string]string{"dateOfBirth": dob},
+		}},
+	}
+	result := clientSessionHelper(t, client, request)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Len(t, result.Issued, 1)
+	require.Equal(t, map[string]string{"dateOfBirth": dob, "over18": "true", "over65": "false"}, result.Issued[0].Attributes)
+
+	attrs := client.Attributes(credid, 0)
+	require.NotNil(t, attrs)
+	require.Equal(t, "true", *attrs.UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLimits.over18")))
+	require.Equal(t, "false", *attrs.UntranslatedAttribute(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLimits.over65")))
+
+	// Derived attributes that contradict their source attribute are rejected
+	request = &irma.IssuanceRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing},
+		Credentials: []*irma.CredentialRequest{{
+			CredentialTypeID: credid,
+			Attributes:       map[string]string{"dateOfBirth": dob, "over65": "true"},
+		}},
+	}
+	_, _, err := irmaServer.StartSession(request, nil)
+	require.IsType(t, &irma.ValidationError{}, err)
+}
+
+func TestDisclosedCredentialHash(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	disclose := func(value *string, hashes bool) *irma.DisclosedAttribute {
+		request := getDisclosureRequest(id)
+		if value != nil {
+			request.Content[0].Values = map[irma.AttributeTypeIdentifier]*string{id: value}
+		}
+		serverChan := make(chan *server.SessionResult)
+		qr, _, err := irmaServer.StartSession(&irma.ServiceProviderRequest{
+			RequestorBaseRequest: irma.RequestorBaseRequest{CredentialHashes: hashes},
+			Request:              request,
+		}, func(result *server.SessionResult) {
+			serverChan <- result
+		})
+		require.NoError(t, err)
+		j, err := json.Marshal(qr)
+		require.NoError(t, err)
+		clientChan := make(chan *SessionResult)
+		client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+		if clientResult := <-clientChan; clientResult != nil {
+			require.NoError(t, clientResult.Err)
+		}
+		result := <-serverChan
+		require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+		require.Len(t, result.Disclosed, 1)
+		require.NotNil(t, result.Disclosed[0].IssuanceTime)
+		return result.Disclosed[0]
+	}
+
+	// Disclosures of the same credential instance have the same hash
+	original := "456"
+	first := disclose(&original, true)
+	require.NotEmpty(t, first.CredentialHash)
+	second := disclose(&original, true)
+	require.Equal(t, first.CredentialHash, second.CredentialHash)
+	require.Equal(t, first.IssuanceTime, second.IssuanceTime)
+
+	// Only if requested
+	require.Empty(t, disclose(&original, false).CredentialHash)
+
+	// Another instance of the same credential type has another hash
+	clientSessionHelper(t, client, getIssuanceRequest(true))
+	issued := "s1234567"
+	other := disclose(&issued, true)
+	require.NotEmpty(t, other.CredentialHash)
+	require.NotEqual(t, first.CredentialHash, other.CredentialHash)
+}
+
+func TestRefreshSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	serverChan := make(chan *server.SessionResult)
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, token, err := irmaServer.StartSession(getDisclosureRequest(id), func(result *server.SessionResult) {
+		serverChan <- result
+	})
+	require.NoError(t, err)
+	require.NotNil(t, qr.Expiry)
+	refreshed, err := irmaServer.RefreshSession(token)
+	require.NoError(t, err)
+	require.NotEqual(t, qr.URL, refreshed.URL)
+	require.NotNil(t, refreshed.Expiry)
+	require.Equal(t, refreshed, irmaServer.GetSessionPtr(token))
+
+	// The previous session pointer can no longer be used
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult, 1)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	require.Error(t, (<-clientChan).Err)
+
+	// but the new one completes the original session
+	j, err = json.Marshal(refreshed)
+	require.NoError(t, err)
+	clientChan = make(chan *SessionResult)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+	result := <-serverChan
+	require.Equal(t, token, result.Token)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+
+	// Sessions can't be refreshed once started
+	_, err = irmaServer.RefreshSession(token)
+	require.Error(t, err)
+
+	// Expired session pointers are refused by the client
+	expiry := irma.Timestamp(time.Now().Add(-2 * irma.QrExpiryTolerance))
+	refreshed.Expiry = &expiry
+	j, err = json.Marshal(refreshed)
+	require.NoError(t, err)
+	clientChan = make(chan *SessionResult, 1)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	serr, ok := (<-clientChan).Err.(*irma.SessionError)
+	require.True(t, ok)
+	require.Equal(t, irma.ErrorSessionExpired, serr.ErrorType)
+}
+
+func TestHashAttributeValues(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	value := "456"
+	request := getDisclosureRequest(id)
+	request.Content[0].Values = map[irma.AttributeTypeIdentifier]*string{id: &value}
+	result := clientSessionHelper(t, client, &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{HashAttributeValues: true, HashSalt: "salt"},
+		Request:              request,
+	})
+
+	// The value was verified against the request, but only its hash is included in the result
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Len(t, result.Disclosed, 1)
+	mac := hmac.New(sha256.New, []byte("salt"))
+	mac.Write([]byte(value))
+	hash := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	require.Equal(t, hash, *result.Disclosed[0].RawValue)
+	require.Equal(t, hash, result.Disclosed[0].Value["en"])
+	require.Equal(t, hash, *result.Disjunctions[0].RawValue)
+	bts, err := json.Marshal(result)
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), `"`+value+`"`)
+
+	// Only supported in disclosure sessions, with a salt
+	_, _, err = irmaServer.StartSession(&irma.SignatureRequestorRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{HashAttributeValues: true, HashSalt: "salt"},
+		Request:              getSigningRequest(id),
+	}, nil)
+	require.Error(t, err)
+	_, _, err = irmaServer.StartSession(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{HashAttributeValues: true},
+		Request:              getDisclosureRequest(id),
+	}, nil)
+	require.Error(t, err)
+
+	// Values are hashed before the revocation check, so that they are also absent from the results
+	// of sessions that fail during it
+	checker := &failingRevocationChecker{}
+	StopIrmaServer()
+	startIrmaServer(t, &server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		RevocationChecker:     checker,
+	})
+	request = getDisclosureRequest(id)
+	request.RevocationCheck = true
+	serverChan := make(chan *server.SessionResult, 1)
+	qr, _, err := irmaServer.StartSession(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{HashAttributeValues: true, HashSalt: "salt"},
+		Request:              request,
+	}, func(result *server.SessionResult) { serverChan <- result })
+	require.NoError(t, err)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	clientChan := make(chan *SessionResult, 1)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	clientResult := <-clientChan
+	require.NotNil(t, clientResult)
+	require.Error(t, clientResult.Err)
+	result = <-serverChan
+	require.Equal(t, server.StatusCancelled, result.Status)
+	bts, err = json.Marshal(result)
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), `"`+value+`"`)
+	require.Equal(t, []string{hash}, checker.values)
+
+	// The result JWT contains only the hash as well
+	JwtServerConfiguration.HashAttributeValues = true
+	defer func() { JwtServerConfiguration.HashAttributeValues = false }()
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	request = getDisclosureRequest(id)
+	request.Content[0].Values = map[irma.AttributeTypeIdentifier]*string{id: &value}
+	var pkg server.SessionPackage
+	require.NoError(t, transport.Post("session", &pkg, &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{HashAttributeValues: true, HashSalt: "salt"},
+		Request:              request,
+	}))
+	j, err = json.Marshal(pkg.SessionPtr)
+	require.NoError(t, err)
+	clientChan = make(chan *SessionResult, 1)
+	client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+	if clientResult = <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+	var resultJwt string
+	require.NoError(t, transport.Get("session/"+pkg.Token+"/result-jwt", &resultJwt))
+	parts := strings.Split(resultJwt, ".")
+	require.Len(t, parts, 3)
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	require.Contains(t, string(payload), hash)
+	require.NotContains(t, string(payload), `"`+value+`"`)
+}
+
+// failingRevocationChecker is a server.RevocationChecker that always fails, recording the values
+// of the attributes it was asked to check.
+type failingRevocationChecker struct {
+	sync.Mutex
+	values []string
+}
+
+func (c *failingRevocationChecker) Revoked(attr *irma.DisclosedAttribute) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.values = append(c.values, *attr.RawValue)
+	return false, errors.New("revocation list unavailable")
+}
+
+// TestRevocationCheck revokes one of two instances of a credential, and checks that disclosures
+// of it are marked as revoked only if the request asks for a revocation check.
+func TestRevocationCheck(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	dir, err := ioutil.TempDir("", "revocation")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	list := filepath.Join(dir, "revoked")
+	require.NoError(t, ioutil.WriteFile(list, nil, 0600))
+	startIrmaServer(t, &server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		RevocationChecker:     &server.ListRevocationChecker{Source: list},
+	})
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	disclose := func(value string, check bool) *server.SessionResult {
+		request := getDisclosureRequest(id)
+		request.Content[0].Values = map[irma.AttributeTypeIdentifier]*string{id: &value}
+		request.RevocationCheck = check
+		result := clientSessionHelper(t, client, &irma.ServiceProviderRequest{
+			RequestorBaseRequest: irma.RequestorBaseRequest{CredentialHashes: true},
+			Request:              request,
+		})
+		require.Len(t, result.Disclosed, 1)
+		return result
+	}
+
+	// Issue a second instance, and revoke the first one
+	clientSessionHelper(t, client, getIssuanceRequest(true))
+	original, issued := "456", "s1234567"
+	revoked := disclose(original, false).Disclosed[0].CredentialHash
+	require.NoError(t, ioutil.WriteFile(list, []byte(revoked+"\n"), 0600))
+
+	result := disclose(original, true)
+	require.Equal(t, irma.ProofStatusRevoked, result.ProofStatus)
+	require.Equal(t, irma.ProofStatusReasonRevoked, result.ProofStatusReason)
+	require.Equal(t, irma.AttributeProofStatusRevoked, result.Disclosed[0].Status)
+	require.Equal(t, irma.RevocationStatusRevoked, result.Disclosed[0].RevocationStatus)
+
+	result = disclose(issued, true)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, irma.AttributeProofStatusPresent, result.Disclosed[0].Status)
+	require.Equal(t, irma.RevocationStatusNotRevoked, result.Disclosed[0].RevocationStatus)
+
+	// Without revocation check, the revoked instance is accepted as before
+	result = disclose(original, false)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Empty(t, result.Disclosed[0].RevocationStatus)
+
+	// Servers without revocation checker refuse requests asking for a revocation check
+	other, err := irmaserver.New(&server.Configuration{
+		URL:         "http://localhost:48680",
+		Logger:      logger,
+		SchemesPath: filepath.Join(testdata, "irma_configuration"),
+	})
+	require.NoError(t, err)
+	defer other.Stop()
+	request := getDisclosureRequest(id)
+	request.RevocationCheck = true
+	_, _, err = other.StartSession(request, nil)
+	require.True(t, errors.Is(err, server.ErrorUnsupported))
+}
+
+// flakyPublisher is a server.ResultPublisher that fails the first attempts to publish each result,
+// of which it delivers every other one nonetheless.
+type flakyPublisher struct {
+	sync.Mutex
+	failures  int
+	attempts  map[string]int
+	delivered []string    // tokens of all delivered results, including duplicates
+	published chan string // tokens of the results of successful attempts
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, result *server.SessionResult) error {
+	p.Lock()
+	defer p.Unlock()
+	p.attempts[result.Token]++
+	attempt := p.attempts[result.Token]
+	if attempt > p.failures || attempt%2 == 0 {
+		p.delivered = append(p.delivered, result.Token)
+	}
+	if attempt <= p.failures {
+		return errors.New("broker unavailable")
+	}
+	p.published <- result.Token
+	return nil
+}
+
+// TestResultPublisher checks that the results of all finished sessions are published at least
+// once, in the order in which the sessions finished, despite failures of the publisher.
+func TestResultPublisher(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	publisher := &flakyPublisher{failures: 2, attempts: map[string]int{}, published: make(chan string, 10)}
+	startIrmaServer(t, &server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		ResultPublisher:       publisher,
+		ResultPublishAttempts: 3,
+	})
+	defer StopIrmaServer()
+
+	// A completed session, a cancelled one, and another completed one
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	first := clientSessionHelper(t, client, getDisclosureRequest(id))
+	require.Equal(t, server.StatusDone, first.Status)
+	_, cancelled, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	require.NoError(t, irmaServer.CancelSession(cancelled))
+	last := clientSessionHelper(t, client, getDisclosureRequest(id))
+
+	expected := []string{first.Token, cancelled, last.Token}
+	for _, token := range expected {
+		select {
+		case published := <-publisher.published:
+			require.Equal(t, token, published)
+		case <-time.After(10 * time.Second):
+			t.Fatal("session result not published")
+		}
+	}
+
+	// Each result was delivered twice, of which the duplicate directly follows the first delivery
+	publisher.Lock()
+	defer publisher.Unlock()
+	require.Equal(t, []string{
+		first.Token, first.Token, cancelled, cancelled, last.Token, last.Token,
+	}, publisher.delivered)
+	for _, token := range expected {
+		require.Equal(t, 3, publisher.attempts[token])
+	}
+}
+
+// TestNormalizeRequests checks that redundant disjunctions are removed from session requests if enabled.
+func TestNormalizeRequests(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	startIrmaServer(t, &server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		NormalizeRequests:     true,
+	})
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getDisclosureRequest(id)
+	request.Content = append(request.Content, request.Content[0], &irma.AttributeDisjunction{
+		Label:      request.Content[0].Label,
+		Attributes: []irma.AttributeTypeIdentifier{id, irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")},
+	})
+	result := clientSessionHelper(t, client, request)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Len(t, result.Disclosed, 1)
+	require.Equal(t, id, result.Disclosed[0].Identifier)
+}
+
+// TestRequestFixtureSchemas checks that the session requests used in this test suite conform to their JSON Schemas.
+func TestRequestFixtureSchemas(t *testing.T) {
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	for _, request := range []irma.SessionRequest{
+		getDisclosureRequest(id),
+		getSigningRequest(id),
+		getIssuanceRequest(true),
+		getIssuanceRequest(false),
+		getNameIssuanceRequest(),
+		getCombinedIssuanceRequest(id),
+		getMultipleIssuanceRequest(),
+	} {
+		bts, err := json.Marshal(request)
+		require.NoError(t, err)
+		require.NoError(t, irma.ValidateRequestSchema(bts), string(bts))
+		require.NoError(t, irma.NewJSONSchema(request).Validate(bts), string(bts))
+	}
+
+	rrequest := &irma.SignatureRequestorRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{ResultJwtValidity: 60, CallbackUrl: "https://example.com"},
+		Request:              getSigningRequest(id),
+		MultiParty:           true,
+	}
+	bts, err := json.Marshal(rrequest)
+	require.NoError(t, err)
+	require.NoError(t, irma.ValidateRequestSchema(bts), string(bts))
+}
+
+// TestStrictRequests checks that JSON session requests with unknown fields are rejected if enabled.
+func TestStrictRequests(t *testing.T) {
+	startIrmaServer(t, &server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		StrictRequests:        true,
+	})
+	defer StopIrmaServer()
+
+	bts, err := json.Marshal(getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+	require.NoError(t, err)
+	_, _, err = irmaServer.StartSession(bts, nil)
+	require.NoError(t, err)
+
+	invalid := strings.Replace(string(bts), `"content"`, `"foo":"bar","content"`, 1)
+	_, _, err = irmaServer.StartSession(invalid, nil)
+	require.IsType(t, &irma.ValidationError{}, err)
+	require.Equal(t, "foo", err.(*irma.ValidationError).Problems[0].Path)
+	require.Equal(t, irma.ValidationErrorUnknownField, err.(*irma.ValidationError).Problems[0].Code)
+}
+
+func TestMultiPartySignature(t *testing.T) {
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	// The first signer uses the test storage; the second has its own secret key and credential
+	alice, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	storage, err := ioutil.TempDir("", "irmaclient")
+	require.NoError(t, err)
+	defer os.RemoveAll(storage)
+	bob, err := irmaclient.New(
+		storage,
+		filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		"",
+		&TestClientHandler{t: t, c: make(chan error)},
+	)
+	require.NoError(t, err)
+	clientSessionHelper(t, bob, getIssuanceRequest(true))
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	sign := func(client *irmaclient.Client, rrequest *irma.SignatureRequestorRequest) *server.SessionResult {
+		serverChan := make(chan *server.SessionResult)
+		qr, _, err := irmaServer.StartSession(rrequest, func(result *server.SessionResult) {
+			serverChan <- result
+		})
+		require.NoError(t, err)
+		j, err := json.Marshal(qr)
+		require.NoError(t, err)
+		clientChan := make(chan *SessionResult)
+		client.NewSession(string(j), TestHandler{t, clientChan, client, nil})
+		if clientResult := <-clientChan; clientResult != nil {
+			require.NoError(t, clientResult.Err)
+		}
+		return <-serverChan
+	}
+
+	first := sign(alice, &irma.SignatureRequestorRequest{
+		Request:    getSigningRequest(id),
+		MultiParty: true,
+	})
+	require.Equal(t, irma.ProofStatusValid, first.ProofStatus)
+	require.NotNil(t, first.Signatures)
+	require.Len(t, first.Signatures.Signatures, 1)
+
+	// The second session must be for the same message
+	other := getSigningRequest(id)
+	other.Message = "another message"
+	_, _, err = irmaServer.StartSession(&irma.SignatureRequestorRequest{Request: other, Previous: first.Token}, nil)
+	require.Error(t, err)
+
+	second := sign(bob, &irma.SignatureRequestorRequest{
+		Request:  getSigningRequest(id),
+		Previous: first.Token,
+	})
+	require.Equal(t, irma.ProofStatusValid, second.ProofStatus)
+	require.Len(t, second.Signatures.Signatures, 2)
+	require.Equal(t, first.Signatures.Context, second.Signatures.Context)
+	require.Equal(t, first.Signatures.Context, second.Signature.Context)
+
+	results, err := second.Signatures.Verify(alice.Configuration, nil)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, irma.ProofStatusValid, results[0].Status)
+	require.Equal(t, "456", *results[0].Disclosed[0].RawValue)
+	require.Equal(t, irma.ProofStatusValid, results[1].Status)
+	require.Equal(t, "s1234567", *results[1].Disclosed[0].RawValue)
+
+	// A signature of another multi-party signature cannot be added
+	third := sign(bob, &irma.SignatureRequestorRequest{
+		Request:    getSigningRequest(id),
+		MultiParty: true,
+	})
+	require.Error(t, second.Signatures.Add(third.Signature))
+}
@@ -6,9 +6,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/keyshareserver"
 	"github.com/privacybydesign/irmago/server/requestorserver"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
@@ -18,6 +20,8 @@ var (
 	httpServer      *http.Server
 	irmaServer      *irmaserver.Server
 	requestorServer *requestorserver.Server
+	keyshareServer  *keyshareserver.Server
+	keyshareHttp    *http.Server
 
 	logger   = logrus.New()
 	testdata = test.FindTestdataFolder(nil)
@@ -52,14 +56,18 @@ func StartIrmaServer(t *testing.T) {
 	logger.Level = logrus.ErrorLevel
 	logger.Formatter = &logrus.TextFormatter{}
 
-	var err error
-	irmaServer, err = irmaserver.New(&server.Configuration{
+	startIrmaServer(t, &server.Configuration{
 		URL:                   "http://localhost:48680",
 		Logger:                logger,
 		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
 		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
 	})
+}
 
+// startIrmaServer starts an IRMA server with the specified configuration on port 48680.
+func startIrmaServer(t *testing.T, conf *server.Configuration) {
+	var err error
+	irmaServer, err = irmaserver.New(conf)
 	require.NoError(t, err)
 
 	mux := http.NewServeMux()
@@ -74,6 +82,43 @@ func StopIrmaServer() {
 	_ = httpServer.Close()
 }
 
+// StartKeyshareServer starts the keyshare server of the test scheme at the URL in its scheme
+// description, knowing the user of the test storage (see testdata/teststorage/kss).
+func StartKeyshareServer(t *testing.T) {
+	db := keyshareserver.NewMemoryDB()
+	secret, _ := new(big.Int).SetString("241c78b309f8d774f32e0128c9270dc1776d9e1c6e7b763e66961a13f7b2e4df", 16)
+	user := &keyshareserver.User{Username: "testusername", Secret: secret}
+	require.NoError(t, user.SetPin("puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"))
+	require.NoError(t, db.AddUser(user))
+
+	var err error
+	keyshareServer, err = keyshareserver.New(&keyshareserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                   "http://localhost:8080/irma_keyshare_server/api/v1/irma",
+			Logger:                logger,
+			SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+			IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		},
+		SchemeManager:     "test",
+		DB:                db,
+		JwtPrivateKeyFile: filepath.Join(testdata, "jwtkeys", "kss-sk.pem"),
+	})
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.Handle("/irma_keyshare_server/api/v1/", http.StripPrefix("/irma_keyshare_server/api/v1", keyshareServer.Handler()))
+	keyshareHttp = &http.Server{Addr: ":8080", Handler: mux}
+	go func() {
+		_ = keyshareHttp.ListenAndServe()
+	}()
+	time.Sleep(100 * time.Millisecond) // Give server time to start
+}
+
+func StopKeyshareServer() {
+	keyshareServer.Stop()
+	_ = keyshareHttp.Close()
+}
+
 var IrmaServerConfiguration = &requestorserver.Configuration{
 	Configuration: &server.Configuration{
 		URL:                   "http://localhost:48682/irma",
@@ -1,12 +1,25 @@
 package sessiontest
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/server"
 	"github.com/stretchr/testify/require"
 )
 
@@ -16,12 +29,530 @@ func TestSigningSession(t *testing.T) {
 	sessionHelper(t, request, "signature", nil)
 }
 
+func TestLocalSigning(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getSigningRequest(id)
+	signature, err := client.Sign(request, irmaclient.SignOptions{
+		Handler:     TestHandler{t: t, client: client},
+		NoTimestamp: true,
+	})
+	require.NoError(t, err)
+
+	bts, err := json.Marshal(signature)
+	require.NoError(t, err)
+	parsed := &irma.SignedMessage{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	_, status, err := parsed.Verify(client.Configuration, request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+}
+
+func TestSignDocumentDigest(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	dir, err := ioutil.TempDir("", "irmadocument")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "contract.pdf")
+	require.NoError(t, ioutil.WriteFile(path, bytes.Repeat([]byte("I owe you everything\n"), 100000), 0600))
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	doc, err := irma.NewSignedDocument(file, "contract.pdf", "application/pdf")
+	require.NoError(t, file.Close())
+	require.NoError(t, err)
+	require.Equal(t, int64(2100000), doc.Size)
+
+	request := getSigningRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	request.MessageType = irma.SignedMessageTypeSHA256
+	request.Message, err = doc.Message()
+	require.NoError(t, err)
+	signature, err := client.Sign(request, irmaclient.SignOptions{
+		Handler:     TestHandler{t: t, client: client},
+		NoTimestamp: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, irma.SignedMessageTypeSHA256, signature.MessageType)
+
+	// The message type survives serialization and is logged
+	bts, err := json.Marshal(signature)
+	require.NoError(t, err)
+	parsed := &irma.SignedMessage{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	require.Equal(t, irma.SignedMessageTypeSHA256, logs[len(logs)-1].SignedMessageType)
+
+	// Verification succeeds against the document
+	file, err = os.Open(path)
+	require.NoError(t, err)
+	_, status, err := irma.VerifySignedDocument(client.Configuration, parsed, file, request)
+	require.NoError(t, file.Close())
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+
+	// ... but not against another document
+	_, status, err = irma.VerifySignedDocument(client.Configuration, parsed, bytes.NewReader([]byte("I owe you nothing")), request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusUnmatchedRequest, status)
+
+	// A signature over the digest as a string is not a signature over the document
+	parsed.MessageType = irma.SignedMessageTypeString
+	_, _, err = irma.VerifySignedDocument(client.Configuration, parsed, bytes.NewReader(nil), nil)
+	require.Error(t, err)
+	_, status, err = parsed.Verify(client.Configuration, request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusUnmatchedRequest, status)
+}
+
+func TestSignDetached(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	request := getSigningRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	request.Detached = true
+	signature, err := client.Sign(request, irmaclient.SignOptions{
+		Handler:     TestHandler{t: t, client: client},
+		NoTimestamp: true,
+	})
+	require.NoError(t, err)
+	require.True(t, signature.IsDetached())
+	require.Empty(t, signature.Message)
+
+	_, status, err := signature.VerifyDetached(client.Configuration, nil, []byte(request.Message))
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	_, status, err = signature.Verify(client.Configuration, request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	_, _, err = signature.Verify(client.Configuration, nil)
+	require.Equal(t, irma.ErrorMissingDetachedMessage, err)
+
+	// The signed message retrieved from the logs is detached as well
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	logged, err := logs[len(logs)-1].GetSignedMessage()
+	require.NoError(t, err)
+	require.Equal(t, signature.MessageDigest, logged.MessageDigest)
+}
+
+func TestVerifySigWithRequest(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getSigningRequest(id)
+	request.Version = irma.NewVersion(2, 5)
+	signature, err := client.Sign(request, irmaclient.SignOptions{
+		Handler:     TestHandler{t: t, client: client},
+		NoTimestamp: true,
+	})
+	require.NoError(t, err)
+	require.True(t, signature.Request.Bound)
+
+	// The requestor stores both the request and the signature
+	requestJSON, err := json.Marshal(request)
+	require.NoError(t, err)
+	signatureJSON, err := json.Marshal(signature)
+	require.NoError(t, err)
+	load := func() (*irma.SignatureRequest, *irma.SignedMessage) {
+		req := &irma.SignatureRequest{}
+		require.NoError(t, json.Unmarshal(requestJSON, req))
+		sig := &irma.SignedMessage{}
+		require.NoError(t, json.Unmarshal(signatureJSON, sig))
+		return req, sig
+	}
+
+	req, sig := load()
+	results, status, err := irma.VerifySigWithRequest(client.Configuration, sig, req)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	require.Len(t, results, 1)
+	require.True(t, results[0].Satisfied)
+	require.Equal(t, id, *results[0].Attribute)
+	require.Equal(t, "456", *results[0].RawValue)
+
+	// The protocol version of the stored request may be unknown
+	req, sig = load()
+	req.Version = nil
+	_, status, err = irma.VerifySigWithRequest(client.Configuration, sig, req)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+
+	// A signature over another message does not match
+	req, sig = load()
+	req.Message = "another message"
+	_, status, err = irma.VerifySigWithRequest(client.Configuration, sig, req)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusUnmatchedRequest, status)
+
+	// Nor does a signature for other conditions, even if those are satisfied by the signature
+	req, sig = load()
+	req.Content[0].Label = "bar"
+	_, status, err = irma.VerifySigWithRequest(client.Configuration, sig, req)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusUnmatchedRequest, status)
+	sig.Request.Content[0].Label = "bar"
+	_, status, err = irma.VerifySigWithRequest(client.Configuration, sig, req)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusUnmatchedRequest, status)
+}
+
+func TestOwnSignatures(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	sessionHelper(t, getSigningRequest(id), "signature", client)
+
+	// The signature survives restarting the client
+	client, _ = parseExistingStorage(t)
+	signatures, err := client.GetSignatures()
+	require.NoError(t, err)
+	require.Len(t, signatures, 1)
+	signature := signatures[0]
+	require.Equal(t, "test", signature.Signature.Message)
+	require.NotEmpty(t, signature.ServerName)
+	require.Nil(t, signature.Document)
+
+	validity, err := client.VerifyOwnSignature(signature.LogEntry)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, validity.Status)
+	require.True(t, validity.Valid)
+	require.True(t, validity.UnexpiredNow)
+
+	// The export verifies independently of the client
+	exported, err := client.ExportSignature(signature.LogEntry)
+	require.NoError(t, err)
+	conf, err := irma.NewConfiguration(filepath.Join(test.FindTestdataFolder(t), "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	abs := &irma.SignedMessage{}
+	require.NoError(t, json.Unmarshal(exported, abs))
+	attrs, status, err := abs.Verify(conf, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	require.Equal(t, id, attrs[0].Identifier)
+
+	// Once the scheme is removed, the signature can no longer be verified by the client
+	require.NoError(t, client.RemoveScheme(irma.NewSchemeManagerIdentifier("irma-demo")))
+	validity, err = client.VerifyOwnSignature(signature.LogEntry)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusInvalid, validity.Status)
+	require.Equal(t, irma.ProofStatusReasonUnknownPublicKey, validity.Reason)
+}
+
 func TestDisclosureSession(t *testing.T) {
 	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
 	request := getDisclosureRequest(id)
 	sessionHelper(t, request, "verification", nil)
 }
 
+func TestDisclosureSessionLink(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getDisclosureRequest(id)
+	for _, link := range []string{
+		startSession(t, request, "verification").Link(),
+		startSession(t, request, "verification").UniversalLink("irma.app"),
+		startSession(t, request, "verification").CompactLink(),
+	} {
+		c := make(chan *SessionResult)
+		client.NewSession(link, TestHandler{t, c, client, expectedServerName(t, request, client.Configuration)})
+		if result := <-c; result != nil {
+			require.NoError(t, result.Err)
+		}
+	}
+}
+
+// TestSessionLinkRoundTrip checks that the session links generated from the session pointers
+// returned by the server start sessions in the client.
+func TestSessionLinkRoundTrip(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	JwtServerConfiguration.AppLinkDomain = "irma.app"
+	defer func() { JwtServerConfiguration.AppLinkDomain = "" }()
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getDisclosureRequest(id)
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	packages := make([]*server.SessionPackage, 3)
+	for i := range packages {
+		require.NoError(t, transport.Post("session", &packages[i], request))
+		require.Equal(t, packages[i].SessionPtr.Link(), packages[i].Link)
+		require.Equal(t, packages[i].SessionPtr.UniversalLink("irma.app"), packages[i].UniversalLink)
+	}
+
+	for _, link := range []string{
+		packages[0].Link,
+		packages[1].UniversalLink,
+		packages[2].SessionPtr.UniversalLinkWithFallback("irma.app", "https://example.com/qr?token="+packages[2].Token),
+	} {
+		c := make(chan *SessionResult)
+		client.NewSession(link, TestHandler{t, c, client, expectedServerName(t, request, client.Configuration)})
+		if result := <-c; result != nil {
+			require.NoError(t, result.Err)
+		}
+	}
+	for _, pkg := range packages {
+		var result server.SessionResult
+		require.NoError(t, transport.Get("session/"+pkg.Token+"/result", &result))
+		require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	}
+}
+
+func TestMalformedSessionLink(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	c := make(chan *SessionResult, 1)
+	client.NewSession("irma://qr/json/%7B%22u%22", TestHandler{t: t, c: c, client: client})
+	result := <-c
+	require.NotNil(t, result)
+	serr, ok := result.Err.(*irma.SessionError)
+	require.True(t, ok)
+	require.Equal(t, irma.ErrorInvalidSessionLink, serr.ErrorType)
+	require.Equal(t, irma.ErrorStageStart, serr.Stage)
+}
+
+func TestResumeSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getDisclosureRequest(id)
+	qrjson, err := json.Marshal(startSession(t, request, "verification"))
+	require.NoError(t, err)
+	paused := make(chan struct{})
+	client.NewSession(string(qrjson), PausingTestHandler{TestHandler{t: t, client: client}, paused})
+	<-paused
+
+	// Simulate the app being killed and restarted while the user was asked for permission
+	client, handler := parseExistingStorage(t)
+	require.Len(t, handler.resumable, 1)
+	require.Equal(t, irmaclient.SessionStageConnected, handler.resumable[0].Stage)
+
+	c := make(chan *SessionResult)
+	client.ResumeSession(handler.resumable[0], TestHandler{t, c, client, expectedServerName(t, request, client.Configuration)})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+	require.Empty(t, client.ResumableSessions())
+
+	_, handler = parseExistingStorage(t)
+	require.Empty(t, handler.resumable)
+}
+
+// TestSessionThrottle checks that the user is asked for extra confirmation when a requestor
+// starts more sessions than the threshold, also after restarting, until the throttle is reset.
+func TestSessionThrottle(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	client.SetSessionThrottlePreference(2, time.Minute, false)
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	confirmations := make(chan int, 10)
+	wrap := func(th TestHandler) irmaclient.Handler {
+		return ThrottleTestHandler{th, confirmations}
+	}
+	for i := 0; i < 2; i++ {
+		sessionHelperWithHandler(t, request, "verification", client, wrap)
+	}
+	require.Empty(t, confirmations)
+	sessionHelperWithHandler(t, request, "verification", client, wrap)
+	require.Equal(t, 3, <-confirmations)
+
+	throttle := client.SessionThrottle()
+	require.Len(t, throttle, 1)
+	require.Equal(t, "localhost", throttle[0].Origin)
+	require.Len(t, throttle[0].Sessions, 3)
+	require.True(t, throttle[0].Throttled)
+
+	// The throttle survives restarts
+	client, _ = parseExistingStorage(t)
+	sessionHelperWithHandler(t, request, "verification", client, wrap)
+	require.Equal(t, 4, <-confirmations)
+
+	// After resetting, sessions proceed without confirmation until the threshold is exceeded again
+	require.NoError(t, client.ResetSessionThrottle("localhost"))
+	require.Empty(t, client.SessionThrottle())
+	sessionHelperWithHandler(t, request, "verification", client, wrap)
+	require.Empty(t, confirmations)
+
+	// Throttled sessions may also be declined without asking
+	client.SetSessionThrottlePreference(1, time.Minute, true)
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+	qrjson, err := json.Marshal(startSession(t, request, "verification"))
+	require.NoError(t, err)
+	c := make(chan *SessionResult)
+	client.NewSession(string(qrjson), CancellingTestHandler{TestHandler{t: t, c: c, client: client}})
+	require.Nil(t, <-c)
+	require.Empty(t, confirmations)
+}
+
+// TestCancelSessionNotifiesServer checks that when the user refuses permission, the server is informed
+// that the session is cancelled, after which it posts the result to the callback URL of the requestor.
+func TestCancelSessionNotifiesServer(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	results := make(chan string, 1)
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bts, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		results <- string(bts)
+	}))
+	defer callbackServer.Close()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getDisclosureRequest(id)
+	request.CallbackUrl = callbackServer.URL
+	qrjson, err := json.Marshal(startSession(t, request, "verification"))
+	require.NoError(t, err)
+
+	c := make(chan *SessionResult)
+	client.NewSession(string(qrjson), CancellingTestHandler{TestHandler{t: t, c: c, client: client}})
+	require.Nil(t, <-c)
+
+	select {
+	case j := <-results:
+		claims := &struct {
+			jwt.StandardClaims
+			*server.SessionResult
+		}{SessionResult: &server.SessionResult{}}
+		_, _, err := new(jwt.Parser).ParseUnverified(j, claims)
+		require.NoError(t, err)
+		require.Equal(t, server.StatusCancelled, claims.Status)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Requestor callback was not invoked")
+	}
+}
+
+// installSchemePointer points to the test2 scheme, which is not in the test configuration.
+func installSchemePointer(t *testing.T) *irma.SchemeManagerPointer {
+	pk, err := ioutil.ReadFile(filepath.Join(test.FindTestdataFolder(t), "irma_configuration_install", "test2", "pk.pem"))
+	require.NoError(t, err)
+	return &irma.SchemeManagerPointer{
+		Url:       "http://localhost:48681/irma_configuration_install/test2",
+		Publickey: pk,
+	}
+}
+
+// startInstallSession starts a session at the IRMA server requiring an attribute from the test2 scheme,
+// returning the result of the session at the client.
+func startInstallSession(t *testing.T, client *irmaclient.Client, pointer *irma.SchemeManagerPointer, handler func(c chan *SessionResult) irmaclient.Handler) *SessionResult {
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("test2.issuer.card.number"))
+	request.SchemeManagers = map[irma.SchemeManagerIdentifier]*irma.SchemeManagerPointer{
+		irma.NewSchemeManagerIdentifier("test2"): pointer,
+	}
+	qr, _, err := irmaServer.StartSession(request, nil)
+	require.NoError(t, err)
+	qrjson, err := json.Marshal(qr)
+	require.NoError(t, err)
+
+	c := make(chan *SessionResult)
+	client.NewSession(string(qrjson), handler(c))
+	return <-c
+}
+
+func TestDisclosureInstallsUnknownScheme(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	result := startInstallSession(t, client, installSchemePointer(t), func(c chan *SessionResult) irmaclient.Handler {
+		return TestHandler{t: t, c: c, client: client}
+	})
+
+	// The scheme got installed, after which the session continued; as we don't have the
+	// requested attribute, it then turned out to be unsatisfiable
+	require.NotNil(t, result)
+	require.Equal(t, irma.ErrorType("UnsatisfiableRequest"), result.Err.(*irma.SessionError).ErrorType)
+	schemeid := irma.NewSchemeManagerIdentifier("test2")
+	require.Contains(t, client.Configuration.SchemeManagers, schemeid)
+	require.True(t, client.Configuration.SchemeManagers[schemeid].Valid)
+	require.Contains(t, client.Configuration.CredentialTypes, irma.NewCredentialTypeIdentifier("test2.issuer.card"))
+}
+
+func TestDisclosureUnknownSchemeRefused(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+	schemeid := irma.NewSchemeManagerIdentifier("test2")
+
+	// The user refuses
+	result := startInstallSession(t, client, installSchemePointer(t), func(c chan *SessionResult) irmaclient.Handler {
+		return CancellingTestHandler{TestHandler{t: t, c: c, client: client}}
+	})
+	require.Nil(t, result)
+	require.NotContains(t, client.Configuration.SchemeManagers, schemeid)
+
+	// The scheme is not signed by the specified public key
+	pointer := installSchemePointer(t)
+	pointer.Publickey, _ = ioutil.ReadFile(filepath.Join(test.FindTestdataFolder(t), "irma_configuration", "irma-demo", "pk.pem"))
+	result = startInstallSession(t, client, pointer, func(c chan *SessionResult) irmaclient.Handler {
+		return TestHandler{t: t, c: c, client: client}
+	})
+	require.NotNil(t, result)
+	require.True(t, errors.Is(result.Err, irma.ErrorConfigurationDownload))
+	require.Equal(t, irma.ErrorStageConfiguration, result.Err.(*irma.SessionError).Stage)
+	require.NotContains(t, client.Configuration.SchemeManagers, schemeid)
+	require.NoError(t, fs.AssertPathNotExists(filepath.Join(client.Configuration.Path, "test2")))
+}
+
+// TestDisclosureAfterStorageMigration checks that the credentials in the teststorage, which predates
+// storage versioning, can still be disclosed after the storage has been migrated at startup.
+func TestDisclosureAfterStorageMigration(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	storage := filepath.Join(test.FindTestdataFolder(t), "storage", "test")
+	version, err := ioutil.ReadFile(filepath.Join(storage, "version"))
+	require.NoError(t, err)
+	require.Equal(t, "1", string(version))
+	require.NoError(t, fs.AssertPathExists(filepath.Join(storage, "backup", "attrs")))
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	sessionHelper(t, getDisclosureRequest(id), "verification", client)
+}
+
+// TestDisclosureMissingPublicKey checks that a public key that is required for a session but missing
+// from the client's configuration is downloaded from the scheme manager.
+func TestDisclosureMissingPublicKey(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	counter := client.Attributes(credid, 0).KeyCounter()
+	keyfile := filepath.Join(client.Configuration.Path, "irma-demo", "RU", "PublicKeys", fmt.Sprintf("%d.xml", counter))
+	require.NoError(t, os.Remove(keyfile))
+	pk, err := client.Configuration.PublicKey(credid.IssuerIdentifier(), counter)
+	require.NoError(t, err)
+	require.Nil(t, pk)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	sessionHelper(t, getDisclosureRequest(id), "verification", client)
+	require.NoError(t, fs.AssertPathExists(keyfile))
+}
+
 func TestNoAttributeDisclosureSession(t *testing.T) {
 	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard")
 	request := getDisclosureRequest(id)
@@ -62,6 +593,97 @@ func TestIssuanceOptionalSetAttributes(t *testing.T) {
 	sessionHelper(t, req, "issue", nil)
 }
 
+func TestDisclosureOptionalEmptyAttribute(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.NoError(t, client.RemoveAllCredentials())
+
+	// Issue a credential in which the optional prefix attribute is absent
+	sessionHelper(t, getNameIssuanceRequest(), "issue", client)
+	prefix := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.prefix")
+	creds := client.CredentialInfoList()
+	require.Len(t, creds, 1)
+	require.Contains(t, creds[0].Attributes, prefix)
+	require.Nil(t, creds[0].Attributes[prefix])
+
+	// The absent attribute cannot be disclosed, making a request for it unsatisfiable
+	require.Empty(t, client.Candidates(&irma.AttributeDisjunction{Attributes: []irma.AttributeTypeIdentifier{prefix}}))
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+	qr, _, err := irmaServer.StartSession(getDisclosureRequest(prefix), nil)
+	require.NoError(t, err)
+	qrjson, err := json.Marshal(qr)
+	require.NoError(t, err)
+	c := make(chan *SessionResult)
+	client.NewSession(string(qrjson), TestHandler{t: t, c: c, client: client})
+	result := <-c
+	require.NotNil(t, result)
+	require.Equal(t, irma.ErrorType("UnsatisfiableRequest"), result.Err.(*irma.SessionError).ErrorType)
+}
+
+// TestAbsentAndEmptyAttributes checks that an optional attribute that is absent and one that is set
+// to the empty string remain distinguishable after issuance, in the client and when disclosed.
+func TestAbsentAndEmptyAttributes(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t)
+	defer StopIrmaServer()
+
+	prefix := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.prefix")
+	wildcard := prefix.CredentialTypeIdentifier().Wildcard()
+	van, empty := "van", ""
+	for _, value := range []*string{&van, &empty, nil} {
+		request := getNameIssuanceRequest()
+		if value != nil {
+			request.Credentials[0].Attributes["prefix"] = *value
+		}
+		require.Equal(t, server.StatusDone, clientSessionHelper(t, client, request).Status)
+
+		// The credential of the client
+		var info *irma.CredentialInfo
+		for _, cred := range client.CredentialInfoList() {
+			if cred.ID == "fullName" {
+				info = cred
+			}
+		}
+		require.NotNil(t, info)
+		require.Contains(t, info.Attributes, prefix)
+		bts, err := json.Marshal(info.Attributes[prefix])
+		require.NoError(t, err)
+		if value == nil {
+			require.Nil(t, info.Attributes[prefix])
+			require.Equal(t, "null", string(bts))
+		} else {
+			require.Equal(t, *value, info.Attributes[prefix][""])
+		}
+
+		// Disclose the entire credential, including the prefix
+		result := clientSessionHelper(t, client, getDisclosureRequest(wildcard))
+		require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+		var disclosed *irma.DisclosedAttribute
+		for _, attr := range result.Disclosed {
+			if attr.Identifier == prefix {
+				disclosed = attr
+			}
+		}
+		require.NotNil(t, disclosed)
+		bts, err = json.Marshal(disclosed)
+		require.NoError(t, err)
+		if value == nil {
+			require.Nil(t, disclosed.RawValue)
+			require.Contains(t, string(bts), `"rawvalue":null`)
+			// Requesting the absent attribute itself is unsatisfiable
+			require.Empty(t, client.Candidates(&irma.AttributeDisjunction{Attributes: []irma.AttributeTypeIdentifier{prefix}}))
+		} else {
+			require.NotNil(t, disclosed.RawValue)
+			require.Equal(t, *value, *disclosed.RawValue)
+			result = clientSessionHelper(t, client, getDisclosureRequest(prefix))
+			require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+			require.Equal(t, *value, *result.Disclosed[0].RawValue)
+		}
+	}
+}
+
 func TestLargeAttribute(t *testing.T) {
 	client, _ := parseStorage(t)
 	defer test.ClearTestStorage(t)
@@ -93,6 +715,75 @@ func TestIssuanceSingletonCredential(t *testing.T) {
 	require.Nil(t, client.Attributes(credid, 1))
 }
 
+func TestIssuanceSingletonReplacementLog(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	request := getMultipleIssuanceRequest()
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+
+	sessionHelper(t, request, "issue", client)
+	request.Credentials[1].Attributes["BSN"] = "314159265" // ensure the new instance differs from the old one
+	sessionHelper(t, request, "issue", client)
+	require.NotNil(t, client.Attributes(credid, 0))
+	require.Nil(t, client.Attributes(credid, 1))
+
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	var replaced bool
+	for _, entry := range logs {
+		if entry.RemovalReason == irmaclient.RemovalReasonReplaced {
+			require.Contains(t, entry.Removed, credid)
+			replaced = true
+		}
+	}
+	require.True(t, replaced, "no removal log entry of replaced singleton credential")
+}
+
+func reissueHandler(reissue map[irma.CredentialTypeIdentifier]*irma.ReissueChoice) func(TestHandler) irmaclient.Handler {
+	return func(th TestHandler) irmaclient.Handler {
+		return ReissueTestHandler{TestHandler: th, reissue: reissue}
+	}
+}
+
+func TestIssuanceSingletonKeepBoth(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	request := getMultipleIssuanceRequest()
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	keep := reissueHandler(map[irma.CredentialTypeIdentifier]*irma.ReissueChoice{credid: {KeepAll: true}})
+
+	sessionHelper(t, request, "issue", client)
+	request.Credentials[1].Attributes["BSN"] = "314159265" // ensure the new instance differs from the old one
+	sessionHelperWithHandler(t, request, "issue", client, keep)
+	require.NotNil(t, client.Attributes(credid, 0))
+	require.NotNil(t, client.Attributes(credid, 1))
+}
+
+func TestIssuanceReplaceCredential(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	old := client.Attributes(credid, 0)
+	require.NotNil(t, old)
+	require.Nil(t, client.Attributes(credid, 1))
+
+	// By default a non-singleton credential type gets a second instance
+	sessionHelper(t, getIssuanceRequest(true), "issue", client)
+	require.NotNil(t, client.Attributes(credid, 1))
+
+	// Explicitly replace the original instance
+	replace := reissueHandler(map[irma.CredentialTypeIdentifier]*irma.ReissueChoice{credid: {Replace: []string{old.Hash()}}})
+	sessionHelperWithHandler(t, getSpecialIssuanceRequest(true, "271828"), "issue", client, replace)
+	require.NotNil(t, client.Attributes(credid, 1))
+	require.Nil(t, client.Attributes(credid, 2))
+	for _, attrs := range []*irma.AttributeList{client.Attributes(credid, 0), client.Attributes(credid, 1)} {
+		require.NotEqual(t, old.Hash(), attrs.Hash())
+	}
+}
+
 /* There is an annoying difference between how Java and Go convert big integers to and from
 byte arrays: in Java the sign of the integer is taken into account, but not in Go. This means
 that in Java, when converting a bigint to or from a byte array, the most significant bit
@@ -264,3 +955,94 @@ func TestDownloadSchemeManager(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, exists)
 }
+
+func TestLegacyJwtSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	// Re-sign a captured JWT of the irma_api_server as a requestor known to the server
+	payload, err := ioutil.ReadFile(filepath.Join(test.FindTestdataFolder(t), "golden", "legacyjwt", "dprequest.legacy.json"))
+	require.NoError(t, err)
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	claims := jwt.MapClaims{}
+	require.NoError(t, decoder.Decode(&claims))
+	claims["iss"] = "requestor3"
+	claims["iat"] = time.Now().Unix()
+	key, err := base64.StdEncoding.DecodeString(JwtServerConfiguration.Requestors["requestor3"].AuthenticationKey)
+	require.NoError(t, err)
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tok.Header["kid"] = "requestor3"
+	legacyJwt, err := tok.SignedString(key)
+	require.NoError(t, err)
+
+	var sesPkg server.SessionPackage
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	require.NoError(t, transport.Post("session", &sesPkg, legacyJwt))
+	require.Equal(t, irma.ActionDisclosing, sesPkg.SessionPtr.Type)
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	c := make(chan *SessionResult)
+	qrjson, err := json.Marshal(sesPkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), TestHandler{t, c, client, expectedServerName(t, request, client.Configuration)})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	var result server.SessionResult
+	require.NoError(t, transport.Get("session/"+sesPkg.Token+"/result", &result))
+	require.True(t, result.Legacy)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Len(t, result.Disclosed, 1)
+	require.Equal(t, "456", result.Disclosed[0].Value["en"])
+}
+
+func TestSchemasEndpoint(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	var schemas map[string]*irma.JSONSchema
+	require.NoError(t, transport.Get("schemas", &schemas))
+	require.Len(t, schemas, len(irma.RequestSchemas()))
+	require.Contains(t, schemas, "IssuanceRequest")
+
+	var schema irma.JSONSchema
+	require.NoError(t, transport.Get("schemas/DisclosureRequest", &schema))
+	require.Equal(t, "DisclosureRequest", schema.Title)
+	require.Contains(t, schema.Properties, "content")
+	require.Error(t, transport.Get("schemas/foo", &schema))
+}
+
+func TestCredentialHashesPermission(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{CredentialHashes: true},
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}
+	transport := irma.NewHTTPTransport("http://localhost:48682")
+	transport.SetHeader("Authorization", JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	var sesPkg server.SessionPackage
+	err := transport.Post("session", &sesPkg, request)
+	require.Error(t, err)
+	serr, ok := err.(*irma.SessionError)
+	require.True(t, ok)
+	require.NotNil(t, serr.RemoteError)
+	require.Equal(t, string(server.ErrorUnauthorized.Type), serr.RemoteError.ErrorName)
+	require.True(t, errors.Is(err, server.ErrorUnauthorized))
+
+	// Permitted for this requestor
+	requestor := JwtServerConfiguration.Requestors["requestor2"]
+	requestor.CredentialHashes = true
+	JwtServerConfiguration.Requestors["requestor2"] = requestor
+	defer func() {
+		requestor.CredentialHashes = false
+		JwtServerConfiguration.Requestors["requestor2"] = requestor
+	}()
+	require.NoError(t, transport.Post("session", &sesPkg, request))
+}
@@ -95,14 +95,7 @@ func ClearTestStorage(t *testing.T) {
 
 func CreateTestStorage(t *testing.T) {
 	ClearTestStorage(t)
-	path := filepath.Join(FindTestdataFolder(t), "storage")
-
-	// EnsureDirectoryExists eventually uses mkdir from the OS which is not recursive
-	// so we have to create the temporary test storage by two function calls.
-	// We ignore any error possibly returned by creating the first one, because if it errors,
-	// then the second one certainly will as well.
-	_ = fs.EnsureDirectoryExists(path)
-	err := fs.EnsureDirectoryExists(filepath.Join(path, "test"))
+	err := fs.EnsureDirectoryExists(filepath.Join(FindTestdataFolder(t), "storage", "test"))
 	checkError(t, err)
 }
 
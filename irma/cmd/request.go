@@ -249,12 +249,19 @@ func parseDisjunctions(disjunctionsStr []string, conf *irma.Configuration) (irma
 		attrids := strings.Split(disjunctionStr, ",")
 		for _, attridStr := range attrids {
 			attrid := irma.NewAttributeTypeIdentifier(attridStr)
-			if conf.AttributeTypes[attrid] == nil {
+			if attrid.IsWildcard() {
+				if _, err := conf.WildcardAttributes(attrid); err != nil {
+					return nil, errors.New("unknown credential: " + attridStr)
+				}
+			} else if conf.AttributeTypes[attrid] == nil {
 				return nil, errors.New("unknown attribute: " + attridStr)
 			}
 			disjunction.Attributes = append(disjunction.Attributes, attrid)
 		}
 		disjunction.Label = disjunction.Attributes[0].Name()
+		if disjunction.Attributes[0].IsWildcard() {
+			disjunction.Label = disjunction.Attributes[0].CredentialTypeIdentifier().Name()
+		}
 		list = append(list, disjunction)
 	}
 	return list, nil
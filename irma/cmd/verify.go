@@ -81,10 +81,7 @@ func VerifyScheme(path string) error {
 		return err
 	}
 
-	for _, warning := range conf.Warnings {
-		fmt.Println("Warning: " + warning)
-	}
-	return nil
+	return printReport(conf)
 }
 
 func VerifyIrmaConfiguration(path string) error {
@@ -108,10 +105,22 @@ func VerifyIrmaConfiguration(path string) error {
 		}
 	}
 
-	for _, warning := range conf.Warnings {
+	return printReport(conf)
+}
+
+// printReport prints the errors and warnings encountered while parsing the configuration,
+// returning an error if there were errors.
+func printReport(conf *irma.Configuration) error {
+	report := conf.Report()
+	for _, warning := range report.Warnings {
 		fmt.Println("Warning: " + warning)
 	}
-
+	for _, err := range report.Errors {
+		fmt.Println("Error: " + err)
+	}
+	if len(report.Errors) > 0 {
+		return errors.Errorf("Encountered %d errors", len(report.Errors))
+	}
 	return nil
 }
 
@@ -1,18 +1,35 @@
 package irma
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	gobig "math/big"
+	"strings"
 
 	"github.com/bwesterb/go-atum"
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 )
 
 // SignedMessage is a message signed with an attribute-based signature
-// The 'realnonce' will be calculated as: SigRequest.GetNonce() = ASN1(nonce, SHA256(message), timestampSignature)
+// The 'realnonce' will be calculated as: SigRequest.GetNonce() = ASN1(nonce, SHA256(message), timestampSignature),
+// or ASN1(nonce, SHA256(message), SHA256(conditions), timestampSignature) if the conditions of the
+// signature request are bound into the signature (see SignedMessageRequest.Bound).
+//
+// In JSON a signed message is serialized in a versioned envelope (see SignedMessageVersion), so that
+// stored signatures remain readable when its structure changes. Signatures serialized before the
+// envelope was introduced, which have no version, are read as version 0.
+//
+// A detached signed message (see Detach()) does not contain its message, but only its SHA-256 digest
+// and length, so that it can be stored separately from the message. Verifying it requires the message
+// or its digest to be supplied, see VerifyDetached() and VerifyDetachedDigest().
 type SignedMessage struct {
 	Signature gabi.ProofList            `json:"signature"`
 	Indices   DisclosedAttributeIndices `json:"indices"`
@@ -20,16 +37,305 @@ type SignedMessage struct {
 	Context   *big.Int                  `json:"context"`
 	Message   string                    `json:"message"`
 	Timestamp *atum.Timestamp           `json:"timestamp"`
+	// Type of the message; SignedMessageTypeString if empty
+	MessageType string `json:"messageType,omitempty"`
+	// Excerpt of the signature request that was signed, if known; nil for version 0 signatures
+	Request *SignedMessageRequest `json:"request,omitempty"`
+	// Hex-encoded SHA-256 digest and length in bytes of the message, if the signed message is detached
+	MessageDigest string `json:"messageDigest,omitempty"`
+	MessageLength int    `json:"messageLength,omitempty"`
+}
+
+// ErrorMissingDetachedMessage is returned when verifying a detached signed message (see
+// SignedMessage.Detach()) without supplying its message.
+var ErrorMissingDetachedMessage = errors.New("Signed message is detached: its message or digest must be supplied to verify it")
+
+// SignedMessageRequest is the excerpt of the signature request that is included in a SignedMessage,
+// so that verifiers of the signature can show the requested attributes as the signer saw them.
+type SignedMessageRequest struct {
+	Content AttributeDisjunctionList `json:"content"`
+	// Whether Content is bound into the signature nonce, as it is in signature sessions of protocol
+	// version 2.5 and up; if so the signature is only valid for requests having the same content
+	Bound bool `json:"bound,omitempty"`
+}
+
+// SignedMessageVersion is the version of the JSON serialization of SignedMessage that is written.
+const SignedMessageVersion = 1
+
+// Types of the messages of signed messages and signature requests.
+const (
+	// SignedMessageTypeString is the type of messages consisting of a string.
+	SignedMessageTypeString = "STRING"
+	// SignedMessageTypeSHA256 is the type of messages consisting of the SHA-256 digest of a document
+	// along with optional metadata about it, as a SignedDocument serialized to JSON. The signature binds
+	// the digest and the metadata, but the document itself is not part of it: see VerifySignedDocument().
+	SignedMessageTypeSHA256 = "SHA256"
+)
+
+// SignedDocument is the message of signatures over documents, of type SignedMessageTypeSHA256.
+type SignedDocument struct {
+	Digest   string `json:"sha256"` // Hex-encoded SHA-256 digest of the document
+	Filename string `json:"filename,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+	Size     int64  `json:"size,omitempty"` // Size of the document in bytes
+}
+
+// NewSignedDocument computes the digest and size of the specified document, returning them
+// with the specified (optional) filename and MIME type.
+func NewSignedDocument(document io.Reader, filename, mimetype string) (*SignedDocument, error) {
+	digest, size, err := documentDigest(document)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedDocument{Digest: digest, Filename: filename, MimeType: mimetype, Size: size}, nil
+}
+
+// ParseSignedDocument parses the message of a signature or signature request of type SignedMessageTypeSHA256.
+func ParseSignedDocument(message string) (*SignedDocument, error) {
+	doc := &SignedDocument{}
+	if err := json.Unmarshal([]byte(message), doc); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse document digest", 0)
+	}
+	if digest, err := hex.DecodeString(doc.Digest); err != nil || len(digest) != sha256.Size {
+		return nil, errors.Errorf("Document digest %s is not a hex-encoded SHA-256 digest", doc.Digest)
+	}
+	if doc.Size < 0 {
+		return nil, errors.Errorf("Negative document size %d", doc.Size)
+	}
+	return doc, nil
+}
+
+// Message returns the document digest as the message of a signature request of type SignedMessageTypeSHA256.
+func (doc *SignedDocument) Message() (string, error) {
+	bts, err := json.Marshal(doc)
+	return string(bts), err
+}
+
+// Matches returns whether the specified document has the digest and, if present, the size of this one.
+func (doc *SignedDocument) Matches(document io.Reader) (bool, error) {
+	digest, size, err := documentDigest(document)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(digest, doc.Digest) && (doc.Size == 0 || doc.Size == size), nil
+}
+
+func documentDigest(document io.Reader) (string, int64, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, document)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// VerifySignedDocument verifies the specified signature of type SignedMessageTypeSHA256 over the
+// specified document, optionally against a corresponding signature request (see SignedMessage.Verify()).
+// First the digest of the document is computed; if it does not match the digest in the signature
+// then ProofStatusUnmatchedRequest is returned. Otherwise, the signature is verified cryptographically.
+func VerifySignedDocument(
+	configuration *Configuration, sm *SignedMessage, document io.Reader, request *SignatureRequest,
+) ([]*DisclosedAttribute, ProofStatus, error) {
+	if sm.MessageType != SignedMessageTypeSHA256 {
+		return nil, ProofStatusInvalid, errors.New("Signed message is not a signature over a document digest")
+	}
+	if sm.IsDetached() {
+		return nil, ProofStatusInvalid, ErrorMissingDetachedMessage
+	}
+	doc, err := ParseSignedDocument(sm.Message)
+	if err != nil {
+		return nil, ProofStatusInvalid, err
+	}
+	matches, err := doc.Matches(document)
+	if err != nil {
+		return nil, ProofStatusInvalid, err
+	}
+	if !matches {
+		return nil, ProofStatusUnmatchedRequest, nil
+	}
+	return sm.Verify(configuration, request)
+}
+
+// signedMessageV0 is the JSON serialization of a SignedMessage before it was versioned.
+type signedMessageV0 struct {
+	Signature gabi.ProofList            `json:"signature"`
+	Indices   DisclosedAttributeIndices `json:"indices"`
+	Nonce     *big.Int                  `json:"nonce"`
+	Context   *big.Int                  `json:"context"`
+	Message   string                    `json:"message"`
+	Timestamp *atum.Timestamp           `json:"timestamp"`
+}
+
+// signedMessageV1 is version 1 of the JSON serialization of a SignedMessage.
+type signedMessageV1 struct {
+	Version       int                       `json:"version"`
+	Message       string                    `json:"message,omitempty"`
+	MessageDigest string                    `json:"messageDigest,omitempty"`
+	MessageLength int                       `json:"messageLength,omitempty"`
+	MessageType   string                    `json:"messageType"`
+	Proofs        gabi.ProofList            `json:"proofs"`
+	Indices       DisclosedAttributeIndices `json:"indices,omitempty"`
+	Nonce         *big.Int                  `json:"nonce"`
+	Context       *big.Int                  `json:"context"`
+	Timestamp     *atum.Timestamp           `json:"timestamp,omitempty"`
+	Request       *SignedMessageRequest     `json:"request,omitempty"`
+}
+
+// MarshalJSON marshals the signed message to JSON, as version SignedMessageVersion.
+func (sm *SignedMessage) MarshalJSON() ([]byte, error) {
+	messageType := sm.MessageType
+	if messageType == "" {
+		messageType = SignedMessageTypeString
+	}
+	return json.Marshal(signedMessageV1{
+		Version:       SignedMessageVersion,
+		Message:       sm.Message,
+		MessageDigest: sm.MessageDigest,
+		MessageLength: sm.MessageLength,
+		MessageType:   messageType,
+		Proofs:        sm.Signature,
+		Indices:       sm.Indices,
+		Nonce:         sm.Nonce,
+		Context:       sm.Context,
+		Timestamp:     sm.Timestamp,
+		Request:       sm.Request,
+	})
+}
+
+// UnmarshalJSON unmarshals a signed message from JSON of any version up to SignedMessageVersion,
+// reading JSON without a version as version 0.
+func (sm *SignedMessage) UnmarshalJSON(bts []byte) error {
+	var version struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(bts, &version); err != nil {
+		return err
+	}
+
+	if version.Version == nil {
+		var v0 signedMessageV0
+		if err := json.Unmarshal(bts, &v0); err != nil {
+			return err
+		}
+		*sm = SignedMessage{
+			Signature: v0.Signature,
+			Indices:   v0.Indices,
+			Nonce:     v0.Nonce,
+			Context:   v0.Context,
+			Message:   v0.Message,
+			Timestamp: v0.Timestamp,
+		}
+		return nil
+	}
+
+	if *version.Version != 1 {
+		return errors.Errorf("Unsupported signed message version %d", *version.Version)
+	}
+	var v1 signedMessageV1
+	if err := json.Unmarshal(bts, &v1); err != nil {
+		return err
+	}
+	if v1.MessageType != SignedMessageTypeString && v1.MessageType != SignedMessageTypeSHA256 {
+		return errors.Errorf("Unsupported signed message type %s", v1.MessageType)
+	}
+	if v1.MessageDigest != "" {
+		if v1.Message != "" {
+			return errors.New("Detached signed message cannot contain its message")
+		}
+		if digest, err := hex.DecodeString(v1.MessageDigest); err != nil || len(digest) != sha256.Size {
+			return errors.Errorf("Message digest %s is not a hex-encoded SHA-256 digest", v1.MessageDigest)
+		}
+	}
+	*sm = SignedMessage{
+		Signature:     v1.Proofs,
+		Indices:       v1.Indices,
+		Nonce:         v1.Nonce,
+		Context:       v1.Context,
+		Message:       v1.Message,
+		Timestamp:     v1.Timestamp,
+		MessageType:   v1.MessageType,
+		Request:       v1.Request,
+		MessageDigest: v1.MessageDigest,
+		MessageLength: v1.MessageLength,
+	}
+	return nil
+}
+
+// IsDetached returns whether the signed message is detached from its message, see Detach().
+func (sm *SignedMessage) IsDetached() bool {
+	return sm.MessageDigest != ""
+}
+
+// Detach removes the message from the signed message, recording only its SHA-256 digest and
+// its length, so that it can be stored separately from the message.
+func (sm *SignedMessage) Detach() {
+	if sm.IsDetached() {
+		return
+	}
+	digest := sha256.Sum256([]byte(sm.Message))
+	sm.MessageDigest = hex.EncodeToString(digest[:])
+	sm.MessageLength = len(sm.Message)
+	sm.Message = ""
+}
+
+// messageHash returns the SHA-256 digest of the message, which for detached signed messages
+// is the recorded digest.
+func (sm *SignedMessage) messageHash() []byte {
+	if sm.IsDetached() {
+		digest, _ := hex.DecodeString(sm.MessageDigest)
+		return digest
+	}
+	digest := sha256.Sum256([]byte(sm.Message))
+	return digest[:]
 }
 
 func (sm *SignedMessage) GetNonce() *big.Int {
-	return ASN1ConvertSignatureNonce(sm.Message, sm.Nonce, sm.Timestamp)
+	var conditions []byte
+	if sm.bindsConditions() {
+		conditions = conditionsHash(sm.Request.Content)
+	}
+	return asn1SignatureNonce(sm.messageHash(), sm.Nonce, sm.Timestamp, conditions)
 }
 
 func (sm *SignedMessage) MatchesNonceAndContext(request *SignatureRequest) bool {
 	return sm.Nonce.Cmp(request.Nonce) == 0 &&
 		sm.Context.Cmp(request.Context) == 0 &&
-		sm.GetNonce().Cmp(request.GetNonce()) == 0
+		sm.GetNonce().Cmp(sm.requestNonce(request)) == 0
+}
+
+// bindsConditions returns whether the conditions of the signature request are bound into the signature.
+func (sm *SignedMessage) bindsConditions() bool {
+	return sm.Request != nil && sm.Request.Bound
+}
+
+// requestNonce computes the nonce of the request as in SignatureRequest.GetNonce(). If the protocol
+// version of the request is unknown, e.g. because the requestor stored the request before starting
+// the session, its conditions are bound into the nonce if they are bound into the signature.
+func (sm *SignedMessage) requestNonce(request *SignatureRequest) *big.Int {
+	if request.Version != nil {
+		return request.GetNonce()
+	}
+	return request.nonce(sm.bindsConditions())
+}
+
+// matchesConditions returns whether the request has the same conditions as the signature request
+// included in the signed message, if any.
+func (sm *SignedMessage) matchesConditions(request *SignatureRequest) bool {
+	if sm.Request == nil {
+		return true
+	}
+	return bytes.Equal(conditionsHash(sm.Request.Content), conditionsHash(request.Content))
+}
+
+// matchesMessageType returns whether the signed message and the request have the same message type.
+func (sm *SignedMessage) matchesMessageType(request *SignatureRequest) bool {
+	typ := func(t string) string {
+		if t == "" {
+			return SignedMessageTypeString
+		}
+		return t
+	}
+	return typ(sm.MessageType) == typ(request.MessageType)
 }
 
 func (sm *SignedMessage) Disclosure() *Disclosure {
@@ -39,16 +345,31 @@ func (sm *SignedMessage) Disclosure() *Disclosure {
 	}
 }
 
+// SkippedDisjunctions returns the indices of the optional disjunctions of the signature request
+// that the signer skipped.
+func (sm *SignedMessage) SkippedDisjunctions() []int {
+	return sm.Disclosure().SkippedDisjunctions()
+}
+
 // ASN1ConvertSignatureNonce computes the nonce that is used in the creation of the attribute-based signature:
 //    nonce = SHA256(serverNonce, SHA256(message), timestampSignature)
 // where serverNonce is the nonce sent by the signature requestor.
 func ASN1ConvertSignatureNonce(message string, nonce *big.Int, timestamp *atum.Timestamp) *big.Int {
 	msgHash := sha256.Sum256([]byte(message))
+	return asn1SignatureNonce(msgHash[:], nonce, timestamp, nil)
+}
+
+// asn1SignatureNonce is like ASN1ConvertSignatureNonce, given the SHA-256 digest of the message,
+// additionally binding the SHA-256 digest of the conditions of the signature request if not nil.
+func asn1SignatureNonce(msgHash []byte, nonce *big.Int, timestamp *atum.Timestamp, conditions []byte) *big.Int {
 	n := nonce.Value()
 	if n == nil {
 		n = gobig.NewInt(0)
 	}
-	tohash := []interface{}{n, new(gobig.Int).SetBytes(msgHash[:])}
+	tohash := []interface{}{n, new(gobig.Int).SetBytes(msgHash)}
+	if conditions != nil {
+		tohash = append(tohash, new(gobig.Int).SetBytes(conditions))
+	}
 	if timestamp != nil {
 		tohash = append(tohash, timestamp.Sig.Data)
 	}
@@ -59,3 +380,114 @@ func ASN1ConvertSignatureNonce(message string, nonce *big.Int, timestamp *atum.T
 	asn1hash := sha256.Sum256(asn1bytes)
 	return new(big.Int).SetBytes(asn1hash[:])
 }
+
+// conditionsHash computes the SHA-256 digest of the JSON serialization of the conditions of a
+// signature request, which is bound into the signature nonce in protocol version 2.5 and up.
+func conditionsHash(content AttributeDisjunctionList) []byte {
+	bts, err := json.Marshal(content)
+	if err != nil {
+		log.Print(err) // TODO
+	}
+	hash := sha256.Sum256(bts)
+	return hash[:]
+}
+
+// MultiSignedMessage is a message signed by multiple signers with attribute-based signatures, e.g. an
+// agreement between several parties. All signatures are over the same message and have the same context,
+// which is random and binds the signatures to the same signing ceremony: signatures made for another
+// ceremony, even over the same message, cannot be added.
+type MultiSignedMessage struct {
+	Message     string           `json:"message"`
+	MessageType string           `json:"messageType,omitempty"`
+	Context     *big.Int         `json:"context"`
+	Signatures  []*SignedMessage `json:"signatures"`
+}
+
+// SignerResult is the result of verifying the signature of one of the signers of a MultiSignedMessage.
+type SignerResult struct {
+	Disclosed []*DisclosedAttribute `json:"disclosed"`
+	Status    ProofStatus           `json:"status"`
+	Reason    ProofStatusReason     `json:"reason,omitempty"`
+}
+
+// NewMultiSignedMessage returns a multi-party signature without signatures over the specified message,
+// with a new random context.
+func NewMultiSignedMessage(message, messageType string) (*MultiSignedMessage, error) {
+	context, err := gabi.RandomBigInt(gabi.DefaultSystemParameters[2048].Lstatzk)
+	if err != nil {
+		return nil, err
+	}
+	return &MultiSignedMessage{
+		Message:     message,
+		MessageType: messageType,
+		Context:     context,
+	}, nil
+}
+
+// SignatureRequest returns a signature request for a signer of the multi-party signature,
+// asking for the specified attributes.
+func (msm *MultiSignedMessage) SignatureRequest(content AttributeDisjunctionList) *SignatureRequest {
+	return &SignatureRequest{
+		DisclosureRequest: DisclosureRequest{
+			BaseRequest: BaseRequest{Type: ActionSigning, Context: msm.Context},
+			Content:     content,
+		},
+		Message:     msm.Message,
+		MessageType: msm.MessageType,
+	}
+}
+
+// Add adds the signature of a signer to the multi-party signature. The signature must be over the
+// message of the multi-party signature and have its context; it is not verified otherwise.
+func (msm *MultiSignedMessage) Add(sm *SignedMessage) error {
+	switch msm.mismatch(sm) {
+	case ProofStatusReasonUnmatchedRequest:
+		return errors.New("Signature was made for another multi-party signature")
+	case ProofStatusReasonMessageMismatch:
+		return errors.New("Signature is over another message than the multi-party signature")
+	}
+	msm.Signatures = append(msm.Signatures, sm)
+	return nil
+}
+
+// mismatch returns ProofStatusReasonUnmatchedRequest if the signature does not have the context of
+// the multi-party signature, ProofStatusReasonMessageMismatch if it is not over its message,
+// and ProofStatusReasonNone otherwise.
+func (msm *MultiSignedMessage) mismatch(sm *SignedMessage) ProofStatusReason {
+	if sm.Context == nil || msm.Context == nil || sm.Context.Cmp(msm.Context) != 0 {
+		return ProofStatusReasonUnmatchedRequest
+	}
+	msgHash := sha256.Sum256([]byte(msm.Message))
+	if !bytes.Equal(sm.messageHash(), msgHash[:]) ||
+		!sm.matchesMessageType(&SignatureRequest{MessageType: msm.MessageType}) {
+		return ProofStatusReasonMessageMismatch
+	}
+	return ProofStatusReasonNone
+}
+
+// Verify verifies the signatures of all signers, returning the results in the order in which the
+// signatures were added. If requests is not nil it must contain for each signature the request
+// against which it is verified, as in SignedMessage.Verify().
+func (msm *MultiSignedMessage) Verify(configuration *Configuration, requests []*SignatureRequest) ([]*SignerResult, error) {
+	if requests != nil && len(requests) != len(msm.Signatures) {
+		return nil, errors.Errorf("Expected %d signature requests, got %d", len(msm.Signatures), len(requests))
+	}
+	results := make([]*SignerResult, len(msm.Signatures))
+	for i, sm := range msm.Signatures {
+		if reason := msm.mismatch(sm); reason != ProofStatusReasonNone {
+			results[i] = &SignerResult{Status: ProofStatusUnmatchedRequest, Reason: reason}
+			continue
+		}
+		var request *SignatureRequest
+		if requests != nil {
+			request = requests[i]
+		}
+		// The message of the signature, which may be detached, was checked above
+		disclosed, status, reason, err := sm.verify(configuration, request)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, fmt.Sprintf("Failed to verify signature %d", i), 0)
+		}
+		results[i] = &SignerResult{Disclosed: disclosed, Status: status, Reason: reason}
+	}
+	return results, nil
+}
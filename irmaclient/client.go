@@ -1,7 +1,10 @@
 package irmaclient
 
 import (
+	"net/http"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/getsentry/raven-go"
@@ -54,6 +57,24 @@ type Client struct {
 	irmaConfigurationPath string
 	androidStoragePath    string
 	handler               ClientHandler
+	options               Options
+	metrics               MetricsCollector
+
+	// Background scheme updates, postponed while sessions are in progress
+	schemeUpdater     *schemeUpdater
+	schemeUpdaterLock sync.Mutex
+	activeSessions    int
+	sessionsLock      sync.Mutex
+	// Closed when the scheme change in progress, if any, finishes; guarded by sessionsLock
+	schemeChange chan struct{}
+
+	// Persisted state of interactive sessions in progress, guarded by sessionsLock
+	resumableSessions map[string]*ResumableSession
+	// Start times of recent sessions per requestor, guarded by sessionsLock
+	sessionThrottle map[string][]irma.Timestamp
+
+	// Serializes downloading of missing public keys by concurrent sessions
+	keysLock sync.Mutex
 }
 
 // SentryDSN should be set in the init() function
@@ -62,10 +83,30 @@ var SentryDSN = ""
 
 type Preferences struct {
 	EnableCrashReporting bool
+
+	// DiscloseExpired includes expired credential instances in the disclosure candidates,
+	// for requestors that accept expired attributes. Such candidates have Expired set.
+	DiscloseExpired bool
+	// RemoveExpiredAfter is the duration after expiry after which expired credentials
+	// are automatically removed. Zero disables automatic removal.
+	RemoveExpiredAfter time.Duration
+	// Languages of the device in order of preference, in which translated texts such as the labels
+	// of disjunctions are shown to the user; see irma.TranslatedString.Translation().
+	Languages []string
+	// SessionThrottleThreshold is the number of sessions that a requestor may start within
+	// SessionThrottleWindow, beyond which its sessions are throttled (see throttle.go).
+	// Zero disables throttling.
+	SessionThrottleThreshold int
+	SessionThrottleWindow    time.Duration
+	// SessionThrottleDecline declines the sessions of throttled requestors, instead of asking
+	// the user for confirmation using Handler.RequestThrottledSessionConfirmation().
+	SessionThrottleDecline bool
 }
 
 var defaultPreferences = Preferences{
-	EnableCrashReporting: true,
+	EnableCrashReporting:     true,
+	SessionThrottleThreshold: 10,
+	SessionThrottleWindow:    time.Minute,
 }
 
 // KeyshareHandler is used for asking the user for his email address and PIN,
@@ -90,6 +131,44 @@ type ClientHandler interface {
 
 	UpdateConfiguration(new *irma.IrmaIdentifierSet)
 	UpdateAttributes()
+	// ResumableSessions is called during New() if sessions were in progress when the client
+	// was last stopped, see Client.ResumeSession().
+	ResumableSessions(sessions []*ResumableSession)
+	// KeyshareEnrollmentInvalid is called when the keyshare server of a scheme to which the client
+	// is enrolled moved to a new URL that does not know the account of the client. The user
+	// should re-enroll, see Client.KeyshareRemove() and Client.KeyshareEnroll().
+	KeyshareEnrollmentInvalid(manager irma.SchemeManagerIdentifier, err error)
+}
+
+// Options contains optional settings of a Client, see NewWithOptions().
+type Options struct {
+	// Transport, if set, is used for all outgoing HTTP requests of the client: to IRMA servers,
+	// keyshare servers and scheme servers. Proxy settings and TLS configuration should be set
+	// on this transport.
+	Transport http.RoundTripper
+	// TLSPins overrides the TLS pins of the specified scheme managers, see irma.SchemeManager.TLSPins.
+	TLSPins map[irma.SchemeManagerIdentifier][]string
+	// SessionTimeout, KeyshareTimeout and SchemeTimeout are the timeouts of HTTP requests to
+	// IRMA servers, keyshare servers and scheme managers respectively. Zero means the default
+	// (irma.DefaultSessionTimeout etc.).
+	SessionTimeout  time.Duration
+	KeyshareTimeout time.Duration
+	SchemeTimeout   time.Duration
+	// SchemeRetries is the number of times that failed HTTP requests to scheme managers are retried,
+	// and that interrupted downloads of scheme files are resumed. Zero means irma.DefaultSchemeRetries.
+	SchemeRetries int
+	// DevelopmentSchemes are parsed without verifying them, see irma.Configuration.SetUnsignedSchemes().
+	// Their credentials are flagged as non-production.
+	DevelopmentSchemes []irma.SchemeManagerIdentifier
+	// AssetsOverlay, if set, makes the client use the schemes in irmaConfigurationPath in place
+	// instead of copying them into storage, see irma.NewConfigurationOverlay().
+	AssetsOverlay bool
+	// AdditionalAssetsPaths are folders containing schemes that are searched after irmaConfigurationPath,
+	// e.g. with per-user additions to a system-wide irmaConfigurationPath. A scheme occurring in several
+	// of these folders is taken from the last one, see irma.NewConfigurationFromAssets().
+	AdditionalAssetsPaths []string
+	// Metrics, if set, is notified of sessions and of changes in the state of the client.
+	Metrics MetricsCollector
 }
 
 type secretKey struct {
@@ -113,6 +192,17 @@ func New(
 	irmaConfigurationPath string,
 	androidStoragePath string,
 	handler ClientHandler,
+) (*Client, error) {
+	return NewWithOptions(storagePath, irmaConfigurationPath, androidStoragePath, handler, Options{})
+}
+
+// NewWithOptions is like New(), additionally applying the specified options.
+func NewWithOptions(
+	storagePath string,
+	irmaConfigurationPath string,
+	androidStoragePath string,
+	handler ClientHandler,
+	options Options,
 ) (*Client, error) {
 	var err error
 	if err = fs.AssertPathExists(storagePath); err != nil {
@@ -129,12 +219,27 @@ func New(
 		irmaConfigurationPath: irmaConfigurationPath,
 		androidStoragePath:    androidStoragePath,
 		handler:               handler,
+		options:               options,
+		metrics:               options.Metrics,
+	}
+	if cm.metrics == nil {
+		cm.metrics = nopMetricsCollector{}
 	}
 
-	cm.Configuration, err = irma.NewConfigurationFromAssets(storagePath+"/irma_configuration", irmaConfigurationPath)
+	assets := append([]string{irmaConfigurationPath}, options.AdditionalAssetsPaths...)
+	if options.AssetsOverlay {
+		cm.Configuration, err = irma.NewConfigurationOverlay(storagePath+"/irma_configuration", assets...)
+	} else {
+		cm.Configuration, err = irma.NewConfigurationFromAssets(storagePath+"/irma_configuration", assets...)
+	}
 	if err != nil {
 		return nil, err
 	}
+	cm.Configuration.SetRoundTripper(options.Transport)
+	cm.Configuration.SetTLSPins(options.TLSPins)
+	cm.Configuration.SetTimeout(options.SchemeTimeout)
+	cm.Configuration.SetRetries(options.SchemeRetries)
+	cm.Configuration.SetUnsignedSchemes(options.DevelopmentSchemes)
 
 	schemeMgrErr := cm.Configuration.ParseOrRestoreFolder()
 	// If schemMgrErr is of type SchemeManagerError, we continue and
@@ -155,8 +260,8 @@ func New(
 	}
 	cm.applyPreferences()
 
-	// Perform new update functions from clientUpdates, if any
-	if err = cm.update(); err != nil {
+	// Migrate storage to the current version, if necessary
+	if err = cm.migrate(); err != nil {
 		return nil, err
 	}
 
@@ -167,18 +272,42 @@ func New(
 	if cm.attributes, err = cm.storage.LoadAttributes(); err != nil {
 		return nil, err
 	}
+	if err = cm.storage.RemoveUnreferencedSignatures(cm.attributes); err != nil {
+		return nil, err
+	}
 	if cm.keyshareServers, err = cm.storage.LoadKeyshareServers(); err != nil {
 		return nil, err
 	}
+	if err = cm.updateKeyshareServers(); err != nil {
+		return nil, err
+	}
+	if cm.resumableSessions, err = cm.storage.LoadSessions(); err != nil {
+		return nil, err
+	}
+	if cm.sessionThrottle, err = cm.storage.LoadThrottle(); err != nil {
+		return nil, err
+	}
+	if cm.Preferences.RemoveExpiredAfter > 0 {
+		if err = cm.RemoveExpiredCredentials(cm.Preferences.RemoveExpiredAfter); err != nil {
+			return nil, err
+		}
+	}
+
+	cm.reportCredentialCount()
 
 	if len(cm.UnenrolledSchemeManagers()) > 1 {
 		return nil, errors.New("Too many keyshare servers")
 	}
 
+	if len(cm.resumableSessions) > 0 {
+		cm.handler.ResumableSessions(cm.ResumableSessions())
+	}
+
 	return cm, schemeMgrErr
 }
 
-// CredentialInfoList returns a list of information of all contained credentials.
+// CredentialInfoList returns a list of information of all contained credentials,
+// sorted by credential type.
 func (client *Client) CredentialInfoList() irma.CredentialInfoList {
 	list := irma.CredentialInfoList([]*irma.CredentialInfo{})
 
@@ -188,16 +317,19 @@ func (client *Client) CredentialInfoList() irma.CredentialInfoList {
 			if info == nil {
 				continue
 			}
+			info.Expired = info.IsExpired()
 			list = append(list, info)
 		}
 	}
 
+	sort.Sort(list)
 	return list
 }
 
 // addCredential adds the specified credential to the Client, saving its signature
-// imediately, and optionally cm.attributes as well.
-func (client *Client) addCredential(cred *credential, storeAttributes bool) (err error) {
+// imediately, and optionally cm.attributes as well. Existing instances of its credential type
+// are removed as specified by reissue (see irma.DisclosureChoice.Reissue), which may be nil.
+func (client *Client) addCredential(cred *credential, storeAttributes bool, reissue *irma.ReissueChoice) (err error) {
 	id := irma.NewCredentialTypeIdentifier("")
 	if cred.CredentialType() != nil {
 		id = cred.CredentialType().Identifier()
@@ -212,15 +344,30 @@ func (client *Client) addCredential(cred *credential, storeAttributes bool) (err
 		}
 	}
 
-	// If this is a singleton credential type, ensure we have at most one by removing any previous instance
-	if !id.Empty() && cred.CredentialType().IsSingleton {
-		for len(client.attrs(id)) != 0 {
-			client.remove(id, 0, false)
-		}
+	// Store the signature before any attributes file refers to it
+	if err = client.storage.StoreSignature(cred); err != nil {
+		return
 	}
 
-	// Append the new cred to our attributes and credentials
+	// Append the new cred to our attributes before removing the credentials it replaces, so that
+	// the attributes file stored by remove() contains the new cred as soon as it no longer
+	// contains the replaced ones
+	var replaced []*irma.AttributeList
+	if !id.Empty() {
+		replaced = client.replacedCredentials(cred.CredentialType(), reissue)
+	}
 	client.attributes[id] = append(client.attrs(id), cred.AttributeList())
+	for _, attrs := range replaced {
+		for i, a := range client.attrs(id) {
+			if a == attrs {
+				if err = client.remove(id, i, true, RemovalReasonReplaced); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
 	if !id.Empty() {
 		if _, exists := client.credentialsCache[id]; !exists {
 			client.credentialsCache[id] = make(map[int]*credential)
@@ -229,11 +376,8 @@ func (client *Client) addCredential(cred *credential, storeAttributes bool) (err
 		client.credentialsCache[id][counter] = cred
 	}
 
-	if err = client.storage.StoreSignature(cred); err != nil {
-		return
-	}
 	if storeAttributes {
-		err = client.storage.StoreAttributes(client.attributes)
+		err = client.storeAttributes()
 	}
 	return
 }
@@ -246,9 +390,37 @@ func generateSecretKey() (*secretKey, error) {
 	return &secretKey{Key: key}, nil
 }
 
+// replacedCredentials returns the existing instances of the specified credential type that are
+// to be replaced by a newly issued instance: by default all of them if the credential type is a
+// singleton, or those specified by reissue.
+func (client *Client) replacedCredentials(credtype *irma.CredentialType, reissue *irma.ReissueChoice) []*irma.AttributeList {
+	list := client.attrs(credtype.Identifier())
+	if reissue == nil {
+		if !credtype.IsSingleton {
+			return nil
+		}
+		return append([]*irma.AttributeList(nil), list...)
+	}
+	if reissue.KeepAll {
+		return nil
+	}
+
+	replace := map[string]struct{}{}
+	for _, hash := range reissue.Replace {
+		replace[hash] = struct{}{}
+	}
+	var replaced []*irma.AttributeList
+	for _, attrs := range list {
+		if _, ok := replace[attrs.Hash()]; ok {
+			replaced = append(replaced, attrs)
+		}
+	}
+	return replaced
+}
+
 // Removal methods
 
-func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storenow bool) error {
+func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storenow bool, reason string) error {
 	// Remove attributes
 	list, exists := client.attributes[id]
 	if !exists || index >= len(list) {
@@ -257,7 +429,7 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storen
 	attrs := list[index]
 	client.attributes[id] = append(list[:index], list[index+1:]...)
 	if storenow {
-		if err := client.storage.StoreAttributes(client.attributes); err != nil {
+		if err := client.storeAttributes(); err != nil {
 			return err
 		}
 	}
@@ -280,9 +452,10 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storen
 
 	if storenow {
 		return client.addLogEntry(&LogEntry{
-			Type:    actionRemoval,
-			Time:    irma.Timestamp(time.Now()),
-			Removed: removed,
+			Type:          actionRemoval,
+			Time:          irma.Timestamp(time.Now()),
+			Removed:       removed,
+			RemovalReason: reason,
 		})
 	}
 	return nil
@@ -290,7 +463,25 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storen
 
 // RemoveCredential removes the specified credential.
 func (client *Client) RemoveCredential(id irma.CredentialTypeIdentifier, index int) error {
-	return client.remove(id, index, true)
+	return client.remove(id, index, true, "")
+}
+
+// RemoveExpiredCredentials removes all credentials that expired longer than the specified
+// duration ago, adding a removal log entry with reason RemovalReasonExpired for each of them.
+func (client *Client) RemoveExpiredCredentials(after time.Duration) error {
+	threshold := time.Now().Add(-after)
+	for id, attrlistlist := range client.attributes {
+		// Iterate backwards so that removals don't shift the indices we have yet to visit
+		for i := len(attrlistlist) - 1; i >= 0; i-- {
+			if attrlistlist[i].IsValidOn(threshold) {
+				continue
+			}
+			if err := client.remove(id, i, true, RemovalReasonExpired); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // RemoveCredentialByHash removes the specified credential.
@@ -305,7 +496,12 @@ func (client *Client) RemoveCredentialByHash(hash string) error {
 // RemoveAllCredentials removes all credentials.
 func (client *Client) RemoveAllCredentials() error {
 	removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
-	for _, attrlistlist := range client.attributes {
+	attributes := client.attributes
+	client.attributes = map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
+	if err := client.storeAttributes(); err != nil {
+		return err
+	}
+	for _, attrlistlist := range attributes {
 		for _, attrs := range attrlistlist {
 			if attrs.CredentialType() != nil {
 				removed[attrs.CredentialType().Identifier()] = attrs.Strings()
@@ -313,10 +509,6 @@ func (client *Client) RemoveAllCredentials() error {
 			client.storage.DeleteSignature(attrs)
 		}
 	}
-	client.attributes = map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
-	if err := client.storage.StoreAttributes(client.attributes); err != nil {
-		return err
-	}
 
 	logentry := &LogEntry{
 		Type:    actionRemoval,
@@ -441,24 +633,20 @@ func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma
 			continue
 		}
 		for _, attrs := range creds {
-			if !attrs.IsValid() {
+			expired := !attrs.IsValid()
+			if expired && !client.Preferences.DiscloseExpired {
 				continue
 			}
-			id := &irma.AttributeIdentifier{Type: attribute, CredentialHash: attrs.Hash()}
-			if attribute.IsCredential() {
+			id := &irma.AttributeIdentifier{Type: attribute, CredentialHash: attrs.Hash(), Expired: expired}
+			if attribute.IsCredential() || attribute.IsWildcard() {
 				candidates = append(candidates, id)
 			} else {
 				val := attrs.UntranslatedAttribute(attribute)
 				if val == nil {
 					continue
 				}
-				if !disjunction.HasValues() {
+				if disjunction.ValueAllowed(attribute, *val) {
 					candidates = append(candidates, id)
-				} else {
-					requiredValue, present := disjunction.Values[attribute]
-					if !present || requiredValue == nil || *val == *requiredValue {
-						candidates = append(candidates, id)
-					}
 				}
 			}
 		}
@@ -469,7 +657,7 @@ func (client *Client) Candidates(disjunction *irma.AttributeDisjunction) []*irma
 
 // CheckSatisfiability checks if this client has the required attributes
 // to satisfy the specifed disjunction list. If not, the unsatisfiable disjunctions
-// are returned.
+// are returned. Optional disjunctions are never unsatisfiable, as they may be skipped.
 func (client *Client) CheckSatisfiability(
 	disjunctions irma.AttributeDisjunctionList,
 ) ([][]*irma.AttributeIdentifier, irma.AttributeDisjunctionList) {
@@ -478,13 +666,61 @@ func (client *Client) CheckSatisfiability(
 	for i, disjunction := range disjunctions {
 		candidates = append(candidates, []*irma.AttributeIdentifier{})
 		candidates[i] = client.Candidates(disjunction)
-		if len(candidates[i]) == 0 {
+		if len(candidates[i]) == 0 && !disjunction.Optional {
 			missing = append(missing, disjunction)
 		}
 	}
 	return candidates, missing
 }
 
+// MissingCredentialType is a credential type that would provide one or more of the attributes
+// of a disjunction that the client cannot satisfy.
+type MissingCredentialType struct {
+	ID         irma.CredentialTypeIdentifier
+	Name       irma.TranslatedString `json:",omitempty"`
+	IssuerName irma.TranslatedString `json:",omitempty"`
+	IssueURL   irma.TranslatedString `json:",omitempty"`
+	// The attributes of the disjunction that this credential type provides
+	Attributes []irma.AttributeTypeIdentifier
+}
+
+// MissingDisjunction describes a disjunction that the client cannot satisfy, along with the
+// credential types with which it could be satisfied. Credential types unknown to the client
+// have only their ID set.
+type MissingDisjunction struct {
+	Disjunction     *irma.AttributeDisjunction
+	CredentialTypes []*MissingCredentialType
+}
+
+// MissingReport describes for each of the specified unsatisfiable disjunctions (as returned by
+// CheckSatisfiability()) which credential types the user could obtain to satisfy it.
+func (client *Client) MissingReport(missing irma.AttributeDisjunctionList) []*MissingDisjunction {
+	report := make([]*MissingDisjunction, 0, len(missing))
+	for _, disjunction := range missing {
+		md := &MissingDisjunction{Disjunction: disjunction}
+		credtypes := map[irma.CredentialTypeIdentifier]*MissingCredentialType{}
+		for _, attr := range disjunction.Attributes {
+			id := attr.CredentialTypeIdentifier()
+			mc, seen := credtypes[id]
+			if !seen {
+				mc = &MissingCredentialType{ID: id}
+				if credtype := client.Configuration.CredentialTypes[id]; credtype != nil {
+					mc.Name = credtype.Name
+					mc.IssueURL = credtype.IssueURL
+				}
+				if issuer := client.Configuration.Issuers[id.IssuerIdentifier()]; issuer != nil {
+					mc.IssuerName = issuer.Name
+				}
+				credtypes[id] = mc
+				md.CredentialTypes = append(md.CredentialTypes, mc)
+			}
+			mc.Attributes = append(mc.Attributes, attr)
+		}
+		report = append(report, md)
+	}
+	return report
+}
+
 // attributeGroup points to a credential and some of its attributes which are to be disclosed
 type attributeGroup struct {
 	cred  irma.CredentialIdentifier
@@ -505,6 +741,11 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 	todisclose := make([]attributeGroup, 0, len(choice.Attributes))
 	attributeIndices := make(irma.DisclosedAttributeIndices, len(choice.Attributes))
 	for i, attribute := range choice.Attributes {
+		if attribute == nil {
+			// Skipped optional disjunction, for which nothing is disclosed
+			attributeIndices[i] = []*irma.DisclosedAttributeIndex{}
+			continue
+		}
 		var credIndex int
 		ici := attribute.CredentialIdentifier()
 		if _, present := credIndices[ici]; !present {
@@ -524,6 +765,22 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 			}
 			continue // In this case we only disclose the metadata attribute, which is already handled above
 		}
+		if identifier.IsWildcard() {
+			// Disclose all attributes of the credential, pointing to its metadata attribute first
+			attrs, err := client.Configuration.WildcardAttributes(identifier)
+			if err != nil {
+				return nil, nil, err
+			}
+			attributeIndices[i] = []*irma.DisclosedAttributeIndex{
+				{CredentialIndex: credIndex, AttributeIndex: 1, Identifier: ici},
+			}
+			for j := range attrs {
+				attributeIndices[i] = append(attributeIndices[i],
+					&irma.DisclosedAttributeIndex{CredentialIndex: credIndex, AttributeIndex: j + 2, Identifier: ici})
+				todisclose[credIndex].attrs = append(todisclose[credIndex].attrs, j+2)
+			}
+			continue
+		}
 
 		attrIndex, err := client.Configuration.CredentialTypes[identifier.CredentialTypeIdentifier()].IndexOf(identifier)
 		if err != nil {
@@ -543,6 +800,15 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 // ProofBuilders constructs a list of proof builders for the specified attribute choice.
 func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.SessionRequest, issig bool,
 ) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, error) {
+	if choice != nil {
+		disjunctions := request.ToDisclose()
+		for i, attribute := range choice.Attributes {
+			if attribute == nil && (i >= len(disjunctions) || !disjunctions[i].Optional) {
+				return nil, nil, errors.Errorf("No attribute chosen for disjunction %d, which is not optional", i)
+			}
+		}
+	}
+
 	todisclose, attributeIndices, err := client.groupCredentials(choice)
 	if err != nil {
 		return nil, nil, err
@@ -587,6 +853,8 @@ func (client *Client) Proofs(choice *irma.DisclosureChoice, request irma.Session
 	return &irma.Disclosure{
 		Proofs:  builders.BuildProofList(request.GetContext(), request.GetNonce(), issig),
 		Indices: choices,
+		Nonce:   request.GetNonce(),
+		Context: request.GetContext(),
 	}, nil
 }
 
@@ -597,9 +865,13 @@ func generateIssuerProofNonce() (*big.Int, error) {
 
 // IssuanceProofBuilders constructs a list of proof builders in the issuance protocol
 // for the future credentials as well as possibly any disclosed attributes, and generates
-// a nonce against which the issuer's proof of knowledge must verify.
+// a nonce against which the issuer's proof of knowledge must verify. Attribute values of the future
+// credentials referring to disclosed attributes are resolved (see irma.IssuanceRequest.ResolveReferences()).
 func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest,
 ) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, *big.Int, error) {
+	if err := client.resolveReferences(request); err != nil {
+		return nil, nil, nil, err
+	}
 	issuerProofNonce, err := generateIssuerProofNonce()
 	if err != nil {
 		return nil, nil, nil, err
@@ -641,6 +913,48 @@ func (client *Client) IssueCommitments(request *irma.IssuanceRequest,
 	}, builders, nil
 }
 
+// resolveReferences replaces the values of attributes of the credentials to be issued that refer to a
+// disclosed attribute by the value of the attribute chosen to be disclosed, as the issuer will do.
+func (client *Client) resolveReferences(request *irma.IssuanceRequest) error {
+	disclosed := map[irma.AttributeTypeIdentifier]*string{}
+	if request.Choice != nil {
+		for _, ai := range request.Choice.Attributes {
+			if ai == nil {
+				continue
+			}
+			attrs := client.attributesByHash(ai.CredentialHash)
+			if attrs == nil {
+				return errors.Errorf("Chosen attribute %s not found", ai.Type.String())
+			}
+			ids := []irma.AttributeTypeIdentifier{ai.Type}
+			if ai.Type.IsWildcard() {
+				var err error
+				if ids, err = client.Configuration.WildcardAttributes(ai.Type); err != nil {
+					return err
+				}
+			}
+			for _, id := range ids {
+				if _, ok := disclosed[id]; !ok {
+					disclosed[id] = attrs.UntranslatedAttribute(id)
+				}
+			}
+		}
+	}
+	return request.ResolveReferences(disclosed)
+}
+
+// attributesByHash returns the attributes of the credential with the specified hash, or nil if we do not have it.
+func (client *Client) attributesByHash(hash string) *irma.AttributeList {
+	for _, attrlistlist := range client.attributes {
+		for _, attrs := range attrlistlist {
+			if attrs.Hash() == hash {
+				return attrs
+			}
+		}
+	}
+	return nil
+}
+
 // ConstructCredentials constructs and saves new credentials using the specified issuance signature messages
 // and credential builders.
 func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest, builders gabi.ProofBuilderList) error {
@@ -670,12 +984,20 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 		gabicreds = append(gabicreds, cred)
 	}
 
+	var reissue map[irma.CredentialTypeIdentifier]*irma.ReissueChoice
+	if request.Choice != nil {
+		reissue = request.Choice.Reissue
+	}
 	for _, gabicred := range gabicreds {
 		newcred, err := newCredential(gabicred, client.Configuration)
 		if err != nil {
 			return err
 		}
-		if err = client.addCredential(newcred, true); err != nil {
+		var choice *irma.ReissueChoice
+		if credtype := newcred.CredentialType(); credtype != nil {
+			choice = reissue[credtype.Identifier()]
+		}
+		if err = client.addCredential(newcred, true, choice); err != nil {
 			return err
 		}
 	}
@@ -725,7 +1047,7 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 		return errors.New("PIN too short, must be at least 5 characters")
 	}
 
-	transport := irma.NewHTTPTransport(manager.KeyshareServer)
+	transport := client.newKeyshareTransport(manager.KeyshareServer)
 	kss, err := newKeyshareServer(managerID, manager.KeyshareServer)
 	if err != nil {
 		return err
@@ -770,7 +1092,7 @@ func (client *Client) KeyshareVerifyPin(pin string, schemeid irma.SchemeManagerI
 		}
 	}
 	kss := client.keyshareServers[schemeid]
-	return verifyPinWorker(pin, kss, irma.NewHTTPTransport(kss.URL))
+	return verifyPinWorker(pin, kss, client.newKeyshareTransport(kss.URL))
 }
 
 func (client *Client) KeyshareChangePin(manager irma.SchemeManagerIdentifier, oldPin string, newPin string) {
@@ -788,7 +1110,7 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 		return errors.New("Unknown keyshare server")
 	}
 
-	transport := irma.NewHTTPTransport(kss.URL)
+	transport := client.newKeyshareTransport(kss.URL)
 	message := keyshareChangepin{
 		Username: kss.Username,
 		OldPin:   kss.HashedPin(oldPin),
@@ -838,6 +1160,78 @@ func (client *Client) KeyshareRemoveAll() error {
 	return client.storage.StoreKeyshareServers(client.keyshareServers)
 }
 
+// updateKeyshareServers updates the URL of keyshare server registrations whose scheme specifies
+// another keyshare server URL, e.g. after a scheme update, provided that the keyshare server at
+// the new URL knows our account. If it does not, the handler is asked to have the user re-enroll.
+// If the new keyshare server cannot be reached, this is retried the next time.
+func (client *Client) updateKeyshareServers() error {
+	changed := false
+	for id, kss := range client.keyshareServers {
+		manager, ok := client.Configuration.SchemeManagers[id]
+		if !ok || !manager.Distributed() || manager.KeyshareServer == kss.URL {
+			continue
+		}
+		err := client.checkKeyshareAccount(kss, manager.KeyshareServer)
+		if serr, ok := err.(*irma.SessionError); ok && serr.RemoteError != nil &&
+			(serr.RemoteError.ErrorName == "USER_NOT_FOUND" || serr.RemoteError.ErrorName == "USER_NOT_REGISTERED") {
+			irma.Logger.Warnf("Keyshare server of scheme %s moved to %s, which does not know our account", id, manager.KeyshareServer)
+			client.handler.KeyshareEnrollmentInvalid(id, err)
+			continue
+		}
+		if err != nil {
+			irma.Logger.Warnf("Keyshare server of scheme %s moved to %s, which could not be verified: %s",
+				id, manager.KeyshareServer, err.Error())
+			continue
+		}
+		irma.Logger.Infof("Keyshare server of scheme %s moved from %s to %s", id, kss.URL, manager.KeyshareServer)
+		kss.URL = manager.KeyshareServer
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return client.storage.StoreKeyshareServers(client.keyshareServers)
+}
+
+// checkKeyshareAccount checks that the keyshare server at the specified URL knows the account
+// of the specified keyshare server registration.
+func (client *Client) checkKeyshareAccount(kss *keyshareServer, url string) error {
+	transport := client.newKeyshareTransport(url)
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	transport.SetHeader(kssAuthHeader, "Bearer "+kss.token)
+	transport.SetHeader(kssVersionHeader, "2")
+	auth := &keyshareAuthorization{}
+	if err := transport.Post("users/isAuthorized", auth, ""); err != nil {
+		return err
+	}
+	if auth.Status != kssAuthorized && auth.Status != kssTokenExpired {
+		return errors.Errorf("Keyshare server returned unexpected status %s", auth.Status)
+	}
+	return nil
+}
+
+// newHTTPTransport returns a transport to the specified IRMA server URL using the configured
+// http.RoundTripper, if any, enforcing the TLS pins of the schemes running at its host.
+func (client *Client) newHTTPTransport(url string) *irma.HTTPTransport {
+	transport := irma.NewHTTPTransport(url)
+	transport.SetRoundTripper(client.options.Transport)
+	transport.SetTLSPins(client.Configuration.TLSPins(url))
+	transport.SetTimeout(client.options.SessionTimeout, irma.SubsystemSession)
+	return transport
+}
+
+// newKeyshareTransport is like newHTTPTransport, but for keyshare servers, which may take
+// longer to respond than IRMA servers.
+func (client *Client) newKeyshareTransport(url string) *irma.HTTPTransport {
+	transport := client.newHTTPTransport(url)
+	timeout := client.options.KeyshareTimeout
+	if timeout == 0 {
+		timeout = irma.DefaultKeyshareTimeout
+	}
+	transport.SetTimeout(timeout, irma.SubsystemKeyshare)
+	return transport
+}
+
 // Add, load and store log entries
 
 func (client *Client) addLogEntry(entry *LogEntry) error {
@@ -865,6 +1259,50 @@ func (client *Client) SetCrashReportingPreference(enable bool) {
 	client.applyPreferences()
 }
 
+// SetDiscloseExpiredPreference toggles whether or not expired credentials are offered as
+// disclosure candidates.
+func (client *Client) SetDiscloseExpiredPreference(enable bool) {
+	client.Preferences.DiscloseExpired = enable
+	_ = client.storage.StorePreferences(client.Preferences)
+}
+
+// SetRemoveExpiredPreference sets after how long past their expiry date expired credentials
+// are automatically removed (0 to disable). Takes effect immediately and at each restart.
+func (client *Client) SetRemoveExpiredPreference(after time.Duration) error {
+	client.Preferences.RemoveExpiredAfter = after
+	if err := client.storage.StorePreferences(client.Preferences); err != nil {
+		return err
+	}
+	if after == 0 {
+		return nil
+	}
+	return client.RemoveExpiredCredentials(after)
+}
+
+// SetLanguagePreference sets the languages of the device, in order of preference.
+func (client *Client) SetLanguagePreference(languages ...string) {
+	client.Preferences.Languages = languages
+	_ = client.storage.StorePreferences(client.Preferences)
+}
+
+// SetSessionThrottlePreference sets how many sessions a requestor may start within the specified
+// window before its sessions are throttled (0 to disable), and whether throttled sessions are
+// declined instead of asking the user for confirmation.
+func (client *Client) SetSessionThrottlePreference(threshold int, window time.Duration, decline bool) {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	client.Preferences.SessionThrottleThreshold = threshold
+	client.Preferences.SessionThrottleWindow = window
+	client.Preferences.SessionThrottleDecline = decline
+	_ = client.storage.StorePreferences(client.Preferences)
+}
+
+// DisjunctionLabel returns the label of the specified disjunction in the preferred language of the
+// device, or in the first of its other languages in which the label is translated.
+func (client *Client) DisjunctionLabel(disjunction *irma.AttributeDisjunction) string {
+	return disjunction.TranslatedLabel(client.Preferences.Languages...)
+}
+
 func (client *Client) applyPreferences() {
 	if client.Preferences.EnableCrashReporting {
 		raven.SetDSN(SentryDSN)
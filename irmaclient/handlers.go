@@ -55,6 +55,11 @@ func (h *keyshareEnrollmentHandler) fail(err error) {
 // Not interested, ingore
 func (h *keyshareEnrollmentHandler) StatusUpdate(action irma.Action, status irma.Status) {}
 
+// The user asked for enrollment, so it should proceed even if the keyshare server is throttled
+func (h *keyshareEnrollmentHandler) RequestThrottledSessionConfirmation(origin string, sessions int, callback func(proceed bool)) {
+	callback(true)
+}
+
 // The methods below should never be called, so we let each of them fail the session
 func (h *keyshareEnrollmentHandler) RequestVerificationPermission(request irma.DisclosureRequest, ServerName irma.TranslatedString, callback PermissionHandler) {
 	callback(false, nil)
@@ -65,6 +70,9 @@ func (h *keyshareEnrollmentHandler) RequestSignaturePermission(request irma.Sign
 func (h *keyshareEnrollmentHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
 	callback(false)
 }
+func (h *keyshareEnrollmentHandler) RequestSchemeManagerInstallPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	callback(false)
+}
 func (h *keyshareEnrollmentHandler) Cancelled() {
 	h.fail(errors.New("Keyshare enrollment session unexpectedly cancelled"))
 }
@@ -80,6 +88,6 @@ func (h *keyshareEnrollmentHandler) KeyshareEnrollmentDeleted(manager irma.Schem
 func (h *keyshareEnrollmentHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
 	h.fail(errors.New("Keyshare enrollment failed: unenrolled"))
 }
-func (h *keyshareEnrollmentHandler) UnsatisfiableRequest(ServerName irma.TranslatedString, missing irma.AttributeDisjunctionList) {
+func (h *keyshareEnrollmentHandler) UnsatisfiableRequest(ServerName irma.TranslatedString, missing []*MissingDisjunction) {
 	h.fail(errors.New("Keyshare enrollment failed: unsatisfiable"))
 }
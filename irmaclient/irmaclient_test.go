@@ -1,13 +1,21 @@
 package irmaclient
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
-
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
@@ -162,6 +170,389 @@ func TestCandidates(t *testing.T) {
 	require.Empty(t, attrs)
 }
 
+func TestMissingReport(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	firstname := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+	familyname := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname")
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	unknown := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.unknown.foo")
+	disjunctions := irma.AttributeDisjunctionList{
+		{Label: "satisfiable", Attributes: []irma.AttributeTypeIdentifier{studentID}},
+		{Label: "name", Attributes: []irma.AttributeTypeIdentifier{firstname, bsn, familyname}},
+		{Label: "unknown", Attributes: []irma.AttributeTypeIdentifier{unknown}},
+	}
+
+	_, missing := client.CheckSatisfiability(disjunctions)
+	report := client.MissingReport(missing)
+	require.Len(t, report, 2)
+
+	issuerName := client.Configuration.Issuers[irma.NewIssuerIdentifier("irma-demo.MijnOverheid")].Name
+	require.NotEmpty(t, issuerName)
+
+	require.Equal(t, "name", report[0].Disjunction.Label)
+	require.Len(t, report[0].CredentialTypes, 2)
+	fullName := report[0].CredentialTypes[0]
+	require.Equal(t, firstname.CredentialTypeIdentifier(), fullName.ID)
+	require.Equal(t, []irma.AttributeTypeIdentifier{firstname, familyname}, fullName.Attributes)
+	require.Equal(t, issuerName, fullName.IssuerName)
+	require.NotEmpty(t, fullName.Name)
+	root := report[0].CredentialTypes[1]
+	require.Equal(t, bsn.CredentialTypeIdentifier(), root.ID)
+	require.Equal(t, []irma.AttributeTypeIdentifier{bsn}, root.Attributes)
+
+	require.Equal(t, "unknown", report[1].Disjunction.Label)
+	require.Len(t, report[1].CredentialTypes, 1)
+	require.Equal(t, unknown.CredentialTypeIdentifier(), report[1].CredentialTypes[0].ID)
+	require.Empty(t, report[1].CredentialTypes[0].Name)
+}
+
+func TestDisjunctionLabelLanguage(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	disjunction := &irma.AttributeDisjunction{
+		Label:  "Student number",
+		Labels: irma.TranslatedString{"en": "Student number", "nl": "Studentnummer"},
+	}
+	require.Equal(t, "Student number", client.DisjunctionLabel(disjunction))
+
+	client.SetLanguagePreference("nl-NL", "en-GB")
+	require.Equal(t, "Studentnummer", client.DisjunctionLabel(disjunction))
+	prefs, err := client.storage.LoadPreferences()
+	require.NoError(t, err)
+	require.Equal(t, []string{"nl-NL", "en-GB"}, prefs.Languages)
+
+	client.SetLanguagePreference("de")
+	require.Equal(t, "Student number", client.DisjunctionLabel(disjunction))
+}
+
+// addExpiredCredential adds to the client a copy of its studentCard credential that
+// expired a year ago, returning the attributes of the valid original and the expired copy.
+func addExpiredCredential(t *testing.T, client *Client) (*irma.AttributeList, *irma.AttributeList) {
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	require.Len(t, client.attributes[id], 1)
+	valid := client.attributes[id][0]
+
+	metadata := valid.MetadataAttribute.Bytes()
+	signed := time.Now().AddDate(-1, 0, -7).Unix() / irma.ExpiryFactor
+	binary.BigEndian.PutUint16(metadata[2:4], uint16(signed)) // signing date
+	binary.BigEndian.PutUint16(metadata[4:6], 1)              // validity of one week
+	ints := append([]*big.Int{new(big.Int).SetBytes(metadata)}, valid.Ints[1:]...)
+	expired := irma.NewAttributeListFromInts(ints, client.Configuration)
+	require.False(t, expired.IsValid())
+
+	client.attributes[id] = append(client.attributes[id], expired)
+	require.NoError(t, fs.Copy(
+		client.storage.path(client.storage.signatureFilename(valid)),
+		client.storage.path(client.storage.signatureFilename(expired)),
+	))
+	return valid, expired
+}
+
+func TestExpiredCandidates(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	valid, expired := addExpiredCredential(t, client)
+
+	disjunction := &irma.AttributeDisjunction{
+		Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+	}
+
+	// By default only the valid instance is a candidate
+	attrs := client.Candidates(disjunction)
+	require.Len(t, attrs, 1)
+	require.Equal(t, valid.Hash(), attrs[0].CredentialHash)
+	require.False(t, attrs[0].Expired)
+
+	// If enabled, the expired one is included too, and marked as such
+	client.SetDiscloseExpiredPreference(true)
+	attrs = client.Candidates(disjunction)
+	require.Len(t, attrs, 2)
+	for _, attr := range attrs {
+		require.Equal(t, attr.CredentialHash == expired.Hash(), attr.Expired)
+	}
+}
+
+func TestRemoveExpiredCredentials(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	valid, _ := addExpiredCredential(t, client)
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	// Not expired long enough to be removed
+	require.NoError(t, client.SetRemoveExpiredPreference(2*365*24*time.Hour))
+	require.Len(t, client.attributes[id], 2)
+
+	require.NoError(t, client.SetRemoveExpiredPreference(30*24*time.Hour))
+	require.Len(t, client.attributes[id], 1)
+	require.Equal(t, valid.Hash(), client.attributes[id][0].Hash())
+
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	entry := logs[len(logs)-1]
+	require.Equal(t, actionRemoval, entry.Type)
+	require.Equal(t, RemovalReasonExpired, entry.RemovalReason)
+	require.Contains(t, entry.Removed, id)
+}
+
+func TestStorageDowngrade(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	version, err := client.storage.LoadVersion()
+	require.NoError(t, err)
+	require.Equal(t, storageVersion, version)
+
+	// An older client must refuse storage of a newer version
+	require.NoError(t, client.storage.StoreVersion(storageVersion+1))
+	_, err = New(
+		"../testdata/storage/test",
+		"../testdata/irma_configuration",
+		"",
+		&TestClientHandler{t: t},
+	)
+	require.Error(t, err)
+}
+
+// TestStorageInterruptedWrites simulates the app being killed while writing to storage, and checks
+// that the previous state survives intact and that the remains of the writes are cleaned up.
+func TestStorageInterruptedWrites(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	credentials := client.CredentialInfoList()
+	attrs, err := ioutil.ReadFile(client.storage.path(attributesFile))
+	require.NoError(t, err)
+
+	// Killed while writing the attributes file and a signature, before renaming the temp files
+	_, err = fs.WriteTempFile(client.storage.path(attributesFile), []byte(`[{"foo":`))
+	require.NoError(t, err)
+	_, err = fs.WriteTempFile(client.storage.path(signaturesDir+"/foo"), []byte(`{"A":`))
+	require.NoError(t, err)
+	// Killed while adding a credential, after storing its signature but before the attributes file
+	_, expired := addExpiredCredential(t, client)
+	sigfile := client.storage.path(client.storage.signatureFilename(expired))
+
+	client, err = New(
+		"../testdata/storage/test",
+		"../testdata/irma_configuration",
+		"",
+		&TestClientHandler{t: t},
+	)
+	require.NoError(t, err)
+	require.Equal(t, credentials, client.CredentialInfoList())
+	verifyCredentials(t, client)
+	bts, err := ioutil.ReadFile(client.storage.path(attributesFile))
+	require.NoError(t, err)
+	require.Equal(t, attrs, bts)
+
+	exists, err := fs.PathExists(sigfile)
+	require.NoError(t, err)
+	require.False(t, exists)
+	for _, dir := range []string{"", signaturesDir + "/"} {
+		matches, err := filepath.Glob(client.storage.path(dir + fs.TempFilePrefix + "*"))
+		require.NoError(t, err)
+		require.Empty(t, matches)
+	}
+
+	// Committing a temp file replaces the old file
+	tempfile, err := fs.WriteTempFile(client.storage.path(logsFile), []byte("[]"))
+	require.NoError(t, err)
+	require.NoError(t, fs.CommitTempFile(tempfile, client.storage.path(logsFile)))
+	logs, err := client.storage.LoadLogs()
+	require.NoError(t, err)
+	require.Empty(t, logs)
+}
+
+func TestSign(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	attrid := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := &irma.SignatureRequest{
+		Message: "I owe you everything",
+		DisclosureRequest: irma.DisclosureRequest{
+			BaseRequest: irma.BaseRequest{Type: irma.ActionSigning},
+			Content: irma.AttributeDisjunctionList{
+				&irma.AttributeDisjunction{Label: "foo", Attributes: []irma.AttributeTypeIdentifier{attrid}},
+			},
+		},
+	}
+	candidates := client.Candidates(request.Content[0])
+	require.NotEmpty(t, candidates)
+
+	signature, err := client.Sign(request, SignOptions{
+		Choice:      &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{candidates[0]}},
+		NoTimestamp: true,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, request.Nonce)
+
+	attrs, status, err := signature.Verify(client.Configuration, request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	require.Equal(t, "456", attrs[0].Value["en"])
+	_, status, err = signature.Verify(client.Configuration, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	entry := logs[len(logs)-1]
+	require.Equal(t, irma.ActionSigning, entry.Type)
+	logged, err := entry.GetSignedMessage()
+	require.NoError(t, err)
+	require.Equal(t, request.Message, logged.Message)
+
+	// Without a choice, a handler is required
+	_, err = client.Sign(request, SignOptions{NoTimestamp: true})
+	require.Error(t, err)
+}
+
+// disclosureProofs computes disclosure proofs of n copies of the studentCard credential,
+// as if n different credentials were disclosed.
+func disclosureProofs(t require.TestingT, client *Client, n int) (irma.ProofList, *big.Int, *big.Int) {
+	cred, err := client.credential(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), 0)
+	require.NoError(t, err)
+	builders := make(gabi.ProofBuilderList, n)
+	for i := range builders {
+		builders[i] = cred.Credential.CreateDisclosureProofBuilder([]int{1, 2})
+	}
+	context, nonce := big.NewInt(1), big.NewInt(1000)
+	return irma.ProofList(builders.BuildProofList(context, nonce, false)), context, nonce
+}
+
+func TestVerifyMultipleProofs(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	proofs, context, nonce := disclosureProofs(t, client, 8)
+	corrupted, _, _ := disclosureProofs(t, client, 8)
+	proofd := corrupted[5].(*gabi.ProofD)
+	proofd.A = new(big.Int).Add(proofd.A, big.NewInt(1))
+
+	// Verify concurrently, for the race detector
+	var wg sync.WaitGroup
+	results := make([]bool, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			list := proofs
+			if i%2 == 1 {
+				list = corrupted
+			}
+			valid, err := list.VerifyProofs(client.Configuration, context, nonce, nil, false)
+			results[i] = err == nil && valid
+		}(i)
+	}
+	wg.Wait()
+	for i, valid := range results {
+		require.Equal(t, i%2 == 0, valid)
+	}
+}
+
+// TestVerifyDisjunctionResults checks the per-disjunction results of verifying disclosures that
+// cover only some of the disjunctions of a request.
+func TestVerifyDisjunctionResults(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	university := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")
+	over12 := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over12")
+	base := irma.BaseRequest{Type: irma.ActionDisclosing, Context: big.NewInt(1), Nonce: big.NewInt(42)}
+	// Verification keeps state in the disjunctions, so we use a new request for each verification
+	newRequest := func() *irma.DisclosureRequest {
+		return &irma.DisclosureRequest{
+			BaseRequest: base,
+			Content: irma.AttributeDisjunctionList{
+				{Label: "studentID", Attributes: []irma.AttributeTypeIdentifier{studentID}},
+				{Label: "university", Attributes: []irma.AttributeTypeIdentifier{university}},
+				{Label: "over12", Attributes: []irma.AttributeTypeIdentifier{over12}},
+			},
+		}
+	}
+	// prove discloses attributes satisfying the first n disjunctions of the request
+	prove := func(n int) *irma.Disclosure {
+		request := newRequest()
+		request.Content = request.Content[:n]
+		choice := &irma.DisclosureChoice{}
+		for _, disjunction := range request.Content {
+			candidates := client.Candidates(disjunction)
+			require.NotEmpty(t, candidates)
+			choice.Attributes = append(choice.Attributes, candidates[0])
+		}
+		disclosure, err := client.Proofs(choice, request, false)
+		require.NoError(t, err)
+		return disclosure
+	}
+	verify := func(disclosure *irma.Disclosure, request *irma.DisclosureRequest) ([]*irma.DisjunctionResult, irma.ProofStatus) {
+		attrs, status, err := disclosure.Verify(client.Configuration, request)
+		require.NoError(t, err)
+		results := irma.DisjunctionResults(request.Content, attrs)
+		require.Len(t, results, len(request.Content))
+		return results, status
+	}
+	requireSatisfied := func(result *irma.DisjunctionResult, id irma.AttributeTypeIdentifier, attrIndex int) {
+		require.True(t, result.Satisfied)
+		require.Equal(t, irma.AttributeProofStatusPresent, result.Status)
+		require.Equal(t, id, *result.Attribute)
+		require.Equal(t, 0, result.Index.CredentialIndex)
+		require.Equal(t, attrIndex, result.Index.AttributeIndex)
+	}
+	requireUnsatisfied := func(result *irma.DisjunctionResult) {
+		require.False(t, result.Satisfied)
+		require.Equal(t, irma.AttributeProofStatusMissing, result.Status)
+		require.Nil(t, result.Attribute)
+		require.Nil(t, result.Index)
+	}
+
+	// The client has no over12 attribute, so it can prove at most the first two disjunctions
+	disclosure := prove(2)
+	results, status := verify(disclosure, newRequest())
+	require.Equal(t, irma.ProofStatusMissingAttributes, status)
+	requireSatisfied(results[0], studentID, 4)
+	requireSatisfied(results[1], university, 2)
+	requireUnsatisfied(results[2])
+
+	// The same without indices, as sent by older clients
+	disclosure.Indices = nil
+	results, status = verify(disclosure, newRequest())
+	require.Equal(t, irma.ProofStatusMissingAttributes, status)
+	requireSatisfied(results[0], studentID, 4)
+	requireSatisfied(results[1], university, 2)
+	requireUnsatisfied(results[2])
+
+	results, status = verify(prove(1), newRequest())
+	require.Equal(t, irma.ProofStatusMissingAttributes, status)
+	requireSatisfied(results[0], studentID, 4)
+	requireUnsatisfied(results[1])
+	requireUnsatisfied(results[2])
+
+	// A disclosed attribute not having the required value is reported, but does not satisfy its disjunction
+	value := "123"
+	request := newRequest()
+	request.Content = request.Content[:2]
+	request.Content[0].Values = map[irma.AttributeTypeIdentifier]*string{studentID: &value}
+	results, status = verify(prove(2), request)
+	require.Equal(t, irma.ProofStatusUnsatisfiedCondition, status)
+	require.False(t, results[0].Satisfied)
+	require.Equal(t, irma.AttributeProofStatusInvalidValue, results[0].Status)
+	require.Equal(t, studentID, *results[0].Attribute)
+	requireSatisfied(results[1], university, 2)
+
+	// All disjunctions that the client can satisfy
+	request = newRequest()
+	request.Content = request.Content[:2]
+	results, status = verify(prove(2), request)
+	require.Equal(t, irma.ProofStatusValid, status)
+	requireSatisfied(results[0], studentID, 4)
+	requireSatisfied(results[1], university, 2)
+}
+
 func TestCredentialRemoval(t *testing.T) {
 	client := parseStorage(t)
 	defer test.ClearTestStorage(t)
@@ -231,6 +622,252 @@ func TestCredentialInfoListNewAttribute(t *testing.T) {
 	require.Fail(t, "studentCard credential not found")
 }
 
+func TestCredentialInfoDevelopmentScheme(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	require.NoError(t, fs.CopyDirectory("../testdata/teststorage", "../testdata/storage/test"))
+	schemeid := irma.NewSchemeManagerIdentifier("irma-demo")
+	client, err := NewWithOptions(
+		"../testdata/storage/test",
+		"../testdata/irma_configuration",
+		"",
+		&TestClientHandler{t: t},
+		Options{DevelopmentSchemes: []irma.SchemeManagerIdentifier{schemeid}},
+	)
+	require.NoError(t, err)
+	require.True(t, client.Configuration.SchemeManagers[schemeid].Development)
+
+	var flagged int
+	for _, info := range client.CredentialInfoList() {
+		require.Equal(t, info.SchemeManagerID == schemeid.Name(), info.NonProduction)
+		if info.NonProduction {
+			flagged++
+		}
+	}
+	require.NotZero(t, flagged)
+}
+
+type testUpdateListener chan string
+
+func (l testUpdateListener) SchemesUpdated(diff string) {
+	l <- diff
+}
+
+func TestUpdateSchemes(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	schemeid := irma.NewSchemeManagerIdentifier("irma-demo")
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	attrid := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")
+	conf := client.Configuration
+
+	// Postponed while a session is running
+	client.sessionStarted()
+	_, err := client.UpdateSchemes()
+	require.Equal(t, errSessionsActive, err)
+	client.sessionFinished()
+
+	// Sessions starting during a scheme change wait for it, without blocking on the download
+	done, err := client.startSchemeChange()
+	require.NoError(t, err)
+	_, err = client.UpdateSchemes()
+	require.Equal(t, errSchemesChanging, err)
+	started := make(chan struct{})
+	go func() {
+		client.sessionStarted()
+		close(started)
+	}()
+	select {
+	case <-started:
+		t.Fatal("session started during scheme change")
+	case <-time.After(50 * time.Millisecond):
+	}
+	done()
+	<-started
+	client.sessionFinished()
+
+	// Background updates can be started and stopped concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = client.StartSchemeUpdates(SchemeUpdateOptions{Interval: time.Hour, Gate: func() bool { return false }})
+		}()
+		go func() {
+			defer wg.Done()
+			client.StopSchemeUpdates()
+		}()
+	}
+	wg.Wait()
+	client.StopSchemeUpdates()
+
+	// Unchanged
+	changed, err := client.UpdateSchemes()
+	require.NoError(t, err)
+	require.True(t, changed.Empty())
+
+	// Changed, in the background
+	client.Configuration.SchemeManagers[schemeid].URL = "http://localhost:48681/irma_configuration_updated/irma-demo"
+	listener := make(testUpdateListener, 1)
+	require.NoError(t, client.StartSchemeUpdates(SchemeUpdateOptions{Interval: time.Hour, Listener: listener}))
+	defer client.StopSchemeUpdates()
+	var diff string
+	select {
+	case diff = <-listener:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "scheme update listener not invoked")
+	}
+	changed = &irma.ConfigurationDiff{}
+	require.NoError(t, json.Unmarshal([]byte(diff), changed))
+	require.Equal(t, &irma.ConfigurationDiff{
+		ChangedSchemeManagers: []irma.SchemeManagerIdentifier{schemeid},
+		ChangedCredentialTypes: []*irma.CredentialTypeDiff{{
+			ID:                credid,
+			AddedAttributes:   []irma.AttributeTypeIdentifier{attrid},
+			ChangedAttributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")},
+		}},
+	}, changed)
+	require.True(t, client.Configuration == conf, "configuration pointer should remain stable")
+	require.NotNil(t, client.Configuration.CredentialTypes[credid].AttributeType(attrid))
+}
+
+func TestRemoveScheme(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	schemeid := irma.NewSchemeManagerIdentifier("test")
+	credid := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
+	require.NotEmpty(t, client.attributes[credid])
+	require.Contains(t, client.keyshareServers, schemeid)
+	signature := client.storage.path(client.storage.signatureFilename(client.attributes[credid][0]))
+	require.NoError(t, fs.AssertPathExists(signature))
+
+	// Refused while a session is running
+	client.sessionStarted()
+	require.Equal(t, errSessionsActive, client.RemoveScheme(schemeid))
+	client.sessionFinished()
+	require.Contains(t, client.Configuration.SchemeManagers, schemeid)
+
+	require.NoError(t, client.RemoveScheme(schemeid))
+	require.NotContains(t, client.Configuration.SchemeManagers, schemeid)
+	require.NotContains(t, client.keyshareServers, schemeid)
+	for id := range client.attributes {
+		require.NotEqual(t, schemeid, id.IssuerIdentifier().SchemeManagerIdentifier())
+	}
+	require.NotEmpty(t, client.attributes[irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")])
+	require.NoError(t, fs.AssertPathNotExists(signature))
+	require.NotEmpty(t, client.CredentialInfoList())
+
+	logs, err := client.Logs()
+	require.NoError(t, err)
+	entry := logs[len(logs)-1]
+	require.Equal(t, actionRemoval, entry.Type)
+	require.Equal(t, RemovalReasonSchemeRemoved, entry.RemovalReason)
+	require.Contains(t, entry.Removed, credid)
+
+	// The credentials and keyshare registration remain removed after reopening the client
+	client, err = New(
+		"../testdata/storage/test",
+		"../testdata/irma_configuration",
+		"",
+		&TestClientHandler{t: t},
+	)
+	require.NoError(t, err)
+	require.Empty(t, client.attributes[credid])
+	require.NotContains(t, client.keyshareServers, schemeid)
+
+	require.Error(t, client.RemoveScheme(irma.NewSchemeManagerIdentifier("nonexistent")))
+}
+
+// TestKeyshareTimeout checks that requests to a slow keyshare server time out according to the keyshare
+// timeout, while requests to an IRMA server that are just as slow succeed in parallel.
+func TestKeyshareTimeout(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	client.options.KeyshareTimeout = 100 * time.Millisecond
+	client.options.SessionTimeout = 5 * time.Second
+
+	release := make(chan struct{})
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(300 * time.Millisecond):
+		}
+		_, _ = w.Write([]byte(`"CONNECTED"`))
+	}
+	keyshareServer := httptest.NewServer(http.HandlerFunc(slow))
+	defer keyshareServer.Close()
+	sessionServer := httptest.NewServer(http.HandlerFunc(slow))
+	defer sessionServer.Close()
+	defer close(release)
+
+	schemeid := irma.NewSchemeManagerIdentifier("test")
+	client.keyshareServers[schemeid].URL = keyshareServer.URL
+
+	sessionErr := make(chan error, 1)
+	go func() {
+		var status string
+		sessionErr <- client.newHTTPTransport(sessionServer.URL).Get("status", &status)
+	}()
+
+	_, _, _, err := client.KeyshareVerifyPin("12345", schemeid)
+	require.Error(t, err)
+	serr, ok := err.(*irma.SessionError)
+	require.True(t, ok)
+	require.Equal(t, irma.ErrorTimeout, serr.ErrorType)
+	require.Equal(t, irma.SubsystemKeyshare, serr.Info)
+
+	require.NoError(t, <-sessionErr)
+}
+
+// TestKeyshareServerMoved checks that keyshare server registrations follow the keyshare server
+// URL in the scheme, if the keyshare server at the new URL knows the account of the client.
+func TestKeyshareServerMoved(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	schemeid := irma.NewSchemeManagerIdentifier("test")
+	oldurl := client.keyshareServers[schemeid].URL
+
+	found := true
+	keyshareServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/users/isAuthorized", r.URL.Path)
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"status":404,"error":"USER_NOT_FOUND"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"expired","candidates":[]}`))
+	}))
+	defer keyshareServer.Close()
+
+	// Move the keyshare server in the scheme, which we parse without verifying it
+	descpath := "../testdata/storage/test/irma_configuration/test/description.xml"
+	bts, err := ioutil.ReadFile(descpath)
+	require.NoError(t, err)
+	bts = []byte(strings.Replace(string(bts), oldurl, keyshareServer.URL, 1))
+	require.NoError(t, ioutil.WriteFile(descpath, bts, 0600))
+	options := Options{DevelopmentSchemes: []irma.SchemeManagerIdentifier{schemeid}}
+
+	// The new keyshare server does not know our account
+	found = false
+	handler := &TestClientHandler{t: t, c: make(chan error, 1)}
+	client, err = NewWithOptions("../testdata/storage/test", "../testdata/irma_configuration", "", handler, options)
+	require.NoError(t, err)
+	require.Error(t, <-handler.c)
+	require.Equal(t, oldurl, client.keyshareServers[schemeid].URL)
+
+	// It does
+	found = true
+	client, err = NewWithOptions("../testdata/storage/test", "../testdata/irma_configuration", "", &TestClientHandler{t: t}, options)
+	require.NoError(t, err)
+	require.Equal(t, keyshareServer.URL, client.keyshareServers[schemeid].URL)
+	ksses, err := client.storage.LoadKeyshareServers()
+	require.NoError(t, err)
+	require.Equal(t, keyshareServer.URL, ksses[schemeid].URL)
+}
+
 // ------
 
 type TestClientHandler struct {
@@ -240,6 +877,7 @@ type TestClientHandler struct {
 
 func (i *TestClientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {}
 func (i *TestClientHandler) UpdateAttributes()                               {}
+func (i *TestClientHandler) ResumableSessions(sessions []*ResumableSession)  {}
 func (i *TestClientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
 	select {
 	case i.c <- nil: // nop
@@ -253,6 +891,13 @@ func (i *TestClientHandler) EnrollmentFailure(manager irma.SchemeManagerIdentifi
 		i.t.Fatal(err)
 	}
 }
+func (i *TestClientHandler) KeyshareEnrollmentInvalid(manager irma.SchemeManagerIdentifier, err error) {
+	select {
+	case i.c <- err: // nop
+	default:
+		i.t.Fatal(err)
+	}
+}
 func (i *TestClientHandler) ChangePinSuccess(manager irma.SchemeManagerIdentifier) {
 	select {
 	case i.c <- nil: // nop
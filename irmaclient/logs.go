@@ -19,10 +19,16 @@ type LogEntry struct {
 	Request json.RawMessage     `json:",omitempty"` // Message that started the session
 	request irma.SessionRequest // cached parsed version of Request; get with LogEntry.SessionRequest()
 
+	// Name of the requestor as shown to the user during the session; empty for local signatures
+	ServerName irma.TranslatedString `json:",omitempty"`
+
 	// Session type-specific info
 	Removed       map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:",omitempty"` // In case of credential removal
+	RemovalReason string                                                    `json:",omitempty"` // In case of credential removal
 	SignedMessage []byte                                                    `json:",omitempty"` // In case of signature sessions
 	Timestamp     *atum.Timestamp                                           `json:",omitempty"` // In case of signature sessions
+	// Type of SignedMessage in case of signature sessions; irma.SignedMessageTypeString if empty
+	SignedMessageType string `json:",omitempty"`
 
 	IssueCommitment *irma.IssueCommitmentMessage `json:",omitempty"`
 	Disclosure      *irma.Disclosure             `json:",omitempty"`
@@ -30,6 +36,16 @@ type LogEntry struct {
 
 const actionRemoval = irma.Action("removal")
 
+// RemovalReasons of log entries of credentials that were removed automatically.
+const (
+	// RemovalReasonExpired: the credential had expired for too long
+	RemovalReasonExpired = "expired"
+	// RemovalReasonReplaced: the credential was replaced by a newly issued instance
+	RemovalReasonReplaced = "replaced"
+	// RemovalReasonSchemeRemoved: the scheme of the credential was removed
+	RemovalReasonSchemeRemoved = "schemeRemoved"
+)
+
 func (entry *LogEntry) SessionRequest() (irma.SessionRequest, error) {
 	if entry.request == nil {
 		switch entry.Type {
@@ -104,21 +120,119 @@ func (entry *LogEntry) GetSignedMessage() (abs *irma.SignedMessage, err error) {
 		return nil, err
 	}
 	sigrequest := request.(*irma.SignatureRequest)
-	return &irma.SignedMessage{
-		Signature: entry.Disclosure.Proofs,
-		Nonce:     sigrequest.Nonce,
-		Context:   sigrequest.Context,
-		Message:   string(entry.SignedMessage),
-		Timestamp: entry.Timestamp,
-	}, nil
+	abs = &irma.SignedMessage{
+		Signature:   entry.Disclosure.Proofs,
+		Indices:     entry.Disclosure.Indices,
+		Nonce:       sigrequest.Nonce,
+		Context:     sigrequest.Context,
+		Message:     string(entry.SignedMessage),
+		MessageType: entry.SignedMessageType,
+		Timestamp:   entry.Timestamp,
+		Request: &irma.SignedMessageRequest{
+			Content: sigrequest.Content,
+			Bound:   sigrequest.Version != nil && !sigrequest.Version.Below(2, 5),
+		},
+	}
+	if sigrequest.Detached {
+		abs.Detach()
+	}
+	return abs, nil
+}
+
+// SignatureInfo describes an attribute-based signature that the user made in the past,
+// reconstructed from the logs (see Client.GetSignatures()).
+type SignatureInfo struct {
+	Signature  *irma.SignedMessage
+	Time       irma.Timestamp        // Time at which the signature was made
+	ServerName irma.TranslatedString // Requestor of the signature; empty for local signatures
+	// Document of which the digest was signed, if the message is of type irma.SignedMessageTypeSHA256
+	Document *irma.SignedDocument
+	// Log entry of the signature, with which it can be verified or exported
+	LogEntry *LogEntry
+}
+
+// GetSignatures returns the attribute-based signatures that the user made in the past, in the order
+// in which they were made.
+func (client *Client) GetSignatures() ([]*SignatureInfo, error) {
+	logs, err := client.Logs()
+	if err != nil {
+		return nil, err
+	}
+	var signatures []*SignatureInfo
+	for _, entry := range logs {
+		if entry.Type != irma.ActionSigning {
+			continue
+		}
+		abs, err := entry.GetSignedMessage()
+		if err != nil {
+			return nil, err
+		}
+		info := &SignatureInfo{
+			Signature:  abs,
+			Time:       entry.Time,
+			ServerName: entry.ServerName,
+			LogEntry:   entry,
+		}
+		if abs.MessageType == irma.SignedMessageTypeSHA256 {
+			if info.Document, err = irma.ParseSignedDocument(string(entry.SignedMessage)); err != nil {
+				return nil, err
+			}
+		}
+		signatures = append(signatures, info)
+	}
+	return signatures, nil
+}
+
+// VerifyOwnSignature verifies the attribute-based signature of the specified log entry against the
+// current schemes, and against the signature request of the entry. If the scheme, credential type or
+// public key of one of the credentials of the signature is no longer installed, so that the signature
+// can no longer be verified, the reason of the returned validity is irma.ProofStatusReasonUnknownPublicKey
+// and no error is returned.
+func (client *Client) VerifyOwnSignature(entry *LogEntry) (*irma.SignatureValidity, error) {
+	abs, err := entry.GetSignedMessage()
+	if err != nil {
+		return nil, err
+	}
+	if abs == nil {
+		return nil, errors.New("Log entry is not of a signature session")
+	}
+	request, err := entry.SessionRequest()
+	if err != nil {
+		return nil, err
+	}
+	validity, err := abs.VerifyValidity(client.Configuration, request.(*irma.SignatureRequest))
+	if irma.IsMissingPublicKey(err) || isUnknownCredentialType(err) {
+		validity.Reason = irma.ProofStatusReasonUnknownPublicKey
+		return validity, nil
+	}
+	return validity, err
+}
+
+// ExportSignature returns the attribute-based signature of the specified log entry, in the
+// versioned JSON serialization of signed messages (see irma.SignedMessageVersion).
+func (client *Client) ExportSignature(entry *LogEntry) ([]byte, error) {
+	abs, err := entry.GetSignedMessage()
+	if err != nil {
+		return nil, err
+	}
+	if abs == nil {
+		return nil, errors.New("Log entry is not of a signature session")
+	}
+	return json.Marshal(abs)
+}
+
+func isUnknownCredentialType(err error) bool {
+	merr, ok := err.(*irma.MetadataError)
+	return ok && merr.Err == irma.ErrorUnknownMetadataCredentialType
 }
 
 func (session *session) createLogEntry(response interface{}) (*LogEntry, error) {
 	entry := &LogEntry{
-		Type:    session.Action,
-		Time:    irma.Timestamp(time.Now()),
-		Version: session.Version,
-		request: session.request,
+		Type:       session.Action,
+		Time:       irma.Timestamp(time.Now()),
+		Version:    session.Version,
+		ServerName: session.ServerName,
+		request:    session.request,
 	}
 
 	if err := entry.setSessionRequest(); err != nil {
@@ -132,6 +246,7 @@ func (session *session) createLogEntry(response interface{}) (*LogEntry, error)
 		// Get the signed message and timestamp
 		request := session.request.(*irma.SignatureRequest)
 		entry.SignedMessage = []byte(request.Message)
+		entry.SignedMessageType = request.MessageType
 		entry.Timestamp = request.Timestamp
 
 		fallthrough
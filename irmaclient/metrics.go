@@ -0,0 +1,120 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the reporting of metrics to the MetricsCollector of a Client.
+
+// MetricsCollector is notified of the sessions of a Client and of changes in its state, so that
+// the app embedding the client can measure e.g. session success rates, durations and failure
+// categories (with the consent of the user). Collecting, aggregating and sending the metrics is
+// left to the app. Only the kinds of events are passed, as actions, stages, outcomes, error
+// types and counts: never attribute values, credential types, requestors or other identifiers.
+// The methods may be called concurrently, and should not block.
+type MetricsCollector interface {
+	SessionStarted(action irma.Action)
+	// SessionStage is called when a session enters the specified stage.
+	SessionStage(action irma.Action, stage irma.ErrorStage)
+	// SessionFinished is called when a session ends, with the type of the error if it failed.
+	SessionFinished(action irma.Action, outcome SessionOutcome, errorType irma.ErrorType, duration time.Duration)
+	// CredentialCount is called with the number of credentials of the client when the client
+	// is created and when its credentials change.
+	CredentialCount(count int)
+	// SchemeUpdate is called after each update of the schemes, see Client.UpdateSchemes().
+	SchemeUpdate(outcome SchemeUpdateOutcome)
+}
+
+// SessionOutcome is how a session ended.
+type SessionOutcome string
+
+const (
+	SessionOutcomeSuccess   = SessionOutcome("success")
+	SessionOutcomeCancelled = SessionOutcome("cancelled")
+	// SessionOutcomeUnsatisfiable means that the user lacks attributes required by the session.
+	SessionOutcomeUnsatisfiable = SessionOutcome("unsatisfiable")
+	// SessionOutcomeNetworkFailure means that a server could not be reached, or timed out.
+	SessionOutcomeNetworkFailure  = SessionOutcome("networkFailure")
+	SessionOutcomeKeyshareBlocked = SessionOutcome("keyshareBlocked")
+	SessionOutcomeFailure         = SessionOutcome("failure")
+)
+
+// SchemeUpdateOutcome is the outcome of an update of the schemes.
+type SchemeUpdateOutcome string
+
+const (
+	SchemeUpdateOutcomeChanged   = SchemeUpdateOutcome("changed")
+	SchemeUpdateOutcomeUnchanged = SchemeUpdateOutcome("unchanged")
+	SchemeUpdateOutcomeFailed    = SchemeUpdateOutcome("failed")
+)
+
+// nopMetricsCollector is the MetricsCollector of clients that were not given one.
+type nopMetricsCollector struct{}
+
+func (nopMetricsCollector) SessionStarted(irma.Action)                {}
+func (nopMetricsCollector) SessionStage(irma.Action, irma.ErrorStage) {}
+func (nopMetricsCollector) CredentialCount(int)                       {}
+func (nopMetricsCollector) SchemeUpdate(SchemeUpdateOutcome)          {}
+func (nopMetricsCollector) SessionFinished(irma.Action, SessionOutcome, irma.ErrorType, time.Duration) {
+}
+
+// metricsAction returns the action as passed to the MetricsCollector. The action of a session is
+// taken from the session pointer of the requestor, so it is replaced by irma.ActionUnknown unless
+// it is one of the known actions.
+func metricsAction(action irma.Action) irma.Action {
+	switch action {
+	case irma.ActionDisclosing, irma.ActionSigning, irma.ActionIssuing, irma.ActionSchemeManager:
+		return action
+	default:
+		return irma.ActionUnknown
+	}
+}
+
+// setStage sets the stage of the session, reporting it to the MetricsCollector if it changed.
+func (session *session) setStage(stage irma.ErrorStage) {
+	if session.stage == stage {
+		return
+	}
+	session.stage = stage
+	session.client.metrics.SessionStage(metricsAction(session.Action), stage)
+}
+
+// reportOutcome reports the outcome of the session to the MetricsCollector, unless it already was.
+func (session *session) reportOutcome(outcome SessionOutcome, errorType irma.ErrorType) {
+	if session.reported {
+		return
+	}
+	session.reported = true
+	session.client.metrics.SessionFinished(
+		metricsAction(session.Action), outcome, errorType, time.Since(session.started))
+}
+
+// reportFailure reports the outcome of the session that failed with the specified error.
+func (session *session) reportFailure(err *irma.SessionError) {
+	switch err.ErrorType {
+	case irma.ErrorTransport, irma.ErrorTimeout:
+		session.reportOutcome(SessionOutcomeNetworkFailure, err.ErrorType)
+	default:
+		session.reportOutcome(SessionOutcomeFailure, err.ErrorType)
+	}
+}
+
+// storeAttributes stores the attributes of the client, and reports the resulting number of
+// credentials to the MetricsCollector.
+func (client *Client) storeAttributes() error {
+	if err := client.storage.StoreAttributes(client.attributes); err != nil {
+		return err
+	}
+	client.reportCredentialCount()
+	return nil
+}
+
+func (client *Client) reportCredentialCount() {
+	count := 0
+	for _, attrs := range client.attributes {
+		count += len(attrs)
+	}
+	client.metrics.CredentialCount(count)
+}
@@ -0,0 +1,159 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the persisting of interactive sessions in progress, so that they can be
+// resumed after the client was stopped (e.g. when the OS killed the app) before they finished.
+
+// SessionStage is the stage of a persisted session.
+type SessionStage string
+
+const (
+	// SessionStageConnected means that the session request was received, and that the user
+	// was asked for permission to perform the session.
+	SessionStageConnected = SessionStage("connected")
+	// SessionStagePermitted means that the user gave permission and chose which attributes to
+	// disclose, after which the session was stopped before it finished.
+	SessionStagePermitted = SessionStage("permitted")
+)
+
+// serverStatusConnected is the status of IRMA server sessions that await our response.
+const serverStatusConnected = "CONNECTED"
+
+// ResumableSession is an interactive session that was in progress when the client was stopped.
+// It can be resumed using Client.ResumeSession(), and discarded by dismissing the resumed session.
+// Only the state that was exchanged with the server and the choices of the user are persisted;
+// the cryptographic computations of a resumed session are always performed anew.
+type ResumableSession struct {
+	ServerURL string // Includes the session token
+	Action    irma.Action
+	Version   *irma.ProtocolVersion
+	Stage     SessionStage
+	Started   irma.Timestamp
+	Request   json.RawMessage
+	Choice    *irma.DisclosureChoice `json:",omitempty"`
+}
+
+// ResumableSessions returns the sessions that can be resumed, oldest first.
+func (client *Client) ResumableSessions() []*ResumableSession {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+
+	list := make([]*ResumableSession, 0, len(client.resumableSessions))
+	for _, rs := range client.resumableSessions {
+		list = append(list, rs)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+// ResumeSession resumes the specified session, if the server still awaits our response in it.
+// Depending on the stage of the session, the user is asked for permission again or the
+// session continues directly with the attributes chosen earlier.
+func (client *Client) ResumeSession(rs *ResumableSession, handler Handler) SessionDismisser {
+	session := &session{
+		ServerURL: rs.ServerURL,
+		Action:    rs.Action,
+		Version:   rs.Version,
+		Handler:   handler,
+		client:    client,
+	}
+	if u, err := url.ParseRequestURI(rs.ServerURL); err == nil {
+		session.Hostname = u.Hostname()
+	}
+	session.transport = client.newHTTPTransport(rs.ServerURL)
+	session.start()
+	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
+
+	if session.request = newSessionRequest(session.Action); session.request == nil {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownAction, Info: string(session.Action)})
+		return nil
+	}
+	if err := json.Unmarshal(rs.Request, session.request); err != nil {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+		return nil
+	}
+	session.transport.SetHeader(irma.MinVersionHeader, minVersion.String())
+	session.transport.SetHeader(irma.MaxVersionHeader, maxVersion.String())
+
+	go session.resume(rs)
+	return session
+}
+
+func (session *session) resume(rs *ResumableSession) {
+	defer session.recoverFromPanic()
+
+	var status string
+	if err := session.transport.Get("status", &status); err != nil {
+		session.fail(err.(*irma.SessionError))
+		return
+	}
+	if status != serverStatusConnected {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorSessionNotResumable, Info: status})
+		return
+	}
+
+	if rs.Stage != SessionStagePermitted {
+		session.processSessionInfo()
+		return
+	}
+	session.ServerName = serverName(session.Hostname, session.request, session.client.Configuration)
+	session.choice = rs.Choice
+	session.request.SetDisclosureChoice(rs.Choice)
+	session.doSession(true)
+}
+
+// persist stores the state of this session in the specified stage, if it is interactive.
+func (session *session) persist(stage SessionStage) {
+	if !session.IsInteractive() {
+		return
+	}
+	request, err := json.Marshal(session.request)
+	if err != nil {
+		irma.Logger.Warn("Failed to serialize session request: ", err.Error())
+		return
+	}
+	rs := &ResumableSession{
+		ServerURL: session.ServerURL,
+		Action:    session.Action,
+		Version:   session.Version,
+		Stage:     stage,
+		Started:   irma.Timestamp(time.Now()),
+		Request:   request,
+		Choice:    session.choice,
+	}
+
+	client := session.client
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	if previous, ok := client.resumableSessions[rs.ServerURL]; ok {
+		rs.Started = previous.Started
+	}
+	client.resumableSessions[rs.ServerURL] = rs
+	if err = client.storage.StoreSessions(client.resumableSessions); err != nil {
+		irma.Logger.Warn("Failed to persist session: ", err.Error())
+	}
+}
+
+// unpersist removes the stored state of this session, if any.
+func (session *session) unpersist() {
+	client := session.client
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	if _, ok := client.resumableSessions[session.ServerURL]; !ok {
+		return
+	}
+	delete(client.resumableSessions, session.ServerURL)
+	if err := client.storage.StoreSessions(client.resumableSessions); err != nil {
+		irma.Logger.Warn("Failed to remove persisted session: ", err.Error())
+	}
+}
@@ -0,0 +1,248 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the periodic background updating of the schemes of a Client.
+
+// UpdateListener is notified when a background scheme update (see Client.StartSchemeUpdates())
+// changed the configuration of the client. The changes are passed as the JSON serialization of an
+// irma.ConfigurationDiff, so that the interface can be implemented across the gomobile boundary.
+type UpdateListener interface {
+	SchemesUpdated(diff string)
+}
+
+// SchemeUpdateOptions configures periodic background scheme updates.
+type SchemeUpdateOptions struct {
+	// Interval between two scheme updates.
+	Interval time.Duration
+	// Gate, if set, is invoked before each update, which is skipped if it returns false.
+	// This allows the app to e.g. only update schemes when on wifi.
+	Gate func() bool
+	// Listener, if set, is notified of the changes after each update that changed anything.
+	Listener UpdateListener
+}
+
+type schemeUpdater struct {
+	SchemeUpdateOptions
+	stop chan struct{}
+}
+
+// Minimum and maximum wait before retrying a failed scheme update; doubled for each subsequent
+// failure but never exceeding the update interval.
+var (
+	schemeUpdateRetryMin = 30 * time.Second
+	schemeUpdateRetryMax = 30 * time.Minute
+)
+
+var (
+	errSessionsActive  = errors.New("sessions in progress, postponing scheme update")
+	errSchemesChanging = errors.New("another scheme change is in progress")
+)
+
+// StartSchemeUpdates starts periodically updating the schemes of the client in the background,
+// starting immediately. Any previously started background updates are stopped.
+func (client *Client) StartSchemeUpdates(options SchemeUpdateOptions) error {
+	if options.Interval <= 0 {
+		return errors.New("Scheme update interval must be positive")
+	}
+	client.schemeUpdaterLock.Lock()
+	defer client.schemeUpdaterLock.Unlock()
+	client.stopSchemeUpdates()
+	client.schemeUpdater = &schemeUpdater{
+		SchemeUpdateOptions: options,
+		stop:                make(chan struct{}),
+	}
+	go client.schemeUpdater.run(client)
+	return nil
+}
+
+// StopSchemeUpdates stops background scheme updates started by StartSchemeUpdates(), if any.
+func (client *Client) StopSchemeUpdates() {
+	client.schemeUpdaterLock.Lock()
+	defer client.schemeUpdaterLock.Unlock()
+	client.stopSchemeUpdates()
+}
+
+// stopSchemeUpdates stops the background scheme updates; the caller must hold schemeUpdaterLock.
+func (client *Client) stopSchemeUpdates() {
+	if client.schemeUpdater != nil {
+		close(client.schemeUpdater.stop)
+		client.schemeUpdater = nil
+	}
+}
+
+// UpdateSchemes updates all schemes of the client from their remotes, returning how the
+// configuration changed (see irma.Configuration.UpdateSchemes()), or nil if no scheme changed.
+// Updates are postponed while a session is in progress. Keyshare server registrations follow
+// keyshare servers that moved to a new URL.
+func (client *Client) UpdateSchemes() (*irma.ConfigurationDiff, error) {
+	done, err := client.startSchemeChange()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	diff, err := client.Configuration.UpdateSchemes()
+	if err != nil {
+		client.metrics.SchemeUpdate(SchemeUpdateOutcomeFailed)
+		return nil, err
+	}
+	if diff.Configuration.Empty() {
+		client.metrics.SchemeUpdate(SchemeUpdateOutcomeUnchanged)
+	} else {
+		client.metrics.SchemeUpdate(SchemeUpdateOutcomeChanged)
+	}
+	if err = client.updateKeyshareServers(); err != nil {
+		return nil, err
+	}
+	return diff.Configuration, nil
+}
+
+// InstallScheme installs the scheme at the specified URL, signed with the specified public key or
+// public key fingerprint (see irma.Configuration.InstallScheme()). This is refused while a session
+// is in progress.
+func (client *Client) InstallScheme(url string, publickey []byte, replace bool) error {
+	done, err := client.startSchemeChange()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return client.Configuration.InstallScheme(url, publickey, replace)
+}
+
+// RemoveScheme removes the specified scheme, along with the credentials of the scheme (adding a
+// removal log entry with reason RemovalReasonSchemeRemoved for each of them) and the keyshare
+// server registration of the scheme, if any. This is refused while a session is in progress.
+// The scheme itself is removed last, so that if we crash halfway no credentials are left whose
+// credential type is unknown, and calling RemoveScheme() again finishes the removal.
+func (client *Client) RemoveScheme(id irma.SchemeManagerIdentifier) error {
+	done, err := client.startSchemeChange()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if _, ok := client.Configuration.SchemeManagers[id]; !ok {
+		return errors.Errorf("Cannot remove unknown scheme manager %s", id)
+	}
+
+	for credid, attrs := range client.attributes {
+		if credid.IssuerIdentifier().SchemeManagerIdentifier() != id {
+			continue
+		}
+		for i := len(attrs) - 1; i >= 0; i-- {
+			if err := client.remove(credid, i, true, RemovalReasonSchemeRemoved); err != nil {
+				return err
+			}
+		}
+		delete(client.attributes, credid)
+		delete(client.credentialsCache, credid)
+	}
+	if err := client.storeAttributes(); err != nil {
+		return err
+	}
+	if _, ok := client.keyshareServers[id]; ok {
+		if err := client.KeyshareRemove(id); err != nil {
+			return err
+		}
+	}
+	return client.Configuration.RemoveScheme(id)
+}
+
+func (updater *schemeUpdater) run(client *Client) {
+	var wait time.Duration
+	failures := 0
+	for {
+		select {
+		case <-updater.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		wait = updater.Interval
+		if updater.Gate != nil && !updater.Gate() {
+			continue
+		}
+		changed, err := client.UpdateSchemes()
+		if err != nil {
+			failures++
+			wait = updater.retryWait(failures)
+			irma.Logger.Warnf("Scheme update failed, retrying in %s: %s", wait, err.Error())
+			continue
+		}
+		failures = 0
+		if changed.Empty() || updater.Listener == nil {
+			continue
+		}
+		bts, err := json.Marshal(changed)
+		if err != nil {
+			irma.Logger.Warnf("Failed to serialize scheme changes: %s", err.Error())
+			continue
+		}
+		updater.Listener.SchemesUpdated(string(bts))
+	}
+}
+
+func (updater *schemeUpdater) retryWait(failures int) time.Duration {
+	wait := schemeUpdateRetryMin
+	for i := 1; i < failures && wait < schemeUpdateRetryMax; i++ {
+		wait *= 2
+	}
+	if wait > schemeUpdateRetryMax {
+		wait = schemeUpdateRetryMax
+	}
+	if wait > updater.Interval {
+		wait = updater.Interval
+	}
+	return wait
+}
+
+// startSchemeChange marks the schemes as being changed, unless a session or another scheme
+// change is in progress. The change itself, which may involve downloading from the scheme
+// remotes, happens without holding sessionsLock. Sessions starting in the meantime wait until
+// the returned function is called.
+func (client *Client) startSchemeChange() (func(), error) {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	if client.activeSessions > 0 {
+		return nil, errSessionsActive
+	}
+	if client.schemeChange != nil {
+		return nil, errSchemesChanging
+	}
+	change := make(chan struct{})
+	client.schemeChange = change
+	return func() {
+		client.sessionsLock.Lock()
+		defer client.sessionsLock.Unlock()
+		client.schemeChange = nil
+		close(change)
+	}, nil
+}
+
+// sessionStarted and sessionFinished keep track of the number of sessions in progress,
+// during which scheme updates are postponed. A session starting during a scheme change
+// waits for it to finish.
+
+func (client *Client) sessionStarted() {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	for client.schemeChange != nil {
+		change := client.schemeChange
+		client.sessionsLock.Unlock()
+		<-change
+		client.sessionsLock.Lock()
+	}
+	client.activeSessions++
+}
+
+func (client *Client) sessionFinished() {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	client.activeSessions--
+}
@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
@@ -30,8 +31,10 @@ type Handler interface {
 	StatusUpdate(action irma.Action, status irma.Status)
 	Success(result string)
 	Cancelled()
+	// Failure is called when the session fails. The error says in which stage of the session it
+	// failed, and can be inspected using errors.Is() and errors.As(), e.g. errors.Is(err, irma.ErrorTimeout).
 	Failure(err *irma.SessionError)
-	UnsatisfiableRequest(ServerName irma.TranslatedString, missing irma.AttributeDisjunctionList)
+	UnsatisfiableRequest(ServerName irma.TranslatedString, missing []*MissingDisjunction)
 
 	KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int)
 	KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier)
@@ -42,10 +45,23 @@ type Handler interface {
 	RequestVerificationPermission(request irma.DisclosureRequest, ServerName irma.TranslatedString, callback PermissionHandler)
 	RequestSignaturePermission(request irma.SignatureRequest, ServerName irma.TranslatedString, callback PermissionHandler)
 	RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool))
+	// Asks whether an unknown scheme manager that the session refers to may be installed
+	RequestSchemeManagerInstallPermission(manager *irma.SchemeManager, callback func(proceed bool))
+	// Asks whether to continue a session of a requestor that started the specified number of
+	// sessions in a short time, before asking for permission to perform the session
+	RequestThrottledSessionConfirmation(origin string, sessions int, callback func(proceed bool))
 
 	RequestPin(remainingAttempts int, callback PinHandler)
 }
 
+// DocumentSignatureWarning should be shown by RequestSignaturePermission() along with the metadata
+// of the document (see irma.SignatureRequest.SignedDocument()), when asking permission to sign a
+// request of type irma.SignedMessageTypeSHA256.
+var DocumentSignatureWarning = irma.TranslatedString{
+	"en": "You are signing the fingerprint of this document. Make sure that you have received the document itself from the requestor and that you agree with its contents.",
+	"nl": "U ondertekent de vingerafdruk van dit document. Zorg ervoor dat u het document zelf van de aanvrager heeft ontvangen en dat u akkoord gaat met de inhoud ervan.",
+}
+
 // SessionDismisser can dismiss the current IRMA session.
 type SessionDismisser interface {
 	Dismiss()
@@ -62,6 +78,10 @@ type session struct {
 	client      *Client
 	request     irma.SessionRequest
 	done        bool
+	stage       irma.ErrorStage // Stage of the session, included in errors passed to the Handler
+	throttled   bool            // Whether the requestor was throttled when the session started
+	started     time.Time
+	reported    bool // Whether the outcome was reported to the MetricsCollector
 
 	// State for issuance protocol
 	issuerProofNonce *big.Int
@@ -76,18 +96,30 @@ type session struct {
 // We implement the handler for the keyshare protocol
 var _ keyshareSessionHandler = (*session)(nil)
 
-// Supported protocol versions. Minor version numbers should be reverse sorted.
-var supportedVersions = map[int][]int{
-	2: {4},
-}
-var minVersion = &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][0]}
-var maxVersion = &irma.ProtocolVersion{Major: 2, Minor: supportedVersions[2][len(supportedVersions[2])-1]}
+// Supported protocol versions
+var minVersion = irma.ProtocolVersionPrevious
+var maxVersion = irma.ProtocolVersionCurrent
 
 // Session constructors
 
 // NewSession starts a new IRMA session, given (along with a handler to pass feedback to) a session request.
+// Instead of JSON, the session request may also be a session link (see irma.ParseSessionLink()).
 // When the request is not suitable to start an IRMA session from, it calls the Failure method of the specified Handler.
 func (client *Client) NewSession(sessionrequest string, handler Handler) SessionDismisser {
+	if irma.IsSessionLink(sessionrequest) {
+		qr, err := irma.ParseSessionLink(sessionrequest)
+		if err != nil {
+			handler.Failure(&irma.SessionError{
+				ErrorType: irma.ErrorInvalidSessionLink, Stage: irma.ErrorStageStart, Err: err, Info: sessionrequest,
+			})
+			return nil
+		}
+		if qr.Type == irma.ActionSchemeManager {
+			return client.newSchemeSession((*irma.SchemeManagerRequest)(qr), handler)
+		}
+		return client.newQrSession(qr, handler)
+	}
+
 	bts := []byte(sessionrequest)
 
 	qr := &irma.Qr{}
@@ -110,7 +142,9 @@ func (client *Client) NewSession(sessionrequest string, handler Handler) Session
 		return client.newManualSession(disclosureRequest, handler, irma.ActionDisclosing)
 	}
 
-	handler.Failure(&irma.SessionError{Err: errors.New("Session request could not be parsed"), Info: sessionrequest})
+	handler.Failure(&irma.SessionError{
+		Stage: irma.ErrorStageStart, Err: errors.New("Session request could not be parsed"), Info: sessionrequest,
+	})
 	return nil
 }
 
@@ -123,6 +157,7 @@ func (client *Client) newManualSession(request irma.SessionRequest, handler Hand
 		Version: minVersion,
 		request: request,
 	}
+	session.start()
 	session.Handler.StatusUpdate(session.Action, irma.StatusManualStarted)
 
 	session.processSessionInfo()
@@ -132,11 +167,12 @@ func (client *Client) newManualSession(request irma.SessionRequest, handler Hand
 func (client *Client) newSchemeSession(qr *irma.SchemeManagerRequest, handler Handler) SessionDismisser {
 	session := &session{
 		ServerURL: qr.URL,
-		transport: irma.NewHTTPTransport(qr.URL),
+		transport: client.newHTTPTransport(qr.URL),
 		Action:    irma.ActionSchemeManager,
 		Handler:   handler,
 		client:    client,
 	}
+	session.start()
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
 	go session.managerSession()
@@ -149,27 +185,25 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisse
 	session := &session{
 		ServerURL: qr.URL,
 		Hostname:  u.Hostname(),
-		transport: irma.NewHTTPTransport(qr.URL),
+		transport: client.newHTTPTransport(qr.URL),
 		Action:    irma.Action(qr.Type),
 		Handler:   handler,
 		client:    client,
 	}
+	session.start()
+	session.throttled = client.recordSession(session.Hostname)
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
 	// Check if the action is one of the supported types
-	switch session.Action {
-	case irma.ActionDisclosing:
-		session.request = &irma.DisclosureRequest{}
-	case irma.ActionSigning:
-		session.request = &irma.SignatureRequest{}
-	case irma.ActionIssuing:
-		session.request = &irma.IssuanceRequest{}
-	case irma.ActionUnknown:
-		fallthrough
-	default:
+	if session.request = newSessionRequest(session.Action); session.request == nil {
 		session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownAction, Info: string(session.Action)})
 		return nil
 	}
+	// Don't bother the server with session pointers that are known to have expired
+	if qr.Expired() {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorSessionExpired, Info: qr.Expiry.String()})
+		return nil
+	}
 
 	session.transport.SetHeader(irma.MinVersionHeader, minVersion.String())
 	session.transport.SetHeader(irma.MaxVersionHeader, maxVersion.String())
@@ -181,6 +215,21 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisse
 	return session
 }
 
+// newSessionRequest returns an empty session request of the type corresponding to the action,
+// or nil if the action is not supported.
+func newSessionRequest(action irma.Action) irma.SessionRequest {
+	switch action {
+	case irma.ActionDisclosing:
+		return &irma.DisclosureRequest{}
+	case irma.ActionSigning:
+		return &irma.SignatureRequest{}
+	case irma.ActionIssuing:
+		return &irma.IssuanceRequest{}
+	default:
+		return nil
+	}
+}
+
 // Core session methods
 
 // getSessionInfo retrieves the first message in the IRMA protocol (only in interactive sessions)
@@ -189,12 +238,18 @@ func (session *session) getSessionInfo() {
 
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
-	// Get the first IRMA protocol message and parse it
-	err := session.transport.Get("", session.request)
+	// Get the first IRMA protocol message and parse it, in the format of the protocol version
+	// that the server chose, which it includes in the message
+	var info json.RawMessage
+	err := session.transport.Get("", &info)
 	if err != nil {
 		session.fail(err.(*irma.SessionError))
 		return
 	}
+	if err = irma.UnmarshalMessage(nil, info, session.request); err != nil {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorServerResponse, Err: err})
+		return
+	}
 
 	session.processSessionInfo()
 }
@@ -227,6 +282,7 @@ func serverName(hostname string, request irma.SessionRequest, conf *irma.Configu
 func (session *session) processSessionInfo() {
 	defer session.recoverFromPanic()
 
+	session.setStage(irma.ErrorStageConfiguration)
 	if !session.checkAndUpateConfiguration() {
 		return
 	}
@@ -241,6 +297,23 @@ func (session *session) processSessionInfo() {
 
 	session.ServerName = serverName(session.Hostname, session.request, session.client.Configuration)
 
+	if session.Action == irma.ActionSigning {
+		// Refuse messages that cannot be shown to the user as what they are signing
+		sigrequest := session.request.(*irma.SignatureRequest)
+		switch sigrequest.MessageType {
+		case "", irma.SignedMessageTypeString:
+		case irma.SignedMessageTypeSHA256:
+			if _, err := sigrequest.SignedDocument(); err != nil {
+				session.fail(&irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err})
+				return
+			}
+		default:
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorSerialization,
+				Info: fmt.Sprintf("Unsupported message type %s", sigrequest.MessageType)})
+			return
+		}
+	}
+
 	if session.Action == irma.ActionIssuing {
 		ir := session.request.(*irma.IssuanceRequest)
 		_, err := ir.GetCredentialInfoList(session.client.Configuration, session.Version)
@@ -261,17 +334,29 @@ func (session *session) processSessionInfo() {
 
 	candidates, missing := session.client.CheckSatisfiability(session.request.ToDisclose())
 	if len(missing) > 0 {
-		session.Handler.UnsatisfiableRequest(session.ServerName, missing)
+		session.reportOutcome(SessionOutcomeUnsatisfiable, "")
+		session.Handler.UnsatisfiableRequest(session.ServerName, session.client.MissingReport(missing))
 		return
 	}
 	session.request.SetCandidates(candidates)
 
+	if !session.prefetchPublicKeys(candidates) {
+		return
+	}
+	if !session.confirmThrottled() {
+		return
+	}
+
 	// Ask for permission to execute the session
 	callback := PermissionHandler(func(proceed bool, choice *irma.DisclosureChoice) {
 		session.choice = choice
 		session.request.SetDisclosureChoice(choice)
+		if proceed {
+			session.persist(SessionStagePermitted)
+		}
 		go session.doSession(proceed)
 	})
+	session.persist(SessionStageConnected)
 	session.Handler.StatusUpdate(session.Action, irma.StatusConnected)
 	switch session.Action {
 	case irma.ActionDisclosing:
@@ -299,6 +384,7 @@ func (session *session) doSession(proceed bool) {
 		return
 	}
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
+	session.setStage(irma.ErrorStageResponse)
 
 	if !session.Distributed() {
 		message, err := session.getProof()
@@ -313,6 +399,7 @@ func (session *session) doSession(proceed bool) {
 		if err != nil {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 		}
+		session.setStage(irma.ErrorStageKeyshare)
 		startKeyshareSession(
 			session,
 			session.Handler,
@@ -321,12 +408,22 @@ func (session *session) doSession(proceed bool) {
 			session.client.Configuration,
 			session.client.keyshareServers,
 			session.issuerProofNonce,
+			session.client.newKeyshareTransport,
 		)
 	}
 }
 
 type disclosureResponse string
 
+// post sends the message to the server in the wire format of the protocol version of the session.
+func (session *session) post(url string, result interface{}, message interface{}) error {
+	bts, err := irma.MarshalMessage(session.Version, message)
+	if err != nil {
+		return &irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err}
+	}
+	return session.transport.Post(url, result, json.RawMessage(bts))
+}
+
 // sendResponse sends the proofs of knowledge of the hidden attributes and/or the secret key, or the constructed
 // attribute-based signature, to the API server.
 func (session *session) sendResponse(message interface{}) {
@@ -334,6 +431,8 @@ func (session *session) sendResponse(message interface{}) {
 	var err error
 	var messageJson []byte
 
+	session.setStage(irma.ErrorStageResponse)
+
 	switch session.Action {
 	case irma.ActionSigning:
 		irmaSignature, err := session.request.(*irma.SignatureRequest).SignatureFromMessage(message)
@@ -350,7 +449,7 @@ func (session *session) sendResponse(message interface{}) {
 
 		if session.IsInteractive() {
 			var response disclosureResponse
-			if err = session.transport.Post("proofs", &response, irmaSignature); err != nil {
+			if err = session.post("proofs", &response, irmaSignature); err != nil {
 				session.fail(err.(*irma.SessionError))
 				return
 			}
@@ -368,7 +467,7 @@ func (session *session) sendResponse(message interface{}) {
 		}
 		if session.IsInteractive() {
 			var response disclosureResponse
-			if err = session.transport.Post("proofs", &response, message); err != nil {
+			if err = session.post("proofs", &response, message); err != nil {
 				session.fail(err.(*irma.SessionError))
 				return
 			}
@@ -380,7 +479,7 @@ func (session *session) sendResponse(message interface{}) {
 		log, _ = session.createLogEntry(message) // TODO err
 	case irma.ActionIssuing:
 		response := []*gabi.IssueSignatureMessage{}
-		if err = session.transport.Post("commitments", &response, message); err != nil {
+		if err = session.post("commitments", &response, message); err != nil {
 			session.fail(err.(*irma.SessionError))
 			return
 		}
@@ -395,7 +494,8 @@ func (session *session) sendResponse(message interface{}) {
 	if session.Action == irma.ActionIssuing {
 		session.client.handler.UpdateAttributes()
 	}
-	session.done = true
+	session.finish()
+	session.reportOutcome(SessionOutcomeSuccess, "")
 	session.Handler.Success(string(messageJson))
 }
 
@@ -403,22 +503,26 @@ func (session *session) sendResponse(message interface{}) {
 func (session *session) managerSession() {
 	defer session.recoverFromPanic()
 
+	session.setStage(irma.ErrorStageConfiguration)
 	// We have to download the scheme manager description.xml here before installing it,
 	// because we need to show its contents (name, description, website) to the user
 	// when asking installation permission.
-	manager, err := irma.DownloadSchemeManager(session.ServerURL)
+	manager, err := session.client.Configuration.DownloadSchemeManagerDescription(session.ServerURL)
 	if err != nil {
-		session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
+		session.finish()
+		session.failed(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
 		return
 	}
 
 	session.Handler.RequestSchemeManagerPermission(manager, func(proceed bool) {
+		defer session.finish()
 		if !proceed {
+			session.reportOutcome(SessionOutcomeCancelled, "")
 			session.Handler.Cancelled() // No need to DELETE session here
 			return
 		}
 		if err := session.client.Configuration.InstallSchemeManager(manager, nil); err != nil {
-			session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
+			session.failed(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
 			return
 		}
 
@@ -430,6 +534,7 @@ func (session *session) managerSession() {
 				CredentialTypes: map[irma.CredentialTypeIdentifier]struct{}{},
 			},
 		)
+		session.reportOutcome(SessionOutcomeSuccess, "")
 		session.Handler.Success("")
 	})
 	return
@@ -483,12 +588,13 @@ func (session *session) checkKeyshareEnrollment() bool {
 	for id := range session.request.Identifiers().SchemeManagers {
 		manager, ok := session.client.Configuration.SchemeManagers[id]
 		if !ok {
-			session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorUnknownSchemeManager, Info: id.String()})
+			session.failed(&irma.SessionError{ErrorType: irma.ErrorUnknownSchemeManager, Info: id.String()})
 			return false
 		}
 		distributed := manager.Distributed()
 		_, enrolled := session.client.keyshareServers[id]
 		if distributed && !enrolled {
+			session.reportOutcome(SessionOutcomeFailure, irma.ErrorKeyshare)
 			session.Handler.KeyshareEnrollmentMissing(id)
 			return false
 		}
@@ -497,6 +603,9 @@ func (session *session) checkKeyshareEnrollment() bool {
 }
 
 func (session *session) checkAndUpateConfiguration() bool {
+	if !session.installUnknownSchemeManagers() {
+		return false
+	}
 	for id := range session.request.Identifiers().SchemeManagers {
 		manager, contains := session.client.Configuration.SchemeManagers[id]
 		if !contains {
@@ -532,6 +641,98 @@ func (session *session) checkAndUpateConfiguration() bool {
 	return true
 }
 
+// installUnknownSchemeManagers installs the scheme managers that the session request refers to
+// but that we do not have, if the request or DefaultSchemeManagers says where to find them and
+// the user gives permission. It returns false if the session cannot continue.
+func (session *session) installUnknownSchemeManagers() bool {
+	conf := session.client.Configuration
+	installed := &irma.IrmaIdentifierSet{SchemeManagers: map[irma.SchemeManagerIdentifier]struct{}{}}
+	for _, id := range conf.UnknownSchemeManagers(session.request) {
+		pointer := session.request.SchemeManagerPointer(id)
+		if pointer == nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorUnknownSchemeManager, Info: id.String()})
+			return false
+		}
+		manager, err := conf.DownloadPointedSchemeManager(id, pointer)
+		if err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Info: id.String(), Err: err})
+			return false
+		}
+
+		proceed := make(chan bool, 1)
+		session.Handler.RequestSchemeManagerInstallPermission(manager, func(p bool) {
+			proceed <- p
+		})
+		if !<-proceed {
+			session.cancel()
+			return false
+		}
+
+		if err = conf.InstallPointedSchemeManager(manager, pointer); err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Info: id.String(), Err: err})
+			return false
+		}
+		installed.SchemeManagers[id] = struct{}{}
+	}
+	if len(installed.SchemeManagers) > 0 {
+		session.client.handler.UpdateConfiguration(installed)
+	}
+	return true
+}
+
+// prefetchPublicKeys downloads the public keys that are used in this session but which we do not
+// have yet: those of the issuers in case of issuance, and those of all disclosure candidates.
+// This way, a missing key causes the session to fail before the user is asked for permission
+// instead of during the computation of the proofs.
+func (session *session) prefetchPublicKeys(candidates [][]*irma.AttributeIdentifier) bool {
+	keys := map[irma.IssuerIdentifier]map[int]struct{}{}
+	add := func(id irma.IssuerIdentifier, counter int) {
+		if keys[id] == nil {
+			keys[id] = map[int]struct{}{}
+		}
+		keys[id][counter] = struct{}{}
+	}
+
+	if session.Action == irma.ActionIssuing {
+		for _, credreq := range session.request.(*irma.IssuanceRequest).Credentials {
+			add(credreq.CredentialTypeID.IssuerIdentifier(), credreq.KeyCounter)
+		}
+	}
+	for _, disjunction := range candidates {
+		for _, attr := range disjunction {
+			for _, attrs := range session.client.attrs(attr.Type.CredentialTypeIdentifier()) {
+				if attrs.Hash() == attr.CredentialHash {
+					add(attrs.CredentialType().IssuerIdentifier(), attrs.KeyCounter())
+				}
+			}
+		}
+	}
+
+	conf := session.client.Configuration
+	for id, counters := range keys {
+		for counter := range counters {
+			pk, err := conf.PublicKey(id, counter)
+			if err == nil && pk == nil {
+				session.client.keysLock.Lock()
+				pk, err = conf.DownloadPublicKey(id, counter)
+				session.client.keysLock.Unlock()
+			}
+			if err != nil {
+				session.fail(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
+				return false
+			}
+			if pk == nil {
+				session.fail(&irma.SessionError{
+					ErrorType: irma.ErrorSchemeOutdated,
+					Info:      fmt.Sprintf("%s-%d", id, counter),
+				})
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // IsInteractive returns whether this session uses an API server or not.
 func (session *session) IsInteractive() bool {
 	return session.ServerURL != ""
@@ -554,6 +755,9 @@ func (session *session) Distributed() bool {
 	}
 
 	for _, ai := range session.choice.Attributes {
+		if ai == nil {
+			continue
+		}
 		smi = ai.Type.CredentialTypeIdentifier().IssuerIdentifier().SchemeManagerIdentifier()
 		if session.client.Configuration.SchemeManagers[smi].Distributed() {
 			return true
@@ -567,8 +771,9 @@ func (session *session) Distributed() bool {
 
 func (session *session) recoverFromPanic() {
 	if e := recover(); e != nil {
+		session.finish()
 		if session.Handler != nil {
-			session.Handler.Failure(panicToError(e))
+			session.failed(panicToError(e))
 		}
 	}
 }
@@ -592,23 +797,63 @@ func panicToError(e interface{}) *irma.SessionError {
 func (session *session) delete() bool {
 	if !session.done {
 		if session.IsInteractive() {
-			session.transport.Delete()
+			// Inform the server, which cancels the session and notifies the requestor.
+			// Don't let the user wait for this if the server is unreachable.
+			go session.transport.Delete()
 		}
-		session.done = true
+		session.finish()
 		return true
 	}
 	return false
 }
 
+// start registers the session as in progress, see Client.sessionStarted().
+func (session *session) start() {
+	session.started = time.Now()
+	session.client.sessionStarted()
+	session.client.metrics.SessionStarted(metricsAction(session.Action))
+}
+
+// finish marks the session as done, allowing postponed scheme updates to proceed,
+// and removes its persisted state.
+func (session *session) finish() {
+	if !session.done {
+		session.done = true
+		session.unpersist()
+		session.client.sessionFinished()
+	}
+}
+
 func (session *session) fail(err *irma.SessionError) {
 	if session.delete() {
-		err.Err = errors.Wrap(err.Err, 0)
-		session.Handler.Failure(err)
+		if err.Err != nil {
+			err.Err = errors.Wrap(err.Err, 0)
+		}
+		session.failed(err)
+	}
+}
+
+// failed informs the Handler of the failure of the session, after reporting it.
+func (session *session) failed(err *irma.SessionError) {
+	err = session.withStage(err)
+	session.reportFailure(err)
+	session.Handler.Failure(err)
+}
+
+// withStage sets the stage of the error to the current stage of the session, unless already set.
+func (session *session) withStage(err *irma.SessionError) *irma.SessionError {
+	if err.Stage == "" {
+		err.Stage = session.stage
+	}
+	if err.Stage == "" {
+		err.Stage = irma.ErrorStageStart
 	}
+	return err
 }
 
 func (session *session) cancel() {
 	if session.delete() {
+		session.reportOutcome(SessionOutcomeCancelled, "")
 		session.Handler.Cancelled()
 	}
 }
@@ -627,6 +872,8 @@ func (session *session) KeyshareDone(message interface{}) {
 		session.sendResponse(&irma.Disclosure{
 			Proofs:  message.(gabi.ProofList),
 			Indices: session.attrIndices,
+			Nonce:   session.request.GetNonce(),
+			Context: session.request.GetContext(),
 		})
 	case irma.ActionIssuing:
 		session.sendResponse(&irma.IssueCommitmentMessage{
@@ -641,14 +888,17 @@ func (session *session) KeyshareCancelled() {
 }
 
 func (session *session) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	session.reportOutcome(SessionOutcomeFailure, irma.ErrorKeyshare)
 	session.Handler.KeyshareEnrollmentIncomplete(manager)
 }
 
 func (session *session) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	session.reportOutcome(SessionOutcomeFailure, irma.ErrorKeyshare)
 	session.Handler.KeyshareEnrollmentDeleted(manager)
 }
 
 func (session *session) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	session.reportOutcome(SessionOutcomeKeyshareBlocked, irma.ErrorKeyshare)
 	session.Handler.KeyshareBlocked(manager, duration)
 }
 
@@ -660,6 +910,7 @@ func (session *session) KeyshareError(manager *irma.SchemeManagerIdentifier, err
 	} else {
 		serr.ErrorType = irma.ErrorKeyshare
 	}
+	serr.Stage = irma.ErrorStageKeyshare
 	session.fail(serr)
 }
 
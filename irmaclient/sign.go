@@ -0,0 +1,128 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the creation of attribute-based signatures outside of IRMA sessions.
+
+// SignOptions configures the creation of a local attribute-based signature (see Client.Sign()).
+type SignOptions struct {
+	// Choice specifies the attributes to sign with. If nil, Handler is asked for permission
+	// and for the attributes to sign with.
+	Choice *irma.DisclosureChoice
+	// Handler is used if Choice is nil.
+	Handler Handler
+	// NoTimestamp skips fetching a timestamp over the signature from the timestamp server,
+	// in which case the signature does not prove when it was created.
+	NoTimestamp bool
+}
+
+// Sign creates an attribute-based signature over the message of the specified signature request,
+// without an IRMA server being involved. If the request contains no nonce, a random nonce is
+// generated; the nonce and context used end up in the request and in the returned signature.
+// When asking the Handler for permission, Sign blocks until the Handler invokes its callback.
+// Signing with attributes from a scheme manager that uses a keyshare server is not supported.
+func (client *Client) Sign(request *irma.SignatureRequest, options SignOptions) (*irma.SignedMessage, error) {
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+	if request.Nonce == nil {
+		nonce, err := gabi.RandomBigInt(gabi.DefaultSystemParameters[2048].Lstatzk)
+		if err != nil {
+			return nil, err
+		}
+		request.Nonce = nonce
+	}
+	if request.Context == nil {
+		request.Context = big.NewInt(1)
+	}
+	if request.Version == nil {
+		request.Version = irma.NewVersion(2, 0)
+	}
+
+	choice := options.Choice
+	if choice == nil {
+		var err error
+		if choice, err = client.askSignaturePermission(request, options.Handler); err != nil {
+			return nil, err
+		}
+	}
+	request.SetDisclosureChoice(choice)
+	for _, attr := range choice.Attributes {
+		if attr == nil {
+			continue
+		}
+		manager := client.Configuration.SchemeManagers[attr.Type.CredentialTypeIdentifier().SchemeManagerIdentifier()]
+		if manager != nil && manager.Distributed() {
+			return nil, errors.Errorf("Cannot sign locally with attribute %s: its scheme manager uses a keyshare server", attr.Type)
+		}
+	}
+
+	builders, indices, err := client.ProofBuilders(choice, request, !options.NoTimestamp)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := request.SignatureFromMessage(&irma.Disclosure{
+		Proofs:  builders.BuildProofList(request.GetContext(), request.GetNonce(), true),
+		Indices: indices,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &LogEntry{
+		Type:              irma.ActionSigning,
+		Time:              irma.Timestamp(time.Now()),
+		Version:           request.Version,
+		SignedMessage:     []byte(request.Message),
+		SignedMessageType: request.MessageType,
+		Timestamp:         request.Timestamp,
+		Disclosure:        signature.Disclosure(),
+		request:           request,
+	}
+	if err = entry.setSessionRequest(); err != nil {
+		return nil, err
+	}
+	if err = client.addLogEntry(entry); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// askSignaturePermission asks the handler for permission to sign the request,
+// returning the attributes chosen by the user.
+func (client *Client) askSignaturePermission(request *irma.SignatureRequest, handler Handler) (*irma.DisclosureChoice, error) {
+	if handler == nil {
+		return nil, errors.New("Neither an attribute choice nor a handler was specified")
+	}
+	name := serverName("", request, client.Configuration)
+	candidates, missing := client.CheckSatisfiability(request.Content)
+	if len(missing) > 0 {
+		handler.UnsatisfiableRequest(name, client.MissingReport(missing))
+		return nil, errors.New("Signature request cannot be satisfied")
+	}
+	request.SetCandidates(candidates)
+
+	type permission struct {
+		proceed bool
+		choice  *irma.DisclosureChoice
+	}
+	c := make(chan permission, 1)
+	handler.RequestSignaturePermission(*request, name, func(proceed bool, choice *irma.DisclosureChoice) {
+		c <- permission{proceed, choice}
+	})
+	p := <-c
+	if !p.proceed {
+		return nil, errors.New("Permission to sign was refused")
+	}
+	if p.choice == nil {
+		return nil, errors.New("No attribute choice was made")
+	}
+	return p.choice, nil
+}
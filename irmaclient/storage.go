@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/irmago"
@@ -12,6 +13,13 @@ import (
 
 // This file contains the storage struct and its methods,
 // and some general filesystem functions.
+//
+// All files are written atomically and durably by fs.SaveFile(), so that if the app is killed
+// while writing, each file contains either its old or its new contents. The attributes file
+// and the signature files of the credentials are kept consistent by ordering: a signature is
+// stored before the attributes file refers to it, and deleted only after the attributes file
+// no longer does. At startup, temp files of interrupted writes and signatures to which the
+// attributes file does not refer are removed.
 
 // Storage provider for a Client
 type storage struct {
@@ -27,9 +35,20 @@ const (
 	updatesFile     = "updates"
 	logsFile        = "logs"
 	preferencesFile = "preferences"
+	versionFile     = "version"
+	sessionsFile    = "sessions"
+	throttleFile    = "throttle"
 	signaturesDir   = "sigs"
+	backupDir       = "backup"
 )
 
+// storageFiles lists all files and folders containing client state, i.e. that are backed up
+// before storage migrations.
+var storageFiles = []string{
+	skFile, attributesFile, kssFile, updatesFile, logsFile, preferencesFile, versionFile, sessionsFile,
+	throttleFile, signaturesDir,
+}
+
 func (s *storage) path(p string) string {
 	return s.storagePath + "/" + p
 }
@@ -43,9 +62,36 @@ func (s *storage) EnsureStorageExists() error {
 	if err := fs.AssertPathExists(s.storagePath); err != nil {
 		return err
 	}
+	if err := fs.RemoveTempFiles(s.storagePath); err != nil {
+		return err
+	}
 	return fs.EnsureDirectoryExists(s.path(signaturesDir))
 }
 
+// RemoveUnreferencedSignatures removes the signature files of credentials that are not in the
+// specified attributes, which remain if the app was killed while adding or removing credentials.
+func (s *storage) RemoveUnreferencedSignatures(attributes map[irma.CredentialTypeIdentifier][]*irma.AttributeList) error {
+	referenced := map[string]struct{}{}
+	for _, attrlistlist := range attributes {
+		for _, attrlist := range attrlistlist {
+			referenced[filepath.Base(s.signatureFilename(attrlist))] = struct{}{}
+		}
+	}
+	files, err := ioutil.ReadDir(s.path(signaturesDir))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, ok := referenced[file.Name()]; ok || file.IsDir() {
+			continue
+		}
+		if err = os.Remove(s.path(signaturesDir + "/" + file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *storage) load(dest interface{}, path string) (err error) {
 	exists, err := fs.PathExists(s.path(path))
 	if err != nil || !exists {
@@ -114,6 +160,18 @@ func (s *storage) StoreUpdates(updates []update) (err error) {
 	return s.store(updates, updatesFile)
 }
 
+func (s *storage) StoreVersion(version int) error {
+	return s.store(version, versionFile)
+}
+
+func (s *storage) StoreSessions(sessions map[string]*ResumableSession) error {
+	return s.store(sessions, sessionsFile)
+}
+
+func (s *storage) StoreThrottle(throttle map[string][]irma.Timestamp) error {
+	return s.store(throttle, throttleFile)
+}
+
 func (s *storage) LoadSignature(attrs *irma.AttributeList) (signature *gabi.CLSignature, err error) {
 	sigpath := s.signatureFilename(attrs)
 	if err := fs.AssertPathExists(s.path(sigpath)); err != nil {
@@ -187,6 +245,22 @@ func (s *storage) LoadLogs() (logs []*LogEntry, err error) {
 	return logs, nil
 }
 
+func (s *storage) LoadSessions() (sessions map[string]*ResumableSession, err error) {
+	sessions = make(map[string]*ResumableSession)
+	if err := s.load(&sessions, sessionsFile); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (s *storage) LoadThrottle() (throttle map[string][]irma.Timestamp, err error) {
+	throttle = make(map[string][]irma.Timestamp)
+	if err := s.load(&throttle, throttleFile); err != nil {
+		return nil, err
+	}
+	return throttle, nil
+}
+
 func (s *storage) LoadUpdates() (updates []update, err error) {
 	updates = []update{}
 	if err := s.load(&updates, updatesFile); err != nil {
@@ -195,6 +269,56 @@ func (s *storage) LoadUpdates() (updates []update, err error) {
 	return updates, nil
 }
 
+// LoadVersion returns the schema version of the storage, which is 0 if the storage
+// predates versioning.
+func (s *storage) LoadVersion() (version int, err error) {
+	return version, s.load(&version, versionFile)
+}
+
+// Backup copies all client state to the backup folder, replacing any previous backup.
+func (s *storage) Backup() error {
+	if err := os.RemoveAll(s.path(backupDir)); err != nil {
+		return err
+	}
+	if err := fs.EnsureDirectoryExists(s.path(backupDir)); err != nil {
+		return err
+	}
+	for _, file := range storageFiles {
+		if err := s.copyPath(s.path(file), s.path(backupDir+"/"+file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreBackup restores all client state from the backup made by Backup().
+func (s *storage) RestoreBackup() error {
+	for _, file := range storageFiles {
+		if err := os.RemoveAll(s.path(file)); err != nil {
+			return err
+		}
+		if err := s.copyPath(s.path(backupDir+"/"+file), s.path(file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyPath copies the file or directory at src, if it exists, to dest.
+func (s *storage) copyPath(src, dest string) error {
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fs.CopyDirectory(src, dest)
+	}
+	return fs.Copy(src, dest)
+}
+
 func (s *storage) LoadPreferences() (Preferences, error) {
 	config := defaultPreferences
 	return config, s.load(&config, preferencesFile)
@@ -0,0 +1,131 @@
+package irmaclient
+
+import (
+	"sort"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the throttling of sessions per requestor. A requestor that starts sessions
+// with the user too frequently, e.g. to train the user into approving its sessions without looking,
+// is throttled: before its sessions ask the user for permission, the user is asked for an extra
+// confirmation, or, depending on Preferences.SessionThrottleDecline, its sessions are declined.
+// Requestors are identified by the hostname of their IRMA server.
+
+// ThrottleState is the throttle state of a requestor.
+type ThrottleState struct {
+	Origin string
+	// Start times of the sessions of the requestor within the throttle window, oldest first
+	Sessions  []irma.Timestamp
+	Throttled bool
+}
+
+// SessionThrottle returns the throttle state of each requestor that started sessions within the
+// throttle window, see Preferences.SessionThrottleWindow.
+func (client *Client) SessionThrottle() []*ThrottleState {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+
+	now := time.Now()
+	list := make([]*ThrottleState, 0, len(client.sessionThrottle))
+	for origin := range client.sessionThrottle {
+		sessions := client.recentSessions(origin, now)
+		if len(sessions) == 0 {
+			continue
+		}
+		list = append(list, &ThrottleState{
+			Origin:    origin,
+			Sessions:  sessions,
+			Throttled: client.throttled(sessions),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Origin < list[j].Origin
+	})
+	return list
+}
+
+// ResetSessionThrottle forgets the sessions of the specified requestor, so that it is no longer throttled.
+func (client *Client) ResetSessionThrottle(origin string) error {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	delete(client.sessionThrottle, origin)
+	return client.storage.StoreThrottle(client.sessionThrottle)
+}
+
+// ResetAllSessionThrottles forgets the sessions of all requestors.
+func (client *Client) ResetAllSessionThrottles() error {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	client.sessionThrottle = map[string][]irma.Timestamp{}
+	return client.storage.StoreThrottle(client.sessionThrottle)
+}
+
+// recordSession records that the specified requestor started a session, and returns whether
+// the requestor is throttled.
+func (client *Client) recordSession(origin string) bool {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+
+	// Forget sessions that fell outside the throttle window, of all requestors
+	now := time.Now()
+	for o := range client.sessionThrottle {
+		if sessions := client.recentSessions(o, now); len(sessions) > 0 {
+			client.sessionThrottle[o] = sessions
+		} else {
+			delete(client.sessionThrottle, o)
+		}
+	}
+
+	sessions := append(client.sessionThrottle[origin], irma.Timestamp(now))
+	client.sessionThrottle[origin] = sessions
+	if err := client.storage.StoreThrottle(client.sessionThrottle); err != nil {
+		irma.Logger.Warn("Failed to store session throttle: ", err.Error())
+	}
+	return client.throttled(sessions)
+}
+
+// recentSessions returns the sessions of the specified requestor within the throttle window.
+// The caller must hold sessionsLock.
+func (client *Client) recentSessions(origin string, now time.Time) []irma.Timestamp {
+	since := irma.Timestamp(now.Add(-client.Preferences.SessionThrottleWindow))
+	var sessions []irma.Timestamp
+	for _, t := range client.sessionThrottle[origin] {
+		if !t.Before(since) {
+			sessions = append(sessions, t)
+		}
+	}
+	return sessions
+}
+
+func (client *Client) throttled(sessions []irma.Timestamp) bool {
+	threshold := client.Preferences.SessionThrottleThreshold
+	return threshold > 0 && len(sessions) > threshold
+}
+
+// confirmThrottled asks the user for confirmation to continue the session, if its requestor was
+// throttled when the session started, or declines it, depending on the preferences. It returns
+// false if the session cannot continue.
+func (session *session) confirmThrottled() bool {
+	if !session.throttled {
+		return true
+	}
+	if session.client.Preferences.SessionThrottleDecline {
+		session.cancel()
+		return false
+	}
+
+	session.client.sessionsLock.Lock()
+	count := len(session.client.sessionThrottle[session.Hostname])
+	session.client.sessionsLock.Unlock()
+	proceed := make(chan bool, 1)
+	session.Handler.RequestThrottledSessionConfirmation(session.Hostname, count, func(p bool) {
+		proceed <- p
+	})
+	if !<-proceed {
+		session.cancel()
+		return false
+	}
+	return true
+}
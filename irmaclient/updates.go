@@ -1,14 +1,67 @@
 package irmaclient
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 )
 
 // This file contains the update mechanism for Client
 // as well as updates themselves.
+//
+// The on-disk format of the client is versioned by the number in the version file.
+// At startup, storageMigrations are run to bring the storage up to storageVersion, after
+// backing up the pre-migration state. Storage without a version file (version 0) is in
+// one of the implicit formats from before versioning, which are converted by the legacy
+// clientUpdates below.
+
+// storageVersion is the version of the storage format of this version of the client.
+const storageVersion = 1
+
+// storageMigrations[i] converts storage of version i to version i+1. As a failed migration
+// may leave the storage partially migrated before its backup is restored, migrations should
+// be idempotent.
+var storageMigrations = []func(client *Client) error{
+	// 0 -> 1: Perform any legacy updates not performed yet
+	func(client *Client) error {
+		return client.update()
+	},
+}
+
+// migrate converts the storage to storageVersion, if necessary, restoring the pre-migration
+// state if any migration fails. Storage of a newer version than storageVersion is rejected.
+func (client *Client) migrate() error {
+	version, err := client.storage.LoadVersion()
+	if err != nil {
+		return err
+	}
+	if version > storageVersion {
+		return errors.Errorf("Storage version %d is newer than the version supported by this client (%d)", version, storageVersion)
+	}
+	if version == storageVersion {
+		return nil
+	}
+
+	if err = client.storage.Backup(); err != nil {
+		return errors.WrapPrefix(err, "Failed to back up storage before migrating", 0)
+	}
+	for ; version < storageVersion; version++ {
+		err = storageMigrations[version](client)
+		if err == nil {
+			err = client.storage.StoreVersion(version + 1)
+		}
+		if err != nil {
+			if restoreErr := client.storage.RestoreBackup(); restoreErr != nil {
+				irma.Logger.Error("Failed to restore storage backup: ", restoreErr.Error())
+			}
+			return errors.WrapPrefix(err, fmt.Sprintf("Storage migration from version %d failed", version), 0)
+		}
+	}
+	return nil
+}
 
 type update struct {
 	When    irma.Timestamp
@@ -17,6 +70,9 @@ type update struct {
 	Error   *string
 }
 
+// clientUpdates are the legacy updates from before storage versioning, performed by the
+// first storage migration. New changes to the storage format should be added to
+// storageMigrations instead.
 var clientUpdates = []func(client *Client) error{
 	// 0: Convert old cardemu.xml Android storage to our own storage format
 	nil, // No longer necessary as the Android app was deprecated long ago
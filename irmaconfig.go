@@ -1,15 +1,20 @@
 package irma
 
 import (
+	"context"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/xml"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
 	"strconv"
+	"sync"
 	"time"
 
 	"crypto/sha256"
@@ -25,8 +30,10 @@ import (
 	"encoding/hex"
 
 	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/asn1"
+	"encoding/json"
 	"encoding/pem"
 	gobig "math/big"
 
@@ -53,17 +60,37 @@ type Configuration struct {
 	// (i.e., invalid signature, parsing error), and the problem that occurred when parsing them
 	DisabledSchemeManagers map[SchemeManagerIdentifier]*SchemeManagerError
 
+	// Errors keeps track of the issuers and credential types that were skipped while parsing
+	// because their files contained an error, unless in strict mode (see SetStrict())
+	Errors []*SchemeManagerError
+
 	Warnings []string
 
+	keysLock      sync.Mutex // guards the lazily parsed keys below
 	kssPublicKeys map[SchemeManagerIdentifier]map[int]*rsa.PublicKey
 	publicKeys    map[IssuerIdentifier]map[int]*gabi.PublicKey
+	missingKeys   map[IssuerIdentifier]map[int]time.Time // when fetching these public keys last failed
+	fetchLock     sync.Mutex                             // serializes fetching of public keys, see fetchPublicKey()
 	privateKeys   map[IssuerIdentifier]*gabi.PrivateKey
 	reverseHashes map[string]CredentialTypeIdentifier
 	initialized   bool
-	assets        string
+	assets        []string // see NewConfigurationFromAssets()
+	overlay       bool
 	readOnly      bool
 	cronchan      chan bool
 	scheduler     *gocron.Scheduler
+	roundTripper  http.RoundTripper
+	tlsPins       map[SchemeManagerIdentifier][]string
+	timeout       time.Duration
+	retries       int
+	unsigned      map[SchemeManagerIdentifier]struct{}
+	strict        bool
+	lenientKeys   bool
+	downloadKeys  bool
+	allowRollback bool
+
+	indexValidators map[SchemeManagerIdentifier]indexValidators
+	metadataCache   metadataCache // see metadatacache.go
 }
 
 // ConfigurationFileHash encodes the SHA256 hash of an authenticated
@@ -79,6 +106,7 @@ type SchemeManagerStatus string
 type SchemeManagerError struct {
 	Manager SchemeManagerIdentifier
 	Status  SchemeManagerStatus
+	File    string // File that failed to verify, if any, relative to the configuration path
 	Err     error
 }
 
@@ -90,24 +118,51 @@ const (
 	SchemeManagerStatusParsingError        = SchemeManagerStatus("ParsingError")
 	SchemeManagerStatusContentParsingError = SchemeManagerStatus("ContentParsingError")
 
+	// DevelopmentSchemeFile is the name of the sentinel file that marks a scheme folder as a
+	// local development scheme, see SetUnsignedSchemes().
+	DevelopmentSchemeFile = "development"
+
 	pubkeyPattern  = "%s/%s/%s/PublicKeys/*.xml"
 	privkeyPattern = "%s/%s/%s/PrivateKeys/*.xml"
 )
 
 func (sme SchemeManagerError) Error() string {
+	if sme.File != "" {
+		return fmt.Sprintf("Error parsing scheme manager %s: file %s: %s", sme.Manager.Name(), sme.File, sme.Err.Error())
+	}
 	return fmt.Sprintf("Error parsing scheme manager %s: %s", sme.Manager.Name(), sme.Err.Error())
 }
 
+// ConfigurationReport lists the problems encountered while parsing a Configuration.
+type ConfigurationReport struct {
+	Errors   []string `json:"errors,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Report returns the errors encountered while parsing, i.e. those of the disabled scheme managers
+// and of the skipped issuers and credential types (see SetStrict()), and the warnings.
+func (conf *Configuration) Report() *ConfigurationReport {
+	report := &ConfigurationReport{Warnings: append([]string(nil), conf.Warnings...)}
+	for _, smerr := range conf.DisabledSchemeManagers {
+		report.Errors = append(report.Errors, smerr.Error())
+	}
+	sort.Strings(report.Errors)
+	for _, smerr := range conf.Errors {
+		report.Errors = append(report.Errors, smerr.Error())
+	}
+	return report
+}
+
 // NewConfiguration returns a new configuration. After this
 // ParseFolder() should be called to parse the specified path.
 func NewConfiguration(path string) (*Configuration, error) {
-	return newConfiguration(path, "")
+	return newConfiguration(path, nil)
 }
 
 // NewConfigurationReadOnly returns a new configuration whose representation on disk
 // is never altered. ParseFolder() should be called to parse the specified path.
 func NewConfigurationReadOnly(path string) (*Configuration, error) {
-	conf, err := newConfiguration(path, "")
+	conf, err := newConfiguration(path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -117,20 +172,28 @@ func NewConfigurationReadOnly(path string) (*Configuration, error) {
 
 // NewConfigurationFromAssets returns a new configuration, copying the schemes out of the assets folder to path.
 // ParseFolder() should be called to parse the specified path.
-func NewConfigurationFromAssets(path, assets string) (*Configuration, error) {
+// Multiple assets folders may be specified, e.g. a system-wide folder and a per-user folder, which
+// are searched for schemes in order: if a scheme occurs in more than one, it is taken from the last
+// (see searchpaths.go). Updates of the schemes are only ever written to path.
+func NewConfigurationFromAssets(path string, assets ...string) (*Configuration, error) {
 	return newConfiguration(path, assets)
 }
 
-func newConfiguration(path string, assets string) (conf *Configuration, err error) {
+func newConfiguration(path string, assets []string) (conf *Configuration, err error) {
 	conf = &Configuration{
-		Path:   path,
-		assets: assets,
+		Path:            path,
+		indexValidators: map[SchemeManagerIdentifier]indexValidators{},
 	}
 
-	if conf.assets != "" { // If an assets folder is specified, then it must exist
-		if err = fs.AssertPathExists(conf.assets); err != nil {
+	for _, folder := range assets {
+		if folder == "" {
+			continue
+		}
+		// If an assets folder is specified, then it must exist
+		if err = fs.AssertPathExists(folder); err != nil {
 			return nil, errors.WrapPrefix(err, "Nonexistent assets folder specified", 0)
 		}
+		conf.assets = append(conf.assets, folder)
 	}
 	if err = fs.EnsureDirectoryExists(conf.Path); err != nil {
 		return nil, err
@@ -150,8 +213,118 @@ func (conf *Configuration) clear() {
 	conf.DisabledSchemeManagers = make(map[SchemeManagerIdentifier]*SchemeManagerError)
 	conf.kssPublicKeys = make(map[SchemeManagerIdentifier]map[int]*rsa.PublicKey)
 	conf.publicKeys = make(map[IssuerIdentifier]map[int]*gabi.PublicKey)
+	conf.missingKeys = make(map[IssuerIdentifier]map[int]time.Time)
 	conf.privateKeys = make(map[IssuerIdentifier]*gabi.PrivateKey)
 	conf.reverseHashes = make(map[string]CredentialTypeIdentifier)
+	conf.Errors = nil
+	conf.metadataCache.invalidate()
+}
+
+// SetRoundTripper sets the http.RoundTripper used for all downloads of this Configuration
+// (nil for the default).
+func (conf *Configuration) SetRoundTripper(roundTripper http.RoundTripper) {
+	conf.roundTripper = roundTripper
+}
+
+// SetTimeout sets the timeout of HTTP requests to scheme managers (zero for DefaultSchemeTimeout).
+func (conf *Configuration) SetTimeout(timeout time.Duration) {
+	conf.timeout = timeout
+}
+
+// SetRetries sets the number of times that failed HTTP requests to scheme managers are retried,
+// and that interrupted downloads of scheme files are resumed (zero for DefaultSchemeRetries).
+func (conf *Configuration) SetRetries(retries int) {
+	conf.retries = retries
+}
+
+// SetUnsignedSchemes marks the specified scheme managers as local development schemes, whose
+// index signature and file hashes are not verified when parsing them. Alternatively, a scheme
+// folder can be marked as such by a file called DevelopmentSchemeFile in it. Credentials and
+// attributes of these schemes are flagged as non-production, and the IRMA server refuses them
+// in production mode. Downloads of these schemes are still verified.
+func (conf *Configuration) SetUnsignedSchemes(ids []SchemeManagerIdentifier) {
+	conf.unsigned = make(map[SchemeManagerIdentifier]struct{}, len(ids))
+	for _, id := range ids {
+		conf.unsigned[id] = struct{}{}
+	}
+}
+
+// IsUnsignedScheme returns whether the specified scheme manager is parsed without verifying it
+// (see SetUnsignedSchemes()).
+func (conf *Configuration) IsUnsignedScheme(id SchemeManagerIdentifier) bool {
+	_, ok := conf.unsigned[id]
+	return ok
+}
+
+// SetStrict sets whether an error in the description of an issuer or credential type disables
+// its entire scheme manager, which ParseFolder() then returns. If not (the default), only the
+// affected issuer or credential type is skipped, and the error is added to conf.Errors.
+func (conf *Configuration) SetStrict(strict bool) {
+	conf.strict = strict
+}
+
+// SetLenientKeys sets whether public keys whose <Counter> differs from that in their filename,
+// or whose elements do not match the system parameters for the length of their modulus, are
+// accepted with a warning instead of rejected with an error, e.g. when repairing a scheme.
+func (conf *Configuration) SetLenientKeys(lenient bool) {
+	conf.lenientKeys = lenient
+}
+
+// SetTLSPins overrides the TLS pins of the specified scheme managers (see SchemeManager.TLSPins).
+func (conf *Configuration) SetTLSPins(pins map[SchemeManagerIdentifier][]string) {
+	conf.tlsPins = pins
+}
+
+// TLSPins returns the pins that the TLS certificate of the host of the specified URL must match:
+// those of each scheme manager whose scheme or keyshare server runs at that host.
+func (conf *Configuration) TLSPins(u string) []string {
+	host := urlHost(u)
+	if host == "" {
+		return nil
+	}
+	var pins []string
+	for id, manager := range conf.SchemeManagers {
+		if urlHost(manager.URL) != host && urlHost(manager.KeyshareServer) != host {
+			continue
+		}
+		if override, ok := conf.tlsPins[id]; ok {
+			pins = append(pins, override...)
+		} else {
+			pins = append(pins, manager.TLSPins...)
+		}
+	}
+	return pins
+}
+
+func schemeTimeout(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return DefaultSchemeTimeout
+	}
+	return timeout
+}
+
+func schemeRetries(retries int) int {
+	if retries == 0 {
+		return DefaultSchemeRetries
+	}
+	return retries
+}
+
+func urlHost(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+func (conf *Configuration) newHTTPTransport(url string) *HTTPTransport {
+	transport := NewHTTPTransport(url)
+	transport.SetRoundTripper(conf.roundTripper)
+	transport.SetTLSPins(conf.TLSPins(url))
+	transport.SetTimeout(schemeTimeout(conf.timeout), SubsystemScheme)
+	transport.SetRetries(schemeRetries(conf.retries))
+	return transport
 }
 
 // ParseFolder populates the current Configuration by parsing the storage path,
@@ -160,44 +333,52 @@ func (conf *Configuration) ParseFolder() (err error) {
 	// Init all maps
 	conf.clear()
 
-	// Copy any new or updated scheme managers out of the assets into storage
-	if conf.assets != "" {
-		err = iterateSubfolders(conf.assets, func(dir string) error {
-			scheme := NewSchemeManagerIdentifier(filepath.Base(dir))
-			uptodate, err := conf.isUpToDate(scheme)
-			if err != nil {
-				return err
-			}
-			if !uptodate {
-				_, err = conf.CopyManagerFromAssets(scheme)
-			}
-			return err
-		})
+	// Finish scheme folder replacements that were interrupted by a crash
+	if err = conf.restoreSchemeFolders(); err != nil {
+		return err
+	}
+
+	// Copy any new or updated scheme managers out of the assets into storage,
+	// or in overlay mode remove outdated versions from storage
+	schemes, err := conf.assetSchemes()
+	if err != nil {
+		return err
+	}
+	for _, scheme := range schemes {
+		uptodate, err := conf.isUpToDate(scheme)
 		if err != nil {
 			return err
 		}
+		if !uptodate {
+			if _, err = conf.CopyManagerFromAssets(scheme); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Parse scheme managers in storage
-	var mgrerr *SchemeManagerError
-	err = iterateSubfolders(conf.Path, func(dir string) error {
-		manager := NewSchemeManager(filepath.Base(dir))
-		err := conf.ParseSchemeManagerFolder(dir, manager)
-		if err == nil {
-			return nil // OK, do next scheme manager folder
-		}
-		// If there is an error, and it is of type SchemeManagerError, return nil
-		// so as to continue parsing other managers.
-		var ok bool
-		if mgrerr, ok = err.(*SchemeManagerError); ok {
-			conf.DisabledSchemeManagers[manager.Identifier()] = mgrerr
-			return nil
-		}
-		return err // Not a SchemeManagerError? return it & halt parsing now
+	var dirs []string
+	err = conf.iterateSubfolders(conf.Path, func(dir string) error {
+		dirs = append(dirs, dir)
+		return nil
 	})
 	if err != nil {
 		return
 	}
+	var mgrerr *SchemeManagerError
+	for _, parsed := range conf.parseSchemeManagerFolders(dirs) {
+		conf.merge(parsed.conf)
+		if parsed.err == nil {
+			continue // OK, do next scheme manager folder
+		}
+		// If there is an error, and it is of type SchemeManagerError, continue parsing other managers.
+		var ok bool
+		if mgrerr, ok = parsed.err.(*SchemeManagerError); ok {
+			conf.DisabledSchemeManagers[parsed.id] = mgrerr
+			continue
+		}
+		return parsed.err // Not a SchemeManagerError? return it & halt parsing now
+	}
 	conf.initialized = true
 	if mgrerr != nil {
 		return mgrerr
@@ -205,6 +386,79 @@ func (conf *Configuration) ParseFolder() (err error) {
 	return
 }
 
+// parseWorkers is the maximum number of scheme manager folders that ParseFolder() parses concurrently.
+var parseWorkers = runtime.NumCPU()
+
+type parsedSchemeManager struct {
+	id   SchemeManagerIdentifier
+	conf *Configuration
+	err  error
+}
+
+// parseSchemeManagerFolders parses the specified scheme manager folders concurrently, each into
+// its own copy of conf, returning the results in the order of the folders.
+func (conf *Configuration) parseSchemeManagerFolders(dirs []string) []parsedSchemeManager {
+	results := make([]parsedSchemeManager, len(dirs))
+	indices := make(chan int)
+	workers := parseWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(dirs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				manager := NewSchemeManager(filepath.Base(dirs[i]))
+				c := conf.copyConfiguration(conf.Path)
+				err := c.ParseSchemeManagerFolder(dirs[i], manager)
+				results[i] = parsedSchemeManager{id: manager.Identifier(), conf: c, err: err}
+			}
+		}()
+	}
+	for i := range dirs {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	return results
+}
+
+// merge adds the scheme managers, issuers, credential types and attribute types parsed into c
+// to conf, along with the errors and warnings encountered while parsing them.
+func (conf *Configuration) merge(c *Configuration) {
+	defer conf.metadataCache.invalidate()
+	for id, manager := range c.SchemeManagers {
+		conf.SchemeManagers[id] = manager
+	}
+	for id, smerr := range c.DisabledSchemeManagers {
+		conf.DisabledSchemeManagers[id] = smerr
+	}
+	for id, issuer := range c.Issuers {
+		conf.Issuers[id] = issuer
+	}
+	for id, credtype := range c.CredentialTypes {
+		conf.CredentialTypes[id] = credtype
+	}
+	for id, attrtype := range c.AttributeTypes {
+		conf.AttributeTypes[id] = attrtype
+	}
+	for hash, id := range c.reverseHashes {
+		conf.reverseHashes[hash] = id
+	}
+	for id := range c.unsigned {
+		if conf.unsigned == nil {
+			conf.unsigned = map[SchemeManagerIdentifier]struct{}{}
+		}
+		conf.unsigned[id] = struct{}{}
+	}
+	conf.Errors = append(conf.Errors, c.Errors...)
+	conf.Warnings = append(conf.Warnings, c.Warnings...)
+}
+
 // ParseOrRestoreFolder parses the irma_configuration folder, and when possible attempts to restore
 // any broken scheme managers from their remote.
 // Any error encountered during parsing is considered recoverable only if it is of type *SchemeManagerError;
@@ -218,7 +472,7 @@ func (conf *Configuration) ParseOrRestoreFolder() error {
 	if _, isSchemeMgrErr := err.(*SchemeManagerError); !isSchemeMgrErr {
 		return err
 	}
-	if err != nil && (conf.assets == "" || conf.readOnly) {
+	if err != nil && (len(conf.assets) == 0 || conf.readOnly) {
 		return err
 	}
 
@@ -250,16 +504,31 @@ func (conf *Configuration) ParseSchemeManagerFolder(dir string, manager *SchemeM
 	// Ensure we return a SchemeManagerError when any error occurs
 	defer func() {
 		if err != nil {
-			err = &SchemeManagerError{
-				Manager: manager.Identifier(),
-				Err:     err,
-				Status:  manager.Status,
+			smerr, ok := err.(*SchemeManagerError)
+			if !ok {
+				smerr = &SchemeManagerError{Manager: manager.Identifier(), Err: err}
 			}
+			smerr.Status = manager.Status
+			err = smerr
 		}
 	}()
 
+	// A sentinel file marks local development schemes, which are not verified
+	var development bool
+	if development, err = fs.PathExists(conf.resolve(filepath.Join(dir, DevelopmentSchemeFile))); err != nil {
+		return
+	}
+	if development {
+		if conf.unsigned == nil {
+			conf.unsigned = map[SchemeManagerIdentifier]struct{}{}
+		}
+		conf.unsigned[manager.Identifier()] = struct{}{}
+	}
+	manager.Development = conf.IsUnsignedScheme(manager.Identifier())
+
 	// Verify signature and read scheme manager description
 	if err = conf.VerifySignature(manager.Identifier()); err != nil {
+		manager.Status = SchemeManagerStatusInvalidSignature
 		return
 	}
 	if manager.index, err = conf.parseIndex(filepath.Base(dir), manager); err != nil {
@@ -287,7 +556,7 @@ func (conf *Configuration) ParseSchemeManagerFolder(dir string, manager *SchemeM
 	}
 
 	// Read timestamp indicating time of last modification
-	ts, exists, err := readTimestamp(dir + "/timestamp")
+	ts, exists, err := readTimestamp(conf.resolve(dir + "/timestamp"))
 	if err != nil || !exists {
 		return errors.WrapPrefix(err, "Could not read scheme manager timestamp", 0)
 	}
@@ -327,12 +596,15 @@ func relativePath(outer string, inner string) (string, error) {
 
 // PrivateKey returns the specified private key, or nil if not present in the Configuration.
 func (conf *Configuration) PrivateKey(id IssuerIdentifier) (*gabi.PrivateKey, error) {
+	conf.keysLock.Lock()
+	defer conf.keysLock.Unlock()
+
 	if sk := conf.privateKeys[id]; sk != nil {
 		return sk, nil
 	}
 
 	path := fmt.Sprintf(privkeyPattern, conf.Path, id.SchemeManagerIdentifier().Name(), id.Name())
-	files, err := filepath.Glob(path)
+	files, err := conf.glob(path)
 	if err != nil {
 		return nil, err
 	}
@@ -356,7 +628,7 @@ func (conf *Configuration) PrivateKey(id IssuerIdentifier) (*gabi.PrivateKey, er
 
 	// Read private key
 	file := strings.Replace(path, "*", strconv.Itoa(counter), 1)
-	sk, err := gabi.NewPrivateKeyFromFile(file)
+	sk, err := gabi.NewPrivateKeyFromFile(conf.resolve(file))
 	if err != nil {
 		return nil, err
 	}
@@ -369,7 +641,28 @@ func (conf *Configuration) PrivateKey(id IssuerIdentifier) (*gabi.PrivateKey, er
 }
 
 // PublicKey returns the specified public key, or nil if not present in the Configuration.
+// Keys are parsed from the scheme folder when first requested, and cached. If enabled using
+// SetDownloadMissingPublicKeys(), keys not present in the scheme folder are fetched from the
+// scheme manager before returning nil (see publickeys.go).
 func (conf *Configuration) PublicKey(id IssuerIdentifier, counter int) (*gabi.PublicKey, error) {
+	return conf.PublicKeyContext(context.Background(), id, counter)
+}
+
+// PublicKeyContext is like PublicKey, but aborts fetching a missing key from the scheme manager
+// when the context is done, returning the error of the context.
+func (conf *Configuration) PublicKeyContext(ctx context.Context, id IssuerIdentifier, counter int) (*gabi.PublicKey, error) {
+	pk, err := conf.parsedPublicKey(id, counter)
+	if err != nil || pk != nil || !conf.downloadKeys {
+		return pk, err
+	}
+	return conf.fetchPublicKey(ctx, id, counter)
+}
+
+// parsedPublicKey returns the specified public key from the cache, or from the scheme folder.
+func (conf *Configuration) parsedPublicKey(id IssuerIdentifier, counter int) (*gabi.PublicKey, error) {
+	conf.keysLock.Lock()
+	defer conf.keysLock.Unlock()
+
 	var haveIssuer, haveKey bool
 	var err error
 	_, haveIssuer = conf.publicKeys[id]
@@ -387,6 +680,47 @@ func (conf *Configuration) PublicKey(id IssuerIdentifier, counter int) (*gabi.Pu
 	return conf.publicKeys[id][counter], nil
 }
 
+// DownloadPublicKey downloads the specified public key from its scheme manager if we do not
+// already have it, authenticating it using the scheme manager index. If our copy of the index
+// does not contain the key, the scheme manager is updated first. Returns nil if the scheme
+// manager does not have the key either.
+func (conf *Configuration) DownloadPublicKey(id IssuerIdentifier, counter int) (*gabi.PublicKey, error) {
+	pk, err := conf.PublicKey(id, counter)
+	if err != nil || pk != nil {
+		return pk, err
+	}
+	if conf.readOnly {
+		return nil, errors.New("cannot download into a read-only configuration")
+	}
+	manager, contains := conf.SchemeManagers[id.SchemeManagerIdentifier()]
+	if !contains {
+		return nil, errors.Errorf("Unknown scheme manager %s", id.SchemeManagerIdentifier())
+	}
+
+	filename := fmt.Sprintf("%s/%s/PublicKeys/%d.xml", manager.ID, id.Name(), counter)
+	if _, known := manager.index[filename]; !known {
+		if err = conf.UpdateSchemeManager(manager.Identifier(), nil); err != nil {
+			return nil, err
+		}
+	}
+	hash, known := manager.index[filename]
+	if !known {
+		return nil, nil
+	}
+	path := filepath.Join(conf.Path, filename)
+	exists, err := fs.PathExists(conf.resolve(path))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		stripped := filename[len(manager.ID)+1:] // Scheme manager URL already ends with its name
+		if err = conf.newHTTPTransport(manager.URL+"/").GetSignedFile(stripped, path, hash); err != nil {
+			return nil, err
+		}
+	}
+	return conf.PublicKey(id, counter)
+}
+
 // KeyshareServerKeyFunc returns a function that returns the public key with which to verify a keyshare server JWT,
 // suitable for passing to jwt.Parse() and jwt.ParseWithClaims().
 func (conf *Configuration) KeyshareServerKeyFunc(scheme SchemeManagerIdentifier) func(t *jwt.Token) (interface{}, error) {
@@ -404,11 +738,14 @@ func (conf *Configuration) KeyshareServerKeyFunc(scheme SchemeManagerIdentifier)
 
 // KeyshareServerPublicKey returns the i'th public key of the specified scheme.
 func (conf *Configuration) KeyshareServerPublicKey(scheme SchemeManagerIdentifier, i int) (*rsa.PublicKey, error) {
+	conf.keysLock.Lock()
+	defer conf.keysLock.Unlock()
+
 	if _, contains := conf.kssPublicKeys[scheme]; !contains {
 		conf.kssPublicKeys[scheme] = make(map[int]*rsa.PublicKey)
 	}
 	if _, contains := conf.kssPublicKeys[scheme][i]; !contains {
-		pkbts, err := ioutil.ReadFile(filepath.Join(conf.Path, scheme.Name(), fmt.Sprintf("kss-%d.pem", i)))
+		pkbts, err := ioutil.ReadFile(conf.resolve(filepath.Join(conf.Path, scheme.Name(), fmt.Sprintf("kss-%d.pem", i))))
 		if err != nil {
 			return nil, err
 		}
@@ -429,6 +766,7 @@ func (conf *Configuration) KeyshareServerPublicKey(scheme SchemeManagerIdentifie
 func (conf *Configuration) addReverseHash(credid CredentialTypeIdentifier) {
 	hash := sha256.Sum256([]byte(credid.String()))
 	conf.reverseHashes[base64.StdEncoding.EncodeToString(hash[:16])] = credid
+	conf.metadataCache.invalidate()
 }
 
 func (conf *Configuration) hashToCredentialType(hash []byte) *CredentialType {
@@ -453,21 +791,22 @@ func (conf *Configuration) Prune() {
 }
 
 func (conf *Configuration) parseIssuerFolders(manager *SchemeManager, path string) error {
-	return iterateSubfolders(path, func(dir string) error {
+	return conf.iterateSubfolders(path, func(dir string) error {
 		issuer := &Issuer{}
-		exists, err := conf.pathToDescription(manager, dir+"/description.xml", issuer)
+		file := dir + "/description.xml"
+		exists, err := conf.pathToDescription(manager, file, issuer)
 		if err != nil {
-			return err
+			return conf.skip(manager, file, err)
 		}
 		if !exists {
 			return nil
 		}
 		if issuer.XMLVersion < 4 {
-			return errors.New("Unsupported issuer description")
+			return conf.skip(manager, file, errors.New("Unsupported issuer description"))
 		}
 
 		if err = conf.checkIssuer(manager, issuer, dir); err != nil {
-			return err
+			return conf.skip(manager, file, err)
 		}
 
 		conf.Issuers[issuer.Identifier()] = issuer
@@ -477,6 +816,7 @@ func (conf *Configuration) parseIssuerFolders(manager *SchemeManager, path strin
 }
 
 func (conf *Configuration) DeleteSchemeManager(id SchemeManagerIdentifier) error {
+	defer conf.metadataCache.invalidate()
 	delete(conf.SchemeManagers, id)
 	delete(conf.DisabledSchemeManagers, id)
 	name := id.String()
@@ -496,17 +836,31 @@ func (conf *Configuration) DeleteSchemeManager(id SchemeManagerIdentifier) error
 		}
 	}
 	if !conf.readOnly {
-		return os.RemoveAll(filepath.Join(conf.Path, id.Name()))
+		return conf.mask(id)
 	}
 	return nil
 }
 
+// parsePublicKeys parses the public keys of all issuers, which are otherwise parsed lazily.
+// Errors are ignored, as PublicKey() returns them when the affected keys are requested.
+func (conf *Configuration) parsePublicKeys() {
+	conf.keysLock.Lock()
+	defer conf.keysLock.Unlock()
+	for id := range conf.Issuers {
+		_ = conf.parseKeysFolder(id)
+	}
+}
+
 // parse $schememanager/$issuer/PublicKeys/$i.xml for $i = 1, ...
+// The caller must hold conf.keysLock.
 func (conf *Configuration) parseKeysFolder(issuerid IssuerIdentifier) error {
 	manager := conf.SchemeManagers[issuerid.SchemeManagerIdentifier()]
-	conf.publicKeys[issuerid] = map[int]*gabi.PublicKey{}
+	if conf.publicKeys[issuerid] == nil {
+		// Keys already present remain, so that keys fetched by fetchPublicKey() are not forgotten
+		conf.publicKeys[issuerid] = map[int]*gabi.PublicKey{}
+	}
 	path := fmt.Sprintf(pubkeyPattern, conf.Path, issuerid.SchemeManagerIdentifier().Name(), issuerid.Name())
-	files, err := filepath.Glob(path)
+	files, err := conf.glob(path)
 	if err != nil {
 		return err
 	}
@@ -528,10 +882,14 @@ func (conf *Configuration) parseKeysFolder(issuerid IssuerIdentifier) error {
 		}
 		pk, err := gabi.NewPublicKeyFromBytes(bts)
 		if err != nil {
-			return err
+			return errors.Errorf("Public key %s of issuer %s could not be parsed: %s", relativepath, issuerid.String(), err.Error())
 		}
-		if int(pk.Counter) != i {
-			return errors.Errorf("Public key %s of issuer %s has wrong <Counter>", file, issuerid.String())
+		if err = checkPublicKey(pk, i); err != nil {
+			msg := fmt.Sprintf("Public key %s of issuer %s %s", relativepath, issuerid.String(), err.Error())
+			if !conf.lenientKeys {
+				return errors.New(msg)
+			}
+			conf.Warnings = append(conf.Warnings, msg)
 		}
 		pk.Issuer = issuerid.String()
 		conf.publicKeys[issuerid][i] = pk
@@ -540,13 +898,47 @@ func (conf *Configuration) parseKeysFolder(issuerid IssuerIdentifier) error {
 	return nil
 }
 
+// checkPublicKey checks that the public key read from the file for the specified counter has that
+// counter, and that its elements match the system parameters for the length of its modulus.
+func checkPublicKey(pk *gabi.PublicKey, counter int) error {
+	if int(pk.Counter) != counter {
+		return errors.Errorf("has <Counter> %d instead of %d", pk.Counter, counter)
+	}
+	if pk.N == nil {
+		return errors.New("has no modulus")
+	}
+	keylength := pk.N.BitLen()
+	params, ok := gabi.DefaultSystemParameters[keylength]
+	if !ok || (pk.Params != nil && pk.Params.Ln != params.Ln) {
+		return errors.Errorf("has modulus of unsupported length %d", keylength)
+	}
+	elements := append([]*big.Int{pk.Z, pk.S}, pk.R...)
+	for i, x := range elements {
+		if x == nil || x.BitLen() > keylength || x.Cmp(pk.N) >= 0 {
+			return errors.Errorf("has %s exceeding the modulus", keyElementName(i))
+		}
+	}
+	return nil
+}
+
+func keyElementName(i int) string {
+	switch i {
+	case 0:
+		return "<Z>"
+	case 1:
+		return "<S>"
+	default:
+		return fmt.Sprintf("base R_%d", i-2)
+	}
+}
+
 func (conf *Configuration) PublicKeyIndices(issuerid IssuerIdentifier) (i []int, err error) {
 	return conf.matchKeyPattern(issuerid, pubkeyPattern)
 }
 
 func (conf *Configuration) matchKeyPattern(issuerid IssuerIdentifier, pattern string) (i []int, err error) {
 	pkpath := fmt.Sprintf(pattern, conf.Path, issuerid.SchemeManagerIdentifier().Name(), issuerid.Name())
-	files, err := filepath.Glob(pkpath)
+	files, err := conf.glob(pkpath)
 	if err != nil {
 		return
 	}
@@ -565,17 +957,18 @@ func (conf *Configuration) matchKeyPattern(issuerid IssuerIdentifier, pattern st
 // parse $schememanager/$issuer/Issues/*/description.xml
 func (conf *Configuration) parseCredentialsFolder(manager *SchemeManager, issuer *Issuer, path string) error {
 	var foundcred bool
-	err := iterateSubfolders(path, func(dir string) error {
+	err := conf.iterateSubfolders(path, func(dir string) error {
 		cred := &CredentialType{}
-		exists, err := conf.pathToDescription(manager, dir+"/description.xml", cred)
+		file := dir + "/description.xml"
+		exists, err := conf.pathToDescription(manager, file, cred)
 		if err != nil {
-			return err
+			return conf.skip(manager, file, err)
 		}
 		if !exists {
 			return nil
 		}
 		if err = conf.checkCredentialType(manager, issuer, cred, dir); err != nil {
-			return err
+			return conf.skip(manager, file, err)
 		}
 		foundcred = true
 		cred.Valid = conf.SchemeManagers[cred.SchemeManagerIdentifier()].Valid
@@ -597,6 +990,28 @@ func (conf *Configuration) parseCredentialsFolder(manager *SchemeManager, issuer
 	return err
 }
 
+// skip handles an error in the specified description file of an issuer or credential type.
+// In strict mode it is returned, disabling the scheme manager. Otherwise it is added to
+// conf.Errors, and nil is returned so that the issuer or credential type is skipped.
+func (conf *Configuration) skip(manager *SchemeManager, path string, err error) error {
+	file, relerr := relativePath(conf.Path, path)
+	if relerr != nil {
+		file = path
+	}
+	smerr := &SchemeManagerError{
+		Manager: manager.Identifier(),
+		Status:  SchemeManagerStatusContentParsingError,
+		File:    filepath.ToSlash(file),
+		Err:     err,
+	}
+	if conf.strict {
+		return smerr
+	}
+	Logger.Warn(smerr.Error())
+	conf.Errors = append(conf.Errors, smerr)
+	return nil
+}
+
 // iterateSubfolders iterates over the subfolders of the specified path,
 // calling the specified handler each time. If anything goes wrong, or
 // if the caller returns a non-nil error, an error is immediately returned.
@@ -614,7 +1029,7 @@ func iterateSubfolders(path string, handler func(string) error) error {
 		if !stat.IsDir() {
 			continue
 		}
-		if strings.HasSuffix(dir, "/.git") {
+		if strings.HasPrefix(filepath.Base(dir), ".") { // e.g. .git, or staging folders of updates
 			continue
 		}
 		err = handler(dir)
@@ -627,7 +1042,7 @@ func iterateSubfolders(path string, handler func(string) error) error {
 }
 
 func (conf *Configuration) pathToDescription(manager *SchemeManager, path string, description interface{}) (bool, error) {
-	if _, err := os.Stat(path); err != nil {
+	if _, err := os.Stat(conf.resolve(path)); err != nil {
 		return false, nil
 	}
 
@@ -662,12 +1077,33 @@ func (conf *Configuration) Contains(cred CredentialTypeIdentifier) bool {
 		conf.CredentialTypes[cred] != nil
 }
 
+// WildcardAttributes returns the attribute types of the credential type to which the specified
+// wildcard refers (see AttributeTypeIdentifier.IsWildcard()).
+func (conf *Configuration) WildcardAttributes(id AttributeTypeIdentifier) ([]AttributeTypeIdentifier, error) {
+	if !id.IsWildcard() {
+		return nil, errors.Errorf("%s is not a wildcard", id.String())
+	}
+	credtype := conf.CredentialTypes[id.CredentialTypeIdentifier()]
+	if credtype == nil {
+		return nil, errors.Errorf("Unknown credential type %s", id.CredentialTypeIdentifier().String())
+	}
+	attrs := make([]AttributeTypeIdentifier, 0, len(credtype.AttributeTypes))
+	for _, attr := range credtype.AttributeTypes {
+		attrs = append(attrs, attr.GetAttributeTypeIdentifier())
+	}
+	return attrs, nil
+}
+
 func (conf *Configuration) isUpToDate(scheme SchemeManagerIdentifier) (bool, error) {
-	if conf.assets == "" || conf.readOnly {
+	name := scheme.String()
+	assets := conf.assetsFolder(name)
+	if assets == "" || conf.readOnly {
 		return true, nil
 	}
-	name := scheme.String()
-	newTime, exists, err := readTimestamp(filepath.Join(conf.assets, name, "timestamp"))
+	if conf.masked(name) {
+		return true, nil // Deleted by the user, see mask()
+	}
+	newTime, exists, err := readTimestamp(filepath.Join(assets, name, "timestamp"))
 	if err != nil || !exists {
 		return true, errors.WrapPrefix(err, "Could not read asset timestamp of scheme "+name, 0)
 	}
@@ -680,17 +1116,22 @@ func (conf *Configuration) isUpToDate(scheme SchemeManagerIdentifier) (bool, err
 }
 
 func (conf *Configuration) CopyManagerFromAssets(scheme SchemeManagerIdentifier) (bool, error) {
-	if conf.assets == "" || conf.readOnly {
+	name := scheme.String()
+	assets := conf.assetsFolder(name)
+	if assets == "" || conf.readOnly {
 		return false, nil
 	}
 	// Remove old version; we want an exact copy of the assets version
 	// not a merge of the assets version and the storage version
-	name := scheme.String()
 	if err := os.RemoveAll(filepath.Join(conf.Path, name)); err != nil {
 		return false, err
 	}
+	if conf.overlay {
+		// Without the storage version the assets version shows through
+		return true, conf.unmask(scheme)
+	}
 	return true, fs.CopyDirectory(
-		filepath.Join(conf.assets, name),
+		filepath.Join(assets, name),
 		filepath.Join(conf.Path, name),
 	)
 }
@@ -698,6 +1139,16 @@ func (conf *Configuration) CopyManagerFromAssets(scheme SchemeManagerIdentifier)
 // DownloadSchemeManager downloads and returns a scheme manager description.xml file
 // from the specified URL.
 func DownloadSchemeManager(url string) (*SchemeManager, error) {
+	return downloadSchemeManager(url, (&Configuration{}).newHTTPTransport) // using default settings
+}
+
+// DownloadSchemeManagerDescription is like DownloadSchemeManager(), but uses the HTTP settings
+// of this Configuration (http.RoundTripper, TLS pins, timeout and retries).
+func (conf *Configuration) DownloadSchemeManagerDescription(url string) (*SchemeManager, error) {
+	return downloadSchemeManager(url, conf.newHTTPTransport)
+}
+
+func downloadSchemeManager(url string, newTransport func(string) *HTTPTransport) (*SchemeManager, error) {
 	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
 		url = "https://" + url
 	}
@@ -707,7 +1158,7 @@ func DownloadSchemeManager(url string) (*SchemeManager, error) {
 	if strings.HasSuffix(url, "/description.xml") {
 		url = url[:len(url)-len("/description.xml")]
 	}
-	b, err := NewHTTPTransport(url).GetBytes("description.xml")
+	b, err := newTransport(url).GetBytes("description.xml")
 	if err != nil {
 		return nil, err
 	}
@@ -723,6 +1174,7 @@ func DownloadSchemeManager(url string) (*SchemeManager, error) {
 // RemoveSchemeManager removes the specified scheme manager and all associated issuers,
 // public keys and credential types from this Configuration.
 func (conf *Configuration) RemoveSchemeManager(id SchemeManagerIdentifier, fromStorage bool) error {
+	defer conf.metadataCache.invalidate()
 	// Remove everything falling under the manager's responsibility
 	for credid := range conf.CredentialTypes {
 		if credid.IssuerIdentifier().SchemeManagerIdentifier() == id {
@@ -754,14 +1206,25 @@ func (conf *Configuration) ReinstallSchemeManager(manager *SchemeManager) (err e
 
 	// Check if downloading stuff from the remote works before we uninstall the specified manager:
 	// If we can't download anything we should keep the broken version
-	manager, err = DownloadSchemeManager(manager.URL)
+	manager, err = conf.DownloadSchemeManagerDescription(manager.URL)
+	if err != nil {
+		return
+	}
+	// Verify the reinstalled scheme against the public key we already have, instead of
+	// trusting whatever public key the remote serves
+	publickey, err := conf.knownPublicKey(manager.Identifier())
 	if err != nil {
 		return
 	}
+	if publickey == nil {
+		if publickey, err = readIfExists(conf.resolve(filepath.Join(conf.Path, manager.ID, "pk.pem"))); err != nil {
+			return
+		}
+	}
 	if err = conf.DeleteSchemeManager(manager.Identifier()); err != nil {
 		return
 	}
-	err = conf.InstallSchemeManager(manager, nil)
+	err = conf.InstallSchemeManager(manager, publickey)
 	return
 }
 
@@ -773,11 +1236,14 @@ func (conf *Configuration) InstallSchemeManager(manager *SchemeManager, publicke
 	}
 
 	name := manager.ID
+	if err := conf.unmask(manager.Identifier()); err != nil {
+		return err
+	}
 	if err := fs.EnsureDirectoryExists(filepath.Join(conf.Path, name)); err != nil {
 		return err
 	}
 
-	t := NewHTTPTransport(manager.URL)
+	t := conf.newHTTPTransport(manager.URL)
 	path := fmt.Sprintf("%s/%s", conf.Path, name)
 	if err := t.GetFile("description.xml", path+"/description.xml"); err != nil {
 		return err
@@ -809,18 +1275,35 @@ func (conf *Configuration) DownloadSchemeManagerSignature(manager *SchemeManager
 		return errors.New("cannot download into a read-only configuration")
 	}
 
-	t := NewHTTPTransport(manager.URL)
+	t := conf.newHTTPTransport(manager.URL)
 	path := fmt.Sprintf("%s/%s", conf.Path, manager.ID)
 	index := filepath.Join(path, "index")
 	sig := filepath.Join(path, "index.sig")
 
+	// Keep the current index and signature, so that we can restore them if the new ones
+	// turn out to be invalid
+	var oldIndex, oldSig []byte
+	if oldIndex, err = readIfExists(index); err != nil {
+		return
+	}
+	if oldSig, err = readIfExists(sig); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil && oldIndex != nil && oldSig != nil {
+			_ = fs.SaveFile(index, oldIndex)
+			_ = fs.SaveFile(sig, oldSig)
+		}
+	}()
+
 	if err = t.GetFile("index", index); err != nil {
 		return
 	}
 	if err = t.GetFile("index.sig", sig); err != nil {
 		return
 	}
-	err = conf.VerifySignature(manager.Identifier())
+	// Downloads are always verified, also of schemes that are not verified when parsing
+	err = conf.verifySignature(manager.Identifier())
 	return
 }
 
@@ -836,6 +1319,7 @@ func (conf *Configuration) Download(session SessionRequest) (downloaded *IrmaIde
 		SchemeManagers:  map[SchemeManagerIdentifier]struct{}{},
 		Issuers:         map[IssuerIdentifier]struct{}{},
 		CredentialTypes: map[CredentialTypeIdentifier]struct{}{},
+		PublicKeys:      map[IssuerIdentifier][]int{},
 	}
 
 	// Calculate which scheme managers must be updated
@@ -905,7 +1389,7 @@ func (conf *Configuration) checkCredentialTypes(session SessionRequest, managers
 				managers[credid.Root()] = struct{}{}
 				continue
 			}
-			if !attrid.IsCredential() && !typ.ContainsAttribute(attrid) {
+			if !attrid.IsCredential() && !attrid.IsWildcard() && !typ.ContainsAttribute(attrid) {
 				managers[credid.Root()] = struct{}{}
 			}
 		}
@@ -975,8 +1459,11 @@ func (i SchemeManagerIndex) FromString(s string) error {
 
 // parseIndex parses the index file of the specified manager.
 func (conf *Configuration) parseIndex(name string, manager *SchemeManager) (SchemeManagerIndex, error) {
-	path := filepath.Join(conf.Path, name, "index")
+	path := conf.resolve(filepath.Join(conf.Path, name, "index"))
 	if err := fs.AssertPathExists(path); err != nil {
+		if conf.IsUnsignedScheme(manager.Identifier()) {
+			return SchemeManagerIndex{}, nil
+		}
 		return nil, fmt.Errorf("Missing scheme manager index file; tried %s", path)
 	}
 	indexbts, err := ioutil.ReadFile(path)
@@ -987,12 +1474,22 @@ func (conf *Configuration) parseIndex(name string, manager *SchemeManager) (Sche
 	if err = index.FromString(string(indexbts)); err != nil {
 		return nil, err
 	}
+	// Otherwise an update could turn the scheme into an unverified development scheme
+	if _, ok := index[name+"/"+DevelopmentSchemeFile]; ok {
+		return nil, errors.New("Scheme manager index must not contain the development scheme sentinel file")
+	}
 
 	return index, conf.checkUnsignedFiles(name, index)
 }
 
 func (conf *Configuration) checkUnsignedFiles(name string, index SchemeManagerIndex) error {
-	return filepath.Walk(filepath.Join(conf.Path, name), func(path string, info os.FileInfo, err error) error {
+	// In overlay mode storage need not contain the scheme; files in the assets that are not
+	// listed in the index are ignored anyway
+	dir := filepath.Join(conf.Path, name)
+	if exists, err := fs.PathExists(dir); err != nil || !exists {
+		return err
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		relpath, err := relativePath(conf.Path, path)
 		if err != nil {
 			return err
@@ -1036,12 +1533,19 @@ var sigExceptions = []*regexp.Regexp{
 	regexp.MustCompile(`^.*?/AUTHORS$`),
 	regexp.MustCompile(`^.*?/LICENSE$`),
 	regexp.MustCompile(`^.*?/README\.md$`),
+	regexp.MustCompile(`^[^/]+/development$`),
 	regexp.MustCompile(`^.*?/.*?/PrivateKeys$`),
 	regexp.MustCompile(`^.*?/.*?/PrivateKeys/\d+.xml$`),
 	regexp.MustCompile(`\.DS_Store$`),
 }
 
+// VerifySchemeManager verifies the signature on the index of the specified scheme manager,
+// and the hashes of all files of the scheme that are listed in the index. If a file fails to
+// verify, a *SchemeManagerError identifying the file is returned.
 func (conf *Configuration) VerifySchemeManager(manager *SchemeManager) error {
+	if conf.IsUnsignedScheme(manager.Identifier()) {
+		return nil
+	}
 	err := conf.VerifySignature(manager.Identifier())
 	if err != nil {
 		return err
@@ -1049,7 +1553,7 @@ func (conf *Configuration) VerifySchemeManager(manager *SchemeManager) error {
 
 	var exists bool
 	for file := range manager.index {
-		exists, err = fs.PathExists(filepath.Join(conf.Path, file))
+		exists, err = fs.PathExists(conf.resolve(filepath.Join(conf.Path, file)))
 		if err != nil {
 			return err
 		}
@@ -1058,7 +1562,12 @@ func (conf *Configuration) VerifySchemeManager(manager *SchemeManager) error {
 		}
 		// Don't care about the actual bytes
 		if _, _, err = conf.ReadAuthenticatedFile(manager, file); err != nil {
-			return err
+			return &SchemeManagerError{
+				Manager: manager.Identifier(),
+				Status:  SchemeManagerStatusInvalidSignature,
+				File:    file,
+				Err:     err,
+			}
 		}
 	}
 
@@ -1068,13 +1577,22 @@ func (conf *Configuration) VerifySchemeManager(manager *SchemeManager) error {
 // ReadAuthenticatedFile reads the file at the specified path
 // and verifies its authenticity by checking that the file hash
 // is present in the (signed) scheme manager index file.
+// Files of unsigned schemes (see SetUnsignedSchemes()) are read without verification.
 func (conf *Configuration) ReadAuthenticatedFile(manager *SchemeManager, path string) ([]byte, bool, error) {
+	if conf.IsUnsignedScheme(manager.Identifier()) {
+		bts, err := ioutil.ReadFile(conf.resolve(filepath.Join(conf.Path, path)))
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return bts, true, err
+	}
+
 	signedHash, ok := manager.index[filepath.ToSlash(path)]
 	if !ok {
 		return nil, false, nil
 	}
 
-	bts, err := ioutil.ReadFile(filepath.Join(conf.Path, path))
+	bts, err := ioutil.ReadFile(conf.resolve(filepath.Join(conf.Path, path)))
 	if err != nil {
 		return nil, true, err
 	}
@@ -1089,7 +1607,15 @@ func (conf *Configuration) ReadAuthenticatedFile(manager *SchemeManager, path st
 // VerifySignature verifies the signature on the scheme manager index file
 // (which contains the SHA256 hashes of all files under this scheme manager,
 // which are used for verifying file authenticity).
-func (conf *Configuration) VerifySignature(id SchemeManagerIdentifier) (err error) {
+// Unsigned schemes (see SetUnsignedSchemes()) are not verified.
+func (conf *Configuration) VerifySignature(id SchemeManagerIdentifier) error {
+	if conf.IsUnsignedScheme(id) {
+		return nil
+	}
+	return conf.verifySignature(id)
+}
+
+func (conf *Configuration) verifySignature(id SchemeManagerIdentifier) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			if e, ok := r.(error); ok {
@@ -1101,42 +1627,146 @@ func (conf *Configuration) VerifySignature(id SchemeManagerIdentifier) (err erro
 	}()
 
 	dir := filepath.Join(conf.Path, id.String())
-	if err := fs.AssertPathExists(dir+"/index", dir+"/index.sig", dir+"/pk.pem"); err != nil {
+	indexpath, sigpath, pkpath := conf.resolve(dir+"/index"), conf.resolve(dir+"/index.sig"), conf.resolve(dir+"/pk.pem")
+	if err := fs.AssertPathExists(indexpath, sigpath, pkpath); err != nil {
 		return errors.New("Missing scheme manager index file, signature, or public key")
 	}
 
 	// Read and hash index file
-	indexbts, err := ioutil.ReadFile(dir + "/index")
+	indexbts, err := ioutil.ReadFile(indexpath)
 	if err != nil {
 		return err
 	}
-	indexhash := sha256.Sum256(indexbts)
 
 	// Read and parse scheme manager public key
-	pkbts, err := ioutil.ReadFile(dir + "/pk.pem")
+	pk, err := conf.schemePublicKey(id)
 	if err != nil {
 		return err
 	}
-	pk, err := ParsePemEcdsaPublicKey(pkbts)
+
+	// Read and verify signature
+	sig, err := ioutil.ReadFile(sigpath)
 	if err != nil {
 		return err
 	}
+	return verifyIndexSignature(pk, indexbts, sig)
+}
 
-	// Read and parse signature
-	sig, err := ioutil.ReadFile(dir + "/index.sig")
+// schemePublicKey reads and parses the public key of the specified scheme manager from storage,
+// checking it against its known public key if any.
+func (conf *Configuration) schemePublicKey(id SchemeManagerIdentifier) (*ecdsa.PublicKey, error) {
+	pkpath := conf.resolve(filepath.Join(conf.Path, id.String()) + "/pk.pem")
+	pkbts, err := ioutil.ReadFile(pkpath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ints := make([]*gobig.Int, 0, 2)
-	_, err = asn1.Unmarshal(sig, &ints)
+	if known, err := conf.knownPublicKey(id); err != nil {
+		return nil, err
+	} else if known != nil && !bytes.Equal(known, pkbts) {
+		return nil, errors.Errorf("Public key of scheme manager %s differs from its known public key", id)
+	}
+	return ParsePemEcdsaPublicKey(pkbts)
+}
 
-	// Verify signature
+// verifyIndexSignature verifies the signature over the specified scheme manager index.
+func verifyIndexSignature(pk *ecdsa.PublicKey, index, sig []byte) error {
+	indexhash := sha256.Sum256(index)
+	ints := make([]*gobig.Int, 0, 2)
+	if _, err := asn1.Unmarshal(sig, &ints); err != nil || len(ints) != 2 {
+		return errors.New("Scheme manager signature was invalid")
+	}
 	if !ecdsa.Verify(pk, indexhash[:], ints[0], ints[1]) {
 		return errors.New("Scheme manager signature was invalid")
 	}
 	return nil
 }
 
+// SchemeUpdateAnnouncementMaxAge is the maximum age of scheme update announcements, after which
+// they are refused so that they can't be replayed indefinitely.
+const SchemeUpdateAnnouncementMaxAge = 10 * time.Minute
+
+// SchemeUpdateAnnouncement announces that a new version of a scheme manager has been published
+// at its remote, so that receivers can update it immediately instead of at their next update.
+type SchemeUpdateAnnouncement struct {
+	Scheme    SchemeManagerIdentifier `json:"scheme"`
+	Timestamp Timestamp               `json:"timestamp"`
+}
+
+// SignedSchemeUpdateAnnouncement contains a JSON-encoded SchemeUpdateAnnouncement and its signature,
+// made with the private key of the announced scheme manager in the same way as its index.
+type SignedSchemeUpdateAnnouncement struct {
+	Announcement []byte `json:"announcement"`
+	Signature    []byte `json:"signature"`
+}
+
+// SignSchemeUpdateAnnouncement signs the specified announcement using the private key of its scheme manager.
+func SignSchemeUpdateAnnouncement(sk *ecdsa.PrivateKey, announcement *SchemeUpdateAnnouncement) (*SignedSchemeUpdateAnnouncement, error) {
+	bts, err := json.Marshal(announcement)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(bts)
+	r, s, err := ecdsa.Sign(rand.Reader, sk, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	sig, err := asn1.Marshal([]*gobig.Int{r, s})
+	if err != nil {
+		return nil, err
+	}
+	return &SignedSchemeUpdateAnnouncement{Announcement: bts, Signature: sig}, nil
+}
+
+// VerifySchemeUpdateAnnouncement verifies the signature of the announcement against the public key
+// of the announced scheme manager, which must be a signed scheme manager having a remote, and checks
+// that the announcement is not older than SchemeUpdateAnnouncementMaxAge, returning the announcement.
+// As announcements can be replayed within that time, receivers should also refuse announcements
+// that are not newer than the last one they accepted of the same scheme manager.
+func (conf *Configuration) VerifySchemeUpdateAnnouncement(signed *SignedSchemeUpdateAnnouncement) (*SchemeUpdateAnnouncement, error) {
+	var announcement SchemeUpdateAnnouncement
+	if err := json.Unmarshal(signed.Announcement, &announcement); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse scheme update announcement", 0)
+	}
+	id := announcement.Scheme
+	manager, ok := conf.SchemeManagers[id]
+	if !ok {
+		return nil, errors.Errorf("unknown scheme manager %s", id)
+	}
+	if conf.IsUnsignedScheme(id) || manager.URL == "" {
+		return nil, errors.Errorf("scheme manager %s cannot be updated", id)
+	}
+	pk, err := conf.schemePublicKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyIndexSignature(pk, signed.Announcement, signed.Signature); err != nil {
+		return nil, err
+	}
+	age := time.Since(time.Time(announcement.Timestamp))
+	if age > SchemeUpdateAnnouncementMaxAge || age < -SchemeUpdateAnnouncementMaxAge {
+		return nil, errors.Errorf("scheme update announcement of %s is expired or not yet valid", id)
+	}
+	return &announcement, nil
+}
+
+func readIfExists(path string) ([]byte, error) {
+	exists, err := fs.PathExists(path)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// knownPublicKey returns the public key of the specified scheme manager that is bundled in the
+// assets, if any, against which the public key in storage must be verified.
+func (conf *Configuration) knownPublicKey(id SchemeManagerIdentifier) ([]byte, error) {
+	assets := conf.assetsFolder(id.String())
+	if assets == "" {
+		return nil, nil
+	}
+	return readIfExists(filepath.Join(assets, id.String(), "pk.pem"))
+}
+
 func ParsePemEcdsaPublicKey(pkbts []byte) (*ecdsa.PublicKey, error) {
 	pkblk, _ := pem.Decode(pkbts)
 	genericPk, err := x509.ParsePKIXPublicKey(pkblk.Bytes)
@@ -1161,7 +1791,7 @@ func (hash ConfigurationFileHash) Equal(other ConfigurationFileHash) bool {
 // UpdateSchemeManager syncs the stored version within the irma_configuration directory
 // with the remote version at the scheme manager's URL, downloading and storing
 // new and modified files, according to the index files of both versions.
-// It stores the identifiers of new or updated credential types or issuers in the second parameter.
+// It stores the identifiers of new or updated credential types, issuers or public keys in the second parameter.
 // Note: any newly downloaded files are not yet parsed and inserted into conf.
 func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downloaded *IrmaIdentifierSet) (err error) {
 	if conf.readOnly {
@@ -1173,7 +1803,7 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 	}
 
 	// Check remote timestamp and see if we have to do anything
-	transport := NewHTTPTransport(manager.URL + "/")
+	transport := conf.newHTTPTransport(manager.URL + "/")
 	timestampBts, err := transport.GetBytes("timestamp")
 	if err != nil {
 		return err
@@ -1199,15 +1829,12 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 		return
 	}
 
-	issPattern := regexp.MustCompile("(.+)/(.+)/description\\.xml")
-	credPattern := regexp.MustCompile("(.+)/(.+)/Issues/(.+)/description\\.xml")
-
 	// TODO: how to recover/fix local copy if err != nil below?
 	for filename, newHash := range newIndex {
 		path := filepath.Join(conf.Path, filename)
 		oldHash, known := manager.index[filename]
 		var have bool
-		have, err = fs.PathExists(path)
+		have, err = fs.PathExists(conf.resolve(path))
 		if err != nil {
 			return err
 		}
@@ -1224,42 +1851,467 @@ func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downl
 			return
 		}
 		// See if the file is a credential type or issuer, and add it to the downloaded set if so
-		if downloaded == nil {
+		if downloaded != nil {
+			addSchemeFile(downloaded, filename)
+		}
+	}
+
+	manager.index = newIndex
+	return
+}
+
+var (
+	issPattern  = regexp.MustCompile("^([^/]+)/([^/]+)/description\\.xml$")
+	credPattern = regexp.MustCompile("^([^/]+)/([^/]+)/Issues/([^/]+)/description\\.xml$")
+	keyPattern  = regexp.MustCompile("^([^/]+)/([^/]+)/PublicKeys/(\\d+)\\.xml$")
+)
+
+// addSchemeFile adds the issuer, credential type or public key that the specified file
+// (relative to the irma_configuration folder) describes, if any, to the set.
+func addSchemeFile(set *IrmaIdentifierSet, filename string) {
+	filename = filepath.ToSlash(filename)
+	if matches := issPattern.FindStringSubmatch(filename); len(matches) == 3 {
+		issid := NewIssuerIdentifier(fmt.Sprintf("%s.%s", matches[1], matches[2]))
+		set.Issuers[issid] = struct{}{}
+	}
+	if matches := credPattern.FindStringSubmatch(filename); len(matches) == 4 {
+		credid := NewCredentialTypeIdentifier(fmt.Sprintf("%s.%s.%s", matches[1], matches[2], matches[3]))
+		set.CredentialTypes[credid] = struct{}{}
+	}
+	if matches := keyPattern.FindStringSubmatch(filename); len(matches) == 4 {
+		issid := NewIssuerIdentifier(fmt.Sprintf("%s.%s", matches[1], matches[2]))
+		counter, _ := strconv.Atoi(matches[3]) // regexp guarantees this is a number
+		if set.PublicKeys == nil {
+			set.PublicKeys = map[IssuerIdentifier][]int{}
+		}
+		set.PublicKeys[issid] = append(set.PublicKeys[issid], counter)
+	}
+}
+
+// SchemeManagerDiff lists the files of a scheme manager that were added, modified or removed
+// by an update, relative to the irma_configuration folder.
+type SchemeManagerDiff struct {
+	Added    []string
+	Modified []string
+	Removed  []string
+}
+
+// SchemesDiff describes the changes made by Configuration.UpdateSchemes().
+type SchemesDiff struct {
+	// Schemes contains the changed files of each scheme manager that was updated.
+	Schemes map[SchemeManagerIdentifier]*SchemeManagerDiff
+	// Changed contains the updated scheme managers, and the issuers, credential types
+	// and public keys that were added or modified.
+	Changed *IrmaIdentifierSet
+	// Configuration describes how the parsed configuration changed, comparing the state before
+	// the update with that after it. Nil if no scheme manager was updated or parsing failed.
+	Configuration *ConfigurationDiff
+}
+
+// Empty returns true if no scheme manager was updated.
+func (diff *SchemesDiff) Empty() bool {
+	return len(diff.Schemes) == 0
+}
+
+// indexValidators contains the ETag and Last-Modified headers with which the remote of a
+// scheme manager last served its index.
+type indexValidators struct {
+	etag, modified string
+}
+
+// UpdateSchemes updates all scheme managers from their remotes, returning what changed.
+// Unsigned schemes (see SetUnsignedSchemes()) are skipped.
+//
+// The index of each scheme manager is requested conditionally on the previous response of its
+// remote, and only the files that are new or modified according to the new index are downloaded.
+// The new version of the scheme is assembled and verified in a staging folder, after which it
+// replaces the stored scheme folder by renaming, so that a failure halfway leaves the stored scheme
+// intact. A stored scheme is only replaced by a version having a newer timestamp; updates to a
+// version older than the newest one installed are refused with an error (see SetAllowRollback()).
+// Finally the irma_configuration folder is parsed into fresh maps which replace those of
+// conf only if parsing succeeded, so that users of the previously parsed scheme managers, issuers
+// and credential types are unaffected. If an error occurs, the returned diff describes the scheme
+// managers that were updated before it occurred.
+//
+// As UpdateSchemes() modifies conf, it must not be used concurrently with other uses of conf.
+// In that case use UpdateSchemesSnapshot() instead.
+func (conf *Configuration) UpdateSchemes() (*SchemesDiff, error) {
+	fresh, diff, err := conf.UpdateSchemesSnapshot()
+	if fresh != nil {
+		conf.replace(fresh)
+	}
+	return diff, err
+}
+
+// UpdateSchemesSnapshot updates all scheme managers from their remotes like UpdateSchemes(), but
+// instead of modifying conf, it returns a new Configuration parsed from the updated
+// irma_configuration folder, or nil if no scheme manager changed or parsing failed. Thus conf
+// remains an immutable snapshot of the schemes that can safely be used by other goroutines during
+// the update, which can switch to the returned snapshot once it is available.
+// Subsequent updates should be performed on the returned snapshot.
+func (conf *Configuration) UpdateSchemesSnapshot() (*Configuration, *SchemesDiff, error) {
+	return conf.updateSchemesSnapshot(func(SchemeManagerIdentifier) bool { return true })
+}
+
+// UpdateSchemeSnapshot updates only the specified scheme manager from its remote, returning a new
+// Configuration like UpdateSchemesSnapshot().
+func (conf *Configuration) UpdateSchemeSnapshot(id SchemeManagerIdentifier) (*Configuration, *SchemesDiff, error) {
+	if _, ok := conf.SchemeManagers[id]; !ok {
+		return nil, nil, errors.Errorf("unknown scheme manager %s", id)
+	}
+	return conf.updateSchemesSnapshot(func(other SchemeManagerIdentifier) bool { return other == id })
+}
+
+// updateSchemesSnapshot updates the scheme managers for which include returns true into a new
+// Configuration, as described at UpdateSchemesSnapshot().
+func (conf *Configuration) updateSchemesSnapshot(include func(SchemeManagerIdentifier) bool) (*Configuration, *SchemesDiff, error) {
+	if conf.readOnly {
+		return nil, nil, errors.New("cannot update a read-only configuration")
+	}
+	if conf.indexValidators == nil {
+		conf.indexValidators = map[SchemeManagerIdentifier]indexValidators{}
+	}
+
+	diff := &SchemesDiff{
+		Schemes: map[SchemeManagerIdentifier]*SchemeManagerDiff{},
+		Changed: &IrmaIdentifierSet{
+			SchemeManagers:  map[SchemeManagerIdentifier]struct{}{},
+			Issuers:         map[IssuerIdentifier]struct{}{},
+			CredentialTypes: map[CredentialTypeIdentifier]struct{}{},
+			PublicKeys:      map[IssuerIdentifier][]int{},
+		},
+	}
+	var err error
+	for id, manager := range conf.SchemeManagers {
+		if !include(id) || conf.IsUnsignedScheme(id) || manager.URL == "" {
 			continue
 		}
-		var matches []string
-		matches = issPattern.FindStringSubmatch(filename)
-		if len(matches) == 3 {
-			issid := NewIssuerIdentifier(fmt.Sprintf("%s.%s", matches[1], matches[2]))
-			downloaded.Issuers[issid] = struct{}{}
+		var schemediff *SchemeManagerDiff
+		if schemediff, err = conf.updateScheme(manager); err != nil {
+			break
 		}
-		matches = credPattern.FindStringSubmatch(filename)
-		if len(matches) == 4 {
-			credid := NewCredentialTypeIdentifier(fmt.Sprintf("%s.%s.%s", matches[1], matches[2], matches[3]))
-			downloaded.CredentialTypes[credid] = struct{}{}
+		if schemediff == nil {
+			continue
+		}
+		diff.Schemes[id] = schemediff
+		diff.Changed.SchemeManagers[id] = struct{}{}
+		for _, file := range append(schemediff.Added, schemediff.Modified...) {
+			addSchemeFile(diff.Changed, file)
 		}
 	}
 
-	manager.index = newIndex
-	return
+	// Also if an error occurred, parse the schemes that were updated before that
+	var fresh *Configuration
+	if !diff.Empty() {
+		var parseErr error
+		if fresh, parseErr = conf.Reparse(); err == nil {
+			err = parseErr
+		}
+	}
+	if fresh != nil {
+		// Parse the public keys now instead of lazily, so that users of the snapshot don't read
+		// them from storage while later updates modify it
+		fresh.parsePublicKeys()
+		diff.Configuration = conf.Diff(fresh)
+		for _, schemediff := range diff.Schemes {
+			diff.Configuration.addPublicKeys(schemediff.Added)
+		}
+	}
+	return fresh, diff, err
 }
 
-func (conf *Configuration) updateSchemes() error {
-	for id := range conf.SchemeManagers {
-		Logger.WithField("scheme", id).Info("Auto-updating scheme")
-		if err := conf.UpdateSchemeManager(id, nil); err != nil {
+// updateScheme updates the specified scheme manager in storage as described at UpdateSchemes(),
+// returning nil if its remote did not change.
+func (conf *Configuration) updateScheme(manager *SchemeManager) (*SchemeManagerDiff, error) {
+	id := manager.Identifier()
+	transport := conf.newHTTPTransport(manager.URL + "/")
+	validators := conf.indexValidators[id]
+	indexbts, header, err := transport.GetBytesIfModified("index", validators.etag, validators.modified)
+	if err != nil {
+		return nil, err
+	}
+	if indexbts == nil {
+		return nil, nil // Not modified
+	}
+	validators = indexValidators{etag: header.Get("ETag"), modified: header.Get("Last-Modified")}
+
+	dir := filepath.Join(conf.Path, manager.ID)
+	current, err := readIfExists(conf.resolve(filepath.Join(dir, "index")))
+	if err != nil {
+		return nil, err
+	}
+	if manager.Valid && bytes.Equal(current, indexbts) {
+		conf.indexValidators[id] = validators
+		return nil, nil
+	}
+
+	// Assemble the new version in a staging folder within our own folder, so that it can be
+	// moved into place by renaming. Hidden folders are ignored when parsing.
+	tmp, err := ioutil.TempDir(conf.Path, ".update-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	staged := filepath.Join(tmp, manager.ID)
+	exists, err := fs.PathExists(dir) // in overlay mode storage need not contain the scheme
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if err = fs.CopyDirectory(dir, staged); err != nil {
+			return nil, err
+		}
+	}
+	diff, err := conf.stageScheme(manager, transport, indexbts, staged)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the signature over the new index and the hashes of all files by parsing the staged scheme
+	stagedManager := NewSchemeManager(manager.ID)
+	if err = conf.copyConfiguration(tmp).ParseSchemeManagerFolder(staged, stagedManager); err != nil {
+		return nil, err
+	}
+	// Never replace our version by an older one (see rollback.go) or by the same version
+	installed, err := conf.installedTimestamp(manager)
+	if err != nil {
+		return nil, err
+	}
+	older := installed != nil && stagedManager.Timestamp.Before(*installed)
+	if older && !conf.allowRollback {
+		return nil, errors.Errorf("Refusing to roll back scheme manager %s from version of %s to older version of %s",
+			manager.ID, time.Time(*installed).String(), time.Time(stagedManager.Timestamp).String())
+	}
+	if manager.Valid && !older && !manager.Timestamp.Before(stagedManager.Timestamp) {
+		conf.indexValidators[id] = validators
+		return nil, nil
+	}
+
+	if err = replaceSchemeFolder(staged, dir); err != nil {
+		return nil, err
+	}
+	if err = conf.recordTimestamp(stagedManager); err != nil {
+		return nil, err
+	}
+	conf.indexValidators[id] = validators
+	return diff, nil
+}
+
+// replaceSchemeFolder moves the staged scheme folder to dir by renaming, moving the existing
+// folder at dir, if any, out of the way to its old folder (see oldSchemeFolder()) in between.
+// If we crash between the two renames, restoreSchemeFolder() moves the old folder back.
+func replaceSchemeFolder(staged, dir string) error {
+	if err := restoreSchemeFolder(dir); err != nil {
+		return err
+	}
+	exists, err := fs.PathExists(dir)
+	if err != nil {
+		return err
+	}
+	old := oldSchemeFolder(dir)
+	if exists {
+		if err = os.Rename(dir, old); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(staged, dir); err != nil {
+		if exists {
+			_ = os.Rename(old, dir)
+		}
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// oldSchemeFolder returns the hidden folder next to the specified scheme folder to which
+// replaceSchemeFolder() moves it while replacing it.
+func oldSchemeFolder(dir string) string {
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".old")
+}
+
+// restoreSchemeFolder finishes a replacement of the specified scheme folder by
+// replaceSchemeFolder() that was interrupted: if the scheme folder is missing its old folder
+// is moved back, and otherwise the old folder, being superseded, is removed.
+func restoreSchemeFolder(dir string) error {
+	old := oldSchemeFolder(dir)
+	oldExists, err := fs.PathExists(old)
+	if err != nil || !oldExists {
+		return err
+	}
+	exists, err := fs.PathExists(dir)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.RemoveAll(old)
+	}
+	Logger.Warnf("Restoring scheme folder %s after interrupted update", dir)
+	return os.Rename(old, dir)
+}
+
+// restoreSchemeFolders calls restoreSchemeFolder() for the old scheme folders in our path.
+func (conf *Configuration) restoreSchemeFolders() error {
+	olds, err := filepath.Glob(filepath.Join(conf.Path, ".*.old"))
+	if err != nil {
+		return err
+	}
+	for _, old := range olds {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(old), "."), ".old")
+		if err = restoreSchemeFolder(filepath.Join(conf.Path, name)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// stageScheme assembles the version of the specified scheme manager having the specified index
+// in the staged folder, which may contain a copy of the stored version, by downloading the files
+// that are new or modified according to the index.
+func (conf *Configuration) stageScheme(
+	manager *SchemeManager, transport *HTTPTransport, indexbts []byte, staged string,
+) (*SchemeManagerDiff, error) {
+	index := SchemeManagerIndex{}
+	if err := index.FromString(string(indexbts)); err != nil {
+		return nil, err
+	}
+	root := filepath.Dir(staged)
+	if err := fs.EnsureDirectoryExists(staged); err != nil {
+		return nil, err
+	}
+	if err := fs.SaveFile(filepath.Join(staged, "index"), indexbts); err != nil {
+		return nil, err
+	}
+	if err := transport.GetFile("index.sig", filepath.Join(staged, "index.sig")); err != nil {
+		return nil, err
+	}
+
+	diff := &SchemeManagerDiff{}
+	for filename, hash := range index {
+		path := filepath.Join(root, filename)
+		if !strings.HasPrefix(path, staged+string(filepath.Separator)) {
+			return nil, errors.Errorf("Index of scheme manager %s contains file %s outside of the scheme", manager.ID, filename)
+		}
+		oldHash, known := manager.index[filename]
+		have, err := fs.PathExists(path)
+		if err != nil {
+			return nil, err
+		}
+		if assets := conf.assetsFolder(manager.ID); !have && conf.overlay && assets != "" {
+			// Unmodified files from the assets are not copied into storage
+			if have, err = fs.PathExists(filepath.Join(assets, filename)); err != nil {
+				return nil, err
+			}
+		}
+		if known && have && oldHash.Equal(hash) {
+			continue
+		}
+		stripped := filename[len(manager.ID)+1:] // Scheme manager URL already ends with its name
+		if err = transport.GetSignedFile(stripped, path, hash); err != nil {
+			return nil, err
+		}
+		if known {
+			diff.Modified = append(diff.Modified, filename)
+		} else {
+			diff.Added = append(diff.Added, filename)
+		}
+	}
+	for filename := range manager.index {
+		if _, ok := index[filename]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(root, filename)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		diff.Removed = append(diff.Removed, filename)
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Modified)
+	sort.Strings(diff.Removed)
+	return diff, nil
+}
+
+// copyConfiguration returns a new, empty Configuration at the specified path, having the same settings as conf.
+func (conf *Configuration) copyConfiguration(path string) *Configuration {
+	c := &Configuration{
+		Path:            path,
+		assets:          conf.assets,
+		overlay:         conf.overlay,
+		roundTripper:    conf.roundTripper,
+		tlsPins:         conf.tlsPins,
+		timeout:         conf.timeout,
+		retries:         conf.retries,
+		strict:          conf.strict,
+		lenientKeys:     conf.lenientKeys,
+		downloadKeys:    conf.downloadKeys,
+		allowRollback:   conf.allowRollback,
+		indexValidators: conf.indexValidators,
+	}
+	for id := range conf.unsigned {
+		if c.unsigned == nil {
+			c.unsigned = map[SchemeManagerIdentifier]struct{}{}
+		}
+		c.unsigned[id] = struct{}{}
+	}
+	c.clear()
+	return c
+}
+
+// Reparse parses the irma_configuration folder into a new Configuration having the same settings
+// as conf, leaving conf unmodified. It returns nil if parsing failed.
+func (conf *Configuration) Reparse() (*Configuration, error) {
+	fresh := conf.copyConfiguration(conf.Path)
+	if err := fresh.ParseFolder(); err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
+
+// replace replaces the parsed contents of conf by those of the fresh Configuration.
+func (conf *Configuration) replace(fresh *Configuration) {
+	conf.SchemeManagers = fresh.SchemeManagers
+	conf.Issuers = fresh.Issuers
+	conf.CredentialTypes = fresh.CredentialTypes
+	conf.AttributeTypes = fresh.AttributeTypes
+	conf.DisabledSchemeManagers = fresh.DisabledSchemeManagers
+	conf.Errors = fresh.Errors
+	conf.Warnings = fresh.Warnings
+	conf.reverseHashes = fresh.reverseHashes
+	conf.unsigned = fresh.unsigned
+	conf.keysLock.Lock()
+	conf.kssPublicKeys = fresh.kssPublicKeys
+	conf.publicKeys = fresh.publicKeys
+	conf.missingKeys = fresh.missingKeys
+	conf.privateKeys = fresh.privateKeys
+	conf.keysLock.Unlock()
+	conf.initialized = true
+	conf.metadataCache.invalidate()
+}
+
+func (conf *Configuration) updateSchemes() error {
+	Logger.Info("Auto-updating schemes")
+	diff, err := conf.UpdateSchemes()
+	if diff != nil {
+		for id := range diff.Schemes {
+			Logger.WithField("scheme", id).Info("Updated scheme")
+		}
+	}
+	return err
+}
+
 func (conf *Configuration) AutoUpdateSchemes(interval uint) {
+	conf.ScheduleSchemeUpdates(interval, conf.updateSchemes)
+}
+
+// ScheduleSchemeUpdates calls update every interval minutes, starting shortly after this call,
+// logging any error it returns. It can be used instead of AutoUpdateSchemes() to update the schemes
+// in a different way, e.g. using UpdateSchemesSnapshot(). StopAutoUpdateSchemes() stops it.
+func (conf *Configuration) ScheduleSchemeUpdates(interval uint, update func() error) {
 	Logger.Infof("Updating schemes every %d minutes", interval)
 
 	conf.scheduler = gocron.NewScheduler()
 	conf.scheduler.Every(uint64(interval)).Minutes().Do(func() {
-		if err := conf.updateSchemes(); err != nil {
+		if err := update(); err != nil {
 			Logger.Error("Scheme autoupdater failed: ")
 			if e, ok := err.(*errors.Error); ok {
 				Logger.Error(e.ErrorStack())
@@ -1286,12 +2338,28 @@ func (conf *Configuration) StopAutoUpdateSchemes() {
 
 // Methods containing consistency checks on irma_configuration
 
+// identifierPattern matches valid IDs of schemes, issuers, credential types and attributes.
+// As dots separate these in fully qualified identifiers, they may not occur in IDs: otherwise
+// e.g. issuer b.c of scheme a and issuer c of scheme a.b would both be a.b.c. Together with the
+// IDs having to equal their directory names, this makes fully qualified identifiers unique.
+var identifierPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func checkIdentifier(kind, id string) error {
+	if !identifierPattern.MatchString(id) {
+		return errors.Errorf("%s ID %q contains characters other than letters, digits, - and _", kind, id)
+	}
+	return nil
+}
+
 func (conf *Configuration) checkIssuer(manager *SchemeManager, issuer *Issuer, dir string) error {
+	if err := checkIdentifier("Issuer", issuer.ID); err != nil {
+		return err
+	}
 	issuerid := issuer.Identifier()
 	conf.checkTranslations(fmt.Sprintf("Issuer %s", issuerid.String()), issuer)
 	// Check that the issuer has public keys
 	pkpath := fmt.Sprintf(pubkeyPattern, conf.Path, issuerid.SchemeManagerIdentifier().Name(), issuerid.Name())
-	files, err := filepath.Glob(pkpath)
+	files, err := conf.glob(pkpath)
 	if err != nil {
 		return err
 	}
@@ -1305,7 +2373,10 @@ func (conf *Configuration) checkIssuer(manager *SchemeManager, issuer *Issuer, d
 	if manager.ID != issuer.SchemeManagerID {
 		return errors.Errorf("Issuer %s has wrong SchemeManager %s", issuerid.String(), issuer.SchemeManagerID)
 	}
-	if err = fs.AssertPathExists(dir + "/logo.png"); err != nil {
+	if issuer.LogoPath, err = conf.logoPath(dir); err != nil {
+		return err
+	}
+	if issuer.LogoPath == "" {
 		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Issuer %s has no logo.png", issuerid.String()))
 	}
 	return nil
@@ -1317,6 +2388,9 @@ func (conf *Configuration) checkCredentialType(manager *SchemeManager, issuer *I
 	if cred.XMLVersion < 4 {
 		return errors.New("Unsupported credential type description")
 	}
+	if err := checkIdentifier("Credential type", cred.ID); err != nil {
+		return err
+	}
 	if cred.ID != filepath.Base(dir) {
 		return errors.Errorf("Credential type %s has wrong directory name %s", credid.String(), filepath.Base(dir))
 	}
@@ -1326,20 +2400,46 @@ func (conf *Configuration) checkCredentialType(manager *SchemeManager, issuer *I
 	if cred.SchemeManagerID != manager.ID {
 		return errors.Errorf("Credential type %s has wrong SchemeManager %s", credid.String(), cred.SchemeManagerID)
 	}
-	if err := fs.AssertPathExists(dir + "/logo.png"); err != nil {
+	var err error
+	if cred.LogoPath, err = conf.logoPath(dir); err != nil {
+		return err
+	}
+	if cred.LogoPath == "" {
 		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has no logo.png", credid.String()))
 	}
 	return conf.checkAttributes(cred)
 }
 
+// logoPath returns the absolute path to the logo.png in the specified issuer or credential type
+// folder, or an empty string if it does not exist.
+func (conf *Configuration) logoPath(dir string) (string, error) {
+	path, err := filepath.Abs(conf.resolve(filepath.Join(dir, "logo.png")))
+	if err != nil {
+		return "", err
+	}
+	exists, err := fs.PathExists(path)
+	if err != nil || !exists {
+		return "", err
+	}
+	return path, nil
+}
+
 func (conf *Configuration) checkAttributes(cred *CredentialType) error {
 	name := cred.Identifier().String()
 	indices := make(map[int]struct{})
+	ids := make(map[string]struct{})
 	count := len(cred.AttributeTypes)
 	if count == 0 {
 		return errors.Errorf("Credenial type %s has no attributes", name)
 	}
 	for i, attr := range cred.AttributeTypes {
+		if err := checkIdentifier("Attribute", attr.ID); err != nil {
+			return errors.Errorf("Credential type %s: %s", name, err.Error())
+		}
+		if _, ok := ids[attr.ID]; ok {
+			return errors.Errorf("Credential type %s contains attribute %s more than once", name, attr.ID)
+		}
+		ids[attr.ID] = struct{}{}
 		conf.checkTranslations(fmt.Sprintf("Attribute %s of credential type %s", attr.ID, cred.Identifier().String()), attr)
 		index := i
 		if attr.DisplayIndex != nil {
@@ -1353,6 +2453,48 @@ func (conf *Configuration) checkAttributes(cred *CredentialType) error {
 	if len(indices) != count {
 		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has invalid attribute ordering, check the displayIndex tags", name))
 	}
+	for _, attr := range cred.AttributeTypes {
+		if err := checkDerivation(cred, attr); err != nil {
+			return errors.Errorf("Credential type %s: attribute %s: %s", name, attr.ID, err.Error())
+		}
+	}
+	return nil
+}
+
+func checkDerivation(cred *CredentialType, attr *AttributeType) error {
+	d := attr.Derivation
+	if d == nil {
+		return nil
+	}
+	if d.Source == attr.ID {
+		return errors.New("derived from itself")
+	}
+	var source *AttributeType
+	for _, a := range cred.AttributeTypes {
+		if a.ID == d.Source {
+			source = a
+		}
+	}
+	if source == nil {
+		return errors.Errorf("derived from nonexisting attribute %s", d.Source)
+	}
+	if source.IsDerived() {
+		return errors.Errorf("derived from derived attribute %s", d.Source)
+	}
+	switch d.Operation {
+	case AttributeDerivationAgeThreshold:
+		if source.ValueType() != AttributeValueTypeDate {
+			return errors.Errorf("age threshold derived from attribute %s which is not of type date", d.Source)
+		}
+		if d.Threshold <= 0 {
+			return errors.Errorf("invalid age threshold %d", d.Threshold)
+		}
+	default:
+		return errors.Errorf("unknown derivation operation %s", d.Operation)
+	}
+	if d.TrueValue() == d.FalseValue() {
+		return errors.New("derivation has equal true and false values")
+	}
 	return nil
 }
 
@@ -1361,12 +2503,16 @@ func (conf *Configuration) checkScheme(scheme *SchemeManager, dir string) error
 		scheme.Status = SchemeManagerStatusParsingError
 		return errors.New("Unsupported scheme manager description")
 	}
+	if err := checkIdentifier("Scheme", scheme.ID); err != nil {
+		scheme.Status = SchemeManagerStatusParsingError
+		return err
+	}
 	if filepath.Base(dir) != scheme.ID {
 		scheme.Status = SchemeManagerStatusParsingError
 		return errors.Errorf("Scheme %s has wrong directory name %s", scheme.ID, filepath.Base(dir))
 	}
 	if scheme.KeyshareServer != "" {
-		if err := fs.AssertPathExists(filepath.Join(dir, "kss-0.pem")); err != nil {
+		if err := fs.AssertPathExists(conf.resolve(filepath.Join(dir, "kss-0.pem"))); err != nil {
 			scheme.Status = SchemeManagerStatusParsingError
 			return errors.Errorf("Scheme %s has keyshare URL but no keyshare public key kss-0.pem", scheme.ID)
 		}
@@ -1377,6 +2523,10 @@ func (conf *Configuration) checkScheme(scheme *SchemeManager, dir string) error
 
 // checkTranslations checks for each member of the interface o that is of type TranslatedString
 // that it contains all necessary translations.
+// optionalTranslations contains the names of the TranslatedString fields of descriptions
+// that may be absent, so that checkTranslations() only checks them if present.
+var optionalTranslations = map[string]bool{"Category": true}
+
 func (conf *Configuration) checkTranslations(file string, o interface{}) {
 	langs := []string{"en", "nl"} // Hardcode these for now, TODO make configurable
 	v := reflect.ValueOf(o)
@@ -1389,6 +2539,9 @@ func (conf *Configuration) checkTranslations(file string, o interface{}) {
 	for i := 0; i < v.NumField(); i++ {
 		if v.Field(i).Type() == reflect.TypeOf(TranslatedString{}) {
 			val := v.Field(i).Interface().(TranslatedString)
+			if val == nil && optionalTranslations[v.Type().Field(i).Name] {
+				continue
+			}
 			for _, lang := range langs {
 				if _, exists := val[lang]; !exists {
 					conf.Warnings = append(conf.Warnings, fmt.Sprintf("%s misses %s translation in <%s> tag", file, lang, v.Type().Field(i).Name))
@@ -1402,7 +2555,10 @@ func (conf *Configuration) CheckKeys() error {
 	const expiryBoundary = int64(time.Hour/time.Second) * 24 * 31 // 1 month, TODO make configurable
 
 	for issuerid := range conf.Issuers {
-		if err := conf.parseKeysFolder(issuerid); err != nil {
+		conf.keysLock.Lock()
+		err := conf.parseKeysFolder(issuerid)
+		conf.keysLock.Unlock()
+		if err != nil {
 			return err
 		}
 		indices, err := conf.PublicKeyIndices(issuerid)
@@ -1427,7 +2583,7 @@ func (conf *Configuration) CheckKeys() error {
 
 		// Check private keys if any
 		privkeypath := fmt.Sprintf(privkeyPattern, conf.Path, issuerid.SchemeManagerIdentifier().Name(), issuerid.Name())
-		privkeys, err := filepath.Glob(privkeypath)
+		privkeys, err := conf.glob(privkeypath)
 		if err != nil {
 			return err
 		}
@@ -1437,7 +2593,7 @@ func (conf *Configuration) CheckKeys() error {
 			if err != nil {
 				return err
 			}
-			sk, err := gabi.NewPrivateKeyFromFile(privkey)
+			sk, err := gabi.NewPrivateKeyFromFile(conf.resolve(privkey))
 			if err != nil {
 				return err
 			}
@@ -1,11 +1,41 @@
 package irma
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	gobig "math/big"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 
 	"github.com/privacybydesign/irmago/internal/fs"
@@ -62,6 +92,283 @@ func TestParseInvalidIrmaConfiguration(t *testing.T) {
 	require.Equal(t, false, conf.SchemeManagers[smerr.Manager].Valid)
 }
 
+// tamperedConfiguration returns a copy of the test configuration in which an attribute description
+// of the irma-demo scheme has been modified without updating the scheme index.
+func tamperedConfiguration(t *testing.T) (string, string) {
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	file := "irma-demo/RU/Issues/studentCard/description.xml"
+	bts, err := ioutil.ReadFile(filepath.Join(path, file))
+	require.NoError(t, err)
+	bts = bytes.Replace(bts, []byte("Student Card"), []byte("Stolen Card"), 1)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(path, file), bts, 0600))
+	return path, file
+}
+
+func TestParseTamperedIrmaConfiguration(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+	path, file := tamperedConfiguration(t)
+
+	conf, err := NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	err = conf.ParseFolder()
+	require.Error(t, err)
+	smerr, ok := err.(*SchemeManagerError)
+	require.True(t, ok)
+	require.Equal(t, NewSchemeManagerIdentifier("irma-demo"), smerr.Manager)
+	require.Equal(t, file, smerr.File)
+	require.Equal(t, SchemeManagerStatusInvalidSignature, smerr.Status)
+	require.False(t, conf.SchemeManagers[smerr.Manager].Valid)
+
+	// The other scheme is unaffected
+	require.True(t, conf.SchemeManagers[NewSchemeManagerIdentifier("test")].Valid)
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("test.test.mijnirma"))
+	require.NotContains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+
+	// Explicitly trusted unsigned schemes are parsed without verification
+	conf.SetUnsignedSchemes([]SchemeManagerIdentifier{smerr.Manager})
+	require.NoError(t, conf.ParseFolder())
+	credtype := conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")]
+	require.NotNil(t, credtype)
+	require.Equal(t, "Stolen Card", credtype.Name["en"])
+}
+
+func TestParseDevelopmentScheme(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+	path, _ := tamperedConfiguration(t)
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+
+	// The sentinel file marks the tampered scheme as an unverified development scheme
+	require.NoError(t, ioutil.WriteFile(filepath.Join(path, "irma-demo", DevelopmentSchemeFile), nil, 0600))
+	conf, err := NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.True(t, conf.SchemeManagers[schemeid].Development)
+	require.False(t, conf.SchemeManagers[NewSchemeManagerIdentifier("test")].Development)
+	require.Equal(t, "Stolen Card", conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")].Name["en"])
+
+	set := &IrmaIdentifierSet{SchemeManagers: map[SchemeManagerIdentifier]struct{}{schemeid: {}}}
+	require.True(t, set.Development(conf))
+	set.SchemeManagers = map[SchemeManagerIdentifier]struct{}{NewSchemeManagerIdentifier("test"): {}}
+	require.False(t, set.Development(conf))
+}
+
+func TestParseBrokenCredentialType(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Break the XML of one credential type of an (unsigned, so that its hash is not checked) scheme
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	file := "irma-demo/MijnOverheid/Issues/fullName/description.xml"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(path, file), []byte("<IssueSpecification version=\"4\">"), 0600))
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+
+	// Only the broken credential type is skipped
+	conf, err := NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	conf.SetUnsignedSchemes([]SchemeManagerIdentifier{schemeid})
+	require.NoError(t, conf.ParseFolder())
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.NotContains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"))
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"))
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	require.Contains(t, conf.Issuers, NewIssuerIdentifier("irma-demo.MijnOverheid"))
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("test.test.mijnirma"))
+	require.Len(t, conf.Errors, 1)
+	require.Equal(t, file, conf.Errors[0].File)
+	report := conf.Report()
+	require.Len(t, report.Errors, 1)
+	require.Contains(t, report.Errors[0], file)
+
+	// In strict mode the scheme is disabled
+	conf.SetStrict(true)
+	err = conf.ParseFolder()
+	require.Error(t, err)
+	smerr, ok := err.(*SchemeManagerError)
+	require.True(t, ok)
+	require.Equal(t, file, smerr.File)
+	require.Equal(t, SchemeManagerStatusContentParsingError, smerr.Status)
+	require.False(t, conf.SchemeManagers[schemeid].Valid)
+	require.Contains(t, conf.DisabledSchemeManagers, schemeid)
+	require.Empty(t, conf.Errors)
+	require.True(t, conf.SchemeManagers[NewSchemeManagerIdentifier("test")].Valid)
+}
+
+func TestParseMismatchingPublicKeys(t *testing.T) {
+	// In this (development) scheme, PublicKeys/1.xml contains key 0,
+	// and the <Z> of PublicKeys/2.xml exceeds its modulus
+	path := filepath.Join("testdata", "irma_configuration_keys")
+	issuerid := NewIssuerIdentifier("irma-demo.RU")
+	conf, err := NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	_, err = conf.PublicKey(issuerid, 0)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "irma-demo/RU/PublicKeys/1.xml of issuer irma-demo.RU has <Counter> 0 instead of 1")
+	require.Error(t, conf.CheckKeys())
+
+	// Lenient mode accepts them with a warning
+	conf, err = NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	conf.SetLenientKeys(true)
+	require.NoError(t, conf.ParseFolder())
+	pk, err := conf.PublicKey(issuerid, 2)
+	require.NoError(t, err)
+	require.NotNil(t, pk)
+	require.Contains(t, conf.Warnings, "Public key irma-demo/RU/PublicKeys/1.xml of issuer irma-demo.RU has <Counter> 0 instead of 1")
+	require.Contains(t, conf.Warnings, "Public key irma-demo/RU/PublicKeys/2.xml of issuer irma-demo.RU has <Z> exceeding the modulus")
+}
+
+func TestParseInvalidIdentifiers(t *testing.T) {
+	// This (development) scheme contains an issuer and a credential type whose IDs contain a dot,
+	// a credential type with an attribute whose ID contains a dot, and one containing an attribute twice
+	path := filepath.Join("testdata", "irma_configuration_identifiers")
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	files := []string{
+		"irma-demo/R.U/description.xml",
+		"irma-demo/RU/Issues/dottedAttribute/description.xml",
+		"irma-demo/RU/Issues/duplicateAttribute/description.xml",
+		"irma-demo/RU/Issues/student.card/description.xml",
+	}
+
+	// Only the offending issuer and credential types are skipped
+	conf, err := NewConfigurationReadOnly(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.Len(t, conf.Issuers, 1)
+	require.Contains(t, conf.Issuers, NewIssuerIdentifier("irma-demo.RU"))
+	require.Len(t, conf.CredentialTypes, 1)
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	require.Len(t, conf.Errors, len(files))
+	for i, file := range files {
+		require.Equal(t, file, conf.Errors[i].File)
+	}
+	require.Contains(t, conf.Errors[2].Error(), "contains attribute studentCardNumber more than once")
+
+	// In strict mode the scheme is disabled
+	conf.SetStrict(true)
+	err = conf.ParseFolder()
+	require.Error(t, err)
+	smerr, ok := err.(*SchemeManagerError)
+	require.True(t, ok)
+	require.Equal(t, files[0], smerr.File)
+	require.False(t, conf.SchemeManagers[schemeid].Valid)
+	require.Contains(t, conf.DisabledSchemeManagers, schemeid)
+}
+
+// Run with -race to check the thread safety of the lazy parsing of keys.
+func TestConcurrentKeyLookups(t *testing.T) {
+	conf := parseConfiguration(t)
+	issuerid := NewIssuerIdentifier("irma-demo.RU")
+	schemeid := NewSchemeManagerIdentifier("test")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 30)
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		counter := i % 3
+		go func() {
+			defer wg.Done()
+			pk, err := conf.PublicKey(issuerid, counter)
+			if err == nil && pk == nil {
+				err = fmt.Errorf("public key %d not found", counter)
+			}
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			sk, err := conf.PrivateKey(issuerid)
+			if err == nil && sk == nil {
+				err = fmt.Errorf("private key not found")
+			}
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := conf.KeyshareServerPublicKey(schemeid, 0)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+// syntheticConfiguration returns a configuration folder containing n unsigned copies
+// of the irma-demo scheme.
+func syntheticConfiguration(b *testing.B, n int) (string, []SchemeManagerIdentifier) {
+	path, err := ioutil.TempDir("", "irma_configuration")
+	require.NoError(b, err)
+	src := filepath.Join("testdata", "irma_configuration", "irma-demo")
+	ids := make([]SchemeManagerIdentifier, 0, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("demo%d", i)
+		dir := filepath.Join(path, name)
+		require.NoError(b, fs.CopyDirectory(src, dir))
+		require.NoError(b, os.Remove(filepath.Join(dir, "index")))
+		require.NoError(b, os.Remove(filepath.Join(dir, "index.sig")))
+		require.NoError(b, filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if err != nil || filepath.Base(file) != "description.xml" {
+				return err
+			}
+			bts, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(file, bytes.Replace(bts, []byte("irma-demo"), []byte(name), -1), 0600)
+		}))
+		ids = append(ids, NewSchemeManagerIdentifier(name))
+	}
+	return path, ids
+}
+
+// BenchmarkParseFolder compares parsing a configuration of many schemes serially,
+// as ParseFolder() used to do, with parsing it concurrently.
+func BenchmarkParseFolder(b *testing.B) {
+	path, ids := syntheticConfiguration(b, 50)
+	defer os.RemoveAll(path)
+
+	for _, workers := range []int{1, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			defer func(w int) { parseWorkers = w }(parseWorkers)
+			parseWorkers = workers
+			for i := 0; i < b.N; i++ {
+				conf, err := NewConfigurationReadOnly(path)
+				require.NoError(b, err)
+				conf.SetUnsignedSchemes(ids)
+				require.NoError(b, conf.ParseFolder())
+				require.Len(b, conf.SchemeManagers, len(ids))
+			}
+		})
+	}
+}
+
+func TestParseIrmaConfigurationUnknownPublicKey(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Replace the public key of the irma-demo scheme in storage by another one
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), path))
+	pk, err := ioutil.ReadFile(filepath.Join(path, "test", "pk.pem"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(path, "irma-demo", "pk.pem"), pk, 0600))
+
+	conf, err := NewConfigurationFromAssets(path, filepath.Join("testdata", "irma_configuration"))
+	require.NoError(t, err)
+	err = conf.ParseFolder()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "known public key")
+	require.Contains(t, conf.DisabledSchemeManagers, NewSchemeManagerIdentifier("irma-demo"))
+}
+
 func TestRetryHTTPRequest(t *testing.T) {
 	test.StartBadHttpServer(3, 1*time.Second, "42")
 	defer test.StopBadHttpServer()
@@ -73,6 +380,97 @@ func TestRetryHTTPRequest(t *testing.T) {
 	require.Equal(t, "42\n", string(bts))
 }
 
+// selfSignedCertificate generates a self-signed certificate with a fresh key.
+func selfSignedCertificate(t *testing.T) *x509.Certificate {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: gobig.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &sk.PublicKey, sk)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestTLSPins(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("42"))
+	}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	serverPin := TLSPin(server.Certificate())
+	otherPin := TLSPin(selfSignedCertificate(t))
+
+	newTransport := func(pins ...string) *HTTPTransport {
+		transport := NewHTTPTransport(server.URL)
+		transport.inner.TLSClientConfig = &tls.Config{RootCAs: roots}
+		transport.SetTLSPins(pins)
+		return transport
+	}
+
+	_, err := newTransport().GetBytes("")
+	require.NoError(t, err)
+	_, err = newTransport(serverPin).GetBytes("")
+	require.NoError(t, err)
+	_, err = newTransport(otherPin, serverPin).GetBytes("") // rotation
+	require.NoError(t, err)
+
+	_, err = newTransport(otherPin).GetBytes("")
+	require.Error(t, err)
+	require.Equal(t, ErrorTLSPinMismatch, err.(*SessionError).ErrorType)
+
+	// Concurrent requests over one transport each report their own outcome
+	mismatching, matching := newTransport(otherPin), newTransport(serverPin)
+	errs := make([]error, 8)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			transport := matching
+			if i%2 == 1 {
+				transport = mismatching
+			}
+			_, errs[i] = transport.GetBytes("")
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if i%2 == 0 {
+			require.NoError(t, err)
+		} else {
+			require.Error(t, err)
+			require.Equal(t, ErrorTLSPinMismatch, err.(*SessionError).ErrorType)
+		}
+	}
+
+	// With a custom RoundTripper, the pins are checked after the request
+	transport := NewHTTPTransport(server.URL)
+	transport.SetRoundTripper(server.Client().Transport)
+	transport.SetTLSPins([]string{otherPin})
+	_, err = transport.GetBytes("")
+	require.Error(t, err)
+	require.Equal(t, ErrorTLSPinMismatch, err.(*SessionError).ErrorType)
+}
+
+func TestConfigurationTLSPins(t *testing.T) {
+	conf := parseConfiguration(t)
+	manager := conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")]
+	manager.TLSPins = []string{"pin1", "pin2"}
+
+	require.Equal(t, []string{"pin1", "pin2"}, conf.TLSPins(manager.URL+"/timestamp"))
+	require.Empty(t, conf.TLSPins("https://example.com/irma"))
+
+	conf.SetTLSPins(map[SchemeManagerIdentifier][]string{manager.Identifier(): {"pin3"}})
+	require.Equal(t, []string{"pin3"}, conf.TLSPins(manager.URL))
+}
+
 func TestInvalidIrmaConfigurationRestoreFromRemote(t *testing.T) {
 	test.StartSchemeManagerHttpServer()
 	defer test.StopSchemeManagerHttpServer()
@@ -103,7 +501,7 @@ func TestInvalidIrmaConfigurationRestoreFromAssets(t *testing.T) {
 	require.NotEmpty(t, conf.DisabledSchemeManagers)
 
 	// Try again from correct assets
-	conf.assets = "testdata/irma_configuration"
+	conf.assets = []string{"testdata/irma_configuration"}
 	err = conf.ParseOrRestoreFolder()
 	require.NoError(t, err)
 	require.Empty(t, conf.DisabledSchemeManagers)
@@ -111,6 +509,788 @@ func TestInvalidIrmaConfigurationRestoreFromAssets(t *testing.T) {
 	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
 }
 
+// schemeServer serves the scheme folders within a testdata folder, with ETags, recording
+// the requested paths and failing requests for the path in fail.
+type schemeServer struct {
+	*httptest.Server
+	dir  string
+	fail string
+
+	sync.Mutex
+	requests    []string
+	notModified int
+}
+
+func newSchemeServer(dir string) *schemeServer {
+	s := &schemeServer{dir: dir}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		defer s.Unlock()
+		s.requests = append(s.requests, r.URL.Path)
+		if r.URL.Path == s.fail {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		bts, err := ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(r.URL.Path)))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256(bts))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			s.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write(bts)
+	}))
+	return s
+}
+
+func (s *schemeServer) reset(dir, fail string) {
+	s.Lock()
+	defer s.Unlock()
+	s.dir, s.fail = dir, fail
+	s.requests, s.notModified = nil, 0
+}
+
+func TestUpdateSchemes(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(path, "irma-demo")))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	attrid := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")
+	server := newSchemeServer(filepath.Join("testdata", "irma_configuration"))
+	defer server.Close()
+	update := func() (*SchemesDiff, error) {
+		conf.SchemeManagers[schemeid].URL = server.URL + "/irma-demo"
+		return conf.UpdateSchemes()
+	}
+	originalIndex, err := ioutil.ReadFile(filepath.Join(path, "irma-demo", "index"))
+	require.NoError(t, err)
+
+	// Remote has the same version
+	diff, err := update()
+	require.NoError(t, err)
+	require.True(t, diff.Empty())
+
+	// Remote responds that the index was not modified since the previous request
+	server.reset(server.dir, "")
+	diff, err = update()
+	require.NoError(t, err)
+	require.True(t, diff.Empty())
+	require.Equal(t, []string{"/irma-demo/index"}, server.requests)
+	require.Equal(t, 1, server.notModified)
+
+	// Download of a changed file fails halfway, leaving our version intact
+	server.reset(filepath.Join("testdata", "irma_configuration_updated"), "/irma-demo/timestamp")
+	diff, err = update()
+	require.Error(t, err)
+	require.True(t, diff.Empty())
+	index, err := ioutil.ReadFile(filepath.Join(path, "irma-demo", "index"))
+	require.NoError(t, err)
+	require.Equal(t, originalIndex, index)
+	require.False(t, conf.CredentialTypes[credid].ContainsAttribute(attrid))
+	staging, err := filepath.Glob(filepath.Join(path, ".*"))
+	require.NoError(t, err)
+	require.Empty(t, staging)
+	reparsed, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, reparsed.ParseFolder())
+	require.False(t, reparsed.CredentialTypes[credid].ContainsAttribute(attrid))
+
+	// Remote has a newer version, of which only the changed files are downloaded
+	server.reset(server.dir, "")
+	oldCredType := conf.CredentialTypes[credid]
+	diff, err = update()
+	require.NoError(t, err)
+	require.Equal(t, &SchemeManagerDiff{
+		Modified: []string{"irma-demo/RU/Issues/studentCard/description.xml", "irma-demo/timestamp"},
+	}, diff.Schemes[schemeid])
+	require.Contains(t, diff.Changed.SchemeManagers, schemeid)
+	require.Contains(t, diff.Changed.CredentialTypes, credid)
+	require.Empty(t, diff.Changed.Issuers)
+	require.ElementsMatch(t, []string{
+		"/irma-demo/index",
+		"/irma-demo/index.sig",
+		"/irma-demo/RU/Issues/studentCard/description.xml",
+		"/irma-demo/timestamp",
+	}, server.requests)
+	require.True(t, conf.CredentialTypes[credid].ContainsAttribute(attrid))
+	require.False(t, oldCredType.ContainsAttribute(attrid), "previously parsed configuration should be unaffected")
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	staging, err = filepath.Glob(filepath.Join(path, ".*"))
+	require.NoError(t, err)
+	require.Empty(t, staging)
+}
+
+func TestRestoreSchemeFolder(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	dir, old := filepath.Join(path, "irma-demo"), filepath.Join(path, ".irma-demo.old")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), dir))
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	// Crash after moving the scheme folder out of the way: parsing moves it back
+	require.NoError(t, os.Rename(dir, old))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.Contains(t, conf.CredentialTypes, credid)
+	require.NoError(t, fs.AssertPathNotExists(old))
+
+	// Crash after moving the staged folder into place: the superseded old folder is removed,
+	// and does not get in the way of the next replacement
+	require.NoError(t, fs.CopyDirectory(dir, old))
+	staged := filepath.Join(path, ".update-test", "irma-demo")
+	require.NoError(t, fs.CopyDirectory(dir, staged))
+	require.NoError(t, replaceSchemeFolder(staged, dir))
+	require.NoError(t, fs.AssertPathNotExists(old))
+	require.NoError(t, fs.AssertPathNotExists(staged))
+	require.NoError(t, conf.ParseFolder())
+	require.Contains(t, conf.CredentialTypes, credid)
+}
+
+func TestUpdateSchemesResumesDownloads(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(path, "irma-demo")))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	// Serve the newer version of the scheme, dropping the connection halfway through the first
+	// download of each file except the index, and recording the ranged requests
+	remote := filepath.Join("testdata", "irma_configuration_updated")
+	files := http.FileServer(http.Dir(remote))
+	var lock sync.Mutex
+	dropped := map[string]bool{}
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		drop := r.URL.Path != "/irma-demo/index" && !dropped[r.URL.Path]
+		dropped[r.URL.Path] = true
+		if rng := r.Header.Get("Range"); rng != "" {
+			ranges = append(ranges, r.URL.Path+" "+rng)
+		}
+		lock.Unlock()
+		if !drop {
+			files.ServeHTTP(w, r)
+			return
+		}
+		bts, err := ioutil.ReadFile(filepath.Join(remote, filepath.FromSlash(r.URL.Path)))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(bts)))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(bts[:len(bts)/2])
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}))
+	defer server.Close()
+
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	conf.SchemeManagers[schemeid].URL = server.URL + "/irma-demo"
+	diff, err := conf.UpdateSchemes()
+	require.NoError(t, err)
+	require.Equal(t, &SchemeManagerDiff{
+		Modified: []string{"irma-demo/RU/Issues/studentCard/description.xml", "irma-demo/timestamp"},
+	}, diff.Schemes[schemeid])
+	require.True(t, conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")].ContainsAttribute(
+		NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")))
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+
+	// Each interrupted download was resumed where it was interrupted
+	require.Len(t, ranges, 3)
+	for _, file := range []string{"index.sig", "RU/Issues/studentCard/description.xml", "timestamp"} {
+		bts, err := ioutil.ReadFile(filepath.Join(remote, "irma-demo", filepath.FromSlash(file)))
+		require.NoError(t, err)
+		require.Contains(t, ranges, fmt.Sprintf("/irma-demo/%s bytes=%d-", file, len(bts)/2))
+	}
+	partial, err := filepath.Glob(filepath.Join(path, "irma-demo", "*.part"))
+	require.NoError(t, err)
+	require.Empty(t, partial)
+}
+
+// publishSchemeVersion turns the scheme in dir into a new version having the specified timestamp,
+// signing its new index with the private key of the scheme.
+func publishSchemeVersion(t *testing.T, dir string, timestamp int64) {
+	publishSchemeFiles(t, dir, map[string][]byte{"timestamp": []byte(fmt.Sprintf("%d\n", timestamp))})
+}
+
+// publishSchemeFiles writes the specified files, relative to the scheme in dir, into the scheme
+// and its index, signing the new index with the private key of the scheme. Files specified as nil
+// are removed from the scheme and its index.
+func publishSchemeFiles(t *testing.T, dir string, files map[string][]byte) {
+	id := filepath.Base(dir)
+	indexbts, err := ioutil.ReadFile(filepath.Join(dir, "index"))
+	require.NoError(t, err)
+	index := SchemeManagerIndex{}
+	require.NoError(t, index.FromString(string(indexbts)))
+	for file, bts := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if bts == nil {
+			require.NoError(t, os.Remove(path))
+			delete(index, id+"/"+file)
+			continue
+		}
+		require.NoError(t, fs.EnsureDirectoryExists(filepath.Dir(path)))
+		require.NoError(t, ioutil.WriteFile(path, bts, 0644))
+		hash := sha256.Sum256(bts)
+		index[id+"/"+file] = hash[:]
+	}
+	indexbts = []byte(index.String())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index"), indexbts, 0644))
+
+	skbts, err := ioutil.ReadFile(filepath.Join(dir, "sk.pem"))
+	require.NoError(t, err)
+	block, _ := pem.Decode(skbts)
+	require.NotNil(t, block)
+	sk, err := x509.ParseECPrivateKey(block.Bytes)
+	require.NoError(t, err)
+	hash := sha256.Sum256(indexbts)
+	r, s, err := ecdsa.Sign(rand.Reader, sk, hash[:])
+	require.NoError(t, err)
+	sig, err := asn1.Marshal([]*gobig.Int{r, s})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.sig"), sig, 0644))
+}
+
+func TestUpdateSchemesSnapshotConcurrently(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Serve a copy of irma-demo, of which we publish new versions during the test
+	remote := filepath.Join("testdata", "storage", "test", "remote")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(remote, "irma-demo")))
+	server := newSchemeServer(remote)
+	defer server.Close()
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join(remote, "irma-demo"), filepath.Join(path, "irma-demo")))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	conf.SchemeManagers[schemeid].URL = server.URL + "/irma-demo"
+
+	// As the IRMA server does, share the current snapshot among goroutines verifying proofs
+	var lock sync.RWMutex
+	current := conf
+	snapshot := func() *Configuration {
+		lock.RLock()
+		defer lock.RUnlock()
+		return current
+	}
+	msg := &SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(validSignedMessageJSON), msg))
+	_, status, err := msg.Verify(conf, nil)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, status)
+
+	done := make(chan struct{})
+	failures := make(chan error, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, status, err := msg.Verify(snapshot(), nil); err != nil || status != ProofStatusValid {
+					failures <- fmt.Errorf("verification failed with status %s: %v", status, err)
+					return
+				}
+			}
+		}()
+	}
+
+	timestamp := time.Time(conf.SchemeManagers[schemeid].Timestamp).Unix()
+	for i := int64(1); i <= 10; i++ {
+		publishSchemeVersion(t, filepath.Join(remote, "irma-demo"), timestamp+i)
+		fresh, diff, err := snapshot().UpdateSchemesSnapshot()
+		require.NoError(t, err)
+		require.NotNil(t, fresh)
+		require.Equal(t, []string{"irma-demo/timestamp"}, diff.Schemes[schemeid].Modified)
+		require.Equal(t, timestamp+i, time.Time(fresh.SchemeManagers[schemeid].Timestamp).Unix())
+		fresh.SchemeManagers[schemeid].URL = server.URL + "/irma-demo"
+		lock.Lock()
+		current = fresh
+		lock.Unlock()
+	}
+	close(done)
+	wg.Wait()
+	close(failures)
+	for err := range failures {
+		require.NoError(t, err)
+	}
+
+	// The original snapshot was left untouched
+	require.Equal(t, timestamp, time.Time(conf.SchemeManagers[schemeid].Timestamp).Unix())
+}
+
+func TestUpdateSchemesRollback(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	remote := filepath.Join("testdata", "storage", "test", "remote")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(remote, "irma-demo")))
+	server := newSchemeServer(remote)
+	defer server.Close()
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join(remote, "irma-demo"), filepath.Join(path, "irma-demo")))
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	parse := func() *Configuration {
+		conf, err := NewConfiguration(path)
+		require.NoError(t, err)
+		require.NoError(t, conf.ParseFolder())
+		conf.SchemeManagers[schemeid].URL = server.URL + "/irma-demo"
+		return conf
+	}
+	timestampOf := func(conf *Configuration) int64 {
+		require.True(t, conf.SchemeManagers[schemeid].Valid)
+		return time.Time(conf.SchemeManagers[schemeid].Timestamp).Unix()
+	}
+	conf := parse()
+	timestamp := timestampOf(conf)
+
+	// Publish two newer versions, keeping a copy of the first one
+	publishSchemeVersion(t, filepath.Join(remote, "irma-demo"), timestamp+1)
+	old := filepath.Join("testdata", "storage", "test", "old")
+	require.NoError(t, fs.CopyDirectory(filepath.Join(remote, "irma-demo"), filepath.Join(old, "irma-demo")))
+	publishSchemeVersion(t, filepath.Join(remote, "irma-demo"), timestamp+2)
+	_, err := conf.UpdateSchemes()
+	require.NoError(t, err)
+	require.Equal(t, timestamp+2, timestampOf(conf))
+
+	// A remote serving the older, validly signed version is refused, leaving the current version intact
+	server.reset(old, "")
+	diff, err := conf.UpdateSchemes()
+	require.Error(t, err)
+	require.True(t, diff.Empty())
+	require.Equal(t, timestamp+2, timestampOf(conf))
+	require.Equal(t, timestamp+2, timestampOf(parse()))
+	staging, err := filepath.Glob(filepath.Join(path, ".update-*"))
+	require.NoError(t, err)
+	require.Empty(t, staging)
+
+	// Also after the stored scheme was replaced by an even older version, e.g. from the assets
+	require.NoError(t, os.RemoveAll(filepath.Join(path, "irma-demo")))
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(path, "irma-demo")))
+	conf = parse()
+	require.Equal(t, timestamp, timestampOf(conf))
+	_, err = conf.UpdateSchemes()
+	require.Error(t, err)
+	require.Equal(t, timestamp, timestampOf(parse()))
+
+	// Unless explicitly allowed
+	conf.SetAllowRollback(true)
+	_, err = conf.UpdateSchemes()
+	require.NoError(t, err)
+	require.Equal(t, timestamp+1, timestampOf(conf))
+	conf = parse()
+	conf.SetAllowRollback(false)
+	server.reset(remote, "")
+	_, err = conf.UpdateSchemes()
+	require.NoError(t, err)
+	require.Equal(t, timestamp+2, timestampOf(conf))
+}
+
+func TestUpdateSchemesConfigurationDiff(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	remote := filepath.Join("testdata", "storage", "test", "remote")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(remote, "irma-demo")))
+	server := newSchemeServer(remote)
+	defer server.Close()
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join(remote, "irma-demo"), filepath.Join(path, "irma-demo")))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	conf.SchemeManagers[schemeid].URL = server.URL + "/irma-demo"
+
+	// Unchanged
+	diff, err := conf.UpdateSchemes()
+	require.NoError(t, err)
+	require.True(t, diff.Configuration.Empty())
+
+	read := func(file string) string {
+		bts, err := ioutil.ReadFile(filepath.Join("testdata", file))
+		require.NoError(t, err)
+		return string(bts)
+	}
+	issuer := read("irma_configuration/irma-demo/RU/description.xml")
+	credtype := read("irma_configuration/irma-demo/RU/Issues/studentCard/description.xml")
+	pk := read("irma_configuration/irma-demo/RU/PublicKeys/2.xml")
+	timestamp := time.Time(conf.SchemeManagers[schemeid].Timestamp).Unix()
+	publishSchemeFiles(t, filepath.Join(remote, "irma-demo"), map[string][]byte{
+		// Rename the issuer
+		"RU/description.xml": []byte(strings.Replace(issuer, "Radboud University Nijmegen", "Radboud University", 1)),
+		// Make level optional and add newAttribute
+		"RU/Issues/studentCard/description.xml":    []byte(read("irma_configuration_updated/irma-demo/RU/Issues/studentCard/description.xml")),
+		"RU/Issues/newCard/description.xml":        []byte(strings.Replace(credtype, "<CredentialID>studentCard</CredentialID>", "<CredentialID>newCard</CredentialID>", 1)),
+		"RU/PublicKeys/3.xml":                      []byte(strings.Replace(pk, "<Counter>2</Counter>", "<Counter>3</Counter>", 1)),
+		"MijnOverheid/Issues/root/description.xml": nil,
+		"MijnOverheid/Issues/root/logo.png":        nil,
+		"timestamp":                                []byte(fmt.Sprintf("%d\n", timestamp+1)),
+	})
+
+	diff, err = conf.UpdateSchemes()
+	require.NoError(t, err)
+	require.Equal(t, &ConfigurationDiff{
+		ChangedSchemeManagers:  []SchemeManagerIdentifier{schemeid},
+		ChangedIssuers:         []IssuerIdentifier{NewIssuerIdentifier("irma-demo.RU")},
+		AddedCredentialTypes:   []CredentialTypeIdentifier{NewCredentialTypeIdentifier("irma-demo.RU.newCard")},
+		RemovedCredentialTypes: []CredentialTypeIdentifier{NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")},
+		ChangedCredentialTypes: []*CredentialTypeDiff{{
+			ID:                NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+			AddedAttributes:   []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")},
+			ChangedAttributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")},
+		}},
+		AddedPublicKeys: map[IssuerIdentifier][]int{NewIssuerIdentifier("irma-demo.RU"): {3}},
+	}, diff.Configuration)
+
+	// The diff survives the gomobile boundary
+	bts, err := json.Marshal(diff.Configuration)
+	require.NoError(t, err)
+	decoded := &ConfigurationDiff{}
+	require.NoError(t, json.Unmarshal(bts, decoded))
+	require.Equal(t, diff.Configuration, decoded)
+}
+
+func TestFetchMissingPublicKeys(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Serve a copy of irma-demo, to which we add a new key of RU during the test
+	remote := filepath.Join("testdata", "storage", "test", "remote")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(remote, "irma-demo")))
+	server := newSchemeServer(remote)
+	defer server.Close()
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join(remote, "irma-demo"), filepath.Join(path, "irma-demo")))
+	keyfile := filepath.Join(path, "irma-demo", "RU", "PublicKeys", "2.xml")
+	require.NoError(t, os.Remove(keyfile))
+	parse := func() *Configuration {
+		conf, err := NewConfiguration(path)
+		require.NoError(t, err)
+		require.NoError(t, conf.ParseFolder())
+		conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")].URL = server.URL + "/irma-demo"
+		return conf
+	}
+	issuerid := NewIssuerIdentifier("irma-demo.RU")
+
+	// Not fetched unless enabled
+	conf := parse()
+	pk, err := conf.PublicKey(issuerid, 2)
+	require.NoError(t, err)
+	require.Nil(t, pk)
+	require.Empty(t, server.requests)
+
+	// Concurrent lookups of the key that went missing from storage fetch it once, restoring it
+	conf.SetDownloadMissingPublicKeys(true)
+	var wg sync.WaitGroup
+	failures := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if pk, err := conf.PublicKey(issuerid, 2); err != nil || pk == nil {
+				failures <- fmt.Errorf("public key not fetched: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(failures)
+	for err := range failures {
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"/irma-demo/RU/PublicKeys/2.xml"}, server.requests)
+	require.NoError(t, fs.AssertPathExists(keyfile))
+	pk, err = parse().PublicKey(issuerid, 2)
+	require.NoError(t, err)
+	require.NotNil(t, pk)
+
+	// A key that the scheme manager does not have is looked up in its current index,
+	// after which it is not requested again for a while
+	server.reset(remote, "")
+	pk, err = conf.PublicKey(issuerid, 3)
+	require.NoError(t, err)
+	require.Nil(t, pk)
+	require.Equal(t, []string{"/irma-demo/index", "/irma-demo/index.sig"}, server.requests)
+	pk, err = conf.PublicKey(issuerid, 3)
+	require.NoError(t, err)
+	require.Nil(t, pk)
+	require.Len(t, server.requests, 2)
+
+	// The issuer starts using a new key that is not yet in our version of the scheme
+	bts, err := ioutil.ReadFile(filepath.Join(remote, "irma-demo", "RU", "PublicKeys", "2.xml"))
+	require.NoError(t, err)
+	bts = []byte(strings.Replace(string(bts), "<Counter>2</Counter>", "<Counter>3</Counter>", 1))
+	publishSchemeFiles(t, filepath.Join(remote, "irma-demo"), map[string][]byte{"RU/PublicKeys/3.xml": bts})
+	pk, err = conf.PublicKey(issuerid, 3)
+	require.NoError(t, err)
+	require.Nil(t, pk, "failed fetches should not be retried immediately")
+
+	defer func(retry time.Duration) { missingPublicKeyRetry = retry }(missingPublicKeyRetry)
+	missingPublicKeyRetry = 0
+	server.reset(remote, "")
+	pk, err = conf.PublicKey(issuerid, 3)
+	require.NoError(t, err)
+	require.NotNil(t, pk)
+	require.Equal(t, uint(3), pk.Counter)
+	require.Equal(t, []string{"/irma-demo/index", "/irma-demo/index.sig", "/irma-demo/RU/PublicKeys/3.xml"}, server.requests)
+	// As our index does not authenticate it, the key is cached but not stored
+	require.NoError(t, fs.AssertPathNotExists(filepath.Join(path, "irma-demo", "RU", "PublicKeys", "3.xml")))
+	server.reset(remote, "")
+	pk, err = conf.PublicKey(issuerid, 3)
+	require.NoError(t, err)
+	require.NotNil(t, pk)
+	require.Empty(t, server.requests)
+
+	// Keys are not fetched using an index whose signature does not verify
+	bts = []byte(strings.Replace(string(bts), "<Counter>3</Counter>", "<Counter>4</Counter>", 1))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(remote, "irma-demo", "RU", "PublicKeys", "4.xml"), bts, 0644))
+	index, err := ioutil.ReadFile(filepath.Join(remote, "irma-demo", "index"))
+	require.NoError(t, err)
+	index = append(index, fmt.Sprintf("%x irma-demo/RU/PublicKeys/4.xml\n", sha256.Sum256(bts))...)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(remote, "irma-demo", "index"), index, 0644))
+	pk, err = conf.PublicKey(issuerid, 4)
+	require.NoError(t, err)
+	require.Nil(t, pk)
+}
+
+func TestInstallScheme(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Serve the scheme from a temporary folder
+	storage := filepath.Join("testdata", "storage", "test")
+	remote := filepath.Join(storage, "remote")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration_install", "test2"), filepath.Join(remote, "test2")))
+	server := httptest.NewServer(http.FileServer(http.Dir(remote)))
+	defer server.Close()
+	url := server.URL + "/test2"
+
+	path := filepath.Join(storage, "irma_configuration")
+	require.NoError(t, fs.EnsureDirectoryExists(path))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	schemeid := NewSchemeManagerIdentifier("test2")
+	credid := NewCredentialTypeIdentifier("test2.issuer.card")
+	pk, err := ioutil.ReadFile(filepath.Join(remote, "test2", "pk.pem"))
+	require.NoError(t, err)
+	otherpk, err := ioutil.ReadFile(filepath.Join("testdata", "irma_configuration", "irma-demo", "pk.pem"))
+	require.NoError(t, err)
+
+	// Not signed with the specified public key
+	require.Error(t, conf.InstallScheme(url, otherpk, false))
+	require.NotContains(t, conf.SchemeManagers, schemeid)
+	require.NoError(t, fs.AssertPathNotExists(filepath.Join(path, "test2")))
+
+	require.NoError(t, conf.InstallScheme(url, pk, false))
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.Contains(t, conf.CredentialTypes, credid)
+	reparsed, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, reparsed.ParseFolder())
+	require.Contains(t, reparsed.CredentialTypes, credid)
+
+	// Colliding ID, unless replacing; this time by fingerprint
+	require.Error(t, conf.InstallScheme(url, pk, false))
+	fingerprint, err := PublicKeyFingerprint(pk)
+	require.NoError(t, err)
+	require.Error(t, conf.InstallScheme(url, []byte("AAAA"), true))
+	require.NoError(t, conf.InstallScheme(url, []byte(fingerprint), true))
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.Contains(t, conf.CredentialTypes, credid)
+
+	require.NoError(t, conf.RemoveScheme(schemeid))
+	require.NotContains(t, conf.SchemeManagers, schemeid)
+	require.NotContains(t, conf.CredentialTypes, credid)
+	require.NotContains(t, conf.AttributeTypes, NewAttributeTypeIdentifier("test2.issuer.card.number"))
+	require.NoError(t, fs.AssertPathNotExists(filepath.Join(path, "test2")))
+	require.Error(t, conf.RemoveScheme(schemeid))
+
+	staging, err := filepath.Glob(filepath.Join(path, ".*"))
+	require.NoError(t, err)
+	require.Empty(t, staging)
+}
+
+// storedFiles returns the files within the specified folder, relative to it.
+func storedFiles(t *testing.T, dir string) []string {
+	var files []string
+	require.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	}))
+	return files
+}
+
+func TestConfigurationOverlay(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	storage := filepath.Join("testdata", "storage", "test")
+	assets := filepath.Join(storage, "assets")
+	path := filepath.Join(storage, "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(assets, "irma-demo")))
+	parse := func() *Configuration {
+		conf, err := NewConfigurationOverlay(path, assets)
+		require.NoError(t, err)
+		require.NoError(t, conf.ParseFolder())
+		return conf
+	}
+
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	attrid := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")
+
+	// Schemes are parsed out of the assets without copying them into storage
+	conf := parse()
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.False(t, conf.CredentialTypes[credid].ContainsAttribute(attrid))
+	require.NoError(t, fs.AssertPathNotExists(filepath.Join(path, "irma-demo")))
+
+	// Updates store only the changed files, which override those of the assets
+	server := newSchemeServer(filepath.Join("testdata", "irma_configuration_updated"))
+	defer server.Close()
+	conf.SchemeManagers[schemeid].URL = server.URL + "/irma-demo"
+	_, err := conf.UpdateSchemes()
+	require.NoError(t, err)
+	require.True(t, conf.CredentialTypes[credid].ContainsAttribute(attrid))
+	require.ElementsMatch(t, []string{
+		"RU/Issues/studentCard/description.xml", "index", "index.sig", "timestamp",
+	}, storedFiles(t, filepath.Join(path, "irma-demo")))
+	conf = parse()
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.True(t, conf.CredentialTypes[credid].ContainsAttribute(attrid))
+	require.NotEmpty(t, conf.CredentialTypes[credid].Logo(conf))
+
+	// Newer assets, e.g. after an app update, win over an older version in storage
+	require.NoError(t, os.RemoveAll(filepath.Join(assets, "irma-demo")))
+	require.NoError(t, os.RemoveAll(filepath.Join(path, "irma-demo")))
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration_updated", "irma-demo"), filepath.Join(assets, "irma-demo")))
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(path, "irma-demo")))
+	conf = parse()
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.True(t, conf.CredentialTypes[credid].ContainsAttribute(attrid))
+	require.NoError(t, fs.AssertPathNotExists(filepath.Join(path, "irma-demo")))
+
+	// Deleting a scheme masks its assets, also when parsing again
+	require.NoError(t, conf.RemoveScheme(schemeid))
+	require.NotContains(t, conf.SchemeManagers, schemeid)
+	conf = parse()
+	require.NotContains(t, conf.SchemeManagers, schemeid)
+	require.NotContains(t, conf.CredentialTypes, credid)
+	require.NoError(t, fs.AssertPathNotExists(filepath.Join(path, "irma-demo")))
+
+	// Until it is restored from the assets
+	_, err = conf.CopyManagerFromAssets(schemeid)
+	require.NoError(t, err)
+	conf = parse()
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+}
+
+func TestConfigurationSearchPaths(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// A system-wide assets folder, and a per-user one containing a newer version of irma-demo
+	storage := filepath.Join("testdata", "storage", "test")
+	system, user := filepath.Join(storage, "system"), filepath.Join(storage, "user")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration"), system))
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration_updated"), user))
+	parse := func(path string, overlay bool, assets ...string) *Configuration {
+		var conf *Configuration
+		var err error
+		if overlay {
+			conf, err = NewConfigurationOverlay(path, assets...)
+		} else {
+			conf, err = NewConfigurationFromAssets(path, assets...)
+		}
+		require.NoError(t, err)
+		require.NoError(t, conf.ParseFolder())
+		return conf
+	}
+
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	attrid := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")
+	conflict := fmt.Sprintf("Scheme irma-demo occurs in multiple assets folders, using %s instead of %s", user, system)
+
+	// Schemes are copied into storage from the last folder containing them
+	path := filepath.Join(storage, "copied")
+	conf := parse(path, false, system, user)
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.True(t, conf.CredentialTypes[credid].ContainsAttribute(attrid))
+	require.Contains(t, conf.SchemeManagers, NewSchemeManagerIdentifier("test"))
+	require.Contains(t, conf.Warnings, conflict)
+	index, err := ioutil.ReadFile(filepath.Join(user, "irma-demo", "index"))
+	require.NoError(t, err)
+	stored, err := ioutil.ReadFile(filepath.Join(path, "irma-demo", "index"))
+	require.NoError(t, err)
+	require.Equal(t, index, stored)
+
+	// In overlay mode, also the order of the folders determines the version that is used
+	path = filepath.Join(storage, "overlay")
+	conf = parse(path, true, user, system)
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.False(t, conf.CredentialTypes[credid].ContainsAttribute(attrid))
+	require.Contains(t, conf.Warnings, fmt.Sprintf("Scheme irma-demo occurs in multiple assets folders, using %s instead of %s", system, user))
+	conf = parse(path, true, system, user)
+	require.True(t, conf.CredentialTypes[credid].ContainsAttribute(attrid))
+	require.Contains(t, conf.Warnings, conflict)
+	require.NoError(t, fs.AssertPathNotExists(filepath.Join(path, "irma-demo")))
+
+	// When the scheme is removed from the later folder, that of the earlier one shows through
+	require.NoError(t, os.RemoveAll(filepath.Join(user, "irma-demo")))
+	conf = parse(path, true, system, user)
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.False(t, conf.CredentialTypes[credid].ContainsAttribute(attrid))
+	require.NotContains(t, conf.Warnings, conflict)
+
+	// Deleting the scheme masks it in all folders, which are left untouched
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration_updated", "irma-demo"), filepath.Join(user, "irma-demo")))
+	require.NoError(t, conf.RemoveScheme(schemeid))
+	conf = parse(path, true, system, user)
+	require.NotContains(t, conf.SchemeManagers, schemeid)
+	require.NotContains(t, conf.CredentialTypes, credid)
+	require.NoError(t, fs.AssertPathExists(filepath.Join(system, "irma-demo"), filepath.Join(user, "irma-demo")))
+}
+
 func TestParseIrmaConfiguration(t *testing.T) {
 	conf := parseConfiguration(t)
 
@@ -185,11 +1365,789 @@ func TestAttributeDisjunctionMarshaling(t *testing.T) {
 
 	require.True(t, disjunction.MatchesConfig(conf))
 
-	require.False(t, disjunction.satisfied())
-	index := 0
-	disjunction.selected = &disjunction.Attributes[0]
-	disjunction.index = &index
-	require.True(t, disjunction.satisfied())
+	require.False(t, disjunction.satisfied())
+	index := 0
+	disjunction.selected = &disjunction.Attributes[0]
+	disjunction.index = &index
+	require.False(t, disjunction.satisfied()) // absent attributes satisfy nothing
+	value := "yes"
+	disjunction.value = &value
+	require.True(t, disjunction.satisfied())
+
+	// Multiple allowed values, along with a required value and an attribute without condition
+	disjunction = AttributeDisjunction{}
+	attrsjson = `
+	{
+		"label": "Over 18",
+		"attributes": {
+			"MijnOverheid.ageLower.over18": ["yes", "ja"],
+			"Thalia.age.over18": "Yes",
+			"Thalia.age.over21": null
+		}
+	}`
+	require.NoError(t, json.Unmarshal([]byte(attrsjson), &disjunction))
+	require.True(t, disjunction.HasValues())
+	require.Len(t, disjunction.Attributes, 3)
+	require.Equal(t, []string{"yes", "ja"}, disjunction.AllowedValues[id])
+	require.NotContains(t, disjunction.Values, id)
+	require.True(t, disjunction.ValueAllowed(id, "ja"))
+	require.False(t, disjunction.ValueAllowed(id, "no"))
+	require.False(t, disjunction.ValueAllowed(NewAttributeTypeIdentifier("Thalia.age.over18"), "yes"))
+	require.True(t, disjunction.ValueAllowed(NewAttributeTypeIdentifier("Thalia.age.over21"), "no"))
+
+	bts, err := json.Marshal(&disjunction)
+	require.NoError(t, err)
+	roundtrip := AttributeDisjunction{}
+	require.NoError(t, json.Unmarshal(bts, &roundtrip))
+	require.Equal(t, disjunction.AllowedValues, roundtrip.AllowedValues)
+	require.Equal(t, disjunction.Values, roundtrip.Values)
+
+	require.Error(t, json.Unmarshal([]byte(`{"attributes": {"Thalia.age.over18": 18}}`), &AttributeDisjunction{}))
+
+	// Optional disjunctions, which are satisfied also when skipped
+	disjunction = AttributeDisjunction{}
+	require.NoError(t, json.Unmarshal([]byte(`{"label": "Over 18", "attributes": ["MijnOverheid.ageLower.over18"], "optional": true}`), &disjunction))
+	require.True(t, disjunction.Optional)
+	require.True(t, AttributeDisjunctionList{&disjunction}.satisfied())
+	bts, err = json.Marshal(&disjunction)
+	require.NoError(t, err)
+	roundtrip = AttributeDisjunction{}
+	require.NoError(t, json.Unmarshal(bts, &roundtrip))
+	require.True(t, roundtrip.Optional)
+}
+
+func TestAttributeDisjunctionTranslatedLabel(t *testing.T) {
+	// Untranslated labels are marshaled as a string, as before
+	plain := `{"label":"Over 18","attributes":["irma-demo.MijnOverheid.ageLower.over18"]}`
+	disjunction := &AttributeDisjunction{}
+	require.NoError(t, json.Unmarshal([]byte(plain), disjunction))
+	require.Equal(t, "Over 18", disjunction.Label)
+	require.Nil(t, disjunction.Labels)
+	require.Equal(t, "Over 18", disjunction.TranslatedLabel("nl"))
+	bts, err := json.Marshal(disjunction)
+	require.NoError(t, err)
+	require.JSONEq(t, plain, string(bts))
+
+	// Translated labels, with and without conditions on attribute values
+	for _, translated := range []string{
+		`{"label":{"en":"Over 18","nl":"Ouder dan 18"},"attributes":["irma-demo.MijnOverheid.ageLower.over18"]}`,
+		`{"label":{"en":"Over 18","nl":"Ouder dan 18"},"attributes":{"irma-demo.MijnOverheid.ageLower.over18":"yes"}}`,
+	} {
+		disjunction = &AttributeDisjunction{}
+		require.NoError(t, json.Unmarshal([]byte(translated), disjunction))
+		require.Equal(t, "Over 18", disjunction.Label)
+		require.Equal(t, TranslatedString{"en": "Over 18", "nl": "Ouder dan 18"}, disjunction.Labels)
+		require.Equal(t, "Ouder dan 18", disjunction.TranslatedLabel("nl-NL", "en"))
+		require.Equal(t, "Over 18", disjunction.TranslatedLabel("de"))
+		bts, err = json.Marshal(disjunction)
+		require.NoError(t, err)
+		require.JSONEq(t, translated, string(bts))
+	}
+
+	require.Error(t, json.Unmarshal([]byte(`{"label":18,"attributes":["irma-demo.MijnOverheid.ageLower.over18"]}`), &AttributeDisjunction{}))
+
+	// The translations survive the signature request in which they are embedded
+	request := &SignatureRequest{}
+	require.NoError(t, UnmarshalValidate([]byte(`{
+		"type": "signing",
+		"message": "I owe you everything",
+		"content": [{"label": {"en": "Student number", "nl": "Studentnummer"}, "attributes": ["irma-demo.RU.studentCard.studentID"]}]
+	}`), request))
+	bts, err = json.Marshal(request)
+	require.NoError(t, err)
+	roundtrip := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal(bts, roundtrip))
+	require.Equal(t, "Studentnummer", roundtrip.Content[0].TranslatedLabel("nl"))
+	require.Equal(t, request.Content[0].Labels, roundtrip.Content[0].Labels)
+
+	// Relabeling in Merge() applies to all translations
+	attr := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	other := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	merged := AttributeDisjunctionList{request.Content[0]}.Merge(AttributeDisjunctionList{
+		{Label: "Student number", Labels: request.Content[0].Labels, Attributes: []AttributeTypeIdentifier{other}},
+		{Label: "Student number", Labels: TranslatedString{"en": "Student number"}, Attributes: []AttributeTypeIdentifier{attr}},
+	})
+	require.Len(t, merged, 3)
+	require.Equal(t, TranslatedString{"en": "Student number (2)", "nl": "Studentnummer (2)"}, merged[1].Labels)
+	require.Equal(t, "Student number", merged[2].Label, "disjunctions with other translations are not equivalent")
+}
+
+func TestTranslatedStringTranslation(t *testing.T) {
+	ts := TranslatedString{"en": "Age", "nl": "Leeftijd", "fr": "Âge"}
+	require.Equal(t, "Leeftijd", ts.Translation("nl"))
+	require.Equal(t, "Leeftijd", ts.Translation("nl-BE"))
+	require.Equal(t, "Leeftijd", ts.Translation("nl_BE", "fr"))
+	require.Equal(t, "Âge", ts.Translation("de", "fr"))
+	require.Equal(t, "Age", ts.Translation("de"))
+	require.Equal(t, "Age", ts.Translation())
+	require.Equal(t, "raw", TranslatedString{"": "raw", "nl": "Leeftijd"}.Translation("de"))
+	require.Equal(t, "Âge", TranslatedString{"nl": "Leeftijd", "fr": "Âge"}.Translation("de"))
+	require.Equal(t, "", TranslatedString{}.Translation("nl"))
+}
+
+func TestDisclosureRequestValidateValues(t *testing.T) {
+	request := &DisclosureRequest{}
+	require.NoError(t, UnmarshalValidate([]byte(`{
+		"type": "disclosing",
+		"content": [{"label": "Over 18", "attributes": {"irma-demo.MijnOverheid.ageLower.over18": ["yes", "ja"]}}]
+	}`), request))
+
+	// Values must concern attributes of the disjunction
+	value := "yes"
+	request.Content[0].Values = map[AttributeTypeIdentifier]*string{NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over21"): &value}
+	require.Error(t, request.Validate())
+
+	// An empty list of allowed values cannot be satisfied
+	require.Error(t, UnmarshalValidate([]byte(`{
+		"type": "disclosing",
+		"content": [{"label": "Over 18", "attributes": {"irma-demo.MijnOverheid.ageLower.over18": []}}]
+	}`), &DisclosureRequest{}))
+}
+
+func TestDisclosureRequestWildcard(t *testing.T) {
+	conf := parseConfiguration(t)
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	wildcard := credid.Wildcard()
+	require.Equal(t, "irma-demo.RU.studentCard.*", wildcard.String())
+	require.True(t, wildcard.IsWildcard())
+	require.False(t, wildcard.IsCredential())
+	require.False(t, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID").IsWildcard())
+	require.Equal(t, credid, wildcard.CredentialTypeIdentifier())
+
+	attrs, err := conf.WildcardAttributes(wildcard)
+	require.NoError(t, err)
+	require.Len(t, attrs, len(conf.CredentialTypes[credid].AttributeTypes))
+	require.Contains(t, attrs, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	_, err = conf.WildcardAttributes(NewAttributeTypeIdentifier("irma-demo.RU.foo.*"))
+	require.Error(t, err)
+
+	require.NoError(t, UnmarshalValidate([]byte(`{
+		"type": "disclosing",
+		"content": [{"label": "Student card", "attributes": ["irma-demo.RU.studentCard.*"]}]
+	}`), &DisclosureRequest{}))
+	require.Error(t, UnmarshalValidate([]byte(`{
+		"type": "disclosing",
+		"content": [{"label": "Student card", "attributes": ["irma-demo.RU.*"]}]
+	}`), &DisclosureRequest{}))
+	require.Error(t, UnmarshalValidate([]byte(`{
+		"type": "disclosing",
+		"content": [{"label": "Student card", "attributes": {"irma-demo.RU.studentCard.*": "456"}}]
+	}`), &DisclosureRequest{}))
+}
+
+func TestAttributeDisjunctionListNormalize(t *testing.T) {
+	a := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	b := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	c := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	value := "42"
+	dl := AttributeDisjunctionList{
+		{Label: "x", Attributes: []AttributeTypeIdentifier{a, b}},
+		{Label: "x", Attributes: []AttributeTypeIdentifier{b, a}},              // equivalent to the first
+		{Label: "x", Attributes: []AttributeTypeIdentifier{a, b, c}},           // implied by the first
+		{Label: "y", Attributes: []AttributeTypeIdentifier{a, b, c}},           // other label
+		{Label: "x", Attributes: []AttributeTypeIdentifier{c}, Optional: true}, // optional
+		{Label: "x", Attributes: []AttributeTypeIdentifier{c, b}},              // implied only by the optional one
+		{Label: "z", Attributes: []AttributeTypeIdentifier{b}, Values: map[AttributeTypeIdentifier]*string{b: &value}},
+		{Label: "z", Attributes: []AttributeTypeIdentifier{b, c}},                                                                    // implied by the previous one
+		{Label: "z", Attributes: []AttributeTypeIdentifier{b}, AllowedValues: map[AttributeTypeIdentifier][]string{b: {"41", "42"}}}, // idem
+		{Label: "w", Attributes: []AttributeTypeIdentifier{b}, AllowedValues: map[AttributeTypeIdentifier][]string{b: {"41", "42"}}}, // implied by the next one
+		{Label: "w", Attributes: []AttributeTypeIdentifier{b}, Values: map[AttributeTypeIdentifier]*string{b: &value}},
+	}
+	require.Equal(t, AttributeDisjunctionList{dl[0], dl[3], dl[4], dl[5], dl[6], dl[10]}, dl.Normalize())
+	require.Len(t, dl, 11, "receiver should not be modified")
+
+	merged := AttributeDisjunctionList{dl[0]}.Merge(AttributeDisjunctionList{dl[2], dl[5], {Label: "x", Attributes: []AttributeTypeIdentifier{c}}})
+	require.Len(t, merged, 3)
+	require.Equal(t, dl[0], merged[0])
+	require.Equal(t, "x (2)", merged[1].Label)
+	require.Equal(t, dl[5].Attributes, merged[1].Attributes)
+	require.Equal(t, "x (3)", merged[2].Label)
+	require.Equal(t, "x", dl[5].Label, "merged lists should not be modified")
+
+	// Property: normalized and merged lists accept the same disclosures as the original lists.
+	// The attribute values of a disclosure are drawn from a small set, so that conditions matter.
+	random := mathrand.New(mathrand.NewSource(42))
+	attrs := []AttributeTypeIdentifier{a, b, c, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")}
+	values := []string{"1", "2", "3"}
+	randomList := func() AttributeDisjunctionList {
+		var list AttributeDisjunctionList
+		for i := random.Intn(6); i > 0; i-- {
+			disjunction := &AttributeDisjunction{
+				Label:         []string{"p", "q"}[random.Intn(2)],
+				Optional:      random.Intn(4) == 0,
+				Values:        map[AttributeTypeIdentifier]*string{},
+				AllowedValues: map[AttributeTypeIdentifier][]string{},
+			}
+			for _, j := range random.Perm(len(attrs))[:1+random.Intn(len(attrs))] {
+				disjunction.Attributes = append(disjunction.Attributes, attrs[j])
+				switch random.Intn(3) {
+				case 0:
+					v := values[random.Intn(len(values))]
+					disjunction.Values[attrs[j]] = &v
+				case 1:
+					disjunction.AllowedValues[attrs[j]] = values[:1+random.Intn(2)]
+				}
+			}
+			list = append(list, disjunction)
+		}
+		return list
+	}
+	dump := func(list AttributeDisjunctionList) string {
+		bts, err := json.Marshal(list)
+		require.NoError(t, err)
+		return string(bts)
+	}
+	accepts := func(list AttributeDisjunctionList, disclosed map[AttributeTypeIdentifier]string) bool {
+		for _, disjunction := range list {
+			if disjunction.Optional {
+				continue
+			}
+			satisfied := false
+			for _, attr := range disjunction.Attributes {
+				if v, ok := disclosed[attr]; ok && disjunction.ValueAllowed(attr, v) {
+					satisfied = true
+				}
+			}
+			if !satisfied {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 1000; i++ {
+		list, other := randomList(), randomList()
+		normalized, merged := list.Normalize(), list.Merge(other)
+		require.True(t, len(normalized) <= len(list))
+		for j := 0; j < 20; j++ {
+			disclosed := map[AttributeTypeIdentifier]string{}
+			for _, attr := range attrs {
+				if random.Intn(2) == 0 {
+					disclosed[attr] = values[random.Intn(len(values))]
+				}
+			}
+			require.Equal(t, accepts(list, disclosed), accepts(normalized, disclosed), "list %s", dump(list))
+			require.Equal(t, accepts(list, disclosed) && accepts(other, disclosed), accepts(merged, disclosed),
+				"lists %s and %s", dump(list), dump(other))
+		}
+		require.Equal(t, normalized, normalized.Normalize(), "normalization should be idempotent")
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		dest     interface{}
+		json     string
+		problems []ValidationProblem // only Path and Code are compared
+	}{
+		{
+			name:     "missing type that cannot be inferred",
+			dest:     &DisclosureRequest{},
+			json:     `{"protocolVersion": "2.4"}`,
+			problems: []ValidationProblem{{Path: "type", Code: ValidationErrorMissingField}},
+		},
+		{
+			name:     "wrong type",
+			dest:     &DisclosureRequest{},
+			json:     `{"type": "signing", "content": [{"label": "Over 18", "attributes": ["irma-demo.MijnOverheid.ageLower.over18"]}]}`,
+			problems: []ValidationProblem{{Path: "type", Code: ValidationErrorInvalidValue}},
+		},
+		{
+			name:     "no content",
+			dest:     &DisclosureRequest{},
+			json:     `{"type": "disclosing", "content": []}`,
+			problems: []ValidationProblem{{Path: "content", Code: ValidationErrorMissingField}},
+		},
+		{
+			name: "empty disjunction",
+			dest: &DisclosureRequest{},
+			json: `{"type": "disclosing", "content": [
+				{"label": "Over 18", "attributes": ["irma-demo.MijnOverheid.ageLower.over18"]},
+				{"label": "Nothing", "attributes": []}
+			]}`,
+			problems: []ValidationProblem{{Path: "content[1].attributes", Code: ValidationErrorMissingField}},
+		},
+		{
+			name:     "malformed wildcard",
+			dest:     &DisclosureRequest{},
+			json:     `{"type": "disclosing", "content": [{"label": "Student card", "attributes": ["irma-demo.RU.*"]}]}`,
+			problems: []ValidationProblem{{Path: "content[0].attributes[0]", Code: ValidationErrorInvalidValue}},
+		},
+		{
+			name:     "value for wildcard",
+			dest:     &DisclosureRequest{},
+			json:     `{"type": "disclosing", "content": [{"label": "Student card", "attributes": {"irma-demo.RU.studentCard.*": "456"}}]}`,
+			problems: []ValidationProblem{{Path: "content[0].attributes[0]", Code: ValidationErrorConflictingFields}},
+		},
+		{
+			name:     "empty list of values",
+			dest:     &DisclosureRequest{},
+			json:     `{"type": "disclosing", "content": [{"label": "Over 18", "attributes": {"irma-demo.MijnOverheid.ageLower.over18": []}}]}`,
+			problems: []ValidationProblem{{Path: "content[0].attributes[0]", Code: ValidationErrorInvalidValue}},
+		},
+		{
+			name:     "signature request without message",
+			dest:     &SignatureRequest{},
+			json:     `{"type": "signing", "content": [{"label": "Over 18", "attributes": ["irma-demo.MijnOverheid.ageLower.over18"]}]}`,
+			problems: []ValidationProblem{{Path: "message", Code: ValidationErrorMissingField}},
+		},
+		{
+			name: "negative maximum age of expired attributes",
+			dest: &DisclosureRequest{},
+			json: `{"type": "disclosing", "maxExpiredAge": -1,
+				"content": [{"label": "Over 18", "attributes": ["irma-demo.MijnOverheid.ageLower.over18"]}]}`,
+			problems: []ValidationProblem{{Path: "maxExpiredAge", Code: ValidationErrorInvalidValue}},
+		},
+		{
+			name: "maximum age of expired attributes while not accepting them",
+			dest: &DisclosureRequest{},
+			json: `{"type": "disclosing", "acceptExpired": false, "maxExpiredAge": 3600,
+				"content": [{"label": "Over 18", "attributes": ["irma-demo.MijnOverheid.ageLower.over18"]}]}`,
+			problems: []ValidationProblem{{Path: "maxExpiredAge", Code: ValidationErrorConflictingFields}},
+		},
+		{
+			name: "multiple problems in issuance request",
+			dest: &IssuanceRequest{},
+			json: `{"type": "issuing", "credentials": [
+				{"credential": "irma-demo.RU.studentCard", "validity": 1000000000, "keyCounter": -1, "attributes": {}},
+				{"attributes": {}}
+			], "disclose": [{"label": "Nothing", "attributes": []}]}`,
+			problems: []ValidationProblem{
+				{Path: "credentials[0].validity", Code: ValidationErrorInvalidValue},
+				{Path: "credentials[0].keyCounter", Code: ValidationErrorInvalidValue},
+				{Path: "credentials[1].credential", Code: ValidationErrorMissingField},
+				{Path: "disclose[0].attributes", Code: ValidationErrorMissingField},
+			},
+		},
+		{
+			name: "field of wrong type",
+			dest: &SignatureRequest{},
+			json: `{"type": "signing", "message": 42,
+				"content": [{"label": "Over 18", "attributes": ["irma-demo.MijnOverheid.ageLower.over18"]}]}`,
+			problems: []ValidationProblem{{Path: "message", Code: ValidationErrorInvalidValue}},
+		},
+		{
+			name:     "wrapped session request",
+			dest:     &ServiceProviderRequest{},
+			json:     `{"request": {"type": "disclosing", "content": []}}`,
+			problems: []ValidationProblem{{Path: "request.content", Code: ValidationErrorMissingField}},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			err := UnmarshalValidate([]byte(tst.json), tst.dest)
+			require.Error(t, err)
+			verr, ok := err.(*ValidationError)
+			require.True(t, ok, "not a ValidationError: %s", err.Error())
+			require.Len(t, verr.Problems, len(tst.problems), err.Error())
+			for i, problem := range tst.problems {
+				require.Equal(t, problem.Path, verr.Problems[i].Path)
+				require.Equal(t, problem.Code, verr.Problems[i].Code)
+				require.NotEmpty(t, verr.Problems[i].Message)
+			}
+		})
+	}
+}
+
+func TestInferAction(t *testing.T) {
+	content := `"content": [{"label": "Over 18", "attributes": ["irma-demo.MijnOverheid.ageLower.over18"]}]`
+	credentials := `"credentials": [{"credential": "irma-demo.RU.studentCard", "attributes": {"studentID": "456"}}]`
+	disclose := `"disclose": [{"label": "Over 18", "attributes": ["irma-demo.MijnOverheid.ageLower.over18"]}]`
+	message := `"message": "I owe you everything"`
+
+	tests := []struct {
+		name   string
+		fields []string
+		action Action
+		code   ValidationErrorCode // of the problem if the action cannot be determined
+		path   string
+	}{
+		{name: "content", fields: []string{content}, action: ActionDisclosing},
+		{name: "content and message", fields: []string{content, message}, action: ActionSigning},
+		{name: "message", fields: []string{message}, action: ActionSigning},
+		{name: "credentials", fields: []string{credentials}, action: ActionIssuing},
+		{name: "credentials and disclose", fields: []string{credentials, disclose}, action: ActionIssuing},
+		{name: "explicit type", fields: []string{`"type": "signing"`, content, message}, action: ActionSigning},
+		{name: "explicit type without its fields", fields: []string{`"type": "signing"`}, action: ActionSigning},
+		{name: "null fields", fields: []string{content, `"credentials": null`, `"message": null`}, action: ActionDisclosing},
+		{name: "nothing", fields: nil, code: ValidationErrorMissingField, path: "type"},
+		{name: "only disclose", fields: []string{disclose}, code: ValidationErrorConflictingFields, path: "type"},
+		{name: "credentials and message", fields: []string{credentials, message}, code: ValidationErrorConflictingFields, path: "type"},
+		{name: "credentials and content", fields: []string{credentials, content}, code: ValidationErrorConflictingFields, path: "type"},
+		{name: "unknown type", fields: []string{`"type": "foo"`, content}, code: ValidationErrorInvalidValue, path: "type"},
+		{name: "disclosing with credentials", fields: []string{`"type": "disclosing"`, credentials}, code: ValidationErrorConflictingFields, path: "credentials"},
+		{name: "disclosing with message", fields: []string{`"type": "disclosing"`, content, message}, code: ValidationErrorConflictingFields, path: "message"},
+		{name: "issuing with content", fields: []string{`"type": "issuing"`, credentials, content}, code: ValidationErrorConflictingFields, path: "content"},
+		{name: "issuing with message", fields: []string{`"type": "issuing"`, credentials, message}, code: ValidationErrorConflictingFields, path: "message"},
+		{name: "signing with credentials", fields: []string{`"type": "signing"`, content, message, credentials}, code: ValidationErrorConflictingFields, path: "credentials"},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			request := "{" + strings.Join(tst.fields, ", ") + "}"
+			for _, wrapped := range []bool{false, true} {
+				bts, path := []byte(request), tst.path
+				if wrapped {
+					bts, path = []byte(`{"validity": 120, "request": `+request+"}"), "request."+tst.path
+				}
+				action, err := InferAction(bts)
+				if tst.action != "" {
+					require.NoError(t, err)
+					require.Equal(t, tst.action, action)
+					continue
+				}
+				require.IsType(t, &ValidationError{}, err)
+				problems := err.(*ValidationError).Problems
+				require.Len(t, problems, 1)
+				require.Equal(t, path, problems[0].Path)
+				require.Equal(t, tst.code, problems[0].Code)
+			}
+		})
+	}
+
+	// UnmarshalValidate sets the inferred type, if it matches the destination
+	request := &DisclosureRequest{}
+	require.NoError(t, UnmarshalValidate([]byte("{"+content+"}"), request))
+	require.Equal(t, ActionDisclosing, request.Type)
+	sigrequest := &SignatureRequest{}
+	require.NoError(t, UnmarshalValidate([]byte("{"+content+", "+message+"}"), sigrequest))
+	require.Equal(t, ActionSigning, sigrequest.Type)
+	issrequest := &IdentityProviderRequest{}
+	require.NoError(t, UnmarshalValidate([]byte(`{"request": {`+credentials+"}}"), issrequest))
+	require.Equal(t, ActionIssuing, issrequest.Request.Type)
+	require.Error(t, UnmarshalValidate([]byte("{"+content+", "+message+"}"), &DisclosureRequest{}))
+	require.Error(t, UnmarshalValidate([]byte("{"+credentials+"}"), &SignatureRequest{}))
+	require.Error(t, UnmarshalValidate([]byte(`{"type": "disclosing", `+content+", "+message+"}"), &SignatureRequest{}))
+}
+
+func TestIssuanceRequestReferences(t *testing.T) {
+	request := &IssuanceRequest{}
+	require.NoError(t, UnmarshalValidate([]byte(`{
+		"type": "issuing",
+		"credentials": [{
+			"credential": "irma-demo.RU.studentCard",
+			"attributes": {
+				"university": "$disclosed.irma-demo.RU.studentCard.university",
+				"studentCardNumber": "$disclosed.irma-demo.MijnOverheid.root.BSN",
+				"studentID": "s1234567",
+				"level": "42"
+			}
+		}],
+		"disclose": [
+			{"label": "BSN", "attributes": ["irma-demo.MijnOverheid.root.BSN"]},
+			{"label": "Student card", "attributes": ["irma-demo.RU.studentCard.*"]}
+		]
+	}`), request))
+	require.Equal(t, map[string]AttributeTypeIdentifier{
+		"university":        NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"),
+		"studentCardNumber": NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"),
+	}, request.Credentials[0].References())
+	require.NoError(t, request.Credentials[0].Validate(parseConfiguration(t)))
+
+	bsn, university := "299792458", "Radboud"
+	require.Error(t, request.ResolveReferences(map[AttributeTypeIdentifier]*string{
+		NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"): &bsn,
+	}))
+	require.NoError(t, request.ResolveReferences(map[AttributeTypeIdentifier]*string{
+		NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"):        &bsn,
+		NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"):    &university,
+		NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"):     nil,
+		NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.prefix"): nil,
+	}))
+	require.Equal(t, "299792458", request.Credentials[0].Attributes["studentCardNumber"])
+	require.Equal(t, "Radboud", request.Credentials[0].Attributes["university"])
+	require.Empty(t, request.Credentials[0].References())
+
+	// References must concern attributes that are requested to be disclosed
+	err := UnmarshalValidate([]byte(`{
+		"type": "issuing",
+		"credentials": [{
+			"credential": "irma-demo.MijnOverheid.root",
+			"attributes": {"BSN": "$disclosed.irma-demo.RU.studentCard.studentID"}
+		}],
+		"disclose": [{"label": "BSN", "attributes": ["irma-demo.MijnOverheid.root.BSN"]}]
+	}`), &IssuanceRequest{})
+	require.IsType(t, &ValidationError{}, err)
+	require.Equal(t, "credentials[0].attributes.BSN", err.(*ValidationError).Problems[0].Path)
+	require.Equal(t, ValidationErrorUnknownAttribute, err.(*ValidationError).Problems[0].Code)
+
+	err = UnmarshalValidate([]byte(`{
+		"type": "issuing",
+		"credentials": [{
+			"credential": "irma-demo.MijnOverheid.root",
+			"attributes": {"BSN": "$disclosed.irma-demo.MijnOverheid.root"}
+		}],
+		"disclose": [{"label": "BSN", "attributes": ["irma-demo.MijnOverheid.root.BSN"]}]
+	}`), &IssuanceRequest{})
+	require.IsType(t, &ValidationError{}, err)
+	require.Equal(t, ValidationErrorInvalidValue, err.(*ValidationError).Problems[0].Code)
+}
+
+func TestValidateAgainstConfiguration(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	request := &DisclosureRequest{}
+	require.NoError(t, UnmarshalValidate([]byte(`{"type": "disclosing", "content": [
+		{"label": "Student", "attributes": ["irma-demo.RU.studentCard.studentID", "irma-demo.RU.studentCard.foo"]},
+		{"label": "Unknown", "attributes": ["irma-demo.RU.foo.bar"]}
+	]}`), request))
+	err := ValidateAgainstConfiguration(request, conf)
+	require.IsType(t, &ValidationError{}, err)
+	problems := err.(*ValidationError).Problems
+	require.Len(t, problems, 2)
+	require.Equal(t, "content[0].attributes[1]", problems[0].Path)
+	require.Equal(t, ValidationErrorUnknownAttribute, problems[0].Code)
+	require.Equal(t, "content[1].attributes[0]", problems[1].Path)
+	require.Equal(t, ValidationErrorUnknownCredentialType, problems[1].Code)
+
+	issuance := &IssuanceRequest{}
+	require.NoError(t, UnmarshalValidate([]byte(`{"type": "issuing", "credentials": [
+		{"credential": "irma-demo.RU.studentCard", "attributes": {"university": "Radboud", "foo": "bar"}}
+	]}`), issuance))
+	err = ValidateAgainstConfiguration(issuance, conf)
+	require.IsType(t, &ValidationError{}, err)
+	problems = err.(*ValidationError).Problems
+	require.NotEmpty(t, problems)
+	require.Equal(t, "credentials[0].attributes.foo", problems[0].Path)
+	require.Equal(t, ValidationErrorUnknownAttribute, problems[0].Code)
+	for _, problem := range problems[1:] {
+		require.Equal(t, ValidationErrorMissingField, problem.Code)
+	}
+}
+
+func TestAttributeValueTypes(t *testing.T) {
+	v, err := AttributeValueTypeInteger.Parse("-42")
+	require.NoError(t, err)
+	require.Equal(t, int64(-42), v)
+	_, err = AttributeValueTypeInteger.Parse("42.0")
+	require.Error(t, err)
+	v, err = AttributeValueTypeDate.Parse("2019-05-31")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2019, 5, 31, 0, 0, 0, 0, time.UTC), v)
+	_, err = AttributeValueTypeDate.Parse("31-05-2019")
+	require.Error(t, err)
+	v, err = AttributeValueTypeBoolean.Parse("false")
+	require.NoError(t, err)
+	require.Equal(t, false, v)
+	_, err = AttributeValueTypeBoolean.Parse("yes")
+	require.Error(t, err)
+	v, err = AttributeValueType("unknown").Parse("yes")
+	require.NoError(t, err)
+	require.Equal(t, "yes", v)
+
+	// Issuance requests are validated against the declared types
+	conf := parseConfiguration(t)
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	level := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	require.Equal(t, AttributeValueTypeString, conf.AttributeTypes[level].ValueType())
+	request := &CredentialRequest{
+		CredentialTypeID: credid,
+		Attributes: map[string]string{
+			"university":        "Radboud",
+			"studentCardNumber": "31415927",
+			"studentID":         "s1234567",
+			"level":             "high",
+		},
+	}
+	require.NoError(t, request.Validate(conf))
+	conf.AttributeTypes[level].Type = AttributeValueTypeInteger
+	require.Error(t, request.Validate(conf))
+	request.Attributes["level"] = "42"
+	require.NoError(t, request.Validate(conf))
+
+	// Typed accessors and values of disclosed attributes
+	value := "42"
+	attr := &DisclosedAttribute{Identifier: level, RawValue: &value}
+	i, err := attr.IntValue()
+	require.NoError(t, err)
+	require.Equal(t, int64(42), i)
+	_, err = attr.DateValue()
+	require.Error(t, err)
+	SetTypedValues(conf, []*DisclosedAttribute{attr})
+	require.Equal(t, int64(42), attr.TypedValue)
+	_, err = (&DisclosedAttribute{Identifier: level}).IntValue()
+	require.Error(t, err)
+}
+
+func TestAttributeDerivation(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		dob       string
+		now       time.Time
+		expected  string
+	}{
+		{"birthday today", 18, "2000-10-15", time.Date(2018, 10, 15, 0, 0, 0, 0, time.UTC), "true"},
+		{"birthday tomorrow", 18, "2000-10-16", time.Date(2018, 10, 15, 23, 59, 59, 0, time.UTC), "false"},
+		{"birthday yesterday", 18, "2000-10-14", time.Date(2018, 10, 15, 0, 0, 0, 0, time.UTC), "true"},
+		{"dates in UTC", 18, "2000-10-16", time.Date(2018, 10, 16, 1, 0, 0, 0, time.FixedZone("CEST", 2*60*60)), "false"},
+		{"leap day, before birthday in non-leap year", 18, "2000-02-29", time.Date(2018, 2, 28, 0, 0, 0, 0, time.UTC), "false"},
+		{"leap day, birthday in non-leap year", 18, "2000-02-29", time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC), "true"},
+		{"leap day, before birthday in leap year", 20, "2000-02-29", time.Date(2020, 2, 28, 0, 0, 0, 0, time.UTC), "false"},
+		{"leap day, birthday in leap year", 20, "2000-02-29", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC), "true"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &AttributeDerivation{Source: "dateOfBirth", Operation: AttributeDerivationAgeThreshold, Threshold: test.threshold}
+			value, err := d.Derive(test.dob, test.now)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, value)
+		})
+	}
+
+	over18 := &AttributeDerivation{Source: "dateOfBirth", Operation: AttributeDerivationAgeThreshold, Threshold: 18}
+	_, err := over18.Derive("15-10-2000", time.Now())
+	require.Error(t, err)
+	custom := &AttributeDerivation{Source: "dateOfBirth", Operation: AttributeDerivationAgeThreshold, Threshold: 18, True: "yes", False: "no"}
+	value, err := custom.Derive("2000-10-16", time.Date(2018, 10, 15, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, "no", value)
+	_, err = (&AttributeDerivation{Source: "dateOfBirth", Operation: "unknown"}).Derive("2000-10-16", time.Now())
+	require.Error(t, err)
+
+	// Derived attributes are computed at issuance if omitted, and checked if present
+	conf := parseConfiguration(t)
+	credid := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.ageLimits")
+	require.True(t, conf.AttributeTypes[NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLimits.over18")].IsDerived())
+	dob := time.Now().AddDate(-30, 0, 0).Format(AttributeDateFormat)
+	request := &CredentialRequest{
+		CredentialTypeID: credid,
+		Attributes:       map[string]string{"dateOfBirth": dob},
+	}
+	require.NoError(t, request.Validate(conf))
+	list, err := request.AttributeList(conf, 0x03)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"dateOfBirth": dob, "over18": "true", "over65": "false"}, request.Attributes)
+	require.Equal(t, "true", *list.UntranslatedAttribute(NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLimits.over18")))
+
+	request.Attributes["over65"] = "true"
+	err = request.Validate(conf)
+	require.Error(t, err)
+	verr, ok := err.(*ValidationError)
+	require.True(t, ok)
+	require.Len(t, verr.Problems, 1)
+	require.Equal(t, "attributes.over65", verr.Problems[0].Path)
+	require.Equal(t, ValidationErrorConflictingFields, verr.Problems[0].Code)
+
+	// Without the source attribute the derived attributes cannot be omitted
+	request.Attributes = map[string]string{}
+	err = request.Validate(conf)
+	require.Error(t, err)
+	require.Len(t, err.(*ValidationError).Problems, 3)
+
+	// Derivations are checked when parsing the credential type
+	credtype := conf.CredentialTypes[credid]
+	require.NoError(t, conf.checkAttributes(credtype))
+	credtype.AttributeTypes[1].Derivation = &AttributeDerivation{Source: "over65", Operation: AttributeDerivationAgeThreshold, Threshold: 18}
+	require.Error(t, conf.checkAttributes(credtype))
+	credtype.AttributeTypes[1].Derivation = &AttributeDerivation{Source: "dateOfBirth", Operation: AttributeDerivationAgeThreshold}
+	require.Error(t, conf.checkAttributes(credtype))
+}
+
+func TestAbsentAttributeEncoding(t *testing.T) {
+	conf := parseConfiguration(t)
+	prefix := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.prefix")
+	request := &CredentialRequest{
+		CredentialTypeID: prefix.CredentialTypeIdentifier(),
+		Attributes: map[string]string{
+			"firstnames": "Johan Pieter",
+			"firstname":  "Johan",
+			"familyname": "Stuivezand",
+		},
+	}
+
+	absent, err := request.AttributeList(conf, 0x03)
+	require.NoError(t, err)
+	require.Nil(t, absent.UntranslatedAttribute(prefix))
+	require.Nil(t, absent.Info().Attributes[prefix])
+
+	request.Attributes["prefix"] = ""
+	empty, err := request.AttributeList(conf, 0x03)
+	require.NoError(t, err)
+	require.NotNil(t, empty.UntranslatedAttribute(prefix))
+	require.Equal(t, "", *empty.UntranslatedAttribute(prefix))
+	require.Equal(t, "", empty.Info().Attributes[prefix][""])
+
+	// Metadata version 2 cannot encode absent attributes
+	_, err = request.AttributeList(conf, 0x02)
+	require.NoError(t, err)
+	delete(request.Attributes, "prefix")
+	_, err = request.AttributeList(conf, 0x02)
+	require.Error(t, err)
+}
+
+func TestCredentialRequestValidity(t *testing.T) {
+	conf := parseConfiguration(t)
+	parse := func(json string) (*IssuanceRequest, error) {
+		request := &IssuanceRequest{}
+		err := UnmarshalValidate([]byte(`{"type":"issuing","credentials":[`+json+`]}`), request)
+		return request, err
+	}
+	const credential = `"credential":"irma-demo.RU.studentCard","attributes":{"university":"Radboud","studentCardNumber":"31415927","studentID":"s1234567","level":"42"}`
+
+	// Validity as RFC3339 date and as Unix timestamp
+	request, err := parse(`{"validity":"2029-01-01T12:00:00Z",` + credential + `}`)
+	require.NoError(t, err)
+	require.Equal(t, int64(1861963200), time.Time(*request.Credentials[0].Validity).Unix())
+	request, err = parse(`{"validity":1861963200,` + credential + `}`)
+	require.NoError(t, err)
+	require.Equal(t, int64(1861963200), time.Time(*request.Credentials[0].Validity).Unix())
+	request, err = parse(`{` + credential + `}`)
+	require.NoError(t, err)
+	require.Nil(t, request.Credentials[0].Validity)
+
+	// Malformed or past validity
+	_, err = parse(`{"validity":"2029-01-01",` + credential + `}`)
+	require.Error(t, err)
+	_, err = parse(`{"validity":true,` + credential + `}`)
+	require.Error(t, err)
+	_, err = parse(`{"validity":"2019-01-01T12:00:00Z",` + credential + `}`)
+	require.Error(t, err)
+
+	// Key counter: explicitly 0, absent, or negative
+	request, err = parse(`{"keyCounter":0,` + credential + `}`)
+	require.NoError(t, err)
+	require.True(t, request.Credentials[0].KeyCounterSpecified())
+	request, err = parse(`{` + credential + `}`)
+	require.NoError(t, err)
+	require.False(t, request.Credentials[0].KeyCounterSpecified())
+	_, err = parse(`{"keyCounter":-1,` + credential + `}`)
+	require.Error(t, err)
+
+	// The key must exist and not expire before the credential does
+	request, err = parse(`{"validity":"2029-01-01T12:00:00Z","keyCounter":2,` + credential + `}`)
+	require.NoError(t, err)
+	require.NoError(t, request.Credentials[0].ValidateKey(conf))
+	request, err = parse(`{"validity":"2031-01-01T12:00:00Z","keyCounter":2,` + credential + `}`)
+	require.NoError(t, err)
+	require.Error(t, request.Credentials[0].ValidateKey(conf))
+	request, err = parse(`{"validity":"2029-01-01T12:00:00Z","keyCounter":5,` + credential + `}`)
+	require.NoError(t, err)
+	require.Error(t, request.Credentials[0].ValidateKey(conf))
+	request, err = parse(`{"validity":"2029-01-01T12:00:00Z","keyCounter":0,` + credential + `}`)
+	require.NoError(t, err)
+	require.Error(t, request.Credentials[0].ValidateKey(conf))
+}
+
+func TestExpiryPolicy(t *testing.T) {
+	expiry := time.Now()
+	before, after := expiry.Add(-time.Hour), expiry.Add(time.Hour)
+
+	require.True(t, ExpiryPolicy{}.Accepts(expiry, before))
+	require.False(t, ExpiryPolicy{}.Accepts(expiry, after))
+	require.True(t, ExpiryPolicy{AcceptExpired: true}.Accepts(expiry, after.AddDate(10, 0, 0)))
+	require.True(t, ExpiryPolicy{AcceptExpired: true, MaxExpiredAge: 2 * time.Hour}.Accepts(expiry, after))
+	require.False(t, ExpiryPolicy{AcceptExpired: true, MaxExpiredAge: time.Minute}.Accepts(expiry, after))
+
+	// A default policy applies only to requests not specifying one
+	request := &DisclosureRequest{}
+	request.SetDefaultExpiryPolicy(ExpiryPolicy{AcceptExpired: true, MaxExpiredAge: time.Hour})
+	require.Equal(t, ExpiryPolicy{AcceptExpired: true, MaxExpiredAge: time.Hour}, request.ExpiryPolicy())
+	accept := false
+	request = &DisclosureRequest{BaseRequest: BaseRequest{AcceptExpired: &accept}}
+	request.SetDefaultExpiryPolicy(ExpiryPolicy{AcceptExpired: true})
+	require.Equal(t, ExpiryPolicy{}, request.ExpiryPolicy())
 }
 
 func TestMetadataAttribute(t *testing.T) {
@@ -228,6 +2186,222 @@ func TestMetadataCompatibility(t *testing.T) {
 	require.Equal(t, 2, attr.KeyCounter(), "Unexpected key counter")
 }
 
+func TestMetadataFields(t *testing.T) {
+	conf := parseConfiguration(t)
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	signed := FloorToEpochBoundary(time.Date(2016, 2, 1, 12, 0, 0, 0, time.UTC))
+
+	for _, version := range []byte{MetadataVersion2, MetadataVersion3} {
+		fields := &MetadataFields{
+			Version:          version,
+			SigningDate:      Timestamp(signed),
+			ValidityDuration: 52,
+			KeyCounter:       2,
+			CredentialTypeID: &credid,
+		}
+		attr, err := NewMetadataAttributeFromFields(fields, conf)
+		require.NoError(t, err)
+		require.Equal(t, version, attr.Version())
+		require.Equal(t, signed.Unix(), attr.SigningDate().Unix())
+		require.Equal(t, 2, attr.KeyCounter())
+		require.Equal(t, credid, attr.CredentialType().Identifier())
+
+		decoded, err := DecodeMetadata(new(big.Int).Set(attr.Int), conf)
+		require.NoError(t, err)
+		expected := &MetadataFields{
+			Version:            version,
+			SigningDate:        Timestamp(time.Unix(signed.Unix(), 0)),
+			ValidityDuration:   52,
+			Expiry:             Timestamp(time.Unix(signed.Unix()+52*ExpiryFactor, 0)),
+			KeyCounter:         2,
+			CredentialTypeHash: attr.CredentialTypeHash(),
+			CredentialTypeID:   &credid,
+		}
+		require.Equal(t, expected, decoded.Fields())
+
+		// JSON round trip, and reconstruction from the hash instead of the identifier
+		bts, err := json.Marshal(decoded.Fields())
+		require.NoError(t, err)
+		parsed := &MetadataFields{}
+		require.NoError(t, json.Unmarshal(bts, parsed))
+		require.Equal(t, expected, parsed)
+		parsed.CredentialTypeID = nil
+		rebuilt, err := NewMetadataAttributeFromFields(parsed, conf)
+		require.NoError(t, err)
+		require.Equal(t, attr.Int, rebuilt.Int)
+	}
+
+	// An actual metadata attribute of an IRMA credential extracted from the IRMA app
+	attr, err := DecodeMetadata(s2big("49043481832371145193140299771658227036446546573739245068"), conf)
+	require.NoError(t, err)
+	require.Equal(t,
+		"credential type irma-demo.RU.studentCard, signed 2017-07-13, expires 2018-01-18, key counter 2, version 2",
+		attr.Fields().String(),
+	)
+
+	// Fields that cannot be encoded
+	_, err = NewMetadataAttributeFromFields(&MetadataFields{Version: 3, KeyCounter: 1 << 16, CredentialTypeID: &credid}, conf)
+	require.Error(t, err)
+	_, err = NewMetadataAttributeFromFields(&MetadataFields{Version: 3, CredentialTypeHash: []byte{1, 2}}, conf)
+	require.Error(t, err)
+	_, err = NewMetadataAttributeFromFields(&MetadataFields{CredentialTypeID: &credid}, conf)
+	require.Error(t, err)
+
+	// Decoding errors
+	_, err = DecodeMetadata(new(big.Int), conf)
+	require.Equal(t, &MetadataError{Err: ErrorMalformedMetadata}, err)
+	_, err = DecodeMetadata(new(big.Int).Lsh(big.NewInt(1), 8*metadataLength), conf)
+	require.Equal(t, &MetadataError{Err: ErrorMalformedMetadata}, err)
+	unsupported, err := NewMetadataAttributeFromFields(&MetadataFields{Version: 9, CredentialTypeID: &credid}, conf)
+	require.NoError(t, err)
+	_, err = DecodeMetadata(unsupported.Int, conf)
+	require.IsType(t, &MetadataError{}, err)
+	require.Equal(t, ErrorUnsupportedMetadataVersion, err.(*MetadataError).Err)
+	unknown := NewCredentialTypeIdentifier("irma-demo.RU.unknownCard")
+	unknownAttr, err := NewMetadataAttributeFromFields(&MetadataFields{Version: 3, SigningDate: Timestamp(signed), CredentialTypeID: &unknown}, conf)
+	require.NoError(t, err)
+	_, err = DecodeMetadata(unknownAttr.Int, conf)
+	require.IsType(t, &MetadataError{}, err)
+	require.Equal(t, ErrorUnknownMetadataCredentialType, err.(*MetadataError).Err)
+	require.Contains(t, err.Error(), "unknown credential type")
+	require.Contains(t, err.Error(), "signed 2016-01-28")
+
+	// Proofs with an unknown public key are reported along with their metadata
+	missing, err := NewMetadataAttributeFromFields(&MetadataFields{Version: 3, SigningDate: Timestamp(signed), KeyCounter: 42, CredentialTypeID: &credid}, conf)
+	require.NoError(t, err)
+	_, err = ProofList{&gabi.ProofD{ADisclosed: map[int]*big.Int{1: missing.Int}}}.ExtractPublicKeys(conf)
+	require.True(t, IsMissingPublicKey(err))
+	require.Contains(t, err.Error(), "credential type irma-demo.RU.studentCard, signed 2016-01-28")
+	require.Contains(t, err.Error(), "key counter 42")
+}
+
+func TestMetadataCache(t *testing.T) {
+	conf, err := NewConfigurationReadOnly("testdata/irma_configuration")
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	i := s2big("49043481832371145193140299771658227036446546573739245068")
+
+	// Metadata attributes of the same value share their decoding
+	attr := MetadataFromInt(i, conf)
+	require.Equal(t, conf.CredentialTypes[credid], attr.CredentialType())
+	pk, err := attr.PublicKey()
+	require.NoError(t, err)
+	require.NotNil(t, pk)
+	other := MetadataFromInt(new(big.Int).Set(i), conf)
+	require.Equal(t, attr.Fields(), other.Fields())
+	require.True(t, attr.cached == other.cacheEntry())
+	otherpk, err := other.PublicKey()
+	require.NoError(t, err)
+	require.True(t, pk == otherpk)
+	require.Len(t, conf.metadataCache.entries, 1)
+
+	// Modifications of metadata attributes are noticed
+	other.setKeyCounter(1)
+	require.Equal(t, 1, other.KeyCounter())
+	require.Equal(t, 2, attr.KeyCounter())
+	require.Len(t, conf.metadataCache.entries, 2)
+
+	// Changes to the configuration invalidate the cache
+	require.NoError(t, conf.RemoveSchemeManager(NewSchemeManagerIdentifier("irma-demo"), false))
+	require.Nil(t, attr.CredentialType())
+	fresh, err := conf.Reparse()
+	require.NoError(t, err)
+	conf.replace(fresh)
+	require.NotNil(t, attr.CredentialType())
+	require.Equal(t, conf.CredentialTypes[credid], attr.CredentialType())
+	require.Equal(t, conf.hashToCredentialType(attr.CredentialTypeHash()), attr.CredentialType())
+
+	// The cache is bounded
+	for j := 0; j < metadataCacheSize+10; j++ {
+		MetadataFromInt(new(big.Int).Add(i, big.NewInt(int64(j))), conf).Version()
+	}
+	require.Len(t, conf.metadataCache.entries, metadataCacheSize)
+
+	// Concurrent use while the configuration is reloaded
+	var wg sync.WaitGroup
+	results := make([]bool, 8)
+	for j := range results {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			results[j] = true
+			for k := 0; k < 100; k++ {
+				attr := MetadataFromInt(i, conf)
+				_, err := attr.PublicKey()
+				results[j] = results[j] && err == nil && attr.KeyCounter() == 2
+			}
+		}(j)
+	}
+	for j := 0; j < 10; j++ {
+		conf.metadataCache.invalidate()
+	}
+	wg.Wait()
+	for _, ok := range results {
+		require.True(t, ok)
+	}
+}
+
+// BenchmarkMetadata compares decoding metadata attributes using the cache of their
+// Configuration with decoding them after invalidating the cache.
+func BenchmarkMetadata(b *testing.B) {
+	conf, err := NewConfigurationReadOnly("testdata/irma_configuration")
+	require.NoError(b, err)
+	require.NoError(b, conf.ParseFolder())
+	i := s2big("49043481832371145193140299771658227036446546573739245068")
+
+	for _, invalidate := range []bool{false, true} {
+		b.Run(fmt.Sprintf("invalidate=%t", invalidate), func(b *testing.B) {
+			for j := 0; j < b.N; j++ {
+				if invalidate {
+					conf.metadataCache.invalidate()
+				}
+				attr := MetadataFromInt(i, conf)
+				require.NotNil(b, attr.CredentialType())
+				_, err := attr.PublicKey()
+				require.NoError(b, err)
+				attr.Expiry()
+			}
+		})
+	}
+}
+
+func TestExtractPublicKeysCounters(t *testing.T) {
+	conf := parseConfiguration(t)
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	proof := func(counter int, signed time.Time) ProofList {
+		metadata, err := NewMetadataAttributeFromFields(&MetadataFields{
+			Version:          MetadataVersion3,
+			SigningDate:      Timestamp(signed),
+			ValidityDuration: 26,
+			KeyCounter:       counter,
+			CredentialTypeID: &credid,
+		}, conf)
+		require.NoError(t, err)
+		return ProofList{&gabi.ProofD{ADisclosed: map[int]*big.Int{1: metadata.Int}}}
+	}
+
+	// The public key is selected using the counter in the metadata attribute, not the latest one
+	pks, err := proof(2, time.Now()).ExtractPublicKeys(conf)
+	require.NoError(t, err)
+	require.Equal(t, 2, pks[0].Counter)
+	// Key 1 expired on 2017-04-06, but was valid when this credential was signed
+	pks, err = proof(1, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)).ExtractPublicKeys(conf)
+	require.NoError(t, err)
+	require.Equal(t, 1, pks[0].Counter)
+
+	// Key 1 had expired when this credential was signed
+	_, err = proof(1, time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)).ExtractPublicKeys(conf)
+	require.True(t, IsExpiredPublicKey(err))
+	require.False(t, IsMissingPublicKey(err))
+	require.Contains(t, err.Error(), "key counter 1")
+
+	// Unknown key
+	_, err = proof(42, time.Now()).ExtractPublicKeys(conf)
+	require.True(t, IsMissingPublicKey(err))
+	require.False(t, IsExpiredPublicKey(err))
+}
+
 func TestTimestamp(t *testing.T) {
 	mytime := Timestamp(time.Unix(1500000000, 0))
 	timestruct := struct{ Time *Timestamp }{Time: &mytime}
@@ -239,6 +2413,68 @@ func TestTimestamp(t *testing.T) {
 	require.Equal(t, time.Time(*timestruct.Time).Unix(), int64(1500000000))
 }
 
+func TestParseCredentialTypeDeprecation(t *testing.T) {
+	credtype := &CredentialType{}
+	require.NoError(t, xml.Unmarshal([]byte(`<IssueSpecification version="4"><DeprecatedSince>
+		1500000000
+	</DeprecatedSince></IssueSpecification>`), credtype))
+	require.NotNil(t, credtype.DeprecatedSince)
+	require.Equal(t, int64(1500000000), time.Time(*credtype.DeprecatedSince).Unix())
+	require.False(t, credtype.IsDeprecatedAt(Timestamp(time.Unix(1499999999, 0))))
+	require.True(t, credtype.IsDeprecatedAt(Timestamp(time.Unix(1500000000, 0))))
+
+	// Credential types without DeprecatedSince are never deprecated
+	conf := parseConfiguration(t)
+	credtype = conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")]
+	require.Nil(t, credtype.DeprecatedSince)
+	require.False(t, credtype.IsDeprecatedAt(Timestamp(time.Now())))
+}
+
+func TestParseDisplayMetadata(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	credtype := conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")]
+	require.NotNil(t, credtype)
+	require.Equal(t, "Personal data", credtype.Category["en"])
+	var order []string
+	for _, attr := range credtype.AttributesInDisplayOrder() {
+		order = append(order, attr.ID)
+	}
+	require.Equal(t, []string{"firstname", "prefix", "familyname", "firstnames"}, order)
+	require.Equal(t, "firstnames", credtype.AttributeTypes[0].ID) // declaration order is unaffected
+
+	// Without displayIndex attributes are displayed in declaration order
+	studentCard := conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")]
+	require.Equal(t, studentCard.AttributeTypes, studentCard.AttributesInDisplayOrder())
+	require.Nil(t, studentCard.Category)
+
+	// Logo paths are absolute and exist
+	issuer := conf.Issuers[NewIssuerIdentifier("irma-demo.MijnOverheid")]
+	for _, path := range []string{credtype.LogoPath, issuer.LogoPath} {
+		require.True(t, filepath.IsAbs(path))
+		exists, err := fs.PathExists(path)
+		require.NoError(t, err)
+		require.True(t, exists)
+	}
+	require.Equal(t, "MijnOverheid", filepath.Base(filepath.Dir(issuer.LogoPath)))
+
+	// JSON includes the attributes in display order
+	bts, err := json.Marshal(credtype)
+	require.NoError(t, err)
+	var parsed struct {
+		Category   TranslatedString
+		LogoPath   string
+		Attributes []struct{ ID string }
+	}
+	require.NoError(t, json.Unmarshal(bts, &parsed))
+	require.Equal(t, credtype.Category, parsed.Category)
+	require.Equal(t, credtype.LogoPath, parsed.LogoPath)
+	require.Len(t, parsed.Attributes, len(order))
+	for i, attr := range parsed.Attributes {
+		require.Equal(t, order[i], attr.ID)
+	}
+}
+
 func TestServiceProvider(t *testing.T) {
 	var spjwt ServiceProviderJwt
 
@@ -266,10 +2502,85 @@ func TestServiceProvider(t *testing.T) {
 	require.NotNil(t, spjwt.Request.Request.Content.Find(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
 }
 
+func TestParseLegacyRequestorJwt(t *testing.T) {
+	key := []byte("legacy requestor key")
+	for _, name := range []string{"disclosure", "dprequest", "signature", "issuance"} {
+		t.Run(name, func(t *testing.T) {
+			// Captured JWT payload of the irma_api_server, re-signed with a test key
+			payload, err := ioutil.ReadFile(filepath.Join("testdata", "golden", "legacyjwt", name+".legacy.json"))
+			require.NoError(t, err)
+			decoder := json.NewDecoder(bytes.NewReader(payload))
+			decoder.UseNumber()
+			claims := jwt.MapClaims{}
+			require.NoError(t, decoder.Decode(&claims))
+			legacyJwt, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+			require.NoError(t, err)
+
+			parsed, err := ParseRequestorJwt(claims["sub"].(string), legacyJwt)
+			require.NoError(t, err)
+			rrequest := parsed.RequestorRequest()
+			require.NoError(t, rrequest.Validate())
+			require.True(t, rrequest.Base().Legacy)
+			require.Equal(t, claims["iss"], parsed.Requestor())
+
+			// The converted request should be equivalent to the native one
+			var expected RequestorRequest
+			switch parsed.Action() {
+			case ActionDisclosing:
+				expected = &ServiceProviderRequest{}
+			case ActionSigning:
+				expected = &SignatureRequestorRequest{}
+			case ActionIssuing:
+				expected = &IdentityProviderRequest{}
+			}
+			native, err := ioutil.ReadFile(filepath.Join("testdata", "golden", "legacyjwt", name+".json"))
+			require.NoError(t, err)
+			require.NoError(t, UnmarshalValidate(native, expected))
+			require.False(t, expected.Base().Legacy)
+			expectedJson, err := json.Marshal(expected)
+			require.NoError(t, err)
+			actualJson, err := json.Marshal(rrequest)
+			require.NoError(t, err)
+			require.JSONEq(t, string(expectedJson), string(actualJson))
+			require.Equal(t, expected.Base().ResultJwtValidity, rrequest.Base().ResultJwtValidity)
+
+			// Signing the converted request results in a current JWT, which is not legacy
+			currentJwt, err := SignRequestorRequest(rrequest, jwt.SigningMethodHS256, key, parsed.Requestor())
+			require.NoError(t, err)
+			reparsed, err := ParseRequestorJwt(string(parsed.Action()), currentJwt)
+			require.NoError(t, err)
+			require.False(t, reparsed.RequestorRequest().Base().Legacy)
+			reparsedJson, err := json.Marshal(reparsed.RequestorRequest())
+			require.NoError(t, err)
+			require.JSONEq(t, string(expectedJson), string(reparsedJson))
+		})
+	}
+
+	// A legacy request of which the type contradicts the JWT is rejected
+	legacyJwt, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "verification_request",
+		"iss": "testsp",
+		"iat": 1500000000,
+		"dprequest": map[string]interface{}{
+			"request": map[string]interface{}{
+				"type":    "issuing",
+				"content": []interface{}{map[string]interface{}{"label": "Student number", "attributes": []string{"irma-demo.RU.studentCard.studentID"}}},
+			},
+		},
+	}).SignedString(key)
+	require.NoError(t, err)
+	_, err = ParseRequestorJwt("verification_request", legacyJwt)
+	require.Error(t, err)
+}
+
+// validSignedMessageJSON is an attribute-based signature over irma-demo.RU.studentCard.studentID
+// using public key 2 of irma-demo.RU.
+const validSignedMessageJSON = "{\"signature\":[{\"c\":\"pliyrSE7wXcDcKXuBtZW5bnucvBSXpILIRvnNBgx7hQ=\",\"A\":\"D/8wLPq9860bpXZ5c+VYyoPJ+Z8CWDZNQ0jXvst8qnPRdivy/GQIfJHjVnpOPlHbguphb/7JVbfcV3bZeybA3bCF/4UesjRUZlMf/iJ/QgKHbt41ogN1PPT5z7qBJpkxuNTIkHxaUPoDvhouHmuC9pNj4afRUyLJerxKPkpdBw0=\",\"e_response\":\"YOrKTrMSs4/QOUtPkT0YaYNEmW7Cs+cu624zr2xrHodyL88ub6yaXB7MGHAcQ1+iXsGN8jkfxB/0\",\"v_response\":\"AYSa1p8ISs//MsocJjODwWuPB/z6+iKHHi+sTToRs0eJ2X1gwmWoA5QB0aHjRkWye3/+2rtosfUzI77FlPQVnrbMERwcuYM/fx3fpNCpjm2qcs3AOJRcSRxcNFMe1+4ECsmJhByMDutS1KXAAKiNvnhEXx9f0JrQGwQFtpSFPh8dOuvEKUZHAUALr4FcHCa2HL9nDRiqy2KAOxE0nAANAcMaBo/ed+WZeHtv4CTB7egyYs27cklVbwlBzmRrbjNZk57ICd0jVd6SZ2Ir93r/aPejkyhQ03xh9RVVyhOn4bkbjKIBzEybXTJAXgNmvd6F8Ds00srBZVWlo7Z23JZ7\",\"a_responses\":{\"0\":\"QHTznWWrECRNNmUNcy0yGu2L6qsZU6qkvaII8QB8QjbUxpwHzSeJWkzrn/Kk1KIowfoqB1DKGaFLATvuBl+bCoJjea+2VfK9Ns8=\",\"2\":\"H57Y9CTXJ5MAVo+aFfNSbmRMFQpraBIZVOXiRxCD/P7Aw4fW8r9P5l9pO9DTUeExaqFzsLyF5i5EridVWxlP2Wv0zbH8ku9Sg9w=\",\"3\":\"joggAmOhqM4QsKdoLHAfaslzXqJswS7MwZ/5+AKYdkMaHQ45biMdZU/6R+B7bjvsumg2f6KyTyg0G+BI+wVdJOjh3kGezdANB7Y=\",\"5\":\"5YP4A82WWeqc33e5Zg/Q8lqQQ1amLE8mOxMwCXb3N4J0UJRfV9lUFvbH1Q3Yb3YHAZpzGvhN/pBacwqktMkP4L71PnMldqA+nqA=\"},\"a_disclosed\":{\"1\":\"AgAJuwB+AALWy2qU9p3l52l9LU1rVT4M\",\"4\":\"NDU2\"}}],\"nonce\":\"Kg==\",\"context\":\"BTk=\",\"message\":\"I owe you everything\",\"timestamp\":{\"Time\":1527196489,\"ServerUrl\":\"https://metrics.privacybydesign.foundation/atum\",\"Sig\":{\"Alg\":\"ed25519\",\"Data\":\"ZV1qkvDrFK14QrUSC66xTNr9HitCOV4vwfGX0bh3iwY7qyHCi9rIOE97KY8CZifU5oLgVhFWy5E+ALR+gEpACw==\",\"PublicKey\":\"e/nMAJF7nwrvNZRpuJljNpRx+CsT7caaXyn9OX683R8=\"}}}"
+
 func TestVerifyValidSig(t *testing.T) {
 	conf := parseConfiguration(t)
 
-	irmaSignedMessageJson := "{\"signature\":[{\"c\":\"pliyrSE7wXcDcKXuBtZW5bnucvBSXpILIRvnNBgx7hQ=\",\"A\":\"D/8wLPq9860bpXZ5c+VYyoPJ+Z8CWDZNQ0jXvst8qnPRdivy/GQIfJHjVnpOPlHbguphb/7JVbfcV3bZeybA3bCF/4UesjRUZlMf/iJ/QgKHbt41ogN1PPT5z7qBJpkxuNTIkHxaUPoDvhouHmuC9pNj4afRUyLJerxKPkpdBw0=\",\"e_response\":\"YOrKTrMSs4/QOUtPkT0YaYNEmW7Cs+cu624zr2xrHodyL88ub6yaXB7MGHAcQ1+iXsGN8jkfxB/0\",\"v_response\":\"AYSa1p8ISs//MsocJjODwWuPB/z6+iKHHi+sTToRs0eJ2X1gwmWoA5QB0aHjRkWye3/+2rtosfUzI77FlPQVnrbMERwcuYM/fx3fpNCpjm2qcs3AOJRcSRxcNFMe1+4ECsmJhByMDutS1KXAAKiNvnhEXx9f0JrQGwQFtpSFPh8dOuvEKUZHAUALr4FcHCa2HL9nDRiqy2KAOxE0nAANAcMaBo/ed+WZeHtv4CTB7egyYs27cklVbwlBzmRrbjNZk57ICd0jVd6SZ2Ir93r/aPejkyhQ03xh9RVVyhOn4bkbjKIBzEybXTJAXgNmvd6F8Ds00srBZVWlo7Z23JZ7\",\"a_responses\":{\"0\":\"QHTznWWrECRNNmUNcy0yGu2L6qsZU6qkvaII8QB8QjbUxpwHzSeJWkzrn/Kk1KIowfoqB1DKGaFLATvuBl+bCoJjea+2VfK9Ns8=\",\"2\":\"H57Y9CTXJ5MAVo+aFfNSbmRMFQpraBIZVOXiRxCD/P7Aw4fW8r9P5l9pO9DTUeExaqFzsLyF5i5EridVWxlP2Wv0zbH8ku9Sg9w=\",\"3\":\"joggAmOhqM4QsKdoLHAfaslzXqJswS7MwZ/5+AKYdkMaHQ45biMdZU/6R+B7bjvsumg2f6KyTyg0G+BI+wVdJOjh3kGezdANB7Y=\",\"5\":\"5YP4A82WWeqc33e5Zg/Q8lqQQ1amLE8mOxMwCXb3N4J0UJRfV9lUFvbH1Q3Yb3YHAZpzGvhN/pBacwqktMkP4L71PnMldqA+nqA=\"},\"a_disclosed\":{\"1\":\"AgAJuwB+AALWy2qU9p3l52l9LU1rVT4M\",\"4\":\"NDU2\"}}],\"nonce\":\"Kg==\",\"context\":\"BTk=\",\"message\":\"I owe you everything\",\"timestamp\":{\"Time\":1527196489,\"ServerUrl\":\"https://metrics.privacybydesign.foundation/atum\",\"Sig\":{\"Alg\":\"ed25519\",\"Data\":\"ZV1qkvDrFK14QrUSC66xTNr9HitCOV4vwfGX0bh3iwY7qyHCi9rIOE97KY8CZifU5oLgVhFWy5E+ALR+gEpACw==\",\"PublicKey\":\"e/nMAJF7nwrvNZRpuJljNpRx+CsT7caaXyn9OX683R8=\"}}}"
+	irmaSignedMessageJson := validSignedMessageJSON
 	irmaSignedMessage := &SignedMessage{}
 	json.Unmarshal([]byte(irmaSignedMessageJson), irmaSignedMessage)
 
@@ -307,6 +2618,395 @@ func TestVerifyValidSig(t *testing.T) {
 	require.Equal(t, attrs[0].Value["en"], "456")
 }
 
+func TestVerifyProofStatusReasons(t *testing.T) {
+	conf := parseConfiguration(t)
+	studentID := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	wrongID := "123"
+
+	// Replaces the metadata attribute of the signature by one with the specified key counter and signing date
+	setMetadata := func(counter int, signed time.Time) func(*SignedMessage, *SignatureRequest) {
+		return func(msg *SignedMessage, _ *SignatureRequest) {
+			proofd := msg.Signature[0].(*gabi.ProofD)
+			fields := MetadataFromInt(proofd.ADisclosed[1], conf).Fields()
+			fields.KeyCounter = counter
+			fields.SigningDate = Timestamp(signed)
+			metadata, err := NewMetadataAttributeFromFields(fields, conf)
+			require.NoError(t, err)
+			proofd.ADisclosed[1] = metadata.Int
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*SignedMessage, *SignatureRequest)
+		status ProofStatus
+		reason ProofStatusReason
+	}{
+		{"valid", func(*SignedMessage, *SignatureRequest) {},
+			ProofStatusValid, ProofStatusReasonNone},
+		{"invalid proof", func(msg *SignedMessage, _ *SignatureRequest) {
+			msg.Signature[0].(*gabi.ProofD).C = big.NewInt(42)
+		}, ProofStatusInvalid, ProofStatusReasonInvalidProof},
+		{"unknown public key", setMetadata(42, time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)),
+			ProofStatusInvalid, ProofStatusReasonUnknownPublicKey},
+		{"expired public key", setMetadata(1, time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)),
+			ProofStatusInvalid, ProofStatusReasonExpiredPublicKey},
+		{"malformed metadata", func(msg *SignedMessage, _ *SignatureRequest) {
+			msg.Signature[0].(*gabi.ProofD).ADisclosed[1] = big.NewInt(0)
+		}, ProofStatusInvalid, ProofStatusReasonMalformedMetadata},
+		{"nonce mismatch", func(_ *SignedMessage, req *SignatureRequest) {
+			req.Nonce = big.NewInt(43)
+		}, ProofStatusUnmatchedRequest, ProofStatusReasonNonceMismatch},
+		{"context mismatch", func(_ *SignedMessage, req *SignatureRequest) {
+			req.Context = big.NewInt(1338)
+		}, ProofStatusUnmatchedRequest, ProofStatusReasonUnmatchedRequest},
+		{"message mismatch", func(_ *SignedMessage, req *SignatureRequest) {
+			req.Message = "I owe you nothing"
+		}, ProofStatusUnmatchedRequest, ProofStatusReasonMessageMismatch},
+		{"message substitution", func(msg *SignedMessage, _ *SignatureRequest) {
+			msg.Message = "I owe you nothing"
+		}, ProofStatusUnmatchedRequest, ProofStatusReasonMessageMismatch},
+		{"missing attributes", func(_ *SignedMessage, req *SignatureRequest) {
+			req.Content = append(req.Content, &AttributeDisjunction{
+				Label:      "Level",
+				Attributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")},
+			})
+		}, ProofStatusMissingAttributes, ProofStatusReasonMissingAttributes},
+		{"unsatisfied condition", func(_ *SignedMessage, req *SignatureRequest) {
+			req.Content[0].Values = map[AttributeTypeIdentifier]*string{studentID: &wrongID}
+		}, ProofStatusUnsatisfiedCondition, ProofStatusReasonUnsatisfiedCondition},
+	}
+
+	setup := func(modify func(*SignedMessage, *SignatureRequest)) (*SignedMessage, *SignatureRequest) {
+		msg := &SignedMessage{}
+		require.NoError(t, json.Unmarshal([]byte(validSignedMessageJSON), msg))
+		request := &SignatureRequest{}
+		require.NoError(t, json.Unmarshal([]byte("{\"nonce\": \"Kg==\", \"context\": \"BTk=\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]}]}"), request))
+		modify(msg, request)
+		return msg, request
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, request := setup(test.modify)
+			_, status, reason, _ := msg.VerifyWithReason(conf, request)
+			require.Equal(t, test.status, status)
+			require.Equal(t, test.reason, reason)
+
+			// Verify() reports the same status
+			msg, request = setup(test.modify)
+			_, status, _ = msg.Verify(conf, request)
+			require.Equal(t, test.status, status)
+		})
+	}
+}
+
+func TestSignedMessageSubstitution(t *testing.T) {
+	conf := parseConfiguration(t)
+	message := "I owe you everything"
+	parse := func() (*SignedMessage, *SignatureRequest) {
+		msg := &SignedMessage{}
+		require.NoError(t, json.Unmarshal([]byte(validSignedMessageJSON), msg))
+		request := &SignatureRequest{}
+		require.NoError(t, json.Unmarshal([]byte("{\"nonce\": \"Kg==\", \"context\": \"BTk=\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]}]}"), request))
+		return msg, request
+	}
+
+	for i := 0; i < len(message); i++ {
+		mutated := []byte(message)
+		mutated[i] ^= 1
+
+		// The proofs do not verify against another message
+		msg, _ := parse()
+		msg.Message = string(mutated)
+		_, status, _, _ := msg.VerifyWithReason(conf, nil)
+		require.Equal(t, ProofStatusInvalid, status, "byte %d", i)
+
+		// Against a request, the substitution is reported as such
+		msg, request := parse()
+		msg.Message = string(mutated)
+		_, status, reason, err := msg.VerifyWithReason(conf, request)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusUnmatchedRequest, status, "byte %d", i)
+		require.Equal(t, ProofStatusReasonMessageMismatch, reason, "byte %d", i)
+
+		// Also when the request is for the substituted message
+		msg, request = parse()
+		msg.Message = string(mutated)
+		request.Message = string(mutated)
+		_, status, reason, err = msg.VerifyWithReason(conf, request)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusInvalid, status, "byte %d", i)
+		require.Equal(t, ProofStatusReasonInvalidProof, reason, "byte %d", i)
+
+		// and for detached signed messages
+		msg, request = parse()
+		msg.Detach()
+		request.Message = string(mutated)
+		_, status, reason, err = msg.VerifyWithReason(conf, request)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusUnmatchedRequest, status, "byte %d", i)
+		require.Equal(t, ProofStatusReasonMessageMismatch, reason, "byte %d", i)
+		_, status, err = msg.VerifyDetached(conf, nil, mutated)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusUnmatchedRequest, status, "byte %d", i)
+	}
+}
+
+func TestSignedMessageValidity(t *testing.T) {
+	conf := parseConfiguration(t)
+	parse := func() (*SignedMessage, *SignatureRequest) {
+		msg := &SignedMessage{}
+		require.NoError(t, json.Unmarshal([]byte(validSignedMessageJSON), msg))
+		request := &SignatureRequest{}
+		require.NoError(t, json.Unmarshal([]byte("{\"nonce\": \"Kg==\", \"context\": \"BTk=\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]}]}"), request))
+		return msg, request
+	}
+
+	// The signature was timestamped in 2018, before its credential expired on 2020-02-27
+	msg, request := parse()
+	validity, err := msg.VerifyValidity(conf, request)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, validity.Status)
+	require.True(t, validity.Valid)
+	require.True(t, validity.UnexpiredAtSigning)
+	require.False(t, validity.UnexpiredNow)
+	require.Equal(t, Timestamp(time.Unix(1527196489, 0)), *validity.SigningTime)
+	require.Equal(t, Timestamp(time.Date(2020, 2, 27, 0, 0, 0, 0, time.UTC)), *validity.Expires)
+	require.Len(t, validity.Disclosed, 1)
+	require.False(t, validity.Disclosed[0].Expired)
+
+	// Invalid signatures have none of the facets
+	msg, request = parse()
+	request.Message = "I owe you nothing"
+	validity, err = msg.VerifyValidity(conf, request)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusUnmatchedRequest, validity.Status)
+	require.Equal(t, ProofStatusReasonMessageMismatch, validity.Reason)
+	require.False(t, validity.Valid)
+	require.False(t, validity.UnexpiredAtSigning)
+	require.False(t, validity.UnexpiredNow)
+	require.Nil(t, validity.SigningTime)
+}
+
+func TestMultiSignedMessage(t *testing.T) {
+	conf := parseConfiguration(t)
+	parse := func() *SignedMessage {
+		sm := &SignedMessage{}
+		require.NoError(t, json.Unmarshal([]byte(validSignedMessageJSON), sm))
+		return sm
+	}
+
+	msm, err := NewMultiSignedMessage("I owe you everything", "")
+	require.NoError(t, err)
+	require.NotNil(t, msm.Context)
+	request := msm.SignatureRequest(AttributeDisjunctionList{{
+		Label:      "Student number (RU)",
+		Attributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+	}})
+	require.Equal(t, msm.Context, request.Context)
+	require.Equal(t, msm.Message, request.Message)
+
+	// The test signature has context 1337
+	require.Error(t, msm.Add(parse()))
+	msm.Context = big.NewInt(1337)
+	require.NoError(t, msm.Add(parse()))
+	detached := parse()
+	detached.Detach()
+	require.NoError(t, msm.Add(detached))
+	other := parse()
+	other.Message = "I owe you nothing"
+	require.Error(t, msm.Add(other))
+	require.Len(t, msm.Signatures, 2)
+
+	bts, err := json.Marshal(msm)
+	require.NoError(t, err)
+	parsed := &MultiSignedMessage{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	results, err := parsed.Verify(conf, nil)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	for _, result := range results {
+		require.Equal(t, ProofStatusValid, result.Status)
+		require.Equal(t, "456", *result.Disclosed[0].RawValue)
+	}
+
+	// Signatures that were modified after adding them do not verify
+	parsed.Signatures[1].MessageDigest = strings.Repeat("00", 32)
+	parsed.Signatures = append(parsed.Signatures, other)
+	_, err = parsed.Verify(conf, []*SignatureRequest{nil})
+	require.Error(t, err)
+	results, err = parsed.Verify(conf, nil)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, results[0].Status)
+	require.Equal(t, ProofStatusUnmatchedRequest, results[1].Status)
+	require.Equal(t, ProofStatusReasonMessageMismatch, results[1].Reason)
+	require.Equal(t, ProofStatusUnmatchedRequest, results[2].Status)
+}
+
+func TestSignedMessageVersions(t *testing.T) {
+	conf := parseConfiguration(t)
+	request := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal([]byte(`{"nonce": "Kg==", "context": "BTk=", "message": "I owe you everything", "content": [{"label": "Student number (RU)", "attributes": ["irma-demo.RU.studentCard.studentID"]}]}`), request))
+
+	golden := func(version int) []byte {
+		bts, err := ioutil.ReadFile(filepath.Join("testdata", "golden", "signedmessage", fmt.Sprintf("v%d.json", version)))
+		require.NoError(t, err)
+		return bts
+	}
+	v0, v1 := golden(0), golden(1)
+
+	// Signatures of both versions verify
+	for _, bts := range [][]byte{v0, v1} {
+		msg := &SignedMessage{}
+		require.NoError(t, json.Unmarshal(bts, msg))
+		_, status, err := msg.Verify(conf, request)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusValid, status)
+	}
+
+	// Unversioned signatures are read as version 0, and written as the current version
+	msg := &SignedMessage{}
+	require.NoError(t, json.Unmarshal(v0, msg))
+	require.Nil(t, msg.Request)
+	msg.Request = &SignedMessageRequest{Content: request.Content}
+	bts, err := json.Marshal(msg)
+	require.NoError(t, err)
+	require.JSONEq(t, string(v1), string(bts))
+
+	// Version 1 survives a roundtrip, including the request excerpt
+	msg = &SignedMessage{}
+	require.NoError(t, json.Unmarshal(v1, msg))
+	require.Equal(t, SignedMessageTypeString, msg.MessageType)
+	require.Equal(t, "Student number (RU)", msg.Request.Content[0].Label)
+	bts, err = json.Marshal(msg)
+	require.NoError(t, err)
+	require.JSONEq(t, string(v1), string(bts))
+
+	// Unknown versions and message types are rejected
+	require.Error(t, json.Unmarshal([]byte(`{"version": 2, "message": "foo", "messageType": "STRING"}`), &SignedMessage{}))
+	require.Error(t, json.Unmarshal([]byte(`{"version": 1, "message": "foo", "messageType": "HTML"}`), &SignedMessage{}))
+}
+
+func TestSignatureRequestMessageType(t *testing.T) {
+	doc, err := NewSignedDocument(strings.NewReader("I owe you everything"), "iou.txt", "text/plain")
+	require.NoError(t, err)
+	require.Equal(t, int64(20), doc.Size)
+	message, err := doc.Message()
+	require.NoError(t, err)
+
+	request := &SignatureRequest{
+		DisclosureRequest: DisclosureRequest{
+			BaseRequest: BaseRequest{Type: ActionSigning},
+			Content: AttributeDisjunctionList{{
+				Label:      "Student number",
+				Attributes: []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+			}},
+		},
+		Message:     message,
+		MessageType: SignedMessageTypeSHA256,
+	}
+	require.NoError(t, request.Validate())
+	parsed, err := request.SignedDocument()
+	require.NoError(t, err)
+	require.Equal(t, doc, parsed)
+	matches, err := parsed.Matches(strings.NewReader("I owe you everything"))
+	require.NoError(t, err)
+	require.True(t, matches)
+	matches, err = parsed.Matches(strings.NewReader("I owe you nothing"))
+	require.NoError(t, err)
+	require.False(t, matches)
+
+	// The message must be a document digest
+	request.Message = `{"sha256": "deadbeef"}`
+	require.Error(t, request.Validate())
+	request.Message = "I owe you everything"
+	require.Error(t, request.Validate())
+
+	// Unknown message types are rejected
+	request.MessageType = "HTML"
+	require.Error(t, request.Validate())
+	request.MessageType = SignedMessageTypeString
+	require.NoError(t, request.Validate())
+	parsed, err = request.SignedDocument()
+	require.NoError(t, err)
+	require.Nil(t, parsed)
+}
+
+func TestVerifySigWithRequestUnbound(t *testing.T) {
+	conf := parseConfiguration(t)
+	sm := &SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(validSignedMessageJSON), sm))
+	require.Nil(t, sm.Request)
+
+	request := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal([]byte("{\"nonce\": \"Kg==\", \"context\": \"BTk=\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]}]}"), request))
+	results, status, err := VerifySigWithRequest(conf, sm, request)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, status)
+	require.Len(t, results, 1)
+	require.True(t, results[0].Satisfied)
+	require.Equal(t, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), *results[0].Attribute)
+	require.Equal(t, "456", *results[0].RawValue)
+
+	// Conditions are not bound into version 0 signatures, but messages are
+	request.Message = "I owe you nothing"
+	results, status, err = VerifySigWithRequest(conf, sm, request)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusUnmatchedRequest, status)
+	require.Nil(t, results)
+}
+
+func TestDetachedSignedMessage(t *testing.T) {
+	conf := parseConfiguration(t)
+	sm := &SignedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(validSignedMessageJSON), sm))
+	nonce := sm.GetNonce()
+	sm.Detach()
+	require.True(t, sm.IsDetached())
+	require.Empty(t, sm.Message)
+	require.Equal(t, len("I owe you everything"), sm.MessageLength)
+	require.Equal(t, nonce, sm.GetNonce())
+
+	// Without its message a detached signed message cannot be verified
+	_, _, err := sm.Verify(conf, nil)
+	require.Equal(t, ErrorMissingDetachedMessage, err)
+
+	// The message may be supplied by the request
+	request := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal([]byte("{\"nonce\": \"Kg==\", \"context\": \"BTk=\", \"message\":\"I owe you everything\",\"content\":[{\"label\":\"Student number (RU)\",\"attributes\":[\"irma-demo.RU.studentCard.studentID\"]}]}"), request))
+	_, status, err := sm.Verify(conf, request)
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, status)
+
+	// or separately
+	_, status, err = sm.VerifyDetached(conf, nil, []byte("I owe you everything"))
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, status)
+	_, status, err = sm.VerifyDetached(conf, nil, []byte("I owe you nothing"))
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusUnmatchedRequest, status)
+	digest := sha256.Sum256([]byte("I owe you everything"))
+	_, status, err = sm.VerifyDetachedDigest(conf, nil, digest[:])
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, status)
+
+	// The message is omitted from the JSON serialization
+	bts, err := json.Marshal(sm)
+	require.NoError(t, err)
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(bts, &fields))
+	require.NotContains(t, fields, "message")
+	require.Equal(t, hex.EncodeToString(digest[:]), fields["messageDigest"])
+	require.Equal(t, float64(20), fields["messageLength"])
+	parsed := &SignedMessage{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	require.Equal(t, sm.MessageDigest, parsed.MessageDigest)
+	_, status, err = parsed.VerifyDetached(conf, nil, []byte("I owe you everything"))
+	require.NoError(t, err)
+	require.Equal(t, ProofStatusValid, status)
+}
+
 func TestVerifyInValidSig(t *testing.T) {
 	conf := parseConfiguration(t)
 
@@ -360,6 +3060,59 @@ func TestEmptySignature(t *testing.T) {
 	require.NotEqual(t, ProofStatusValid, status)
 }
 
+// testProof is a gabi.Proof that accepts only the challenge against which gabi verified it
+// (see testProofs()).
+type testProof struct {
+	contribution *big.Int
+	challenge    *big.Int
+}
+
+// recordingProof records the challenge against which gabi verifies its testProof.
+type recordingProof struct{ *testProof }
+
+func (p *testProof) ChallengeContribution(pk *gabi.PublicKey) []*big.Int {
+	return []*big.Int{p.contribution}
+}
+
+func (p *testProof) VerifyWithChallenge(pk *gabi.PublicKey, challenge *big.Int) bool {
+	return p.challenge != nil && p.challenge.Cmp(challenge) == 0
+}
+
+func (p *testProof) SecretKeyResponse() *big.Int {
+	return big.NewInt(42)
+}
+
+func (p *testProof) MergeProofP(proofP *gabi.ProofP, pk *gabi.PublicKey) {}
+
+func (p recordingProof) VerifyWithChallenge(pk *gabi.PublicKey, challenge *big.Int) bool {
+	p.challenge = challenge
+	return true
+}
+
+func TestVerifyProofsCancelled(t *testing.T) {
+	conf := parseConfiguration(t)
+	proofs, recording := make(ProofList, 4), make(gabi.ProofList, 4)
+	pks, kss := make([]*gabi.PublicKey, 4), make([]string, 4)
+	for i := range proofs {
+		proof := &testProof{contribution: big.NewInt(int64(1000 + i))}
+		proofs[i], recording[i], kss[i] = proof, recordingProof{proof}, "."
+		pks[i] = &gabi.PublicKey{Issuer: "irma-demo.RU"}
+	}
+	require.True(t, recording.Verify(pks, big.NewInt(1), big.NewInt(2), false, kss))
+
+	// Proofs are not verified once the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	valid, err := proofs.verifyProofs(ctx, conf, big.NewInt(1), big.NewInt(2), pks, false)
+	require.Equal(t, context.Canceled, err)
+	require.False(t, valid)
+
+	// but are verified by gabi otherwise
+	valid, err = proofs.verifyProofs(context.Background(), conf, big.NewInt(1), big.NewInt(2), pks, false)
+	require.NoError(t, err)
+	require.True(t, valid)
+}
+
 // Test attribute decoding with both old and new metadata versions
 func TestAttributeDecoding(t *testing.T) {
 	expected := "male"
@@ -372,3 +3125,464 @@ func TestAttributeDecoding(t *testing.T) {
 	oldString := decodeAttribute(oldAttribute, 2)
 	require.Equal(t, *oldString, expected)
 }
+
+func TestCredentialRequestOptionalAttributes(t *testing.T) {
+	conf := parseConfiguration(t)
+	req := &CredentialRequest{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"),
+		Attributes: map[string]string{
+			"firstnames": "Johan Pieter",
+			"firstname":  "Johan",
+			"familyname": "Stuivezand",
+		},
+	}
+
+	// The optional prefix attribute is encoded as absent
+	list, err := req.AttributeList(conf, 0x03)
+	require.NoError(t, err)
+	prefix := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.prefix")
+	require.Nil(t, list.UntranslatedAttribute(prefix))
+	require.Nil(t, list.Attribute(prefix))
+	require.Equal(t, "Johan", *list.UntranslatedAttribute(NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")))
+
+	// Omitting non-optional attributes is an error naming them
+	delete(req.Attributes, "firstname")
+	delete(req.Attributes, "familyname")
+	err = req.Validate(conf)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "irma-demo.MijnOverheid.fullName.firstname, irma-demo.MijnOverheid.fullName.familyname")
+
+	// An absent attribute does not satisfy a disjunction requesting it
+	disjunction := &AttributeDisjunction{Attributes: []AttributeTypeIdentifier{prefix}}
+	require.True(t, disjunction.attemptSatisfy(prefix, nil))
+	require.False(t, disjunction.satisfied())
+	require.Equal(t, AttributeProofStatusMissing, disjunction.proofStatus(nil))
+}
+
+func TestParseSessionLink(t *testing.T) {
+	expected := &Qr{URL: "https://example.com/irma/session/abc", Type: ActionDisclosing}
+	qrjson := `{"u":"https://example.com/irma/session/abc","irmaqr":"disclosing"}`
+
+	tests := []struct {
+		name  string
+		link  string
+		valid bool
+	}{
+		{"irma json", "irma://qr/json/" + url.PathEscape(qrjson), true},
+		{"universal link fragment", "https://irma.app/-/session#" + url.PathEscape(qrjson), true},
+		{"irma query", "irma://qr?u=" + url.QueryEscape(expected.URL) + "&irmaqr=disclosing", true},
+		{"universal link query", "https://irma.app/-/session?u=" + url.QueryEscape(expected.URL) + "&irmaqr=disclosing", true},
+		{"base64", "https://irma.app/-/session?qr=" + base64.RawURLEncoding.EncodeToString([]byte(qrjson)), true},
+		{"padded base64", "irma://qr?qr=" + base64.URLEncoding.EncodeToString([]byte(qrjson)), true},
+		{"surrounding whitespace", " irma://qr/json/" + url.PathEscape(qrjson) + "\n", true},
+		{"compact", "irma://s/d/example.com/irma/session/abc", true},
+		{"compact with scheme", "irma://s/d/https://example.com/irma/session/abc", true},
+		{"compact unknown type", "irma://s/x/example.com/irma/session/abc", false},
+		{"compact missing type", "irma://s/", false},
+		{"unsupported scheme", "ftp://qr/json/" + url.PathEscape(qrjson), false},
+		{"no session pointer", "https://irma.app/-/session", false},
+		{"invalid json", "irma://qr/json/%7B%22u%22", false},
+		{"invalid base64", "irma://qr?qr=!!!", false},
+		{"missing type", "irma://qr?u=" + url.QueryEscape(expected.URL), false},
+		{"unknown type", "irma://qr?u=" + url.QueryEscape(expected.URL) + "&irmaqr=foo", false},
+		{"missing url", "irma://qr?irmaqr=disclosing&u=", false},
+	}
+
+	for _, tst := range tests {
+		qr, err := ParseSessionLink(tst.link)
+		if !tst.valid {
+			require.Error(t, err, tst.name)
+			continue
+		}
+		require.NoError(t, err, tst.name)
+		require.Equal(t, expected, qr, tst.name)
+		require.True(t, IsSessionLink(tst.link), tst.name)
+	}
+
+	require.False(t, IsSessionLink(qrjson))
+}
+
+func TestSessionLinkRoundTrip(t *testing.T) {
+	for _, qr := range []*Qr{
+		{URL: "http://localhost:48682/irma/session/abc?x=y&z=%20", Type: ActionIssuing},
+		{URL: "https://example.com/irma/session/def#frag", Type: ActionSigning},
+		{URL: "https://example.com/schememanager", Type: ActionSchemeManager},
+	} {
+		parsed, err := ParseSessionLink(qr.Link())
+		require.NoError(t, err)
+		require.Equal(t, qr, parsed)
+
+		parsed, err = ParseSessionLink(qr.UniversalLink("irma.app"))
+		require.NoError(t, err)
+		require.Equal(t, qr, parsed)
+
+		parsed, err = ParseSessionLink(qr.CompactLink())
+		require.NoError(t, err)
+		require.Equal(t, qr, parsed)
+
+		fallback := "https://example.com/irma?session=abc&lang=nl#qr"
+		link := qr.UniversalLinkWithFallback("irma.app", fallback)
+		parsed, err = ParseSessionLink(link)
+		require.NoError(t, err)
+		require.Equal(t, qr, parsed)
+		require.Equal(t, fallback, SessionLinkFallback(link))
+		require.Empty(t, SessionLinkFallback(qr.UniversalLink("irma.app")))
+	}
+}
+
+func TestCompactLink(t *testing.T) {
+	qr := &Qr{URL: "https://example.com/irma/session/abc", Type: ActionSigning}
+	require.Equal(t, "irma://s/s/example.com/irma/session/abc", qr.CompactLink())
+	bts, err := json.Marshal(qr)
+	require.NoError(t, err)
+	require.True(t, len(qr.CompactLink()) < len(bts))
+}
+
+func TestCredentialInfoGolden(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	meta := NewMetadataAttribute(0x03)
+	meta.setCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	meta.setField(signingDateField, shortToByte(2500))
+	meta.setValidityDuration(26)
+	meta.setKeyCounter(2)
+	ints := []*big.Int{meta.Int}
+	for _, val := range []string{"Radboud", "31415927", "s1234567", "42"} {
+		i := new(big.Int).SetBytes([]byte(val))
+		i.Lsh(i, 1)
+		i.Add(i, big.NewInt(1))
+		ints = append(ints, i)
+	}
+
+	info := NewCredentialInfo(ints, conf)
+	require.NotNil(t, info)
+	bts, err := json.MarshalIndent(info, "", "\t")
+	require.NoError(t, err)
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "golden", "credentialinfo.json"))
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(string(golden)), string(bts))
+
+	parsed := &CredentialInfo{}
+	require.NoError(t, json.Unmarshal(golden, parsed))
+	require.Equal(t, info, parsed)
+}
+
+func TestSchemeJSONGolden(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	bts, etag, err := conf.MarshalSchemeJSON()
+	require.NoError(t, err)
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "golden", "schemes.json"))
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(string(golden)), string(bts))
+
+	parsed := &SchemesJSON{}
+	require.NoError(t, json.Unmarshal(golden, parsed))
+	require.Equal(t, conf.SchemeJSON(), parsed)
+
+	// The ETag is stable, and changes along with the schemes
+	otheretag, err := parseConfiguration(t).SchemeJSONETag()
+	require.NoError(t, err)
+	require.Equal(t, etag, otheretag)
+	conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")].index["irma-demo/timestamp"] = []byte{0}
+	otheretag, err = conf.SchemeJSONETag()
+	require.NoError(t, err)
+	require.NotEqual(t, etag, otheretag)
+}
+
+func TestCredentialInfoListSort(t *testing.T) {
+	list := CredentialInfoList{
+		{SchemeManagerID: "irma-demo", IssuerID: "RU", ID: "studentCard", SignedOn: Timestamp(time.Unix(2000, 0)), Hash: "b"},
+		{SchemeManagerID: "irma-demo", IssuerID: "RU", ID: "studentCard", SignedOn: Timestamp(time.Unix(1000, 0)), Hash: "c"},
+		{SchemeManagerID: "irma-demo", IssuerID: "MijnOverheid", ID: "root", SignedOn: Timestamp(time.Unix(3000, 0)), Hash: "d"},
+		{SchemeManagerID: "irma-demo", IssuerID: "RU", ID: "studentCard", SignedOn: Timestamp(time.Unix(2000, 0)), Hash: "a"},
+	}
+	sort.Sort(list)
+
+	var hashes []string
+	for _, info := range list {
+		hashes = append(hashes, info.Hash)
+	}
+	require.Equal(t, []string{"d", "c", "a", "b"}, hashes)
+}
+
+func TestRequestSchemas(t *testing.T) {
+	schemas := RequestSchemas()
+	for _, name := range []string{
+		"DisclosureRequest", "SignatureRequest", "IssuanceRequest",
+		"ServiceProviderRequest", "SignatureRequestorRequest", "IdentityProviderRequest",
+	} {
+		schema := schemas[name]
+		require.NotNil(t, schema, name)
+		require.Equal(t, JSONSchemaVersion, schema.Schema)
+		require.Equal(t, "object", schema.Type)
+		require.Equal(t, false, schema.AdditionalProperties)
+	}
+	require.Contains(t, schemas["SignatureRequest"].Properties, "content")
+	require.Contains(t, schemas["SignatureRequest"].Properties, "message")
+	require.Contains(t, schemas["SignatureRequest"].Required, "content")
+	require.Contains(t, schemas["SignatureRequestorRequest"].Properties["request"].Properties, "message")
+	require.NotContains(t, schemas["DisclosureRequest"].Properties, "Candidates")
+
+	// The schemas must be valid JSON, and survive a roundtrip
+	bts, err := json.Marshal(schemas)
+	require.NoError(t, err)
+	var parsed map[string]*JSONSchema
+	require.NoError(t, json.Unmarshal(bts, &parsed))
+	require.Len(t, parsed, len(schemas))
+
+	// The request fixtures of this test suite conform to the schemas
+	for _, fixture := range []string{
+		`{"nonce": "Kg==", "context": "BTk=", "message": "I owe you everything", "content": [{"label": "Student number (RU)", "attributes": ["irma-demo.RU.studentCard.studentID"]}]}`,
+		`{"type": "disclosing", "content": [{"label": "Over 18", "attributes": {"irma-demo.MijnOverheid.ageLower.over18": ["yes", "ja"]}}]}`,
+		`{"type": "disclosing", "content": [{"label": "Student card", "attributes": ["irma-demo.RU.studentCard.*"]}]}`,
+		`{"type": "disclosing", "acceptExpired": true, "maxExpiredAge": 3600, "content": [{"label": {"en": "Student", "nl": "Student"}, "attributes": {"irma-demo.RU.studentCard.studentID": null}, "optional": true}]}`,
+		`{"type": "issuing", "credentials": [{"credential": "irma-demo.RU.studentCard", "validity": "2030-01-01T00:00:00Z", "keyCounter": 2, "attributes": {"university": "Radboud"}}]}`,
+		`{"type": "issuing", "credentials": [{"credential": "irma-demo.RU.studentCard", "validity": 1893456000, "attributes": {"university": "Radboud"}}], "disclose": null}`,
+		`{"validity": 60, "timeout": 60, "request": {"content": [{"label": "ID", "attributes": ["irma-demo.RU.studentCard.studentID"]}]}}`,
+		`{"multiParty": true, "request": {"type": "signing", "protocolVersion": "2.5", "message": "test", "detached": true, "content": [{"label": "ID", "attributes": ["irma-demo.RU.studentCard.studentID"]}]}}`,
+	} {
+		require.NoError(t, ValidateRequestSchema([]byte(fixture)), fixture)
+	}
+}
+
+func TestUnmarshalValidateStrict(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		dest interface{}
+		path string
+		code ValidationErrorCode
+	}{
+		{
+			name: "unknown field",
+			json: `{"type": "disclosing", "contnet": [], "content": [{"label": "ID", "attributes": ["irma-demo.RU.studentCard.studentID"]}]}`,
+			dest: &DisclosureRequest{},
+			path: "contnet",
+			code: ValidationErrorUnknownField,
+		},
+		{
+			name: "unknown nested field",
+			json: `{"type": "disclosing", "content": [{"label": "ID", "attributes": ["irma-demo.RU.studentCard.studentID"], "optionl": true}]}`,
+			dest: &DisclosureRequest{},
+			path: "content[0].optionl",
+			code: ValidationErrorUnknownField,
+		},
+		{
+			name: "wrong type",
+			json: `{"type": "disclosing", "content": [{"label": "ID", "attributes": ["irma-demo.RU.studentCard.studentID"], "optional": "yes"}]}`,
+			dest: &DisclosureRequest{},
+			path: "content[0].optional",
+			code: ValidationErrorInvalidValue,
+		},
+		{
+			name: "wrong attribute value type",
+			json: `{"type": "issuing", "credentials": [{"credential": "irma-demo.RU.studentCard", "attributes": {"level": 42}}]}`,
+			dest: &IssuanceRequest{},
+			path: "credentials[0].attributes.level",
+			code: ValidationErrorInvalidValue,
+		},
+		{
+			name: "invalid validity",
+			json: `{"type": "issuing", "credentials": [{"credential": "irma-demo.RU.studentCard", "validity": "tomorrow", "attributes": {}}]}`,
+			dest: &IssuanceRequest{},
+			path: "credentials[0].validity",
+			code: ValidationErrorInvalidValue,
+		},
+		{
+			name: "missing required field",
+			json: `{"type": "signing", "content": [{"label": "ID", "attributes": ["irma-demo.RU.studentCard.studentID"]}]}`,
+			dest: &SignatureRequest{},
+			path: "message",
+			code: ValidationErrorMissingField,
+		},
+		{
+			name: "unknown field in wrapped request",
+			json: `{"request": {"type": "disclosing", "content": [{"label": "ID", "attributes": ["irma-demo.RU.studentCard.studentID"]}], "foo": 1}}`,
+			dest: &ServiceProviderRequest{},
+			path: "request.foo",
+			code: ValidationErrorUnknownField,
+		},
+	}
+
+	for _, tst := range tests {
+		err := UnmarshalValidateStrict([]byte(tst.json), tst.dest)
+		require.IsType(t, &ValidationError{}, err, tst.name)
+		problems := err.(*ValidationError).Problems
+		require.Len(t, problems, 1, tst.name)
+		require.Equal(t, tst.path, problems[0].Path, tst.name)
+		require.Equal(t, tst.code, problems[0].Code, tst.name)
+		require.Error(t, ValidateRequestSchema([]byte(tst.json)), tst.name)
+	}
+
+	// Unknown fields are ignored outside of strict mode
+	request := &DisclosureRequest{}
+	data := []byte(`{"type": "disclosing", "foo": "bar", "content": [{"label": "ID", "attributes": ["irma-demo.RU.studentCard.studentID"]}]}`)
+	require.NoError(t, UnmarshalValidate(data, request))
+	require.Error(t, UnmarshalValidateStrict(data, &DisclosureRequest{}))
+	require.NoError(t, UnmarshalValidateStrict([]byte(`{"type": "disclosing", "content": [{"label": "ID", "attributes": ["irma-demo.RU.studentCard.studentID"]}]}`), request))
+}
+
+// TestErrorMatching checks that the errors of this package can be distinguished using
+// errors.Is() and errors.As(), also when wrapped, without matching their messages.
+func TestErrorMatching(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			<-release
+		case "/unknown":
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte(`{"status":400,"error":"SESSION_UNKNOWN","description":"Unknown or expired session"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`"VALID"`))
+	}))
+	defer server.Close()
+	var result string
+
+	// API error: matches its type and its remote error
+	err := NewHTTPTransport(server.URL).Get("unknown", &result)
+	require.True(t, errors.Is(err, ErrorApi))
+	require.False(t, errors.Is(err, ErrorTransport))
+	var rerr *RemoteError
+	require.True(t, errors.As(err, &rerr))
+	require.Equal(t, "SESSION_UNKNOWN", rerr.ErrorName)
+	require.True(t, errors.Is(err, &RemoteError{ErrorName: "SESSION_UNKNOWN"}))
+	require.False(t, errors.Is(err, &RemoteError{ErrorName: "UNAUTHORIZED"}))
+
+	// Timeout, also when wrapped again
+	transport := NewHTTPTransport(server.URL)
+	transport.SetTimeout(100*time.Millisecond, SubsystemKeyshare)
+	transport.SetRetries(0)
+	err = fmt.Errorf("verifying pin: %w", transport.Get("slow", &result))
+	require.True(t, errors.Is(err, ErrorTimeout))
+	var serr *SessionError
+	require.True(t, errors.As(err, &serr))
+	require.Equal(t, SubsystemKeyshare, serr.Info)
+	close(release)
+
+	// Transport error: the cause is reachable
+	err = NewHTTPTransport("http://[::1").Get("", &result)
+	require.True(t, errors.Is(err, ErrorTransport))
+	var urlErr *url.Error
+	require.True(t, errors.As(err, &urlErr))
+
+	// Stage and type of session errors are serialized
+	serr = &SessionError{ErrorType: ErrorKeyshare, Stage: ErrorStageKeyshare, RemoteError: rerr}
+	bts, err := json.Marshal(serr)
+	require.NoError(t, err)
+	require.Contains(t, string(bts), `"type":"keyshare","stage":"keyshare"`)
+	require.Contains(t, string(bts), `"error":"SESSION_UNKNOWN"`)
+
+	// Scheme parsing error: matches its status, and the messages are unchanged
+	conf, err := NewConfigurationReadOnly("testdata/irma_configuration_invalid")
+	require.NoError(t, err)
+	err = fmt.Errorf("parsing: %w", conf.ParseFolder())
+	require.True(t, errors.Is(err, SchemeManagerStatusInvalidSignature))
+	require.False(t, errors.Is(err, SchemeManagerStatusParsingError))
+	var smerr *SchemeManagerError
+	require.True(t, errors.As(err, &smerr))
+	require.Equal(t, "parsing: "+smerr.Error(), err.Error())
+
+	// Metadata errors match the sentinel they wrap
+	err = &MetadataError{Err: ErrorMissingPublicKey}
+	require.True(t, errors.Is(err, ErrorMissingPublicKey))
+	require.False(t, errors.Is(err, ErrorExpiredPublicKey))
+	require.True(t, IsMissingPublicKey(err))
+
+	// Validation errors match the codes of their problems
+	err = UnmarshalValidate([]byte(`{"type": "signing", "content": [{"label": "ID", "attributes": ["irma-demo.RU.studentCard.studentID"]}]}`), &SignatureRequest{})
+	require.True(t, errors.Is(err, ValidationErrorMissingField))
+	require.False(t, errors.Is(err, ValidationErrorUnknownField))
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr))
+}
+
+// TestProtocolCompatibility checks that messages in the wire format of the previous protocol
+// version, of which golden fixtures are in testdata/golden/protocol-<version>, are accepted and
+// emitted. It must keep passing until that version is dropped (see ProtocolVersionPrevious).
+func TestProtocolCompatibility(t *testing.T) {
+	require.Equal(t, "2.4", ProtocolVersionPrevious.String())
+	golden := func(name string) []byte {
+		bts, err := ioutil.ReadFile(filepath.Join("testdata", "golden", "protocol-2.4", name+".json"))
+		require.NoError(t, err)
+		return bts
+	}
+
+	messages := []struct {
+		name string
+		dest interface{}
+	}{
+		{"qr", &Qr{}},
+		{"disclosing", &DisclosureRequest{}},
+		{"signing", &SignatureRequest{}},
+		{"issuing", &IssuanceRequest{}},
+		{"disclosure", &Disclosure{}},
+		{"signature", &SignedMessage{}},
+		{"status", new(string)},
+	}
+	for _, msg := range messages {
+		bts := golden(msg.name)
+		require.NoError(t, UnmarshalMessage(ProtocolVersionPrevious, bts, msg.dest), msg.name)
+		marshaled, err := MarshalMessage(ProtocolVersionPrevious, msg.dest)
+		require.NoError(t, err, msg.name)
+		require.JSONEq(t, string(bts), string(marshaled), msg.name)
+	}
+
+	// Session requests sent to the client carry their version
+	request := &SignatureRequest{}
+	require.NoError(t, UnmarshalMessage(nil, golden("signing"), request))
+	require.Equal(t, ProtocolVersionPrevious, request.Version)
+	require.Equal(t, "I owe you everything", request.Message)
+
+	// The signature of the previous version has no envelope, and is read like one that has
+	signature := &SignedMessage{}
+	require.NoError(t, UnmarshalMessage(ProtocolVersionPrevious, golden("signature"), signature))
+	require.Equal(t, "I owe you everything", signature.Message)
+	require.Len(t, signature.Signature, 1)
+	bts, err := MarshalMessage(ProtocolVersionCurrent, signature)
+	require.NoError(t, err)
+	require.Contains(t, string(bts), `"version":1`)
+	signature.MessageType = SignedMessageTypeSHA256
+	_, err = MarshalMessage(ProtocolVersionPrevious, signature)
+	require.Error(t, err)
+
+	// Disclosures include their nonce and context only in the current version
+	disclosure := &Disclosure{}
+	require.NoError(t, UnmarshalMessage(ProtocolVersionPrevious, golden("disclosure"), disclosure))
+	require.Nil(t, disclosure.Nonce)
+	disclosure.Nonce, disclosure.Context = big.NewInt(42), big.NewInt(1)
+	bts, err = MarshalMessage(ProtocolVersionCurrent, disclosure)
+	require.NoError(t, err)
+	require.Contains(t, string(bts), `"nonce"`)
+	bts, err = MarshalMessage(ProtocolVersionPrevious, disclosure)
+	require.NoError(t, err)
+	require.JSONEq(t, string(golden("disclosure")), string(bts))
+	require.NotNil(t, disclosure.Nonce)
+
+	// Other versions are not supported
+	_, err = MarshalMessage(NewVersion(2, 3), disclosure)
+	require.True(t, errors.Is(err, ErrorProtocolVersionNotSupported))
+	err = UnmarshalMessage(NewVersion(3, 0), golden("disclosure"), &Disclosure{})
+	require.True(t, errors.Is(err, ErrorProtocolVersionNotSupported))
+}
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	version, err := NegotiateProtocolVersion(NewVersion(2, 4), NewVersion(2, 5))
+	require.NoError(t, err)
+	require.Equal(t, ProtocolVersionCurrent, version)
+
+	version, err = NegotiateProtocolVersion(NewVersion(2, 4), NewVersion(2, 4))
+	require.NoError(t, err)
+	require.Equal(t, NewVersion(2, 4), version)
+
+	version, err = NegotiateProtocolVersion(NewVersion(2, 5), NewVersion(3, 2))
+	require.NoError(t, err)
+	require.Equal(t, ProtocolVersionCurrent, version)
+
+	_, err = NegotiateProtocolVersion(NewVersion(2, 1), NewVersion(2, 3))
+	require.Error(t, err)
+	_, err = NegotiateProtocolVersion(NewVersion(3, 0), NewVersion(3, 1))
+	require.Error(t, err)
+}
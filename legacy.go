@@ -0,0 +1,194 @@
+package irma
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+)
+
+// legacyRequestorJwtClaims maps the claims in which the JWTs of the irma_api_server contained
+// the requestor request to the corresponding session type.
+var legacyRequestorJwtClaims = map[string]Action{
+	"sprequest":  ActionDisclosing,
+	"dprequest":  ActionDisclosing,
+	"absrequest": ActionSigning,
+	"iprequest":  ActionIssuing,
+}
+
+// requestorJwtClaims maps session types to the claim in which requestor JWTs contain the requestor request.
+var requestorJwtClaims = map[Action]string{
+	ActionDisclosing: "sprequest",
+	ActionSigning:    "absrequest",
+	ActionIssuing:    "iprequest",
+}
+
+// legacyCountAnnotation matches the count annotation that the irma_api_server allowed after attribute
+// and credential type identifiers, e.g. the [1] in irma-demo.RU.studentCard.studentID[1].
+var legacyCountAnnotation = regexp.MustCompile(`\[\d*\]$`)
+
+// parseLegacyRequestorJwt parses the specified JWT into dest if it uses the layout of the JWTs
+// of the irma_api_server, returning whether it does. In that layout the session request has no type,
+// the claim containing a disclosure request may be called dprequest, signature requests have a
+// messageType, and identifiers may have a count annotation. The JWT is converted to the current
+// layout, and the requestor request in dest is marked as legacy.
+// Note: this function does not verify the signature! Do that elsewhere.
+func parseLegacyRequestorJwt(requestorJwt string, dest RequestorJwt) (bool, error) {
+	parts := strings.Split(requestorJwt, ".")
+	if len(parts) != 3 {
+		return false, nil // let the JWT parser report the error
+	}
+	payload, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return false, nil
+	}
+	var claims map[string]json.RawMessage
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return false, nil
+	}
+
+	action := dest.Action()
+	var claim string
+	for name, a := range legacyRequestorJwtClaims {
+		if a == action && present(claims, name) {
+			claim = name
+			break
+		}
+	}
+	if claim == "" {
+		return false, nil
+	}
+	var rrequest map[string]json.RawMessage
+	if err = json.Unmarshal(claims[claim], &rrequest); err != nil {
+		return false, nil
+	}
+	var request map[string]json.RawMessage
+	if err = json.Unmarshal(rrequest["request"], &request); err != nil {
+		return false, nil
+	}
+	if claim == requestorJwtClaims[action] && present(request, "type") && !legacyMessageType(request) {
+		return false, nil
+	}
+
+	if err = convertLegacyRequest(action, request); err != nil {
+		return true, errors.WrapPrefix(err, "Failed to convert legacy session request", 0)
+	}
+	if rrequest["request"], err = json.Marshal(request); err != nil {
+		return true, err
+	}
+	delete(claims, claim)
+	if claims[requestorJwtClaims[action]], err = json.Marshal(rrequest); err != nil {
+		return true, err
+	}
+	if payload, err = json.Marshal(claims); err != nil {
+		return true, err
+	}
+	if err = json.Unmarshal(payload, dest); err != nil {
+		return true, err
+	}
+
+	switch d := dest.(type) {
+	case *ServiceProviderJwt:
+		d.Request.Legacy = true
+	case *SignatureRequestorJwt:
+		d.Request.Legacy = true
+	case *IdentityProviderJwt:
+		d.Request.Legacy = true
+	}
+	return true, nil
+}
+
+// legacyMessageType returns whether the specified session request has the messageType of the
+// signature requests of the irma_api_server, which is the default message type of current requests.
+func legacyMessageType(request map[string]json.RawMessage) bool {
+	var messageType string
+	return present(request, "messageType") &&
+		json.Unmarshal(request["messageType"], &messageType) == nil && messageType == SignedMessageTypeString
+}
+
+// convertLegacyRequest converts the specified session request from the irma_api_server to the
+// current format, in place.
+func convertLegacyRequest(action Action, request map[string]json.RawMessage) error {
+	var err error
+	if present(request, "type") {
+		var t Action
+		if err = json.Unmarshal(request["type"], &t); err != nil || t != action {
+			return errors.Errorf("Session request type does not match JWT")
+		}
+	}
+	if request["type"], err = json.Marshal(action); err != nil {
+		return err
+	}
+	if legacyMessageType(request) {
+		delete(request, "messageType")
+	}
+
+	for _, field := range []string{"content", "disclose"} {
+		if !present(request, field) {
+			continue
+		}
+		if request[field], err = convertLegacyDisjunctions(request[field]); err != nil {
+			return err
+		}
+	}
+	if present(request, "credentials") {
+		var credentials []map[string]json.RawMessage
+		if err = json.Unmarshal(request["credentials"], &credentials); err != nil {
+			return err
+		}
+		for _, cred := range credentials {
+			var id string
+			if err = json.Unmarshal(cred["credential"], &id); err != nil {
+				return err
+			}
+			if cred["credential"], err = json.Marshal(legacyIdentifier(id)); err != nil {
+				return err
+			}
+		}
+		if request["credentials"], err = json.Marshal(credentials); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertLegacyDisjunctions normalizes the attribute identifiers in the specified JSON list of disjunctions.
+func convertLegacyDisjunctions(bts json.RawMessage) (json.RawMessage, error) {
+	var disjunctions []map[string]json.RawMessage
+	if err := json.Unmarshal(bts, &disjunctions); err != nil {
+		return nil, err
+	}
+	for _, disjunction := range disjunctions {
+		var err error
+		var list []string
+		if err = json.Unmarshal(disjunction["attributes"], &list); err == nil {
+			for i := range list {
+				list[i] = legacyIdentifier(list[i])
+			}
+			if disjunction["attributes"], err = json.Marshal(list); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var values map[string]json.RawMessage
+		if err = json.Unmarshal(disjunction["attributes"], &values); err != nil {
+			return nil, errors.New("Disjunction attributes are neither a list nor a map")
+		}
+		normalized := make(map[string]json.RawMessage, len(values))
+		for id, value := range values {
+			normalized[legacyIdentifier(id)] = value
+		}
+		if disjunction["attributes"], err = json.Marshal(normalized); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(disjunctions)
+}
+
+// legacyIdentifier returns the specified identifier from a legacy session request without
+// surrounding whitespace and count annotation.
+func legacyIdentifier(id string) string {
+	return legacyCountAnnotation.ReplaceAllString(strings.TrimSpace(id), "")
+}
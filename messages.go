@@ -1,10 +1,12 @@
 package irma
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"bytes"
 
@@ -13,6 +15,7 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 )
 
 // Status encodes the status of an IRMA session (e.g., connected).
@@ -24,6 +27,9 @@ var ForceHttps bool = false
 const (
 	MinVersionHeader = "X-IRMA-MinProtocolVersion"
 	MaxVersionHeader = "X-IRMA-MaxProtocolVersion"
+	// Included in status responses of sessions that the client has not yet connected to,
+	// containing the expiry of the session pointer as Unix timestamp (see Qr.Expiry)
+	SessionExpiryHeader = "X-IRMA-SessionExpiry"
 )
 
 // ProtocolVersion encodes the IRMA protocol version of an IRMA session.
@@ -87,9 +93,15 @@ func (v *ProtocolVersion) AboveVersion(other *ProtocolVersion) bool {
 // the server will use.
 func GetMetadataVersion(v *ProtocolVersion) byte {
 	if v.Below(2, 3) {
-		return 0x02 // no support for optional attributes
+		return MetadataVersion2 // no support for optional attributes
 	}
-	return 0x03 // current version
+	return MetadataVersion3 // current version
+}
+
+// signatureBindsConditions returns whether in signature sessions of the specified protocol version,
+// the conditions of the signature request are bound into the signature nonce.
+func signatureBindsConditions(v *ProtocolVersion) bool {
+	return v != nil && !v.Below(2, 5)
 }
 
 // Action encodes the session type of an IRMA session (e.g., disclosing).
@@ -98,10 +110,12 @@ type Action string
 // ErrorType are session errors.
 type ErrorType string
 
-// SessionError is a protocol error.
+// SessionError is a protocol error. It can be inspected using errors.Is() and errors.As(),
+// see errors.go.
 type SessionError struct {
 	Err error
 	ErrorType
+	Stage        ErrorStage // Stage of the session in which the error occurred, if known
 	Info         string
 	RemoteError  *RemoteError
 	RemoteStatus int
@@ -121,9 +135,20 @@ type Validator interface {
 }
 
 // UnmarshalValidate json.Unmarshal's data, and validates it using the
-// Validate() method if dest implements the Validator interface.
+// Validate() method if dest implements the Validator interface. If dest is a session request
+// without type, its type is inferred from data (see InferAction()). Fields of the wrong JSON type,
+// and the problems found by the validation methods of session requests, are returned as a
+// *ValidationError.
 func UnmarshalValidate(data []byte, dest interface{}) error {
 	if err := json.Unmarshal(data, dest); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			verr := &ValidationError{}
+			verr.add(typeErr.Field, typeErr.Value, ValidationErrorInvalidValue, "%s", typeErr.Error())
+			return verr
+		}
+		return err
+	}
+	if err := inferType(data, dest); err != nil {
 		return err
 	}
 	if v, ok := dest.(Validator); ok {
@@ -132,6 +157,40 @@ func UnmarshalValidate(data []byte, dest interface{}) error {
 	return nil
 }
 
+// inferType sets the type of the session request in dest, if it is (or contains) one without type,
+// to the action inferred from data if that matches the session request (see InferAction()).
+func inferType(data []byte, dest interface{}) error {
+	var request SessionRequest
+	switch d := dest.(type) {
+	case *DisclosureRequest, *SignatureRequest, *IssuanceRequest:
+		request = d.(SessionRequest)
+	case *ServiceProviderRequest:
+		if d.Request != nil {
+			request = d.Request
+		}
+	case *SignatureRequestorRequest:
+		if d.Request != nil {
+			request = d.Request
+		}
+	case *IdentityProviderRequest:
+		if d.Request != nil {
+			request = d.Request
+		}
+	}
+	inferrer, ok := request.(interface{ setInferredType(Action) })
+	if !ok {
+		return nil
+	}
+	action, err := InferAction(data)
+	if err != nil {
+		return err
+	}
+	if action == request.Action() {
+		inferrer.setInferredType(action)
+	}
+	return nil
+}
+
 func (err *RemoteError) Error() string {
 	var msg string
 	if err.Message != "" {
@@ -147,8 +206,15 @@ type Qr struct {
 	URL string `json:"u"`
 	// Session type (disclosing, signing, issuing)
 	Type Action `json:"irmaqr"`
+	// Time after which the session can no longer be started, if known. Compact session links
+	// (see CompactLink()) do not include it.
+	Expiry *Timestamp `json:"expiry,omitempty"`
 }
 
+// QrExpiryTolerance is the clock skew between the client and the server tolerated when
+// checking whether a session pointer expired.
+const QrExpiryTolerance = time.Minute
+
 type SchemeManagerRequest Qr
 
 // Statuses
@@ -173,6 +239,10 @@ const (
 	ErrorProtocolVersionNotSupported = ErrorType("protocolVersionNotSupported")
 	// Error in HTTP communication
 	ErrorTransport = ErrorType("transport")
+	// Server certificate did not match the TLS pins of its scheme manager
+	ErrorTLSPinMismatch = ErrorType("tlsPinMismatch")
+	// HTTP request timed out; Info names the subsystem (see HTTPTransport.SetTimeout())
+	ErrorTimeout = ErrorType("timeout")
 	// Invalid client JWT in first IRMA message
 	ErrorInvalidJWT = ErrorType("invalidJwt")
 	// Unkown session type (not disclosing, signing, or issuing)
@@ -197,8 +267,16 @@ const (
 	ErrorUnknownSchemeManager = ErrorType("unknownSchemeManager")
 	// A session is requested involving a scheme manager that has some problem
 	ErrorInvalidSchemeManager = ErrorType("invalidSchemeManager")
+	// A session requires a public key that is not present in (the remote copy of) its scheme manager
+	ErrorSchemeOutdated = ErrorType("schemeOutdated")
 	// Recovered panic
 	ErrorPanic = ErrorType("panic")
+	// Session link could not be parsed or contained an invalid session pointer
+	ErrorInvalidSessionLink = ErrorType("invalidSessionLink")
+	// A persisted session could not be resumed because the server no longer awaits our response
+	ErrorSessionNotResumable = ErrorType("sessionNotResumable")
+	// Session pointer expired before the session was started
+	ErrorSessionExpired = ErrorType("sessionExpired")
 )
 
 func (e *SessionError) Error() string {
@@ -245,11 +323,29 @@ func (e *SessionError) Stack() string {
 type Disclosure struct {
 	Proofs  gabi.ProofList            `json:"proofs"`
 	Indices DisclosedAttributeIndices `json:"indices"`
+	// Nonce and context over which the proofs were computed, with which the verifier can recognize
+	// proofs meant for another session; the proofs are cryptographically bound to them regardless.
+	// Absent in disclosures of older clients.
+	Nonce   *big.Int `json:"nonce,omitempty"`
+	Context *big.Int `json:"context,omitempty"`
+}
+
+// MatchesNonceAndContext returns false if the disclosure specifies a nonce or context
+// other than the one of the specified request.
+func (d *Disclosure) MatchesNonceAndContext(request SessionRequest) bool {
+	return bigIntMatches(d.Nonce, request.GetNonce()) && bigIntMatches(d.Context, request.GetContext())
+}
+
+func bigIntMatches(specified, expected *big.Int) bool {
+	if specified == nil {
+		return true
+	}
+	return expected != nil && specified.Cmp(expected) == 0
 }
 
 // DisclosedAttributeIndices contains, for each conjunction of an attribute disclosure request,
 // a list of attribute indices, pointing to where the disclosed attributes for that conjunction
-// can be found within a gabi.ProofList.
+// can be found within a gabi.ProofList. The list is empty for optional conjunctions that were skipped.
 type DisclosedAttributeIndices [][]*DisclosedAttributeIndex
 
 // DisclosedAttributeIndex points to a specific attribute in a gabi.ProofList.
@@ -271,7 +367,8 @@ func (i *IssueCommitmentMessage) Disclosure() *Disclosure {
 	}
 }
 
-// ParseRequestorJwt parses the specified JWT and returns the contents.
+// ParseRequestorJwt parses the specified JWT and returns the contents. JWTs in the format of the
+// irma_api_server are converted to the current format (see parseLegacyRequestorJwt()).
 // Note: this function does not verify the signature! Do that elsewhere.
 func ParseRequestorJwt(action string, requestorJwt string) (RequestorJwt, error) {
 	var retval RequestorJwt
@@ -285,6 +382,9 @@ func ParseRequestorJwt(action string, requestorJwt string) (RequestorJwt, error)
 	default:
 		return nil, errors.New("Invalid session type")
 	}
+	if legacy, err := parseLegacyRequestorJwt(requestorJwt, retval); legacy || err != nil {
+		return retval, err
+	}
 	if _, _, err := new(jwt.Parser).ParseUnverified(requestorJwt, retval); err != nil {
 		return nil, err
 	}
@@ -326,3 +426,174 @@ func (smr *SchemeManagerRequest) Validate() error {
 	}
 	return nil
 }
+
+// Session links are URLs that start an IRMA session, embedding the session pointer (Qr) in one
+// of the following ways:
+//  - irma://qr/json/<percent-encoded JSON session pointer>
+//  - https://<host>/-/session#<percent-encoded JSON session pointer>
+//  - a qr query parameter containing the (unpadded) base64url-encoded JSON session pointer
+//  - u and irmaqr query parameters containing the URL and type of the session pointer
+//  - irma://s/<type code>/<URL>, the compact form (see Qr.CompactLink())
+// in which the third and fourth may be used both with the irma:// and https:// schemes.
+
+// UniversalLinkPath is the path of universal session links (see Qr.UniversalLink()).
+const UniversalLinkPath = "/-/session"
+
+// IsSessionLink returns whether the specified string looks like a session link (as opposed to
+// e.g. a session pointer in JSON), without checking if it is valid.
+func IsSessionLink(link string) bool {
+	link = strings.ToLower(strings.TrimSpace(link))
+	return strings.HasPrefix(link, "irma://") ||
+		strings.HasPrefix(link, "https://") ||
+		strings.HasPrefix(link, "http://")
+}
+
+// Expired returns whether the session pointer has an expiry that passed, by more than
+// QrExpiryTolerance to allow for clock skew.
+func (qr *Qr) Expired() bool {
+	return qr.Expiry != nil && time.Time(*qr.Expiry).Add(QrExpiryTolerance).Before(time.Now())
+}
+
+// Link returns an irma:// link containing the session pointer.
+func (qr *Qr) Link() string {
+	bts, _ := json.Marshal(qr)
+	return "irma://qr/json/" + url.PathEscape(string(bts))
+}
+
+// compactLinkPrefix is the prefix of compact session links (see Qr.CompactLink()).
+const compactLinkPrefix = "irma://s/"
+
+// compactActionCodes maps session types to their single-letter code in compact session links.
+var compactActionCodes = map[Action]string{
+	ActionDisclosing:    "d",
+	ActionSigning:       "s",
+	ActionIssuing:       "i",
+	ActionSchemeManager: "m",
+}
+
+// CompactLink returns the compact form of the session pointer, irma://s/<type code>/<URL>, in
+// which the https:// scheme of the URL is omitted. Because it avoids the JSON syntax and field
+// names, the QR code it is rendered in has considerably fewer modules than that of the JSON
+// session pointer. Only clients supporting protocol version 2.5 or higher accept it, so servers
+// emit it only when configured to do so.
+func (qr *Qr) CompactLink() string {
+	return compactLinkPrefix + compactActionCodes[qr.Type] + "/" + strings.TrimPrefix(qr.URL, "https://")
+}
+
+func parseCompactLink(link string) (*Qr, error) {
+	parts := strings.SplitN(link[len(compactLinkPrefix):], "/", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Compact session link does not contain a session type")
+	}
+	qr := &Qr{URL: parts[1]}
+	for action, code := range compactActionCodes {
+		if code == parts[0] {
+			qr.Type = action
+		}
+	}
+	lower := strings.ToLower(qr.URL)
+	if !strings.HasPrefix(lower, "https://") && !strings.HasPrefix(lower, "http://") {
+		qr.URL = "https://" + qr.URL
+	}
+	return qr, nil
+}
+
+// UniversalLink returns a https:// link at the specified host that contains the session pointer,
+// to be handled by an IRMA app registered for that host.
+func (qr *Qr) UniversalLink(host string) string {
+	return qr.UniversalLinkWithFallback(host, "")
+}
+
+// UniversalLinkWithFallback is like UniversalLink(), but includes the specified URL in the
+// fallback query parameter of the link, to which the web page at the link can redirect the user
+// if no IRMA app is installed to handle it, e.g. a page showing the session pointer as a QR code.
+func (qr *Qr) UniversalLinkWithFallback(host, fallback string) string {
+	bts, _ := json.Marshal(qr)
+	u := url.URL{Scheme: "https", Host: host, Path: UniversalLinkPath, Fragment: string(bts)}
+	if fallback != "" {
+		u.RawQuery = url.Values{"fallback": {fallback}}.Encode()
+	}
+	return u.String()
+}
+
+// SessionLinkFallback returns the fallback URL of the specified universal link (see
+// Qr.UniversalLinkWithFallback()), or the empty string if it has none.
+func SessionLinkFallback(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("fallback")
+}
+
+// ParseSessionLink parses and validates the session pointer contained in the specified session
+// link (see IsSessionLink()). The returned session pointer may also be of type
+// ActionSchemeManager.
+func ParseSessionLink(link string) (*Qr, error) {
+	link = strings.TrimSpace(link)
+	if strings.HasPrefix(strings.ToLower(link), compactLinkPrefix) {
+		qr, err := parseCompactLink(link)
+		if err != nil {
+			return nil, err
+		}
+		return validateSessionLinkQr(qr)
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, errors.Errorf("Invalid session link: %s", err.Error())
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "irma", "https", "http":
+	default:
+		return nil, errors.Errorf("Unsupported session link scheme %s", u.Scheme)
+	}
+
+	query := u.Query()
+	var qr *Qr
+	switch {
+	case query.Get("u") != "":
+		qr = &Qr{URL: query.Get("u"), Type: Action(query.Get("irmaqr"))}
+	case query.Get("qr") != "":
+		bts, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(query.Get("qr"), "="))
+		if err != nil {
+			return nil, errors.Errorf("Session link contains invalid base64: %s", err.Error())
+		}
+		if qr, err = parseSessionLinkJson(bts); err != nil {
+			return nil, err
+		}
+	case strings.EqualFold(u.Scheme, "irma") && u.Host == "qr" && strings.HasPrefix(u.Path, "/json/"):
+		if qr, err = parseSessionLinkJson([]byte(strings.TrimPrefix(u.Path, "/json/"))); err != nil {
+			return nil, err
+		}
+	case u.Fragment != "":
+		if qr, err = parseSessionLinkJson([]byte(u.Fragment)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Session link does not contain a session pointer")
+	}
+
+	return validateSessionLinkQr(qr)
+}
+
+func validateSessionLinkQr(qr *Qr) (*Qr, error) {
+	var err error
+	if qr.Type == ActionSchemeManager {
+		err = (*SchemeManagerRequest)(qr).Validate()
+	} else {
+		err = qr.Validate()
+	}
+	if err != nil {
+		return nil, errors.Errorf("Session link contains invalid session pointer: %s", err.Error())
+	}
+	return qr, nil
+}
+
+func parseSessionLinkJson(bts []byte) (*Qr, error) {
+	qr := &Qr{}
+	if err := json.Unmarshal(bts, qr); err != nil {
+		return nil, errors.Errorf("Session link contains invalid JSON: %s", err.Error())
+	}
+	return qr, nil
+}
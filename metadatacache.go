@@ -0,0 +1,112 @@
+package irma
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+)
+
+// This file contains the caching of the decoding of metadata attributes. Each disclosed or
+// issued credential has one, and decoding it involves converting it to bytes for each of its
+// fields and resolving its credential type and public key from the Configuration, which shows up
+// in profiles of servers under load. As the metadata attributes of the credentials of a user
+// remain the same across sessions, the decoded bytes, credential type and public key are cached
+// per Configuration by the value of the metadata attribute. The cache is invalidated when the
+// scheme managers, issuers or credential types of the Configuration change.
+
+// metadataCacheSize is the maximum amount of metadata attributes whose decoding is cached.
+const metadataCacheSize = 4096
+
+type metadataCache struct {
+	sync.RWMutex
+	entries    map[string]*metadataCacheEntry
+	generation uint32 // incremented on invalidation; accessed atomically
+}
+
+type metadataCacheEntry struct {
+	cache      *metadataCache
+	generation uint32
+	value      *big.Int
+	bytes      []byte
+	credtype   *CredentialType
+	pk         *gabi.PublicKey // resolved lazily, guarded by cache
+}
+
+// invalidate empties the cache, and marks the entries that metadata attributes still refer to
+// as stale.
+func (c *metadataCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = nil
+	atomic.AddUint32(&c.generation, 1)
+}
+
+// entry returns the cache entry of the specified metadata attribute, creating it if necessary.
+func (c *metadataCache) entry(i *big.Int, conf *Configuration) *metadataCacheEntry {
+	bts := i.Bytes()
+	c.RLock()
+	e := c.entries[string(bts)]
+	generation := c.generation
+	c.RUnlock()
+	if e != nil {
+		return e
+	}
+
+	e = &metadataCacheEntry{
+		cache:      c,
+		generation: generation,
+		value:      new(big.Int).Set(i),
+		bytes:      (&MetadataAttribute{Int: i}).Bytes(),
+	}
+	e.credtype = conf.hashToCredentialType(e.bytes[credentialID.offset : credentialID.offset+credentialID.length])
+
+	c.Lock()
+	defer c.Unlock()
+	if c.generation != generation {
+		// invalidated while resolving the credential type, which may thus be outdated
+		return nil
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*metadataCacheEntry)
+	}
+	if len(c.entries) >= metadataCacheSize {
+		for key := range c.entries { // evict an arbitrary entry
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[string(bts)] = e
+	return e
+}
+
+func (e *metadataCacheEntry) valid(i *big.Int, conf *Configuration) bool {
+	return e.cache == &conf.metadataCache &&
+		e.generation == atomic.LoadUint32(&e.cache.generation) &&
+		e.value.Cmp(i) == 0
+}
+
+func (e *metadataCacheEntry) publicKey() *gabi.PublicKey {
+	e.cache.RLock()
+	defer e.cache.RUnlock()
+	return e.pk
+}
+
+func (e *metadataCacheEntry) setPublicKey(pk *gabi.PublicKey) {
+	e.cache.Lock()
+	defer e.cache.Unlock()
+	e.pk = pk
+}
+
+// cacheEntry returns the cache entry of this metadata attribute in its Configuration,
+// or nil if it has no Configuration.
+func (attr *MetadataAttribute) cacheEntry() *metadataCacheEntry {
+	if attr.Conf == nil || attr.Int == nil {
+		return nil
+	}
+	if attr.cached == nil || !attr.cached.valid(attr.Int, attr.Conf) {
+		attr.cached = attr.Conf.metadataCache.entry(attr.Int, attr.Conf)
+	}
+	return attr.cached
+}
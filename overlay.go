@@ -0,0 +1,203 @@
+package irma
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the overlay mode of a Configuration, in which the schemes in the assets
+// folder are not copied into storage. Instead, the assets act as a read-only lower layer beneath
+// storage, which then contains only the files that were downloaded or modified by updates.
+// When parsing, each file is read from storage if it is present there, and otherwise from the
+// assets. When the assets contain a newer version of a scheme than storage (by comparing their
+// timestamps, e.g. after an app update shipping a newer version), the scheme is removed from
+// storage so that the assets version is used again. Deleting a scheme leaves a whiteout file
+// in storage, which masks the assets of the scheme. With multiple assets folders, each scheme is
+// taken from one of them as described in searchpaths.go.
+
+// whiteoutPrefix is the prefix of the whiteout files in storage that mask the assets of deleted schemes.
+const whiteoutPrefix = ".wh."
+
+// NewConfigurationOverlay returns a new configuration that uses the assets folder(s) as a read-only
+// lower layer beneath the storage folder at path, instead of copying the schemes out of the assets.
+// ParseFolder() should be called to parse the configuration.
+func NewConfigurationOverlay(path string, assets ...string) (*Configuration, error) {
+	conf, err := newConfiguration(path, assets)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.assets) == 0 {
+		return nil, errors.New("Overlay configuration requires an assets folder")
+	}
+	conf.overlay = true
+	return conf, nil
+}
+
+func (conf *Configuration) whiteout(scheme string) string {
+	return filepath.Join(conf.Path, whiteoutPrefix+scheme)
+}
+
+// masked returns whether the assets of the specified scheme are masked by a whiteout file.
+func (conf *Configuration) masked(scheme string) bool {
+	if !conf.overlay {
+		return false
+	}
+	exists, err := fs.PathExists(conf.whiteout(scheme))
+	return err == nil && exists
+}
+
+// mask removes the specified scheme from storage, in overlay mode masking its assets if any.
+// The scheme folder is first moved out of the way, so that a crash during removal does not leave
+// a partially removed scheme behind.
+func (conf *Configuration) mask(id SchemeManagerIdentifier) error {
+	dir := filepath.Join(conf.Path, id.String())
+	exists, err := fs.PathExists(dir)
+	if err != nil {
+		return err
+	}
+	if exists {
+		tmp, err := ioutil.TempDir(conf.Path, ".remove-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		if err = os.Rename(dir, filepath.Join(tmp, id.String())); err != nil {
+			return err
+		}
+	}
+	if !conf.overlay {
+		return nil
+	}
+	if conf.assetsFolder(id.String()) == "" {
+		return nil
+	}
+	return fs.SaveFile(conf.whiteout(id.String()), nil)
+}
+
+// unmask removes the whiteout file of the specified scheme, if any.
+func (conf *Configuration) unmask(id SchemeManagerIdentifier) error {
+	if !conf.overlay {
+		return nil
+	}
+	if err := os.Remove(conf.whiteout(id.String())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// visible returns whether the specified file or folder in the assets, relative to the assets
+// folder, is part of the overlay. This is the case if its scheme is not masked, and if the file
+// is listed in the index of the scheme in case we know it. The latter hides files in the assets
+// that were removed from the scheme by an update.
+func (conf *Configuration) visible(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	name := schemeOf(rel)
+	if conf.masked(name) {
+		return false
+	}
+	id := NewSchemeManagerIdentifier(name)
+	manager, ok := conf.SchemeManagers[id]
+	if !ok || manager.index == nil || rel == name || conf.IsUnsignedScheme(id) {
+		return true
+	}
+	for _, ex := range sigExceptions {
+		if ex.MatchString(rel) {
+			return true
+		}
+	}
+	return dirInScheme(manager.index, rel)
+}
+
+// resolve returns the path from which to read the file at the specified path in storage.
+// In overlay mode, this is the corresponding file in the assets if storage does not contain it.
+func (conf *Configuration) resolve(path string) string {
+	if !conf.overlay {
+		return path
+	}
+	if exists, err := fs.PathExists(path); err != nil || exists {
+		return path
+	}
+	rel, err := relativePath(conf.Path, path)
+	if err != nil || !conf.visible(rel) {
+		return path
+	}
+	assets := conf.assetsFolder(schemeOf(rel))
+	if assets == "" {
+		return path
+	}
+	return filepath.Join(assets, rel)
+}
+
+// glob is like filepath.Glob() for patterns within storage, in overlay mode additionally
+// returning the visible matches in the assets as their corresponding paths in storage.
+func (conf *Configuration) glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil || !conf.overlay {
+		return matches, err
+	}
+	rel, err := relativePath(conf.Path, pattern)
+	if err != nil {
+		return matches, nil
+	}
+
+	seen := make(map[string]struct{}, len(matches))
+	for _, match := range matches {
+		seen[match] = struct{}{}
+	}
+	for _, assets := range conf.assets {
+		lower, err := filepath.Glob(filepath.Join(assets, rel))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range lower {
+			matchrel, err := relativePath(assets, match)
+			if err != nil {
+				return nil, err
+			}
+			path := filepath.Join(conf.Path, matchrel)
+			if _, ok := seen[path]; ok || !conf.visible(matchrel) || conf.assetsFolder(schemeOf(matchrel)) != assets {
+				continue
+			}
+			seen[path] = struct{}{}
+			matches = append(matches, path)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// iterateSubfolders is like the iterateSubfolders() function, in overlay mode iterating over
+// the subfolders of both layers.
+func (conf *Configuration) iterateSubfolders(path string, handler func(string) error) error {
+	if !conf.overlay {
+		return iterateSubfolders(path, handler)
+	}
+	dirs, err := conf.glob(path + "/*")
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if strings.HasPrefix(filepath.Base(dir), ".") { // e.g. .git, whiteouts, or staging folders of updates
+			continue
+		}
+		stat, err := os.Stat(conf.resolve(dir))
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			continue
+		}
+		if err = handler(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package irma
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/go-errors/errors"
+)
+
+// This file contains the versioning of the messages that IRMA clients and servers exchange during
+// sessions. The protocol version of a session is negotiated when the client first contacts the
+// server, using the MinVersionHeader and MaxVersionHeader (see NegotiateProtocolVersion()).
+// Afterwards, both sides send and receive their messages using MarshalMessage() and
+// UnmarshalMessage(), which emit and accept the wire format of both the current and the previous
+// protocol version. In Go, messages always have the structure of the current version.
+//
+// A change to the wire format of a message is made by raising ProtocolVersionCurrent, and adding
+// a conversion of the message from and to the format of the previous version to previousVersion.
+// When ProtocolVersionPrevious is raised, the conversions of the version that is dropped are
+// removed, along with its golden fixtures in testdata/golden/protocol-<version>.
+
+var (
+	// ProtocolVersionCurrent is the latest protocol version, which is used with peers supporting it.
+	ProtocolVersionCurrent = NewVersion(2, 5)
+	// ProtocolVersionPrevious is the oldest protocol version that is still supported.
+	ProtocolVersionPrevious = NewVersion(2, 4)
+)
+
+// messageConversion converts a protocol message between the current wire format and that of
+// ProtocolVersionPrevious.
+type messageConversion struct {
+	// marshal marshals a message, of the type of the conversion, in the format of the previous version
+	marshal func(message interface{}) ([]byte, error)
+	// upgrade converts a message in the format of the previous version to the current format;
+	// if nil, the previous format is accepted as it is
+	upgrade func(data []byte) ([]byte, error)
+}
+
+// previousVersion contains the conversions of the messages whose wire format differs between
+// ProtocolVersionPrevious and ProtocolVersionCurrent, keyed by their Go type. Messages that are
+// not listed here have the same format in both versions.
+var previousVersion = map[reflect.Type]messageConversion{
+	// Disclosures of version 2.4 do not contain the nonce and context over which they were computed
+	reflect.TypeOf(Disclosure{}): {
+		marshal: func(message interface{}) ([]byte, error) {
+			d := *message.(*Disclosure)
+			d.Nonce, d.Context = nil, nil
+			return json.Marshal(d)
+		},
+	},
+	// Signatures of version 2.4 have no versioned envelope (see SignedMessage); they are accepted
+	// as they are, as SignedMessage.UnmarshalJSON() reads unversioned signatures as version 0
+	reflect.TypeOf(SignedMessage{}): {
+		marshal: func(message interface{}) ([]byte, error) {
+			sm := message.(*SignedMessage)
+			if sm.MessageType != "" && sm.MessageType != SignedMessageTypeString {
+				return nil, errors.Errorf("Signed messages of type %s are not supported by protocol version %s",
+					sm.MessageType, ProtocolVersionPrevious.String())
+			}
+			if sm.MessageDigest != "" {
+				return nil, errors.Errorf("Detached signed messages are not supported by protocol version %s",
+					ProtocolVersionPrevious.String())
+			}
+			return json.Marshal(signedMessageV0{
+				Signature: sm.Signature,
+				Indices:   sm.Indices,
+				Nonce:     sm.Nonce,
+				Context:   sm.Context,
+				Message:   sm.Message,
+				Timestamp: sm.Timestamp,
+			})
+		},
+	},
+}
+
+// NegotiateProtocolVersion returns the protocol version to use with a peer supporting the
+// versions from min up to and including max: the highest version supported by both.
+func NegotiateProtocolVersion(min, max *ProtocolVersion) (*ProtocolVersion, error) {
+	if min.AboveVersion(ProtocolVersionCurrent) || max.BelowVersion(ProtocolVersionPrevious) || max.BelowVersion(min) {
+		return nil, errors.Errorf("Protocol version negotiation failed, min=%s max=%s", min.String(), max.String())
+	}
+	if max.AboveVersion(ProtocolVersionCurrent) {
+		return ProtocolVersionCurrent, nil
+	}
+	return max, nil
+}
+
+// MarshalMessage JSON-marshals the specified protocol message in the wire format of the specified
+// protocol version; nil means ProtocolVersionCurrent.
+func MarshalMessage(version *ProtocolVersion, message interface{}) ([]byte, error) {
+	conversion, err := messageConversionOf(version, message)
+	if err != nil {
+		return nil, err
+	}
+	if conversion.marshal == nil || reflect.ValueOf(message).IsNil() {
+		return json.Marshal(message)
+	}
+	return conversion.marshal(message)
+}
+
+// UnmarshalMessage unmarshals and validates (see UnmarshalValidate()) the specified protocol
+// message, in the wire format of the specified protocol version, into dest. If the version is nil
+// it is read from the protocolVersion field of the message, as present in session requests sent
+// to the client; if that is absent too, the message is taken to be of ProtocolVersionCurrent.
+func UnmarshalMessage(version *ProtocolVersion, data []byte, dest interface{}) error {
+	if version == nil {
+		version = messageVersion(data)
+	}
+	conversion, err := messageConversionOf(version, dest)
+	if err != nil {
+		return err
+	}
+	if conversion.upgrade != nil {
+		if data, err = conversion.upgrade(data); err != nil {
+			return err
+		}
+	}
+	return UnmarshalValidate(data, dest)
+}
+
+// messageConversionOf returns the conversion of messages of the type of the specified message
+// to the specified version, which is empty if the format of the message is the current one.
+// If the version is not supported a *SessionError of type ErrorProtocolVersionNotSupported is returned.
+func messageConversionOf(version *ProtocolVersion, message interface{}) (messageConversion, error) {
+	if version == nil {
+		return messageConversion{}, nil
+	}
+	if version.BelowVersion(ProtocolVersionPrevious) || version.AboveVersion(ProtocolVersionCurrent) {
+		return messageConversion{}, &SessionError{ErrorType: ErrorProtocolVersionNotSupported, Info: version.String()}
+	}
+	if !version.BelowVersion(ProtocolVersionCurrent) {
+		return messageConversion{}, nil
+	}
+	typ := reflect.TypeOf(message)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return messageConversion{}, nil
+	}
+	return previousVersion[typ.Elem()], nil
+}
+
+// messageVersion returns the protocol version in the protocolVersion field of the specified
+// message, or nil if it has none.
+func messageVersion(data []byte) *ProtocolVersion {
+	var message struct {
+		Version *ProtocolVersion `json:"protocolVersion"`
+	}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil
+	}
+	return message.Version
+}
@@ -0,0 +1,155 @@
+package irma
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the fetching of public keys that are missing from the scheme folder from
+// their scheme manager, which PublicKey() does when enabled using SetDownloadMissingPublicKeys().
+// This allows verifiers to accept proofs using keys that their issuers started using after the
+// scheme was last updated, e.g. right after a key rotation. A fetched key is authenticated using
+// the index of the scheme in storage if that lists it, in which case the key is also saved into
+// the scheme folder (e.g. after its file went missing). Otherwise the key is authenticated using
+// the current index of the scheme manager, whose signature is verified against the public key of
+// the scheme in storage; then the key is only cached in memory, until the next scheme update
+// stores it. Keys that the scheme manager does not have, or that could otherwise not be fetched,
+// are not requested again until missingPublicKeyRetry has passed. Fetches aborted because the
+// context of the caller was done do not count as failed.
+
+// missingPublicKeyRetry is the time after which fetching a public key that failed is retried.
+var missingPublicKeyRetry = 5 * time.Minute
+
+// SetDownloadMissingPublicKeys sets whether PublicKey() fetches public keys that are missing from
+// the scheme folder from their scheme manager.
+func (conf *Configuration) SetDownloadMissingPublicKeys(download bool) {
+	conf.downloadKeys = download
+}
+
+// fetchPublicKey fetches the specified public key from its scheme manager, and caches the result.
+// As verification fails anyway if the key cannot be fetched, errors are logged instead of returned,
+// except for the error of the context if it is done.
+func (conf *Configuration) fetchPublicKey(ctx context.Context, id IssuerIdentifier, counter int) (*gabi.PublicKey, error) {
+	conf.fetchLock.Lock()
+	defer conf.fetchLock.Unlock()
+
+	// Another goroutine may have fetched the key, or failed to, while we were waiting for the lock
+	conf.keysLock.Lock()
+	pk := conf.publicKeys[id][counter]
+	failed, ok := conf.missingKeys[id][counter]
+	conf.keysLock.Unlock()
+	if pk != nil || (ok && time.Since(failed) < missingPublicKeyRetry) {
+		return pk, nil
+	}
+
+	pk, err := conf.fetchPublicKeyFile(ctx, id, counter)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		Logger.Warnf("Failed to fetch public key %s-%d: %s", id.String(), counter, err.Error())
+	}
+
+	conf.keysLock.Lock()
+	defer conf.keysLock.Unlock()
+	if pk == nil {
+		if conf.missingKeys[id] == nil {
+			conf.missingKeys[id] = map[int]time.Time{}
+		}
+		conf.missingKeys[id][counter] = time.Now()
+		return nil, nil
+	}
+	delete(conf.missingKeys[id], counter)
+	if conf.publicKeys[id] == nil {
+		conf.publicKeys[id] = map[int]*gabi.PublicKey{}
+	}
+	conf.publicKeys[id][counter] = pk
+	return pk, nil
+}
+
+// fetchPublicKeyFile downloads and authenticates the specified public key, returning nil if the
+// scheme manager does not have it.
+func (conf *Configuration) fetchPublicKeyFile(ctx context.Context, id IssuerIdentifier, counter int) (*gabi.PublicKey, error) {
+	manager, ok := conf.SchemeManagers[id.SchemeManagerIdentifier()]
+	if !ok || manager.URL == "" || conf.IsUnsignedScheme(manager.Identifier()) {
+		return nil, nil
+	}
+
+	filename := fmt.Sprintf("%s/%s/PublicKeys/%d.xml", manager.ID, id.Name(), counter)
+	transport := conf.newHTTPTransport(manager.URL + "/")
+	transport.SetContext(ctx)
+	hash, store := manager.index[filename]
+	if !store {
+		index, err := conf.fetchIndex(manager, transport)
+		if err != nil {
+			return nil, err
+		}
+		if hash, ok = index[filename]; !ok {
+			return nil, nil
+		}
+	}
+
+	bts, err := transport.GetBytes(filename[len(manager.ID)+1:]) // Scheme manager URL already ends with its name
+	if err != nil {
+		return nil, err
+	}
+	if computed := sha256.Sum256(bts); !hash.Equal(computed[:]) {
+		return nil, errors.Errorf("Hash of %s does not match scheme manager index", filename)
+	}
+	pk, err := gabi.NewPublicKeyFromBytes(bts)
+	if err != nil {
+		return nil, errors.Errorf("Public key %s of issuer %s could not be parsed: %s", filename, id.String(), err.Error())
+	}
+	if err = checkPublicKey(pk, counter); err != nil {
+		return nil, errors.Errorf("Public key %s of issuer %s %s", filename, id.String(), err.Error())
+	}
+	pk.Issuer = id.String()
+
+	if store && !conf.readOnly {
+		path := filepath.Join(conf.Path, filename)
+		if err = fs.EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+		if err = fs.SaveFile(path, bts); err != nil {
+			return nil, err
+		}
+	}
+	return pk, nil
+}
+
+// fetchIndex downloads the current index of the specified scheme manager, verifying its signature
+// against the public key of the scheme in storage.
+func (conf *Configuration) fetchIndex(manager *SchemeManager, transport *HTTPTransport) (SchemeManagerIndex, error) {
+	indexbts, err := transport.GetBytes("index")
+	if err != nil {
+		return nil, err
+	}
+	sig, err := transport.GetBytes("index.sig")
+	if err != nil {
+		return nil, err
+	}
+	pkbts, err := ioutil.ReadFile(conf.resolve(filepath.Join(conf.Path, manager.ID, "pk.pem")))
+	if err != nil {
+		return nil, err
+	}
+	pk, err := ParsePemEcdsaPublicKey(pkbts)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyIndexSignature(pk, indexbts, sig); err != nil {
+		return nil, err
+	}
+	index := SchemeManagerIndex(make(map[string]ConfigurationFileHash))
+	if err = index.FromString(string(indexbts)); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
@@ -0,0 +1,61 @@
+package irma
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// This file contains the reloading of schemes that were changed in storage by other means than
+// UpdateSchemes(), e.g. by an administrator installing a new version of a scheme containing a new
+// issuer key, so that long-running processes such as the IRMA server need not be restarted.
+// Whether a scheme changed is judged by its signed timestamp, which a new version of a scheme
+// always increases; scheme folders that were added or removed are also noticed. The assets
+// folders are not checked, as their schemes are copied into storage only by ParseFolder().
+
+// SchemesModified returns whether the schemes in the irma_configuration folder differ from the
+// parsed ones: whether scheme folders were added or removed, or the timestamp of a scheme changed.
+func (conf *Configuration) SchemesModified() (bool, error) {
+	var dirs []string
+	err := conf.iterateSubfolders(conf.Path, func(dir string) error {
+		dirs = append(dirs, dir)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(dirs) != len(conf.SchemeManagers) {
+		return true, nil
+	}
+
+	for _, dir := range dirs {
+		manager, ok := conf.SchemeManagers[NewSchemeManagerIdentifier(filepath.Base(dir))]
+		if !ok {
+			return true, nil
+		}
+		ts, exists, err := readTimestamp(conf.resolve(filepath.Join(dir, "timestamp")))
+		if err != nil {
+			return false, err
+		}
+		if !exists || !time.Time(*ts).Equal(time.Time(manager.Timestamp)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ReloadSnapshot re-parses the irma_configuration folder into a new Configuration like Reparse()
+// if SchemesModified() reports that the schemes in it changed, and returns nil otherwise. As with
+// UpdateSchemesSnapshot(), conf is left unmodified so that it can be used concurrently, and the
+// public keys of the returned snapshot are parsed immediately instead of lazily.
+func (conf *Configuration) ReloadSnapshot() (*Configuration, error) {
+	modified, err := conf.SchemesModified()
+	if err != nil || !modified {
+		return nil, err
+	}
+	fresh, err := conf.Reparse()
+	if err != nil {
+		return nil, err
+	}
+	fresh.parsePublicKeys()
+	return fresh, nil
+}
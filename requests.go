@@ -1,9 +1,13 @@
 package irma
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bwesterb/go-atum"
@@ -24,6 +28,169 @@ type BaseRequest struct {
 	Ids        *IrmaIdentifierSet       `json:"-"`
 
 	Version *ProtocolVersion `json:"protocolVersion,omitempty"`
+
+	// Where to find scheme managers that the request refers to, for IRMA apps and servers that don't have them yet
+	SchemeManagers map[SchemeManagerIdentifier]*SchemeManagerPointer `json:"schemeManagers,omitempty"`
+
+	// Whether attributes of expired credentials are accepted; if absent, the default of the verifier applies
+	AcceptExpired *bool `json:"acceptExpired,omitempty"`
+	// If expired attributes are accepted, the maximum number of seconds since their expiry; 0 for no maximum
+	MaxExpiredAge int64 `json:"maxExpiredAge,omitempty"`
+
+	// Whether the verifier must check that the credentials of the disclosed attributes were not
+	// revoked. The IRMA server refuses such requests if it has no revocation checker.
+	RevocationCheck bool `json:"revocationCheck,omitempty"`
+}
+
+// RequiresRevocationCheck returns whether the credentials of the attributes disclosed
+// in the session must be checked for revocation.
+func (sr *BaseRequest) RequiresRevocationCheck() bool {
+	return sr.RevocationCheck
+}
+
+// ExpiryPolicy returns the policy of this request for attributes of expired credentials.
+func (sr *BaseRequest) ExpiryPolicy() ExpiryPolicy {
+	return ExpiryPolicy{
+		AcceptExpired: sr.AcceptExpired != nil && *sr.AcceptExpired,
+		MaxExpiredAge: time.Duration(sr.MaxExpiredAge) * time.Second,
+	}
+}
+
+// SetDefaultExpiryPolicy sets the policy for attributes of expired credentials to the specified one,
+// if the request does not specify one itself.
+func (sr *BaseRequest) SetDefaultExpiryPolicy(policy ExpiryPolicy) {
+	if sr.AcceptExpired != nil {
+		return
+	}
+	sr.AcceptExpired = &policy.AcceptExpired
+	sr.MaxExpiredAge = int64(policy.MaxExpiredAge / time.Second)
+}
+
+// validateType records a problem in verr if the request is not of the specified type,
+// returning whether it is.
+func (sr *BaseRequest) validateType(verr *ValidationError, action Action, message string) bool {
+	switch sr.Type {
+	case action:
+		return true
+	case "":
+		verr.add("type", nil, ValidationErrorMissingField, message)
+	default:
+		verr.add("type", sr.Type, ValidationErrorInvalidValue, message)
+	}
+	return false
+}
+
+func (sr *BaseRequest) validateExpiryPolicy(verr *ValidationError) {
+	if sr.MaxExpiredAge < 0 {
+		verr.add("maxExpiredAge", sr.MaxExpiredAge, ValidationErrorInvalidValue, "Negative maximum age of expired attributes")
+	}
+	if sr.MaxExpiredAge != 0 && sr.AcceptExpired != nil && !*sr.AcceptExpired {
+		verr.add("maxExpiredAge", sr.MaxExpiredAge, ValidationErrorConflictingFields,
+			"Maximum age of expired attributes specified while expired attributes are not accepted")
+	}
+}
+
+// setInferredType sets the type of the request to the specified action if it has none.
+func (sr *BaseRequest) setInferredType(action Action) {
+	if sr.Type == "" {
+		sr.Type = action
+	}
+}
+
+// InferAction returns the action of the specified JSON session request, or of the session request
+// in the "request" field of the specified JSON requestor request. If the request has no "type" it is
+// inferred from the fields that are present: "credentials" implies issuing, "message" signing, and
+// "content" disclosing. An error is returned if the action cannot be inferred, if the fields
+// imply more than one action, or if they contradict the explicit type of the request.
+func InferAction(data []byte) (Action, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", errors.WrapPrefix(err, "Failed to JSON unmarshal session request", 0)
+	}
+	if present(fields, "request") {
+		var request map[string]json.RawMessage
+		if err := json.Unmarshal(fields["request"], &request); err != nil {
+			return "", errors.WrapPrefix(err, "Failed to JSON unmarshal session request", 0)
+		}
+		action, err := inferAction(request)
+		if err != nil {
+			verr := &ValidationError{}
+			verr.merge("request", err)
+			return "", verr
+		}
+		return action, nil
+	}
+	action, err := inferAction(fields)
+	if err != nil {
+		return "", err
+	}
+	return action, nil
+}
+
+func inferAction(fields map[string]json.RawMessage) (Action, *ValidationError) {
+	verr := &ValidationError{}
+	credentials, message, content := present(fields, "credentials"), present(fields, "message"), present(fields, "content")
+
+	var action Action
+	if present(fields, "type") {
+		if err := json.Unmarshal(fields["type"], &action); err != nil {
+			verr.add("type", nil, ValidationErrorInvalidValue, "Session type is not a string")
+			return "", verr
+		}
+	}
+	switch action {
+	case ActionIssuing, ActionSigning, ActionDisclosing:
+		if credentials && action != ActionIssuing {
+			verr.add("credentials", nil, ValidationErrorConflictingFields, "Credentials in %s session request", action)
+		}
+		if message && action != ActionSigning {
+			verr.add("message", nil, ValidationErrorConflictingFields, "Message in %s session request", action)
+		}
+		if content && action == ActionIssuing {
+			verr.add("content", nil, ValidationErrorConflictingFields,
+				"Content in issuance session request, attributes to disclose should be in disclose")
+		}
+		return action, verr.errorOrNil()
+	case "":
+		// inferred below
+	default:
+		verr.add("type", action, ValidationErrorInvalidValue, "Unknown session type %s", action)
+		return "", verr
+	}
+
+	switch {
+	case credentials && (message || content):
+		verr.add("type", nil, ValidationErrorConflictingFields,
+			"Session request has no type, and both credentials and message or content are present")
+	case credentials:
+		return ActionIssuing, nil
+	case message:
+		return ActionSigning, nil
+	case content:
+		return ActionDisclosing, nil
+	case present(fields, "disclose"):
+		verr.add("type", nil, ValidationErrorConflictingFields,
+			"Session request has no type, and disclose is present without credentials")
+	default:
+		verr.add("type", nil, ValidationErrorMissingField,
+			"Session request has no type, and none of credentials, message or content are present")
+	}
+	return "", verr
+}
+
+// present returns whether the specified JSON object contains a non-null value for the specified key.
+func present(fields map[string]json.RawMessage, key string) bool {
+	value, ok := fields[key]
+	return ok && string(value) != "null"
+}
+
+// SchemeManagerPointer returns where to find the specified scheme manager: from the scheme
+// managers specified in the request, or otherwise from DefaultSchemeManagers.
+func (sr *BaseRequest) SchemeManagerPointer(id SchemeManagerIdentifier) *SchemeManagerPointer {
+	if pointer, ok := sr.SchemeManagers[id]; ok && pointer != nil {
+		return pointer
+	}
+	return defaultSchemeManagerPointer(id)
 }
 
 func (sr *BaseRequest) SetCandidates(candidates [][]*AttributeIdentifier) {
@@ -60,6 +227,11 @@ type DisclosureRequest struct {
 type SignatureRequest struct {
 	DisclosureRequest
 	Message string `json:"message"`
+	// Type of the message; SignedMessageTypeString if empty. For SignedMessageTypeSHA256 the
+	// message is a SignedDocument, see NewSignedDocument().
+	MessageType string `json:"messageType,omitempty"`
+	// Whether the resulting signed message should be detached from the message, see SignedMessage.Detach().
+	Detached bool `json:"detached,omitempty"`
 
 	// Session state
 	Timestamp *atum.Timestamp `json:"-"`
@@ -80,10 +252,95 @@ type IssuanceRequest struct {
 // A CredentialRequest contains the attributes and metadata of a credential
 // that will be issued in an IssuanceRequest.
 type CredentialRequest struct {
-	Validity         *Timestamp               `json:"validity,omitempty"`
+	// Expiry date of the credential, which is rounded down to the epoch boundary (see FloorToEpochBoundary()).
+	// In JSON either a Unix timestamp or an RFC3339 date. If absent, the credential is valid for 6 months.
+	Validity *Timestamp `json:"validity,omitempty"`
+	// Counter of the issuer key with which to issue the credential. If absent, the latest key is used.
 	KeyCounter       int                      `json:"keyCounter,omitempty"`
 	CredentialTypeID CredentialTypeIdentifier `json:"credential"`
 	Attributes       map[string]string        `json:"attributes"`
+
+	keyCounterSpecified bool
+}
+
+// UnmarshalJSON unmarshals a credential request, accepting its validity either as a Unix timestamp
+// or as an RFC3339 date (e.g. "2030-01-01T00:00:00Z").
+func (cr *CredentialRequest) UnmarshalJSON(bts []byte) error {
+	type credentialRequest CredentialRequest // prevent recursion
+	temp := struct {
+		*credentialRequest
+		Validity   json.RawMessage `json:"validity"`
+		KeyCounter *int            `json:"keyCounter"`
+	}{credentialRequest: (*credentialRequest)(cr)}
+	if err := json.Unmarshal(bts, &temp); err != nil {
+		return err
+	}
+
+	cr.Validity = nil
+	if len(temp.Validity) > 0 && string(temp.Validity) != "null" {
+		var date string
+		if err := json.Unmarshal(temp.Validity, &date); err == nil {
+			t, err := time.Parse(time.RFC3339, date)
+			if err != nil {
+				return errors.Errorf("Credential validity %s is not an RFC3339 date", date)
+			}
+			ts := Timestamp(t)
+			cr.Validity = &ts
+		} else {
+			ts := Timestamp{}
+			if err := json.Unmarshal(temp.Validity, &ts); err != nil {
+				return errors.Errorf("Credential validity %s is neither a Unix timestamp nor an RFC3339 date", string(temp.Validity))
+			}
+			cr.Validity = &ts
+		}
+	}
+
+	cr.KeyCounter, cr.keyCounterSpecified = 0, temp.KeyCounter != nil
+	if temp.KeyCounter != nil {
+		cr.KeyCounter = *temp.KeyCounter
+	}
+	return nil
+}
+
+// DisclosedAttributeReferencePrefix is the prefix of attribute values in credential requests that refer to
+// an attribute disclosed in the same session, e.g. "$disclosed.irma-demo.MijnOverheid.root.BSN". Such values
+// are replaced by the value of the disclosed attribute, see IssuanceRequest.ResolveReferences().
+const DisclosedAttributeReferencePrefix = "$disclosed."
+
+// References returns the attributes of the credential request of which the value refers to a
+// disclosed attribute, mapped to the attribute they refer to.
+func (cr *CredentialRequest) References() map[string]AttributeTypeIdentifier {
+	refs := map[string]AttributeTypeIdentifier{}
+	for name, value := range cr.Attributes {
+		if strings.HasPrefix(value, DisclosedAttributeReferencePrefix) {
+			refs[name] = NewAttributeTypeIdentifier(strings.TrimPrefix(value, DisclosedAttributeReferencePrefix))
+		}
+	}
+	return refs
+}
+
+// KeyCounterSpecified returns whether the issuer key with which to issue the credential is specified
+// by KeyCounter, i.e. KeyCounter is nonzero or was present in the JSON of the request.
+func (cr *CredentialRequest) KeyCounterSpecified() bool {
+	return cr.keyCounterSpecified || cr.KeyCounter != 0
+}
+
+// ValidateKey checks that the issuer public key with the KeyCounter of this credential request is
+// present in the specified Configuration, and that it does not expire before the credential does.
+func (cr *CredentialRequest) ValidateKey(conf *Configuration) error {
+	iss := cr.CredentialTypeID.IssuerIdentifier()
+	pk, err := conf.PublicKey(iss, cr.KeyCounter)
+	if err != nil {
+		return err
+	}
+	if pk == nil {
+		return errors.Errorf("Unknown public key %d of issuer %s", cr.KeyCounter, iss.String())
+	}
+	if cr.Validity != nil && time.Time(*cr.Validity).Unix() > pk.ExpiryDate {
+		return errors.Errorf("Credential validity %s is beyond the expiry date of public key %d of issuer %s",
+			cr.Validity.String(), cr.KeyCounter, iss.String())
+	}
+	return nil
 }
 
 // ServerJwt contains standard JWT fields.
@@ -99,6 +356,31 @@ type RequestorBaseRequest struct {
 	ResultJwtValidity int    `json:"validity,omitempty"`    // Validity of session result JWT in seconds
 	ClientTimeout     int    `json:"timeout,omitempty"`     // Wait this many seconds for the IRMA app to connect before the session times out
 	CallbackUrl       string `json:"callbackUrl,omitempty"` // URL to post session result to
+
+	// CredentialHashes specifies that the session result should include the credential hashes of the
+	// disclosed attributes, with which disclosures of the same credential instance can be linked
+	// (see DisclosedAttribute.CredentialHash). The IRMA server requires permission for this.
+	CredentialHashes bool `json:"credentialHashes,omitempty"`
+
+	// HashAttributeValues specifies that the values of the disclosed attributes in the session result
+	// are replaced by their hashes, salted with HashSalt (see HashAttributeValue()), for requestors that
+	// only need to compare the values with ones they already hold. The values are still verified by the
+	// IRMA server as usual. Only supported in disclosure sessions, as signatures contain the values and
+	// issued credentials the values they refer to. The IRMA server requires permission for this.
+	HashAttributeValues bool   `json:"hashAttributeValues,omitempty"`
+	HashSalt            string `json:"hashSalt,omitempty"`
+
+	// Legacy is true if the request was converted from a JWT in the format of the irma_api_server
+	Legacy bool `json:"-"`
+
+	// Requestor is the name of the requestor that started the session, as authenticated by the
+	// requestor server, which uses it for the rest of the session (see SetRequestor())
+	Requestor string `json:"-"`
+}
+
+// SetRequestor sets the name of the authenticated requestor that started the session.
+func (r *RequestorBaseRequest) SetRequestor(name string) {
+	r.Requestor = name
 }
 
 // RequestorRequest is the message with which requestors start an IRMA session. It contains a
@@ -107,6 +389,7 @@ type RequestorRequest interface {
 	Validator
 	SessionRequest() SessionRequest
 	Base() RequestorBaseRequest
+	SetRequestor(name string)
 }
 
 // A ServiceProviderRequest contains a disclosure request.
@@ -119,6 +402,13 @@ type ServiceProviderRequest struct {
 type SignatureRequestorRequest struct {
 	RequestorBaseRequest
 	Request *SignatureRequest `json:"request"`
+
+	// MultiParty specifies that the session starts a multi-party signature (see MultiSignedMessage),
+	// which is then included in the session result. Further signers sign in sessions that specify
+	// the token of the previous session as Previous, which must be finished with a valid signature
+	// and have the same message; their session results include the signatures of all signers so far.
+	MultiParty bool   `json:"multiParty,omitempty"`
+	Previous   string `json:"previous,omitempty"`
 }
 
 // An IdentityProviderRequest contains an issuance request.
@@ -146,24 +436,40 @@ type IdentityProviderJwt struct {
 }
 
 func (r *ServiceProviderRequest) Validate() error {
-	if r.Request == nil {
+	if r == nil || r.Request == nil {
 		return errors.New("Not a ServiceProviderRequest")
 	}
-	return r.Request.Validate()
+	return validateRequest(r)
 }
 
 func (r *SignatureRequestorRequest) Validate() error {
-	if r.Request == nil {
+	if r == nil || r.Request == nil {
 		return errors.New("Not a SignatureRequestorRequest")
 	}
-	return r.Request.Validate()
+	return validateRequest(r)
 }
 
 func (r *IdentityProviderRequest) Validate() error {
-	if r.Request == nil {
+	if r == nil || r.Request == nil {
 		return errors.New("Not a IdentityProviderRequest")
 	}
-	return r.Request.Validate()
+	return validateRequest(r)
+}
+
+// validateRequest validates a RequestorRequest and its session request, prefixing the paths
+// of the problems it finds in the session request with that of the session request.
+func validateRequest(r RequestorRequest) error {
+	verr := &ValidationError{}
+	if base := r.Base(); base.HashAttributeValues {
+		if base.HashSalt == "" {
+			verr.add("hashSalt", base.HashSalt, ValidationErrorMissingField, "A salt is required to hash attribute values")
+		}
+		if r.SessionRequest().Action() != ActionDisclosing {
+			verr.add("hashAttributeValues", true, ValidationErrorInvalidValue, "Attribute values can only be hashed in disclosure sessions")
+		}
+	}
+	verr.merge("request", r.SessionRequest().Validate())
+	return verr.errorOrNil()
 }
 
 func (r *ServiceProviderRequest) SessionRequest() SessionRequest {
@@ -205,6 +511,10 @@ type SessionRequest interface {
 	SetCandidates(candidates [][]*AttributeIdentifier)
 	Identifiers() *IrmaIdentifierSet
 	Action() Action
+	SchemeManagerPointer(id SchemeManagerIdentifier) *SchemeManagerPointer
+	ExpiryPolicy() ExpiryPolicy
+	SetDefaultExpiryPolicy(policy ExpiryPolicy)
+	RequiresRevocationCheck() bool
 }
 
 // Timestamp is a time.Time that marshals to Unix timestamps.
@@ -219,17 +529,28 @@ func (cr *CredentialRequest) Info(conf *Configuration, metadataVersion byte) (*C
 }
 
 // Validate checks that this credential request is consistent with the specified Configuration:
-// the credential type is known, all required attributes are present and no unknown attributes
-// are given.
+// the credential type is known, all attributes not marked optional in the credential type are
+// present and no unknown attributes are given. Optional attributes that are omitted are encoded as
+// absent by AttributeList(), as opposed to attributes that are present with the empty string as value.
+// Derived attributes may be omitted if their source attribute is present; if they are present,
+// their value must equal the value computed from the source attribute.
 func (cr *CredentialRequest) Validate(conf *Configuration) error {
+	verr := &ValidationError{}
 	credtype := conf.CredentialTypes[cr.CredentialTypeID]
 	if credtype == nil {
-		return errors.New("Credential request of unknown credential type")
+		verr.add("credential", cr.CredentialTypeID.String(), ValidationErrorUnknownCredentialType,
+			"Credential request of unknown credential type %s", cr.CredentialTypeID.String())
+		return verr
 	}
 
 	// Check that there are no attributes in the credential request that aren't
 	// in the credential descriptor.
+	names := make([]string, 0, len(cr.Attributes))
 	for crName := range cr.Attributes {
+		names = append(names, crName)
+	}
+	sort.Strings(names)
+	for _, crName := range names {
 		found := false
 		for _, ad := range credtype.AttributeTypes {
 			if ad.ID == crName {
@@ -238,24 +559,100 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 			}
 		}
 		if !found {
-			return errors.New("Credential request contaiins unknown attribute")
+			verr.add("attributes."+crName, crName, ValidationErrorUnknownAttribute,
+				"Credential request contains unknown attribute %s.%s", cr.CredentialTypeID.String(), crName)
 		}
 	}
 
 	for _, attrtype := range credtype.AttributeTypes {
-		if _, present := cr.Attributes[attrtype.ID]; !present && attrtype.Optional != "true" {
-			return errors.New("Required attribute not present in credential request")
+		value, present := cr.Attributes[attrtype.ID]
+		if !present {
+			if _, sourcePresent := cr.derivationSource(attrtype); sourcePresent {
+				continue // computed by DeriveAttributes()
+			}
+			if !attrtype.IsOptional() {
+				verr.add("attributes."+attrtype.ID, nil, ValidationErrorMissingField,
+					"Required attribute %s not present in credential request", attrtype.GetAttributeTypeIdentifier().String())
+			}
+			continue
+		}
+		if strings.HasPrefix(value, DisclosedAttributeReferencePrefix) {
+			continue // checked by IssuanceRequest.Validate(), and after it is resolved
+		}
+		if _, err := attrtype.ValueType().Parse(value); err != nil {
+			verr.add("attributes."+attrtype.ID, value, ValidationErrorInvalidValue, "Invalid value for attribute %s of type %s: %s",
+				attrtype.GetAttributeTypeIdentifier().String(), attrtype.ValueType(), err.Error())
+			continue
+		}
+		if source, ok := cr.derivationSource(attrtype); ok {
+			derived, err := attrtype.Derivation.Derive(source, time.Now())
+			if err != nil {
+				continue // invalid source value, reported at the source attribute
+			}
+			if derived != value {
+				verr.add("attributes."+attrtype.ID, value, ValidationErrorConflictingFields,
+					"Value %s of attribute %s does not match value %s computed from attribute %s",
+					value, attrtype.GetAttributeTypeIdentifier().String(), derived, attrtype.Derivation.Source)
+			}
 		}
 	}
 
+	return verr.errorOrNil()
+}
+
+// derivationSource returns the value of the attribute from which the specified attribute type
+// is derived, and whether the attribute type is derived and its source value is present
+// in this credential request as an actual value (and not a reference to a disclosed attribute).
+func (cr *CredentialRequest) derivationSource(attrtype *AttributeType) (string, bool) {
+	if !attrtype.IsDerived() {
+		return "", false
+	}
+	value, present := cr.Attributes[attrtype.Derivation.Source]
+	if !present || strings.HasPrefix(value, DisclosedAttributeReferencePrefix) {
+		return "", false
+	}
+	return value, true
+}
+
+// DeriveAttributes computes the values of the derived attributes of the credential type that are
+// omitted in this credential request but of which the source attribute is present, as of now.
+func (cr *CredentialRequest) DeriveAttributes(conf *Configuration) error {
+	credtype := conf.CredentialTypes[cr.CredentialTypeID]
+	if credtype == nil {
+		return errors.Errorf("Credential request of unknown credential type %s", cr.CredentialTypeID.String())
+	}
+	now := time.Now()
+	for _, attrtype := range credtype.AttributeTypes {
+		if _, present := cr.Attributes[attrtype.ID]; present {
+			continue
+		}
+		source, ok := cr.derivationSource(attrtype)
+		if !ok {
+			continue
+		}
+		value, err := attrtype.Derivation.Derive(source, now)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to compute attribute "+attrtype.GetAttributeTypeIdentifier().String(), 0)
+		}
+		if cr.Attributes == nil {
+			cr.Attributes = map[string]string{}
+		}
+		cr.Attributes[attrtype.ID] = value
+	}
 	return nil
 }
 
-// AttributeList returns the list of attributes from this credential request.
+// AttributeList returns the list of attributes from this credential request. As metadata versions
+// below 3 have no encoding for absent attributes, in which they would be indistinguishable from
+// empty attributes, an error is returned if an optional attribute is omitted in that case.
+// Omitted derived attributes are first computed from their source attribute, see DeriveAttributes().
 func (cr *CredentialRequest) AttributeList(conf *Configuration, metadataVersion byte) (*AttributeList, error) {
 	if err := cr.Validate(conf); err != nil {
 		return nil, err
 	}
+	if err := cr.DeriveAttributes(conf); err != nil {
+		return nil, err
+	}
 
 	// Compute metadata attribute
 	meta := NewMetadataAttribute(metadataVersion)
@@ -272,13 +669,20 @@ func (cr *CredentialRequest) AttributeList(conf *Configuration, metadataVersion
 	attrs[0] = meta.Int
 	for i, attrtype := range credtype.AttributeTypes {
 		attrs[i+1] = new(big.Int)
-		if str, present := cr.Attributes[attrtype.ID]; present {
-			// Set attribute to str << 1 + 1
-			attrs[i+1].SetBytes([]byte(str))
-			if meta.Version() >= 0x03 {
-				attrs[i+1].Lsh(attrs[i+1], 1)             // attr <<= 1
-				attrs[i+1].Add(attrs[i+1], big.NewInt(1)) // attr += 1
+		str, present := cr.Attributes[attrtype.ID]
+		if !present {
+			// Absent attributes are encoded as 0, which no present attribute is encoded to from version 3 on
+			if meta.Version() < 0x03 {
+				return nil, errors.Errorf("Optional attribute %s cannot be absent in metadata version %d",
+					attrtype.GetAttributeTypeIdentifier().String(), meta.Version())
 			}
+			continue
+		}
+		// Set attribute to str << 1 + 1
+		attrs[i+1].SetBytes([]byte(str))
+		if meta.Version() >= 0x03 {
+			attrs[i+1].Lsh(attrs[i+1], 1)             // attr <<= 1
+			attrs[i+1].Add(attrs[i+1], big.NewInt(1)) // attr += 1
 		}
 	}
 
@@ -359,12 +763,78 @@ func (ir *IssuanceRequest) SetNonce(nonce *big.Int) { ir.Nonce = nonce }
 func (ir *IssuanceRequest) Action() Action { return ActionIssuing }
 
 func (ir *IssuanceRequest) Validate() error {
-	if ir.Type != ActionIssuing {
-		return errors.New("Not an issuance request")
+	verr := &ValidationError{}
+	if !ir.validateType(verr, ActionIssuing, "Not an issuance request") {
+		return verr
 	}
 	if len(ir.Credentials) == 0 {
-		return errors.New("Empty issuance request")
+		verr.add("credentials", nil, ValidationErrorMissingField, "Empty issuance request")
+	}
+	ir.validateExpiryPolicy(verr)
+	for i, cred := range ir.Credentials {
+		path := fmt.Sprintf("credentials[%d]", i)
+		if cred == nil {
+			verr.add(path, nil, ValidationErrorMissingField, "Empty credential request")
+			continue
+		}
+		if cred.CredentialTypeID.Empty() {
+			verr.add(path+".credential", nil, ValidationErrorMissingField, "Credential request without credential type")
+		}
+		if cred.Validity != nil && !time.Time(*cred.Validity).After(time.Now()) {
+			verr.add(path+".validity", cred.Validity.String(), ValidationErrorInvalidValue,
+				"Validity of credential %s is not in the future", cred.CredentialTypeID.String())
+		}
+		if cred.KeyCounter < 0 {
+			verr.add(path+".keyCounter", cred.KeyCounter, ValidationErrorInvalidValue,
+				"Negative key counter for credential %s", cred.CredentialTypeID.String())
+		}
+		ir.validateReferences(verr, path, cred)
+	}
+	ir.Disclose.validate(verr, "disclose")
+	return verr.errorOrNil()
+}
+
+// validateReferences checks that the attributes of the credential request that refer to a disclosed
+// attribute refer to one that the request asks to be disclosed, recording problems in verr.
+func (ir *IssuanceRequest) validateReferences(verr *ValidationError, path string, cred *CredentialRequest) {
+	refs := cred.References()
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	for _, name := range names {
+		id := refs[name]
+		attrpath := path + ".attributes." + name
+		if strings.Count(id.String(), ".") != 3 || id.IsWildcard() {
+			verr.add(attrpath, cred.Attributes[name], ValidationErrorInvalidValue,
+				"Attribute %s has malformed reference to disclosed attribute %s", name, id.String())
+			continue
+		}
+		if !ir.Disclose.requests(id) {
+			verr.add(attrpath, cred.Attributes[name], ValidationErrorUnknownAttribute,
+				"Attribute %s refers to attribute %s, which is not requested to be disclosed", name, id.String())
+		}
+	}
+}
+
+// ResolveReferences replaces the values of attributes of the credentials to be issued that refer to a
+// disclosed attribute (see DisclosedAttributeReferencePrefix) by the value of that attribute in the
+// specified map, which should contain the values of the attributes disclosed in the session.
+func (ir *IssuanceRequest) ResolveReferences(disclosed map[AttributeTypeIdentifier]*string) error {
+	for _, cred := range ir.Credentials {
+		for name, id := range cred.References() {
+			value, ok := disclosed[id]
+			if !ok {
+				return errors.Errorf("Attribute %s refers to attribute %s, which was not disclosed", name, id.String())
+			}
+			if value == nil {
+				return errors.Errorf("Attribute %s refers to attribute %s, which was disclosed without value", name, id.String())
+			}
+			cred.Attributes[name] = *value
+		}
+	}
+	ir.CredentialInfoList = nil
 	return nil
 }
 
@@ -405,24 +875,30 @@ func (dr *DisclosureRequest) SetNonce(nonce *big.Int) { dr.Nonce = nonce }
 func (dr *DisclosureRequest) Action() Action { return ActionDisclosing }
 
 func (dr *DisclosureRequest) Validate() error {
-	if dr.Type != ActionDisclosing {
-		return errors.New("Not a disclosure request")
+	verr := &ValidationError{}
+	if !dr.validateType(verr, ActionDisclosing, "Not a disclosure request") {
+		return verr
 	}
 	if len(dr.Content) == 0 {
-		return errors.New("Disclosure request had no attributes")
+		verr.add("content", nil, ValidationErrorMissingField, "Disclosure request had no attributes")
 	}
-	for _, disjunction := range dr.Content {
-		if len(disjunction.Attributes) == 0 {
-			return errors.New("Disclosure request had an empty disjunction")
-		}
-	}
-	return nil
+	dr.validateExpiryPolicy(verr)
+	dr.Content.validate(verr, "content")
+	return verr.errorOrNil()
 }
 
 // GetNonce returns the nonce of this signature session
-// (with the message already hashed into it).
+// (with the message, and from protocol version 2.5 the conditions, already hashed into it).
 func (sr *SignatureRequest) GetNonce() *big.Int {
-	return ASN1ConvertSignatureNonce(sr.Message, sr.Nonce, sr.Timestamp)
+	return sr.nonce(signatureBindsConditions(sr.Version))
+}
+
+func (sr *SignatureRequest) nonce(bindConditions bool) *big.Int {
+	if !bindConditions {
+		return ASN1ConvertSignatureNonce(sr.Message, sr.Nonce, sr.Timestamp)
+	}
+	msgHash := sha256.Sum256([]byte(sr.Message))
+	return asn1SignatureNonce(msgHash[:], sr.Nonce, sr.Timestamp, conditionsHash(sr.Content))
 }
 
 func (sr *SignatureRequest) SignatureFromMessage(message interface{}) (*SignedMessage, error) {
@@ -432,34 +908,59 @@ func (sr *SignatureRequest) SignatureFromMessage(message interface{}) (*SignedMe
 		return nil, errors.Errorf("Type assertion failed")
 	}
 
-	return &SignedMessage{
-		Signature: signature.Proofs,
-		Indices:   signature.Indices,
-		Nonce:     sr.Nonce,
-		Context:   sr.Context,
-		Message:   sr.Message,
-		Timestamp: sr.Timestamp,
-	}, nil
+	sm := &SignedMessage{
+		Signature:   signature.Proofs,
+		Indices:     signature.Indices,
+		Nonce:       sr.Nonce,
+		Context:     sr.Context,
+		Message:     sr.Message,
+		MessageType: sr.MessageType,
+		Timestamp:   sr.Timestamp,
+		Request: &SignedMessageRequest{
+			Content: sr.Content,
+			Bound:   signatureBindsConditions(sr.Version),
+		},
+	}
+	if sr.Detached {
+		sm.Detach()
+	}
+	return sm, nil
+}
+
+// SignedDocument returns the document digest that the request asks to sign, or nil if the message
+// of the request is not of type SignedMessageTypeSHA256.
+func (sr *SignatureRequest) SignedDocument() (*SignedDocument, error) {
+	if sr.MessageType != SignedMessageTypeSHA256 {
+		return nil, nil
+	}
+	return ParseSignedDocument(sr.Message)
 }
 
 func (sr *SignatureRequest) Action() Action { return ActionSigning }
 
 func (sr *SignatureRequest) Validate() error {
-	if sr.Type != ActionSigning {
-		return errors.New("Not a signature request")
+	verr := &ValidationError{}
+	if !sr.validateType(verr, ActionSigning, "Not a signature request") {
+		return verr
 	}
 	if sr.Message == "" {
-		return errors.New("Signature request had empty message")
-	}
-	if len(sr.Content) == 0 {
-		return errors.New("Disclosure request had no attributes")
+		verr.add("message", nil, ValidationErrorMissingField, "Signature request had empty message")
 	}
-	for _, disjunction := range sr.Content {
-		if len(disjunction.Attributes) == 0 {
-			return errors.New("Disclosure request had an empty disjunction")
+	switch sr.MessageType {
+	case "", SignedMessageTypeString:
+	case SignedMessageTypeSHA256:
+		if _, err := ParseSignedDocument(sr.Message); err != nil && sr.Message != "" {
+			verr.add("message", sr.Message, ValidationErrorInvalidValue, "Signature request message is not a document digest: %s", err.Error())
 		}
+	default:
+		verr.add("messageType", sr.MessageType, ValidationErrorInvalidValue, "Unsupported message type %s", sr.MessageType)
 	}
-	return nil
+	if len(sr.Content) == 0 {
+		verr.add("content", nil, ValidationErrorMissingField, "Disclosure request had no attributes")
+	}
+	sr.validateExpiryPolicy(verr)
+	sr.Content.validate(verr, "content")
+	return verr.errorOrNil()
 }
 
 // Check if Timestamp is before other Timestamp. Used for checking expiry of attributes
@@ -486,6 +987,16 @@ func (t *Timestamp) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// UnmarshalText unmarshals a timestamp from a Unix timestamp, e.g. in scheme XML files.
+func (t *Timestamp) UnmarshalText(text []byte) error {
+	ts, err := strconv.ParseInt(strings.TrimSpace(string(text)), 10, 64)
+	if err != nil {
+		return err
+	}
+	*t = Timestamp(time.Unix(ts, 0))
+	return nil
+}
+
 // Timestamp implements Stringer.
 func (t *Timestamp) String() string {
 	return fmt.Sprint(time.Time(*t).Unix())
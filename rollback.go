@@ -0,0 +1,61 @@
+package irma
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the rollback protection of scheme updates. A scheme manager remote, or a
+// mirror of it, could serve an older version of a scheme, which is validly signed but which e.g.
+// lacks a key rotation or the deprecation of a credential type. For each scheme we therefore
+// record the timestamp of the newest version that an update installed in a hidden file in
+// storage, next to the scheme folder, so that it survives e.g. the scheme being restored from
+// the assets or being reinstalled. Updates to a version older than the recorded one, or than the
+// one currently installed, are refused, unless explicitly allowed with SetAllowRollback().
+
+// timestampRecordPrefix is the prefix of the files in storage recording the timestamp of the
+// newest installed version of a scheme.
+const timestampRecordPrefix = ".timestamp."
+
+// SetAllowRollback sets whether scheme updates may replace a scheme by an older version, e.g. when
+// an operator deliberately rolls back a scheme to an earlier version. Use with care.
+func (conf *Configuration) SetAllowRollback(allow bool) {
+	conf.allowRollback = allow
+}
+
+func (conf *Configuration) timestampRecord(scheme string) string {
+	return filepath.Join(conf.Path, timestampRecordPrefix+scheme)
+}
+
+// installedTimestamp returns the timestamp of the newest installed version of the specified scheme
+// manager: the newest of the recorded timestamp and that of the scheme manager, if it is valid.
+// It returns nil if neither is present.
+func (conf *Configuration) installedTimestamp(manager *SchemeManager) (*Timestamp, error) {
+	ts, exists, err := readTimestamp(conf.timestampRecord(manager.ID))
+	if err != nil {
+		return nil, err
+	}
+	if manager.Valid && (!exists || ts.Before(manager.Timestamp)) {
+		current := manager.Timestamp
+		return &current, nil
+	}
+	return ts, nil
+}
+
+// recordTimestamp records the timestamp of the specified scheme manager as that of its newest
+// installed version.
+func (conf *Configuration) recordTimestamp(manager *SchemeManager) error {
+	return fs.SaveFile(conf.timestampRecord(manager.ID), []byte(fmt.Sprintf("%d\n", time.Time(manager.Timestamp).Unix())))
+}
+
+// removeTimestampRecord removes the timestamp record of the specified scheme, if any.
+func (conf *Configuration) removeTimestampRecord(scheme string) error {
+	if err := os.Remove(conf.timestampRecord(scheme)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
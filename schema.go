@@ -0,0 +1,456 @@
+package irma
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+)
+
+// This file contains JSON Schema (draft 7) definitions of session requests, which are generated
+// from the Go structs of the session requests so that they cannot drift from what this package
+// actually accepts, and a validator for the subset of JSON Schema that these definitions use.
+// The validator is used by UnmarshalValidateStrict(), which unlike UnmarshalValidate() rejects
+// unknown fields and fields of the wrong JSON type instead of ignoring them.
+
+// JSONSchemaVersion is the JSON Schema draft to which the generated schemas adhere.
+const JSONSchemaVersion = "http://json-schema.org/draft-07/schema#"
+
+// JSONSchema is a JSON Schema document, or a subschema within one.
+type JSONSchema struct {
+	Schema      string `json:"$schema,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// A JSON type such as "object" or "string", or a list of those
+	Type    interface{}   `json:"type,omitempty"`
+	Format  string        `json:"format,omitempty"`
+	Pattern string        `json:"pattern,omitempty"`
+	Enum    []interface{} `json:"enum,omitempty"`
+
+	Properties map[string]*JSONSchema `json:"properties,omitempty"`
+	Required   []string               `json:"required,omitempty"`
+	// Either false, disallowing properties not in Properties, or a *JSONSchema for their values
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+
+	Items *JSONSchema   `json:"items,omitempty"`
+	AnyOf []*JSONSchema `json:"anyOf,omitempty"`
+}
+
+// RequestSchemas returns the JSON Schemas of the session requests and of the requestor requests
+// wrapping them, keyed by the name of their Go type.
+func RequestSchemas() map[string]*JSONSchema {
+	schemas := map[string]*JSONSchema{}
+	for _, v := range []interface{}{
+		&DisclosureRequest{}, &SignatureRequest{}, &IssuanceRequest{},
+		&ServiceProviderRequest{}, &SignatureRequestorRequest{}, &IdentityProviderRequest{},
+	} {
+		schema := NewJSONSchema(v)
+		schemas[schema.Title] = schema
+	}
+	return schemas
+}
+
+// NewJSONSchema generates the JSON Schema of the JSON representation of the specified value,
+// from its Go type.
+func NewJSONSchema(v interface{}) *JSONSchema {
+	typ := reflect.TypeOf(v)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	schema := (&schemaGenerator{visiting: map[reflect.Type]bool{}}).schema(typ)
+	schema.Schema = JSONSchemaVersion
+	schema.Title = typ.Name()
+	return schema
+}
+
+// Schemas of types with a custom JSON representation.
+var (
+	disjunctionValueSchema = &JSONSchema{AnyOf: []*JSONSchema{
+		{Type: []string{"string", "null"}},
+		{Type: "array", Items: &JSONSchema{Type: "string"}},
+	}}
+	schemaOverrides = map[reflect.Type]*JSONSchema{
+		reflect.TypeOf(big.Int{}):         {Type: "string", Format: "byte"},
+		reflect.TypeOf(Timestamp{}):       {Type: "integer"},
+		reflect.TypeOf(ProtocolVersion{}): {Type: "string", Pattern: `^\d+\.\d+$`},
+		reflect.TypeOf(Action("")):        {Type: "string", Enum: []interface{}{ActionDisclosing, ActionSigning, ActionIssuing}},
+		reflect.TypeOf(AttributeDisjunction{}): {
+			Type: "object",
+			Properties: map[string]*JSONSchema{
+				"label": {AnyOf: []*JSONSchema{
+					{Type: []string{"string", "null"}},
+					{Type: "object", AdditionalProperties: &JSONSchema{Type: "string"}},
+				}},
+				"attributes": {AnyOf: []*JSONSchema{
+					{Type: "array", Items: &JSONSchema{Type: "string"}},
+					{Type: "object", AdditionalProperties: disjunctionValueSchema},
+				}},
+				"optional": {Type: "boolean"},
+			},
+			Required:             []string{"attributes"},
+			AdditionalProperties: false,
+		},
+	}
+	// Required fields of structs, in addition to those of their embedded structs. Fields that
+	// may be absent from JSON but not from a valid request, like the type of a session request
+	// which may be inferred, are not listed.
+	schemaRequired = map[reflect.Type][]string{
+		reflect.TypeOf(DisclosureRequest{}):         {"content"},
+		reflect.TypeOf(SignatureRequest{}):          {"message"},
+		reflect.TypeOf(IssuanceRequest{}):           {"credentials"},
+		reflect.TypeOf(CredentialRequest{}):         {"credential", "attributes"},
+		reflect.TypeOf(ServiceProviderRequest{}):    {"request"},
+		reflect.TypeOf(SignatureRequestorRequest{}): {"request"},
+		reflect.TypeOf(IdentityProviderRequest{}):   {"request"},
+	}
+	// Adjustments to the generated schemas of structs with a custom UnmarshalJSON method
+	schemaPatches = map[reflect.Type]func(*JSONSchema){
+		reflect.TypeOf(CredentialRequest{}): func(schema *JSONSchema) {
+			schema.Properties["validity"] = &JSONSchema{AnyOf: []*JSONSchema{
+				{Type: []string{"integer", "null"}},
+				{Type: "string", Format: "date-time"},
+			}}
+		},
+	}
+
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+type schemaGenerator struct {
+	visiting map[reflect.Type]bool
+}
+
+// schema returns the schema of the JSON representation of the specified type, following the
+// rules of encoding/json.
+func (g *schemaGenerator) schema(typ reflect.Type) *JSONSchema {
+	if override, ok := schemaOverrides[typ]; ok {
+		copied := *override
+		return &copied
+	}
+	if typ.Kind() == reflect.Ptr {
+		return nullable(g.schema(typ.Elem()))
+	}
+	implements := func(iface reflect.Type) bool {
+		return typ.Implements(iface) || reflect.PtrTo(typ).Implements(iface)
+	}
+	if implements(textMarshalerType) && !implements(jsonMarshalerType) {
+		return &JSONSchema{Type: "string"}
+	}
+	if implements(jsonMarshalerType) && typ.Kind() == reflect.Struct && schemaPatches[typ] == nil {
+		return &JSONSchema{} // unknown custom representation, accept anything
+	}
+
+	switch typ.Kind() {
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &JSONSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return &JSONSchema{Type: []string{"string", "null"}, Format: "byte"}
+		}
+		return nullable(&JSONSchema{Type: "array", Items: g.schema(typ.Elem())})
+	case reflect.Array:
+		return &JSONSchema{Type: "array", Items: g.schema(typ.Elem())}
+	case reflect.Map:
+		return nullable(&JSONSchema{Type: "object", AdditionalProperties: g.schema(typ.Elem())})
+	case reflect.Struct:
+		if g.visiting[typ] {
+			return &JSONSchema{} // recursive type
+		}
+		g.visiting[typ] = true
+		defer delete(g.visiting, typ)
+		schema := &JSONSchema{Type: "object", Properties: map[string]*JSONSchema{}, AdditionalProperties: false}
+		g.addFields(schema, typ)
+		if patch := schemaPatches[typ]; patch != nil {
+			patch(schema)
+		}
+		return schema
+	default:
+		return &JSONSchema{}
+	}
+}
+
+// addFields adds the JSON fields of the specified struct type to the schema, including those of
+// embedded structs.
+func (g *schemaGenerator) addFields(schema *JSONSchema, typ reflect.Type) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		fieldtype := field.Type
+		if fieldtype.Kind() == reflect.Ptr {
+			fieldtype = fieldtype.Elem()
+		}
+		if field.Anonymous && name == "" && fieldtype.Kind() == reflect.Struct {
+			g.addFields(schema, fieldtype)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = g.schema(field.Type)
+	}
+	schema.Required = append(schema.Required, schemaRequired[typ]...)
+}
+
+// nullable returns the schema additionally allowing null.
+func nullable(schema *JSONSchema) *JSONSchema {
+	switch t := schema.Type.(type) {
+	case string:
+		schema.Type = []string{t, "null"}
+	case []string:
+		for _, s := range t {
+			if s == "null" {
+				return schema
+			}
+		}
+		schema.Type = append(append([]string{}, t...), "null")
+	default:
+		if len(schema.AnyOf) > 0 {
+			schema.AnyOf = append(append([]*JSONSchema{}, schema.AnyOf...), &JSONSchema{Type: "null"})
+		}
+	}
+	return schema
+}
+
+// Validate checks that the specified JSON conforms to the schema, returning the problems that
+// are found in a *ValidationError.
+func (s *JSONSchema) Validate(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return errors.WrapPrefix(err, "Failed to JSON unmarshal", 0)
+	}
+	verr := &ValidationError{}
+	s.validate(verr, "", value)
+	return verr.errorOrNil()
+}
+
+func (s *JSONSchema) validate(verr *ValidationError, path string, value interface{}) {
+	if len(s.AnyOf) > 0 {
+		s.validateAnyOf(verr, path, value)
+		return
+	}
+	if !s.allowsType(jsonType(value)) {
+		verr.add(path, value, ValidationErrorInvalidValue, "Expected %s, got %s", s.typeDescription(), jsonType(value))
+		return
+	}
+	if len(s.Enum) > 0 && !s.enumContains(value) {
+		verr.add(path, value, ValidationErrorInvalidValue, "Value is not one of the allowed values")
+	}
+
+	switch v := value.(type) {
+	case string:
+		s.validateString(verr, path, v)
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(verr, fmt.Sprintf("%s[%d]", path, i), item)
+			}
+		}
+	case map[string]interface{}:
+		s.validateObject(verr, path, v)
+	}
+}
+
+func (s *JSONSchema) validateString(verr *ValidationError, path, value string) {
+	if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(value) {
+		verr.add(path, value, ValidationErrorInvalidValue, "Value does not match pattern %s", s.Pattern)
+	}
+	switch s.Format {
+	case "byte":
+		if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+			verr.add(path, value, ValidationErrorInvalidValue, "Value is not base64-encoded")
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			verr.add(path, value, ValidationErrorInvalidValue, "Value is not an RFC3339 date")
+		}
+	}
+}
+
+func (s *JSONSchema) validateObject(verr *ValidationError, path string, value map[string]interface{}) {
+	for _, name := range s.Required {
+		if _, ok := value[name]; !ok {
+			verr.add(jsonPath(path, name), nil, ValidationErrorMissingField, "Required field %s is missing", name)
+		}
+	}
+	keys := make([]string, 0, len(value))
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if prop, ok := s.Properties[key]; ok {
+			prop.validate(verr, jsonPath(path, key), value[key])
+			continue
+		}
+		switch additional := s.AdditionalProperties.(type) {
+		case *JSONSchema:
+			additional.validate(verr, jsonPath(path, key), value[key])
+		case bool:
+			if !additional {
+				verr.add(jsonPath(path, key), nil, ValidationErrorUnknownField, "Unknown field %s", key)
+			}
+		}
+	}
+}
+
+// validateAnyOf validates the value against the alternatives of the schema. If the value matches
+// none of them, the problems with the alternative that allows its JSON type are reported, so
+// that these point to the offending nested field; if there is no such unique alternative the
+// value is reported as a whole.
+func (s *JSONSchema) validateAnyOf(verr *ValidationError, path string, value interface{}) {
+	var candidate *ValidationError
+	candidates := 0
+	for _, alternative := range s.AnyOf {
+		altverr := &ValidationError{}
+		alternative.validate(altverr, path, value)
+		if len(altverr.Problems) == 0 {
+			return
+		}
+		if alternative.allowsType(jsonType(value)) {
+			candidate = altverr
+			candidates++
+		}
+	}
+	if candidates == 1 {
+		verr.Problems = append(verr.Problems, candidate.Problems...)
+		return
+	}
+	verr.add(path, value, ValidationErrorInvalidValue, "Value is not of any of the allowed forms")
+}
+
+func (s *JSONSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []string:
+		return t
+	case []interface{}: // as unmarshaled from JSON
+		types := make([]string, 0, len(t))
+		for _, typ := range t {
+			types = append(types, fmt.Sprint(typ))
+		}
+		return types
+	default:
+		return nil
+	}
+}
+
+func (s *JSONSchema) allowsType(typ string) bool {
+	types := s.types()
+	if len(types) == 0 {
+		return len(s.AnyOf) == 0 // no type constraint
+	}
+	for _, t := range types {
+		if t == typ || (t == "number" && typ == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *JSONSchema) typeDescription() string {
+	return strings.Join(s.types(), " or ")
+}
+
+func (s *JSONSchema) enumContains(value interface{}) bool {
+	for _, e := range s.Enum {
+		if fmt.Sprint(e) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType returns the JSON Schema type of the specified value, as decoded by a json.Decoder
+// with UseNumber() enabled.
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// ValidateRequestSchema checks that the specified JSON session request, or requestor request
+// wrapping one, conforms to the JSON Schema of its (inferred, see InferAction()) type.
+func ValidateRequestSchema(data []byte) error {
+	action, err := InferAction(data)
+	if err != nil {
+		return err
+	}
+	var header struct {
+		Request json.RawMessage `json:"request"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return errors.WrapPrefix(err, "Failed to JSON unmarshal session request", 0)
+	}
+	wrapped := len(header.Request) > 0 && string(header.Request) != "null"
+
+	var v interface{}
+	switch action {
+	case ActionDisclosing:
+		v = &DisclosureRequest{}
+		if wrapped {
+			v = &ServiceProviderRequest{}
+		}
+	case ActionSigning:
+		v = &SignatureRequest{}
+		if wrapped {
+			v = &SignatureRequestorRequest{}
+		}
+	case ActionIssuing:
+		v = &IssuanceRequest{}
+		if wrapped {
+			v = &IdentityProviderRequest{}
+		}
+	}
+	return NewJSONSchema(v).Validate(data)
+}
+
+// UnmarshalValidateStrict is like UnmarshalValidate(), but first checks that data conforms to
+// the JSON Schema of dest (see NewJSONSchema()), rejecting unknown fields and fields of the wrong
+// JSON type with a *ValidationError listing their paths.
+func UnmarshalValidateStrict(data []byte, dest interface{}) error {
+	if err := NewJSONSchema(dest).Validate(data); err != nil {
+		return err
+	}
+	return UnmarshalValidate(data, dest)
+}
@@ -0,0 +1,201 @@
+package irma
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// This file contains the export of the parsed schemes as a JSON document, for frontends that need
+// e.g. the names and attributes of credential types without parsing the scheme files themselves.
+// The document lists the valid schemes, their issuers, credential types and attributes, sorted by
+// identifier. Logos are referred to by their URL at the scheme manager. The format is locked by
+// a golden file test; fields may be added but not changed or removed.
+
+// schemeJSONVersion is included in the ETag of the document, and must be incremented when its format changes.
+const schemeJSONVersion = 1
+
+// SchemesJSON is the JSON document describing the schemes, see Configuration.MarshalSchemeJSON().
+type SchemesJSON struct {
+	Schemes []*SchemeJSON `json:"schemes"`
+}
+
+// SchemeJSON describes a scheme in a SchemesJSON document.
+type SchemeJSON struct {
+	ID          SchemeManagerIdentifier `json:"id"`
+	Name        TranslatedString        `json:"name"`
+	Description TranslatedString        `json:"description"`
+	URL         string                  `json:"url"`
+	Timestamp   Timestamp               `json:"timestamp"`
+	Development bool                    `json:"development,omitempty"`
+	Issuers     []*IssuerJSON           `json:"issuers"`
+}
+
+// IssuerJSON describes an issuer in a SchemesJSON document.
+type IssuerJSON struct {
+	ID              IssuerIdentifier      `json:"id"`
+	Name            TranslatedString      `json:"name"`
+	ShortName       TranslatedString      `json:"shortName"`
+	ContactEMail    string                `json:"contactEmail,omitempty"`
+	Logo            string                `json:"logo,omitempty"`
+	CredentialTypes []*CredentialTypeJSON `json:"credentialTypes"`
+}
+
+// CredentialTypeJSON describes a credential type in a SchemesJSON document.
+type CredentialTypeJSON struct {
+	ID              CredentialTypeIdentifier `json:"id"`
+	Name            TranslatedString         `json:"name"`
+	ShortName       TranslatedString         `json:"shortName"`
+	Description     TranslatedString         `json:"description"`
+	IssueURL        TranslatedString         `json:"issueURL,omitempty"`
+	Category        TranslatedString         `json:"category,omitempty"`
+	Singleton       bool                     `json:"singleton,omitempty"`
+	DeprecatedSince *Timestamp               `json:"deprecatedSince,omitempty"`
+	Logo            string                   `json:"logo,omitempty"`
+	Attributes      []*AttributeTypeJSON     `json:"attributes"`
+}
+
+// AttributeTypeJSON describes an attribute of a credential type in a SchemesJSON document.
+type AttributeTypeJSON struct {
+	ID          AttributeTypeIdentifier `json:"id"`
+	Name        TranslatedString        `json:"name"`
+	Description TranslatedString        `json:"description"`
+	Optional    bool                    `json:"optional,omitempty"`
+	// Position of the attribute when displaying its credential type, see AttributeType.DisplayPosition()
+	DisplayPosition int `json:"displayPosition"`
+}
+
+// SchemeJSON returns the JSON document describing the valid schemes of this Configuration.
+func (conf *Configuration) SchemeJSON() *SchemesJSON {
+	doc := &SchemesJSON{Schemes: []*SchemeJSON{}}
+	schemes := map[SchemeManagerIdentifier]*SchemeJSON{}
+	for id, manager := range conf.SchemeManagers {
+		if !manager.Valid {
+			continue
+		}
+		scheme := &SchemeJSON{
+			ID:          id,
+			Name:        manager.Name,
+			Description: manager.Description,
+			URL:         manager.URL,
+			Timestamp:   manager.Timestamp,
+			Development: manager.Development,
+			Issuers:     []*IssuerJSON{},
+		}
+		schemes[id] = scheme
+		doc.Schemes = append(doc.Schemes, scheme)
+	}
+
+	issuers := map[IssuerIdentifier]*IssuerJSON{}
+	for id, issuer := range conf.Issuers {
+		scheme := schemes[id.SchemeManagerIdentifier()]
+		if scheme == nil {
+			continue
+		}
+		i := &IssuerJSON{
+			ID:              id,
+			Name:            issuer.Name,
+			ShortName:       issuer.ShortName,
+			ContactEMail:    issuer.ContactEMail,
+			CredentialTypes: []*CredentialTypeJSON{},
+		}
+		if issuer.LogoPath != "" {
+			i.Logo = fmt.Sprintf("%s/%s/logo.png", scheme.URL, id.Name())
+		}
+		issuers[id] = i
+		scheme.Issuers = append(scheme.Issuers, i)
+	}
+
+	for id, credtype := range conf.CredentialTypes {
+		issuer := issuers[id.IssuerIdentifier()]
+		if issuer == nil {
+			continue
+		}
+		c := &CredentialTypeJSON{
+			ID:              id,
+			Name:            credtype.Name,
+			ShortName:       credtype.ShortName,
+			Description:     credtype.Description,
+			IssueURL:        credtype.IssueURL,
+			Category:        credtype.Category,
+			Singleton:       credtype.IsSingleton,
+			DeprecatedSince: credtype.DeprecatedSince,
+			Attributes:      make([]*AttributeTypeJSON, 0, len(credtype.AttributeTypes)),
+		}
+		if credtype.LogoPath != "" {
+			c.Logo = fmt.Sprintf("%s/%s/Issues/%s/logo.png", schemes[id.SchemeManagerIdentifier()].URL, credtype.IssuerID, credtype.ID)
+		}
+		for _, attr := range credtype.AttributeTypes {
+			c.Attributes = append(c.Attributes, &AttributeTypeJSON{
+				ID:              attr.GetAttributeTypeIdentifier(),
+				Name:            attr.Name,
+				Description:     attr.Description,
+				Optional:        attr.IsOptional(),
+				DisplayPosition: attr.DisplayPosition(),
+			})
+		}
+		issuer.CredentialTypes = append(issuer.CredentialTypes, c)
+	}
+
+	sort.Slice(doc.Schemes, func(i, j int) bool { return doc.Schemes[i].ID.String() < doc.Schemes[j].ID.String() })
+	for _, scheme := range doc.Schemes {
+		sort.Slice(scheme.Issuers, func(i, j int) bool { return scheme.Issuers[i].ID.String() < scheme.Issuers[j].ID.String() })
+		for _, issuer := range scheme.Issuers {
+			sort.Slice(issuer.CredentialTypes, func(i, j int) bool {
+				return issuer.CredentialTypes[i].ID.String() < issuer.CredentialTypes[j].ID.String()
+			})
+		}
+	}
+	return doc
+}
+
+// MarshalSchemeJSON returns the JSON document describing the valid schemes of this Configuration,
+// along with an ETag for it. As the ETag is derived from the indices of the schemes, it can be
+// computed using SchemeJSONETag() without marshaling the document.
+func (conf *Configuration) MarshalSchemeJSON() ([]byte, string, error) {
+	bts, err := json.MarshalIndent(conf.SchemeJSON(), "", "\t")
+	if err != nil {
+		return nil, "", err
+	}
+	etag, err := conf.SchemeJSONETag()
+	if err != nil {
+		return nil, "", err
+	}
+	return bts, etag, nil
+}
+
+// SchemeJSONETag returns the ETag of the JSON document returned by MarshalSchemeJSON(), which
+// changes whenever one of the schemes changes. It is derived from the signed indices of the schemes,
+// and for development schemes, which need not have an index, from their part of the document.
+func (conf *Configuration) SchemeJSONETag() (string, error) {
+	ids := make([]SchemeManagerIdentifier, 0, len(conf.SchemeManagers))
+	for id, manager := range conf.SchemeManagers {
+		if manager.Valid {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "%d\n", schemeJSONVersion)
+	var doc *SchemesJSON
+	for i, id := range ids {
+		manager := conf.SchemeManagers[id]
+		_, _ = fmt.Fprintf(hash, "%s %s\n", id.String(), manager.URL)
+		if !manager.Development && manager.index != nil {
+			_, _ = hash.Write([]byte(manager.index.String()))
+			continue
+		}
+		if doc == nil {
+			doc = conf.SchemeJSON()
+		}
+		bts, err := json.Marshal(doc.Schemes[i])
+		if err != nil {
+			return "", err
+		}
+		_, _ = hash.Write(bts)
+	}
+	return fmt.Sprintf(`"%s"`, hex.EncodeToString(hash.Sum(nil))), nil
+}
@@ -1,16 +1,27 @@
 package irma
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"path/filepath"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
 )
 
 // SchemeManagerPointer points to a remote IRMA scheme, containing information to download the scheme,
 // including its (pinned) public key.
 type SchemeManagerPointer struct {
-	Url       string // URL to download scheme from
-	Demo      bool   // Whether or not this is a demo scheme; if true, private keys are also downloaded
-	Publickey []byte // Public key of scheme against which to verify files after they have been downloaded
+	Url       string `json:"url"`            // URL to download scheme from
+	Demo      bool   `json:"demo,omitempty"` // Whether or not this is a demo scheme; if true, private keys are also downloaded
+	Publickey []byte `json:"publickey"`      // Public key of scheme against which to verify files after they have been downloaded
 }
 
 var DefaultSchemeManagers = [2]SchemeManagerPointer{
@@ -35,7 +46,7 @@ func (conf *Configuration) DownloadDefaultSchemes() error {
 	Logger.Info("downloading default schemes (may take a while)")
 	for _, s := range DefaultSchemeManagers {
 		Logger.Debugf("Downloading scheme at %s", s.Url)
-		scheme, err := DownloadSchemeManager(s.Url)
+		scheme, err := conf.DownloadSchemeManagerDescription(s.Url)
 		if err != nil {
 			return err
 		}
@@ -53,7 +64,7 @@ func (conf *Configuration) DownloadDefaultSchemes() error {
 }
 
 func (conf *Configuration) downloadPrivateKeys(scheme *SchemeManager) error {
-	transport := NewHTTPTransport(scheme.URL)
+	transport := conf.newHTTPTransport(scheme.URL)
 
 	err := transport.GetFile("sk.pem", filepath.Join(conf.Path, scheme.ID, "sk.pem"))
 	if err != nil { // If downloading of any of the private key fails just log it, and then continue
@@ -77,3 +88,237 @@ func (conf *Configuration) downloadPrivateKeys(scheme *SchemeManager) error {
 
 	return nil
 }
+
+// defaultSchemeManagerPointer returns the pointer to the specified scheme manager from
+// DefaultSchemeManagers, if present.
+func defaultSchemeManagerPointer(id SchemeManagerIdentifier) *SchemeManagerPointer {
+	for i := range DefaultSchemeManagers {
+		if path.Base(DefaultSchemeManagers[i].Url) == id.Name() {
+			return &DefaultSchemeManagers[i]
+		}
+	}
+	return nil
+}
+
+// UnknownSchemeManagers returns the scheme managers that the specified session request refers to,
+// but that this Configuration does not contain.
+func (conf *Configuration) UnknownSchemeManagers(request SessionRequest) []SchemeManagerIdentifier {
+	var unknown []SchemeManagerIdentifier
+	for id := range request.Identifiers().SchemeManagers {
+		if _, ok := conf.SchemeManagers[id]; !ok {
+			unknown = append(unknown, id)
+		}
+	}
+	return unknown
+}
+
+// DownloadPointedSchemeManager downloads the description of the scheme manager that the pointer
+// points to, checking that it is the specified scheme manager. As the URL of the pointer may have
+// been supplied by anyone, the pointer must include the public key of the scheme.
+func (conf *Configuration) DownloadPointedSchemeManager(
+	id SchemeManagerIdentifier, pointer *SchemeManagerPointer,
+) (*SchemeManager, error) {
+	if len(pointer.Publickey) == 0 {
+		return nil, errors.Errorf("No public key specified for scheme manager %s", id)
+	}
+	manager, err := conf.DownloadSchemeManagerDescription(pointer.Url)
+	if err != nil {
+		return nil, err
+	}
+	if manager.Identifier() != id {
+		return nil, errors.Errorf("Expected scheme manager %s at %s, found %s", id, pointer.Url, manager.ID)
+	}
+	return manager, nil
+}
+
+// InstallPointedSchemeManager installs the scheme manager previously downloaded with
+// DownloadPointedSchemeManager(), verifying it against the public key of the pointer.
+// If installation fails, any files of the scheme manager that were already stored are removed.
+func (conf *Configuration) InstallPointedSchemeManager(manager *SchemeManager, pointer *SchemeManagerPointer) error {
+	if len(pointer.Publickey) == 0 {
+		return errors.Errorf("No public key specified for scheme manager %s", manager.ID)
+	}
+	err := conf.InstallSchemeManager(manager, pointer.Publickey)
+	if err == nil {
+		return nil
+	}
+	if rmerr := conf.DeleteSchemeManager(manager.Identifier()); rmerr != nil {
+		Logger.Warnf("Failed to remove partially installed scheme manager %s: %s", manager.ID, rmerr.Error())
+	}
+	return err
+}
+
+// PublicKeyFingerprint returns the fingerprint of the specified PEM-encoded scheme public key:
+// the base64 encoding of the SHA256 hash of its DER encoding, like TLS pins (see TLSPin()).
+func PublicKeyFingerprint(publickey []byte) (string, error) {
+	block, _ := pem.Decode(publickey)
+	if block == nil {
+		return "", errors.New("Public key is not PEM-encoded")
+	}
+	hash := sha256.Sum256(block.Bytes)
+	return base64.StdEncoding.EncodeToString(hash[:]), nil
+}
+
+// InstallScheme downloads the scheme at the specified URL and adds it to storage and to this
+// Configuration. The scheme must be signed with the specified public key, which is either
+// PEM-encoded or given by its fingerprint (see PublicKeyFingerprint()), in which case the public
+// key is downloaded from the remote and checked against the fingerprint. The scheme is assembled
+// and verified in a staging folder before it is moved into place, so that a failed installation
+// leaves storage untouched. Installing a scheme whose ID equals that of an existing scheme fails,
+// unless replace is true.
+func (conf *Configuration) InstallScheme(url string, publickey []byte, replace bool) error {
+	if conf.readOnly {
+		return errors.New("cannot install scheme into a read-only configuration")
+	}
+
+	manager, err := conf.DownloadSchemeManagerDescription(url)
+	if err != nil {
+		return err
+	}
+	if manager.ID == "" || strings.HasPrefix(manager.ID, ".") || strings.ContainsAny(manager.ID, `/\`) {
+		return errors.Errorf("Scheme at %s has invalid ID %s", url, manager.ID)
+	}
+	id := manager.Identifier()
+	dir := filepath.Join(conf.Path, manager.ID)
+	exists, err := fs.PathExists(dir)
+	if err != nil {
+		return err
+	}
+	if _, known := conf.SchemeManagers[id]; (known || exists) && !replace {
+		return errors.Errorf("Scheme manager %s already exists", id)
+	}
+
+	transport := conf.newHTTPTransport(manager.URL)
+	if publickey, err = schemePublicKey(transport, publickey); err != nil {
+		return err
+	}
+	indexbts, err := transport.GetBytes("index")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(conf.Path, ".install-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	staged := filepath.Join(tmp, manager.ID)
+	if err = fs.EnsureDirectoryExists(staged); err != nil {
+		return err
+	}
+	if err = fs.SaveFile(filepath.Join(staged, "pk.pem"), publickey); err != nil {
+		return err
+	}
+	if _, err = conf.stageScheme(NewSchemeManager(manager.ID), transport, indexbts, staged); err != nil {
+		return err
+	}
+	if err = conf.copyConfiguration(tmp).ParseSchemeManagerFolder(staged, NewSchemeManager(manager.ID)); err != nil {
+		return err
+	}
+	if err = replaceSchemeFolder(staged, dir); err != nil {
+		return err
+	}
+	if err = conf.unmask(id); err != nil {
+		return err
+	}
+
+	conf.removeParsed(id)
+	err = conf.ParseSchemeManagerFolder(dir, NewSchemeManager(manager.ID))
+	if smerr, ok := err.(*SchemeManagerError); ok {
+		conf.DisabledSchemeManagers[id] = smerr
+	}
+	return err
+}
+
+// RemoveScheme removes the specified scheme from storage and from this Configuration. The scheme
+// folder is removed atomically, so that if we crash halfway the scheme is either still intact or gone.
+// Note that schemes in the assets are copied into storage again by ParseFolder(), except in
+// overlay mode (see NewConfigurationOverlay()) in which their assets are masked.
+func (conf *Configuration) RemoveScheme(id SchemeManagerIdentifier) error {
+	if conf.readOnly {
+		return errors.New("cannot remove scheme from a read-only configuration")
+	}
+	if _, ok := conf.SchemeManagers[id]; !ok {
+		return errors.Errorf("Cannot remove unknown scheme manager %s", id)
+	}
+	if err := conf.mask(id); err != nil {
+		return err
+	}
+	if err := conf.removeTimestampRecord(id.String()); err != nil {
+		return err
+	}
+	conf.removeParsed(id)
+	return nil
+}
+
+// schemePublicKey returns the PEM-encoded public key of a scheme, given either the public key
+// itself or its fingerprint, in which case it is downloaded from the remote of the scheme.
+func schemePublicKey(transport *HTTPTransport, publickey []byte) ([]byte, error) {
+	if len(publickey) == 0 {
+		return nil, errors.New("No public key specified")
+	}
+	if bytes.Contains(publickey, []byte("-----BEGIN")) {
+		_, err := ParsePemEcdsaPublicKey(publickey)
+		return publickey, err
+	}
+
+	remote, err := transport.GetBytes("pk.pem")
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := PublicKeyFingerprint(remote)
+	if err != nil {
+		return nil, err
+	}
+	if fingerprint != strings.TrimSpace(string(publickey)) {
+		return nil, errors.New("Public key of scheme does not match the specified fingerprint")
+	}
+	return remote, nil
+}
+
+// removeParsed removes the specified scheme manager and everything it contains from the parsed
+// contents of this Configuration, leaving storage untouched.
+func (conf *Configuration) removeParsed(id SchemeManagerIdentifier) {
+	defer conf.metadataCache.invalidate()
+	delete(conf.SchemeManagers, id)
+	delete(conf.DisabledSchemeManagers, id)
+	delete(conf.kssPublicKeys, id)
+	delete(conf.indexValidators, id)
+	errs := conf.Errors[:0]
+	for _, smerr := range conf.Errors {
+		if smerr.Manager != id {
+			errs = append(errs, smerr)
+		}
+	}
+	conf.Errors = errs
+	for issid := range conf.Issuers {
+		if issid.SchemeManagerIdentifier() == id {
+			delete(conf.Issuers, issid)
+		}
+	}
+	for issid := range conf.publicKeys {
+		if issid.SchemeManagerIdentifier() == id {
+			delete(conf.publicKeys, issid)
+		}
+	}
+	for issid := range conf.privateKeys {
+		if issid.SchemeManagerIdentifier() == id {
+			delete(conf.privateKeys, issid)
+		}
+	}
+	for credid := range conf.CredentialTypes {
+		if credid.IssuerIdentifier().SchemeManagerIdentifier() == id {
+			delete(conf.CredentialTypes, credid)
+		}
+	}
+	for attrid := range conf.AttributeTypes {
+		if attrid.CredentialTypeIdentifier().IssuerIdentifier().SchemeManagerIdentifier() == id {
+			delete(conf.AttributeTypes, attrid)
+		}
+	}
+	for hash, credid := range conf.reverseHashes {
+		if credid.IssuerIdentifier().SchemeManagerIdentifier() == id {
+			delete(conf.reverseHashes, hash)
+		}
+	}
+}
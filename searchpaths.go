@@ -0,0 +1,67 @@
+package irma
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// This file contains the handling of multiple assets folders, such as a curated set of schemes
+// installed system-wide along with a folder with per-user additions. The assets folders are
+// searched in the order in which they were passed to NewConfigurationFromAssets() or
+// NewConfigurationOverlay(), and each scheme is taken as a whole from the last folder containing
+// it; the schemes in different folders are never merged file by file. Schemes occurring in more
+// than one folder are reported in the warnings of the Configuration. The assets folders are never
+// written to: as with a single assets folder, updates are written to storage.
+
+// assetsFolder returns the assets folder from which the specified scheme is taken,
+// or an empty string if it is in none of them.
+func (conf *Configuration) assetsFolder(scheme string) string {
+	for i := len(conf.assets) - 1; i >= 0; i-- {
+		if exists, err := fs.PathExists(filepath.Join(conf.assets[i], scheme)); err == nil && exists {
+			return conf.assets[i]
+		}
+	}
+	return ""
+}
+
+// assetSchemes returns the schemes in the assets folders, sorted by name, adding a warning
+// for each scheme that occurs in more than one of them.
+func (conf *Configuration) assetSchemes() ([]SchemeManagerIdentifier, error) {
+	folders := map[string][]string{}
+	for _, assets := range conf.assets {
+		err := iterateSubfolders(assets, func(dir string) error {
+			name := filepath.Base(dir)
+			folders[name] = append(folders[name], assets)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(folders))
+	for name := range folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	schemes := make([]SchemeManagerIdentifier, 0, len(names))
+	for _, name := range names {
+		schemes = append(schemes, NewSchemeManagerIdentifier(name))
+		if n := len(folders[name]); n > 1 {
+			conf.Warnings = append(conf.Warnings, fmt.Sprintf(
+				"Scheme %s occurs in multiple assets folders, using %s instead of %s",
+				name, folders[name][n-1], strings.Join(folders[name][:n-1], ", "),
+			))
+		}
+	}
+	return schemes, nil
+}
+
+// schemeOf returns the name of the scheme of the specified path relative to a configuration folder.
+func schemeOf(rel string) string {
+	return strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+}
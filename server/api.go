@@ -12,6 +12,8 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
@@ -26,6 +28,8 @@ var Logger *logrus.Logger = logrus.StandardLogger()
 // Configuration contains configuration for the irmaserver library and irmad.
 type Configuration struct {
 	// irma_configuration. If not given, this will be popupated using SchemesPath.
+	// Scheme updates do not modify it but replace it by a new snapshot, so once the server runs
+	// use CurrentIrmaConfiguration() instead.
 	IrmaConfiguration *irma.Configuration `json:"-"`
 	// Path to IRMA schemes to parse into IrmaConfiguration (only used if IrmaConfiguration == nil).
 	// If left empty, default value is taken using DefaultSchemesPath().
@@ -33,13 +37,44 @@ type Configuration struct {
 	SchemesPath string `json:"schemes_path" mapstructure:"schemes_path"`
 	// If specified, schemes found here are copied into SchemesPath (only used if IrmaConfiguration == nil)
 	SchemesAssetsPath string `json:"schemes_assets_path" mapstructure:"schemes_assets_path"`
-	// Disable scheme updating
+	// Further folders of which the schemes are copied into SchemesPath, e.g. a folder with additions to a
+	// system-wide SchemesAssetsPath. A scheme occurring in several of these folders (including
+	// SchemesAssetsPath, which comes first) is taken from the last one (only used if IrmaConfiguration == nil)
+	SchemesAssetsPaths []string `json:"schemes_assets_paths" mapstructure:"schemes_assets_paths"`
+	// Disable scheme updating, and fetching public keys missing from the schemes when verifying proofs
 	DisableSchemesUpdate bool `json:"disable_schemes_update" mapstructure:"disable_schemes_update"`
-	// Update all schemes every x minutes (default value 0 means 60) (use DisableSchemesUpdate to disable)
+	// Update all schemes every x minutes (default value 0 means 60) (use DisableSchemesUpdate to disable;
+	// see also SchemeUpdateAnnouncements for updating a scheme immediately)
 	SchemesUpdateInterval int `json:"schemes_update" mapstructure:"schemes_update"`
-	// Path to issuer private keys to parse
+	// Check every x seconds whether the schemes in SchemesPath were changed on disk, e.g. by installing
+	// a new version of a scheme with a new issuer key, and if so reload them without restarting
+	// (default value 0 disables this; see also the /reload-schemes endpoint of the requestor server)
+	SchemesReloadInterval int `json:"schemes_reload" mapstructure:"schemes_reload"`
+	// Allow scheme updates to replace schemes by older versions than the ones installed, for rolling
+	// back schemes deliberately. Normally such updates are refused, as an outdated scheme could e.g.
+	// lack a key rotation or the deprecation of a credential type.
+	AllowSchemesRollback bool `json:"allow_schemes_rollback" mapstructure:"allow_schemes_rollback"`
+	// Accept scheme update announcements at the /scheme-update endpoint of the requestor server,
+	// updating the announced scheme immediately if the announcement is signed by the scheme
+	// (independent of DisableSchemesUpdate)
+	SchemeUpdateAnnouncements bool `json:"scheme_update_announcements" mapstructure:"scheme_update_announcements"`
+	// Install scheme managers that disclosure or signature session requests refer to but that are not
+	// in SchemesPath, if the request specifies where to find them (see irma.BaseRequest.SchemeManagers)
+	InstallUnknownSchemes bool `json:"install_unknown_schemes" mapstructure:"install_unknown_schemes"`
+	// Schemes in SchemesPath that are parsed without verifying their signature, for developing schemes
+	// (only used if IrmaConfiguration == nil). Refused in production mode, as are scheme folders
+	// marked as development scheme (see irma.DevelopmentSchemeFile).
+	DevelopmentSchemes []string `json:"development_schemes" mapstructure:"development_schemes"`
+	// Disable schemes entirely if one of their issuers or credential types fails to parse, instead of
+	// skipping only those (only used if IrmaConfiguration == nil). Skipped issuers and credential
+	// types are reported by the /health endpoint of the requestor server.
+	StrictSchemes bool `json:"strict_schemes" mapstructure:"strict_schemes"`
+	// Path to a folder containing issuer private keys, named scheme.issuer.xml or scheme.issuer.counter.xml
+	// (e.g. irma-demo.MijnOverheid.2.xml). Of the keys of each issuer, the one with the highest counter
+	// whose public key is present in the scheme and has not expired is used (see PrivateKey()).
+	// Use LoadPrivateKeys() to reload this folder at runtime.
 	IssuerPrivateKeysPath string `json:"privkeys" mapstructure:"privkeys"`
-	// Issuer private keys
+	// Issuer private keys, in addition to those in IssuerPrivateKeysPath
 	IssuerPrivateKeys map[irma.IssuerIdentifier]*gabi.PrivateKey `json:"-"`
 	// URL at which the IRMA app can reach this server during sessions
 	URL string `json:"url" mapstructure:"url"`
@@ -53,6 +88,40 @@ type Configuration struct {
 	Email string `json:"email" mapstructure:"email"`
 	// Enable server sent events for status updates (experimental; tends to hang when a reverse proxy is used)
 	EnableSSE bool
+	// Include in the disclosed attributes of session results their values parsed according to the
+	// type of their attribute type (see irma.DisclosedAttribute.TypedValue)
+	TypedAttributeValues bool `json:"typed_attribute_values" mapstructure:"typed_attribute_values"`
+	// Accept attributes of expired credentials in sessions whose request does not specify whether
+	// to accept them, if expired at most MaxExpiredAge seconds ago (0 for no maximum)
+	AcceptExpired bool `json:"accept_expired" mapstructure:"accept_expired"`
+	MaxExpiredAge int  `json:"max_expired_age" mapstructure:"max_expired_age"`
+	// Remove redundant disjunctions from session requests before starting the session
+	// (see irma.AttributeDisjunctionList.Normalize()), which changes the layout of session results
+	NormalizeRequests bool `json:"normalize_requests" mapstructure:"normalize_requests"`
+	// Emit session pointers also in their compact form (see irma.Qr.CompactLink()), and render
+	// that in QR codes instead of the JSON session pointer. Only IRMA apps supporting protocol
+	// version 2.5 or higher can scan these, so this is disabled by default.
+	CompactSessionPointers bool `json:"compact_session_pointers" mapstructure:"compact_session_pointers"`
+	// Domain for which the IRMA app handles universal links (e.g. irma.app). If specified, session
+	// packages include the session pointer as irma:// link and as universal link at this domain,
+	// with which frontends on mobile devices can open the IRMA app directly (see irma.Qr.Link()
+	// and irma.Qr.UniversalLink()).
+	AppLinkDomain string `json:"app_link_domain" mapstructure:"app_link_domain"`
+	// If nonzero, polling the status of a session that the client has not yet connected to
+	// postpones the expiry of its session pointer (see irma.Qr.Expiry), up to this many seconds
+	// after the session pointer was issued
+	MaxSessionPtrLifetime int `json:"max_session_ptr_lifetime" mapstructure:"max_session_ptr_lifetime"`
+	// Reject JSON session requests containing unknown fields or fields of the wrong JSON type,
+	// instead of ignoring those (see irma.UnmarshalValidateStrict() and irma.RequestSchemas())
+	StrictRequests bool `json:"strict_requests" mapstructure:"strict_requests"`
+	// Checks, in sessions whose request asks for it, whether the credentials of the disclosed
+	// attributes were revoked (see irma.BaseRequest.RevocationCheck). If nil, such requests are refused.
+	RevocationChecker RevocationChecker `json:"-"`
+	// Publishes the result of every session once it has finished, in addition to the session
+	// handlers and callback URLs of requestors (see ResultPublisher)
+	ResultPublisher ResultPublisher `json:"-"`
+	// Maximum number of attempts to publish each session result (default value 0 means 10)
+	ResultPublishAttempts int `json:"result_publish_attempts" mapstructure:"result_publish_attempts"`
 
 	// Logging verbosity level: 0 is normal, 1 includes DEBUG level, 2 includes TRACE level
 	Verbose int `json:"verbose" mapstructure:"verbose"`
@@ -65,11 +134,27 @@ type Configuration struct {
 
 	// Production mode: enables safer and stricter defaults and config checking
 	Production bool `json:"production" mapstructure:"production"`
+
+	// Private key inventory, loaded by LoadPrivateKeys()
+	privateKeys     map[irma.IssuerIdentifier]map[uint]*privateKey
+	privateKeysLock sync.RWMutex
+
+	// Latest snapshot of the schemes after updating them, see CurrentIrmaConfiguration()
+	irmaConfiguration     *irma.Configuration
+	irmaConfigurationLock sync.RWMutex
 }
 
 type SessionPackage struct {
 	SessionPtr *irma.Qr `json:"sessionPtr"`
 	Token      string   `json:"token"`
+	// Compact form of SessionPtr, if Configuration.CompactSessionPointers is enabled
+	CompactSessionPtr string `json:"compactSessionPtr,omitempty"`
+	// SessionPtr as irma:// link and as universal link, if Configuration.AppLinkDomain is specified
+	Link          string `json:"link,omitempty"`
+	UniversalLink string `json:"universalLink,omitempty"`
+	// Reasons why the request asks for more attributes than needed, if the requestor server
+	// analyzes requests using MinimizationRules and includes its hints in session packages
+	MinimizationHints []*MinimizationHint `json:"minimizationHints,omitempty"`
 }
 
 // SessionResult contains session information such as the session status, type, possible errors,
@@ -82,6 +167,33 @@ type SessionResult struct {
 	Disclosed   []*irma.DisclosedAttribute `json:"disclosed,omitempty"`
 	Signature   *irma.SignedMessage        `json:"signature,omitempty"`
 	Err         *irma.RemoteError          `json:"error,omitempty"`
+	// Why ProofStatus is not irma.ProofStatusValid, if it is not
+	ProofStatusReason irma.ProofStatusReason `json:"proofStatusReason,omitempty"`
+	// For each disjunction of the request, whether and with which disclosed attribute it was satisfied
+	Disjunctions []*irma.DisjunctionResult `json:"disjunctions,omitempty"`
+	// Indices of the optional disjunctions of the request for which the user did and did not disclose an attribute
+	SatisfiedOptional []int `json:"satisfiedOptional,omitempty"`
+	SkippedOptional   []int `json:"skippedOptional,omitempty"`
+	// Expiry dates of the issued credentials, in the order of the issuance request
+	CredentialValidity []irma.Timestamp `json:"credentialValidity,omitempty"`
+	// The issued credentials, in the order of the issuance request, with references to disclosed attributes resolved
+	Issued []*irma.CredentialRequest `json:"issued,omitempty"`
+	// NonProduction is true if the session involves development schemes
+	NonProduction bool `json:"nonProduction,omitempty"`
+	// Legacy is true if the session was started with a JWT in the format of the irma_api_server
+	Legacy bool `json:"legacy,omitempty"`
+	// The signatures collected so far, for signature sessions of a multi-party signature
+	// (see irma.SignatureRequestorRequest.MultiParty)
+	Signatures *irma.MultiSignedMessage `json:"signatures,omitempty"`
+}
+
+// SchemesReloadStatus describes the reloads of the schemes that were changed on disk,
+// see SchemesReloadInterval.
+type SchemesReloadStatus struct {
+	// Time of the last successful reload; absent if the schemes were not reloaded since the server started
+	LastReload *irma.Timestamp `json:"lastReload,omitempty"`
+	// Error of the last reload attempt, if it failed
+	ReloadError string `json:"reloadError,omitempty"`
 }
 
 // Status is the status of an IRMA session.
@@ -95,20 +207,44 @@ const (
 	StatusTimeout     Status = "TIMEOUT"     // Session timed out
 )
 
-func (conf *Configuration) PrivateKey(id irma.IssuerIdentifier) (sk *gabi.PrivateKey, err error) {
-	sk = conf.IssuerPrivateKeys[id]
-	if sk == nil {
-		if sk, err = conf.IrmaConfiguration.PrivateKey(id); err != nil {
-			return nil, err
+// CurrentIrmaConfiguration returns the current snapshot of the schemes: the one resulting from
+// the latest scheme update, or IrmaConfiguration if the schemes were not updated yet. Snapshots
+// are never modified by scheme updates, so they can be used concurrently with those.
+func (conf *Configuration) CurrentIrmaConfiguration() *irma.Configuration {
+	conf.irmaConfigurationLock.RLock()
+	defer conf.irmaConfigurationLock.RUnlock()
+	if conf.irmaConfiguration == nil {
+		return conf.IrmaConfiguration
+	}
+	return conf.irmaConfiguration
+}
+
+// SetCurrentIrmaConfiguration replaces the current snapshot of the schemes, e.g. by the result of
+// irma.Configuration.UpdateSchemesSnapshot(). Users of the previous snapshot, such as sessions
+// that were started before, keep using that one.
+func (conf *Configuration) SetCurrentIrmaConfiguration(irmaconf *irma.Configuration) {
+	conf.irmaConfigurationLock.Lock()
+	defer conf.irmaConfigurationLock.Unlock()
+	conf.irmaConfiguration = irmaconf
+}
+
+// DeprecatedCredentialType returns the identifier of the first of the specified credentials whose
+// credential type is deprecated (see irma.CredentialType.DeprecatedSince), or nil if there is none.
+func (conf *Configuration) DeprecatedCredentialType(creds []*irma.CredentialRequest) *irma.CredentialTypeIdentifier {
+	now := irma.Timestamp(time.Now())
+	for _, cred := range creds {
+		credtype := conf.CurrentIrmaConfiguration().CredentialTypes[cred.CredentialTypeID]
+		if credtype != nil && credtype.IsDeprecatedAt(now) {
+			return &cred.CredentialTypeID
 		}
 	}
-	return sk, nil
+	return nil
 }
 
 func (conf *Configuration) HavePrivateKeys() (bool, error) {
 	var err error
 	var sk *gabi.PrivateKey
-	for id := range conf.IrmaConfiguration.Issuers {
+	for id := range conf.CurrentIrmaConfiguration().Issuers {
 		sk, err = conf.PrivateKey(id)
 		if err != nil {
 			return false, err
@@ -193,32 +329,97 @@ func WriteString(w http.ResponseWriter, str string) {
 // ParseSessionRequest attempts to parse the input as an irma.RequestorRequest instance, accepting (skipping "irma.")
 //  - RequestorRequest instances directly (ServiceProviderRequest, SignatureRequestorRequest, IdentityProviderRequest)
 //  - SessionRequest instances (DisclosureRequest, SignatureRequest, IssuanceRequest)
-//  - JSON representations ([]byte or string) of any of the above.
+//  - JSON representations ([]byte or string) of any of the above, of which the type of the session request
+//    is inferred from its contents if absent (see irma.InferAction()).
+// If the JSON representation is invalid, the problems with it are returned in an *irma.ValidationError.
 func ParseSessionRequest(request interface{}) (irma.RequestorRequest, error) {
+	return parseSessionRequest(request, false)
+}
+
+// ParseSessionRequestStrict is like ParseSessionRequest(), but rejects JSON representations that
+// do not conform to the JSON Schema of their type (see irma.ValidateRequestSchema()).
+func ParseSessionRequestStrict(request interface{}) (irma.RequestorRequest, error) {
+	return parseSessionRequest(request, true)
+}
+
+func parseSessionRequest(request interface{}, strict bool) (irma.RequestorRequest, error) {
 	switch r := request.(type) {
 	case irma.RequestorRequest:
 		return r, nil
 	case irma.SessionRequest:
 		return wrapSessionRequest(r)
 	case string:
-		return ParseSessionRequest([]byte(r))
+		return parseSessionRequest([]byte(r), strict)
 	case []byte:
-		var attempts = []irma.Validator{&irma.ServiceProviderRequest{}, &irma.SignatureRequestorRequest{}, &irma.IdentityProviderRequest{}}
-		t, err := tryUnmarshalJson(r, attempts)
-		if err == nil {
-			return t.(irma.RequestorRequest), nil
+		if strict {
+			if err := irma.ValidateRequestSchema(r); err != nil {
+				return nil, err
+			}
+		}
+		// The (possibly inferred) type of the session request determines into which struct we unmarshal it
+		action, err := irma.InferAction(r)
+		if err != nil {
+			return nil, err
 		}
-		attempts = []irma.Validator{&irma.DisclosureRequest{}, &irma.SignatureRequest{}, &irma.IssuanceRequest{}}
-		t, err = tryUnmarshalJson(r, attempts)
-		if err == nil {
-			return wrapSessionRequest(t.(irma.SessionRequest))
+		var header struct {
+			Request json.RawMessage `json:"request"`
 		}
-		return nil, errors.New("Failed to JSON unmarshal request bytes")
+		if err := json.Unmarshal(r, &header); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to JSON unmarshal request bytes", 0)
+		}
+
+		if len(header.Request) > 0 && string(header.Request) != "null" {
+			var rrequest irma.RequestorRequest
+			switch action {
+			case irma.ActionDisclosing:
+				rrequest = &irma.ServiceProviderRequest{}
+			case irma.ActionSigning:
+				rrequest = &irma.SignatureRequestorRequest{}
+			case irma.ActionIssuing:
+				rrequest = &irma.IdentityProviderRequest{}
+			}
+			if err := irma.UnmarshalValidate(r, rrequest); err != nil {
+				return nil, err
+			}
+			return rrequest, nil
+		}
+
+		var srequest irma.SessionRequest
+		switch action {
+		case irma.ActionDisclosing:
+			srequest = &irma.DisclosureRequest{}
+		case irma.ActionSigning:
+			srequest = &irma.SignatureRequest{}
+		case irma.ActionIssuing:
+			srequest = &irma.IssuanceRequest{}
+		}
+		if err := irma.UnmarshalValidate(r, srequest); err != nil {
+			return nil, err
+		}
+		return wrapSessionRequest(srequest)
 	default:
 		return nil, errors.New("Invalid request type")
 	}
 }
 
+// RequestError returns the RemoteError for an invalid session request, returned by ParseSessionRequest()
+// or when starting a session. If the error is caused by an Error (see AsError()), the RemoteError is of
+// that type, and otherwise of type ErrorInvalidRequest. If the error is an *irma.ValidationError, the
+// description of the RemoteError is the JSON serialization of the list of problems with the request.
+func RequestError(err error) *irma.RemoteError {
+	typ, ok := AsError(err)
+	if !ok {
+		typ = ErrorInvalidRequest
+	}
+	rerr := RemoteError(typ, err.Error())
+	if verr, ok := err.(*irma.ValidationError); ok {
+		if bts, e := json.Marshal(verr.Problems); e == nil {
+			rerr.Description = string(bts)
+		}
+	}
+	return rerr
+}
+
 func wrapSessionRequest(request irma.SessionRequest) (irma.RequestorRequest, error) {
 	switch r := request.(type) {
 	case *irma.DisclosureRequest:
@@ -232,15 +433,6 @@ func wrapSessionRequest(request irma.SessionRequest) (irma.RequestorRequest, err
 	}
 }
 
-func tryUnmarshalJson(bts []byte, attempts []irma.Validator) (irma.Validator, error) {
-	for _, a := range attempts {
-		if err := irma.UnmarshalValidate(bts, a); err == nil {
-			return a, nil
-		}
-	}
-	return nil, errors.New("")
-}
-
 // LocalIP returns the IP address of one of the (non-loopback) network interfaces
 func LocalIP() (string, error) {
 	// Based on https://play.golang.org/p/BDt3qEQ_2H from https://stackoverflow.com/a/23558495
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// ClaimMapping maps OpenID Connect claim names to the attribute types whose disclosed value they
+// receive. If more than one attribute type is listed for a claim, the claim receives the value
+// of the first of these of which an attribute was disclosed, so the attribute types should be
+// listed in order of preference.
+type ClaimMapping map[string][]irma.AttributeTypeIdentifier
+
+// DefaultClaimMapping maps the standard OpenID Connect claims to common attributes of the pbdf scheme.
+var DefaultClaimMapping = ClaimMapping{
+	"email": {
+		irma.NewAttributeTypeIdentifier("pbdf.sidn-pbdf.email.email"),
+		irma.NewAttributeTypeIdentifier("pbdf.pbdf.email.email"),
+	},
+	"phone_number": {
+		irma.NewAttributeTypeIdentifier("pbdf.sidn-pbdf.mobilenumber.mobilenumber"),
+		irma.NewAttributeTypeIdentifier("pbdf.pbdf.mobilenumber.mobilenumber"),
+	},
+	"name": {
+		irma.NewAttributeTypeIdentifier("pbdf.gemeente.personalData.fullname"),
+	},
+	"given_name": {
+		irma.NewAttributeTypeIdentifier("pbdf.gemeente.personalData.firstnames"),
+	},
+	"family_name": {
+		irma.NewAttributeTypeIdentifier("pbdf.gemeente.personalData.familyname"),
+		irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.familyname"),
+	},
+	"birthdate": {
+		irma.NewAttributeTypeIdentifier("pbdf.gemeente.personalData.dateofbirth"),
+		irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.dateofbirth"),
+	},
+}
+
+// NewClaimMapping creates a ClaimMapping from a map from claim names to attribute type identifiers
+// as strings, e.g. as read from a configuration file.
+func NewClaimMapping(mapping map[string][]string) ClaimMapping {
+	m := ClaimMapping{}
+	for claim, ids := range mapping {
+		for _, id := range ids {
+			m[claim] = append(m[claim], irma.NewAttributeTypeIdentifier(id))
+		}
+	}
+	return m
+}
+
+// claimDateFormat is the format of dates in OpenID Connect claims such as birthdate.
+const claimDateFormat = "2006-01-02"
+
+// Claims converts the attributes disclosed in the session result into a flat map of OpenID Connect
+// claims, suitable for embedding in an ID token. Claims of which no attribute was disclosed, e.g.
+// because their attributes were optional or absent from the credential, are omitted, as are all
+// claims if the proofs of the session were not valid.
+// Values are taken from the TypedValue of the attributes if set, or otherwise parsed according to
+// the type of their attribute type in conf if it is not nil; integers and booleans become JSON
+// numbers and booleans and dates become strings of the form 2006-01-02. Other values are strings.
+func (m ClaimMapping) Claims(conf *irma.Configuration, result *SessionResult) map[string]interface{} {
+	claims := map[string]interface{}{}
+	if result == nil || result.ProofStatus != irma.ProofStatusValid {
+		return claims
+	}
+
+	attrs := map[irma.AttributeTypeIdentifier]*irma.DisclosedAttribute{}
+	for _, attr := range result.Disclosed {
+		if attr.RawValue == nil || attrs[attr.Identifier] != nil {
+			continue
+		}
+		if attr.Status != irma.AttributeProofStatusPresent && attr.Status != irma.AttributeProofStatusExtra {
+			continue
+		}
+		attrs[attr.Identifier] = attr
+	}
+
+	for claim, ids := range m {
+		for _, id := range ids {
+			if attr := attrs[id]; attr != nil {
+				claims[claim] = claimValue(conf, attr)
+				break
+			}
+		}
+	}
+	return claims
+}
+
+func claimValue(conf *irma.Configuration, attr *irma.DisclosedAttribute) interface{} {
+	value := attr.TypedValue
+	if value == nil && conf != nil {
+		if attrtype := conf.AttributeTypes[attr.Identifier]; attrtype != nil {
+			value, _ = attrtype.ValueType().Parse(*attr.RawValue)
+		}
+	}
+	switch v := value.(type) {
+	case int64, bool, string:
+		return v
+	case time.Time:
+		return v.Format(claimDateFormat)
+	default:
+		return *attr.RawValue
+	}
+}
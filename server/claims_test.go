@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func disclosed(id, value string, status irma.AttributeProofStatus) *irma.DisclosedAttribute {
+	attr := &irma.DisclosedAttribute{Identifier: irma.NewAttributeTypeIdentifier(id), Status: status}
+	if value != "" {
+		attr.RawValue = &value
+	}
+	return attr
+}
+
+func TestClaims(t *testing.T) {
+	mapping := ClaimMapping{
+		"student_number": {irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		"level":          {irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")},
+		"over18":         {irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLimits.over18")},
+	}
+	for claim, ids := range DefaultClaimMapping {
+		mapping[claim] = ids
+	}
+
+	level := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	over18 := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLimits.over18")
+	dateofbirth := irma.NewAttributeTypeIdentifier("pbdf.gemeente.personalData.dateofbirth")
+	conf := &irma.Configuration{AttributeTypes: map[irma.AttributeTypeIdentifier]*irma.AttributeType{
+		level:       {Type: irma.AttributeValueTypeInteger},
+		over18:      {Type: irma.AttributeValueTypeBoolean},
+		dateofbirth: {Type: irma.AttributeValueTypeDate},
+	}}
+
+	result := &SessionResult{
+		Type:        irma.ActionDisclosing,
+		Status:      StatusDone,
+		ProofStatus: irma.ProofStatusValid,
+		Disclosed: []*irma.DisclosedAttribute{
+			// the second, less preferred email attribute is disclosed only
+			disclosed("pbdf.pbdf.email.email", "alice@example.com", irma.AttributeProofStatusPresent),
+			disclosed("pbdf.gemeente.personalData.fullname", "Alice Doe", irma.AttributeProofStatusPresent),
+			disclosed("pbdf.gemeente.personalData.familyname", "Doe", irma.AttributeProofStatusPresent),
+			disclosed("pbdf.pbdf.idin.familyname", "Smith", irma.AttributeProofStatusExtra),
+			disclosed("pbdf.gemeente.personalData.dateofbirth", "1990-05-17", irma.AttributeProofStatusPresent),
+			// absent optional attribute
+			disclosed("pbdf.gemeente.personalData.firstnames", "", irma.AttributeProofStatusPresent),
+			// not disclosed
+			disclosed("pbdf.sidn-pbdf.mobilenumber.mobilenumber", "0612345678", irma.AttributeProofStatusMissing),
+			disclosed("irma-demo.RU.studentCard.studentID", "s1234567", irma.AttributeProofStatusPresent),
+			disclosed("irma-demo.RU.studentCard.level", "42", irma.AttributeProofStatusPresent),
+			disclosed("irma-demo.MijnOverheid.ageLimits.over18", "true", irma.AttributeProofStatusPresent),
+		},
+	}
+
+	claims := mapping.Claims(conf, result)
+	require.Equal(t, map[string]interface{}{
+		"email":          "alice@example.com",
+		"name":           "Alice Doe",
+		"family_name":    "Doe",
+		"birthdate":      "1990-05-17",
+		"student_number": "s1234567",
+		"level":          int64(42),
+		"over18":         true,
+	}, claims)
+
+	bts, err := json.Marshal(claims)
+	require.NoError(t, err)
+	require.Contains(t, string(bts), `"level":42`)
+	require.Contains(t, string(bts), `"over18":true`)
+
+	// Without configuration values remain strings, unless typed values are present
+	claims = mapping.Claims(nil, result)
+	require.Equal(t, "42", claims["level"])
+	result.Disclosed[8].TypedValue = int64(42)
+	require.Equal(t, int64(42), mapping.Claims(nil, result)["level"])
+
+	// No claims for invalid proofs
+	result.ProofStatus = irma.ProofStatusInvalid
+	require.Empty(t, mapping.Claims(conf, result))
+}
+
+func TestNewClaimMapping(t *testing.T) {
+	mapping := NewClaimMapping(map[string][]string{
+		"email": {"pbdf.sidn-pbdf.email.email", "pbdf.pbdf.email.email"},
+	})
+	require.Equal(t, ClaimMapping{"email": DefaultClaimMapping["email"]}, mapping)
+}
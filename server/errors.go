@@ -1,6 +1,10 @@
 package server
 
-// Error represents an error that occured during an IRMA sessions.
+import "errors"
+
+// Error represents an error that occured during an IRMA sessions. Errors returned by this package
+// and by the irmaserver package match the Error they are caused by using errors.Is() and errors.As(),
+// as do the *irma.RemoteErrors that IRMA clients and requestors receive from the server.
 type Error struct {
 	Type        ErrorType `json:"error"`
 	Status      int       `json:"status"`
@@ -16,21 +20,87 @@ var (
 	ErrorMalformedSignatureRequest Error = Error{Type: "MALFORMED_SIGNATURE_REQUEST", Status: 400, Description: "Malformed signature request"}
 	ErrorMalformedIssuerRequest    Error = Error{Type: "MALFORMED_ISSUER_REQUEST", Status: 400, Description: "Malformed issuer request"}
 	ErrorUnauthorized              Error = Error{Type: "UNAUTHORIZED", Status: 403, Description: "You are not authorized to issue or verify this attribute"}
+	ErrorExcessiveRequest          Error = Error{Type: "EXCESSIVE_REQUEST", Status: 403, Description: "Request asks for more attributes than needed"}
 	ErrorAttributesWrong           Error = Error{Type: "ATTRIBUTES_WRONG", Status: 400, Description: "Specified attribute(s) do not belong to this credential type or missing attributes"}
 	ErrorCannotIssue               Error = Error{Type: "CANNOT_ISSUE", Status: 500, Description: "Cannot issue this credential"}
+	ErrorCredentialTypeDeprecated  Error = Error{Type: "CREDENTIAL_TYPE_DEPRECATED", Status: 400, Description: "Credential type is deprecated and can no longer be issued"}
 
 	ErrorIssuanceFailed       Error = Error{Type: "ISSUANCE_FAILED", Status: 500, Description: "Failed to create credential(s)"}
 	ErrorInvalidProofs        Error = Error{Type: "INVALID_PROOFS", Status: 400, Description: "Invalid secret key commitments and/or disclosure proofs"}
 	ErrorAttributesMissing    Error = Error{Type: "ATTRIBUTES_MISSING", Status: 400, Description: "Not all requested-for attributes were present"}
 	ErrorAttributesExpired    Error = Error{Type: "ATTRIBUTES_EXPIRED", Status: 400, Description: "Disclosed attributes were expired"}
+	ErrorAttributesRevoked    Error = Error{Type: "ATTRIBUTES_REVOKED", Status: 400, Description: "Credentials of disclosed attributes were revoked"}
+	ErrorRevocationCheck      Error = Error{Type: "REVOCATION_CHECK_FAILED", Status: 500, Description: "Could not check whether credentials were revoked"}
 	ErrorUnexpectedRequest    Error = Error{Type: "UNEXPECTED_REQUEST", Status: 403, Description: "Unexpected request in this state"}
 	ErrorUnknownPublicKey     Error = Error{Type: "UNKNOWN_PUBLIC_KEY", Status: 403, Description: "Attributes were not valid against a known public key"}
+	ErrorExpiredPublicKey     Error = Error{Type: "EXPIRED_PUBLIC_KEY", Status: 403, Description: "Attributes were issued under a public key that had already expired"}
 	ErrorKeyshareProofMissing Error = Error{Type: "KEYSHARE_PROOF_MISSING", Status: 403, Description: "ProofP object from a keyshare server missing"}
 	ErrorSessionUnknown       Error = Error{Type: "SESSION_UNKNOWN", Status: 400, Description: "Unknown or expired session"}
 	ErrorMalformedInput       Error = Error{Type: "MALFORMED_INPUT", Status: 400, Description: "Input could not be parsed"}
 	ErrorUnknown              Error = Error{Type: "EXCEPTION", Status: 500, Description: "Encountered unexpected problem"}
+	ErrorRequestCancelled     Error = Error{Type: "REQUEST_CANCELLED", Status: 503, Description: "Request was cancelled before it was handled, and may be retried"}
 
 	ErrorUnsupported     Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
+	ErrorNoJwtKey        Error = Error{Type: "NO_JWT_KEY", Status: 404, Description: "No JWT private key is configured"}
 	ErrorInvalidRequest  Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
 	ErrorProtocolVersion Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
+
+	// Errors of the keyshare server (see the keyshareserver package), whose names the keyshare
+	// protocol implementation of irmaclient recognizes
+	ErrorUserNotFound         Error = Error{Type: "USER_NOT_FOUND", Status: 403, Description: "Unknown keyshare user"}
+	ErrorUserBlocked          Error = Error{Type: "USER_BLOCKED", Status: 403, Description: "Keyshare user is temporarily blocked after too many wrong PIN attempts"}
+	ErrorInvalidAuthorization Error = Error{Type: "INVALID_AUTHORIZATION", Status: 403, Description: "Missing, invalid or expired keyshare authorization token"}
+	ErrorMissingCommitments   Error = Error{Type: "MISSING_COMMITMENTS", Status: 400, Description: "No keyshare commitments were requested before the response"}
 )
+
+func (err Error) Error() string {
+	return string(err.Type) + ": " + err.Description
+}
+
+// ErrorName returns the type of the error, which is the error name of the *irma.RemoteErrors
+// created from it (see RemoteError()), so that those match the error using errors.Is().
+func (err Error) ErrorName() string {
+	return string(err.Type)
+}
+
+// Wrap returns an error having the message of the specified cause, which matches both the cause
+// and the Error using errors.Is() and errors.As(). If the cause is nil the Error itself is returned.
+func (err Error) Wrap(cause error) error {
+	if cause == nil {
+		return err
+	}
+	return &wrappedError{typ: err, cause: cause}
+}
+
+// AsError returns the first Error in the chain of the specified error, if any.
+func AsError(err error) (Error, bool) {
+	var e Error
+	ok := errors.As(err, &e)
+	return e, ok
+}
+
+type wrappedError struct {
+	typ   Error
+	cause error
+}
+
+func (e *wrappedError) Error() string {
+	return e.cause.Error()
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.cause
+}
+
+func (e *wrappedError) Is(target error) bool {
+	t, ok := target.(Error)
+	return ok && t == e.typ
+}
+
+func (e *wrappedError) As(target interface{}) bool {
+	t, ok := target.(*Error)
+	if ok {
+		*t = e.typ
+	}
+	return ok
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorWrap(t *testing.T) {
+	cause := errors.New("can't cancel unknown session abc")
+	err := fmt.Errorf("cancelling: %w", ErrorSessionUnknown.Wrap(cause))
+
+	require.Equal(t, "cancelling: can't cancel unknown session abc", err.Error())
+	require.True(t, errors.Is(err, ErrorSessionUnknown))
+	require.True(t, errors.Is(err, cause))
+	require.False(t, errors.Is(err, ErrorUnauthorized))
+
+	var serr Error
+	require.True(t, errors.As(err, &serr))
+	require.Equal(t, ErrorSessionUnknown, serr)
+	typ, ok := AsError(err)
+	require.True(t, ok)
+	require.Equal(t, ErrorSessionUnknown, typ)
+	_, ok = AsError(cause)
+	require.False(t, ok)
+
+	require.Equal(t, ErrorSessionUnknown, ErrorSessionUnknown.Wrap(nil))
+}
+
+func TestRequestErrorType(t *testing.T) {
+	rerr := RequestError(ErrorCredentialTypeDeprecated.Wrap(errors.New("credential type is deprecated")))
+	require.Equal(t, string(ErrorCredentialTypeDeprecated.Type), rerr.ErrorName)
+	require.Equal(t, ErrorCredentialTypeDeprecated.Status, rerr.Status)
+	require.Equal(t, "credential type is deprecated", rerr.Message)
+
+	rerr = RequestError(errors.New("something else"))
+	require.Equal(t, string(ErrorInvalidRequest.Type), rerr.ErrorName)
+
+	// Errors received by clients and requestors match the server error they were created from
+	err := &irma.SessionError{ErrorType: irma.ErrorApi, RemoteError: RemoteError(ErrorUnauthorized, "")}
+	require.True(t, errors.Is(err, ErrorUnauthorized))
+	require.False(t, errors.Is(err, ErrorSessionUnknown))
+	require.True(t, errors.Is(err, irma.ErrorApi))
+}
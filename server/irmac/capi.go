@@ -21,6 +21,7 @@ package main
 import "C"
 
 import (
+	"context"
 	"encoding/json"
 	"unsafe"
 
@@ -69,7 +70,7 @@ func StartSession(requestString *C.char) C.struct_StartSessionReturn {
 	}
 
 	// Run the actual core function
-	qr, token, err := s.StartSession(C.GoString(requestString))
+	qr, token, err := s.StartSession(context.Background(), C.GoString(requestString))
 
 	// And properly return the result
 	if err != nil {
@@ -196,7 +197,7 @@ func HandleProtocolMessage(path *C.char, method *C.char, headers C.struct_HttpHe
 	}
 
 	// Prepare return values
-	status, body, session := s.HandleProtocolMessage(C.GoString(path), C.GoString(method), headerMap, []byte(C.GoString(message)))
+	status, body, session := s.HandleProtocolMessage(context.Background(), C.GoString(path), C.GoString(method), headerMap, []byte(C.GoString(message)))
 	if session == nil {
 		result.SessionResult = nil
 	} else {
@@ -6,7 +6,9 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-errors/errors"
 	"github.com/mitchellh/mapstructure"
 	"github.com/privacybydesign/irmago/server"
@@ -32,9 +34,19 @@ var RootCommand = &cobra.Command{
 			die(errors.WrapPrefix(err, "Failed to configure server", 0))
 		}
 
+		if viper.GetBool("watch-requestors") && viper.ConfigFileUsed() != "" {
+			viper.OnConfigChange(func(fsnotify.Event) {
+				conf.Logger.Info("Configuration file changed, reloading requestors")
+				reloadRequestors()
+			})
+			viper.WatchConfig()
+		}
+
 		stopped := make(chan struct{})
 		interrupt := make(chan os.Signal, 1)
 		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
 
 		go func() {
 			if err := serv.Start(conf); err != nil {
@@ -50,6 +62,18 @@ var RootCommand = &cobra.Command{
 				conf.Logger.Debug("Caught interrupt")
 				serv.Stop() // causes serv.Start() above to return
 				conf.Logger.Debug("Sent stop signal to server")
+			case <-hangup:
+				conf.Logger.Info("Caught hangup, reloading private keys and requestors")
+				if err := conf.LoadPrivateKeys(); err != nil {
+					conf.Logger.Error("Failed to reload private keys: ", err.Error())
+				}
+				if viper.ConfigFileUsed() != "" {
+					if err := viper.ReadInConfig(); err != nil {
+						conf.Logger.Error("Failed to reread configuration file: ", err.Error())
+					} else {
+						reloadRequestors()
+					}
+				}
 			case <-stopped:
 				conf.Logger.Info("Exiting")
 				close(stopped)
@@ -102,12 +126,32 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.StringP("config", "c", "", "path to configuration file")
 	flags.StringP("schemes-path", "s", schemespath, "path to irma_configuration")
 	flags.String("schemes-assets-path", "", "if specified, copy schemes from here into --schemes-path")
+	flags.StringSlice("schemes-assets-paths", nil, "further folders to copy schemes from into --schemes-path; of a scheme in several assets paths the last one is used")
 	flags.Int("schemes-update", 60, "update IRMA schemes every x minutes (0 to disable)")
-	flags.StringP("privkeys", "k", "", "path to IRMA private keys")
+	flags.Int("schemes-reload", 0, "check every x seconds whether IRMA schemes were changed on disk, and reload them if so (0 to disable)")
+	flags.Bool("allow-schemes-rollback", false, "allow scheme updates to install older versions of schemes than the installed ones")
+	flags.Bool("scheme-update-announcements", false, "update schemes immediately when receiving update announcements signed by them at /scheme-update")
+	flags.Bool("install-unknown-schemes", false, "install unknown schemes that disclosure or signature session requests point to")
+	flags.StringSlice("development-schemes", nil, "schemes in schemes-path to parse without verifying their signature (not allowed in production mode)")
+	flags.Bool("strict-schemes", false, "disable an entire scheme if one of its issuers or credential types fails to parse, instead of skipping those")
+	flags.StringP("privkeys", "k", "", "path to IRMA private keys, named scheme.issuer.xml or scheme.issuer.counter.xml (reloaded on SIGHUP)")
 	flags.String("static-path", "", "Host files under this path as static files (leave empty to disable)")
 	flags.String("static-prefix", "/", "Host static files under this URL prefix")
 	flags.StringP("url", "u", defaulturl, "external URL to server to which the IRMA client connects")
 	flags.Bool("sse", false, "Enable server sent for status updates (experimental)")
+	flags.Bool("typed-attribute-values", false, "include attribute values parsed according to their declared type in session results")
+	flags.Bool("accept-expired", false, "accept attributes of expired credentials if the session request does not specify otherwise")
+	flags.Int("max-expired-age", 0, "maximum number of seconds since expiry of accepted expired attributes (0 for no maximum)")
+	flags.Bool("normalize-requests", false, "remove redundant disjunctions from session requests (changes the layout of session results)")
+	flags.String("app-link-domain", "", "domain of IRMA app universal links, to include session links in session packages (e.g. irma.app)")
+	flags.Bool("strict-requests", false, "reject JSON session requests with unknown fields or fields of the wrong type (see /schemas)")
+	flags.String("revocation-list", "", "file or HTTP(S) URL listing the credential hashes of revoked credentials, one per line, enabling revocation checks")
+	flags.Int("revocation-list-cache", 60, "number of seconds for which the revocation list is used before it is read again")
+	flags.String("result-webhook", "", "URL to which the results of all sessions are posted as JSON, retrying on failure")
+	flags.String("result-file", "", "file to which the results of all sessions are appended as JSON lines")
+	flags.Int("result-publish-attempts", 10, "maximum number of attempts to publish each session result to --result-webhook or --result-file")
+	flags.Bool("compact-session-pointers", false, "render session pointers in QR codes in their compact form (requires IRMA apps supporting protocol 2.5)")
+	flags.Int("max-session-ptr-lifetime", 0, "if nonzero, polling the status of a session postpones the expiry of its session pointer, up to this many seconds after it was issued")
 
 	flags.IntP("port", "p", 8088, "port at which to listen")
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
@@ -117,6 +161,7 @@ func setFlags(cmd *cobra.Command, production bool) error {
 
 	flags.Bool("no-auth", !production, "whether or not to authenticate requestors")
 	flags.String("requestors", "", "requestor configuration (in JSON)")
+	flags.Bool("watch-requestors", false, "reload the requestors when the configuration file changes (also done on SIGHUP)")
 	flags.StringSlice("disclose-perms", nil, "list of attributes that all requestors may verify (default *)")
 	flags.StringSlice("sign-perms", nil, "list of attributes that all requestors may request in signatures (default *)")
 	issHelp := "list of attributes that all requestors may issue"
@@ -124,12 +169,19 @@ func setFlags(cmd *cobra.Command, production bool) error {
 		issHelp += " (default *)"
 	}
 	flags.StringSlice("issue-perms", nil, issHelp)
+	flags.StringSlice("issue-disclose-perms", nil, "list of attributes that all requestors may verify in combined issuance/disclosure sessions (default *)")
+	flags.Bool("credential-hashes", false, "whether all requestors may receive the credential hashes of disclosed attributes, which link disclosures of the same credential")
+	flags.Bool("hash-attribute-values", false, "whether all requestors may receive hashes of disclosed attribute values instead of the values")
+	flags.String("minimization-rules", "", "path to a JSON file of rules flagging disclosure requests that ask for more attributes than needed")
+	flags.Bool("minimization-hints", false, "include the hints of --minimization-rules in session packages")
 	flags.Lookup("no-auth").Header = `Requestor authentication and default requestor permissions`
 
 	flags.StringP("jwt-issuer", "j", "irmaserver", "JWT issuer")
-	flags.String("jwt-privkey", "", "JWT private key")
-	flags.String("jwt-privkey-file", "", "path to JWT private key")
+	flags.String("jwt-privkey", "", "JWT private key (RSA or ECDSA, PEM-encoded)")
+	flags.String("jwt-privkey-file", "", "path to JWT private key (RSA or ECDSA, PEM-encoded)")
+	flags.String("jwt-active-key", "", "ID of the JWT private key to sign with, of those in jwt-privkey-files in the config file")
 	flags.Int("max-request-age", 300, "max age in seconds of a session request JWT")
+	flags.Bool("jwt-claims", false, "include disclosed attributes as OpenID Connect claims in result JWTs (mapping configurable with jwt-claim-mapping in the config file)")
 	flags.Lookup("jwt-issuer").Header = `JWT configuration`
 
 	flags.String("tls-cert", "", "TLS certificate (chain)")
@@ -204,25 +256,45 @@ func configure(cmd *cobra.Command) error {
 	// Read configuration from flags and/or environmental variables
 	conf = &requestorserver.Configuration{
 		Configuration: &server.Configuration{
-			SchemesPath:           viper.GetString("schemes-path"),
-			SchemesAssetsPath:     viper.GetString("schemes-assets-path"),
-			SchemesUpdateInterval: viper.GetInt("schemes-update"),
-			DisableSchemesUpdate:  viper.GetInt("schemes-update") == 0,
-			IssuerPrivateKeysPath: viper.GetString("privkeys"),
-			URL:        viper.GetString("url"),
-			DisableTLS: viper.GetBool("no-tls"),
-			Email:      viper.GetString("email"),
-			EnableSSE:  viper.GetBool("sse"),
-			Verbose:    viper.GetInt("verbose"),
-			Quiet:      viper.GetBool("quiet"),
-			LogJSON:    viper.GetBool("log-json"),
-			Logger:     logger,
-			Production: viper.GetBool("production"),
+			SchemesPath:               viper.GetString("schemes-path"),
+			SchemesAssetsPath:         viper.GetString("schemes-assets-path"),
+			SchemesAssetsPaths:        viper.GetStringSlice("schemes-assets-paths"),
+			SchemesUpdateInterval:     viper.GetInt("schemes-update"),
+			DisableSchemesUpdate:      viper.GetInt("schemes-update") == 0,
+			SchemesReloadInterval:     viper.GetInt("schemes-reload"),
+			AllowSchemesRollback:      viper.GetBool("allow-schemes-rollback"),
+			SchemeUpdateAnnouncements: viper.GetBool("scheme-update-announcements"),
+			InstallUnknownSchemes:     viper.GetBool("install-unknown-schemes"),
+			DevelopmentSchemes:        viper.GetStringSlice("development-schemes"),
+			StrictSchemes:             viper.GetBool("strict-schemes"),
+			IssuerPrivateKeysPath:     viper.GetString("privkeys"),
+			URL:                       viper.GetString("url"),
+			DisableTLS:                viper.GetBool("no-tls"),
+			Email:                     viper.GetString("email"),
+			EnableSSE:                 viper.GetBool("sse"),
+			TypedAttributeValues:      viper.GetBool("typed-attribute-values"),
+			AcceptExpired:             viper.GetBool("accept-expired"),
+			MaxExpiredAge:             viper.GetInt("max-expired-age"),
+			NormalizeRequests:         viper.GetBool("normalize-requests"),
+			CompactSessionPointers:    viper.GetBool("compact-session-pointers"),
+			StrictRequests:            viper.GetBool("strict-requests"),
+			AppLinkDomain:             viper.GetString("app-link-domain"),
+			MaxSessionPtrLifetime:     viper.GetInt("max-session-ptr-lifetime"),
+			ResultPublishAttempts:     viper.GetInt("result-publish-attempts"),
+			Verbose:                   viper.GetInt("verbose"),
+			Quiet:                     viper.GetBool("quiet"),
+			LogJSON:                   viper.GetBool("log-json"),
+			Logger:                    logger,
+			Production:                viper.GetBool("production"),
 		},
 		Permissions: requestorserver.Permissions{
-			Disclosing: handlePermission("disclose-perms"),
-			Signing:    handlePermission("sign-perms"),
-			Issuing:    handlePermission("issue-perms"),
+			Disclosing:         handlePermission("disclose-perms"),
+			Signing:            handlePermission("sign-perms"),
+			Issuing:            handlePermission("issue-perms"),
+			IssuingDisclosures: handlePermission("issue-disclose-perms"),
+
+			CredentialHashes:    viper.GetBool("credential-hashes"),
+			HashAttributeValues: viper.GetBool("hash-attribute-values"),
 		},
 		ListenAddress:                  viper.GetString("listen-addr"),
 		Port:                           viper.GetInt("port"),
@@ -231,9 +303,15 @@ func configure(cmd *cobra.Command) error {
 		DisableRequestorAuthentication: viper.GetBool("no-auth"),
 		Requestors:                     make(map[string]requestorserver.Requestor),
 		JwtIssuer:                      viper.GetString("jwt-issuer"),
+		JwtClaims:                      viper.GetBool("jwt-claims"),
+		JwtClaimMapping:                server.NewClaimMapping(viper.GetStringMapStringSlice("jwt-claim-mapping")),
 		JwtPrivateKey:                  viper.GetString("jwt-privkey"),
 		JwtPrivateKeyFile:              viper.GetString("jwt-privkey-file"),
+		JwtPrivateKeyFiles:             viper.GetStringMapString("jwt-privkey-files"),
+		JwtActiveKey:                   viper.GetString("jwt-active-key"),
 		MaxRequestAge:                  viper.GetInt("max-request-age"),
+		MinimizationRulesFile:          viper.GetString("minimization-rules"),
+		MinimizationHints:              viper.GetBool("minimization-hints"),
 		StaticPath:                     viper.GetString("static-path"),
 		StaticPrefix:                   viper.GetString("static-prefix"),
 
@@ -247,6 +325,22 @@ func configure(cmd *cobra.Command) error {
 		ClientTlsPrivateKeyFile:  viper.GetString("client-tls-privkey-file"),
 	}
 
+	if list := viper.GetString("revocation-list"); list != "" {
+		conf.RevocationChecker = &server.ListRevocationChecker{
+			Source:        list,
+			CacheDuration: time.Duration(viper.GetInt("revocation-list-cache")) * time.Second,
+		}
+	}
+
+	switch webhook, file := viper.GetString("result-webhook"), viper.GetString("result-file"); {
+	case webhook != "" && file != "":
+		return errors.New("--result-webhook cannot be combined with --result-file")
+	case webhook != "":
+		conf.ResultPublisher = &server.WebhookPublisher{URL: webhook}
+	case file != "":
+		conf.ResultPublisher = &server.FilePublisher{Path: file}
+	}
+
 	if conf.Production {
 		if !viper.GetBool("no-email") && conf.Email == "" {
 			return errors.New("In production mode it is required to specify either an email address with the --email flag, or explicitly opting out with --no-email. See help or README for more info.")
@@ -257,21 +351,42 @@ func configure(cmd *cobra.Command) error {
 	}
 
 	// Handle requestors
+	if conf.Requestors, err = readRequestors(); err != nil {
+		return err
+	}
+
+	logger.Debug("Done configuring")
+
+	return nil
+}
+
+func readRequestors() (map[string]requestorserver.Requestor, error) {
+	var err error
 	var requestors map[string]interface{}
 	if val, flagOrEnv := viper.Get("requestors").(string); !flagOrEnv || val != "" {
 		if requestors, err = cast.ToStringMapE(viper.Get("requestors")); err != nil {
-			return errors.WrapPrefix(err, "Failed to unmarshal requestors from flag or env var", 0)
+			return nil, errors.WrapPrefix(err, "Failed to unmarshal requestors from flag or env var", 0)
 		}
 	}
+	result := make(map[string]requestorserver.Requestor)
 	if len(requestors) > 0 {
-		if err := mapstructure.Decode(requestors, &conf.Requestors); err != nil {
-			return errors.WrapPrefix(err, "Failed to unmarshal requestors from config file", 0)
+		if err := mapstructure.Decode(requestors, &result); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to unmarshal requestors from config file", 0)
 		}
 	}
+	return result, nil
+}
 
-	logger.Debug("Done configuring")
-
-	return nil
+// reloadRequestors rereads the requestors from the configuration, replacing those of the server
+// if they are valid (see requestorserver.Configuration.ReloadRequestors()).
+func reloadRequestors() {
+	requestors, err := readRequestors()
+	if err == nil {
+		err = conf.ReloadRequestors(requestors)
+	}
+	if err != nil {
+		conf.Logger.Error("Failed to reload requestors, keeping the current ones: ", err.Error())
+	}
 }
 
 func handlePermission(typ string) []string {
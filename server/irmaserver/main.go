@@ -5,6 +5,7 @@
 package irmaserver
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 
@@ -62,7 +63,16 @@ func StartSession(request interface{}, handler SessionHandler) (*irma.Qr, string
 	return s.StartSession(request, handler)
 }
 func (s *Server) StartSession(request interface{}, handler SessionHandler) (*irma.Qr, string, error) {
-	qr, token, err := s.Server.StartSession(request)
+	return s.StartSessionContext(context.Background(), request, handler)
+}
+
+// StartSessionContext is like StartSession, but returns the error of the context if it is done
+// before the session is started, e.g. while installing scheme managers the request refers to.
+func StartSessionContext(ctx context.Context, request interface{}, handler SessionHandler) (*irma.Qr, string, error) {
+	return s.StartSessionContext(ctx, request, handler)
+}
+func (s *Server) StartSessionContext(ctx context.Context, request interface{}, handler SessionHandler) (*irma.Qr, string, error) {
+	qr, token, err := s.Server.StartSession(ctx, request)
 	if err != nil {
 		return nil, "", err
 	}
@@ -88,6 +98,24 @@ func (s *Server) GetRequest(token string) irma.RequestorRequest {
 	return s.Server.GetRequest(token)
 }
 
+// GetSessionPtr retrieves the session pointer of the specified IRMA session, as returned by StartSession().
+func GetSessionPtr(token string) *irma.Qr {
+	return s.GetSessionPtr(token)
+}
+func (s *Server) GetSessionPtr(token string) *irma.Qr {
+	return s.Server.GetSessionPtr(token)
+}
+
+// RefreshSession issues a new session pointer for the specified IRMA session, provided that the
+// IRMA app has not yet connected to it, restarting its expiry. The session pointer that the session
+// had before can no longer be used.
+func RefreshSession(token string) (*irma.Qr, error) {
+	return s.RefreshSession(token)
+}
+func (s *Server) RefreshSession(token string) (*irma.Qr, error) {
+	return s.Server.RefreshSession(token)
+}
+
 // CancelSession cancels the specified IRMA session.
 func CancelSession(token string) error {
 	return s.CancelSession(token)
@@ -96,6 +124,43 @@ func (s *Server) CancelSession(token string) error {
 	return s.Server.CancelSession(token)
 }
 
+// RemoveScheme removes the specified scheme from storage and from the schemes used by new sessions.
+// This is refused while sessions in progress refer to the scheme.
+func RemoveScheme(id irma.SchemeManagerIdentifier) error {
+	return s.RemoveScheme(id)
+}
+func (s *Server) RemoveScheme(id irma.SchemeManagerIdentifier) error {
+	return s.Server.RemoveScheme(id)
+}
+
+// ReloadSchemes reloads the schemes if they were changed on disk, e.g. by installing a new version
+// of a scheme with a new issuer key, returning how they changed. Sessions in progress are unaffected.
+// See also server.Configuration.SchemesReloadInterval.
+func ReloadSchemes() (*irma.ConfigurationDiff, error) {
+	return s.ReloadSchemes()
+}
+func (s *Server) ReloadSchemes() (*irma.ConfigurationDiff, error) {
+	return s.Server.ReloadSchemes()
+}
+
+// UpdateAnnouncedScheme immediately updates the scheme announced by the signed scheme update
+// announcement, which is dropped if it is not validly signed by the announced scheme.
+func UpdateAnnouncedScheme(announcement *irma.SignedSchemeUpdateAnnouncement) (*irma.ConfigurationDiff, error) {
+	return s.UpdateAnnouncedScheme(announcement)
+}
+func (s *Server) UpdateAnnouncedScheme(announcement *irma.SignedSchemeUpdateAnnouncement) (*irma.ConfigurationDiff, error) {
+	return s.Server.UpdateAnnouncedScheme(announcement)
+}
+
+// SchemesReloadStatus returns the time of the last successful reload of the schemes,
+// and the error of the last attempt if it failed.
+func SchemesReloadStatus() server.SchemesReloadStatus {
+	return s.SchemesReloadStatus()
+}
+func (s *Server) SchemesReloadStatus() server.SchemesReloadStatus {
+	return s.Server.SchemesReloadStatus()
+}
+
 // SubscribeServerSentEvents subscribes the HTTP client to server sent events on status updates
 // of the specified IRMA session.
 func SubscribeServerSentEvents(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
@@ -138,7 +203,12 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 			return
 		}
 
-		status, response, result := s.HandleProtocolMessage(r.URL.Path, r.Method, r.Header, message)
+		status, response, result := s.HandleProtocolMessage(r.Context(), r.URL.Path, r.Method, r.Header, message)
+		if err == nil && noun == "status" {
+			if expiry := s.ClientSessionPtrExpiry(token); expiry != nil {
+				w.Header().Set(irma.SessionExpiryHeader, expiry.String())
+			}
+		}
 		w.WriteHeader(status)
 		_, err = w.Write(response)
 		if err != nil {
@@ -0,0 +1,120 @@
+package keyshareserver
+
+import (
+	"crypto/rsa"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// Supported values of Configuration.DBType.
+const (
+	DBTypeMemory   = "memory"
+	DBTypePostgres = "postgres"
+)
+
+// Configuration contains the configuration of a keyshare server.
+type Configuration struct {
+	// Configuration of the IRMA server with which the keyshare attribute is issued to users
+	// enrolling at the keyshare server. Its URL must be the URL at which Handler() is reachable
+	// by the IRMA app, followed by irma/.
+	*server.Configuration `mapstructure:",squash"`
+
+	// Identifier of the scheme of which this is the keyshare server
+	SchemeManager string `json:"scheme" mapstructure:"scheme"`
+
+	// Storage of the user accounts. If nil, DBType and DBConnStr determine the storage.
+	DB DB `json:"-"`
+	// Type of the user storage: DBTypeMemory (the default) or DBTypePostgres
+	DBType string `json:"db_type" mapstructure:"db_type"`
+	// Connection string of the Postgres database, if DBType is DBTypePostgres
+	DBConnStr string `json:"db_str" mapstructure:"db_str"`
+
+	// Private key with which JWTs are signed, whose public key is kss-<JwtKeyID>.pem in the scheme
+	JwtKeyID          int    `json:"jwt_key_id" mapstructure:"jwt_key_id"`
+	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
+	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
+	// Used in the "iss" field of the JWTs
+	JwtIssuer string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
+
+	// Validity in seconds of the authorization tokens obtained by verifying the PIN (default 900)
+	AuthTokenValidity int `json:"auth_token_validity" mapstructure:"auth_token_validity"`
+	// Number of consecutive wrong PIN attempts after which users are blocked (default 3)
+	MaxPinAttempts int `json:"max_pin_attempts" mapstructure:"max_pin_attempts"`
+	// Seconds for which users are blocked the first time; each subsequent block without a correct
+	// PIN in between lasts twice as long (default 60)
+	PinBlockDuration int `json:"pin_block_duration" mapstructure:"pin_block_duration"`
+
+	jwtPrivateKey     *rsa.PrivateKey
+	scheme            irma.SchemeManagerIdentifier
+	keyshareAttribute irma.AttributeTypeIdentifier
+}
+
+func (conf *Configuration) initialize() error {
+	if conf.AuthTokenValidity == 0 {
+		conf.AuthTokenValidity = 15 * 60
+	}
+	if conf.MaxPinAttempts == 0 {
+		conf.MaxPinAttempts = 3
+	}
+	if conf.PinBlockDuration == 0 {
+		conf.PinBlockDuration = 60
+	}
+	if conf.AuthTokenValidity < 0 || conf.MaxPinAttempts < 0 || conf.PinBlockDuration < 0 {
+		return errors.New("auth_token_validity, max_pin_attempts and pin_block_duration must not be negative")
+	}
+
+	conf.scheme = irma.NewSchemeManagerIdentifier(conf.SchemeManager)
+	scheme := conf.CurrentIrmaConfiguration().SchemeManagers[conf.scheme]
+	if scheme == nil {
+		return errors.Errorf("Unknown scheme %s", conf.SchemeManager)
+	}
+	if !scheme.Distributed() || scheme.KeyshareAttribute == "" {
+		return errors.Errorf("Scheme %s has no keyshare server or keyshare attribute", conf.SchemeManager)
+	}
+	conf.keyshareAttribute = irma.NewAttributeTypeIdentifier(scheme.KeyshareAttribute)
+
+	if err := conf.readPrivateKey(); err != nil {
+		return err
+	}
+
+	if conf.DB != nil {
+		return nil
+	}
+	switch conf.DBType {
+	case "", DBTypeMemory:
+		conf.Logger.Warn("Keyshare users are stored in memory and are lost when the server stops")
+		conf.DB = NewMemoryDB()
+	case DBTypePostgres:
+		db, err := NewPostgresDB(conf.DBConnStr)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to connect to database", 0)
+		}
+		conf.DB = db
+	default:
+		return errors.Errorf("Unsupported db_type %s (supported: %s, %s)", conf.DBType, DBTypeMemory, DBTypePostgres)
+	}
+	return nil
+}
+
+func (conf *Configuration) readPrivateKey() error {
+	keybytes, err := fs.ReadKey(conf.JwtPrivateKey, conf.JwtPrivateKeyFile)
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to read private key", 0)
+	}
+	conf.jwtPrivateKey, err = jwt.ParseRSAPrivateKeyFromPEM(keybytes)
+	if err != nil {
+		return err
+	}
+	pk, err := conf.CurrentIrmaConfiguration().KeyshareServerPublicKey(conf.scheme, conf.JwtKeyID)
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to read keyshare server public key of the scheme", 0)
+	}
+	if pk.N.Cmp(conf.jwtPrivateKey.N) != 0 || pk.E != conf.jwtPrivateKey.E {
+		return errors.Errorf("Private key does not match public key kss-%d.pem of scheme %s", conf.JwtKeyID, conf.SchemeManager)
+	}
+	return nil
+}
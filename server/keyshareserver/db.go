@@ -0,0 +1,97 @@
+package keyshareserver
+
+import (
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is an account at the keyshare server.
+type User struct {
+	Username string
+	// The keyshare server's share of the secret key of the user's credentials
+	Secret *big.Int
+	// bcrypt hash of the PIN of the user (which the IRMA app already hashes with a nonce of its own)
+	PinHash string
+	// Number of consecutive wrong PIN attempts since the last correct PIN or block
+	PinAttempts int
+	// Number of times the user was blocked since the last correct PIN
+	Blocks int
+	// Unix time until which the user is blocked, or 0
+	BlockedUntil int64
+	Email        *string
+	Language     string
+}
+
+// SetPin stores a salted hash of the specified PIN in the user, so that the database does not
+// contain anything with which the user can be authenticated.
+func (user *User) SetPin(pin string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to hash PIN", 0)
+	}
+	user.PinHash = string(hash)
+	return nil
+}
+
+// verifyPin reports whether the specified PIN matches the PIN hash of the user.
+func (user *User) verifyPin(pin string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(user.PinHash), []byte(pin)) == nil
+}
+
+// DB stores the user accounts of a keyshare server.
+type DB interface {
+	// AddUser stores a new user, returning ErrUserExists if the username is taken.
+	AddUser(user *User) error
+	// User returns the user with the specified username, or ErrUserNotFound.
+	User(username string) (*User, error)
+	// UpdateUser stores the modifications of an existing user, or returns ErrUserNotFound.
+	UpdateUser(user *User) error
+}
+
+var (
+	ErrUserExists   = errors.New("User already exists")
+	ErrUserNotFound = errors.New("User not found")
+)
+
+type memoryDB struct {
+	sync.Mutex
+	users map[string]User
+}
+
+// NewMemoryDB returns a DB that keeps the users in memory.
+func NewMemoryDB() DB {
+	return &memoryDB{users: map[string]User{}}
+}
+
+func (db *memoryDB) AddUser(user *User) error {
+	db.Lock()
+	defer db.Unlock()
+	if _, exists := db.users[user.Username]; exists {
+		return ErrUserExists
+	}
+	db.users[user.Username] = *user
+	return nil
+}
+
+func (db *memoryDB) User(username string) (*User, error) {
+	db.Lock()
+	defer db.Unlock()
+	user, exists := db.users[username]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	return &user, nil
+}
+
+func (db *memoryDB) UpdateUser(user *User) error {
+	db.Lock()
+	defer db.Unlock()
+	if _, exists := db.users[user.Username]; !exists {
+		return ErrUserNotFound
+	}
+	db.users[user.Username] = *user
+	return nil
+}
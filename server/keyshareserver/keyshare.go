@@ -0,0 +1,63 @@
+package keyshareserver
+
+import (
+	"time"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+)
+
+// This file contains the keyshare server's part of the zero-knowledge proofs of IRMA sessions
+// involving credentials of its scheme: a Schnorr proof of knowledge of its share of the user's
+// secret key. The IRMA app merges the commitments and responses computed here into the proofs
+// of its credentials (see irmaclient/keyshare.go).
+
+// Time after which commitments for which no response was requested are discarded.
+const commitmentValidity = 5 * time.Minute
+
+// keyshareCommitment is the state of a keyshare proof between the commitments and the response.
+type keyshareCommitment struct {
+	// Commitment randomizer, shared by the commitments for all public keys so that the response
+	// can be merged into the proofs of credentials under any of them
+	randomizer *big.Int
+	// Public keys of the commitments; the response is computed for the first one
+	keys    []*gabi.PublicKey
+	created time.Time
+}
+
+// newKeyshareCommitment generates commitments to the specified secret for the specified public keys.
+func newKeyshareCommitment(secret *big.Int, keys []*gabi.PublicKey) (*keyshareCommitment, []*gabi.ProofPCommitment, error) {
+	randomizer, err := gabi.RandomBigInt(systemParameters(keys[0]).LmCommit)
+	if err != nil {
+		return nil, nil, err
+	}
+	commitments := make([]*gabi.ProofPCommitment, len(keys))
+	for i, pk := range keys {
+		commitments[i] = &gabi.ProofPCommitment{
+			P:       new(big.Int).Exp(pk.R[0], secret, pk.N),
+			Pcommit: new(big.Int).Exp(pk.R[0], randomizer, pk.N),
+		}
+	}
+	return &keyshareCommitment{randomizer: randomizer, keys: keys, created: time.Now()}, commitments, nil
+}
+
+// response computes the response to the specified challenge, completing the proof.
+func (c *keyshareCommitment) response(secret, challenge *big.Int) *gabi.ProofP {
+	pk := c.keys[0]
+	return &gabi.ProofP{
+		P:         new(big.Int).Exp(pk.R[0], secret, pk.N),
+		C:         challenge,
+		SResponse: new(big.Int).Add(c.randomizer, new(big.Int).Mul(challenge, secret)),
+	}
+}
+
+func (c *keyshareCommitment) expired() bool {
+	return time.Since(c.created) > commitmentValidity
+}
+
+func systemParameters(pk *gabi.PublicKey) *gabi.SystemParameters {
+	if pk.Params != nil {
+		return pk.Params
+	}
+	return gabi.DefaultSystemParameters[pk.N.BitLen()]
+}
@@ -0,0 +1,101 @@
+package keyshareserver
+
+import (
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/privacybydesign/gabi/big"
+)
+
+// postgresSchema creates the table in which postgresDB stores the users, if it does not exist.
+const postgresSchema = `CREATE TABLE IF NOT EXISTS users (
+	username      TEXT PRIMARY KEY,
+	secret        BYTEA NOT NULL,
+	pin_hash      TEXT NOT NULL,
+	pin_attempts  INTEGER NOT NULL DEFAULT 0,
+	blocks        INTEGER NOT NULL DEFAULT 0,
+	blocked_until BIGINT NOT NULL DEFAULT 0,
+	email         TEXT,
+	language      TEXT NOT NULL DEFAULT ''
+)`
+
+type postgresDB struct {
+	db *sql.DB
+}
+
+// NewPostgresDB returns a DB that stores the users in the users table of the Postgres database
+// with the specified connection string, creating the table if necessary.
+func NewPostgresDB(connstr string) (DB, error) {
+	db, err := sql.Open("postgres", connstr)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if _, err = db.Exec(postgresSchema); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &postgresDB{db: db}, nil
+}
+
+func (db *postgresDB) AddUser(user *User) error {
+	_, err := db.db.Exec(
+		`INSERT INTO users (username, secret, pin_hash, pin_attempts, blocks, blocked_until, email, language)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		user.Username, user.Secret.Bytes(), user.PinHash, user.PinAttempts, user.Blocks, user.BlockedUntil,
+		user.Email, user.Language,
+	)
+	if perr, ok := err.(*pq.Error); ok && perr.Code.Name() == "unique_violation" {
+		return ErrUserExists
+	}
+	return err
+}
+
+func (db *postgresDB) User(username string) (*User, error) {
+	user := &User{Username: username}
+	var secret []byte
+	var email sql.NullString
+	err := db.db.QueryRow(
+		`SELECT secret, pin_hash, pin_attempts, blocks, blocked_until, email, language FROM users WHERE username = $1`,
+		username,
+	).Scan(&secret, &user.PinHash, &user.PinAttempts, &user.Blocks, &user.BlockedUntil, &email, &user.Language)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.Secret = new(big.Int).SetBytes(secret)
+	if email.Valid {
+		user.Email = &email.String
+	}
+	return user, nil
+}
+
+func (db *postgresDB) UpdateUser(user *User) error {
+	res, err := db.db.Exec(
+		`UPDATE users SET secret = $2, pin_hash = $3, pin_attempts = $4, blocks = $5, blocked_until = $6, email = $7, language = $8
+		 WHERE username = $1`,
+		user.Username, user.Secret.Bytes(), user.PinHash, user.PinAttempts, user.Blocks, user.BlockedUntil,
+		user.Email, user.Language,
+	)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Close closes the connection to the database.
+func (db *postgresDB) Close() error {
+	return db.db.Close()
+}
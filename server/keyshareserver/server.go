@@ -0,0 +1,521 @@
+// Package keyshareserver is the keyshare server of a distributed scheme: it holds a share of the
+// secret key of the credentials of the scheme's users, without which the IRMA app cannot use them,
+// and takes part in the IRMA sessions involving those credentials after the user has entered their
+// PIN. It implements enrollment of new users (issuing them the keyshare attribute of the scheme
+// with their username), PIN verification (blocking users after too many wrong attempts), PIN
+// changes, and the keyshare protocol that irmaclient runs with the keyshare server.
+package keyshareserver
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+)
+
+// Server is a keyshare server instance.
+type Server struct {
+	conf     *Configuration
+	irmaserv *irmaserver.Server
+
+	// Serializes the PIN checks and updates of users, so that wrong attempts are counted correctly
+	userLock sync.Mutex
+
+	// Commitments of the keyshare proofs in progress, per username
+	commitments     map[string]*keyshareCommitment
+	commitmentsLock sync.Mutex
+}
+
+// Messages of the keyshare protocol, as sent and expected by irmaclient
+
+type registration struct {
+	Pin      string  `json:"pin"`
+	Email    *string `json:"email"`
+	Language string  `json:"language"`
+}
+
+type pinMessage struct {
+	Username string `json:"id"`
+	Pin      string `json:"pin"`
+}
+
+type changePinMessage struct {
+	Username string `json:"id"`
+	OldPin   string `json:"oldpin"`
+	NewPin   string `json:"newpin"`
+}
+
+type pinStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type authorization struct {
+	Status     string   `json:"status"`
+	Candidates []string `json:"candidates"`
+}
+
+type commitmentMap struct {
+	Commitments map[string]*gabi.ProofPCommitment `json:"c"`
+}
+
+type authorizationClaims struct {
+	jwt.StandardClaims
+	Username string `json:"user_id"`
+}
+
+type proofPClaims struct {
+	jwt.StandardClaims
+	ProofP *gabi.ProofP
+}
+
+const (
+	usernameHeader = "X-IRMA-Keyshare-Username"
+
+	pinSuccess = "success"
+	pinFailure = "failure"
+	pinBlocked = "error"
+
+	authorized   = "authorized"
+	tokenExpired = "expired"
+
+	authorizationSubject = "auth_tok"
+	proofPSubject        = "ProofP"
+
+	usernameAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	usernameLength   = 12
+)
+
+// New creates a new keyshare server with the specified configuration.
+func New(conf *Configuration) (*Server, error) {
+	irmaserv, err := irmaserver.New(conf.Configuration)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.initialize(); err != nil {
+		irmaserv.Stop()
+		return nil, err
+	}
+	return &Server{
+		conf:        conf,
+		irmaserv:    irmaserv,
+		commitments: map[string]*keyshareCommitment{},
+	}, nil
+}
+
+// Stop the server.
+func (s *Server) Stop() {
+	s.irmaserv.Stop()
+	if closer, ok := s.conf.DB.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			_ = server.LogError(err)
+		}
+	}
+}
+
+// Handler returns a http.Handler that handles the keyshare protocol messages of irmaclient,
+// as well as the IRMA sessions with which users enroll under irma/.
+func (s *Server) Handler() http.Handler {
+	router := chi.NewRouter()
+
+	router.Mount("/irma/", s.irmaserv.HandlerFunc())
+
+	router.Post("/client/register", s.handleRegister)
+	router.Post("/users/verify/pin", s.handleVerifyPin)
+	router.Post("/users/change/pin", s.handleChangePin)
+	router.Post("/users/isAuthorized", s.handleIsAuthorized)
+	router.Post("/prove/getCommitments", s.handleCommitments)
+	router.Post("/prove/getResponse", s.handleResponse)
+
+	return router
+}
+
+// handleRegister creates a new user, and starts the session in which the user receives the
+// keyshare attribute containing their username.
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var msg registration
+	if !s.readMessage(w, r, &msg) {
+		return
+	}
+	if msg.Pin == "" {
+		server.WriteError(w, server.ErrorInvalidRequest, "no PIN specified")
+		return
+	}
+
+	username, err := newUsername()
+	if err != nil {
+		s.writeInternalError(w, err)
+		return
+	}
+	secret, err := gabi.RandomBigInt(gabi.DefaultSystemParameters[1024].Lm)
+	if err != nil {
+		s.writeInternalError(w, err)
+		return
+	}
+	user := &User{
+		Username: username,
+		Secret:   secret,
+		Email:    msg.Email,
+		Language: msg.Language,
+	}
+	if err = user.SetPin(msg.Pin); err != nil {
+		s.writeInternalError(w, err)
+		return
+	}
+	if err = s.conf.DB.AddUser(user); err != nil {
+		s.writeInternalError(w, err)
+		return
+	}
+
+	request := &irma.IssuanceRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing},
+		Credentials: []*irma.CredentialRequest{{
+			CredentialTypeID: s.conf.keyshareAttribute.CredentialTypeIdentifier(),
+			Attributes:       map[string]string{s.conf.keyshareAttribute.Name(): username},
+		}},
+	}
+	qr, _, err := s.irmaserv.StartSession(request, nil)
+	if err != nil {
+		s.writeInternalError(w, err)
+		return
+	}
+	s.conf.Logger.WithField("user", username).Info("Keyshare user registered")
+	server.WriteJson(w, qr)
+}
+
+func (s *Server) handleVerifyPin(w http.ResponseWriter, r *http.Request) {
+	var msg pinMessage
+	if !s.readMessage(w, r, &msg) {
+		return
+	}
+
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+	user, status, ok := s.checkPin(w, msg.Username, msg.Pin)
+	if !ok || status != nil {
+		if status != nil {
+			server.WriteJson(w, status)
+		}
+		return
+	}
+	token, err := s.authorizationToken(user)
+	if err != nil {
+		s.writeInternalError(w, err)
+		return
+	}
+	server.WriteJson(w, &pinStatus{Status: pinSuccess, Message: token})
+}
+
+func (s *Server) handleChangePin(w http.ResponseWriter, r *http.Request) {
+	var msg changePinMessage
+	if !s.readMessage(w, r, &msg) {
+		return
+	}
+	if msg.NewPin == "" {
+		server.WriteError(w, server.ErrorInvalidRequest, "no new PIN specified")
+		return
+	}
+
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+	user, status, ok := s.checkPin(w, msg.Username, msg.OldPin)
+	if !ok || status != nil {
+		if status != nil {
+			server.WriteJson(w, status)
+		}
+		return
+	}
+	if err := user.SetPin(msg.NewPin); err != nil {
+		s.writeInternalError(w, err)
+		return
+	}
+	if err := s.conf.DB.UpdateUser(user); err != nil {
+		s.writeInternalError(w, err)
+		return
+	}
+	server.WriteJson(w, &pinStatus{Status: pinSuccess})
+}
+
+// checkPin checks the specified PIN of the specified user, counting wrong attempts and blocking
+// the user if necessary, which must be done while holding userLock. If the PIN is correct the
+// user is returned; otherwise the status to send to the client. If ok is false, an error has
+// been written to the client.
+func (s *Server) checkPin(w http.ResponseWriter, username, pin string) (user *User, status *pinStatus, ok bool) {
+	user, ok = s.user(w, username)
+	if !ok {
+		return
+	}
+	if wait := user.blockedFor(); wait > 0 {
+		return nil, &pinStatus{Status: pinBlocked, Message: strconv.FormatInt(wait, 10)}, true
+	}
+
+	if user.verifyPin(pin) {
+		user.PinAttempts, user.Blocks, user.BlockedUntil = 0, 0, 0
+	} else {
+		user.PinAttempts++
+		if user.PinAttempts < s.conf.MaxPinAttempts {
+			status = &pinStatus{Status: pinFailure, Message: strconv.Itoa(s.conf.MaxPinAttempts - user.PinAttempts)}
+		} else {
+			duration := int64(s.conf.PinBlockDuration) << uint(user.Blocks)
+			user.PinAttempts = 0
+			user.Blocks++
+			user.BlockedUntil = time.Now().Unix() + duration
+			status = &pinStatus{Status: pinBlocked, Message: strconv.FormatInt(duration, 10)}
+			s.conf.Logger.WithField("user", username).Warnf("Keyshare user blocked for %d seconds", duration)
+		}
+	}
+	if err := s.conf.DB.UpdateUser(user); err != nil {
+		s.writeInternalError(w, err)
+		return nil, nil, false
+	}
+	if status != nil {
+		return nil, status, true
+	}
+	return user, nil, true
+}
+
+// handleIsAuthorized reports whether the authorization token of the user is (still) valid.
+func (s *Server) handleIsAuthorized(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.user(w, r.Header.Get(usernameHeader))
+	if !ok {
+		return
+	}
+	status := authorized
+	if s.verifyAuthorizationToken(r, user) != nil {
+		status = tokenExpired
+	}
+	server.WriteJson(w, &authorization{Status: status, Candidates: []string{"pin"}})
+}
+
+// handleCommitments generates commitments to the user's secret for the public keys specified
+// as a list of keys of the form issuer-counter, e.g. "irma-demo.MijnOverheid-2".
+func (s *Server) handleCommitments(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	var keyids []string
+	if !s.readMessage(w, r, &keyids) {
+		return
+	}
+	if len(keyids) == 0 {
+		server.WriteError(w, server.ErrorInvalidRequest, "no public keys specified")
+		return
+	}
+
+	keys := make([]*gabi.PublicKey, len(keyids))
+	for i, keyid := range keyids {
+		pk, err := s.publicKey(keyid)
+		if err != nil {
+			server.WriteResponse(w, nil, server.RemoteError(server.ErrorUnknownPublicKey, err.Error()))
+			return
+		}
+		keys[i] = pk
+	}
+	commitment, proofPCommitments, err := newKeyshareCommitment(user.Secret, keys)
+	if err != nil {
+		s.writeInternalError(w, err)
+		return
+	}
+
+	s.commitmentsLock.Lock()
+	for username, c := range s.commitments {
+		if c.expired() {
+			delete(s.commitments, username)
+		}
+	}
+	s.commitments[user.Username] = commitment
+	s.commitmentsLock.Unlock()
+
+	response := commitmentMap{Commitments: map[string]*gabi.ProofPCommitment{}}
+	for i, keyid := range keyids {
+		response.Commitments[keyid] = proofPCommitments[i]
+	}
+	server.WriteJson(w, response)
+}
+
+// handleResponse responds to the challenge of the session, completing the keyshare proof
+// of the preceding commitments. The response is sent in a JWT, which the IRMA app includes
+// in its issuance messages and which the issuer verifies (see irma.IssueCommitmentMessage).
+func (s *Server) handleResponse(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	challenge := new(big.Int)
+	if !s.readMessage(w, r, challenge) {
+		return
+	}
+
+	s.commitmentsLock.Lock()
+	commitment := s.commitments[user.Username]
+	delete(s.commitments, user.Username)
+	s.commitmentsLock.Unlock()
+	if commitment == nil || commitment.expired() {
+		server.WriteError(w, server.ErrorMissingCommitments, "")
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, proofPClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    s.conf.JwtIssuer,
+			Subject:   proofPSubject,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(commitmentValidity).Unix(),
+		},
+		ProofP: commitment.response(user.Secret, challenge),
+	})
+	token.Header["kid"] = strconv.Itoa(s.conf.JwtKeyID)
+	signed, err := token.SignedString(s.conf.jwtPrivateKey)
+	if err != nil {
+		s.writeInternalError(w, err)
+		return
+	}
+	server.WriteString(w, signed)
+}
+
+// authorize returns the user of the request, if the request contains a valid authorization
+// token of the user and the user is not blocked; otherwise it writes an error to the client.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, ok := s.user(w, r.Header.Get(usernameHeader))
+	if !ok {
+		return nil, false
+	}
+	if wait := user.blockedFor(); wait > 0 {
+		server.WriteResponse(w, nil, server.RemoteError(server.ErrorUserBlocked, strconv.FormatInt(wait, 10)))
+		return nil, false
+	}
+	if err := s.verifyAuthorizationToken(r, user); err != nil {
+		server.WriteResponse(w, nil, server.RemoteError(server.ErrorInvalidAuthorization, err.Error()))
+		return nil, false
+	}
+	return user, true
+}
+
+// authorizationToken returns a token with which the user can run the keyshare protocol
+// without entering their PIN, until it expires.
+func (s *Server) authorizationToken(user *User) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, authorizationClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    s.conf.JwtIssuer,
+			Subject:   authorizationSubject,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(time.Duration(s.conf.AuthTokenValidity) * time.Second).Unix(),
+		},
+		Username: user.Username,
+	})
+	token.Header["kid"] = strconv.Itoa(s.conf.JwtKeyID)
+	return token.SignedString(s.conf.jwtPrivateKey)
+}
+
+// verifyAuthorizationToken verifies the token in the Authorization header of the request,
+// which irmaclient sends either with or without "Bearer " prefix.
+func (s *Server) verifyAuthorizationToken(r *http.Request, user *User) error {
+	str := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	claims := &authorizationClaims{}
+	_, err := jwt.ParseWithClaims(str, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, errors.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return &s.conf.jwtPrivateKey.PublicKey, nil
+	})
+	if err != nil {
+		return err
+	}
+	if claims.Subject != authorizationSubject || claims.Username != user.Username {
+		return errors.New("authorization token is not of this user")
+	}
+	return nil
+}
+
+// publicKey returns the public key of the scheme of the keyshare server with the specified
+// identifier of the form issuer-counter.
+func (s *Server) publicKey(keyid string) (*gabi.PublicKey, error) {
+	index := strings.LastIndex(keyid, "-")
+	if index == -1 {
+		return nil, errors.Errorf("invalid public key identifier %s", keyid)
+	}
+	counter, err := strconv.Atoi(keyid[index+1:])
+	if err != nil {
+		return nil, errors.Errorf("invalid public key identifier %s", keyid)
+	}
+	issuer := irma.NewIssuerIdentifier(keyid[:index])
+	if issuer.SchemeManagerIdentifier() != s.conf.scheme {
+		return nil, errors.Errorf("public key %s is not of scheme %s", keyid, s.conf.scheme)
+	}
+	pk, err := s.conf.CurrentIrmaConfiguration().PublicKey(issuer, counter)
+	if err != nil {
+		return nil, err
+	}
+	if pk == nil {
+		return nil, errors.Errorf("unknown public key %s", keyid)
+	}
+	return pk, nil
+}
+
+// user returns the user with the specified username, or writes an error to the client.
+func (s *Server) user(w http.ResponseWriter, username string) (*User, bool) {
+	user, err := s.conf.DB.User(username)
+	if err == ErrUserNotFound {
+		server.WriteError(w, server.ErrorUserNotFound, username)
+		return nil, false
+	}
+	if err != nil {
+		s.writeInternalError(w, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// readMessage unmarshals the body of the request into the specified message,
+// or writes an error to the client.
+func (s *Server) readMessage(w http.ResponseWriter, r *http.Request, message interface{}) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return false
+	}
+	if err = json.Unmarshal(body, message); err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *Server) writeInternalError(w http.ResponseWriter, err error) {
+	_ = server.LogError(err)
+	server.WriteError(w, server.ErrorUnknown, err.Error())
+}
+
+// blockedFor returns the number of seconds for which the user is still blocked.
+func (user *User) blockedFor() int64 {
+	return user.BlockedUntil - time.Now().Unix()
+}
+
+// newUsername returns a random username.
+func newUsername() (string, error) {
+	bts := make([]byte, usernameLength)
+	if _, err := rand.Read(bts); err != nil {
+		return "", err
+	}
+	for i, b := range bts {
+		bts[i] = usernameAlphabet[int(b)%len(usernameAlphabet)]
+	}
+	return string(bts), nil
+}
@@ -0,0 +1,158 @@
+package keyshareserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	testdata := test.FindTestdataFolder(t)
+	logger := logrus.New()
+	logger.Level = logrus.ErrorLevel
+
+	db := NewMemoryDB()
+	user := &User{Username: "testusername", Secret: big.NewInt(42)}
+	require.NoError(t, user.SetPin("12345"))
+	require.NoError(t, db.AddUser(user))
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		SchemeManager:     "test",
+		DB:                db,
+		JwtPrivateKeyFile: filepath.Join(testdata, "jwtkeys", "kss-sk.pem"),
+		PinBlockDuration:  60,
+	})
+	require.NoError(t, err)
+	return s, httptest.NewServer(s.Handler())
+}
+
+func post(t *testing.T, url string, message interface{}, headers map[string]string, result interface{}) int {
+	bts, err := json.Marshal(message)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(bts))
+	require.NoError(t, err)
+	for name, val := range headers {
+		req.Header.Set(name, val)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	if result != nil {
+		require.NoError(t, json.NewDecoder(res.Body).Decode(result))
+	}
+	return res.StatusCode
+}
+
+func TestPinVerification(t *testing.T) {
+	s, ts := newTestServer(t)
+	defer s.Stop()
+	defer ts.Close()
+
+	status := &pinStatus{}
+	post(t, ts.URL+"/users/verify/pin", pinMessage{Username: "testusername", Pin: "12345"}, nil, status)
+	require.Equal(t, pinSuccess, status.Status)
+	token := status.Message
+
+	// The token authorizes the user, with or without Bearer prefix
+	auth := &authorization{}
+	headers := map[string]string{usernameHeader: "testusername", "Authorization": "Bearer " + token}
+	post(t, ts.URL+"/users/isAuthorized", nil, headers, auth)
+	require.Equal(t, authorized, auth.Status)
+	headers["Authorization"] = token
+	commitments := &commitmentMap{}
+	require.Equal(t, http.StatusOK, post(t, ts.URL+"/prove/getCommitments", []string{"test.test-3"}, headers, commitments))
+	require.Contains(t, commitments.Commitments, "test.test-3")
+
+	// Unknown users are refused
+	headers[usernameHeader] = "otheruser"
+	rerr := &struct{ Error string }{}
+	require.Equal(t, http.StatusForbidden, post(t, ts.URL+"/users/isAuthorized", nil, headers, rerr))
+	require.Equal(t, string(server.ErrorUserNotFound.Type), rerr.Error)
+
+	// Wrong PINs count down the attempts until the user is blocked, for longer each time
+	post(t, ts.URL+"/users/verify/pin", pinMessage{Username: "testusername", Pin: "00000"}, nil, status)
+	require.Equal(t, pinStatus{Status: pinFailure, Message: "2"}, *status)
+	post(t, ts.URL+"/users/verify/pin", pinMessage{Username: "testusername", Pin: "00000"}, nil, status)
+	require.Equal(t, pinStatus{Status: pinFailure, Message: "1"}, *status)
+	post(t, ts.URL+"/users/verify/pin", pinMessage{Username: "testusername", Pin: "00000"}, nil, status)
+	require.Equal(t, pinStatus{Status: pinBlocked, Message: "60"}, *status)
+
+	// While blocked, even the correct PIN is refused, as are the keyshare protocol messages
+	post(t, ts.URL+"/users/verify/pin", pinMessage{Username: "testusername", Pin: "12345"}, nil, status)
+	require.Equal(t, pinBlocked, status.Status)
+	headers[usernameHeader] = "testusername"
+	require.Equal(t, http.StatusForbidden, post(t, ts.URL+"/prove/getCommitments", []string{"test.test-3"}, headers, rerr))
+	require.Equal(t, string(server.ErrorUserBlocked.Type), rerr.Error)
+
+	user, err := s.conf.DB.User("testusername")
+	require.NoError(t, err)
+	user.BlockedUntil = 0
+	require.NoError(t, s.conf.DB.UpdateUser(user))
+	for i := 0; i < 3; i++ {
+		post(t, ts.URL+"/users/verify/pin", pinMessage{Username: "testusername", Pin: "00000"}, nil, status)
+	}
+	require.Equal(t, pinStatus{Status: pinBlocked, Message: "120"}, *status)
+}
+
+func TestChangePin(t *testing.T) {
+	s, ts := newTestServer(t)
+	defer s.Stop()
+	defer ts.Close()
+
+	status := &pinStatus{}
+	msg := changePinMessage{Username: "testusername", OldPin: "00000", NewPin: "54321"}
+	post(t, ts.URL+"/users/change/pin", msg, nil, status)
+	require.Equal(t, pinFailure, status.Status)
+
+	msg.OldPin = "12345"
+	post(t, ts.URL+"/users/change/pin", msg, nil, status)
+	require.Equal(t, pinSuccess, status.Status)
+	post(t, ts.URL+"/users/verify/pin", pinMessage{Username: "testusername", Pin: "54321"}, nil, status)
+	require.Equal(t, pinSuccess, status.Status)
+
+	// Only a salted hash of the PIN is stored, which does not itself authenticate the user
+	user, err := s.conf.DB.User("testusername")
+	require.NoError(t, err)
+	require.NotContains(t, user.PinHash, "54321")
+	post(t, ts.URL+"/users/verify/pin", pinMessage{Username: "testusername", Pin: user.PinHash}, nil, status)
+	require.Equal(t, pinFailure, status.Status)
+}
+
+func TestKeyshareResponse(t *testing.T) {
+	secret := big.NewInt(42)
+	s, ts := newTestServer(t)
+	defer s.Stop()
+	defer ts.Close()
+
+	pk, err := s.publicKey("test.test-3")
+	require.NoError(t, err)
+	_, err = s.publicKey("irma-demo.RU-2")
+	require.Error(t, err)
+
+	commitment, commitments, err := newKeyshareCommitment(secret, []*gabi.PublicKey{pk})
+	require.NoError(t, err)
+	challenge := big.NewInt(12345)
+	proofP := commitment.response(secret, challenge)
+
+	// R_0^response == Pcommit * P^challenge, i.e. the proof verifies
+	lhs := new(big.Int).Exp(pk.R[0], proofP.SResponse, pk.N)
+	rhs := new(big.Int).Exp(proofP.P, challenge, pk.N)
+	rhs.Mul(rhs, commitments[0].Pcommit).Mod(rhs, pk.N)
+	require.Equal(t, 0, lhs.Cmp(rhs))
+	require.Equal(t, 0, proofP.P.Cmp(commitments[0].P))
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// MinimizationRules are rules flagging disclosure requests that ask for more attributes than
+// needed, read from a JSON file by ReadMinimizationRules(). For example, the following rules flag
+// requests asking for both the birthdate and the over18 attribute, and requests of requestors
+// whose purpose is age verification that ask for attributes of the ageLimits credential other
+// than over18:
+//
+//	{
+//		"rules": [{
+//			"name": "birthdate-and-over18",
+//			"attributes": ["pbdf.gemeente.personalData.dateofbirth", "pbdf.gemeente.ageLimits.over18"],
+//			"message": "over18 suffices to verify age, the birthdate need not be requested"
+//		}],
+//		"purposes": {
+//			"age-verification": [{
+//				"credential": "pbdf.gemeente.ageLimits",
+//				"sufficient": ["pbdf.gemeente.ageLimits.over18"]
+//			}]
+//		}
+//	}
+//
+// Flagged requests are not refused by the rules themselves; see Analyze().
+type MinimizationRules struct {
+	Rules []MinimizationRule `json:"rules"`
+	// Purpose profiles, listing per purpose which attributes suffice of credential types
+	Purposes map[string][]PurposeProfile `json:"purposes"`
+}
+
+// MinimizationRule flags requests asking for all of its attributes, in distinct disjunctions so
+// that the user may have to disclose all of them at once.
+type MinimizationRule struct {
+	Name       string                         `json:"name"`
+	Attributes []irma.AttributeTypeIdentifier `json:"attributes"`
+	// Explanation of the rule, included in its hints
+	Message string `json:"message"`
+}
+
+// PurposeProfile specifies which attributes of a credential type suffice for a purpose. Requests
+// made for the purpose that ask for other attributes of the credential type, or for the entire
+// credential, are flagged.
+type PurposeProfile struct {
+	Credential irma.CredentialTypeIdentifier  `json:"credential"`
+	Sufficient []irma.AttributeTypeIdentifier `json:"sufficient"`
+}
+
+// MinimizationHint describes why a request was flagged by MinimizationRules.
+type MinimizationHint struct {
+	// Name of the rule, or purpose of the purpose profile, that flagged the request
+	Rule string `json:"rule"`
+	// Attributes of the request that were flagged
+	Attributes []irma.AttributeTypeIdentifier `json:"attributes"`
+	Message    string                         `json:"message"`
+}
+
+// ReadMinimizationRules reads MinimizationRules from the specified JSON file.
+func ReadMinimizationRules(path string) (*MinimizationRules, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to read minimization rules", 0)
+	}
+	rules := &MinimizationRules{}
+	if err = json.Unmarshal(bts, rules); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse minimization rules", 0)
+	}
+	if err = rules.validate(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (rules *MinimizationRules) validate() error {
+	for i, rule := range rules.Rules {
+		if rule.Name == "" {
+			return errors.Errorf("Minimization rule %d has no name", i)
+		}
+		if len(rule.Attributes) < 2 {
+			return errors.Errorf("Minimization rule %s must have at least two attributes", rule.Name)
+		}
+	}
+	for purpose, profiles := range rules.Purposes {
+		for _, profile := range profiles {
+			for _, id := range profile.Sufficient {
+				if id.CredentialTypeIdentifier() != profile.Credential {
+					return errors.Errorf("Attribute %s of purpose %s is not of credential type %s",
+						id, purpose, profile.Credential)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Analyze returns hints for each of the rules, and for each purpose profile of the specified
+// purpose (if not empty), that flags the specified disjunctions of a request.
+func (rules *MinimizationRules) Analyze(disjunctions irma.AttributeDisjunctionList, purpose string) []*MinimizationHint {
+	var hints []*MinimizationHint
+	for _, rule := range rules.Rules {
+		if requestedTogether(disjunctions, rule.Attributes) {
+			hints = append(hints, &MinimizationHint{
+				Rule:       rule.Name,
+				Attributes: rule.Attributes,
+				Message:    rule.Message,
+			})
+		}
+	}
+	if purpose == "" {
+		return hints
+	}
+	for _, profile := range rules.Purposes[purpose] {
+		if excess := profile.excess(disjunctions); len(excess) > 0 {
+			hints = append(hints, &MinimizationHint{
+				Rule:       purpose,
+				Attributes: excess,
+				Message: fmt.Sprintf("of %s, only %s suffice for %s",
+					profile.Credential, joinIdentifiers(profile.Sufficient), purpose),
+			})
+		}
+	}
+	return hints
+}
+
+// excess returns the attributes of the credential type of the profile that the disjunctions
+// request but that do not suffice for its purpose, including the wildcard of the credential type
+// if the disjunctions request the entire credential.
+func (profile PurposeProfile) excess(disjunctions irma.AttributeDisjunctionList) []irma.AttributeTypeIdentifier {
+	var excess []irma.AttributeTypeIdentifier
+	seen := map[irma.AttributeTypeIdentifier]bool{}
+	for _, disjunction := range disjunctions {
+		for _, id := range disjunction.Attributes {
+			if seen[id] || id.CredentialTypeIdentifier() != profile.Credential || profile.sufficient(id) {
+				continue
+			}
+			seen[id] = true
+			excess = append(excess, id)
+		}
+	}
+	return excess
+}
+
+func (profile PurposeProfile) sufficient(id irma.AttributeTypeIdentifier) bool {
+	for _, attr := range profile.Sufficient {
+		if attr == id {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedTogether returns whether each of the attributes is requested by a distinct disjunction,
+// either by itself or by the wildcard of its credential type, so that the user may have to
+// disclose all of them. Attributes that are merely alternatives within one disjunction are not.
+func requestedTogether(disjunctions irma.AttributeDisjunctionList, attrs []irma.AttributeTypeIdentifier) bool {
+	used := make([]bool, len(disjunctions))
+	var assign func(i int) bool
+	assign = func(i int) bool {
+		if i == len(attrs) {
+			return true
+		}
+		for j, disjunction := range disjunctions {
+			if used[j] || !disjunctionRequests(disjunction, attrs[i]) {
+				continue
+			}
+			used[j] = true
+			if assign(i + 1) {
+				return true
+			}
+			used[j] = false
+		}
+		return false
+	}
+	return assign(0)
+}
+
+func disjunctionRequests(disjunction *irma.AttributeDisjunction, id irma.AttributeTypeIdentifier) bool {
+	wildcard := id.CredentialTypeIdentifier().Wildcard()
+	for _, attr := range disjunction.Attributes {
+		if attr == id || attr == wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+func joinIdentifiers(ids []irma.AttributeTypeIdentifier) string {
+	strs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		strs = append(strs, id.Name())
+	}
+	return strings.Join(strs, ", ")
+}
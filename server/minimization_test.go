@@ -0,0 +1,132 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+const testMinimizationRules = `{
+	"rules": [{
+		"name": "birthdate-and-over18",
+		"attributes": ["pbdf.gemeente.personalData.dateofbirth", "pbdf.gemeente.ageLimits.over18"],
+		"message": "over18 suffices to verify age"
+	}, {
+		"name": "bsn-and-fullname",
+		"attributes": ["pbdf.gemeente.personalData.bsn", "pbdf.gemeente.personalData.fullname"],
+		"message": "the BSN identifies the user"
+	}],
+	"purposes": {
+		"age-verification": [{
+			"credential": "pbdf.gemeente.ageLimits",
+			"sufficient": ["pbdf.gemeente.ageLimits.over18"]
+		}]
+	}
+}`
+
+func readTestMinimizationRules(t *testing.T, rules string) (*MinimizationRules, error) {
+	dir, err := ioutil.TempDir("", "minimization")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(rules), 0600))
+	return ReadMinimizationRules(path)
+}
+
+func testDisjunctions(attrs ...[]string) irma.AttributeDisjunctionList {
+	list := irma.AttributeDisjunctionList{}
+	for _, ids := range attrs {
+		disjunction := &irma.AttributeDisjunction{Label: "foo"}
+		for _, id := range ids {
+			disjunction.Attributes = append(disjunction.Attributes, irma.NewAttributeTypeIdentifier(id))
+		}
+		list = append(list, disjunction)
+	}
+	return list
+}
+
+func hintRules(hints []*MinimizationHint) []string {
+	var rules []string
+	for _, hint := range hints {
+		rules = append(rules, hint.Rule)
+	}
+	return rules
+}
+
+func TestMinimizationRules(t *testing.T) {
+	rules, err := readTestMinimizationRules(t, testMinimizationRules)
+	require.NoError(t, err)
+
+	// Requesting both the birthdate and over18 is flagged
+	hints := rules.Analyze(testDisjunctions(
+		[]string{"pbdf.gemeente.personalData.dateofbirth"},
+		[]string{"pbdf.gemeente.ageLimits.over18"},
+	), "")
+	require.Equal(t, []string{"birthdate-and-over18"}, hintRules(hints))
+	require.Equal(t, "over18 suffices to verify age", hints[0].Message)
+
+	// Also when the birthdate is requested as part of the entire credential
+	hints = rules.Analyze(testDisjunctions(
+		[]string{"pbdf.gemeente.personalData.*"},
+		[]string{"pbdf.gemeente.ageLimits.over18"},
+	), "")
+	require.Equal(t, []string{"birthdate-and-over18"}, hintRules(hints))
+
+	// Attributes that are alternatives of each other are not flagged, as only one is disclosed
+	hints = rules.Analyze(testDisjunctions(
+		[]string{"pbdf.gemeente.personalData.dateofbirth", "pbdf.gemeente.ageLimits.over18"},
+	), "")
+	require.Empty(t, hints)
+
+	// Unless they are also requested in distinct disjunctions
+	hints = rules.Analyze(testDisjunctions(
+		[]string{"pbdf.gemeente.personalData.dateofbirth", "pbdf.gemeente.ageLimits.over18"},
+		[]string{"pbdf.gemeente.personalData.dateofbirth"},
+	), "")
+	require.Equal(t, []string{"birthdate-and-over18"}, hintRules(hints))
+
+	// Several rules may flag the same request
+	hints = rules.Analyze(testDisjunctions(
+		[]string{"pbdf.gemeente.personalData.bsn"},
+		[]string{"pbdf.gemeente.personalData.fullname"},
+		[]string{"pbdf.gemeente.personalData.dateofbirth"},
+		[]string{"pbdf.gemeente.ageLimits.over18"},
+	), "")
+	require.Equal(t, []string{"birthdate-and-over18", "bsn-and-fullname"}, hintRules(hints))
+	require.Empty(t, rules.Analyze(testDisjunctions([]string{"pbdf.gemeente.personalData.bsn"}), ""))
+}
+
+func TestMinimizationPurposeProfiles(t *testing.T) {
+	rules, err := readTestMinimizationRules(t, testMinimizationRules)
+	require.NoError(t, err)
+
+	// Requesting the entire credential, or other attributes than those that suffice, is flagged
+	hints := rules.Analyze(testDisjunctions([]string{"pbdf.gemeente.ageLimits.*"}), "age-verification")
+	require.Equal(t, []string{"age-verification"}, hintRules(hints))
+	require.Equal(t, []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.gemeente.ageLimits.*")}, hints[0].Attributes)
+	hints = rules.Analyze(testDisjunctions(
+		[]string{"pbdf.gemeente.ageLimits.over18"},
+		[]string{"pbdf.gemeente.ageLimits.over65"},
+	), "age-verification")
+	require.Equal(t, []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.gemeente.ageLimits.over65")}, hints[0].Attributes)
+
+	// Requesting only what suffices is not, nor are requests made for other purposes
+	require.Empty(t, rules.Analyze(testDisjunctions([]string{"pbdf.gemeente.ageLimits.over18"}), "age-verification"))
+	require.Empty(t, rules.Analyze(testDisjunctions([]string{"pbdf.gemeente.ageLimits.*"}), "other"))
+	require.Empty(t, rules.Analyze(testDisjunctions([]string{"pbdf.gemeente.ageLimits.*"}), ""))
+}
+
+func TestInvalidMinimizationRules(t *testing.T) {
+	_, err := readTestMinimizationRules(t, `{"rules": [{"attributes": ["a.b.c.d", "a.b.c.e"]}]}`)
+	require.Error(t, err)
+	_, err = readTestMinimizationRules(t, `{"rules": [{"name": "single", "attributes": ["a.b.c.d"]}]}`)
+	require.Error(t, err)
+	_, err = readTestMinimizationRules(t, `{"purposes": {"p": [{"credential": "a.b.c", "sufficient": ["a.b.other.d"]}]}}`)
+	require.Error(t, err)
+	_, err = readTestMinimizationRules(t, `{"rules": {}}`)
+	require.Error(t, err)
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the private key inventory of the server, consisting of the issuer private
+// keys in IssuerPrivateKeysPath and in IssuerPrivateKeys. Of the keys of an issuer in the inventory,
+// the server issues using the one with the highest counter whose public key is present in the
+// scheme and has not expired. Private keys without corresponding public key are ignored with a
+// warning; they become usable when a scheme update adds their public key.
+
+// privateKeyFilename matches the filenames of private keys in IssuerPrivateKeysPath:
+// scheme.issuer.xml, or scheme.issuer.counter.xml.
+var privateKeyFilename = regexp.MustCompile(`^([^.]+\.[^.]+)(?:\.(\d+))?\.xml$`)
+
+// PrivateKeyInfo describes a private key in the private key inventory.
+type PrivateKeyInfo struct {
+	Issuer  irma.IssuerIdentifier `json:"issuer"`
+	Counter uint                  `json:"counter"`
+	// File from which the key was loaded; empty for keys from IssuerPrivateKeys
+	File string `json:"file,omitempty"`
+	// Whether the scheme contains the corresponding public key and it has not expired
+	Usable bool `json:"usable"`
+}
+
+type privateKey struct {
+	sk   *gabi.PrivateKey
+	file string
+}
+
+// LoadPrivateKeys (re)loads the private key inventory from IssuerPrivateKeysPath and IssuerPrivateKeys.
+// It can be called again at runtime to pick up changes in IssuerPrivateKeysPath without restarting;
+// if it returns an error, the previously loaded inventory remains in use.
+func (conf *Configuration) LoadPrivateKeys() error {
+	keys := map[irma.IssuerIdentifier]map[uint]*privateKey{}
+	add := func(id irma.IssuerIdentifier, key *privateKey) error {
+		if keys[id] == nil {
+			keys[id] = map[uint]*privateKey{}
+		}
+		if _, ok := keys[id][key.sk.Counter]; ok {
+			return errors.Errorf("Private key %s-%d specified more than once", id.String(), key.sk.Counter)
+		}
+		keys[id][key.sk.Counter] = key
+		return nil
+	}
+
+	for id, sk := range conf.IssuerPrivateKeys {
+		if err := add(id, &privateKey{sk: sk}); err != nil {
+			return err
+		}
+	}
+	if conf.IssuerPrivateKeysPath != "" {
+		files, err := ioutil.ReadDir(conf.IssuerPrivateKeysPath)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			filename := file.Name()
+			if file.IsDir() || strings.HasPrefix(filename, ".") {
+				continue
+			}
+			match := privateKeyFilename.FindStringSubmatch(filename)
+			if match == nil {
+				return errors.Errorf("Private key filename %s is not of the form scheme.issuer.xml or scheme.issuer.counter.xml", filename)
+			}
+			path := filepath.Join(conf.IssuerPrivateKeysPath, filename)
+			sk, err := gabi.NewPrivateKeyFromFile(path)
+			if err != nil {
+				return err
+			}
+			if match[2] != "" {
+				if counter, err := strconv.ParseUint(match[2], 10, 32); err != nil || uint(counter) != sk.Counter {
+					return errors.Errorf("Private key %s has wrong <Counter>", filename)
+				}
+			}
+			if err = add(irma.NewIssuerIdentifier(match[1]), &privateKey{sk: sk, file: path}); err != nil {
+				return err
+			}
+		}
+	}
+
+	irmaconf := conf.CurrentIrmaConfiguration()
+	for id, issuerkeys := range keys {
+		for counter, key := range issuerkeys {
+			pk, err := irmaconf.PublicKey(id, int(counter))
+			if err != nil {
+				return err
+			}
+			if pk == nil {
+				Logger.Warnf("Private key %s-%d has no corresponding public key, ignoring it", id.String(), counter)
+				continue
+			}
+			if new(big.Int).Mul(key.sk.P, key.sk.Q).Cmp(pk.N) != 0 {
+				return errors.Errorf("Private key %s-%d does not belong to corresponding public key", id.String(), counter)
+			}
+		}
+	}
+
+	conf.privateKeysLock.Lock()
+	defer conf.privateKeysLock.Unlock()
+	conf.privateKeys = keys
+	return nil
+}
+
+// PrivateKeys lists the keys in the private key inventory, sorted by issuer and counter.
+func (conf *Configuration) PrivateKeys() ([]PrivateKeyInfo, error) {
+	conf.privateKeysLock.RLock()
+	defer conf.privateKeysLock.RUnlock()
+
+	var infos []PrivateKeyInfo
+	for id, issuerkeys := range conf.privateKeys {
+		for counter, key := range issuerkeys {
+			usable, err := conf.usablePrivateKey(id, key.sk)
+			if err != nil {
+				return nil, err
+			}
+			infos = append(infos, PrivateKeyInfo{Issuer: id, Counter: counter, File: key.file, Usable: usable})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Issuer != infos[j].Issuer {
+			return infos[i].Issuer.String() < infos[j].Issuer.String()
+		}
+		return infos[i].Counter < infos[j].Counter
+	})
+	return infos, nil
+}
+
+// PrivateKey returns the private key with which to issue credentials of the specified issuer:
+// the usable key with the highest counter in the private key inventory, or nil if there is none.
+// If the inventory contains no keys at all of the issuer, the latest private key in the scheme
+// is returned, if present and usable.
+func (conf *Configuration) PrivateKey(id irma.IssuerIdentifier) (*gabi.PrivateKey, error) {
+	sks, err := conf.usablePrivateKeys(id)
+	if err != nil || len(sks) == 0 {
+		return nil, err
+	}
+	return sks[len(sks)-1], nil
+}
+
+// PrivateKeyByCounter returns the usable private key of the specified issuer having the specified
+// counter, or nil if there is none.
+func (conf *Configuration) PrivateKeyByCounter(id irma.IssuerIdentifier, counter uint) (*gabi.PrivateKey, error) {
+	sks, err := conf.usablePrivateKeys(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, sk := range sks {
+		if sk.Counter == counter {
+			return sk, nil
+		}
+	}
+	return nil, nil
+}
+
+// usablePrivateKeys returns the usable private keys of the specified issuer, sorted by counter.
+func (conf *Configuration) usablePrivateKeys(id irma.IssuerIdentifier) ([]*gabi.PrivateKey, error) {
+	conf.privateKeysLock.RLock()
+	defer conf.privateKeysLock.RUnlock()
+
+	var candidates []*gabi.PrivateKey
+	if issuerkeys := conf.privateKeys[id]; len(issuerkeys) > 0 {
+		for _, key := range issuerkeys {
+			candidates = append(candidates, key.sk)
+		}
+	} else {
+		sk, err := conf.CurrentIrmaConfiguration().PrivateKey(id)
+		if err != nil {
+			return nil, err
+		}
+		if sk != nil {
+			candidates = append(candidates, sk)
+		}
+	}
+
+	var sks []*gabi.PrivateKey
+	for _, sk := range candidates {
+		usable, err := conf.usablePrivateKey(id, sk)
+		if err != nil {
+			return nil, err
+		}
+		if usable {
+			sks = append(sks, sk)
+		}
+	}
+	sort.Slice(sks, func(i, j int) bool {
+		return sks[i].Counter < sks[j].Counter
+	})
+	return sks, nil
+}
+
+// usablePrivateKey returns whether the scheme contains the public key belonging to the specified
+// private key, and whether it has not expired.
+func (conf *Configuration) usablePrivateKey(id irma.IssuerIdentifier, sk *gabi.PrivateKey) (bool, error) {
+	pk, err := conf.CurrentIrmaConfiguration().PublicKey(id, int(sk.Counter))
+	if err != nil || pk == nil {
+		return false, err
+	}
+	return pk.ExpiryDate > time.Now().Unix() && new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) == 0, nil
+}
+
+// IssuableCredentialType describes a credential type, and whether the server can currently issue it.
+type IssuableCredentialType struct {
+	ID   irma.CredentialTypeIdentifier `json:"id"`
+	Name irma.TranslatedString         `json:"name"`
+	// Whether the credential type is not deprecated and a usable private key of its issuer is installed
+	Issuable bool `json:"issuable"`
+	// Time from which on the credential type can no longer be issued, if any
+	DeprecatedSince *irma.Timestamp `json:"deprecatedSince,omitempty"`
+	// Counters of the usable private keys of the issuer, the highest of which is used
+	KeyCounters []uint              `json:"keyCounters"`
+	Attributes  []IssuableAttribute `json:"attributes"`
+	// Requestor permissions of which a requestor needs one to issue the credential type
+	Permissions []string `json:"permissions"`
+}
+
+// IssuableAttribute describes an attribute of an IssuableCredentialType.
+type IssuableAttribute struct {
+	ID       irma.AttributeTypeIdentifier `json:"id"`
+	Name     irma.TranslatedString        `json:"name"`
+	Optional bool                         `json:"optional,omitempty"`
+}
+
+// IssuableCredentialTypes lists all credential types in the schemes, sorted by identifier, along
+// with whether they can currently be issued. As it is computed from the current private key
+// inventory and schemes, the result reflects reloads and scheme updates.
+func (conf *Configuration) IssuableCredentialTypes() ([]*IssuableCredentialType, error) {
+	irmaconf := conf.CurrentIrmaConfiguration()
+	counters := map[irma.IssuerIdentifier][]uint{}
+	for id := range irmaconf.Issuers {
+		sks, err := conf.usablePrivateKeys(id)
+		if err != nil {
+			return nil, err
+		}
+		counters[id] = []uint{}
+		for _, sk := range sks {
+			counters[id] = append(counters[id], sk.Counter)
+		}
+	}
+
+	now := irma.Timestamp(time.Now())
+	var types []*IssuableCredentialType
+	for id, credtype := range irmaconf.CredentialTypes {
+		issuer := id.IssuerIdentifier()
+		typ := &IssuableCredentialType{
+			ID:              id,
+			Name:            credtype.Name,
+			Issuable:        len(counters[issuer]) > 0 && !credtype.IsDeprecatedAt(now),
+			DeprecatedSince: credtype.DeprecatedSince,
+			KeyCounters:     counters[issuer],
+			Attributes:      make([]IssuableAttribute, 0, len(credtype.AttributeTypes)),
+			Permissions:     []string{"*", id.Root() + ".*", issuer.String() + ".*", id.String()},
+		}
+		for _, attr := range credtype.AttributeTypes {
+			typ.Attributes = append(typ.Attributes, IssuableAttribute{
+				ID:       attr.GetAttributeTypeIdentifier(),
+				Name:     attr.Name,
+				Optional: attr.IsOptional(),
+			})
+		}
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].ID.String() < types[j].ID.String()
+	})
+	return types, nil
+}
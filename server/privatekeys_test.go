@@ -0,0 +1,139 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrivateKeyInventory(t *testing.T) {
+	testdata := test.FindTestdataFolder(t)
+	irmaconf, err := irma.NewConfigurationReadOnly(filepath.Join(testdata, "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, irmaconf.ParseFolder())
+
+	dir, err := ioutil.TempDir("", "privatekeys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	copyKey := func(from, to string, replace ...string) {
+		bts, err := ioutil.ReadFile(filepath.Join(testdata, from))
+		require.NoError(t, err)
+		if len(replace) > 0 {
+			bts = []byte(strings.Replace(string(bts), replace[0], replace[1], 1))
+		}
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, to), bts, 0600))
+	}
+	mijnoverheid := "irma_configuration/irma-demo/MijnOverheid/PrivateKeys"
+	copyKey(filepath.Join(mijnoverheid, "1.xml"), "irma-demo.MijnOverheid.1.xml")
+	copyKey(filepath.Join(mijnoverheid, "2.xml"), "irma-demo.MijnOverheid.2.xml") // public key has expired
+	copyKey(filepath.Join(mijnoverheid, "1.xml"), "irma-demo.MijnOverheid.7.xml", // no public key
+		"<Counter>1</Counter>", "<Counter>7</Counter>")
+	copyKey("privatekeys/irma-demo.RU.xml", "irma-demo.RU.xml") // counter 2
+	copyKey("irma_configuration/irma-demo/RU/PrivateKeys/1.xml", "irma-demo.RU.1.xml")
+
+	conf := &Configuration{IrmaConfiguration: irmaconf, IssuerPrivateKeysPath: dir}
+	require.NoError(t, conf.LoadPrivateKeys())
+
+	mo := irma.NewIssuerIdentifier("irma-demo.MijnOverheid")
+	ru := irma.NewIssuerIdentifier("irma-demo.RU")
+	infos, err := conf.PrivateKeys()
+	require.NoError(t, err)
+	require.Equal(t, []PrivateKeyInfo{
+		{Issuer: mo, Counter: 1, File: filepath.Join(dir, "irma-demo.MijnOverheid.1.xml"), Usable: true},
+		{Issuer: mo, Counter: 2, File: filepath.Join(dir, "irma-demo.MijnOverheid.2.xml"), Usable: false},
+		{Issuer: mo, Counter: 7, File: filepath.Join(dir, "irma-demo.MijnOverheid.7.xml"), Usable: false},
+		{Issuer: ru, Counter: 1, File: filepath.Join(dir, "irma-demo.RU.1.xml"), Usable: false},
+		{Issuer: ru, Counter: 2, File: filepath.Join(dir, "irma-demo.RU.xml"), Usable: true},
+	}, infos)
+
+	sk, err := conf.PrivateKey(mo)
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+	require.Equal(t, uint(1), sk.Counter)
+	sk, err = conf.PrivateKey(ru)
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+	require.Equal(t, uint(2), sk.Counter)
+
+	// Issuers without keys in the inventory fall back to the latest private key in the scheme,
+	// which for test.test has expired
+	sk, err = conf.PrivateKey(irma.NewIssuerIdentifier("test.test"))
+	require.NoError(t, err)
+	require.Nil(t, sk)
+
+	// A counter in the filename must match the key; the previous inventory remains in use if not
+	copyKey("privatekeys/irma-demo.RU.xml", "irma-demo.RU.3.xml")
+	require.Error(t, conf.LoadPrivateKeys())
+	sk, err = conf.PrivateKey(mo)
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+	require.NoError(t, os.Remove(filepath.Join(dir, "irma-demo.RU.3.xml")))
+
+	// Reload after removing the only usable key of MijnOverheid
+	require.NoError(t, os.Remove(filepath.Join(dir, "irma-demo.MijnOverheid.1.xml")))
+	require.NoError(t, conf.LoadPrivateKeys())
+	sk, err = conf.PrivateKey(mo)
+	require.NoError(t, err)
+	require.Nil(t, sk)
+	have, err := conf.HavePrivateKeys()
+	require.NoError(t, err)
+	require.True(t, have)
+}
+
+func TestIssuableCredentialTypes(t *testing.T) {
+	testdata := test.FindTestdataFolder(t)
+	irmaconf, err := irma.NewConfigurationReadOnly(filepath.Join(testdata, "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, irmaconf.ParseFolder())
+	dir, err := ioutil.TempDir("", "privatekeys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := &Configuration{IrmaConfiguration: irmaconf, IssuerPrivateKeysPath: dir}
+	require.NoError(t, conf.LoadPrivateKeys())
+	id := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+	find := func() *IssuableCredentialType {
+		types, err := conf.IssuableCredentialTypes()
+		require.NoError(t, err)
+		require.Len(t, types, len(irmaconf.CredentialTypes))
+		for _, typ := range types {
+			if typ.ID == id {
+				return typ
+			}
+		}
+		require.FailNow(t, "credential type not listed")
+		return nil
+	}
+
+	// The latest private key of MijnOverheid in the scheme belongs to an expired public key
+	typ := find()
+	require.False(t, typ.Issuable)
+	require.Empty(t, typ.KeyCounters)
+	require.Equal(t, []string{"*", "irma-demo.*", "irma-demo.MijnOverheid.*", "irma-demo.MijnOverheid.fullName"}, typ.Permissions)
+	require.Len(t, typ.Attributes, len(irmaconf.CredentialTypes[id].AttributeTypes))
+	require.Equal(t, irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstnames"), typ.Attributes[0].ID)
+	require.NotEmpty(t, typ.Attributes[0].Name["en"])
+
+	bts, err := ioutil.ReadFile(filepath.Join(testdata, "privatekeys", "irma-demo.MijnOverheid.xml"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "irma-demo.MijnOverheid.xml"), bts, 0600))
+	require.NoError(t, conf.LoadPrivateKeys())
+
+	typ = find()
+	require.True(t, typ.Issuable)
+	require.Equal(t, []uint{1}, typ.KeyCounters)
+
+	// Deprecated credential types are not issuable
+	deprecated := irma.Timestamp(time.Now().Add(-time.Hour))
+	irmaconf.CredentialTypes[id].DeprecatedSince = &deprecated
+	typ = find()
+	require.False(t, typ.Issuable)
+	require.Equal(t, &deprecated, typ.DeprecatedSince)
+}
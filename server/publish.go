@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/go-errors/errors"
+)
+
+// ResultPublisher publishes the results of finished sessions, e.g. to a message broker.
+// The IRMA server calls Publish() for each session that reaches a finished status (see
+// Status.Finished()), with the session result at that moment. Delivery is managed by the server:
+//
+//   - Results are published one at a time, in the order in which their sessions finished. As each
+//     session has a single result, for each session token there is at most one result in transit.
+//   - Delivery is at least once: if Publish() returns an error the result is published again after
+//     a delay, until it succeeds or Configuration.ResultPublishAttempts attempts have failed. If
+//     Publish() fails after delivering the result, it is delivered again, so consumers must handle
+//     duplicates, e.g. by the session token.
+//   - Results that are not yet published when the server is stopped are lost. The context passed
+//     to Publish() is cancelled when the server stops.
+type ResultPublisher interface {
+	Publish(ctx context.Context, result *SessionResult) error
+}
+
+// WebhookPublisher is a ResultPublisher that POSTs session results as JSON to a URL, which must
+// respond with a 2xx status. Unlike the callback URLs of requestors, which receive result JWTs
+// signed by the requestor server, the results are unsigned.
+type WebhookPublisher struct {
+	URL string
+	// HTTP client with which results are posted; http.DefaultClient if nil
+	Client *http.Client
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, result *SessionResult) error {
+	bts, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(bts))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf("%s returned status %d", p.URL, res.StatusCode)
+	}
+	return nil
+}
+
+// FilePublisher is a ResultPublisher that appends session results to a file, as JSON lines.
+type FilePublisher struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+func (p *FilePublisher) Publish(ctx context.Context, result *SessionResult) error {
+	bts, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f, err := os.OpenFile(p.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(bts, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilePublisher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publish")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	publisher := &FilePublisher{Path: filepath.Join(dir, "results.jsonl")}
+
+	results := []*SessionResult{
+		{Token: "token1", Status: StatusDone, Type: irma.ActionDisclosing, ProofStatus: irma.ProofStatusValid},
+		{Token: "token2", Status: StatusCancelled, Type: irma.ActionSigning},
+	}
+	for _, result := range results {
+		require.NoError(t, publisher.Publish(context.Background(), result))
+	}
+
+	f, err := os.Open(publisher.Path)
+	require.NoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var read []*SessionResult
+	for scanner.Scan() {
+		result := &SessionResult{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), result))
+		read = append(read, result)
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, results, read)
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	var received []*SessionResult
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := &SessionResult{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(result))
+		received = append(received, result)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	publisher := &WebhookPublisher{URL: ts.URL}
+	result := &SessionResult{Token: "token", Status: StatusDone, Type: irma.ActionDisclosing}
+	require.NoError(t, publisher.Publish(context.Background(), result))
+	require.Equal(t, []*SessionResult{result}, received)
+
+	// Non-2xx responses are failures, so that the result is published again
+	status = http.StatusServiceUnavailable
+	require.Error(t, publisher.Publish(context.Background(), result))
+
+	// Cancelled contexts abort publishing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, publisher.Publish(ctx, result))
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"rsc.io/qr"
+)
+
+// QrLevel is the error correction level of the QR codes rendered by QrPNG() and QrSVG(). Level M
+// allows up to 15% of the QR code to be damaged, which suffices for scanning from screens, while
+// keeping the QR code small enough to scan easily.
+const QrLevel = qr.M
+
+// qrQuietZone is the width in modules of the white border around the QR code, as required by the QR specification.
+const qrQuietZone = 4
+
+// QrPNG renders the session pointer returned by StartSession() as a QR code in a PNG image of
+// size by size pixels. The QR code contains the JSON representation of the session pointer, or
+// if compact is true its compact form (see irma.Qr.CompactLink()).
+// The output is deterministic: the same session pointer and size always render the same image.
+func QrPNG(sessionptr *irma.Qr, compact bool, size int) ([]byte, error) {
+	code, scale, offset, err := encodeQr(sessionptr, compact, size)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.White, image.ZP, draw.Src)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if !code.Black(x, y) {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray(offset+x*scale+dx, offset+y*scale+dy, color.Gray{Y: 0})
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// QrSVG is like QrPNG(), but renders an SVG image of size by size pixels.
+func QrSVG(sessionptr *irma.Qr, compact bool, size int) ([]byte, error) {
+	code, scale, offset, err := encodeQr(sessionptr, compact, size)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, size, size)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#ffffff"/><path fill="#000000" d="`, size, size)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&buf, "M%d %dh%dv%dh-%dz", offset+x*scale, offset+y*scale, scale, scale, scale)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes(), nil
+}
+
+// encodeQr encodes the JSON representation or the compact form of the session pointer in a QR
+// code, returning it along with the size in pixels of its modules and the offset in pixels of
+// the QR code within an image of the specified size, which includes the quiet zone.
+func encodeQr(sessionptr *irma.Qr, compact bool, size int) (*qr.Code, int, int, error) {
+	content := sessionptr.CompactLink()
+	if !compact {
+		bts, err := json.Marshal(sessionptr)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		content = string(bts)
+	}
+	code, err := qr.Encode(content, QrLevel)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	modules := code.Size + 2*qrQuietZone
+	scale := size / modules
+	if scale < 1 {
+		return nil, 0, 0, errors.Errorf("QR code requires a size of at least %d pixels", modules)
+	}
+	return code, scale, (size - code.Size*scale) / 2, nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+var testSessionPtr = &irma.Qr{
+	URL:  "https://example.com/irma/session/abcdefghijklmnopqrst",
+	Type: irma.ActionDisclosing,
+}
+
+func TestQrPNG(t *testing.T) {
+	bts, err := QrPNG(testSessionPtr, false, 300)
+	require.NoError(t, err)
+
+	// Rendering is deterministic
+	again, err := QrPNG(testSessionPtr, false, 300)
+	require.NoError(t, err)
+	require.Equal(t, bts, again)
+
+	img, err := png.Decode(bytes.NewReader(bts))
+	require.NoError(t, err)
+	require.Equal(t, 300, img.Bounds().Dx())
+	require.Equal(t, 300, img.Bounds().Dy())
+
+	// The quiet zone is white, and the top left finder pattern starts with a black module
+	code, scale, offset, err := encodeQr(testSessionPtr, false, 300)
+	require.NoError(t, err)
+	require.True(t, code.Black(0, 0))
+	require.Equal(t, color.GrayModel.Convert(color.White), color.GrayModel.Convert(img.At(0, 0)))
+	require.Equal(t, color.GrayModel.Convert(color.Black), color.GrayModel.Convert(img.At(offset, offset)))
+	require.Equal(t, color.GrayModel.Convert(color.Black), color.GrayModel.Convert(img.At(offset+scale-1, offset+scale-1)))
+	require.Equal(t, color.GrayModel.Convert(color.White), color.GrayModel.Convert(img.At(offset-1, offset-1)))
+}
+
+func TestQrSVG(t *testing.T) {
+	bts, err := QrSVG(testSessionPtr, false, 250)
+	require.NoError(t, err)
+	require.Contains(t, string(bts), `width="250" height="250"`)
+
+	again, err := QrSVG(testSessionPtr, false, 250)
+	require.NoError(t, err)
+	require.Equal(t, bts, again)
+
+	_, scale, offset, err := encodeQr(testSessionPtr, false, 250)
+	require.NoError(t, err)
+	require.Contains(t, string(bts), fmt.Sprintf("M%d %dh%d", offset, offset, scale))
+}
+
+func TestQrTooSmall(t *testing.T) {
+	_, err := QrPNG(testSessionPtr, false, 10)
+	require.Error(t, err)
+	_, err = QrSVG(testSessionPtr, false, 10)
+	require.Error(t, err)
+}
+
+// TestQrCompact checks that the compact form of session pointers yields smaller QR codes.
+func TestQrCompact(t *testing.T) {
+	ptr := &irma.Qr{
+		URL:  "https://irma.example.com/irma/session/" + strings.Repeat("abcdefghij", 2),
+		Type: irma.ActionSigning,
+	}
+	code, _, _, err := encodeQr(ptr, false, 1000)
+	require.NoError(t, err)
+	compact, _, _, err := encodeQr(ptr, true, 1000)
+	require.NoError(t, err)
+	t.Logf("QR code size: %d modules for JSON, %d modules for compact form", code.Size, compact.Size)
+	require.True(t, compact.Size < code.Size)
+
+	_, err = QrPNG(ptr, true, 300)
+	require.NoError(t, err)
+}
@@ -1,8 +1,10 @@
 package requestorserver
 
 import (
+	"crypto/subtle"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -16,7 +18,8 @@ import (
 // post done by the requestor, it is checked whether or not the requestor is known and
 // allowed to submit session requests.
 type Authenticator interface {
-	// Initialize is called once on server startup for each requestor that uses this authentication method.
+	// Initialize is called once on server startup, and when the requestors are reloaded, for each
+	// requestor that uses this authentication method.
 	// Used to parse keys or populate caches for later use.
 	Initialize(name string, requestor Requestor) error
 
@@ -49,11 +52,34 @@ type PublicKeyAuthenticator struct {
 	maxRequestAge int
 }
 type PresharedKeyAuthenticator struct {
-	presharedkeys map[string]string
+	presharedkeys []presharedKey
 }
 type NilAuthenticator struct{}
 
-var authenticators map[AuthenticationMethod]Authenticator
+// presharedKey is a token with which the named requestor authenticates.
+type presharedKey struct {
+	key  []byte
+	name string
+}
+
+var (
+	authenticators     map[AuthenticationMethod]Authenticator
+	authenticatorsLock sync.RWMutex
+)
+
+// currentAuthenticators returns the authenticators. They are replaced as a whole when the
+// requestors are reloaded (see Configuration.ReloadRequestors()), and not modified afterwards.
+func currentAuthenticators() map[AuthenticationMethod]Authenticator {
+	authenticatorsLock.RLock()
+	defer authenticatorsLock.RUnlock()
+	return authenticators
+}
+
+func setAuthenticators(auths map[AuthenticationMethod]Authenticator) {
+	authenticatorsLock.Lock()
+	defer authenticatorsLock.Unlock()
+	authenticators = auths
+}
 
 func (NilAuthenticator) Authenticate(
 	headers http.Header, body []byte,
@@ -63,7 +89,7 @@ func (NilAuthenticator) Authenticate(
 	}
 	request, err := server.ParseSessionRequest(body)
 	if err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+		return true, nil, "", server.RequestError(err)
 	}
 	return true, request, "", nil
 }
@@ -123,28 +149,80 @@ func (pskauth *PresharedKeyAuthenticator) Authenticate(
 	if auth == "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
 		return false, nil, "", nil
 	}
-	requestor, ok := pskauth.presharedkeys[auth]
+	requestor, ok := pskauth.requestor(auth)
 	if !ok {
 		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "")
 	}
 	request, err := server.ParseSessionRequest(body)
 	if err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+		return true, nil, "", server.RequestError(err)
 	}
 	return true, request, requestor, nil
 }
 
+// Initialize registers the key of the requestor (AuthenticationKey or AuthenticationKeyFile)
+// and its AuthenticationKeys, all of which the requestor can authenticate with.
 func (pskauth *PresharedKeyAuthenticator) Initialize(name string, requestor Requestor) error {
-	bts, err := fs.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
+	var keys [][]byte
+	if requestor.AuthenticationKey != "" || requestor.AuthenticationKeyFile != "" || len(requestor.AuthenticationKeys) == 0 {
+		bts, err := fs.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
+		}
+		keys = append(keys, bts)
+	}
+	for _, key := range requestor.AuthenticationKeys {
+		if key == "" {
+			return errors.New("Empty key in keys of requestor " + name)
+		}
+		keys = append(keys, []byte(key))
+	}
+	for _, key := range keys {
+		if other, ok := pskauth.requestor(string(key)); ok {
+			if other == name {
+				return errors.New("Duplicate key in keys of requestor " + name)
+			}
+			return errors.Errorf("Key of requestor %s is also a key of requestor %s", name, other)
+		}
+		pskauth.presharedkeys = append(pskauth.presharedkeys, presharedKey{key: key, name: name})
 	}
-	pskauth.presharedkeys[string(bts)] = name
 	return nil
 }
 
+// requestor returns the name of the requestor having the specified key. The key is compared
+// in constant time against all keys, so that the time taken does not reveal which one matched.
+func (pskauth *PresharedKeyAuthenticator) requestor(auth string) (string, bool) {
+	var (
+		name  string
+		found bool
+	)
+	for _, psk := range pskauth.presharedkeys {
+		if subtle.ConstantTimeCompare(psk.key, []byte(auth)) == 1 && !found {
+			name, found = psk.name, true
+		}
+	}
+	return name, found
+}
+
 // Helper functions
 
+// authenticateHeader authenticates requests to endpoints other than the session endpoint using their
+// Authorization header, returning the name of the requestor. As the other authentication methods
+// authenticate session requests, only requestors using token authentication can be authenticated
+// this way. If requestor authentication is disabled, all requests are accepted.
+func authenticateHeader(headers http.Header) (string, bool) {
+	auths := currentAuthenticators()
+	if _, ok := auths[AuthenticationMethodNone]; ok {
+		return "", true
+	}
+	pskauth, ok := auths[AuthenticationMethodToken].(*PresharedKeyAuthenticator)
+	auth := headers.Get("Authorization")
+	if !ok || auth == "" {
+		return "", false
+	}
+	return pskauth.requestor(auth)
+}
+
 // Given an (unauthenticated) jwt, return the key against which it should be verified using the "kid" header
 func jwtKeyExtractor(publickeys map[string]interface{}) func(token *jwt.Token) (interface{}, error) {
 	return func(token *jwt.Token) (interface{}, error) {
@@ -207,6 +285,9 @@ func jwtAuthenticate(
 	if err != nil {
 		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
+	if err = parsedJwt.RequestorRequest().Validate(); err != nil {
+		return true, nil, "", server.RequestError(err)
+	}
 
 	requestor := claims.Issuer // presence is ensured by jwtKeyExtractor
 	return true, parsedJwt.RequestorRequest(), requestor, nil
@@ -0,0 +1,131 @@
+package requestorserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+var testHmacKey = []byte("eGE2PSomOT84amVVdTU+LmYtJXJWZ2hLbzlmZ2dXc0FUU0sK")
+
+func testRequestorJwt(t *testing.T, method jwt.SigningMethod, key interface{}, issuedAt time.Time) []byte {
+	contents := irma.NewServiceProviderJwt("requestor", &irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
+		Content: irma.AttributeDisjunctionList{{
+			Label:      "foo",
+			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		}},
+	})
+	contents.IssuedAt = irma.Timestamp(issuedAt)
+	j, err := jwt.NewWithClaims(method, contents).SignedString(key)
+	require.NoError(t, err)
+	return []byte(j)
+}
+
+func TestHmacAuthenticator(t *testing.T) {
+	hauth := &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: 5}
+	require.NoError(t, hauth.Initialize("requestor", Requestor{
+		AuthenticationMethod: AuthenticationMethodHmac,
+		AuthenticationKey:    string(testHmacKey),
+	}))
+	key, err := base64.StdEncoding.DecodeString(string(testHmacKey))
+	require.NoError(t, err)
+	headers := http.Header{}
+	headers.Set("Content-Type", "text/plain")
+
+	applies, request, requestor, rerr := hauth.Authenticate(headers, testRequestorJwt(t, jwt.SigningMethodHS256, key, time.Now()))
+	require.True(t, applies)
+	require.Nil(t, rerr)
+	require.Equal(t, "requestor", requestor)
+	require.Equal(t, irma.ActionDisclosing, request.SessionRequest().Action())
+
+	// Signed with another key
+	applies, _, _, rerr = hauth.Authenticate(headers, testRequestorJwt(t, jwt.SigningMethodHS256, []byte("other"), time.Now()))
+	require.True(t, applies)
+	require.NotNil(t, rerr)
+
+	// Too old
+	applies, _, _, rerr = hauth.Authenticate(headers, testRequestorJwt(t, jwt.SigningMethodHS256, key, time.Now().Add(-time.Minute)))
+	require.True(t, applies)
+	require.Equal(t, string(server.ErrorUnauthorized.Type), rerr.ErrorName)
+
+	// Unsigned, or signed with RSA, JWTs are not for this authenticator
+	applies, _, _, _ = hauth.Authenticate(headers, testRequestorJwt(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, time.Now()))
+	require.False(t, applies)
+	skbts, err := ioutil.ReadFile(filepath.Join(test.FindTestdataFolder(t), "jwtkeys", "requestor1-sk.pem"))
+	require.NoError(t, err)
+	sk, err := jwt.ParseRSAPrivateKeyFromPEM(skbts)
+	require.NoError(t, err)
+	rsaJwt := testRequestorJwt(t, jwt.SigningMethodRS256, sk, time.Now())
+	applies, _, _, _ = hauth.Authenticate(headers, rsaJwt)
+	require.False(t, applies)
+
+	// nor are they accepted by the public key authenticator on behalf of an HMAC requestor
+	pkauth := &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: 5}
+	applies, _, _, rerr = pkauth.Authenticate(headers, rsaJwt)
+	require.True(t, applies)
+	require.NotNil(t, rerr)
+}
+
+func TestPresharedKeyAuthenticator(t *testing.T) {
+	pskauth := &PresharedKeyAuthenticator{}
+	require.NoError(t, pskauth.Initialize("requestor", Requestor{
+		AuthenticationMethod: AuthenticationMethodToken,
+		AuthenticationKey:    "oldtoken",
+		AuthenticationKeys:   []string{"newtoken"},
+	}))
+	require.NoError(t, pskauth.Initialize("other", Requestor{
+		AuthenticationMethod: AuthenticationMethodToken,
+		AuthenticationKeys:   []string{"othertoken"},
+	}))
+	body, err := json.Marshal(&irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
+		Content: irma.AttributeDisjunctionList{{
+			Label:      "foo",
+			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		}},
+	})
+	require.NoError(t, err)
+
+	// Each of the tokens of a requestor authenticates it
+	for token, expected := range map[string]string{"oldtoken": "requestor", "newtoken": "requestor", "othertoken": "other"} {
+		headers := http.Header{}
+		headers.Set("Content-Type", "application/json")
+		headers.Set("Authorization", token)
+		applies, request, requestor, rerr := pskauth.Authenticate(headers, body)
+		require.True(t, applies)
+		require.Nil(t, rerr)
+		require.Equal(t, expected, requestor)
+		require.Equal(t, irma.ActionDisclosing, request.SessionRequest().Action())
+	}
+
+	// but other tokens don't
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json")
+	headers.Set("Authorization", "newtoke")
+	applies, _, _, rerr := pskauth.Authenticate(headers, body)
+	require.True(t, applies)
+	require.Equal(t, string(server.ErrorUnauthorized.Type), rerr.ErrorName)
+
+	// Tokens can't be shared by requestors, and a requestor needs at least one
+	err = pskauth.Initialize("third", Requestor{AuthenticationKeys: []string{"newtoken"}})
+	require.EqualError(t, err, "Key of requestor third is also a key of requestor requestor")
+	require.Error(t, pskauth.Initialize("fourth", Requestor{}))
+
+	// A token listed twice for the same requestor is reported as such
+	err = pskauth.Initialize("fifth", Requestor{
+		AuthenticationKey:  "fifthtoken",
+		AuthenticationKeys: []string{"fifthtoken"},
+	})
+	require.EqualError(t, err, "Duplicate key in keys of requestor fifth")
+}
@@ -1,18 +1,27 @@
 package requestorserver
 
 import (
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
 )
 
 type Configuration struct {
@@ -53,26 +62,87 @@ type Configuration struct {
 	// Used in the "iss" field of result JWTs from /result-jwt and /getproof
 	JwtIssuer string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
 
-	// Private key to sign result JWTs with. If absent, /result-jwt and /getproof are disabled.
+	// Include in result JWTs a claims section containing the disclosed attributes as OpenID Connect
+	// claims, according to JwtClaimMapping or if that is empty server.DefaultClaimMapping
+	JwtClaims       bool                `json:"jwt_claims" mapstructure:"jwt_claims"`
+	JwtClaimMapping server.ClaimMapping `json:"jwt_claim_mapping" mapstructure:"jwt_claim_mapping"`
+
+	// PEM-encoded RSA or ECDSA private key to sign result JWTs with, using RS256 or (depending on
+	// the curve of the key) ES256, ES384 or ES512. If absent, /result-jwt and /getproof are disabled.
 	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
 	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
+	// Instead of JwtPrivateKey, for rotating keys: paths to multiple private keys by their key IDs.
+	// JWTs are signed with the one specified by JwtActiveKey, whose ID they include in the kid header,
+	// while /publickey and /.well-known/jwks.json publish all of them, so that JWTs signed by a
+	// previous key keep verifying. JwtActiveKey may be omitted if there is only one key.
+	JwtPrivateKeyFiles map[string]string `json:"jwt_privkey_files" mapstructure:"jwt_privkey_files"`
+	JwtActiveKey       string            `json:"jwt_active_key" mapstructure:"jwt_active_key"`
 
 	// Max age in seconds of a session request JWT (using iat field)
 	MaxRequestAge int `json:"max_request_age" mapstructure:"max_request_age"`
 
+	// Path to a JSON file of server.MinimizationRules with which disclosure requests are analyzed
+	// for asking more attributes than needed. Flagged requests are logged, and refused if their
+	// requestor has StrictMinimization enabled.
+	MinimizationRulesFile string `json:"minimization_rules" mapstructure:"minimization_rules"`
+	// Include the hints of the minimization rules in session packages
+	MinimizationHints bool `json:"minimization_hints" mapstructure:"minimization_hints"`
+
 	// Host files under this path as static files (leave empty to disable)
 	StaticPath string `json:"static_path" mapstructure:"static_path"`
 	// Host static files under this URL prefix
 	StaticPrefix string `json:"static_prefix" mapstructure:"static_prefix"`
 
-	jwtPrivateKey *rsa.PrivateKey
+	jwtPrivateKey     crypto.Signer
+	jwtSigningMethod  jwt.SigningMethod
+	jwtKeyID          string
+	jwtKeys           []resultJwtKey // all JWT private keys, starting with the active one
+	requestorJwtKeys  map[string]resultJwtKey
+	minimizationRules *server.MinimizationRules
+
+	// Guards Requestors and requestorJwtKeys, which ReloadRequestors() replaces
+	requestorsLock sync.RWMutex
+}
+
+// resultJwtKey is a private key to sign result JWTs with, along with the JWT signing method for the key
+// and its key ID, if any.
+type resultJwtKey struct {
+	key    crypto.Signer
+	method jwt.SigningMethod
+	id     string
+}
+
+// sign returns a JWT containing the specified claims signed with the key, having the ID of the key
+// in its kid header if it has one.
+func (k resultJwtKey) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.method, claims)
+	if k.id != "" {
+		token.Header["kid"] = k.id
+	}
+	return token.SignedString(k.key)
 }
 
 // Permissions specify which attributes or credential a requestor may verify or issue.
+// Besides identifiers and wildcards (e.g. "irma-demo.*"), the lists may contain deny entries
+// prefixed with "!" (e.g. "!irma-demo.MijnOverheid.fullName"), of which the trailing ".*" may be
+// omitted. The most specific entry matching an attribute or credential type decides whether
+// it is permitted; a deny entry overrides an allow entry that is equally specific.
 type Permissions struct {
 	Disclosing []string `json:"disclose_perms" mapstructure:"disclose_perms"`
 	Signing    []string `json:"sign_perms" mapstructure:"sign_perms"`
 	Issuing    []string `json:"issue_perms" mapstructure:"issue_perms"`
+	// Attributes that may be verified in combined issuance/disclosure sessions. These are
+	// permitted separately from Disclosing, so that a requestor may e.g. verify an attribute
+	// in disclosure sessions but not as part of issuance, or vice versa.
+	IssuingDisclosures []string `json:"issue_disclose_perms" mapstructure:"issue_disclose_perms"`
+
+	// Whether session results may include the credential hashes of disclosed attributes,
+	// which link disclosures of the same credential instance (see irma.DisclosedAttribute)
+	CredentialHashes bool `json:"credential_hashes" mapstructure:"credential_hashes"`
+
+	// Whether session results may contain hashes of the disclosed attribute values instead of
+	// the values (see irma.RequestorBaseRequest.HashAttributeValues)
+	HashAttributeValues bool `json:"hash_attribute_values" mapstructure:"hash_attribute_values"`
 }
 
 // Requestor contains all configuration (disclosure or verification permissions and authentication)
@@ -83,26 +153,50 @@ type Requestor struct {
 	AuthenticationMethod  AuthenticationMethod `json:"auth_method" mapstructure:"auth_method"`
 	AuthenticationKey     string               `json:"key" mapstructure:"key"`
 	AuthenticationKeyFile string               `json:"key_file" mapstructure:"key_file"`
+	// Additional tokens with which the requestor can authenticate, if it uses token authentication,
+	// e.g. for rotating tokens by adding the new one, migrating to it, and then removing the old one
+	AuthenticationKeys []string `json:"keys" mapstructure:"keys"`
+
+	// Purpose of the requests of the requestor, selecting the purpose profiles of the minimization
+	// rules that apply to them (see server.MinimizationRules)
+	Purpose string `json:"purpose" mapstructure:"purpose"`
+	// Refuse requests of the requestor that the minimization rules flag
+	StrictMinimization bool `json:"strict_minimization" mapstructure:"strict_minimization"`
+
+	// PEM-encoded RSA or ECDSA private key to sign the result JWTs of the sessions of the requestor
+	// with, instead of JwtPrivateKey
+	ResultJwtPrivateKey     string `json:"result_jwt_privkey" mapstructure:"result_jwt_privkey"`
+	ResultJwtPrivateKeyFile string `json:"result_jwt_privkey_file" mapstructure:"result_jwt_privkey_file"`
+	// Used instead of JwtIssuer in the "iss" field of the result JWTs of the sessions of the requestor
+	ResultJwtIssuer string `json:"result_jwt_issuer" mapstructure:"result_jwt_issuer"`
 }
 
-// CanIssue returns whether or not the specified requestor may issue the specified credentials.
+// CanIssue returns whether or not the specified requestor may issue the specified credentials,
+// whether none of their credential types is deprecated, and whether the private key inventory
+// contains a usable private key for each of them.
 // (In case of combined issuance/disclosure sessions, this method does not check whether or not
 // the identity provider is allowed to verify the attributes being verified; use CanVerifyOrSign
 // for that).
 func (conf *Configuration) CanIssue(requestor string, creds []*irma.CredentialRequest) (bool, string) {
-	permissions := append(conf.Requestors[requestor].Issuing, conf.Issuing...)
+	permissions := append(conf.requestor(requestor).Issuing, conf.Issuing...)
 	if len(permissions) == 0 { // requestor is not present in the permissions
 		return false, ""
 	}
 
+	if id := conf.DeprecatedCredentialType(creds); id != nil {
+		return false, id.String()
+	}
 	for _, cred := range creds {
 		id := cred.CredentialTypeID
-		if contains(permissions, "*") ||
-			contains(permissions, id.Root()+".*") ||
-			contains(permissions, id.IssuerIdentifier().String()+".*") ||
-			contains(permissions, id.String()) {
-			continue
-		} else {
+		if !permitted(permissions,
+			id.String(),
+			id.IssuerIdentifier().String()+".*",
+			id.Root()+".*",
+			"*",
+		) {
+			return false, id.String()
+		}
+		if sk, err := conf.PrivateKey(id.IssuerIdentifier()); err != nil || sk == nil {
 			return false, id.String()
 		}
 	}
@@ -111,30 +205,33 @@ func (conf *Configuration) CanIssue(requestor string, creds []*irma.CredentialRe
 }
 
 // CanVerifyOrSign returns whether or not the specified requestor may use the selected attributes
-// in any of the supported session types.
+// in any of the supported session types. The attributes to be verified in issuance sessions are
+// checked against the IssuingDisclosures permissions, not against the Disclosing permissions.
 func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action, disjunctions irma.AttributeDisjunctionList) (bool, string) {
 	var permissions []string
 	switch action {
 	case irma.ActionDisclosing:
-		permissions = append(conf.Requestors[requestor].Disclosing, conf.Disclosing...)
+		permissions = append(conf.requestor(requestor).Disclosing, conf.Disclosing...)
 	case irma.ActionIssuing:
-		permissions = append(conf.Requestors[requestor].Disclosing, conf.Disclosing...)
+		permissions = append(conf.requestor(requestor).IssuingDisclosures, conf.IssuingDisclosures...)
 	case irma.ActionSigning:
-		permissions = append(conf.Requestors[requestor].Signing, conf.Signing...)
+		permissions = append(conf.requestor(requestor).Signing, conf.Signing...)
 	}
 	if len(permissions) == 0 { // requestor is not present in the permissions
 		return false, ""
 	}
 
+	// A wildcard referring to all attributes of a credential type ("scheme.issuer.credential.*")
+	// is permitted by the same permissions as the credential type wildcard, which it equals
 	for _, disjunction := range disjunctions {
 		for _, attr := range disjunction.Attributes {
-			if contains(permissions, "*") ||
-				contains(permissions, attr.Root()+".*") ||
-				contains(permissions, attr.CredentialTypeIdentifier().IssuerIdentifier().String()+".*") ||
-				contains(permissions, attr.CredentialTypeIdentifier().String()+".*") ||
-				contains(permissions, attr.String()) {
-				continue
-			} else {
+			if !permitted(permissions,
+				attr.String(),
+				attr.CredentialTypeIdentifier().String()+".*",
+				attr.CredentialTypeIdentifier().IssuerIdentifier().String()+".*",
+				attr.Root()+".*",
+				"*",
+			) {
 				return false, attr.String()
 			}
 		}
@@ -143,13 +240,36 @@ func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action,
 	return true, ""
 }
 
+// CanReceiveCredentialHashes returns whether the specified requestor may request the credential
+// hashes of disclosed attributes to be included in session results.
+func (conf *Configuration) CanReceiveCredentialHashes(requestor string) bool {
+	return conf.CredentialHashes || conf.requestor(requestor).CredentialHashes
+}
+
+// CanHashAttributeValues returns whether the specified requestor may request the disclosed
+// attribute values in session results to be hashed.
+func (conf *Configuration) CanHashAttributeValues(requestor string) bool {
+	return conf.HashAttributeValues || conf.requestor(requestor).HashAttributeValues
+}
+
 func (conf *Configuration) initialize() error {
 	if err := conf.readPrivateKey(); err != nil {
 		return err
 	}
+	var err error
+	if conf.requestorJwtKeys, err = conf.readRequestorPrivateKeys(conf.Requestors); err != nil {
+		return err
+	}
+	if conf.MinimizationRulesFile != "" {
+		rules, err := server.ReadMinimizationRules(conf.MinimizationRulesFile)
+		if err != nil {
+			return err
+		}
+		conf.minimizationRules = rules
+	}
 
 	if conf.DisableRequestorAuthentication {
-		authenticators = map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}
+		setAuthenticators(map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}})
 		conf.Logger.Warn("Authentication of incoming session requests disabled: anyone who can reach this server can use it")
 		havekeys, err := conf.HavePrivateKeys()
 		if err != nil {
@@ -166,23 +286,11 @@ func (conf *Configuration) initialize() error {
 		if len(conf.Requestors) == 0 {
 			return errors.New("No requestors configured; either configure one or more requestors or disable requestor authentication")
 		}
-		authenticators = map[AuthenticationMethod]Authenticator{
-			AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodToken:     &PresharedKeyAuthenticator{presharedkeys: map[string]string{}},
-		}
-
-		// Initialize authenticators
-		for name, requestor := range conf.Requestors {
-			authenticator, ok := authenticators[requestor.AuthenticationMethod]
-			if !ok {
-				return errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s)",
-					name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac, AuthenticationMethodPublicKey)
-			}
-			if err := authenticator.Initialize(name, requestor); err != nil {
-				return err
-			}
+		auths, err := conf.newAuthenticators(conf.Requestors)
+		if err != nil {
+			return err
 		}
+		setAuthenticators(auths)
 	}
 
 	if conf.Port <= 0 || conf.Port > 65535 {
@@ -208,7 +316,7 @@ func (conf *Configuration) initialize() error {
 		return errors.WrapPrefix(err, "Failed to read client TLS configuration", 0)
 	}
 
-	if err := conf.validatePermissions(); err != nil {
+	if err := conf.validatePermissions(conf.Requestors); err != nil {
 		return err
 	}
 
@@ -250,13 +358,74 @@ func (conf *Configuration) initialize() error {
 	return nil
 }
 
-func (conf *Configuration) validatePermissions() error {
-	if conf.DisableRequestorAuthentication && len(conf.Requestors) != 0 {
+// newAuthenticators returns an authenticator for each supported authentication method,
+// initialized with the keys of the specified requestors.
+func (conf *Configuration) newAuthenticators(requestors map[string]Requestor) (map[AuthenticationMethod]Authenticator, error) {
+	auths := map[AuthenticationMethod]Authenticator{
+		AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
+		AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
+		AuthenticationMethodToken:     &PresharedKeyAuthenticator{},
+	}
+	for name, requestor := range requestors {
+		authenticator, ok := auths[requestor.AuthenticationMethod]
+		if !ok {
+			return nil, errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s)",
+				name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac, AuthenticationMethodPublicKey)
+		}
+		if err := authenticator.Initialize(name, requestor); err != nil {
+			return nil, err
+		}
+	}
+	return auths, nil
+}
+
+// ReloadRequestors replaces the requestors of the server by the specified ones, e.g. after their
+// keys or permissions changed, leaving the sessions in progress untouched. The new requestors are
+// validated and their keys parsed before any requestor is replaced: if any of them is invalid,
+// an error is returned and the current requestors are kept.
+func (conf *Configuration) ReloadRequestors(requestors map[string]Requestor) error {
+	if err := conf.validatePermissions(requestors); err != nil {
+		return err
+	}
+	keys, err := conf.readRequestorPrivateKeys(requestors)
+	if err != nil {
+		return err
+	}
+	var auths map[AuthenticationMethod]Authenticator
+	if !conf.DisableRequestorAuthentication {
+		if len(requestors) == 0 {
+			return errors.New("No requestors configured; either configure one or more requestors or disable requestor authentication")
+		}
+		if auths, err = conf.newAuthenticators(requestors); err != nil {
+			return err
+		}
+	}
+
+	conf.requestorsLock.Lock()
+	defer conf.requestorsLock.Unlock()
+	conf.Requestors = requestors
+	conf.requestorJwtKeys = keys
+	if auths != nil {
+		setAuthenticators(auths)
+	}
+	conf.Logger.WithField("count", len(requestors)).Info("Requestors reloaded")
+	return nil
+}
+
+// requestor returns the configuration of the specified requestor.
+func (conf *Configuration) requestor(name string) Requestor {
+	conf.requestorsLock.RLock()
+	defer conf.requestorsLock.RUnlock()
+	return conf.Requestors[name]
+}
+
+func (conf *Configuration) validatePermissions(requestors map[string]Requestor) error {
+	if conf.DisableRequestorAuthentication && len(requestors) != 0 {
 		return errors.New("Requestors must not be configured when requestor authentication is disabled")
 	}
 
 	errs := conf.validatePermissionSet("Global", conf.Permissions)
-	for name, requestor := range conf.Requestors {
+	for name, requestor := range requestors {
 		errs = append(errs, conf.validatePermissionSet("Requestor "+name, requestor.Permissions)...)
 	}
 	if len(errs) != 0 {
@@ -268,16 +437,18 @@ func (conf *Configuration) validatePermissions() error {
 func (conf *Configuration) validatePermissionSet(requestor string, requestorperms Permissions) []string {
 	var errs []string
 	perms := map[string][]string{
-		"issuing":    requestorperms.Issuing,
-		"signing":    requestorperms.Signing,
-		"disclosing": requestorperms.Disclosing,
+		"issuing":             requestorperms.Issuing,
+		"signing":             requestorperms.Signing,
+		"disclosing":          requestorperms.Disclosing,
+		"issuance disclosing": requestorperms.IssuingDisclosures,
 	}
-	permissionlength := map[string]int{"issuing": 3, "signing": 4, "disclosing": 4}
+	permissionlength := map[string]int{"issuing": 3, "signing": 4, "disclosing": 4, "issuance disclosing": 4}
 
 	for typ, typeperms := range perms {
 		for _, permission := range typeperms {
-			parts := strings.Split(permission, ".")
-			if parts[len(parts)-1] == "*" {
+			deny := strings.HasPrefix(permission, "!")
+			parts := strings.Split(strings.TrimPrefix(permission, "!"), ".")
+			if parts[len(parts)-1] == "*" || (deny && len(parts) < permissionlength[typ]) {
 				if len(parts) > permissionlength[typ] {
 					errs = append(errs, fmt.Sprintf("%s %s permission '%s' should have at most %d parts", requestor, typ, permission, permissionlength[typ]))
 				}
@@ -362,6 +533,9 @@ func (conf *Configuration) readTlsConf(cert, certfile, key, keyfile string) (*tl
 }
 
 func (conf *Configuration) readPrivateKey() error {
+	if len(conf.JwtPrivateKeyFiles) > 0 {
+		return conf.readPrivateKeys()
+	}
 	if conf.JwtPrivateKey == "" && conf.JwtPrivateKeyFile == "" {
 		return nil
 	}
@@ -371,15 +545,248 @@ func (conf *Configuration) readPrivateKey() error {
 		return errors.WrapPrefix(err, "failed to read private key", 0)
 	}
 
-	conf.jwtPrivateKey, err = jwt.ParseRSAPrivateKeyFromPEM(keybytes)
-	conf.Logger.Info("Private key parsed, JWT endpoints enabled")
-	return err
+	if conf.jwtPrivateKey, conf.jwtSigningMethod, err = parseJwtPrivateKey(keybytes); err != nil {
+		return errors.WrapPrefix(err, "failed to parse private key", 0)
+	}
+	conf.jwtKeys = []resultJwtKey{{key: conf.jwtPrivateKey, method: conf.jwtSigningMethod}}
+	conf.Logger.WithField("alg", conf.jwtSigningMethod.Alg()).Info("Private key parsed, JWT endpoints enabled")
+	return nil
+}
+
+// readPrivateKeys parses the private keys of JwtPrivateKeyFiles, of which the one specified
+// by JwtActiveKey becomes the one to sign JWTs with.
+func (conf *Configuration) readPrivateKeys() error {
+	if conf.JwtPrivateKey != "" || conf.JwtPrivateKeyFile != "" {
+		return errors.New("jwt_privkey_files cannot be combined with jwt_privkey or jwt_privkey_file")
+	}
+	active := conf.JwtActiveKey
+	if active == "" && len(conf.JwtPrivateKeyFiles) == 1 {
+		for id := range conf.JwtPrivateKeyFiles {
+			active = id
+		}
+	}
+	if _, ok := conf.JwtPrivateKeyFiles[active]; !ok {
+		return errors.Errorf("jwt_active_key '%s' is not one of the keys in jwt_privkey_files", active)
+	}
+
+	ids := make([]string, 0, len(conf.JwtPrivateKeyFiles))
+	for id := range conf.JwtPrivateKeyFiles {
+		if id != active {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	keys := make([]resultJwtKey, 0, len(conf.JwtPrivateKeyFiles))
+	for _, id := range append([]string{active}, ids...) {
+		keybytes, err := fs.ReadKey("", conf.JwtPrivateKeyFiles[id])
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read private key "+id, 0)
+		}
+		key, method, err := parseJwtPrivateKey(keybytes)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to parse private key "+id, 0)
+		}
+		keys = append(keys, resultJwtKey{key: key, method: method, id: id})
+	}
+
+	conf.jwtKeys = keys
+	conf.jwtPrivateKey, conf.jwtSigningMethod, conf.jwtKeyID = keys[0].key, keys[0].method, keys[0].id
+	conf.Logger.WithFields(logrus.Fields{"kid": active, "alg": conf.jwtSigningMethod.Alg(), "keys": len(keys)}).
+		Info("Private keys parsed, JWT endpoints enabled")
+	return nil
+}
+
+// JwtPublicKeyPEM returns the PEM-encoded public key of the private key with which the server
+// signs JWTs (see JwtPrivateKey), against which its result JWTs can be verified.
+// If multiple private keys are configured (see JwtPrivateKeyFiles), it returns the concatenated
+// PEM blocks of all of their public keys, starting with that of the active key.
+// It returns nil if no JWT private key is configured.
+func (conf *Configuration) JwtPublicKeyPEM() ([]byte, error) {
+	if conf.jwtPrivateKey == nil {
+		return nil, nil
+	}
+	var pems []byte
+	for _, k := range conf.jwtKeys {
+		bts, err := x509.MarshalPKIXPublicKey(k.key.Public())
+		if err != nil {
+			return nil, err
+		}
+		pems = append(pems, pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: bts,
+		})...)
+	}
+	return pems, nil
+}
+
+// JSONWebKey is a public key in the JSON Web Key format (RFC 7517).
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+
+	// RSA public key parameters
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// ECDSA public key parameters
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is a JSON Web Key Set (RFC 7517), as served at /.well-known/jwks.json.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JwtKeySet returns the public keys of all private keys with which the server signs JWTs
+// (see JwtPrivateKey and JwtPrivateKeyFiles) as a JSON Web Key Set, or nil if no JWT private
+// key is configured.
+func (conf *Configuration) JwtKeySet() (*JSONWebKeySet, error) {
+	if conf.jwtPrivateKey == nil {
+		return nil, nil
+	}
+	set := &JSONWebKeySet{Keys: make([]JSONWebKey, 0, len(conf.jwtKeys))}
+	for _, k := range conf.jwtKeys {
+		jwk := JSONWebKey{KeyID: k.id, Use: "sig", Algorithm: k.method.Alg()}
+		switch pk := k.key.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pk.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pk.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (pk.Curve.Params().BitSize + 7) / 8
+			jwk.KeyType = "EC"
+			jwk.Curve = pk.Curve.Params().Name
+			jwk.X = base64.RawURLEncoding.EncodeToString(padBytes(pk.X.Bytes(), size))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(padBytes(pk.Y.Bytes(), size))
+		default:
+			return nil, errors.Errorf("unsupported public key type %T", pk)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+// padBytes left-pads the specified big-endian integer with zeroes to the specified length.
+func padBytes(bts []byte, length int) []byte {
+	if len(bts) >= length {
+		return bts
+	}
+	return append(make([]byte, length-len(bts)), bts...)
+}
+
+// readRequestorPrivateKeys parses the result JWT private keys of the specified requestors that have one.
+func (conf *Configuration) readRequestorPrivateKeys(requestors map[string]Requestor) (map[string]resultJwtKey, error) {
+	keys := map[string]resultJwtKey{}
+	for name, requestor := range requestors {
+		if requestor.ResultJwtPrivateKey == "" && requestor.ResultJwtPrivateKeyFile == "" {
+			continue
+		}
+		keybytes, err := fs.ReadKey(requestor.ResultJwtPrivateKey, requestor.ResultJwtPrivateKeyFile)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to read result JWT private key of requestor "+name, 0)
+		}
+		key, method, err := parseJwtPrivateKey(keybytes)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to parse result JWT private key of requestor "+name, 0)
+		}
+		keys[name] = resultJwtKey{key: key, method: method}
+		conf.Logger.WithFields(logrus.Fields{"requestor": name, "alg": method.Alg()}).
+			Info("Result JWT private key of requestor parsed")
+	}
+	return keys, nil
+}
+
+// resultJwtSigning returns the private key with which to sign the result JWTs of the sessions
+// of the specified requestor, and the issuer to include in them. The key is nil if neither the
+// requestor nor the server has a result JWT private key, and if the requestor is no longer
+// configured, so that its results are never signed with the key of the server instead of its own.
+func (conf *Configuration) resultJwtSigning(requestor string) (*resultJwtKey, string) {
+	conf.requestorsLock.RLock()
+	defer conf.requestorsLock.RUnlock()
+	issuer := conf.JwtIssuer
+	r, ok := conf.Requestors[requestor]
+	if requestor != "" && !ok {
+		return nil, issuer
+	}
+	if r.ResultJwtIssuer != "" {
+		issuer = r.ResultJwtIssuer
+	}
+	if k, ok := conf.requestorJwtKeys[requestor]; ok {
+		return &k, issuer
+	}
+	if conf.jwtPrivateKey == nil {
+		return nil, issuer
+	}
+	return &resultJwtKey{key: conf.jwtPrivateKey, method: conf.jwtSigningMethod, id: conf.jwtKeyID}, issuer
+}
+
+// parseJwtPrivateKey parses a PEM-encoded RSA private key (PKCS #1 or PKCS #8) or ECDSA private key
+// (SEC 1 or PKCS #8), returning it along with the JWT signing method for the key.
+func parseJwtPrivateKey(bts []byte) (crypto.Signer, jwt.SigningMethod, error) {
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, nil, errors.New("no PEM block found")
+	}
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, nil, errors.Errorf("unsupported PEM block type %s", block.Type)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			return k, jwt.SigningMethodES256, nil
+		case 384:
+			return k, jwt.SigningMethodES384, nil
+		case 521:
+			return k, jwt.SigningMethodES512, nil
+		}
+		return nil, nil, errors.Errorf("unsupported ECDSA curve %s", k.Curve.Params().Name)
+	default:
+		return nil, nil, errors.Errorf("unsupported private key type %T", key)
+	}
 }
 
 func (conf *Configuration) separateClientServer() bool {
 	return conf.ClientPort != 0
 }
 
+// permitted returns whether the permissions allow the most specific of the specified patterns,
+// ordered from most to least specific, that they mention. A deny entry ("!" followed by the
+// pattern, of which a trailing ".*" may be omitted) overrides an allow entry of the same pattern.
+func permitted(permissions []string, patterns ...string) bool {
+	for _, pattern := range patterns {
+		if contains(permissions, "!"+pattern) ||
+			(strings.HasSuffix(pattern, ".*") && contains(permissions, "!"+strings.TrimSuffix(pattern, ".*"))) {
+			return false
+		}
+		if contains(permissions, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
 // Return true iff query equals an element of strings.
 func contains(strings []string, query string) bool {
 	for _, s := range strings {
@@ -0,0 +1,451 @@
+package requestorserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func ecdsaKeyPEM(t *testing.T, curve elliptic.Curve, pkcs8 bool) (*ecdsa.PrivateKey, []byte) {
+	sk, err := ecdsa.GenerateKey(curve, rand.Reader)
+	require.NoError(t, err)
+	block := &pem.Block{Type: "EC PRIVATE KEY"}
+	if pkcs8 {
+		block.Type = "PRIVATE KEY"
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(sk)
+	} else {
+		block.Bytes, err = x509.MarshalECPrivateKey(sk)
+	}
+	require.NoError(t, err)
+	return sk, pem.EncodeToMemory(block)
+}
+
+func TestParseJwtPrivateKey(t *testing.T) {
+	bts, err := ioutil.ReadFile(filepath.Join(test.FindTestdataFolder(t), "jwtkeys", "sk.pem"))
+	require.NoError(t, err)
+	_, method, err := parseJwtPrivateKey(bts)
+	require.NoError(t, err)
+	require.Equal(t, jwt.SigningMethodRS256, method)
+
+	// The signing method of ECDSA keys depends on their curve, in SEC 1 and PKCS #8 form alike
+	for _, pkcs8 := range []bool{false, true} {
+		for curve, expected := range map[elliptic.Curve]jwt.SigningMethod{
+			elliptic.P256(): jwt.SigningMethodES256,
+			elliptic.P384(): jwt.SigningMethodES384,
+			elliptic.P521(): jwt.SigningMethodES512,
+		} {
+			sk, bts := ecdsaKeyPEM(t, curve, pkcs8)
+			key, method, err := parseJwtPrivateKey(bts)
+			require.NoError(t, err)
+			require.Equal(t, expected, method)
+			require.Equal(t, sk, key)
+		}
+	}
+
+	_, _, err = parseJwtPrivateKey([]byte("not a key"))
+	require.Error(t, err)
+	_, _, err = parseJwtPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1}}))
+	require.Error(t, err)
+}
+
+func TestEcdsaResultJwt(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.ErrorLevel
+	sk, skPEM := ecdsaKeyPEM(t, elliptic.P256(), false)
+	conf := &Configuration{
+		Configuration: &server.Configuration{
+			SchemesPath:          filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+			Logger:               logger,
+			DisableSchemesUpdate: true,
+		},
+		JwtIssuer:     "testissuer",
+		JwtPrivateKey: string(skPEM),
+	}
+	require.NoError(t, conf.readPrivateKey())
+	irmaserv, err := irmaserver.New(conf.Configuration)
+	require.NoError(t, err)
+	defer irmaserv.Stop()
+	s := &Server{conf: conf, irmaserv: irmaserv}
+
+	_, token, err := irmaserv.StartSession(&irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
+		Content: irma.AttributeDisjunctionList{{
+			Label:      "foo",
+			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	j, err := s.resultJwt(irmaserv.GetSessionResult(token))
+	require.NoError(t, err)
+
+	// The result JWT verifies against the public key of the ECDSA key, and is issued by us
+	claims := &jwt.StandardClaims{}
+	parsed, err := jwt.ParseWithClaims(j, claims, func(*jwt.Token) (interface{}, error) {
+		return &sk.PublicKey, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "ES256", parsed.Method.Alg())
+	require.Equal(t, "testissuer", claims.Issuer)
+	require.Equal(t, "disclosing_result", claims.Subject)
+
+	// but not against other keys
+	other, _ := ecdsaKeyPEM(t, elliptic.P256(), false)
+	_, err = jwt.ParseWithClaims(j, &jwt.StandardClaims{}, func(*jwt.Token) (interface{}, error) {
+		return &other.PublicKey, nil
+	})
+	require.Error(t, err)
+}
+
+func TestJwtPublicKeyPEM(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.ErrorLevel
+	sk, skPEM := ecdsaKeyPEM(t, elliptic.P256(), false)
+	conf := &Configuration{
+		Configuration: &server.Configuration{Logger: logger},
+		JwtPrivateKey: string(skPEM),
+	}
+	require.NoError(t, conf.readPrivateKey())
+	s := &Server{conf: conf}
+
+	// The public key is served PEM-encoded, matching the private key
+	w := httptest.NewRecorder()
+	s.handlePublicKey(w, httptest.NewRequest(http.MethodGet, "/publickey", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	block, _ := pem.Decode(w.Body.Bytes())
+	require.NotNil(t, block)
+	pk, err := x509.ParsePKIXPublicKey(block.Bytes)
+	require.NoError(t, err)
+	require.Equal(t, &sk.PublicKey, pk)
+	bts, err := conf.JwtPublicKeyPEM()
+	require.NoError(t, err)
+	require.Equal(t, w.Body.Bytes(), bts)
+
+	// Without a private key there is no public key to serve
+	conf = &Configuration{Configuration: &server.Configuration{Logger: logger}}
+	require.NoError(t, conf.readPrivateKey())
+	bts, err = conf.JwtPublicKeyPEM()
+	require.NoError(t, err)
+	require.Nil(t, bts)
+	w = httptest.NewRecorder()
+	(&Server{conf: conf}).handlePublicKey(w, httptest.NewRequest(http.MethodGet, "/publickey", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Contains(t, w.Body.String(), string(server.ErrorNoJwtKey.Type))
+}
+
+func TestJwtKeyRotation(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.ErrorLevel
+	dir, err := ioutil.TempDir("", "jwtkeys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sk, skPEM := ecdsaKeyPEM(t, elliptic.P256(), false)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new.pem"), skPEM, 0600))
+	oldPath := filepath.Join(test.FindTestdataFolder(t), "jwtkeys", "sk.pem")
+	conf := &Configuration{
+		Configuration: &server.Configuration{
+			SchemesPath:          filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+			Logger:               logger,
+			DisableSchemesUpdate: true,
+		},
+		JwtPrivateKeyFiles: map[string]string{"2019-01": oldPath, "2019-06": filepath.Join(dir, "new.pem")},
+		JwtActiveKey:       "2019-06",
+	}
+	require.NoError(t, conf.readPrivateKey())
+	irmaserv, err := irmaserver.New(conf.Configuration)
+	require.NoError(t, err)
+	defer irmaserv.Stop()
+	s := &Server{conf: conf, irmaserv: irmaserv}
+
+	// Result JWTs are signed with the active key, whose ID is in their header
+	_, token, err := irmaserv.StartSession(&irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
+		Content: irma.AttributeDisjunctionList{{
+			Label:      "foo",
+			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	j, err := s.resultJwt(irmaserv.GetSessionResult(token))
+	require.NoError(t, err)
+	parsed, err := jwt.Parse(j, func(*jwt.Token) (interface{}, error) {
+		return &sk.PublicKey, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "2019-06", parsed.Header["kid"])
+	require.Equal(t, "ES256", parsed.Method.Alg())
+
+	// All keys are published, starting with the active one
+	pems, err := conf.JwtPublicKeyPEM()
+	require.NoError(t, err)
+	block, rest := pem.Decode(pems)
+	require.NotNil(t, block)
+	pk, err := x509.ParsePKIXPublicKey(block.Bytes)
+	require.NoError(t, err)
+	require.Equal(t, &sk.PublicKey, pk)
+	block, rest = pem.Decode(rest)
+	require.NotNil(t, block)
+	require.Empty(t, rest)
+
+	set, err := conf.JwtKeySet()
+	require.NoError(t, err)
+	require.Len(t, set.Keys, 2)
+	require.Equal(t, "2019-06", set.Keys[0].KeyID)
+	require.Equal(t, "EC", set.Keys[0].KeyType)
+	require.Equal(t, "P-256", set.Keys[0].Curve)
+	x, err := base64.RawURLEncoding.DecodeString(set.Keys[0].X)
+	require.NoError(t, err)
+	require.Len(t, x, 32)
+	require.Zero(t, new(big.Int).SetBytes(x).Cmp(sk.PublicKey.X))
+	require.Equal(t, "2019-01", set.Keys[1].KeyID)
+	require.Equal(t, "RSA", set.Keys[1].KeyType)
+	require.Equal(t, "RS256", set.Keys[1].Algorithm)
+	require.Equal(t, "AQAB", set.Keys[1].E)
+
+	// The active key must be one of the keys, and the keys can't be combined with a single key
+	conf.JwtActiveKey = "2020-01"
+	require.Error(t, conf.readPrivateKey())
+	conf.JwtActiveKey, conf.JwtPrivateKeyFile = "2019-06", oldPath
+	require.Error(t, conf.readPrivateKey())
+}
+
+func TestRequestorResultJwtKey(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.ErrorLevel
+	sk, skPEM := ecdsaKeyPEM(t, elliptic.P384(), true)
+	conf := &Configuration{
+		Configuration: &server.Configuration{
+			SchemesPath:          filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+			Logger:               logger,
+			DisableSchemesUpdate: true,
+		},
+		JwtIssuer:         "testissuer",
+		JwtPrivateKeyFile: filepath.Join(test.FindTestdataFolder(t), "jwtkeys", "sk.pem"),
+		Requestors: map[string]Requestor{
+			"tenant": {ResultJwtPrivateKey: string(skPEM), ResultJwtIssuer: "tenant"},
+			"other":  {},
+		},
+	}
+	require.NoError(t, conf.readPrivateKey())
+	var err error
+	conf.requestorJwtKeys, err = conf.readRequestorPrivateKeys(conf.Requestors)
+	require.NoError(t, err)
+	irmaserv, err := irmaserver.New(conf.Configuration)
+	require.NoError(t, err)
+	defer irmaserv.Stop()
+	s := &Server{conf: conf, irmaserv: irmaserv}
+
+	request := &irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
+		Content: irma.AttributeDisjunctionList{{
+			Label:      "foo",
+			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+		}},
+	}
+	_, tenantToken, err := irmaserv.StartSession(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{Requestor: "tenant"},
+		Request:              request,
+	}, nil)
+	require.NoError(t, err)
+	_, otherToken, err := irmaserv.StartSession(request, nil)
+	require.NoError(t, err)
+
+	// Result JWTs of sessions of the tenant are signed with its own key and issuer
+	j, err := s.resultJwt(irmaserv.GetSessionResult(tenantToken))
+	require.NoError(t, err)
+	claims := &jwt.StandardClaims{}
+	parsed, err := jwt.ParseWithClaims(j, claims, func(*jwt.Token) (interface{}, error) {
+		return &sk.PublicKey, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "ES384", parsed.Method.Alg())
+	require.Equal(t, "tenant", claims.Issuer)
+
+	// those of other sessions with the global key and issuer
+	j, err = s.resultJwt(irmaserv.GetSessionResult(otherToken))
+	require.NoError(t, err)
+	claims = &jwt.StandardClaims{}
+	_, err = jwt.ParseWithClaims(j, claims, func(*jwt.Token) (interface{}, error) {
+		return conf.jwtPrivateKey.Public(), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "testissuer", claims.Issuer)
+
+	// Once the tenant is removed, the results of its sessions are not signed with the global key instead
+	conf.Requestors, conf.requestorJwtKeys = map[string]Requestor{"other": {}}, map[string]resultJwtKey{}
+	_, err = s.resultJwt(irmaserv.GetSessionResult(tenantToken))
+	require.Error(t, err)
+
+	// An unparsable requestor key is refused when the server starts
+	conf.Requestors["tenant"] = Requestor{ResultJwtPrivateKey: "not a key"}
+	require.Error(t, conf.initialize())
+}
+
+func TestCanVerifyOrSignPerAction(t *testing.T) {
+	conf := &Configuration{
+		Configuration: &server.Configuration{},
+		Requestors: map[string]Requestor{
+			"issuer": {Permissions: Permissions{
+				Issuing:            []string{"irma-demo.MijnOverheid.*"},
+				IssuingDisclosures: []string{"irma-demo.RU.studentCard.studentID"},
+			}},
+			"verifier": {Permissions: Permissions{
+				Disclosing: []string{"irma-demo.RU.studentCard.*"},
+			}},
+		},
+	}
+	studentID := irma.AttributeDisjunctionList{{
+		Label:      "foo",
+		Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+	}}
+	university := irma.AttributeDisjunctionList{{
+		Label:      "foo",
+		Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")},
+	}}
+
+	// A requestor with issuing but no disclosing permissions may verify attributes in combined
+	// issuance/disclosure sessions, but only those permitted for issuance
+	allowed, _ := conf.CanVerifyOrSign("issuer", irma.ActionIssuing, studentID)
+	require.True(t, allowed)
+	allowed, reason := conf.CanVerifyOrSign("issuer", irma.ActionIssuing, university)
+	require.False(t, allowed)
+	require.Equal(t, "irma-demo.RU.studentCard.university", reason)
+	allowed, _ = conf.CanVerifyOrSign("issuer", irma.ActionDisclosing, studentID)
+	require.False(t, allowed)
+
+	// Disclosing permissions do not extend to issuance sessions
+	allowed, _ = conf.CanVerifyOrSign("verifier", irma.ActionDisclosing, studentID)
+	require.True(t, allowed)
+	allowed, _ = conf.CanVerifyOrSign("verifier", irma.ActionIssuing, studentID)
+	require.False(t, allowed)
+	allowed, _ = conf.CanVerifyOrSign("verifier", irma.ActionSigning, studentID)
+	require.False(t, allowed)
+
+	// Global permissions apply to all requestors
+	conf.IssuingDisclosures = []string{"irma-demo.RU.*"}
+	allowed, _ = conf.CanVerifyOrSign("verifier", irma.ActionIssuing, university)
+	require.True(t, allowed)
+}
+
+func TestDenyPermissions(t *testing.T) {
+	conf := &Configuration{
+		Configuration: &server.Configuration{},
+		Requestors: map[string]Requestor{
+			"requestor": {Permissions: Permissions{
+				Disclosing: []string{"irma-demo.*", "!irma-demo.MijnOverheid.fullName", "!irma-demo.RU.*", "irma-demo.RU.studentCard.studentID"},
+			}},
+		},
+	}
+	disjunctions := func(attr string) irma.AttributeDisjunctionList {
+		return irma.AttributeDisjunctionList{{
+			Label:      "foo",
+			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier(attr)},
+		}}
+	}
+
+	// Deny entries carve out of less specific allow entries
+	allowed, _ := conf.CanVerifyOrSign("requestor", irma.ActionDisclosing, disjunctions("irma-demo.MijnOverheid.root.BSN"))
+	require.True(t, allowed)
+	allowed, reason := conf.CanVerifyOrSign("requestor", irma.ActionDisclosing, disjunctions("irma-demo.MijnOverheid.fullName.firstname"))
+	require.False(t, allowed)
+	require.Equal(t, "irma-demo.MijnOverheid.fullName.firstname", reason)
+	allowed, reason = conf.CanVerifyOrSign("requestor", irma.ActionDisclosing, disjunctions("irma-demo.RU.studentCard.university"))
+	require.False(t, allowed)
+	require.Equal(t, "irma-demo.RU.studentCard.university", reason)
+
+	// and more specific allow entries out of deny entries
+	allowed, _ = conf.CanVerifyOrSign("requestor", irma.ActionDisclosing, disjunctions("irma-demo.RU.studentCard.studentID"))
+	require.True(t, allowed)
+
+	// Deny entries apply to issuance too
+	conf.Requestors["requestor"] = Requestor{Permissions: Permissions{
+		Issuing: []string{"irma-demo.*", "!irma-demo.MijnOverheid.fullName"},
+	}}
+	allowed, reason = conf.CanIssue("requestor", []*irma.CredentialRequest{
+		{CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")},
+	})
+	require.False(t, allowed)
+	require.Equal(t, "irma-demo.MijnOverheid.fullName", reason)
+}
+
+func TestReloadRequestors(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.ErrorLevel
+	conf := &Configuration{
+		Configuration: &server.Configuration{
+			SchemesPath:          filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+			Logger:               logger,
+			DisableSchemesUpdate: true,
+		},
+	}
+	irmaserv, err := irmaserver.New(conf.Configuration)
+	require.NoError(t, err)
+	defer irmaserv.Stop()
+	defer setAuthenticators(nil)
+
+	studentID := irma.AttributeDisjunctionList{{
+		Label:      "foo",
+		Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+	}}
+	authenticated := func(token string) string {
+		headers := http.Header{}
+		headers.Set("Authorization", token)
+		requestor, _ := authenticateHeader(headers)
+		return requestor
+	}
+
+	require.NoError(t, conf.ReloadRequestors(map[string]Requestor{
+		"requestor1": {
+			AuthenticationMethod: AuthenticationMethodToken,
+			AuthenticationKey:    "token1",
+			Permissions:          Permissions{Disclosing: []string{"irma-demo.RU.*"}},
+		},
+	}))
+	require.Equal(t, "requestor1", authenticated("token1"))
+	allowed, _ := conf.CanVerifyOrSign("requestor1", irma.ActionDisclosing, studentID)
+	require.True(t, allowed)
+
+	// If any of the new requestors is invalid, none of them replaces the current ones
+	requestor2 := Requestor{
+		AuthenticationMethod: AuthenticationMethodToken,
+		AuthenticationKey:    "token2",
+		Permissions:          Permissions{Disclosing: []string{"irma-demo.RU.studentCard.studentID"}},
+	}
+	for _, invalid := range []Requestor{
+		{AuthenticationMethod: AuthenticationMethodToken, AuthenticationKey: "token3", ResultJwtPrivateKey: "not a key"},
+		{AuthenticationMethod: AuthenticationMethodPublicKey, AuthenticationKey: "not a key"},
+		{AuthenticationMethod: AuthenticationMethodToken, AuthenticationKey: "token3", Permissions: Permissions{Disclosing: []string{"irma-demo.RU"}}},
+		{AuthenticationMethod: "unknown"},
+	} {
+		require.Error(t, conf.ReloadRequestors(map[string]Requestor{"requestor2": requestor2, "requestor3": invalid}))
+		require.Equal(t, "requestor1", authenticated("token1"))
+		require.Equal(t, "", authenticated("token2"))
+		require.Len(t, conf.Requestors, 1)
+	}
+
+	// Valid requestors replace the current ones
+	require.NoError(t, conf.ReloadRequestors(map[string]Requestor{"requestor2": requestor2}))
+	require.Equal(t, "", authenticated("token1"))
+	require.Equal(t, "requestor2", authenticated("token2"))
+	allowed, _ = conf.CanVerifyOrSign("requestor1", irma.ActionDisclosing, studentID)
+	require.False(t, allowed)
+	allowed, _ = conf.CanVerifyOrSign("requestor2", irma.ActionDisclosing, studentID)
+	require.True(t, allowed)
+}
@@ -7,13 +7,13 @@ package requestorserver
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -27,12 +27,22 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// Default and maximum size in pixels of the QR codes rendered by GET /session/{token}/qr.png.
+const (
+	defaultQrSize = 300
+	maxQrSize     = 2000
+)
+
 // Server is a requestor server instance.
 type Server struct {
 	conf     *Configuration
 	irmaserv *irmaserver.Server
 	stop     chan struct{}
 	stopped  chan struct{}
+
+	// Cancelled when the server stops, aborting result callbacks in progress
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // Start the server. If successful then it will not return until Stop() is called.
@@ -132,6 +142,7 @@ func filterStopError(err error) error {
 }
 
 func (s *Server) Stop() {
+	s.cancel()
 	s.irmaserv.Stop()
 	s.stop <- struct{}{}
 	<-s.stopped
@@ -148,9 +159,12 @@ func New(config *Configuration) (*Server, error) {
 	if err := config.initialize(); err != nil {
 		return nil, err
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		conf:     config,
 		irmaserv: irmaserv,
+		ctx:      ctx,
+		cancel:   cancel,
 	}, nil
 }
 
@@ -189,15 +203,25 @@ func (s *Server) Handler() http.Handler {
 	// Server routes
 	router.Post("/session", s.handleCreate)
 	router.Delete("/session/{token}", s.handleDelete)
+	router.Post("/session/{token}/refresh", s.handleRefresh)
 	router.Get("/session/{token}/status", s.handleStatus)
 	router.Get("/session/{token}/statusevents", s.handleStatusEvents)
 	router.Get("/session/{token}/result", s.handleResult)
+	router.Get("/session/{token}/qr.png", s.handleQr)
 
 	// Routes for getting signed JWTs containing the session result. Only work if configuration has a private key
 	router.Get("/session/{token}/result-jwt", s.handleJwtResult)
 	router.Get("/session/{token}/getproof", s.handleJwtProofs) // irma_api_server-compatible JWT
 
 	router.Get("/publickey", s.handlePublicKey)
+	router.Get("/.well-known/jwks.json", s.handleJwks)
+	router.Get("/health", s.handleHealth)
+	router.Get("/issuable", s.handleIssuable)
+	router.Get("/schemes", s.handleSchemes)
+	router.Get("/schemas", s.handleSchemas)
+	router.Get("/schemas/{name}", s.handleSchemas)
+	router.Post("/reload-schemes", s.handleReloadSchemes)
+	router.Post("/scheme-update", s.handleSchemeUpdate)
 
 	return router
 }
@@ -225,6 +249,13 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
 	}
+	// Session requests in JWTs are parsed by the authenticators and not checked in strict mode
+	if s.conf.StrictRequests && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := irma.ValidateRequestSchema(body); err != nil {
+			server.WriteResponse(w, nil, server.RequestError(err))
+			return
+		}
+	}
 
 	// Authenticate request: check if the requestor is known and allowed to submit requests.
 	// We do this by feeding the HTTP POST details to all known authenticators, and see if
@@ -236,7 +267,7 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 		rerr      *irma.RemoteError
 		applies   bool
 	)
-	for _, authenticator := range authenticators { // rrequest abbreviates "requestor request"
+	for _, authenticator := range currentAuthenticators() { // rrequest abbreviates "requestor request"
 		applies, rrequest, requestor, rerr = authenticator.Authenticate(r.Header, body)
 		if applies || rerr != nil {
 			break
@@ -258,14 +289,28 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 	// the requested attributes or credentials
 	request = rrequest.SessionRequest()
 	if request.Action() == irma.ActionIssuing {
+		if id := s.conf.DeprecatedCredentialType(request.(*irma.IssuanceRequest).Credentials); id != nil {
+			server.WriteError(w, server.ErrorCredentialTypeDeprecated, id.String())
+			return
+		}
 		allowed, reason := s.conf.CanIssue(requestor, request.(*irma.IssuanceRequest).Credentials)
 		if !allowed {
 			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
-				Warn("Requestor not authorized to issue credential; full request: ", server.ToJson(request))
+				Warn("Requestor not authorized to issue credential or no usable private key; full request: ", server.ToJson(request))
 			server.WriteError(w, server.ErrorUnauthorized, reason)
 			return
 		}
 	}
+	if rrequest.Base().CredentialHashes && !s.conf.CanReceiveCredentialHashes(requestor) {
+		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor not authorized to receive credential hashes")
+		server.WriteError(w, server.ErrorUnauthorized, "credentialHashes")
+		return
+	}
+	if rrequest.Base().HashAttributeValues && !s.conf.CanHashAttributeValues(requestor) {
+		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor not authorized to hash attribute values")
+		server.WriteError(w, server.ErrorUnauthorized, "hashAttributeValues")
+		return
+	}
 	disjunctions := request.ToDisclose()
 	if len(disjunctions) > 0 {
 		allowed, reason := s.conf.CanVerifyOrSign(requestor, request.Action(), disjunctions)
@@ -276,23 +321,56 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	if rrequest.Base().CallbackUrl != "" && s.conf.jwtPrivateKey == nil {
+	if key, _ := s.conf.resultJwtSigning(requestor); rrequest.Base().CallbackUrl != "" && key == nil {
 		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor provided callbackUrl but no JWT private key is installed")
 		server.WriteError(w, server.ErrorUnsupported, "")
 		return
 	}
 
-	// Everything is authenticated and parsed, we're good to go!
-	qr, token, err := s.irmaserv.StartSession(rrequest, s.doResultCallback)
+	// Check whether the request asks for more attributes than needed
+	var hints []*server.MinimizationHint
+	if s.conf.minimizationRules != nil {
+		hints = s.conf.minimizationRules.Analyze(request.ToDisclose(), s.conf.requestor(requestor).Purpose)
+		for _, hint := range hints {
+			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "rule": hint.Rule, "attributes": hint.Attributes}).
+				Warn("Session request asks for more attributes than needed: ", hint.Message)
+		}
+		if len(hints) > 0 && s.conf.requestor(requestor).StrictMinimization {
+			server.WriteError(w, server.ErrorExcessiveRequest, fmt.Sprintf("%s: %s", hints[0].Rule, hints[0].Message))
+			return
+		}
+	}
+
+	// Everything is authenticated and parsed, we're good to go! The requestor is kept in the
+	// request of the session, determining e.g. with which key its result JWTs are signed
+	rrequest.SetRequestor(requestor)
+	qr, token, err := s.irmaserv.StartSessionContext(r.Context(), rrequest, s.doResultCallback)
 	if err != nil {
-		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		server.WriteResponse(w, nil, server.RequestError(err))
 		return
 	}
 
-	server.WriteJson(w, server.SessionPackage{
+	pkg := s.sessionPackage(qr, token)
+	if s.conf.MinimizationHints {
+		pkg.MinimizationHints = hints
+	}
+	server.WriteJson(w, pkg)
+}
+
+// sessionPackage returns the session package containing the specified session pointer.
+func (s *Server) sessionPackage(qr *irma.Qr, token string) *server.SessionPackage {
+	pkg := &server.SessionPackage{
 		SessionPtr: qr,
 		Token:      token,
-	})
+	}
+	if s.conf.CompactSessionPointers {
+		pkg.CompactSessionPtr = qr.CompactLink()
+	}
+	if s.conf.AppLinkDomain != "" {
+		pkg.Link = qr.Link()
+		pkg.UniversalLink = qr.UniversalLink(s.conf.AppLinkDomain)
+	}
+	return pkg
 }
 
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -301,6 +379,9 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
 		return
 	}
+	if qr := s.irmaserv.GetSessionPtr(chi.URLParam(r, "token")); qr != nil && qr.Expiry != nil {
+		w.Header().Set(irma.SessionExpiryHeader, qr.Expiry.String())
+	}
 	server.WriteJson(w, res.Status)
 }
 
@@ -316,6 +397,18 @@ func (s *Server) handleStatusEvents(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleRefresh issues a new session pointer for the session, if the IRMA app has not yet
+// connected to it, returning it in a session package.
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	qr, err := s.irmaserv.RefreshSession(token)
+	if err != nil {
+		server.WriteResponse(w, nil, server.RequestError(err))
+		return
+	}
+	server.WriteJson(w, s.sessionPackage(qr, token))
+}
+
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	err := s.irmaserv.CancelSession(chi.URLParam(r, "token"))
 	if err != nil {
@@ -332,14 +425,40 @@ func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
 	server.WriteJson(w, res)
 }
 
+// handleQr renders the session pointer of the session as a QR code in a PNG image, of which the
+// size in pixels may be specified in the size query parameter.
+func (s *Server) handleQr(w http.ResponseWriter, r *http.Request) {
+	qr := s.irmaserv.GetSessionPtr(chi.URLParam(r, "token"))
+	if qr == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	size := defaultQrSize
+	if param := r.URL.Query().Get("size"); param != "" {
+		var err error
+		if size, err = strconv.Atoi(param); err != nil || size <= 0 || size > maxQrSize {
+			server.WriteError(w, server.ErrorInvalidRequest, "invalid QR size")
+			return
+		}
+	}
+	bts, err := server.QrPNG(qr, s.conf.CompactSessionPointers, size)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(bts)
+}
+
 func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
-	if s.conf.jwtPrivateKey == nil {
+	sessiontoken := chi.URLParam(r, "token")
+	if key, _ := s.resultJwtSigning(sessiontoken); key == nil {
 		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
 	}
 
-	sessiontoken := chi.URLParam(r, "token")
 	res := s.irmaserv.GetSessionResult(sessiontoken)
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
@@ -357,13 +476,14 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
-	if s.conf.jwtPrivateKey == nil {
+	sessiontoken := chi.URLParam(r, "token")
+	key, issuer := s.resultJwtSigning(sessiontoken)
+	if key == nil {
 		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
 	}
 
-	sessiontoken := chi.URLParam(r, "token")
 	res := s.irmaserv.GetSessionResult(sessiontoken)
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
@@ -385,28 +505,33 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	claims["iat"] = time.Now().Unix()
-	if s.conf.JwtIssuer != "" {
-		claims["iss"] = s.conf.JwtIssuer
+	if issuer != "" {
+		claims["iss"] = issuer
 	}
 	claims["status"] = res.ProofStatus
+	if res.ProofStatusReason != irma.ProofStatusReasonNone {
+		claims["statusReason"] = res.ProofStatusReason
+	}
 	validity := s.irmaserv.GetRequest(sessiontoken).Base().ResultJwtValidity
 	if validity != 0 {
 		claims["exp"] = time.Now().Unix() + int64(validity)
 	}
 
-	// Disclosed credentials and possibly signature
-	m := make(map[irma.AttributeTypeIdentifier]string, len(res.Disclosed))
+	// Disclosed credentials and possibly signature; absent attributes are null
+	m := make(map[irma.AttributeTypeIdentifier]*string, len(res.Disclosed))
 	for _, attr := range res.Disclosed {
-		m[attr.Identifier] = attr.Value[""]
+		m[attr.Identifier] = attr.RawValue
 	}
 	claims["attributes"] = m
+	if len(res.Disjunctions) > 0 {
+		claims["disjunctions"] = res.Disjunctions
+	}
 	if res.Signature != nil {
 		claims["signature"] = res.Signature
 	}
 
 	// Sign the jwt and return it
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	resultJwt, err := token.SignedString(s.conf.jwtPrivateKey)
+	resultJwt, err := key.sign(claims)
 	if err != nil {
 		s.conf.Logger.Error("Failed to sign session result JWT")
 		_ = server.LogError(err)
@@ -416,49 +541,189 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 	server.WriteString(w, resultJwt)
 }
 
+// handlePublicKey returns the PEM-encoded public key against which the JWTs of the server verify,
+// or a 404 error if it has no JWT private key.
 func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
-	if s.conf.jwtPrivateKey == nil {
-		server.WriteError(w, server.ErrorUnsupported, "")
+	pubBytes, err := s.conf.JwtPublicKeyPEM()
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	if pubBytes == nil {
+		server.WriteError(w, server.ErrorNoJwtKey, "")
 		return
 	}
+	_, _ = w.Write(pubBytes)
+}
 
-	bts, err := x509.MarshalPKIXPublicKey(&s.conf.jwtPrivateKey.PublicKey)
+// handleJwks returns the JSON Web Key Set containing the public keys against which the JWTs of
+// the server verify, or a 404 error if it has no JWT private key.
+func (s *Server) handleJwks(w http.ResponseWriter, r *http.Request) {
+	set, err := s.conf.JwtKeySet()
 	if err != nil {
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
 	}
-	pubBytes := pem.EncodeToMemory(&pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: bts,
+	if set == nil {
+		server.WriteError(w, server.ErrorNoJwtKey, "")
+		return
+	}
+	server.WriteJson(w, set)
+}
+
+// HealthReport is returned by the /health endpoint.
+type HealthReport struct {
+	*irma.ConfigurationReport
+	server.SchemesReloadStatus
+}
+
+// handleHealth reports the problems encountered while parsing the schemes, and the outcome of reloading them.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	server.WriteJson(w, HealthReport{
+		ConfigurationReport: s.conf.CurrentIrmaConfiguration().Report(),
+		SchemesReloadStatus: s.irmaserv.SchemesReloadStatus(),
 	})
-	_, _ = w.Write(pubBytes)
+}
+
+// handleIssuable lists the credential types in the schemes, and whether they can currently be issued.
+func (s *Server) handleIssuable(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authenticateHeader(r.Header); !ok {
+		server.WriteError(w, server.ErrorUnauthorized, "")
+		return
+	}
+	types, err := s.conf.IssuableCredentialTypes()
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	server.WriteJson(w, types)
+}
+
+// handleReloadSchemes reloads the schemes if they were changed on disk, returning how they changed.
+func (s *Server) handleReloadSchemes(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authenticateHeader(r.Header); !ok {
+		server.WriteError(w, server.ErrorUnauthorized, "")
+		return
+	}
+	diff, err := s.irmaserv.ReloadSchemes()
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	server.WriteJson(w, diff)
+}
+
+// handleSchemeUpdate updates the scheme announced by the posted scheme update announcement,
+// returning how the schemes changed, if enabled by SchemeUpdateAnnouncements. Instead of requestor
+// authentication, the announcement must be signed by the announced scheme.
+func (s *Server) handleSchemeUpdate(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	var announcement irma.SignedSchemeUpdateAnnouncement
+	if err = json.Unmarshal(body, &announcement); err != nil {
+		s.conf.Logger.Warn("Dropping malformed scheme update announcement")
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	// Refused announcements result in 400, failed updates in 500
+	diff, err := s.irmaserv.UpdateAnnouncedScheme(&announcement)
+	if err != nil {
+		server.WriteResponse(w, nil, server.RequestError(err))
+		return
+	}
+	server.WriteJson(w, diff)
+}
+
+// handleSchemes returns the JSON document describing the schemes (see irma.Configuration.MarshalSchemeJSON()),
+// supporting conditional requests using its ETag.
+func (s *Server) handleSchemes(w http.ResponseWriter, r *http.Request) {
+	irmaconf := s.conf.CurrentIrmaConfiguration()
+	etag, err := irmaconf.SchemeJSONETag()
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	bts, _, err := irmaconf.MarshalSchemeJSON()
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bts)
+}
+
+// handleSchemas returns the JSON Schemas of session requests (see irma.RequestSchemas()), or if a
+// name is specified the one of the session request type of that name, e.g. DisclosureRequest.
+func (s *Server) handleSchemas(w http.ResponseWriter, r *http.Request) {
+	schemas := irma.RequestSchemas()
+	name := chi.URLParam(r, "name")
+	if name == "" {
+		server.WriteJson(w, schemas)
+		return
+	}
+	schema, ok := schemas[strings.TrimSuffix(name, ".json")]
+	if !ok {
+		server.WriteError(w, server.ErrorInvalidRequest, "unknown schema")
+		return
+	}
+	server.WriteJson(w, schema)
 }
 
 func (s *Server) resultJwt(sessionresult *server.SessionResult) (string, error) {
+	key, issuer := s.resultJwtSigning(sessionresult.Token)
+	if key == nil {
+		return "", errors.New("no JWT private key configured")
+	}
 	claims := struct {
 		jwt.StandardClaims
 		*server.SessionResult
+		Claims map[string]interface{} `json:"claims,omitempty"`
 	}{
 		StandardClaims: jwt.StandardClaims{
-			Issuer:   s.conf.JwtIssuer,
+			Issuer:   issuer,
 			IssuedAt: time.Now().Unix(),
 			Subject:  string(sessionresult.Type) + "_result",
 		},
 		SessionResult: sessionresult,
 	}
+	if s.conf.JwtClaims {
+		mapping := s.conf.JwtClaimMapping
+		if len(mapping) == 0 {
+			mapping = server.DefaultClaimMapping
+		}
+		claims.Claims = mapping.Claims(s.conf.CurrentIrmaConfiguration(), sessionresult)
+	}
 	validity := s.irmaserv.GetRequest(sessionresult.Token).Base().ResultJwtValidity
 	if validity != 0 {
 		claims.ExpiresAt = time.Now().Unix() + int64(validity)
 	}
 
 	// Sign the jwt and return it
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	return token.SignedString(s.conf.jwtPrivateKey)
+	return key.sign(claims)
+}
+
+// resultJwtSigning returns the private key and issuer with which to sign the result JWTs
+// of the specified session, depending on the requestor that started it.
+func (s *Server) resultJwtSigning(token string) (*resultJwtKey, string) {
+	var requestor string
+	if request := s.irmaserv.GetRequest(token); request != nil {
+		requestor = request.Base().Requestor
+	}
+	return s.conf.resultJwtSigning(requestor)
 }
 
 func (s *Server) doResultCallback(result *server.SessionResult) {
 	callbackUrl := s.irmaserv.GetRequest(result.Token).Base().CallbackUrl
-	if callbackUrl == "" || s.conf.jwtPrivateKey == nil {
+	if key, _ := s.resultJwtSigning(result.Token); callbackUrl == "" || key == nil {
 		return
 	}
 	s.conf.Logger.WithFields(logrus.Fields{"session": result.Token, "callbackUrl": callbackUrl}).Debug("POSTing session result")
@@ -470,7 +735,9 @@ func (s *Server) doResultCallback(result *server.SessionResult) {
 	}
 
 	var x string // dummy for the server's return value that we don't care about
-	if err := irma.NewHTTPTransport(callbackUrl).Post("", &x, j); err != nil {
+	transport := irma.NewHTTPTransport(callbackUrl)
+	transport.SetContext(s.ctx)
+	if err := transport.Post("", &x, j); err != nil {
 		// not our problem, log it and go on
 		s.conf.Logger.Warn(errors.WrapPrefix(err, "Failed to POST session result to callback URL", 0))
 	}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// RevocationChecker determines whether the credentials of disclosed attributes were revoked,
+// in sessions whose request asks for this (see irma.BaseRequest.RevocationCheck). After verifying
+// the proofs, the IRMA server calls Revoked() once for each disclosed credential, with the first
+// of its disclosed attributes, whose CredentialHash identifies the credential instance and whose
+// Identifier, IssuanceTime and Expires describe its metadata.
+//
+// As the credential hash is computed from the disclosed attributes, it identifies the instance
+// only among disclosures of the same attributes of the credential.
+type RevocationChecker interface {
+	Revoked(attr *irma.DisclosedAttribute) (bool, error)
+}
+
+// ListRevocationChecker is a RevocationChecker using a list of the credential hashes of revoked
+// credentials, one per line, in a file or at an HTTP(S) URL. Empty lines and lines starting with
+// # are ignored.
+type ListRevocationChecker struct {
+	// Path of the file or HTTP(S) URL of the list
+	Source string
+	// How long the list is used before it is read again; 0 to read it at every check
+	CacheDuration time.Duration
+
+	mutex   sync.Mutex
+	revoked map[string]struct{}
+	read    time.Time
+}
+
+func (c *ListRevocationChecker) Revoked(attr *irma.DisclosedAttribute) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.revoked == nil || time.Since(c.read) >= c.CacheDuration {
+		revoked, err := c.readList()
+		if err != nil {
+			return false, err
+		}
+		c.revoked, c.read = revoked, time.Now()
+	}
+	_, revoked := c.revoked[attr.CredentialHash]
+	return revoked, nil
+}
+
+func (c *ListRevocationChecker) readList() (map[string]struct{}, error) {
+	var bts []byte
+	var err error
+	if strings.HasPrefix(c.Source, "http://") || strings.HasPrefix(c.Source, "https://") {
+		bts, err = c.download()
+	} else {
+		bts, err = ioutil.ReadFile(c.Source)
+	}
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to read revocation list", 0)
+	}
+
+	revoked := map[string]struct{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(bts))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		revoked[line] = struct{}{}
+	}
+	return revoked, scanner.Err()
+}
+
+func (c *ListRevocationChecker) download() ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(c.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s returned status %d", c.Source, res.StatusCode)
+	}
+	return ioutil.ReadAll(res.Body)
+}
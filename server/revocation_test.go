@@ -0,0 +1,63 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListRevocationChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "revoked")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# revoked credentials\nabc\n\n  def  \n"), 0600))
+
+	revoked := func(checker RevocationChecker, hash string) bool {
+		r, err := checker.Revoked(&irma.DisclosedAttribute{CredentialHash: hash})
+		require.NoError(t, err)
+		return r
+	}
+
+	checker := &ListRevocationChecker{Source: path}
+	require.True(t, revoked(checker, "abc"))
+	require.True(t, revoked(checker, "def"))
+	require.False(t, revoked(checker, "ghi"))
+	require.False(t, revoked(checker, "# revoked credentials"))
+
+	// Without caching, changes to the list apply immediately
+	require.NoError(t, ioutil.WriteFile(path, []byte("ghi\n"), 0600))
+	require.True(t, revoked(checker, "ghi"))
+	require.False(t, revoked(checker, "abc"))
+
+	// With caching, the list is read again only after the cache duration
+	cached := &ListRevocationChecker{Source: path, CacheDuration: time.Hour}
+	require.True(t, revoked(cached, "ghi"))
+	require.NoError(t, ioutil.WriteFile(path, []byte("abc\n"), 0600))
+	require.True(t, revoked(cached, "ghi"))
+	require.False(t, revoked(cached, "abc"))
+
+	// The list can be served over HTTP
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/revoked" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("jkl\n"))
+	}))
+	defer ts.Close()
+	require.True(t, revoked(&ListRevocationChecker{Source: ts.URL + "/revoked"}, "jkl"))
+
+	// Unreadable lists are reported instead of treating credentials as not revoked
+	_, err = (&ListRevocationChecker{Source: ts.URL + "/other"}).Revoked(&irma.DisclosedAttribute{CredentialHash: "jkl"})
+	require.Error(t, err)
+	_, err = (&ListRevocationChecker{Source: filepath.Join(dir, "nonexisting")}).Revoked(&irma.DisclosedAttribute{})
+	require.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package smoketest
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// clientHandler is the irmaclient.ClientHandler of the test client, which does not enroll
+// to keyshare servers or change PINs.
+type clientHandler struct{}
+
+func (clientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet)                           {}
+func (clientHandler) UpdateAttributes()                                                         {}
+func (clientHandler) ResumableSessions(sessions []*irmaclient.ResumableSession)                 {}
+func (clientHandler) KeyshareEnrollmentInvalid(manager irma.SchemeManagerIdentifier, err error) {}
+func (clientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier)                    {}
+func (clientHandler) EnrollmentFailure(manager irma.SchemeManagerIdentifier, err error)         {}
+func (clientHandler) ChangePinSuccess(manager irma.SchemeManagerIdentifier)                     {}
+func (clientHandler) ChangePinFailure(manager irma.SchemeManagerIdentifier, err error)          {}
+func (clientHandler) ChangePinIncorrect(manager irma.SchemeManagerIdentifier, attempts int)     {}
+func (clientHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int)        {}
+
+// sessionHandler is the irmaclient.Handler of the sessions of the test client. It approves
+// everything, disclosing the first candidate of each disjunction, and sends the outcome of
+// the session to done.
+type sessionHandler struct {
+	client *irmaclient.Client
+	pin    string
+	done   chan error
+}
+
+// Force sessionHandler to implement the Handler interface
+var _ irmaclient.Handler = (*sessionHandler)(nil)
+
+func newSessionHandler(client *irmaclient.Client, pin string) *sessionHandler {
+	return &sessionHandler{client: client, pin: pin, done: make(chan error, 1)}
+}
+
+// finish reports the outcome of the session, ignoring all but the first.
+func (h *sessionHandler) finish(err error) {
+	select {
+	case h.done <- err:
+	default:
+	}
+}
+
+func (h *sessionHandler) StatusUpdate(action irma.Action, status irma.Status) {}
+func (h *sessionHandler) Success(result string) {
+	h.finish(nil)
+}
+func (h *sessionHandler) Cancelled() {
+	h.finish(errors.New("Session cancelled"))
+}
+func (h *sessionHandler) Failure(err *irma.SessionError) {
+	h.finish(err)
+}
+func (h *sessionHandler) UnsatisfiableRequest(serverName irma.TranslatedString, missing []*irmaclient.MissingDisjunction) {
+	h.finish(errors.New("Session request not satisfiable with the credentials of the test client"))
+}
+
+func (h *sessionHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.finish(errors.Errorf("Keyshare account at %s blocked", manager.String()))
+}
+func (h *sessionHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.finish(errors.Errorf("Keyshare enrollment at %s incomplete", manager.String()))
+}
+func (h *sessionHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.finish(errors.Errorf("Not enrolled at keyshare server of %s", manager.String()))
+}
+func (h *sessionHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	h.finish(errors.Errorf("Keyshare enrollment at %s deleted", manager.String()))
+}
+
+func (h *sessionHandler) RequestVerificationPermission(request irma.DisclosureRequest, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	choice := &irma.DisclosureChoice{Attributes: []*irma.AttributeIdentifier{}}
+	for _, disjunction := range request.Content {
+		candidates := h.client.Candidates(disjunction)
+		if len(candidates) == 0 {
+			if !disjunction.Optional {
+				h.finish(errors.New("No disclosure candidates found"))
+				callback(false, nil)
+				return
+			}
+			choice.Attributes = append(choice.Attributes, nil) // skip it
+			continue
+		}
+		choice.Attributes = append(choice.Attributes, candidates[0])
+	}
+	callback(true, choice)
+}
+func (h *sessionHandler) RequestIssuancePermission(request irma.IssuanceRequest, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	h.RequestVerificationPermission(irma.DisclosureRequest{
+		BaseRequest: request.BaseRequest,
+		Content:     request.Disclose,
+	}, serverName, callback)
+}
+func (h *sessionHandler) RequestSignaturePermission(request irma.SignatureRequest, serverName irma.TranslatedString, callback irmaclient.PermissionHandler) {
+	h.RequestVerificationPermission(request.DisclosureRequest, serverName, callback)
+}
+func (h *sessionHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	callback(true)
+}
+func (h *sessionHandler) RequestSchemeManagerInstallPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	callback(true)
+}
+func (h *sessionHandler) RequestThrottledSessionConfirmation(origin string, sessions int, callback func(proceed bool)) {
+	callback(true)
+}
+func (h *sessionHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
+	if remainingAttempts == -1 { // -1 signifies that this is the first attempt
+		callback(true, h.pin)
+		return
+	}
+	h.finish(errors.New("PIN incorrect"))
+	callback(false, "")
+}
@@ -0,0 +1,242 @@
+// Package smoketest performs complete IRMA sessions against an IRMA server without a phone,
+// for testing deployments of the IRMA server. Run() starts a session at the requestor endpoints
+// of the server and performs it using a headless IRMA client with throwaway storage, which
+// approves everything. The client obtains the credentials it needs for the session beforehand,
+// by restoring a backup of an existing client storage (see Storage.Backup()) and/or by issuance
+// using a local IRMA server with the private keys of the issuers.
+//
+// Example:
+//
+//	result, err := smoketest.Run(
+//		&smoketest.Requestor{URL: "https://irma.example.com", AuthMethod: "token", Key: "mytoken"},
+//		request,
+//		&smoketest.Options{
+//			SchemesPath:     "irma_configuration",
+//			PrivateKeysPath: "privatekeys",
+//			Credentials:     credentials,
+//		},
+//	)
+package smoketest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is the timeout of the sessions of Run() if Options.Timeout is not set.
+const DefaultTimeout = time.Minute
+
+// Requestor specifies the IRMA server at which Run() starts the session, and how it
+// authenticates as requestor, as in the irma session command.
+type Requestor struct {
+	// URL of the requestor endpoints of the server, e.g. https://irma.example.com
+	URL string
+	// Authentication method of the requestor: none, token, hmac or rsa
+	AuthMethod string
+	// Token, Base64-encoded HMAC key or PEM-encoded RSA private key of the requestor,
+	// or path to a file containing it
+	Key string
+	// Name of the requestor, for the hmac and rsa authentication methods
+	Name string
+}
+
+// Options configure the test client of Run().
+type Options struct {
+	// Path to the irma_configuration folder containing the schemes of the IRMA server
+	SchemesPath string
+
+	// Backup of the storage of a client (see Storage.Backup()) whose credentials and keyshare
+	// enrollments the test client uses
+	Backup []byte
+	// PIN of the keyshare enrollments in Backup
+	Pin string
+
+	// Credentials issued to the test client before the session by a local IRMA server, using
+	// the issuer private keys in PrivateKeysPath
+	Credentials     []*irma.CredentialRequest
+	PrivateKeysPath string
+
+	// Maximum duration of each session of the test client; DefaultTimeout if zero
+	Timeout time.Duration
+	// Logger of the local IRMA server; if nil, it logs only errors
+	Logger *logrus.Logger
+}
+
+// Run performs a complete session of the specified request at the IRMA server of the requestor,
+// using a headless test client set up according to the options, and returns the session result
+// retrieved from the server. The request may be of any type accepted by irmaserver.StartSession().
+// An error is returned if the session could not be started or the test client did not complete it.
+func Run(requestor *Requestor, request interface{}, options *Options) (*server.SessionResult, error) {
+	rrequest, err := server.ParseSessionRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var storage *Storage
+	if options.Backup != nil {
+		storage, err = NewStorageFromBackup(options.Backup)
+	} else {
+		storage, err = NewStorage()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Remove()
+
+	client, err := irmaclient.New(storage.Path, options.SchemesPath, "", clientHandler{})
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to create test client", 0)
+	}
+	if len(options.Credentials) > 0 {
+		if err = issueLocally(client, options); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to issue test credentials", 0)
+		}
+	}
+
+	qr, transport, err := startSession(requestor, rrequest)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to start session", 0)
+	}
+	if err = clientSession(client, qr, options); err != nil {
+		return nil, errors.WrapPrefix(err, "Test client failed to perform session", 0)
+	}
+
+	result := &server.SessionResult{}
+	if err = transport.Get("result", result); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to get session result", 0)
+	}
+	return result, nil
+}
+
+// issueLocally issues the credentials of the options to the client using an IRMA server
+// listening on a random local port.
+func issueLocally(client *irmaclient.Client, options *Options) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = server.NewLogger(0, true, false)
+	}
+	irmaServer, err := irmaserver.New(&server.Configuration{
+		URL:                   "http://" + listener.Addr().String(),
+		Logger:                logger,
+		SchemesPath:           options.SchemesPath,
+		IssuerPrivateKeysPath: options.PrivateKeysPath,
+		DisableSchemesUpdate:  true,
+	})
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+	defer irmaServer.Stop()
+	httpServer := &http.Server{Handler: irmaServer.HandlerFunc()}
+	go func() {
+		_ = httpServer.Serve(listener)
+	}()
+	defer httpServer.Close()
+
+	qr, _, err := irmaServer.StartSession(&irma.IssuanceRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionIssuing},
+		Credentials: options.Credentials,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return clientSession(client, qr, options)
+}
+
+// startSession starts the session at the IRMA server of the requestor, returning the session
+// pointer for the client and a transport to the requestor endpoints of the session.
+func startSession(requestor *Requestor, request irma.RequestorRequest) (*irma.Qr, *irma.HTTPTransport, error) {
+	var (
+		err       error
+		pkg       = &server.SessionPackage{}
+		transport = irma.NewHTTPTransport(requestor.URL)
+	)
+
+	switch requestor.AuthMethod {
+	case "", "none":
+		err = transport.Post("session", pkg, request)
+	case "token":
+		transport.SetHeader("Authorization", requestor.Key)
+		err = transport.Post("session", pkg, request)
+	case "hmac", "rsa":
+		var jwtstr string
+		if jwtstr, err = signRequest(requestor, request); err != nil {
+			return nil, nil, err
+		}
+		err = transport.Post("session", pkg, jwtstr)
+	default:
+		return nil, nil, errors.New("Invalid authentication method (must be none, token, hmac or rsa)")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transport.Server += fmt.Sprintf("session/%s/", pkg.Token)
+	return pkg.SessionPtr, transport, nil
+}
+
+func signRequest(requestor *Requestor, request irma.RequestorRequest) (string, error) {
+	var (
+		err    error
+		sk     interface{}
+		jwtalg jwt.SigningMethod
+		bts    []byte
+	)
+	// If the key refers to an existing file, use contents of the file as key
+	if bts, err = fs.ReadKey("", requestor.Key); err != nil {
+		bts = []byte(requestor.Key)
+	}
+	switch requestor.AuthMethod {
+	case "hmac":
+		jwtalg = jwt.SigningMethodHS256
+		if sk, err = fs.Base64Decode(bts); err != nil {
+			return "", err
+		}
+	case "rsa":
+		jwtalg = jwt.SigningMethodRS256
+		if sk, err = jwt.ParseRSAPrivateKeyFromPEM(bts); err != nil {
+			return "", err
+		}
+	}
+	return irma.SignRequestorRequest(request, jwtalg, sk, requestor.Name)
+}
+
+// clientSession performs the session to which the session pointer refers using the client,
+// dismissing it if it takes longer than the timeout of the options.
+func clientSession(client *irmaclient.Client, qr *irma.Qr, options *Options) error {
+	bts, err := json.Marshal(qr)
+	if err != nil {
+		return err
+	}
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	handler := newSessionHandler(client, options.Pin)
+	dismisser := client.NewSession(string(bts), handler)
+	select {
+	case err = <-handler.done:
+		return err
+	case <-time.After(timeout):
+		if dismisser != nil {
+			dismisser.Dismiss()
+		}
+		return errors.New("Session timed out")
+	}
+}
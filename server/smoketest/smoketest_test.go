@@ -0,0 +1,141 @@
+package smoketest_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/privacybydesign/irmago/server/smoketest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+const hmacKey = "eGE2PSomOT84amVVdTU+LmYtJXJWZ2BmNjNwSGltCg=="
+
+var testdata = test.FindTestdataFolder(nil)
+
+func TestMain(m *testing.M) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	logger := logrus.New()
+	logger.Level = logrus.ErrorLevel
+	conf := &requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                  "http://localhost:48683/irma",
+			Logger:               logger,
+			SchemesPath:          filepath.Join(testdata, "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		Port: 48683,
+		Permissions: requestorserver.Permissions{
+			Disclosing: []string{"*"},
+		},
+		Requestors: map[string]requestorserver.Requestor{
+			"tokenrequestor": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:    "smoketesttoken",
+			},
+			"hmacrequestor": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodHmac,
+				AuthenticationKey:    hmacKey,
+			},
+		},
+		JwtPrivateKeyFile: filepath.Join(testdata, "jwtkeys", "sk.pem"),
+	}
+	requestorServer, err := requestorserver.New(conf)
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		_ = requestorServer.Start(conf)
+	}()
+	time.Sleep(100 * time.Millisecond) // Give server time to start
+
+	code := m.Run()
+	requestorServer.Stop()
+	os.Exit(code)
+}
+
+func disclosureRequest(id irma.AttributeTypeIdentifier) *irma.DisclosureRequest {
+	return &irma.DisclosureRequest{
+		BaseRequest: irma.BaseRequest{Type: irma.ActionDisclosing},
+		Content: irma.AttributeDisjunctionList{{
+			Label:      "foo",
+			Attributes: []irma.AttributeTypeIdentifier{id},
+		}},
+	}
+}
+
+func TestRunWithLocalIssuance(t *testing.T) {
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result, err := smoketest.Run(
+		&smoketest.Requestor{URL: "http://localhost:48683", AuthMethod: "token", Key: "smoketesttoken"},
+		disclosureRequest(id),
+		&smoketest.Options{
+			SchemesPath:     filepath.Join(testdata, "irma_configuration"),
+			PrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+			Credentials: []*irma.CredentialRequest{{
+				CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+				Attributes: map[string]string{
+					"university":        "Radboud",
+					"studentCardNumber": "31415927",
+					"studentID":         "s1234567",
+					"level":             "42",
+				},
+			}},
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Len(t, result.Disclosed, 1)
+	require.Equal(t, id, result.Disclosed[0].Identifier)
+	require.Equal(t, "s1234567", result.Disclosed[0].Value["en"])
+}
+
+func TestRunWithBackup(t *testing.T) {
+	storage, err := smoketest.NewStorageFromDirectory(filepath.Join(testdata, "teststorage"))
+	require.NoError(t, err)
+	backup, err := storage.Backup()
+	require.NoError(t, err)
+	require.NoError(t, storage.Remove())
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result, err := smoketest.Run(
+		&smoketest.Requestor{URL: "http://localhost:48683", AuthMethod: "hmac", Key: hmacKey, Name: "hmacrequestor"},
+		disclosureRequest(id),
+		&smoketest.Options{
+			SchemesPath: filepath.Join(testdata, "irma_configuration"),
+			Backup:      backup,
+			Pin:         "12345",
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, "456", result.Disclosed[0].Value["en"])
+}
+
+func TestRunUnsatisfiable(t *testing.T) {
+	_, err := smoketest.Run(
+		&smoketest.Requestor{URL: "http://localhost:48683", AuthMethod: "token", Key: "smoketesttoken"},
+		disclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")),
+		&smoketest.Options{SchemesPath: filepath.Join(testdata, "irma_configuration"), Timeout: 10 * time.Second},
+	)
+	require.Error(t, err)
+}
+
+func TestRunUnauthorized(t *testing.T) {
+	_, err := smoketest.Run(
+		&smoketest.Requestor{URL: "http://localhost:48683", AuthMethod: "token", Key: "wrongtoken"},
+		disclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+		&smoketest.Options{SchemesPath: filepath.Join(testdata, "irma_configuration")},
+	)
+	require.Error(t, err)
+}
@@ -0,0 +1,65 @@
+package smoketest
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// Storage is a throwaway storage directory for an irmaclient.Client, that can be backed up
+// and restored as a single blob.
+type Storage struct {
+	Path string
+}
+
+// NewStorage creates a new, empty storage directory in the temp directory of the OS.
+func NewStorage() (*Storage, error) {
+	path, err := ioutil.TempDir("", "irmatest")
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to create storage", 0)
+	}
+	return &Storage{Path: path}, nil
+}
+
+// NewStorageFromDirectory creates a new storage directory containing a copy of the specified
+// client storage directory, which is not modified by clients using the new storage.
+func NewStorageFromDirectory(src string) (*Storage, error) {
+	if err := fs.AssertPathExists(src); err != nil {
+		return nil, err
+	}
+	s, err := NewStorage()
+	if err != nil {
+		return nil, err
+	}
+	if err = fs.CopyDirectory(src, s.Path); err != nil {
+		_ = s.Remove()
+		return nil, errors.WrapPrefix(err, "Failed to copy storage", 0)
+	}
+	return s, nil
+}
+
+// NewStorageFromBackup creates a new storage directory out of a backup made by Storage.Backup().
+func NewStorageFromBackup(backup []byte) (*Storage, error) {
+	s, err := NewStorage()
+	if err != nil {
+		return nil, err
+	}
+	if err = fs.ExtractArchive(backup, s.Path); err != nil {
+		_ = s.Remove()
+		return nil, errors.WrapPrefix(err, "Failed to restore storage backup", 0)
+	}
+	return s, nil
+}
+
+// Backup returns the contents of the storage as a blob, from which NewStorageFromBackup()
+// restores it. No client should be using the storage while it is backed up.
+func (s *Storage) Backup() ([]byte, error) {
+	return fs.ArchiveDirectory(s.Path)
+}
+
+// Remove removes the storage directory and everything in it.
+func (s *Storage) Remove() error {
+	return os.RemoveAll(s.Path)
+}
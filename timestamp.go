@@ -31,7 +31,11 @@ func GetTimestamp(message string, sigs []*big.Int, disclosed [][]*big.Int) (*atu
 // and the disclosed attributes.
 func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int) ([]byte, error) {
 	msgHash := sha256.Sum256([]byte(message))
+	return timestampRequest(msgHash[:], sigs, disclosed)
+}
 
+// timestampRequest is like TimestampRequest, given the SHA-256 digest of the message.
+func timestampRequest(msgHash []byte, sigs []*big.Int, disclosed [][]*big.Int) ([]byte, error) {
 	// Convert the sigs and disclosed (double) slices to (double) slices of gobig.Int's for asn1
 	sigsint := make([]*gobig.Int, len(sigs))
 	disclosedint := make([][]*gobig.Int, len(disclosed))
@@ -49,7 +53,7 @@ func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int) (
 		MsgHash   []byte
 		Disclosed [][]*gobig.Int
 	}{
-		sigsint, msgHash[:], disclosedint,
+		sigsint, msgHash, disclosedint,
 	})
 	if err != nil {
 		return nil, err
@@ -64,6 +68,12 @@ const TimestampServerURL = "https://metrics.privacybydesign.foundation/atum"
 // Given an SignedMessage, verify the timestamp over the signed message, disclosed attributes,
 // and rerandomized CL-signatures.
 func (sm *SignedMessage) VerifyTimestamp(message string, conf *Configuration) error {
+	msgHash := sha256.Sum256([]byte(message))
+	return sm.verifyTimestamp(msgHash[:], conf)
+}
+
+// verifyTimestamp is like VerifyTimestamp, given the SHA-256 digest of the message.
+func (sm *SignedMessage) verifyTimestamp(msgHash []byte, conf *Configuration) error {
 	if sm.Timestamp.ServerUrl != TimestampServerURL {
 		return errors.New("Untrusted timestamp server")
 	}
@@ -93,7 +103,7 @@ func (sm *SignedMessage) VerifyTimestamp(message string, conf *Configuration) er
 		}
 	}
 
-	bts, err := TimestampRequest(message, sigs, disclosed)
+	bts, err := timestampRequest(msgHash, sigs, disclosed)
 	if err != nil {
 		return err
 	}
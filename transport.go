@@ -2,13 +2,19 @@ package irma
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
@@ -26,8 +32,33 @@ type HTTPTransport struct {
 	Server  string
 	client  *retryablehttp.Client
 	headers map[string]string
+
+	inner     *http.Transport
+	ctx       context.Context
+	pins      []string
+	subsystem string
+	timedOut  bool
 }
 
+// Subsystems of the client that send HTTP requests, as reported in timeout errors.
+const (
+	SubsystemSession  = "session"
+	SubsystemKeyshare = "keyshare"
+	SubsystemScheme   = "scheme"
+)
+
+// Default timeouts of HTTP requests of the respective subsystems.
+const (
+	DefaultSessionTimeout  = 5 * time.Second
+	DefaultKeyshareTimeout = 15 * time.Second
+	DefaultSchemeTimeout   = 30 * time.Second
+)
+
+// DefaultSchemeRetries is the default number of times that failed HTTP requests to scheme managers
+// are retried, and that interrupted downloads of scheme files are resumed. As scheme updates run in
+// the background, often over mobile connections, they are retried more often than other requests.
+const DefaultSchemeRetries = 5
+
 // Logger is used for logging. If not set, init() will initialize it to logrus.StandardLogger().
 var Logger *logrus.Logger
 
@@ -72,15 +103,125 @@ func NewHTTPTransport(serverURL string) *HTTPTransport {
 	client.RetryWaitMax = 500 * time.Millisecond
 	client.Logger = transportlogger
 	client.HTTPClient = &http.Client{
-		Timeout:   time.Second * 5,
+		Timeout:   DefaultSessionTimeout,
 		Transport: &innerTransport,
 	}
 
-	return &HTTPTransport{
+	transport := &HTTPTransport{
 		Server:  url,
 		headers: map[string]string{},
 		client:  client,
+		inner:   &innerTransport,
+	}
+	// retryablehttp does not return the error of the last attempt, so we remember timeouts here
+	client.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		if isTLSPinError(err) {
+			return false, err // retrying won't help, and this makes retryablehttp return err
+		}
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			transport.timedOut = true
+		}
+		return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+	}
+	return transport
+}
+
+// SetTimeout sets the timeout of each attempt at sending a request, and the subsystem
+// that is mentioned in errors when a request times out. A zero timeout is ignored.
+func (transport *HTTPTransport) SetTimeout(timeout time.Duration, subsystem string) {
+	if timeout != 0 {
+		transport.client.HTTPClient.Timeout = timeout
+	}
+	transport.subsystem = subsystem
+}
+
+// SetRetries sets the number of times that failed requests are retried, and that interrupted
+// downloads of GetSignedFile() are resumed.
+func (transport *HTTPTransport) SetRetries(retries int) {
+	transport.client.RetryMax = retries
+}
+
+// SetRoundTripper sets the http.RoundTripper used for sending requests, replacing the default one
+// (e.g. to route requests through a proxy). A nil value leaves the transport unchanged.
+func (transport *HTTPTransport) SetRoundTripper(roundTripper http.RoundTripper) {
+	if roundTripper != nil {
+		transport.client.HTTPClient.Transport = roundTripper
+	}
+}
+
+// SetContext sets the context of the requests of the transport, which are aborted (and not
+// retried) when the context is cancelled or its deadline passes. A nil context is ignored.
+func (transport *HTTPTransport) SetContext(ctx context.Context) {
+	if ctx != nil {
+		transport.ctx = ctx
+	}
+}
+
+// SetTLSPins restricts the transport to TLS servers whose certificate chain contains a public key
+// matching one of the specified pins (see TLSPin()), in addition to the usual certificate
+// validation; listing multiple pins allows keys to be rotated. If a custom http.RoundTripper is
+// used (see SetRoundTripper()), the pins can only be checked after a request has been sent.
+func (transport *HTTPTransport) SetTLSPins(pins []string) {
+	transport.pins = pins
+	if len(pins) == 0 {
+		return
 	}
+	if transport.inner.TLSClientConfig == nil {
+		transport.inner.TLSClientConfig = &tls.Config{}
+	}
+	transport.inner.TLSClientConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		return transport.verifyPins(certs)
+	}
+}
+
+// TLSPin returns the pin of the public key of the specified certificate: the base64-encoded
+// SHA256 hash of its DER-encoded SubjectPublicKeyInfo.
+func TLSPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// tlsPinError is returned by verifyPins() if no certificate of the server matches the TLS pins.
+type tlsPinError struct{}
+
+func (*tlsPinError) Error() string {
+	return "No certificate of the server matches the TLS pins"
+}
+
+// isTLSPinError reports whether the error, e.g. the *url.Error returned when sending a request,
+// was caused by a TLS pin mismatch.
+func isTLSPinError(err error) bool {
+	for err != nil {
+		if _, ok := err.(*tlsPinError); ok {
+			return true
+		}
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = wrapper.Unwrap()
+	}
+	return false
+}
+
+func (transport *HTTPTransport) verifyPins(certs []*x509.Certificate) error {
+	for _, cert := range certs {
+		pin := TLSPin(cert)
+		for _, p := range transport.pins {
+			if p == pin {
+				return nil
+			}
+		}
+	}
+	return &tlsPinError{}
 }
 
 // SetHeader sets a header to be sent in requests.
@@ -96,6 +237,9 @@ func (transport *HTTPTransport) request(
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	if transport.ctx != nil {
+		req.Request = req.Request.WithContext(transport.ctx)
+	}
 
 	req.Header.Set("User-Agent", "irmago")
 	if reader != nil {
@@ -109,10 +253,33 @@ func (transport *HTTPTransport) request(
 		req.Header.Set(name, val)
 	}
 
+	transport.timedOut = false
 	res, err := transport.client.Do(&req)
 	if err != nil {
+		if isTLSPinError(err) {
+			return nil, &SessionError{ErrorType: ErrorTLSPinMismatch, Err: err}
+		}
+		if transport.timedOut {
+			prefix := "Request timed out"
+			if transport.subsystem != "" {
+				prefix = "Request to " + transport.subsystem + " server timed out"
+			}
+			return nil, &SessionError{ErrorType: ErrorTimeout, Info: transport.subsystem, Err: errors.WrapPrefix(err, prefix, 0)}
+		}
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	if len(transport.pins) > 0 {
+		// Also catches connections not made by our own inner transport
+		if res.TLS == nil {
+			err = errors.New("Pinned server was not contacted over TLS")
+		} else {
+			err = transport.verifyPins(res.TLS.PeerCertificates)
+		}
+		if err != nil {
+			res.Body.Close()
+			return nil, &SessionError{ErrorType: ErrorTLSPinMismatch, Err: err}
+		}
+	}
 	return res, nil
 }
 
@@ -146,6 +313,7 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 	if method == http.MethodDelete {
 		return nil
 	}
@@ -180,7 +348,7 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
 	res, err := transport.request(url, http.MethodGet, nil, false)
 	if err != nil {
-		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
+		return nil, err
 	}
 
 	if res.StatusCode != 200 {
@@ -193,19 +361,121 @@ func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
 	return b, nil
 }
 
+// GetBytesIfModified performs a conditional GET request, using the ETag and Last-Modified
+// response headers of an earlier request for the same url (either of which may be empty).
+// If the server responds that the resource was not modified, nil is returned. The response
+// headers are returned for use in subsequent conditional requests.
+func (transport *HTTPTransport) GetBytesIfModified(url, etag, modified string) ([]byte, http.Header, error) {
+	if etag != "" {
+		transport.SetHeader("If-None-Match", etag)
+		defer delete(transport.headers, "If-None-Match")
+	}
+	if modified != "" {
+		transport.SetHeader("If-Modified-Since", modified)
+		defer delete(transport.headers, "If-Modified-Since")
+	}
+	res, err := transport.request(url, http.MethodGet, nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		return nil, res.Header, nil
+	}
+	if res.StatusCode != 200 {
+		return nil, nil, &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+	}
+	return b, res.Header, nil
+}
+
+// GetSignedFile downloads the file at the specified url to dest, checking that its SHA256 hash
+// equals hash if that is not nil. If the connection drops during the download, the download is
+// resumed using a ranged request instead of starting over, as many times as requests are retried
+// (see SetRetries()). Until the download is complete and verified, it is kept next to dest.
 func (transport *HTTPTransport) GetSignedFile(url string, dest string, hash ConfigurationFileHash) error {
-	b, err := transport.GetBytes(url)
+	if err := fs.EnsureDirectoryExists(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	partial := dest + ".part"
+	file, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
-	sha := sha256.Sum256(b)
-	if hash != nil && !bytes.Equal(hash, sha[:]) {
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(partial)
+	}()
+
+	var received int64
+	var interrupted bool
+	for resumes := 0; ; resumes++ {
+		received, interrupted, err = transport.getFrom(url, received, file)
+		if err == nil {
+			break
+		}
+		if !interrupted || resumes >= transport.client.RetryMax {
+			return err
+		}
+		Logger.Debugf("Download of %s interrupted after %d bytes, resuming: %s", url, received, err.Error())
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sha := sha256.New()
+	if _, err = io.Copy(sha, file); err != nil {
+		return err
+	}
+	if hash != nil && !bytes.Equal(hash, sha.Sum(nil)) {
 		return errors.Errorf("Signature over new file %s is not valid", dest)
 	}
-	if err = fs.EnsureDirectoryExists(filepath.Dir(dest)); err != nil {
+	if err = file.Close(); err != nil {
 		return err
 	}
-	return fs.SaveFile(dest, b)
+	return os.Rename(partial, dest)
+}
+
+// getFrom requests the file at the specified url from the specified offset onwards, writing the
+// response into file from that offset. It returns the offset up to which file is written, and
+// whether the response body was interrupted, in which case the download can be resumed from there.
+func (transport *HTTPTransport) getFrom(url string, offset int64, file *os.File) (int64, bool, error) {
+	if offset > 0 {
+		transport.SetHeader("Range", fmt.Sprintf("bytes=%d-", offset))
+		defer delete(transport.headers, "Range")
+	}
+	res, err := transport.request(url, http.MethodGet, nil, false)
+	if err != nil {
+		return offset, false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		offset = 0 // The server does not support ranged requests, so we start over
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return offset, false, &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode,
+				Err: errors.Errorf("Unexpected Content-Range %s", res.Header.Get("Content-Range"))}
+		}
+	default:
+		return offset, false, &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
+	}
+	if err = file.Truncate(offset); err != nil {
+		return offset, false, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return offset, false, err
+	}
+	n, err := io.Copy(file, res.Body)
+	if err != nil {
+		return offset + n, true, &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+	}
+	return offset + n, false, nil
 }
 
 func (transport *HTTPTransport) GetFile(url string, dest string) error {
@@ -222,7 +492,10 @@ func (transport *HTTPTransport) Get(url string, result interface{}) error {
 	return transport.jsonRequest(url, http.MethodGet, result, nil)
 }
 
-// Delete performs a DELETE.
+// Delete performs a DELETE. As the server cleans up unfinished sessions by itself eventually,
+// failures are only logged.
 func (transport *HTTPTransport) Delete() {
-	_ = transport.jsonRequest("", http.MethodDelete, nil, nil)
+	if err := transport.jsonRequest("", http.MethodDelete, nil, nil); err != nil {
+		Logger.Warn("DELETE failed: ", err.Error())
+	}
 }
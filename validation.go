@@ -0,0 +1,124 @@
+package irma
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationErrorCode is the machine-readable kind of a ValidationProblem.
+type ValidationErrorCode string
+
+const (
+	ValidationErrorMissingField          = ValidationErrorCode("MISSING_FIELD")           // Required field is absent or empty
+	ValidationErrorInvalidValue          = ValidationErrorCode("INVALID_VALUE")           // Field has a value that is not allowed
+	ValidationErrorConflictingFields     = ValidationErrorCode("CONFLICTING_FIELDS")      // Field conflicts with another field
+	ValidationErrorUnknownAttribute      = ValidationErrorCode("UNKNOWN_ATTRIBUTE")       // Attribute type is not in the schemes
+	ValidationErrorUnknownCredentialType = ValidationErrorCode("UNKNOWN_CREDENTIAL_TYPE") // Credential type is not in the schemes
+	ValidationErrorUnknownField          = ValidationErrorCode("UNKNOWN_FIELD")           // Field is not part of the message (in strict mode)
+)
+
+// ValidationProblem is a single problem found when validating a message, such as a session request.
+type ValidationProblem struct {
+	// JSON path to the offending field, e.g. "content[2].attributes[0]"
+	Path    string              `json:"path"`
+	Value   interface{}         `json:"value,omitempty"`
+	Code    ValidationErrorCode `json:"code"`
+	Message string              `json:"message"`
+}
+
+// ValidationError is returned by UnmarshalValidate() and the validation methods of session requests,
+// listing all problems that were found in the message instead of only the first one.
+type ValidationError struct {
+	Problems []*ValidationProblem `json:"problems"`
+}
+
+func (verr *ValidationError) Error() string {
+	msgs := make([]string, 0, len(verr.Problems))
+	for _, problem := range verr.Problems {
+		if problem.Path == "" {
+			msgs = append(msgs, problem.Message)
+		} else {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", problem.Path, problem.Message))
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// add records a problem at the specified path, which is relative to the path of the caller.
+func (verr *ValidationError) add(path string, value interface{}, code ValidationErrorCode, format string, args ...interface{}) {
+	verr.Problems = append(verr.Problems, &ValidationProblem{
+		Path:    path,
+		Value:   value,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// merge records the problems of the specified error, if it is a ValidationError, with their paths
+// prefixed by the specified path; other errors are recorded as an invalid value at that path.
+func (verr *ValidationError) merge(path string, err error) {
+	if err == nil {
+		return
+	}
+	other, ok := err.(*ValidationError)
+	if !ok {
+		verr.add(path, nil, ValidationErrorInvalidValue, "%s", err.Error())
+		return
+	}
+	for _, problem := range other.Problems {
+		p := *problem
+		p.Path = jsonPath(path, p.Path)
+		verr.Problems = append(verr.Problems, &p)
+	}
+}
+
+// errorOrNil returns the ValidationError if it contains problems, and nil otherwise.
+func (verr *ValidationError) errorOrNil() error {
+	if len(verr.Problems) == 0 {
+		return nil
+	}
+	return verr
+}
+
+// jsonPath joins the specified JSON paths.
+func jsonPath(prefix, path string) string {
+	switch {
+	case prefix == "":
+		return path
+	case path == "" || strings.HasPrefix(path, "["):
+		return prefix + path
+	default:
+		return prefix + "." + path
+	}
+}
+
+// ValidateAgainstConfiguration checks that the credential types and attributes that the request
+// refers to are present in the specified configuration, and for issuance requests that the credentials
+// to be issued are consistent with it (see CredentialRequest.Validate()). The problems that are found
+// are returned in a *ValidationError.
+func ValidateAgainstConfiguration(request SessionRequest, conf *Configuration) error {
+	verr := &ValidationError{}
+	path := "content"
+	if ir, ok := request.(*IssuanceRequest); ok {
+		path = "disclose"
+		for i, cred := range ir.Credentials {
+			verr.merge(fmt.Sprintf("credentials[%d]", i), cred.Validate(conf))
+		}
+	}
+
+	for i, disjunction := range request.ToDisclose() {
+		for j, attr := range disjunction.Attributes {
+			attrpath := fmt.Sprintf("%s[%d].attributes[%d]", path, i, j)
+			credtype := conf.CredentialTypes[attr.CredentialTypeIdentifier()]
+			switch {
+			case credtype == nil:
+				verr.add(attrpath, attr.String(), ValidationErrorUnknownCredentialType,
+					"Unknown credential type %s", attr.CredentialTypeIdentifier().String())
+			case !attr.IsCredential() && !attr.IsWildcard() && !credtype.ContainsAttribute(attr):
+				verr.add(attrpath, attr.String(), ValidationErrorUnknownAttribute, "Unknown attribute %s", attr.String())
+			}
+		}
+	}
+
+	return verr.errorOrNil()
+}
@@ -1,7 +1,15 @@
 package irma
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -20,46 +28,254 @@ const (
 	ProofStatusValid             = ProofStatus("VALID")              // Proof is valid
 	ProofStatusInvalid           = ProofStatus("INVALID")            // Proof is invalid
 	ProofStatusInvalidTimestamp  = ProofStatus("INVALID_TIMESTAMP")  // Attribute-based signature had invalid timestamp
-	ProofStatusUnmatchedRequest  = ProofStatus("UNMATCHED_REQUEST")  // Proof does not correspond to a specified request
+	ProofStatusUnmatchedRequest  = ProofStatus("UNMATCHED_REQUEST")  // Proof does not correspond to a specified request, e.g. it is meant for another session
 	ProofStatusMissingAttributes = ProofStatus("MISSING_ATTRIBUTES") // Proof does not contain all requested attributes
 	ProofStatusExpired           = ProofStatus("EXPIRED")            // Attributes were expired at proof creation time (now, or according to timestamp in case of abs)
+	// Proof contains all requested attributes, but not all of them have the values required by the
+	// request; those have status AttributeProofStatusInvalidValue
+	ProofStatusUnsatisfiedCondition = ProofStatus("UNSATISFIED_CONDITION")
+	// Proof is valid, but the credential of one or more of the disclosed attributes was revoked;
+	// those have status AttributeProofStatusRevoked (see BaseRequest.RevocationCheck)
+	ProofStatusRevoked = ProofStatus("REVOKED")
 
 	AttributeProofStatusPresent      = AttributeProofStatus("PRESENT")       // Attribute is disclosed and matches the value
 	AttributeProofStatusExtra        = AttributeProofStatus("EXTRA")         // Attribute is disclosed, but wasn't requested in request
 	AttributeProofStatusMissing      = AttributeProofStatus("MISSING")       // Attribute is NOT disclosed, but should be according to request
 	AttributeProofStatusInvalidValue = AttributeProofStatus("INVALID_VALUE") // Attribute is disclosed, but has invalid value according to request
+	AttributeProofStatusSkipped      = AttributeProofStatus("SKIPPED")       // Attribute of an optional disjunction is NOT disclosed, which is allowed
+	AttributeProofStatusRevoked      = AttributeProofStatus("REVOKED")       // Attribute is disclosed, but its credential was revoked
 )
 
-// DisclosedAttribute represents a disclosed attribute.
+// RevocationStatus is the outcome of checking whether the credential of a disclosed attribute was
+// revoked, if the request asked for this (see BaseRequest.RevocationCheck).
+type RevocationStatus string
+
+const (
+	RevocationStatusNotRevoked = RevocationStatus("NOT_REVOKED")
+	RevocationStatusRevoked    = RevocationStatus("REVOKED")
+)
+
+// ProofStatusReason specifies why a proof did not have status ProofStatusValid. In particular it
+// distinguishes between the various causes of ProofStatusInvalid and ProofStatusUnmatchedRequest;
+// for the other statuses it equals the status.
+type ProofStatusReason string
+
+const (
+	ProofStatusReasonNone                 = ProofStatusReason("")                      // Proof is valid
+	ProofStatusReasonInvalidProof         = ProofStatusReason("INVALID_PROOF")         // Zero-knowledge proofs did not verify, or were malformed
+	ProofStatusReasonUnknownPublicKey     = ProofStatusReason("UNKNOWN_PUBLIC_KEY")    // Public key of an issuer is unknown (ErrorMissingPublicKey)
+	ProofStatusReasonExpiredPublicKey     = ProofStatusReason("EXPIRED_PUBLIC_KEY")    // Public key of an issuer had expired at issuance (ErrorExpiredPublicKey)
+	ProofStatusReasonMalformedMetadata    = ProofStatusReason("MALFORMED_METADATA")    // Metadata attribute could not be decoded
+	ProofStatusReasonNonceMismatch        = ProofStatusReason("NONCE_MISMATCH")        // Proof was made against another nonce, e.g. it is replayed
+	ProofStatusReasonUnmatchedRequest     = ProofStatusReason("UNMATCHED_REQUEST")     // Proof was made against another context, or for other conditions
+	ProofStatusReasonMessageMismatch      = ProofStatusReason("MESSAGE_MISMATCH")      // Attribute-based signature was made over another message
+	ProofStatusReasonMissingAttributes    = ProofStatusReason("MISSING_ATTRIBUTES")    // See ProofStatusMissingAttributes
+	ProofStatusReasonUnsatisfiedCondition = ProofStatusReason("UNSATISFIED_CONDITION") // See ProofStatusUnsatisfiedCondition
+	ProofStatusReasonExpired              = ProofStatusReason("EXPIRED")               // See ProofStatusExpired
+	ProofStatusReasonInvalidTimestamp     = ProofStatusReason("INVALID_TIMESTAMP")     // See ProofStatusInvalidTimestamp
+	ProofStatusReasonRevoked              = ProofStatusReason("REVOKED")               // See ProofStatusRevoked
+)
+
+// ProofErrorReason returns the reason for a proof being invalid, given the error that
+// its verification or ExtractPublicKeys() encountered.
+func ProofErrorReason(err error) ProofStatusReason {
+	switch {
+	case IsMissingPublicKey(err):
+		return ProofStatusReasonUnknownPublicKey
+	case IsExpiredPublicKey(err):
+		return ProofStatusReasonExpiredPublicKey
+	}
+	if _, ok := err.(*MetadataError); ok {
+		return ProofStatusReasonMalformedMetadata
+	}
+	return ProofStatusReasonInvalidProof
+}
+
+// DisclosedAttribute represents a disclosed attribute. If the attribute is absent, i.e. it is an
+// optional attribute that was omitted during issuance, RawValue and Value are nil, serializing to
+// null in JSON, as opposed to attributes that are present with the empty string as value.
 type DisclosedAttribute struct {
 	RawValue   *string                 `json:"rawvalue"`
 	Value      TranslatedString        `json:"value"` // Value of the disclosed attribute
 	Identifier AttributeTypeIdentifier `json:"id"`
 	Status     AttributeProofStatus    `json:"status"`
+	// NonProduction is true if the attribute is of a development scheme
+	NonProduction bool `json:"nonProduction,omitempty"`
+	// Value parsed according to the type of the attribute type, if set by SetTypedValues()
+	TypedValue interface{} `json:"typedValue,omitempty"`
+	// Expiry date of the credential containing the attribute, and whether it had expired at verification
+	// time (or signing time, for attribute-based signatures with a timestamp); see ExpiryPolicy
+	Expires *Timestamp `json:"expires,omitempty"`
+	Expired bool       `json:"expired,omitempty"`
+	// Time at which the credential containing the attribute was issued, rounded down to the
+	// epoch boundary as in its metadata attribute
+	IssuanceTime *Timestamp `json:"issuanceTime,omitempty"`
+	// Hash of the metadata attribute and disclosed attributes of the credential containing the
+	// attribute. Disclosures of the same attributes of the same credential instance have the same
+	// hash, so it links those disclosures to each other. This linkability exists regardless,
+	// as the hash is computed from the disclosed values, but the hash makes it trivial;
+	// the IRMA server includes it only for requestors that are permitted to receive it.
+	CredentialHash string `json:"credentialHash,omitempty"`
+	// Whether the credential containing the attribute was revoked, if the request asked for
+	// this to be checked (see BaseRequest.RevocationCheck)
+	RevocationStatus RevocationStatus `json:"revocationStatus,omitempty"`
+
+	index *DisclosedAttributeIndex // position of the attribute in the proof list it was disclosed in
+}
+
+// DisjunctionResult describes whether, and with which attribute, a disjunction of a request was
+// satisfied by a disclosure.
+type DisjunctionResult struct {
+	Satisfied bool `json:"satisfied"`
+	// Status of the attribute disclosed for the disjunction, e.g. AttributeProofStatusMissing if there is none
+	Status AttributeProofStatus `json:"status"`
+	// The attribute disclosed for the disjunction and its position in the proof list, if any
+	Attribute *AttributeTypeIdentifier `json:"attribute,omitempty"`
+	Index     *DisclosedAttributeIndex `json:"index,omitempty"`
+	// Raw value of the attribute disclosed for the disjunction, if any
+	RawValue *string `json:"rawvalue,omitempty"`
+}
+
+// HashAttributeValue returns the hash that replaces the value of a disclosed attribute in the
+// session results of requests specifying RequestorBaseRequest.HashAttributeValues: the base64
+// encoding of the HMAC-SHA256 of the value, keyed with the salt.
+func HashAttributeValue(salt, value string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(value))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ExpiryPolicy determines whether attributes of credentials that had expired at verification time
+// (or signing time, for attribute-based signatures with a timestamp) are accepted.
+type ExpiryPolicy struct {
+	AcceptExpired bool
+	// Maximum time since the expiry of accepted expired credentials; 0 for no maximum
+	MaxExpiredAge time.Duration
+}
+
+// Accepts returns whether the policy accepts a credential with the specified expiry date at time t.
+func (policy ExpiryPolicy) Accepts(expiry, t time.Time) bool {
+	if !expiry.Before(t) {
+		return true
+	}
+	if !policy.AcceptExpired {
+		return false
+	}
+	return policy.MaxExpiredAge == 0 || !expiry.Add(policy.MaxExpiredAge).Before(t)
+}
+
+// IntValue returns the value of the attribute as an integer (see AttributeValueTypeInteger).
+func (attr *DisclosedAttribute) IntValue() (int64, error) {
+	v, err := attr.parseValue(AttributeValueTypeInteger)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
+
+// DateValue returns the value of the attribute as a date (see AttributeValueTypeDate).
+func (attr *DisclosedAttribute) DateValue() (time.Time, error) {
+	v, err := attr.parseValue(AttributeValueTypeDate)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return v.(time.Time), nil
+}
+
+// BoolValue returns the value of the attribute as a boolean (see AttributeValueTypeBoolean).
+func (attr *DisclosedAttribute) BoolValue() (bool, error) {
+	v, err := attr.parseValue(AttributeValueTypeBoolean)
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+func (attr *DisclosedAttribute) parseValue(typ AttributeValueType) (interface{}, error) {
+	if attr.RawValue == nil {
+		return nil, errors.Errorf("Attribute %s has no value", attr.Identifier.String())
+	}
+	return typ.Parse(*attr.RawValue)
+}
+
+// SetTypedValues sets the TypedValue of each of the specified attributes that has a value, by
+// parsing it according to the type of its attribute type in the configuration. Values that are
+// not of that type, e.g. because they were issued before the type was declared, are left unset.
+func SetTypedValues(conf *Configuration, attrs []*DisclosedAttribute) {
+	for _, attr := range attrs {
+		attrtype := conf.AttributeTypes[attr.Identifier]
+		if attr.RawValue == nil || attrtype == nil {
+			continue
+		}
+		if v, err := attrtype.ValueType().Parse(*attr.RawValue); err == nil {
+			attr.TypedValue = v
+		}
+	}
 }
 
 // ProofList is a gabi.ProofList with some extra methods.
 type ProofList gabi.ProofList
 
-var ErrorMissingPublicKey = errors.New("Missing public key")
+var (
+	ErrorMissingPublicKey = errors.New("Missing public key")
+	ErrorExpiredPublicKey = errors.New("Public key had expired when the credential was issued")
+)
+
+// IsMissingPublicKey returns whether the specified error, as returned by ExtractPublicKeys()
+// and the verification methods, is or wraps ErrorMissingPublicKey.
+func IsMissingPublicKey(err error) bool {
+	return isMetadataError(err, ErrorMissingPublicKey)
+}
+
+// IsExpiredPublicKey returns whether the specified error, as returned by ExtractPublicKeys()
+// and the verification methods, is or wraps ErrorExpiredPublicKey.
+func IsExpiredPublicKey(err error) bool {
+	return isMetadataError(err, ErrorExpiredPublicKey)
+}
+
+func isMetadataError(err error, target error) bool {
+	if merr, ok := err.(*MetadataError); ok {
+		err = merr.Err
+	}
+	return err == target
+}
 
 // ExtractPublicKeys returns the public keys of each proof in the proofList, in the same order,
-// for later use in verification of the proofList. If one of the proofs is not a ProofD
-// an error is returned.
+// for later use in verification of the proofList. The public key of each proof is the one with the
+// counter in its metadata attribute, which need not be the latest key of the issuer: any key that
+// had not yet expired when the credential was issued is accepted. If one of the proofs is not a ProofD
+// an error is returned. If the metadata attribute of a proof cannot be decoded, or its public key
+// is unknown (ErrorMissingPublicKey) or had already expired at the signing date of the credential
+// (ErrorExpiredPublicKey), a *MetadataError describing the metadata attribute is returned.
 func (pl ProofList) ExtractPublicKeys(configuration *Configuration) ([]*gabi.PublicKey, error) {
+	return pl.ExtractPublicKeysContext(context.Background(), configuration)
+}
+
+// ExtractPublicKeysContext is like ExtractPublicKeys, but aborts fetching missing public keys
+// (see Configuration.PublicKeyContext()) when the context is done, returning the error of the context.
+func (pl ProofList) ExtractPublicKeysContext(ctx context.Context, configuration *Configuration) ([]*gabi.PublicKey, error) {
 	var publicKeys = make([]*gabi.PublicKey, 0, len(pl))
 
 	for _, v := range pl {
 		switch v.(type) {
 		case *gabi.ProofD:
 			proof := v.(*gabi.ProofD)
-			metadata := MetadataFromInt(proof.ADisclosed[1], configuration) // index 1 is metadata attribute
-			publicKey, err := metadata.PublicKey()
+			metadata, err := DecodeMetadata(proof.ADisclosed[1], configuration) // index 1 is metadata attribute
 			if err != nil {
 				return nil, err
 			}
+			publicKey, err := metadata.publicKey(ctx)
+			if err != nil && ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				return nil, &MetadataError{Err: err, Metadata: metadata.Fields()}
+			}
 			if publicKey == nil {
-				return nil, ErrorMissingPublicKey
+				return nil, &MetadataError{Err: ErrorMissingPublicKey, Metadata: metadata.Fields()}
+			}
+			if publicKey.ExpiryDate <= metadata.SigningDate().Unix() {
+				return nil, &MetadataError{Err: ErrorExpiredPublicKey, Metadata: metadata.Fields()}
 			}
 			publicKeys = append(publicKeys, publicKey)
 		default:
@@ -70,10 +286,22 @@ func (pl ProofList) ExtractPublicKeys(configuration *Configuration) ([]*gabi.Pub
 }
 
 // VerifyProofs verifies the proofs cryptographically.
-func (pl ProofList) VerifyProofs(configuration *Configuration, context *big.Int, nonce *big.Int, publickeys []*gabi.PublicKey, isSig bool) (bool, error) {
+func (pl ProofList) VerifyProofs(configuration *Configuration, reqContext *big.Int, nonce *big.Int, publickeys []*gabi.PublicKey, isSig bool) (bool, error) {
+	return pl.verifyProofs(context.Background(), configuration, reqContext, nonce, publickeys, isSig)
+}
+
+// verifyProofs is like VerifyProofs, but if the context is done before the proofs are verified,
+// the error of the context is returned.
+func (pl ProofList) verifyProofs(
+	ctx context.Context,
+	configuration *Configuration,
+	reqContext, nonce *big.Int,
+	publickeys []*gabi.PublicKey,
+	isSig bool,
+) (bool, error) {
 	if publickeys == nil {
 		var err error
-		publickeys, err = pl.ExtractPublicKeys(configuration)
+		publickeys, err = pl.ExtractPublicKeysContext(ctx, configuration)
 		if err != nil {
 			return false, err
 		}
@@ -94,7 +322,11 @@ func (pl ProofList) VerifyProofs(configuration *Configuration, context *big.Int,
 		}
 	}
 
-	return gabi.ProofList(pl).Verify(publickeys, context, nonce, isSig, keyshareServers), nil
+	// gabi verifies the proofs all at once, so the context can only be checked beforehand
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return gabi.ProofList(pl).Verify(publickeys, reqContext, nonce, isSig, keyshareServers), nil
 }
 
 // Expired returns true if any of the contained disclosure proofs is specified at the specified time,
@@ -117,11 +349,52 @@ func (pl ProofList) Expired(configuration *Configuration, t *time.Time) bool {
 	return false
 }
 
+// expiry returns the earliest expiry date of the credentials of the contained disclosure proofs,
+// or nil if there are none.
+func (pl ProofList) expiry(configuration *Configuration) *Timestamp {
+	var expiry *Timestamp
+	for _, proof := range pl {
+		proofd, ok := proof.(*gabi.ProofD)
+		if !ok {
+			continue
+		}
+		metadata := MetadataFromInt(proofd.ADisclosed[1], configuration) // index 1 is metadata attribute
+		if exp := Timestamp(metadata.Expiry()); expiry == nil || exp.Before(*expiry) {
+			expiry = &exp
+		}
+	}
+	return expiry
+}
+
+// CheckExpiry returns whether the specified policy accepts the credentials of all contained disclosure
+// proofs at time t, marking the disclosed attributes of credentials that had expired at t as Expired.
+func (pl ProofList) CheckExpiry(configuration *Configuration, attrs []*DisclosedAttribute, t time.Time, policy ExpiryPolicy) bool {
+	for _, attr := range attrs {
+		attr.Expired = attr.Expires != nil && attr.Expires.Before(Timestamp(t))
+	}
+	for _, proof := range pl {
+		proofd, ok := proof.(*gabi.ProofD)
+		if !ok {
+			continue
+		}
+		metadata := MetadataFromInt(proofd.ADisclosed[1], configuration) // index 1 is metadata attribute
+		if !policy.Accepts(metadata.Expiry(), t) {
+			return false
+		}
+	}
+	return true
+}
+
 // DisclosedAttributes returns a slice containing the disclosed attributes that are present in the proof list.
 // If a non-empty and non-nil AttributeDisjunctionList is included, then the first attributes in the returned slice match
 // with the disjunction list in the disjunction list. If any of the given disjunctions is not matched by one
-// of the disclosed attributes, then the corresponding item in the returned slice has status AttributeProofStatusMissing.
-// The first return parameter of this function indicates whether or not all disjunctions (if present) are satisfied.
+// of the disclosed attributes, then the corresponding item in the returned slice has status AttributeProofStatusMissing,
+// or AttributeProofStatusSkipped if the disjunction is optional.
+// A wildcard in a disjunction, referring to all attributes of a credential type (see AttributeTypeIdentifier.IsWildcard()),
+// is satisfied only by a credential of which all attributes are disclosed. These attributes are included in the returned
+// slice after those matching the disjunctions, with status AttributeProofStatusPresent instead of AttributeProofStatusExtra.
+// The first return parameter of this function indicates whether or not all disjunctions (if present) are satisfied,
+// skipped optional disjunctions not counting as unsatisfied.
 func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjunctions AttributeDisjunctionList) (bool, []*DisclosedAttribute, error) {
 	if d.Indices == nil || len(disjunctions) == 0 {
 		return ProofList(d.Proofs).DisclosedAttributes(configuration, disjunctions)
@@ -129,10 +402,16 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjuncti
 
 	list := make([]*DisclosedAttribute, len(disjunctions))
 	usedAttrs := map[int]map[int]struct{}{} // keep track of attributes that satisfy the disjunctions
+	wildcardCreds := map[int]struct{}{}     // keep track of credentials that satisfy a wildcard
 
 	// For each of the disjunctions, lookup the attribute that the user sent to satisfy this disjunction,
 	// using the indices specified by the user in d.Indices. Then see if the attribute satisfies the disjunction.
 	for i, disjunction := range disjunctions {
+		if i >= len(d.Indices) || len(d.Indices[i]) == 0 {
+			// The user sent no attribute for this disjunction, which is only allowed if it is optional
+			list[i] = &DisclosedAttribute{Status: disjunction.missingStatus()}
+			continue
+		}
 		index := d.Indices[i][0]
 		proofd, ok := d.Proofs[index.CredentialIndex].(*gabi.ProofD)
 		if !ok {
@@ -142,24 +421,30 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjuncti
 		}
 
 		metadata := MetadataFromInt(proofd.ADisclosed[1], configuration) // index 1 is metadata attribute
-		attr, attrval, err := parseAttribute(index.AttributeIndex, metadata, proofd.ADisclosed[index.AttributeIndex])
+		attr, attrval, err := parseAttribute(index.AttributeIndex, metadata, proofd.ADisclosed[index.AttributeIndex], credentialHash(proofd))
 		if err != nil {
 			return false, nil, err
 		}
+		wildcard := index.AttributeIndex == 1 &&
+			disjunction.contains(attr.Identifier.CredentialTypeIdentifier().Wildcard()) &&
+			disclosesAllAttributes(proofd, metadata.CredentialType())
+		if wildcard {
+			attr.Identifier = attr.Identifier.CredentialTypeIdentifier().Wildcard()
+		}
 
+		attr.index = index
 		if disjunction.attemptSatisfy(attr.Identifier, attrval) {
 			list[i] = attr
-			if disjunction.satisfied() {
-				list[i].Status = AttributeProofStatusPresent
-			} else {
-				list[i].Status = AttributeProofStatusInvalidValue
+			list[i].Status = disjunction.proofStatus(attrval)
+			if wildcard {
+				wildcardCreds[index.CredentialIndex] = struct{}{}
 			}
 			if usedAttrs[index.CredentialIndex] == nil {
 				usedAttrs[index.CredentialIndex] = map[int]struct{}{}
 			}
 			usedAttrs[index.CredentialIndex][index.AttributeIndex] = struct{}{}
 		} else {
-			list[i] = &DisclosedAttribute{Status: AttributeProofStatusMissing}
+			list[i] = &DisclosedAttribute{Status: disjunction.missingStatus()}
 		}
 	}
 
@@ -170,6 +455,7 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjuncti
 			continue
 		}
 		metadata := MetadataFromInt(proofd.ADisclosed[1], configuration) // index 1 is metadata attribute
+		credhash := credentialHash(proofd)
 		for attrIndex, attrInt := range proofd.ADisclosed {
 			if attrIndex == 0 || attrIndex == 1 { // Never add secret key or metadata (i.e. no-attribute disclosure) as extra
 				continue // Note that the secret should never be disclosed by the client, but we skip it to be sure
@@ -178,11 +464,16 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjuncti
 				continue
 			}
 
-			attr, _, err := parseAttribute(attrIndex, metadata, attrInt)
+			attr, _, err := parseAttribute(attrIndex, metadata, attrInt, credhash)
 			if err != nil {
 				return false, nil, err
 			}
-			attr.Status = AttributeProofStatusExtra
+			attr.index = &DisclosedAttributeIndex{CredentialIndex: i, AttributeIndex: attrIndex}
+			if _, wildcard := wildcardCreds[i]; wildcard {
+				attr.Status = AttributeProofStatusPresent
+			} else {
+				attr.Status = AttributeProofStatusExtra
+			}
 			list = append(list, attr)
 		}
 	}
@@ -190,7 +481,118 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, disjuncti
 	return len(disjunctions) == 0 || disjunctions.satisfied(), list, nil
 }
 
-func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int) (*DisclosedAttribute, *string, error) {
+// disclosesAllAttributes returns whether the disclosure proof discloses all attributes of the
+// specified credential type.
+func disclosesAllAttributes(proofd *gabi.ProofD, credtype *CredentialType) bool {
+	for i := range credtype.AttributeTypes {
+		if _, disclosed := proofd.ADisclosed[i+2]; !disclosed {
+			return false
+		}
+	}
+	return true
+}
+
+// proofStatus returns the status of a disclosed attribute with the specified value, which was
+// selected by attemptSatisfy() to satisfy this disjunction. A disclosed attribute that is absent
+// (i.e., it was left empty during issuance) cannot satisfy the disjunction, so it counts as missing.
+func (disjunction *AttributeDisjunction) proofStatus(value *string) AttributeProofStatus {
+	switch {
+	case disjunction.satisfied():
+		return AttributeProofStatusPresent
+	case value == nil:
+		return AttributeProofStatusMissing
+	default:
+		return AttributeProofStatusInvalidValue
+	}
+}
+
+// missingStatus returns the status of this disjunction if no attribute satisfying it was disclosed.
+func (disjunction *AttributeDisjunction) missingStatus() AttributeProofStatus {
+	if disjunction.Optional {
+		return AttributeProofStatusSkipped
+	}
+	return AttributeProofStatusMissing
+}
+
+// OptionalDisjunctions returns the indices of the optional disjunctions among the specified disjunctions
+// of a request that were satisfied, and of those that were skipped, according to the disclosed
+// attributes returned when verifying the disclosure against the request.
+func OptionalDisjunctions(disjunctions AttributeDisjunctionList, disclosed []*DisclosedAttribute) (satisfied []int, skipped []int) {
+	for i, disjunction := range disjunctions {
+		if !disjunction.Optional || i >= len(disclosed) {
+			continue
+		}
+		switch disclosed[i].Status {
+		case AttributeProofStatusPresent:
+			satisfied = append(satisfied, i)
+		case AttributeProofStatusSkipped:
+			skipped = append(skipped, i)
+		}
+	}
+	return
+}
+
+// DisjunctionResults returns for each of the specified disjunctions of a request whether, and with
+// which attribute, it was satisfied, according to the disclosed attributes returned when verifying
+// the disclosure against the request. If there are none, e.g. because the proofs were invalid, it returns nil.
+func DisjunctionResults(disjunctions AttributeDisjunctionList, disclosed []*DisclosedAttribute) []*DisjunctionResult {
+	if disclosed == nil {
+		return nil
+	}
+	results := make([]*DisjunctionResult, len(disjunctions))
+	for i := range disjunctions {
+		if i >= len(disclosed) {
+			results[i] = &DisjunctionResult{Status: disjunctions[i].missingStatus()}
+			continue
+		}
+		attr := disclosed[i]
+		results[i] = &DisjunctionResult{
+			Satisfied: attr.Status == AttributeProofStatusPresent,
+			Status:    attr.Status,
+			Index:     attr.index,
+			RawValue:  attr.RawValue,
+		}
+		if !attr.Identifier.Empty() {
+			id := attr.Identifier
+			results[i].Attribute = &id
+		}
+	}
+	return results
+}
+
+// SkippedDisjunctions returns the indices of the disjunctions of the request for which the
+// disclosure contains no attribute, i.e. the optional disjunctions that the user skipped.
+func (d *Disclosure) SkippedDisjunctions() []int {
+	var skipped []int
+	for i, indices := range d.Indices {
+		if len(indices) == 0 {
+			skipped = append(skipped, i)
+		}
+	}
+	return skipped
+}
+
+// credentialHash computes the DisclosedAttribute.CredentialHash of the attributes disclosed in the specified proof.
+func credentialHash(proofd *gabi.ProofD) string {
+	indices := make([]int, 0, len(proofd.ADisclosed))
+	for i := range proofd.ADisclosed {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	h := sha256.New()
+	for _, i := range indices {
+		bts := proofd.ADisclosed[i].Bytes()
+		// Write index and length along with each attribute, so that distinct proofs have distinct input
+		prefix := make([]byte, 8)
+		binary.BigEndian.PutUint32(prefix[:4], uint32(i))
+		binary.BigEndian.PutUint32(prefix[4:], uint32(len(bts)))
+		h.Write(prefix)
+		h.Write(bts)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int, credhash string) (*DisclosedAttribute, *string, error) {
 	var attrid AttributeTypeIdentifier
 	var attrval *string
 	credtype := metadata.CredentialType()
@@ -205,10 +607,20 @@ func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int) (*Dis
 		attrid = credtype.AttributeTypes[index-2].GetAttributeTypeIdentifier()
 		attrval = decodeAttribute(attr, metadata.Version())
 	}
+	var development bool
+	if manager := metadata.Conf.SchemeManagers[credtype.SchemeManagerIdentifier()]; manager != nil {
+		development = manager.Development
+	}
+	expires := Timestamp(metadata.Expiry())
+	issued := Timestamp(metadata.SigningDate())
 	return &DisclosedAttribute{
-		Identifier: attrid,
-		RawValue:   attrval,
-		Value:      NewTranslatedString(attrval),
+		Identifier:     attrid,
+		RawValue:       attrval,
+		Value:          NewTranslatedString(attrval),
+		NonProduction:  development,
+		Expires:        &expires,
+		IssuanceTime:   &issued,
+		CredentialHash: credhash,
 	}, attrval, nil
 }
 
@@ -216,10 +628,10 @@ func (pl ProofList) DisclosedAttributes(configuration *Configuration, disjunctio
 	var list []*DisclosedAttribute
 	list = make([]*DisclosedAttribute, len(disjunctions))
 	for i := range list {
-		// Populate list with AttributeProofStatusMissing; if an attribute that satisfies a disjunction
-		// is found below, the corresponding entry in the list is overwritten
+		// Populate list with AttributeProofStatusMissing (or AttributeProofStatusSkipped for optional disjunctions);
+		// if an attribute that satisfies a disjunction is found below, the corresponding entry in the list is overwritten
 		list[i] = &DisclosedAttribute{
-			Status: AttributeProofStatusMissing,
+			Status: disjunctions[i].missingStatus(),
 		}
 	}
 
@@ -228,22 +640,24 @@ func (pl ProofList) DisclosedAttributes(configuration *Configuration, disjunctio
 	// we append these to list just before returning
 	extraAttrs := map[AttributeTypeIdentifier]*DisclosedAttribute{}
 
-	for _, proof := range pl {
+	for credIndex, proof := range pl {
 		proofd, ok := proof.(*gabi.ProofD)
 		if !ok {
 			continue
 		}
 		metadata := MetadataFromInt(proofd.ADisclosed[1], configuration) // index 1 is metadata attribute
+		credhash := credentialHash(proofd)
 
 		for attrIndex, attrInt := range proofd.ADisclosed {
 			if attrIndex == 0 {
 				continue // Should never be disclosed, but skip it to be sure
 			}
 
-			attr, attrval, err := parseAttribute(attrIndex, metadata, attrInt)
+			attr, attrval, err := parseAttribute(attrIndex, metadata, attrInt, credhash)
 			if err != nil {
 				return false, nil, err
 			}
+			attr.index = &DisclosedAttributeIndex{CredentialIndex: credIndex, AttributeIndex: attrIndex}
 
 			if attrIndex > 1 { // Never add metadata (i.e. no-attribute disclosure) as extra
 				extraAttrs[attr.Identifier] = attr
@@ -255,11 +669,7 @@ func (pl ProofList) DisclosedAttributes(configuration *Configuration, disjunctio
 			// See if the current attribute satisfies one of the disjunctions, if so, delete it from extraAttrs
 			for i, disjunction := range disjunctions {
 				if disjunction.attemptSatisfy(attr.Identifier, attrval) {
-					if disjunction.satisfied() {
-						attr.Status = AttributeProofStatusPresent
-					} else {
-						attr.Status = AttributeProofStatusInvalidValue
-					}
+					attr.Status = disjunction.proofStatus(attrval)
 					list[i] = attr
 					delete(extraAttrs, attr.Identifier)
 				}
@@ -283,63 +693,210 @@ func (d *Disclosure) VerifyAgainstDisjunctions(
 	publickeys []*gabi.PublicKey,
 	issig bool,
 ) ([]*DisclosedAttribute, ProofStatus, error) {
+	list, status, _, err := d.VerifyAgainstDisjunctionsWithReason(configuration, required, context, nonce, publickeys, issig)
+	return list, status, err
+}
+
+// VerifyAgainstDisjunctionsWithReason is like VerifyAgainstDisjunctions, but additionally
+// returns why the proof is not valid, if it is not.
+func (d *Disclosure) VerifyAgainstDisjunctionsWithReason(
+	configuration *Configuration,
+	required AttributeDisjunctionList,
+	reqContext, nonce *big.Int,
+	publickeys []*gabi.PublicKey,
+	issig bool,
+) ([]*DisclosedAttribute, ProofStatus, ProofStatusReason, error) {
+	return d.VerifyAgainstDisjunctionsWithReasonContext(context.Background(), configuration, required, reqContext, nonce, publickeys, issig)
+}
+
+// VerifyAgainstDisjunctionsWithReasonContext is like VerifyAgainstDisjunctionsWithReason, but
+// aborts verification when the context is done, returning the error of the context.
+func (d *Disclosure) VerifyAgainstDisjunctionsWithReasonContext(
+	ctx context.Context,
+	configuration *Configuration,
+	required AttributeDisjunctionList,
+	reqContext, nonce *big.Int,
+	publickeys []*gabi.PublicKey,
+	issig bool,
+) ([]*DisclosedAttribute, ProofStatus, ProofStatusReason, error) {
 	// Cryptographically verify the IRMA disclosure proofs in the signature
-	valid, err := ProofList(d.Proofs).VerifyProofs(configuration, context, nonce, publickeys, issig)
-	if !valid || err != nil {
-		return nil, ProofStatusInvalid, err
+	valid, err := ProofList(d.Proofs).verifyProofs(ctx, configuration, reqContext, nonce, publickeys, issig)
+	if err != nil && ctx.Err() != nil {
+		return nil, ProofStatusInvalid, ProofStatusReasonNone, err
+	}
+	if err != nil {
+		return nil, ProofStatusInvalid, ProofErrorReason(err), err
+	}
+	if !valid {
+		return nil, ProofStatusInvalid, ProofStatusReasonInvalidProof, nil
 	}
 
 	// Next extract the contained attributes from the proofs, and match them to the signature request if present
 	allmatched, list, err := d.DisclosedAttributes(configuration, required)
 	if err != nil {
-		return nil, ProofStatusInvalid, err
+		return nil, ProofStatusInvalid, ProofErrorReason(err), err
 	}
 
-	// Return MISSING_ATTRIBUTES as proofstatus if one of the disjunctions in the request (if present) is not satisfied
+	// Return MISSING_ATTRIBUTES as proofstatus if one of the disjunctions in the request (if present) is not satisfied,
+	// or UNSATISFIED_CONDITION if the requested attributes are present but some do not have the required value
 	if !allmatched {
-		return list, ProofStatusMissingAttributes, nil
+		status := ProofStatusMissingAttributes
+		for _, attr := range list[:len(required)] {
+			if attr.Status == AttributeProofStatusMissing {
+				return list, ProofStatusMissingAttributes, ProofStatusReasonMissingAttributes, nil
+			}
+			if attr.Status == AttributeProofStatusInvalidValue {
+				status = ProofStatusUnsatisfiedCondition
+			}
+		}
+		return list, status, ProofStatusReason(status), nil
 	}
 
-	return list, ProofStatusValid, nil
+	return list, ProofStatusValid, ProofStatusReasonNone, nil
 }
 
 func (d *Disclosure) Verify(configuration *Configuration, request *DisclosureRequest) ([]*DisclosedAttribute, ProofStatus, error) {
-	list, status, err := d.VerifyAgainstDisjunctions(configuration, request.Content, request.Context, request.Nonce, nil, false)
+	list, status, _, err := d.VerifyWithReason(configuration, request)
+	return list, status, err
+}
+
+// VerifyWithReason is like Verify, but additionally returns why the disclosure is not valid, if it is not.
+func (d *Disclosure) VerifyWithReason(configuration *Configuration, request *DisclosureRequest) ([]*DisclosedAttribute, ProofStatus, ProofStatusReason, error) {
+	return d.VerifyWithReasonContext(context.Background(), configuration, request)
+}
+
+// VerifyWithReasonContext is like VerifyWithReason, but aborts verification when the context
+// is done, returning the error of the context.
+func (d *Disclosure) VerifyWithReasonContext(ctx context.Context, configuration *Configuration, request *DisclosureRequest) ([]*DisclosedAttribute, ProofStatus, ProofStatusReason, error) {
+	if !bigIntMatches(d.Nonce, request.GetNonce()) {
+		return nil, ProofStatusUnmatchedRequest, ProofStatusReasonNonceMismatch, nil
+	}
+	if !d.MatchesNonceAndContext(request) {
+		return nil, ProofStatusUnmatchedRequest, ProofStatusReasonUnmatchedRequest, nil
+	}
+	list, status, reason, err := d.VerifyAgainstDisjunctionsWithReasonContext(
+		ctx, configuration, request.Content, request.Context, request.Nonce, nil, false)
 	if err != nil {
-		return list, status, err
+		return list, status, reason, err
 	}
 
-	now := time.Now()
-	if expired := ProofList(d.Proofs).Expired(configuration, &now); expired {
-		return list, ProofStatusExpired, nil
+	if !ProofList(d.Proofs).CheckExpiry(configuration, list, time.Now(), request.ExpiryPolicy()) {
+		return list, ProofStatusExpired, ProofStatusReasonExpired, nil
 	}
 
-	return list, status, nil
+	return list, status, reason, nil
 }
 
 // Verify the attribute-based signature, optionally against a corresponding signature request. If the request is present
 // (i.e. not nil), then the first attributes in the returned result match with the disjunction list in the request
 // (that is, the i'th attribute in the result should satisfy the i'th disjunction in the request). If the request is not
-// fully satisfied in this fasion, the Status of the result is ProofStatusMissingAttributes. Any remaining attributes
+// fully satisfied in this fasion, the Status of the result is ProofStatusMissingAttributes, or ProofStatusUnsatisfiedCondition
+// if only the values of some of the attributes do not match those required by the request. Any remaining attributes
 // (i.e. not asked for by the request) are also included in the result, after the attributes that match disjunctions
 // in the request.
 //
 // The signature request is optional; if it is nil then the attribute-based signature is still verified, and all
 // containing attributes returned in the result.
 func (sm *SignedMessage) Verify(configuration *Configuration, request *SignatureRequest) ([]*DisclosedAttribute, ProofStatus, error) {
-	var message string
+	list, status, _, err := sm.VerifyWithReason(configuration, request)
+	return list, status, err
+}
+
+// VerifyWithReason is like Verify, but additionally returns why the attribute-based signature
+// is not valid, if it is not.
+//
+// If the request is present and its message differs from the signed message, the reason is
+// ProofStatusReasonMessageMismatch. Without a request, a signed message whose message was replaced has
+// status ProofStatusInvalid, as the message is hashed into the challenge of the proofs.
+//
+// A detached signed message (see SignedMessage.Detach()) can only be verified by this function if
+// the request is present, whose message is then the signed message; otherwise ErrorMissingDetachedMessage
+// is returned.
+func (sm *SignedMessage) VerifyWithReason(configuration *Configuration, request *SignatureRequest) ([]*DisclosedAttribute, ProofStatus, ProofStatusReason, error) {
+	if sm.IsDetached() && request == nil {
+		return nil, ProofStatusInvalid, ProofErrorReason(ErrorMissingDetachedMessage), ErrorMissingDetachedMessage
+	}
+	return sm.verify(configuration, request)
+}
+
+// VerifyWithReasonContext is like VerifyWithReason, but aborts verification when the context
+// is done, returning the error of the context.
+func (sm *SignedMessage) VerifyWithReasonContext(ctx context.Context, configuration *Configuration, request *SignatureRequest) ([]*DisclosedAttribute, ProofStatus, ProofStatusReason, error) {
+	if sm.IsDetached() && request == nil {
+		return nil, ProofStatusInvalid, ProofErrorReason(ErrorMissingDetachedMessage), ErrorMissingDetachedMessage
+	}
+	return sm.verifyContext(ctx, configuration, request)
+}
+
+// VerifyDetached verifies the detached signed message (see SignedMessage.Detach()) over the specified
+// message, optionally against a corresponding signature request as in Verify(). If the message does not
+// match the digest and length recorded in the signed message, ProofStatusUnmatchedRequest is returned.
+func (sm *SignedMessage) VerifyDetached(configuration *Configuration, request *SignatureRequest, message []byte) ([]*DisclosedAttribute, ProofStatus, error) {
+	if sm.IsDetached() && len(message) != sm.MessageLength {
+		return nil, ProofStatusUnmatchedRequest, nil
+	}
+	digest := sha256.Sum256(message)
+	return sm.VerifyDetachedDigest(configuration, request, digest[:])
+}
+
+// VerifyDetachedDigest is like VerifyDetached, given the SHA-256 digest of the message instead of the
+// message itself.
+func (sm *SignedMessage) VerifyDetachedDigest(configuration *Configuration, request *SignatureRequest, digest []byte) ([]*DisclosedAttribute, ProofStatus, error) {
+	if !bytes.Equal(digest, sm.messageHash()) {
+		return nil, ProofStatusUnmatchedRequest, nil
+	}
+	list, status, _, err := sm.verify(configuration, request)
+	return list, status, err
+}
+
+func (sm *SignedMessage) verify(configuration *Configuration, request *SignatureRequest) ([]*DisclosedAttribute, ProofStatus, ProofStatusReason, error) {
+	return sm.verifyContext(context.Background(), configuration, request)
+}
+
+func (sm *SignedMessage) verifyContext(ctx context.Context, configuration *Configuration, request *SignatureRequest) ([]*DisclosedAttribute, ProofStatus, ProofStatusReason, error) {
+	result, status, reason, err := sm.verifyProofs(ctx, configuration, request)
+	if status != ProofStatusValid || err != nil {
+		return result, status, reason, err
+	}
+
+	// Check if a credential was expired at creation time, according to the timestamp,
+	// and if so whether the policy of the request accepts that
+	var policy ExpiryPolicy
+	if request != nil {
+		policy = request.ExpiryPolicy()
+	}
+	if !ProofList(sm.Signature).CheckExpiry(configuration, result, sm.signingTime(), policy) {
+		return result, ProofStatusExpired, ProofStatusReasonExpired, nil
+	}
+
+	// The attributes were valid, nonexpired, and the request was satisfied
+	return result, ProofStatusValid, ProofStatusReasonNone, nil
+}
+
+// verifyProofs verifies the signed message like verify(), except for the expiry of its credentials.
+func (sm *SignedMessage) verifyProofs(ctx context.Context, configuration *Configuration, request *SignatureRequest) ([]*DisclosedAttribute, ProofStatus, ProofStatusReason, error) {
+	var msgHash []byte
 
 	// First check if this signature matches the request
 	if request != nil {
 		request.Timestamp = sm.Timestamp
-		if !sm.MatchesNonceAndContext(request) {
-			return nil, ProofStatusUnmatchedRequest, nil
+		if !bigIntMatches(sm.Nonce, request.Nonce) {
+			return nil, ProofStatusUnmatchedRequest, ProofStatusReasonNonceMismatch, nil
+		}
+		// If there is a request, then the signed message must be that of the request. As the message
+		// is hashed into the nonce, a signature whose proofs are attached to another message would
+		// not verify; but we compare the messages explicitly to report message substitution as such.
+		digest := sha256.Sum256([]byte(request.Message))
+		msgHash = digest[:]
+		if !bytes.Equal(msgHash, sm.messageHash()) {
+			return nil, ProofStatusUnmatchedRequest, ProofStatusReasonMessageMismatch, nil
+		}
+		if !sm.MatchesNonceAndContext(request) || !sm.matchesMessageType(request) {
+			return nil, ProofStatusUnmatchedRequest, ProofStatusReasonUnmatchedRequest, nil
 		}
-		// If there is a request, then the signed message must be that of the request
-		message = request.Message
 	} else {
 		// If not, we just verify that the signed message is a valid signature over its contained message
-		message = sm.Message
+		msgHash = sm.messageHash()
 	}
 
 	// Now, cryptographically verify the IRMA disclosure proofs in the signature
@@ -347,27 +904,103 @@ func (sm *SignedMessage) Verify(configuration *Configuration, request *Signature
 	if request != nil {
 		required = request.Content
 	}
-	result, status, err := sm.Disclosure().VerifyAgainstDisjunctions(configuration, required, sm.Context, sm.GetNonce(), nil, true)
+	result, status, reason, err := sm.Disclosure().VerifyAgainstDisjunctionsWithReasonContext(ctx, configuration, required, sm.Context, sm.GetNonce(), nil, true)
 	if status != ProofStatusValid || err != nil {
-		return result, status, err
+		return result, status, reason, err
 	}
 
 	// Next, verify the timestamp
-	t := time.Now()
 	if sm.Timestamp != nil {
-		if err := sm.VerifyTimestamp(message, configuration); err != nil {
-			return nil, ProofStatusInvalidTimestamp, nil
+		if err := sm.verifyTimestamp(msgHash, configuration); err != nil {
+			return nil, ProofStatusInvalidTimestamp, ProofStatusReasonInvalidTimestamp, nil
 		}
-		t = time.Unix(sm.Timestamp.Time, 0)
 	}
 
-	// Check if a credential was expired at creation time, according to the timestamp
-	if expired := ProofList(sm.Signature).Expired(configuration, &t); expired {
-		return result, ProofStatusExpired, nil
+	return result, ProofStatusValid, ProofStatusReasonNone, nil
+}
+
+// signingTime returns the time at which the signature was made according to its timestamp,
+// or the current time if it has no timestamp.
+func (sm *SignedMessage) signingTime() time.Time {
+	if sm.Timestamp == nil {
+		return time.Now()
 	}
+	return time.Unix(sm.Timestamp.Time, 0)
+}
 
-	// The attributes were valid, nonexpired, and the request was satisfied
-	return result, ProofStatusValid, nil
+// VerifySigWithRequest verifies the signed message against the signature request it was created for,
+// e.g. when both were stored by the requestor, returning for each disjunction of the request whether,
+// and with which attribute and value, it was satisfied (see DisjunctionResults()).
+// If the signature was created for another request, i.e. with another message or other conditions,
+// ProofStatusUnmatchedRequest is returned. Conditions are only bound into signatures created in
+// sessions of protocol version 2.5 and up (see SignatureRequest.GetNonce()); for older signatures
+// they are compared to the request included in the signed message, if any.
+func VerifySigWithRequest(configuration *Configuration, sig *SignedMessage, request *SignatureRequest) ([]*DisjunctionResult, ProofStatus, error) {
+	if request == nil {
+		return nil, ProofStatusInvalid, errors.New("No signature request specified")
+	}
+	if !sig.matchesConditions(request) {
+		return nil, ProofStatusUnmatchedRequest, nil
+	}
+	disclosed, status, err := sig.Verify(configuration, request)
+	return DisjunctionResults(request.Content, disclosed), status, err
+}
+
+// SignatureValidity describes the validity of an attribute-based signature in separate facets,
+// allowing the caller to apply its own policy, e.g. to decide whether a signature made with credentials
+// that have since expired is still valid.
+type SignatureValidity struct {
+	// Status and reason as returned by SignedMessage.VerifyWithReason(), except that the expiry
+	// of the credentials is not taken into account
+	Status    ProofStatus           `json:"status"`
+	Reason    ProofStatusReason     `json:"reason,omitempty"`
+	Disclosed []*DisclosedAttribute `json:"disclosed"`
+	// Whether the signature is cryptographically valid, has a valid timestamp if any, and matches
+	// the request if specified, i.e. whether Status is ProofStatusValid
+	Valid bool `json:"valid"`
+	// Whether the credentials of the signature were unexpired when it was made according to its
+	// timestamp; always false for signatures without timestamp
+	UnexpiredAtSigning bool `json:"unexpiredAtSigning"`
+	// Whether the credentials of the signature are unexpired at VerificationTime
+	UnexpiredNow bool `json:"unexpiredNow"`
+	// Time at which the signature was made according to its timestamp, if it has one
+	SigningTime *Timestamp `json:"signingTime,omitempty"`
+	// Time at which the signature was verified
+	VerificationTime Timestamp `json:"verificationTime"`
+	// Earliest expiry date of the credentials of the signature
+	Expires *Timestamp `json:"expires,omitempty"`
+}
+
+// VerifyValidity verifies the signed message, optionally against a signature request, reporting
+// its validity in separate facets instead of in one status; see SignatureValidity. The facets other
+// than Status, Reason and Disclosed are only set if the signature is valid.
+func (sm *SignedMessage) VerifyValidity(configuration *Configuration, request *SignatureRequest) (*SignatureValidity, error) {
+	if sm.IsDetached() && request == nil {
+		return nil, ErrorMissingDetachedMessage
+	}
+	now := time.Now()
+	disclosed, status, reason, err := sm.verifyProofs(context.Background(), configuration, request)
+	validity := &SignatureValidity{
+		Status:           status,
+		Reason:           reason,
+		Disclosed:        disclosed,
+		VerificationTime: Timestamp(now),
+	}
+	if status != ProofStatusValid || err != nil {
+		return validity, err
+	}
+
+	validity.Valid = true
+	validity.Expires = ProofList(sm.Signature).expiry(configuration)
+	acceptAll := ExpiryPolicy{AcceptExpired: true}
+	ProofList(sm.Signature).CheckExpiry(configuration, disclosed, sm.signingTime(), acceptAll)
+	if sm.Timestamp != nil {
+		signed := Timestamp(sm.signingTime())
+		validity.SigningTime = &signed
+		validity.UnexpiredAtSigning = validity.Expires == nil || !validity.Expires.Before(signed)
+	}
+	validity.UnexpiredNow = validity.Expires == nil || !validity.Expires.Before(Timestamp(now))
+	return validity, nil
 }
 
 // ExpiredError indicates that something (e.g. a JWT) has expired.
@@ -383,7 +1016,7 @@ func (e ExpiredError) Error() string {
 func ParseApiServerJwt(inputJwt string, signingKey *rsa.PublicKey) (map[AttributeTypeIdentifier]*DisclosedAttribute, error) {
 	claims := struct {
 		jwt.StandardClaims
-		Attributes map[AttributeTypeIdentifier]string `json:"attributes"`
+		Attributes map[AttributeTypeIdentifier]*string `json:"attributes"`
 	}{}
 	_, err := jwt.ParseWithClaims(inputJwt, claims, func(token *jwt.Token) (interface{}, error) {
 		return signingKey, nil
@@ -404,8 +1037,8 @@ func ParseApiServerJwt(inputJwt string, signingKey *rsa.PublicKey) (map[Attribut
 	for id, value := range claims.Attributes {
 		disclosedAttributes[id] = &DisclosedAttribute{
 			Identifier: id,
-			RawValue:   &value,
-			Value:      NewTranslatedString(&value),
+			RawValue:   value,
+			Value:      NewTranslatedString(value),
 			Status:     AttributeProofStatusPresent,
 		}
 	}